@@ -14,7 +14,9 @@ import (
 	"io"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/containerd/containerd/reference/docker"
 	"github.com/distribution/reference"
@@ -23,12 +25,17 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
 
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/backend"
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/build"
 	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/checker"
 	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/checker/rule"
 	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/chunkdict/generator"
 	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/committer"
 	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/converter"
 	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/copier"
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/doctor"
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/kms"
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/migrator"
 	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/packer"
 	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/provider"
 	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
@@ -43,6 +50,11 @@ var (
 
 var maxCacheMaxRecords uint = 200
 
+const (
+	minChunkSize = 0x1000
+	maxChunkSize = 0x1000000
+)
+
 const defaultLogLevel = logrus.InfoLevel
 
 func isPossibleValue(excepted []string, value string) bool {
@@ -97,6 +109,97 @@ func getBackendConfig(c *cli.Context, prefix string, required bool) (string, str
 	return backendType, backendConfig, nil
 }
 
+// getRegistryTimeouts parses the timeouts of manifest and blob requests to
+// registry formatted like 'manifest=30s' or 'blob=30m', the timeout unset
+// is zero which means no limitation.
+func getRegistryTimeouts(c *cli.Context) (time.Duration, time.Duration, error) {
+	var manifestTimeout, blobTimeout time.Duration
+	for _, value := range c.StringSlice("registry-timeout") {
+		kind, duration, ok := strings.Cut(value, "=")
+		timeout, err := time.ParseDuration(duration)
+		if !ok || err != nil || timeout < 0 {
+			return 0, 0, fmt.Errorf("--registry-timeout should be formatted like 'manifest=30s' or 'blob=30m'")
+		}
+		switch kind {
+		case "manifest":
+			manifestTimeout = timeout
+		case "blob":
+			blobTimeout = timeout
+		default:
+			return 0, 0, fmt.Errorf("--registry-timeout %s should be for manifest or blob requests", value)
+		}
+	}
+	return manifestTimeout, blobTimeout, nil
+}
+
+// getLayerCompressors parses the compressors overriding --compressor for
+// the source layers formatted like 'layer=compressor', the layer is the
+// index of layer in source manifest or the digest of layer, which are
+// validated by the provider.
+func getLayerCompressors(c *cli.Context) (map[string]string, error) {
+	compressors := map[string]string{}
+	for _, value := range c.StringSlice("layer-compressor") {
+		layer, compressor, ok := strings.Cut(value, "=")
+		if !ok || layer == "" || compressor == "" {
+			return nil, fmt.Errorf("--layer-compressor should be formatted like 'index=compressor' or 'digest=compressor'")
+		}
+		compressors[layer] = compressor
+	}
+	return compressors, nil
+}
+
+// getConcurrencyPerBackend parses the upload concurrency of storage backends
+// formatted like 'type=concurrency', for example 's3=16'.
+func getConcurrencyPerBackend(c *cli.Context) (map[string]int, error) {
+	possibleBackendTypes := []string{"oss", "s3"}
+	concurrency := map[string]int{}
+	for _, value := range c.StringSlice("concurrency-per-backend") {
+		backendType, limit, ok := strings.Cut(value, "=")
+		if !ok || !isPossibleValue(possibleBackendTypes, backendType) {
+			return nil, fmt.Errorf("--concurrency-per-backend should be formatted like 'type=concurrency', type should be one of %v", possibleBackendTypes)
+		}
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("--concurrency-per-backend %s should have a positive concurrency", value)
+		}
+		concurrency[backendType] = n
+	}
+	return concurrency, nil
+}
+
+// getUploadPartSize parses the multipart part size of storage backends, it
+// returns 0 for the default part size if unspecified. The part size is
+// validated by the limits of backend on creating backend.
+func getUploadPartSize(c *cli.Context) (int64, error) {
+	value := c.String("upload-part-size")
+	if value == "" {
+		return 0, nil
+	}
+	partSize, err := humanize.ParseBytes(value)
+	if err != nil || partSize == 0 {
+		return 0, fmt.Errorf("--upload-part-size %s should be a positive size like '64MiB'", value)
+	}
+	return int64(partSize), nil
+}
+
+// getBackendOptions returns the options of storage backend in type
+// backendType from the flags of backend mmap, concurrency and part size.
+func getBackendOptions(c *cli.Context, backendType string) (backend.Options, error) {
+	concurrency, err := getConcurrencyPerBackend(c)
+	if err != nil {
+		return backend.Options{}, err
+	}
+	partSize, err := getUploadPartSize(c)
+	if err != nil {
+		return backend.Options{}, err
+	}
+	return backend.Options{
+		Mmap:        c.Bool("backend-mmap"),
+		Concurrency: concurrency[backendType],
+		PartSize:    partSize,
+	}, nil
+}
+
 // Add suffix to source image reference as the target
 // image reference, like this:
 // Source: localhost:5000/nginx:latest
@@ -114,23 +217,29 @@ func addReferenceSuffix(source, suffix string) (string, error) {
 	return target, nil
 }
 
-func getTargetReference(c *cli.Context) (string, error) {
-	target := c.String("target")
+// getTargetReferences returns the target references, the first one is the
+// primary target, `--target` can be repeated to push to multiple targets.
+func getTargetReferences(c *cli.Context) ([]string, error) {
+	targets := c.StringSlice("target")
 	targetSuffix := c.String("target-suffix")
-	if target != "" && targetSuffix != "" {
-		return "", fmt.Errorf("--target conflicts with --target-suffix")
+	if len(targets) > 0 && targetSuffix != "" {
+		return nil, fmt.Errorf("--target conflicts with --target-suffix")
 	}
-	if target == "" && targetSuffix == "" {
-		return "", fmt.Errorf("--target or --target-suffix is required")
+	if len(targets) == 0 && targetSuffix == "" {
+		// The estimation doesn't push target image.
+		if c.Bool("estimate") {
+			return []string{""}, nil
+		}
+		return nil, fmt.Errorf("--target or --target-suffix is required")
 	}
-	var err error
 	if targetSuffix != "" {
-		target, err = addReferenceSuffix(c.String("source"), targetSuffix)
+		target, err := addReferenceSuffix(c.String("source"), targetSuffix)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
+		targets = []string{target}
 	}
-	return target, nil
+	return targets, nil
 }
 
 func getCacheReference(c *cli.Context, target string) (string, error) {
@@ -149,16 +258,61 @@ func getCacheReference(c *cli.Context, target string) (string, error) {
 	return cache, nil
 }
 
+// getChunkSize validates the chunk size specified by option, which should be
+// power of two and between 0x1000-0x1000000, and normalizes it to hex format.
+func getChunkSize(c *cli.Context, name string) (string, error) {
+	value := strings.TrimSpace(c.String(name))
+	if value == "" {
+		return "", nil
+	}
+	chunkSize, err := strconv.ParseUint(value, 0, 32)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid --%s option", name)
+	}
+	if chunkSize < minChunkSize || chunkSize > maxChunkSize || chunkSize&(chunkSize-1) != 0 {
+		return "", fmt.Errorf("--%s should be power of two and between 0x%x-0x%x", name, minChunkSize, maxChunkSize)
+	}
+	return fmt.Sprintf("0x%x", chunkSize), nil
+}
+
+// getPlatform extracts arch and variant from the --platform and
+// --platform-variant options.
+func getPlatform(c *cli.Context) (string, string, error) {
+	_, arch, variant, err := provider.ExtractPlatform(c.String("platform"))
+	if err != nil {
+		return "", "", err
+	}
+	if c.String("platform-variant") != "" {
+		variant = c.String("platform-variant")
+	}
+	return arch, variant, nil
+}
+
 func getPrefetchPatterns(c *cli.Context) (string, error) {
 	prefetchedDir := c.String("prefetch-dir")
 	prefetchPatterns := c.Bool("prefetch-patterns")
+	accessHints := c.String("access-hints")
 
 	if len(prefetchedDir) > 0 && prefetchPatterns {
 		return "", fmt.Errorf("--prefetch-dir conflicts with --prefetch-patterns")
 	}
+	if len(accessHints) > 0 && (len(prefetchedDir) > 0 || prefetchPatterns) {
+		return "", fmt.Errorf("--access-hints conflicts with --prefetch-dir and --prefetch-patterns")
+	}
 
 	var patterns string
 
+	if len(accessHints) > 0 {
+		file, err := os.Open(accessHints)
+		if err != nil {
+			return "", errors.Wrap(err, "open access hints")
+		}
+		defer file.Close()
+		if patterns, err = converter.ParseAccessHints(file); err != nil {
+			return "", errors.Wrapf(err, "parse access hints %s", accessHints)
+		}
+	}
+
 	if prefetchPatterns {
 		bytes, err := io.ReadAll(os.Stdin)
 		if err != nil {
@@ -207,6 +361,32 @@ func main() {
 			Usage:   "Set log level (panic, fatal, error, warn, info, debug, trace)",
 			EnvVars: []string{"LOG_LEVEL"},
 		},
+		&cli.BoolFlag{
+			Name:    "quiet",
+			Aliases: []string{"q"},
+			Value:   false,
+			Usage:   "Only print error logs, shorthand of '--log-level error'",
+			EnvVars: []string{"QUIET"},
+		},
+		&cli.BoolFlag{
+			Name:    "verbose",
+			Value:   false,
+			Usage:   "Print debug logs including the detail of each pulled and pushed content, shorthand of '--log-level debug'",
+			EnvVars: []string{"VERBOSE"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "layer-compression",
+			Usage:   "Map the custom layer media type to compression (none, gzip, zstd) for decompressing source layers, for example: 'application/vnd.custom.layer=gzip'",
+			EnvVars: []string{"LAYER_COMPRESSION"},
+		},
+	}
+	app.Before = func(c *cli.Context) error {
+		for _, mapping := range c.StringSlice("layer-compression") {
+			if err := utils.ParseLayerCompression(mapping); err != nil {
+				return errors.Wrap(err, "invalid --layer-compression option")
+			}
+		}
+		return nil
 	}
 
 	app.Commands = []*cli.Command{
@@ -220,10 +400,10 @@ func main() {
 					Usage:    "Source OCI image reference",
 					EnvVars:  []string{"SOURCE"},
 				},
-				&cli.StringFlag{
+				&cli.StringSliceFlag{
 					Name:     "target",
 					Required: false,
-					Usage:    "Target (Nydus) image reference",
+					Usage:    "Target (Nydus) image reference, can be repeated to push the image to multiple targets, the first one is the primary target",
 					EnvVars:  []string{"TARGET"},
 				},
 				&cli.StringFlag{
@@ -244,6 +424,30 @@ func main() {
 					Usage:    "Skip verifying server certs for HTTPS target registry",
 					EnvVars:  []string{"TARGET_INSECURE"},
 				},
+				&cli.StringFlag{
+					Name:    "source-auth",
+					Value:   "",
+					Usage:   "Credential in 'username:password' format to pull source image, overrides the docker config, e.g. a read-only credential",
+					EnvVars: []string{"SOURCE_AUTH"},
+				},
+				&cli.StringFlag{
+					Name:    "target-auth",
+					Value:   "",
+					Usage:   "Credential in 'username:password' format to push target image and build cache, overrides the docker config, even if the source is in the same registry",
+					EnvVars: []string{"TARGET_AUTH"},
+				},
+				&cli.StringFlag{
+					Name:    "source-socket",
+					Value:   "",
+					Usage:   "Access source registry through unix domain socket, e.g. 'unix:///run/registry.sock'",
+					EnvVars: []string{"SOURCE_SOCKET"},
+				},
+				&cli.StringFlag{
+					Name:    "target-socket",
+					Value:   "",
+					Usage:   "Access target registry through unix domain socket, e.g. 'unix:///run/registry.sock', the storage backend of --backend-type is still accessed over TCP",
+					EnvVars: []string{"TARGET_SOCKET"},
+				},
 
 				&cli.StringFlag{
 					Name:    "backend-type",
@@ -269,6 +473,13 @@ func main() {
 					Value: false, Usage: "Force to push Nydus blobs even if they already exist in storage backend",
 					EnvVars: []string{"BACKEND_FORCE_PUSH"},
 				},
+				&cli.StringFlag{
+					Name:      "backend-objects-output",
+					Value:     "",
+					TakesFile: true,
+					Usage:     "File path to save the list of Nydus blob objects (blob ID, size, object key) written to storage backend in JSON format, requires --backend-type",
+					EnvVars:   []string{"BACKEND_OBJECTS_OUTPUT"},
+				},
 
 				&cli.StringFlag{
 					Name:    "build-cache",
@@ -294,6 +505,42 @@ func main() {
 					Usage:    "Skip verifying server certs for HTTPS cache registry",
 					EnvVars:  []string{"BUILD_CACHE_INSECURE"},
 				},
+				&cli.StringFlag{
+					Name:    "build-cache-socket",
+					Value:   "",
+					Usage:   "Access cache registry through unix domain socket, e.g. 'unix:///run/registry.sock'",
+					EnvVars: []string{"BUILD_CACHE_SOCKET"},
+				},
+				&cli.StringFlag{
+					Name:    "build-cache-policy",
+					Value:   "merge",
+					Usage:   "Policy to push cache image, possible values: 'merge' (merge with the cache records pushed by concurrent conversions), 'overwrite'",
+					EnvVars: []string{"BUILD_CACHE_POLICY"},
+				},
+				&cli.StringFlag{
+					Name:    "build-cache-dir",
+					Value:   "",
+					Usage:   "Local directory to persist the pulled layers and built blobs between conversions for speeding up rebuilds, can't be shared by concurrent conversions",
+					EnvVars: []string{"BUILD_CACHE_DIR"},
+				},
+				&cli.BoolFlag{
+					Name:    "build-cache-readonly",
+					Value:   false,
+					Usage:   "Only use the cache image to skip building the cached layers, without pushing the cache records back",
+					EnvVars: []string{"BUILD_CACHE_READONLY"},
+				},
+				&cli.BoolFlag{
+					Name:    "no-cache",
+					Value:   false,
+					Usage:   "Rebuild all layers without reading or writing the cache image and the build cache directory",
+					EnvVars: []string{"NO_CACHE"},
+				},
+				&cli.BoolFlag{
+					Name:    "resume",
+					Value:   false,
+					Usage:   "Keep a per-layer checkpoint in work directory if the conversion fails or gets killed, and skip the layers pulled, built and pushed in checkpoint on restart",
+					EnvVars: []string{"RESUME"},
+				},
 				// The --build-cache-max-records flag represents the maximum number
 				// of layers in cache image. 200 (bootstrap + blob in one record) was
 				// chosen to make it compatible with the 127 max in graph driver of
@@ -318,6 +565,12 @@ func main() {
 					Usage:    "Skip verifying server certs for HTTPS dict registry",
 					EnvVars:  []string{"CHUNK_DICT_INSECURE"},
 				},
+				&cli.StringFlag{
+					Name:    "chunk-dict-socket",
+					Value:   "",
+					Usage:   "Access dict registry through unix domain socket, e.g. 'unix:///run/registry.sock'",
+					EnvVars: []string{"CHUNK_DICT_SOCKET"},
+				},
 
 				&cli.BoolFlag{
 					Name:    "merge-platform",
@@ -336,6 +589,16 @@ func main() {
 					Value: "linux/" + runtime.GOARCH,
 					Usage: "Convert images for specific platforms, for example: 'linux/amd64,linux/arm64'",
 				},
+				&cli.StringFlag{
+					Name:  "source-platform",
+					Value: "",
+					Usage: "Select the manifest of platform from source image index, or check the platform of single manifest source image, conflicts with --platform and --all-platforms",
+				},
+				&cli.StringFlag{
+					Name:  "target-platform",
+					Value: "",
+					Usage: "Set the platform in the config of target image, for example: 'linux/arm64'",
+				},
 				&cli.BoolFlag{
 					Name:    "oci-ref",
 					Value:   false,
@@ -348,6 +611,244 @@ func main() {
 					Usage:   "Associate a reference to the source image, see https://github.com/opencontainers/distribution-spec/blob/main/spec.md#listing-referrers",
 					EnvVars: []string{"WITH_REFERRER"},
 				},
+				&cli.StringSliceFlag{
+					Name:    "encrypt-recipients",
+					Usage:   "Encrypt the nydus bootstrap layers for the ocicrypt recipients, like 'jwe:/path/to/pubkey.pem', or 'provider:kms:<key-id>' to wrap the data keys by the master key in KMS with --kms-command, can be repeated",
+					EnvVars: []string{"ENCRYPT_RECIPIENTS"},
+				},
+				&cli.StringFlag{
+					Name:    "kms-command",
+					Usage:   "Command to access KMS for the 'provider:kms:<key-id>' recipients, invoked as '<command> encrypt|decrypt <key-id>' with the data key or wrapped key in stdin, and the result in stdout",
+					EnvVars: []string{"KMS_COMMAND"},
+				},
+				&cli.BoolFlag{
+					Name:    "harbor-accessory",
+					Value:   false,
+					Usage:   "Push the Nydus image as the accessory of source image in Harbor, the source manifest is pushed to the target repository if needed, implies --with-referrer",
+					EnvVars: []string{"HARBOR_ACCESSORY"},
+				},
+				&cli.BoolFlag{
+					Name:    "source-digest-label",
+					Value:   false,
+					Usage:   "Record the source manifest digest into the labels of Nydus image config, besides the annotation of Nydus manifest",
+					EnvVars: []string{"SOURCE_DIGEST_LABEL"},
+				},
+				&cli.BoolFlag{
+					Name:    "strip-history",
+					Value:   false,
+					Usage:   "Remove the history inherited from source image in Nydus image config, which may leak the build commands",
+					EnvVars: []string{"STRIP_HISTORY"},
+				},
+				&cli.BoolFlag{
+					Name:    "append-history",
+					Value:   false,
+					Usage:   "Append a history entry noting the Nydus conversion to Nydus image config",
+					EnvVars: []string{"APPEND_HISTORY"},
+				},
+				&cli.BoolFlag{
+					Name:    "skip-blob-push",
+					Value:   false,
+					Usage:   "Only push the Nydus manifest, config and bootstrap layer, the Nydus blob layers are uploaded to target repository separately and must exist before pushing",
+					EnvVars: []string{"SKIP_BLOB_PUSH"},
+				},
+				&cli.BoolFlag{
+					Name:    "check-blob-references",
+					Value:   false,
+					Usage:   "Check that every blob referenced by the Nydus bootstrap is pushed in target image or exists in storage backend, refuse to publish the manifest referencing a missing blob",
+					EnvVars: []string{"CHECK_BLOB_REFERENCES"},
+				},
+				&cli.StringFlag{
+					Name:    "existing-target-policy",
+					Value:   "overwrite",
+					Usage:   "Policy for the target tag existing before conversion, possible values: overwrite (always convert), skip (skip if converted from the same source, otherwise overwrite), error (skip if converted from the same source, otherwise fail)",
+					EnvVars: []string{"EXISTING_TARGET_POLICY"},
+				},
+				&cli.BoolFlag{
+					Name:    "check-push-permission",
+					Value:   false,
+					Usage:   "Check the push permission of target repository by a canceled blob upload before pulling and converting, to fail fast on missing permission",
+					EnvVars: []string{"CHECK_PUSH_PERMISSION"},
+				},
+				&cli.DurationFlag{
+					Name:    "max-source-age",
+					Usage:   "Refuse to convert the source image created earlier than the age like '720h' by the 'created' in image config, zero means no limitation",
+					EnvVars: []string{"MAX_SOURCE_AGE"},
+				},
+				&cli.StringFlag{
+					Name:    "mount-from",
+					Value:   "",
+					Usage:   "Repository on target registry to mount the existing blobs from instead of uploading them, e.g. registry.example.com/library/nginx, falls back to uploading if the registry refuses to mount",
+					EnvVars: []string{"MOUNT_FROM"},
+				},
+				&cli.StringFlag{
+					Name:    "mount-from-auth",
+					Value:   "",
+					Usage:   "Credential in 'username:password' format to mount the blobs from --mount-from, which is required to pull the mount repository and push the target, defaults to the credential of target",
+					EnvVars: []string{"MOUNT_FROM_AUTH"},
+				},
+				&cli.StringFlag{
+					Name:    "base-nydus",
+					Value:   "",
+					Usage:   "Nydus image converted from the base image of source with the same build options, the source layers shared with the base image reuse its Nydus blobs instead of converting, e.g. registry.example.com/library/ubuntu:nydus",
+					EnvVars: []string{"BASE_NYDUS"},
+				},
+				&cli.BoolFlag{
+					Name:    "reference-base-blobs",
+					Value:   false,
+					Usage:   "Reference the Nydus blobs of --base-nydus in registry by digest instead of fetching and pushing them again, only their bootstraps are read, the blobs are mounted from the repository of base image if missing in target repository",
+					EnvVars: []string{"REFERENCE_BASE_BLOBS"},
+				},
+				&cli.StringFlag{
+					Name:    "digest-algorithm",
+					Value:   "sha256",
+					Usage:   "Digest algorithm of the index, manifests, configs and bootstrap layers in Nydus image, possible values: sha256, sha512, the Nydus blobs are always digested by sha256",
+					EnvVars: []string{"DIGEST_ALGORITHM"},
+				},
+				&cli.StringFlag{
+					Name:    "layer-name-template",
+					Value:   "",
+					Usage:   "Go template to name the Nydus blob and bootstrap layers by annotation \"org.opencontainers.image.title\", with fields .Type (blob or bootstrap), .Digest, .ShortDigest, .Image and .Index, e.g. \"{{.Image}}-{{.Type}}-{{.ShortDigest}}\"",
+					EnvVars: []string{"LAYER_NAME_TEMPLATE"},
+				},
+				&cli.DurationFlag{
+					Name:    "dial-timeout",
+					Value:   30 * time.Second,
+					Usage:   "Timeout of establishing a connection to registry",
+					EnvVars: []string{"DIAL_TIMEOUT"},
+				},
+				&cli.DurationFlag{
+					Name:    "read-timeout",
+					Value:   0,
+					Usage:   "Timeout of each read from registry, a stalled transfer fails after the timeout, 0 means no limitation",
+					EnvVars: []string{"READ_TIMEOUT"},
+				},
+				&cli.StringSliceFlag{
+					Name:    "registry-timeout",
+					Usage:   "Timeout of each manifest or blob request to registry including the transfer, formatted like 'manifest=30s' or 'blob=30m', the blob transfer takes much longer than the manifest requests, unset means no limitation",
+					EnvVars: []string{"REGISTRY_TIMEOUT"},
+				},
+				&cli.UintFlag{
+					Name:    "min-concurrency",
+					Value:   1,
+					Usage:   "Minimum concurrency of pulling and pushing layers adapted by --max-concurrency",
+					EnvVars: []string{"MIN_CONCURRENCY"},
+				},
+				&cli.UintFlag{
+					Name:    "max-concurrency",
+					Value:   0,
+					Usage:   "Maximum concurrency of pulling and pushing layers, the concurrency is adapted to the latency and errors of registry between the minimum and maximum, 0 means the static concurrency",
+					EnvVars: []string{"MAX_CONCURRENCY"},
+				},
+				&cli.StringFlag{
+					Name:    "http-version",
+					Value:   "1.1",
+					Usage:   "HTTP version of registry transport, 1.1 or 2, HTTP/1.1 works with the registries having a buggy HTTP/2 implementation, while HTTP/2 multiplexes the requests on the connections kept alive",
+					EnvVars: []string{"HTTP_VERSION"},
+				},
+				&cli.UintFlag{
+					Name:    "http2-max-concurrent-streams",
+					Value:   0,
+					Usage:   "Maximum concurrent requests multiplexed to a registry host with --http-version 2, 0 means the limit of registry only",
+					EnvVars: []string{"HTTP2_MAX_CONCURRENT_STREAMS"},
+				},
+				&cli.StringFlag{
+					Name:    "blob-media-type",
+					Value:   "",
+					Usage:   "Override the media type of Nydus blob layers for the compatibility with specific snapshotter versions or registries, one of application/vnd.oci.image.layer.nydus.blob.v1, application/vnd.oci.image.layer.v1.tar and application/vnd.docker.image.rootfs.diff.tar",
+					EnvVars: []string{"BLOB_MEDIA_TYPE"},
+				},
+				&cli.StringFlag{
+					Name:    "manifest-format",
+					Value:   "",
+					Usage:   "Format of target manifest, 'oci' or 'docker' for the registries rejecting OCI manifests, the Nydus blob layers are kept, empty keeps the format of source image, 'docker' conflicts with --oci, --oci-ref, --with-referrer and --harbor-accessory",
+					EnvVars: []string{"MANIFEST_FORMAT"},
+				},
+				&cli.StringFlag{
+					Name:    "blob-order",
+					Value:   "",
+					Usage:   "Order of the Nydus blob layers in target manifest, empty keeps the order of conversion, 'digest' for the stable manifest digest, 'layer' follows the source layers, 'size' puts the largest blob first, 'access' puts the blobs with the most prefetched data first, the bootstrap layer is always the last",
+					EnvVars: []string{"BLOB_ORDER"},
+				},
+				&cli.StringFlag{
+					Name:    "artifact-type-policy",
+					Value:   "keep",
+					Usage:   "Policy for the artifactType declared by OCI source manifest, 'keep' preserves it in Nydus manifest, 'nydus' replaces it with application/vnd.nydus.image.v1",
+					EnvVars: []string{"ARTIFACT_TYPE_POLICY"},
+				},
+				&cli.BoolFlag{
+					Name:    "generate-sbom",
+					Value:   false,
+					Usage:   "Generate an SPDX SBOM of the packages (dpkg and apk) in source image, and push it as the OCI referrer of Nydus manifest",
+					EnvVars: []string{"GENERATE_SBOM"},
+				},
+				&cli.BoolFlag{
+					Name:    "lazy-index",
+					Value:   false,
+					Usage:   "Generate a lazy-loading index of the blobs and their chunk maps referenced by Nydus bootstrap, and push it as the OCI referrer of Nydus manifest to speed up the initial mount",
+					EnvVars: []string{"LAZY_INDEX"},
+				},
+				&cli.BoolFlag{
+					Name:    "file-manifest",
+					Value:   false,
+					Usage:   "Generate a manifest of the file paths and sizes in source image, and push it as the OCI referrer of Nydus manifest for tuning the prefetch",
+					EnvVars: []string{"FILE_MANIFEST"},
+				},
+				&cli.StringSliceFlag{
+					Name:    "exclude-path",
+					Usage:   "Remove the files matched by the glob of absolute path from the source layers before building, a matched directory is removed with its descendants, can be specified multiple times, for example: '/var/cache', '/etc/ssl/*.key'",
+					EnvVars: []string{"EXCLUDE_PATH"},
+				},
+				&cli.StringSliceFlag{
+					Name:    "include-glob",
+					Usage:   "Keep only the files matched by the globs in source layers before building, the glob matches the base name of file, or the absolute path of file if it contains a slash, the directories emptied are removed, can be specified multiple times, for example: '*.so', '/usr/bin/*'",
+					EnvVars: []string{"INCLUDE_GLOB"},
+				},
+				&cli.StringSliceFlag{
+					Name:    "exclude-glob",
+					Usage:   "Remove the files matched by the globs from source layers before building, the glob matches the base name of file, or the absolute path of file if it contains a slash, the directories emptied are removed, can be specified multiple times, for example: '*.debug', '/usr/share/doc/*/*'",
+					EnvVars: []string{"EXCLUDE_GLOB"},
+				},
+				&cli.IntFlag{
+					Name:    "normalize-uid",
+					Value:   -1,
+					Usage:   "Force the uid of the entries in source layers before building and remove the owner names, -1 keeps the uid",
+					EnvVars: []string{"NORMALIZE_UID"},
+				},
+				&cli.IntFlag{
+					Name:    "normalize-gid",
+					Value:   -1,
+					Usage:   "Force the gid of the entries in source layers before building and remove the group names, -1 keeps the gid",
+					EnvVars: []string{"NORMALIZE_GID"},
+				},
+				&cli.Int64Flag{
+					Name:    "normalize-mtime",
+					Value:   -1,
+					Usage:   "Clamp the modification time of the entries in source layers to the unix timestamp before building and remove the access and change times, e.g. $SOURCE_DATE_EPOCH, -1 keeps the times",
+					EnvVars: []string{"NORMALIZE_MTIME"},
+				},
+				&cli.BoolFlag{
+					Name:    "normalize-mode",
+					Value:   false,
+					Usage:   "Normalize the mode of directories and executable files to 0755 and the other entries except symlinks to 0644 in source layers before building",
+					EnvVars: []string{"NORMALIZE_MODE"},
+				},
+				&cli.StringSliceFlag{
+					Name:    "allowed-registries",
+					Usage:   "Refuse to convert if the source, target, build cache or chunk dict image is outside the allowed registry hosts, can be specified multiple times, for example: 'docker.io', 'localhost:5000'",
+					EnvVars: []string{"ALLOWED_REGISTRIES"},
+				},
+				&cli.StringFlag{
+					Name:    "notify-url",
+					Value:   "",
+					Usage:   "Post the reference and digest of target image in JSON to the URL after conversion, e.g. to trigger a node to prefetch the image, the failed post is retried",
+					EnvVars: []string{"NOTIFY_URL"},
+				},
+				&cli.StringFlag{
+					Name:    "event-output",
+					Value:   "",
+					Usage:   "Append the conversion lifecycle events (started, progress, layer-done, completed, failed) in JSON lines to the file, e.g. a named pipe consumed by a message queue producer",
+					EnvVars: []string{"EVENT_OUTPUT"},
+				},
 				&cli.BoolFlag{
 					Name:    "oci",
 					Value:   false,
@@ -391,16 +892,33 @@ func main() {
 					Usage:   "Read prefetch list from STDIN, please input absolute paths line by line",
 					EnvVars: []string{"PREFETCH_PATTERNS"},
 				},
+				&cli.StringFlag{
+					Name:    "access-hints",
+					Value:   "",
+					Usage:   "Prefetch the files in access hints file, the hot files are placed earlier in Nydus blob, each line is a path or an access count and a path (\"uniq -c\" output)",
+					EnvVars: []string{"ACCESS_HINTS"},
+				},
 				&cli.StringFlag{
 					Name:    "compressor",
 					Value:   "zstd",
-					Usage:   "Algorithm to compress image data blob, possible values: none, lz4_block, zstd",
+					Usage:   "Algorithm to compress image data blob, possible values: none, lz4_block, zstd, auto, 'auto' stores the layers whose data barely compresses uncompressed and compresses the others by zstd",
 					EnvVars: []string{"COMPRESSOR"},
 				},
+				&cli.StringSliceFlag{
+					Name:    "layer-compressor",
+					Usage:   "Compressor of a source layer overriding --compressor, formatted like 'index=compressor' or 'digest=compressor', the index of layer in source manifest starts from 0, possible compressors: none, lz4_block, zstd, can be repeated, for example: '2=none'",
+					EnvVars: []string{"LAYER_COMPRESSOR"},
+				},
+				&cli.StringFlag{
+					Name:    "bootstrap-compressor",
+					Value:   "",
+					Usage:   "Algorithm to compress image bootstrap layer, possible values: none, gzip, zstd, keep the gzip layer built if empty",
+					EnvVars: []string{"BOOTSTRAP_COMPRESSOR"},
+				},
 				&cli.StringFlag{
 					Name:    "fs-chunk-size",
 					Value:   "0x100000",
-					Usage:   "size of nydus image data chunk, must be power of two and between 0x1000-0x100000, [default: 0x100000]",
+					Usage:   "size of nydus image data chunk, must be power of two and between 0x1000-0x1000000, [default: 0x100000]",
 					EnvVars: []string{"FS_CHUNK_SIZE"},
 					Aliases: []string{"chunk-size"},
 				},
@@ -410,6 +928,54 @@ func main() {
 					Usage:   "size of batch data chunks, must be power of two, between 0x1000-0x1000000 or zero, [default: 0]",
 					EnvVars: []string{"BATCH_SIZE"},
 				},
+				&cli.StringFlag{
+					Name:    "max-blob-size",
+					Value:   "0",
+					Usage:   "Maximum size of a blob accepted by the target registry, e.g. '10GiB', the source layers are split to build the blobs smaller than it, abort conversion before pushing if still exceeded, e.g. by a single large file, 0 means no limitation",
+					EnvVars: []string{"MAX_BLOB_SIZE"},
+				},
+				&cli.StringFlag{
+					Name:    "max-disk-usage",
+					Value:   "0",
+					Usage:   "Maximum disk usage of work directory during conversion, e.g. '20GiB', pause pulling layers or abort conversion before exceeded, 0 means no limitation",
+					EnvVars: []string{"MAX_DISK_USAGE"},
+				},
+				&cli.StringFlag{
+					Name:    "small-image-threshold",
+					Value:   "0",
+					Usage:   "Batch the layers of source image into a single layer to build at once if they are smaller than the threshold in total, e.g. '16MiB', not applied with --build-cache or --base-nydus, 0 means disabled",
+					EnvVars: []string{"SMALL_IMAGE_THRESHOLD"},
+				},
+				&cli.UintFlag{
+					Name:    "max-concurrent-builds",
+					Value:   0,
+					Usage:   "Maximum number of source layers built concurrently by separate builder processes, the compression threads of each builder aren't limited, 0 means all layers of an image are built concurrently",
+					EnvVars: []string{"MAX_CONCURRENT_BUILDS"},
+				},
+				&cli.UintFlag{
+					Name:    "decompress-layers",
+					Value:   8,
+					Usage:   "Number of source layers decompressed at once by rewriting, splitting, batching and sampling the layers, the layers decompressed by the builders aren't limited",
+					EnvVars: []string{"DECOMPRESS_LAYERS"},
+				},
+				&cli.UintFlag{
+					Name:    "decompress-threads",
+					Value:   0,
+					Usage:   "Number of threads decompressing each zstd or gzip source layer by rewriting, splitting, batching and sampling the layers, gzip layers use the unpigz binary in PATH for more than 1 thread, 0 means the default of decompressor",
+					EnvVars: []string{"DECOMPRESS_THREADS"},
+				},
+				&cli.UintFlag{
+					Name:    "build-retries",
+					Value:   0,
+					Usage:   "Retry the conversion up to the times with backoff if the builder fails transiently, e.g. killed under memory pressure, the builder rejecting the source layers isn't retried",
+					EnvVars: []string{"BUILD_RETRIES"},
+				},
+				&cli.UintFlag{
+					Name:    "push-blob-retries",
+					Value:   0,
+					Usage:   "Retry the blobs failed to push up to the times after the other blobs are pushed, instead of failing the conversion on the first failed blob",
+					EnvVars: []string{"PUSH_BLOB_RETRIES"},
+				},
 				&cli.StringFlag{
 					Name:    "work-dir",
 					Value:   "./tmp",
@@ -425,17 +991,24 @@ func main() {
 				&cli.StringFlag{
 					Name:    "output-json",
 					Value:   "",
-					Usage:   "File path to save the metrics collected during conversion in JSON format, for example: './output.json'",
+					Usage:   "File path to save the versioned conversion result (target digest, layers, pushed bytes, cache hits, durations) in JSON format, for example: './output.json'",
 					EnvVars: []string{"OUTPUT_JSON"},
 				},
+				&cli.BoolFlag{
+					Name:    "estimate",
+					Value:   false,
+					Usage:   "Estimate the size of Nydus blobs and bootstrap converted from source image by --fs-version, --compressor and --chunk-size without building or pushing, the estimates are saved to --output-json if specified, --target isn't required",
+					EnvVars: []string{"ESTIMATE"},
+				},
 			},
 			Action: func(c *cli.Context) error {
 				setupLogLevel(c)
 
-				targetRef, err := getTargetReference(c)
+				targetRefs, err := getTargetReferences(c)
 				if err != nil {
 					return err
 				}
+				targetRef := targetRefs[0]
 
 				backendType, backendConfig, err := getBackendConfig(c, "", false)
 				if err != nil {
@@ -446,6 +1019,9 @@ func main() {
 				if err != nil {
 					return err
 				}
+				if c.Uint("decompress-layers") < 1 {
+					return fmt.Errorf("--decompress-layers should be greater than 0")
+				}
 				cacheMaxRecords := c.Uint("build-cache-max-records")
 				if cacheMaxRecords < 1 {
 					return fmt.Errorf("--build-cache-max-records should be greater than 0")
@@ -453,7 +1029,19 @@ func main() {
 				if cacheMaxRecords > maxCacheMaxRecords {
 					return fmt.Errorf("--build-cache-max-records should not be greater than %d", maxCacheMaxRecords)
 				}
+				if maxConcurrency := c.Uint("max-concurrency"); maxConcurrency > 0 && c.Uint("min-concurrency") > maxConcurrency {
+					return fmt.Errorf("--min-concurrency should not be greater than --max-concurrency")
+				}
+				possibleHTTPVersions := []string{"1.1", "2"}
+				if !isPossibleValue(possibleHTTPVersions, c.String("http-version")) {
+					return fmt.Errorf("--http-version should be one of %v", possibleHTTPVersions)
+				}
 				cacheVersion := c.String("build-cache-version")
+				cachePolicy := c.String("build-cache-policy")
+				possibleCachePolicies := []string{"merge", "overwrite"}
+				if !isPossibleValue(possibleCachePolicies, cachePolicy) {
+					return fmt.Errorf("--build-cache-policy should be one of %v", possibleCachePolicies)
+				}
 
 				fsVersion := c.String("fs-version")
 				possibleFsVersions := []string{"5", "6"}
@@ -466,6 +1054,79 @@ func main() {
 					return err
 				}
 
+				chunkSize, err := getChunkSize(c, "chunk-size")
+				if err != nil {
+					return err
+				}
+
+				maxBlobSize, err := humanize.ParseBytes(c.String("max-blob-size"))
+				if err != nil {
+					return errors.Wrap(err, "invalid --max-blob-size option")
+				}
+
+				maxDiskUsage, err := humanize.ParseBytes(c.String("max-disk-usage"))
+				if err != nil {
+					return errors.Wrap(err, "invalid --max-disk-usage option")
+				}
+
+				manifestTimeout, blobTimeout, err := getRegistryTimeouts(c)
+				if err != nil {
+					return err
+				}
+
+				layerCompressors, err := getLayerCompressors(c)
+				if err != nil {
+					return err
+				}
+
+				smallImageThreshold, err := humanize.ParseBytes(c.String("small-image-threshold"))
+				if err != nil {
+					return errors.Wrap(err, "invalid --small-image-threshold option")
+				}
+
+				if c.String("manifest-format") == "docker" && (c.Bool("oci") || c.Bool("oci-ref") || c.Bool("with-referrer") || c.Bool("harbor-accessory")) {
+					return fmt.Errorf("--manifest-format docker conflicts with --oci, --oci-ref, --with-referrer and --harbor-accessory")
+				}
+
+				if c.Bool("harbor-accessory") && c.Bool("merge-platform") {
+					return fmt.Errorf("--harbor-accessory conflicts with --merge-platform")
+				}
+
+				if c.String("source-platform") != "" && (c.Bool("all-platforms") || c.IsSet("platform")) {
+					return fmt.Errorf("--source-platform conflicts with --platform and --all-platforms")
+				}
+
+				if c.String("backend-objects-output") != "" && backendType == "" {
+					return fmt.Errorf("--backend-objects-output requires --backend-type")
+				}
+
+				if c.Bool("reference-base-blobs") && c.String("base-nydus") == "" {
+					return fmt.Errorf("--reference-base-blobs requires --base-nydus")
+				}
+
+				if c.String("mount-from-auth") != "" && c.String("mount-from") == "" {
+					return fmt.Errorf("--mount-from-auth requires --mount-from")
+				}
+
+				historyComment := ""
+				if c.Bool("append-history") {
+					historyComment = fmt.Sprintf("converted to Nydus image by nydusify %s", gitVersion)
+				}
+
+				var publisher converter.Publisher
+				if eventOutput := c.String("event-output"); eventOutput != "" {
+					file, err := os.OpenFile(eventOutput, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+					if err != nil {
+						return errors.Wrap(err, "open event output")
+					}
+					defer file.Close()
+					publisher = converter.NewWriterPublisher(file)
+				}
+
+				tarNormalization := converter.ParseTarNormalization(
+					c.Int("normalize-uid"), c.Int("normalize-gid"), c.Int64("normalize-mtime"), c.Bool("normalize-mode"),
+				)
+
 				chunkDictRef := ""
 				chunkDict := c.String("chunk-dict")
 				if chunkDict != "" {
@@ -489,14 +1150,26 @@ func main() {
 					docker2OCI = true
 				}
 
+				var kmsClient kms.KMS
+				if c.String("kms-command") != "" {
+					if kmsClient, err = kms.NewCommandKMS(c.String("kms-command")); err != nil {
+						return err
+					}
+				}
+
 				opt := converter.Opt{
 					WorkDir:        c.String("work-dir"),
 					NydusImagePath: c.String("nydus-image"),
 
 					Source:         c.String("source"),
 					Target:         targetRef,
+					ExtraTargets:   targetRefs[1:],
 					SourceInsecure: c.Bool("source-insecure"),
 					TargetInsecure: c.Bool("target-insecure"),
+					SourceAuth:     c.String("source-auth"),
+					TargetAuth:     c.String("target-auth"),
+					SourceSocket:   c.String("source-socket"),
+					TargetSocket:   c.String("target-socket"),
 
 					BackendType:      backendType,
 					BackendConfig:    backendConfig,
@@ -504,11 +1177,18 @@ func main() {
 
 					CacheRef:        cacheRef,
 					CacheInsecure:   c.Bool("build-cache-insecure"),
+					CacheSocket:     c.String("build-cache-socket"),
 					CacheMaxRecords: cacheMaxRecords,
 					CacheVersion:    cacheVersion,
+					CachePolicy:     cachePolicy,
+					BuildCacheDir:   c.String("build-cache-dir"),
+					NoCache:         c.Bool("no-cache"),
+					CacheReadOnly:   c.Bool("build-cache-readonly"),
+					Resume:          c.Bool("resume"),
 
 					ChunkDictRef:      chunkDictRef,
 					ChunkDictInsecure: c.Bool("chunk-dict-insecure"),
+					ChunkDictSocket:   c.String("chunk-dict-socket"),
 
 					PrefetchPatterns: prefetchPatterns,
 					MergePlatform:    c.Bool("merge-platform"),
@@ -516,17 +1196,81 @@ func main() {
 					FsVersion:        fsVersion,
 					FsAlignChunk:     c.Bool("backend-aligned-chunk") || c.Bool("fs-align-chunk"),
 					Compressor:       c.String("compressor"),
-					ChunkSize:        c.String("chunk-size"),
+					ChunkSize:        chunkSize,
 					BatchSize:        c.String("batch-size"),
+					MaxBlobSize:      int64(maxBlobSize),
+					MaxDiskUsage:     int64(maxDiskUsage),
+
+					LayerCompressors:    layerCompressors,
+					BootstrapCompressor: c.String("bootstrap-compressor"),
+
+					SmallImageThreshold: int64(smallImageThreshold),
+					MaxConcurrentBuilds: int(c.Uint("max-concurrent-builds")),
+					DecompressLayers:    int(c.Uint("decompress-layers")),
+					DecompressThreads:   int(c.Uint("decompress-threads")),
+					BuildRetries:        int(c.Uint("build-retries")),
+					PushBlobRetries:     int(c.Uint("push-blob-retries")),
 
 					OCIRef:       c.Bool("oci-ref"),
 					WithReferrer: c.Bool("with-referrer"),
 					AllPlatforms: c.Bool("all-platforms"),
 					Platforms:    c.String("platform"),
 
+					SourcePlatform: c.String("source-platform"),
+					TargetPlatform: c.String("target-platform"),
+
+					HarborAccessory:    c.Bool("harbor-accessory"),
+					EncryptRecipients:  c.StringSlice("encrypt-recipients"),
+					KMS:                kmsClient,
+					SourceDigestLabel:  c.Bool("source-digest-label"),
+					StripHistory:       c.Bool("strip-history"),
+					HistoryComment:     historyComment,
+					SkipBlobPush:       c.Bool("skip-blob-push"),
+					MountFrom:          c.String("mount-from"),
+					MountFromAuth:      c.String("mount-from-auth"),
+					BaseNydus:          c.String("base-nydus"),
+					ReferenceBaseBlobs: c.Bool("reference-base-blobs"),
+					DigestAlgorithm:    c.String("digest-algorithm"),
+					LayerNameTemplate:  c.String("layer-name-template"),
+					DialTimeout:        c.Duration("dial-timeout"),
+					ReadTimeout:        c.Duration("read-timeout"),
+					ManifestTimeout:    manifestTimeout,
+					BlobTimeout:        blobTimeout,
+					MinConcurrency:     int(c.Uint("min-concurrency")),
+					MaxConcurrency:     int(c.Uint("max-concurrency")),
+					BlobMediaType:      c.String("blob-media-type"),
+					ManifestFormat:     c.String("manifest-format"),
+					BlobOrder:          c.String("blob-order"),
+					GenerateSBOM:       c.Bool("generate-sbom"),
+					LazyIndex:          c.Bool("lazy-index"),
+					FileManifest:       c.Bool("file-manifest"),
+					ExcludePaths:       c.StringSlice("exclude-path"),
+					IncludeGlobs:       c.StringSlice("include-glob"),
+					ExcludeGlobs:       c.StringSlice("exclude-glob"),
+					TarNormalization:   tarNormalization,
+					AllowedRegistries:  c.StringSlice("allowed-registries"),
+					NotifyURL:          c.String("notify-url"),
+					Publisher:          publisher,
+
+					HTTPVersion:               c.String("http-version"),
+					HTTP2MaxConcurrentStreams: uint32(c.Uint("http2-max-concurrent-streams")),
+
+					ExistingTargetPolicy: c.String("existing-target-policy"),
+					CheckPushPermission:  c.Bool("check-push-permission"),
+					CheckBlobReferences:  c.Bool("check-blob-references"),
+					MaxSourceAge:         c.Duration("max-source-age"),
+					ArtifactTypePolicy:   c.String("artifact-type-policy"),
+
+					BackendObjectsOutput: c.String("backend-objects-output"),
+
 					OutputJSON: c.String("output-json"),
 				}
 
+				if c.Bool("estimate") {
+					_, err := converter.EstimateSize(context.Background(), opt)
+					return err
+				}
+
 				return converter.Convert(context.Background(), opt)
 			},
 		},
@@ -571,76 +1315,292 @@ func main() {
 					Usage:   "Json string for storage backend configuration",
 					EnvVars: []string{"BACKEND_CONFIG"},
 				},
-				&cli.PathFlag{
-					Name:      "backend-config-file",
-					Value:     "",
-					TakesFile: true,
-					Usage:     "Json configuration file for storage backend",
-					EnvVars:   []string{"BACKEND_CONFIG_FILE"},
+				&cli.PathFlag{
+					Name:      "backend-config-file",
+					Value:     "",
+					TakesFile: true,
+					Usage:     "Json configuration file for storage backend",
+					EnvVars:   []string{"BACKEND_CONFIG_FILE"},
+				},
+
+				&cli.BoolFlag{
+					Name:    "multi-platform",
+					Value:   false,
+					Usage:   "Verify that the image contains an image index with both OCI and Nydus manifests",
+					EnvVars: []string{"MULTI_PLATFORM"},
+				},
+				&cli.StringFlag{
+					Name:  "platform",
+					Value: "linux/" + runtime.GOARCH,
+					Usage: "Specify platform identifier to choose image manifest, possible values: 'linux/amd64' and 'linux/arm64'",
+				},
+				&cli.StringFlag{
+					Name:  "platform-variant",
+					Value: "",
+					Usage: "Specify platform variant to choose image manifest, for example: 'v7' for 'linux/arm', overrides the variant in --platform",
+				},
+
+				&cli.StringFlag{
+					Name:    "work-dir",
+					Value:   "./output",
+					Usage:   "Working directory for image verification",
+					EnvVars: []string{"WORK_DIR"},
+				},
+				&cli.StringFlag{
+					Name:    "nydus-image",
+					Value:   "nydus-image",
+					Usage:   "Path to the nydus-image binary, default to search in PATH",
+					EnvVars: []string{"NYDUS_IMAGE"},
+				},
+				&cli.StringFlag{
+					Name:    "nydusd",
+					Value:   "nydusd",
+					Usage:   "Path to the nydusd binary, default to search in PATH",
+					EnvVars: []string{"NYDUSD"},
+				},
+				&cli.UintFlag{
+					Name:    "decompress-layers",
+					Value:   8,
+					Usage:   "Number of source layers pulled and decompressed at once",
+					EnvVars: []string{"DECOMPRESS_LAYERS"},
+				},
+				&cli.UintFlag{
+					Name:    "decompress-threads",
+					Value:   0,
+					Usage:   "Number of threads decompressing each zstd or gzip source layer, gzip layers use the unpigz binary in PATH for more than 1 thread, 0 means the default of decompressor",
+					EnvVars: []string{"DECOMPRESS_THREADS"},
+				},
+			},
+			Action: func(c *cli.Context) error {
+				setupLogLevel(c)
+
+				backendType, backendConfig, err := getBackendConfig(c, "", false)
+				if err != nil {
+					return err
+				}
+
+				if c.Uint("decompress-layers") < 1 {
+					return fmt.Errorf("--decompress-layers should be greater than 0")
+				}
+
+				arch, variant, err := getPlatform(c)
+				if err != nil {
+					return err
+				}
+
+				checker, err := checker.New(checker.Opt{
+					WorkDir:         c.String("work-dir"),
+					Source:          c.String("source"),
+					Target:          c.String("target"),
+					MultiPlatform:   c.Bool("multi-platform"),
+					SourceInsecure:  c.Bool("source-insecure"),
+					TargetInsecure:  c.Bool("target-insecure"),
+					NydusImagePath:  c.String("nydus-image"),
+					NydusdPath:      c.String("nydusd"),
+					BackendType:     backendType,
+					BackendConfig:   backendConfig,
+					ExpectedArch:    arch,
+					ExpectedVariant: variant,
+
+					DecompressLayers:  c.Uint("decompress-layers"),
+					DecompressThreads: int(c.Uint("decompress-threads")),
+				})
+				if err != nil {
+					return err
+				}
+
+				return checker.Check(context.Background())
+			},
+		},
+		{
+			Name:  "doctor",
+			Usage: "Validate the toolchain and environment required by image conversion",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:    "target",
+					Value:   "",
+					Usage:   "Target (Nydus) image reference, enable verification of registry access and push permission if specified",
+					EnvVars: []string{"TARGET"},
+				},
+				&cli.BoolFlag{
+					Name:     "target-insecure",
+					Required: false,
+					Usage:    "Skip verifying server certs for HTTPS target registry",
+					EnvVars:  []string{"TARGET_INSECURE"},
+				},
+
+				&cli.StringFlag{
+					Name:    "backend-type",
+					Value:   "",
+					Usage:   "Type of storage backend, enable verification of backend access if specified, possible values: 'oss', 's3'",
+					EnvVars: []string{"BACKEND_TYPE"},
+				},
+				&cli.StringFlag{
+					Name:    "backend-config",
+					Value:   "",
+					Usage:   "Json string for storage backend configuration",
+					EnvVars: []string{"BACKEND_CONFIG"},
+				},
+				&cli.PathFlag{
+					Name:      "backend-config-file",
+					Value:     "",
+					TakesFile: true,
+					Usage:     "Json configuration file for storage backend",
+					EnvVars:   []string{"BACKEND_CONFIG_FILE"},
+				},
+
+				&cli.StringFlag{
+					Name:    "work-dir",
+					Value:   "./tmp",
+					Usage:   "Working directory for image conversion",
+					EnvVars: []string{"WORK_DIR"},
+				},
+				&cli.StringFlag{
+					Name:    "nydus-image",
+					Value:   "nydus-image",
+					Usage:   "Path to the nydus-image binary, default to search in PATH",
+					EnvVars: []string{"NYDUS_IMAGE"},
+				},
+				&cli.StringFlag{
+					Name:    "min-nydus-image-version",
+					Value:   "",
+					Usage:   "Minimal required version of the nydus-image binary, e.g. 'v2.2.0'",
+					EnvVars: []string{"MIN_NYDUS_IMAGE_VERSION"},
+				},
+				&cli.StringFlag{
+					Name:    "output-json",
+					Value:   "",
+					Usage:   "File path to save the check results",
+					EnvVars: []string{"OUTPUT_JSON"},
+				},
+			},
+			Action: func(c *cli.Context) error {
+				setupLogLevel(c)
+
+				backendType, backendConfig, err := getBackendConfig(c, "", false)
+				if err != nil {
+					return err
+				}
+
+				results := doctor.New(doctor.Opt{
+					WorkDir:           c.String("work-dir"),
+					NydusImagePath:    c.String("nydus-image"),
+					MinBuilderVersion: c.String("min-nydus-image-version"),
+					Target:            c.String("target"),
+					TargetInsecure:    c.Bool("target-insecure"),
+					BackendType:       backendType,
+					BackendConfig:     backendConfig,
+				}).Run(context.Background())
+
+				if err := doctor.Report(os.Stdout, results); err != nil {
+					return err
+				}
+				if outputJSON := c.String("output-json"); outputJSON != "" {
+					data, err := json.MarshalIndent(results, "", "  ")
+					if err != nil {
+						return errors.Wrap(err, "marshal check results")
+					}
+					if err := os.WriteFile(outputJSON, data, 0644); err != nil {
+						return errors.Wrap(err, "write check results")
+					}
+				}
+				if !doctor.Passed(results) {
+					return errors.New("some checks failed")
+				}
+
+				return nil
+			},
+		},
+		{
+			Name:      "prefetch-source",
+			Usage:     "Pull source images into the build cache directory without conversion, for speeding up the subsequent conversions",
+			ArgsUsage: "SOURCE [SOURCE...]",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "build-cache-dir",
+					Required: true,
+					Usage:    "Local directory to persist the pulled layers, the same as '--build-cache-dir' of the subsequent conversions",
+					EnvVars:  []string{"BUILD_CACHE_DIR"},
+				},
+				&cli.BoolFlag{
+					Name:     "source-insecure",
+					Required: false,
+					Usage:    "Skip verifying server certs for HTTPS source registry",
+					EnvVars:  []string{"SOURCE_INSECURE"},
+				},
+				&cli.StringFlag{
+					Name:    "source-auth",
+					Value:   "",
+					Usage:   "Credential in 'username:password' format to pull source image, overrides the docker config",
+					EnvVars: []string{"SOURCE_AUTH"},
 				},
-
 				&cli.BoolFlag{
-					Name:    "multi-platform",
-					Value:   false,
-					Usage:   "Verify that the image contains an image index with both OCI and Nydus manifests",
-					EnvVars: []string{"MULTI_PLATFORM"},
+					Name:  "all-platforms",
+					Value: false,
+					Usage: "Pull images for all platforms, conflicts with --platform",
 				},
 				&cli.StringFlag{
 					Name:  "platform",
 					Value: "linux/" + runtime.GOARCH,
-					Usage: "Specify platform identifier to choose image manifest, possible values: 'linux/amd64' and 'linux/arm64'",
+					Usage: "Pull images for specific platforms, for example: 'linux/amd64,linux/arm64'",
 				},
-
-				&cli.StringFlag{
-					Name:    "work-dir",
-					Value:   "./output",
-					Usage:   "Working directory for image verification",
-					EnvVars: []string{"WORK_DIR"},
+				&cli.StringSliceFlag{
+					Name:    "allowed-registries",
+					Usage:   "Refuse to pull if the source image is outside the allowed registry hosts, can be specified multiple times, for example: 'docker.io', 'localhost:5000'",
+					EnvVars: []string{"ALLOWED_REGISTRIES"},
+				},
+				&cli.DurationFlag{
+					Name:    "dial-timeout",
+					Value:   30 * time.Second,
+					Usage:   "Timeout of establishing a connection to registry",
+					EnvVars: []string{"DIAL_TIMEOUT"},
+				},
+				&cli.DurationFlag{
+					Name:    "read-timeout",
+					Value:   0,
+					Usage:   "Timeout of each read from registry, a stalled transfer fails after the timeout, 0 means no limitation",
+					EnvVars: []string{"READ_TIMEOUT"},
 				},
-				&cli.StringFlag{
-					Name:    "nydus-image",
-					Value:   "nydus-image",
-					Usage:   "Path to the nydus-image binary, default to search in PATH",
-					EnvVars: []string{"NYDUS_IMAGE"},
+				&cli.StringSliceFlag{
+					Name:    "registry-timeout",
+					Usage:   "Timeout of each manifest or blob request to registry including the transfer, formatted like 'manifest=30s' or 'blob=30m', unset means no limitation",
+					EnvVars: []string{"REGISTRY_TIMEOUT"},
 				},
 				&cli.StringFlag{
-					Name:    "nydusd",
-					Value:   "nydusd",
-					Usage:   "Path to the nydusd binary, default to search in PATH",
-					EnvVars: []string{"NYDUSD"},
+					Name:    "work-dir",
+					Value:   "./tmp",
+					Usage:   "Working directory for pulling images",
+					EnvVars: []string{"WORK_DIR"},
 				},
 			},
 			Action: func(c *cli.Context) error {
 				setupLogLevel(c)
 
-				backendType, backendConfig, err := getBackendConfig(c, "", false)
-				if err != nil {
-					return err
+				sources := c.Args().Slice()
+				if len(sources) == 0 {
+					return errors.New("at least one source image reference is required")
 				}
 
-				_, arch, err := provider.ExtractOsArch(c.String("platform"))
+				manifestTimeout, blobTimeout, err := getRegistryTimeouts(c)
 				if err != nil {
 					return err
 				}
 
-				checker, err := checker.New(checker.Opt{
+				return converter.PrefetchSources(context.Background(), converter.Opt{
 					WorkDir:        c.String("work-dir"),
-					Source:         c.String("source"),
-					Target:         c.String("target"),
-					MultiPlatform:  c.Bool("multi-platform"),
+					BuildCacheDir:  c.String("build-cache-dir"),
 					SourceInsecure: c.Bool("source-insecure"),
-					TargetInsecure: c.Bool("target-insecure"),
-					NydusImagePath: c.String("nydus-image"),
-					NydusdPath:     c.String("nydusd"),
-					BackendType:    backendType,
-					BackendConfig:  backendConfig,
-					ExpectedArch:   arch,
-				})
-				if err != nil {
-					return err
-				}
+					SourceAuth:     c.String("source-auth"),
 
-				return checker.Check(context.Background())
+					AllPlatforms: c.Bool("all-platforms"),
+					Platforms:    c.String("platform"),
+
+					DialTimeout:       c.Duration("dial-timeout"),
+					ReadTimeout:       c.Duration("read-timeout"),
+					ManifestTimeout:   manifestTimeout,
+					BlobTimeout:       blobTimeout,
+					AllowedRegistries: c.StringSlice("allowed-registries"),
+				}, sources)
 			},
 		},
 		{
@@ -680,21 +1640,27 @@ func main() {
 							Value: "linux/" + runtime.GOARCH,
 							Usage: "Specify platform identifier to choose image manifest, possible values: 'linux/amd64' and 'linux/arm64'",
 						},
+						&cli.StringFlag{
+							Name:  "platform-variant",
+							Value: "",
+							Usage: "Specify platform variant to choose image manifest, for example: 'v7' for 'linux/arm', overrides the variant in --platform",
+						},
 					},
 					Action: func(c *cli.Context) error {
 						setupLogLevel(c)
 
-						_, arch, err := provider.ExtractOsArch(c.String("platform"))
+						arch, variant, err := getPlatform(c)
 						if err != nil {
 							return err
 						}
 
 						generator, err := generator.New(generator.Opt{
-							WorkDir:        c.String("work-dir"),
-							Sources:        c.StringSlice("sources"),
-							SourceInsecure: c.Bool("source-insecure"),
-							NydusImagePath: c.String("nydus-image"),
-							ExpectedArch:   arch,
+							WorkDir:         c.String("work-dir"),
+							Sources:         c.StringSlice("sources"),
+							SourceInsecure:  c.Bool("source-insecure"),
+							NydusImagePath:  c.String("nydus-image"),
+							ExpectedArch:    arch,
+							ExpectedVariant: variant,
 						})
 						if err != nil {
 							return err
@@ -755,6 +1721,11 @@ func main() {
 					Value: "linux/" + runtime.GOARCH,
 					Usage: "Specify platform identifier to choose image manifest, possible values: 'linux/amd64' and 'linux/arm64'",
 				},
+				&cli.StringFlag{
+					Name:  "platform-variant",
+					Value: "",
+					Usage: "Specify platform variant to choose image manifest, for example: 'v7' for 'linux/arm', overrides the variant in --platform",
+				},
 
 				&cli.StringFlag{
 					Name:    "work-dir",
@@ -798,20 +1769,21 @@ func main() {
 
 				}
 
-				_, arch, err := provider.ExtractOsArch(c.String("platform"))
+				arch, variant, err := getPlatform(c)
 				if err != nil {
 					return err
 				}
 
 				fsViewer, err := viewer.New(viewer.Opt{
-					WorkDir:        c.String("work-dir"),
-					Target:         c.String("target"),
-					TargetInsecure: c.Bool("target-insecure"),
-					MountPath:      c.String("mount-path"),
-					NydusdPath:     c.String("nydusd"),
-					BackendType:    backendType,
-					BackendConfig:  backendConfig,
-					ExpectedArch:   arch,
+					WorkDir:         c.String("work-dir"),
+					Target:          c.String("target"),
+					TargetInsecure:  c.Bool("target-insecure"),
+					MountPath:       c.String("mount-path"),
+					NydusdPath:      c.String("nydusd"),
+					BackendType:     backendType,
+					BackendConfig:   backendConfig,
+					ExpectedArch:    arch,
+					ExpectedVariant: variant,
 				})
 				if err != nil {
 					return err
@@ -829,7 +1801,7 @@ func main() {
 					Name:     "source-dir",
 					Aliases:  []string{"target-dir"}, // for compatibility
 					Required: true,
-					Usage:    "Source directory to build Nydus filesystem from",
+					Usage:    "Source directory to build Nydus filesystem from, or '-' to read a single layer tar (gzip) stream from stdin",
 					EnvVars:  []string{"SOURCE_DIR"},
 				},
 				&cli.StringFlag{
@@ -872,6 +1844,22 @@ func main() {
 					Usage:     "Json configuration file for storage backend",
 					EnvVars:   []string{"BACKEND_CONFIG_FILE"},
 				},
+				&cli.BoolFlag{
+					Name:    "backend-mmap",
+					Value:   false,
+					Usage:   "Read the built blob file by mmap when pushing to storage backend, fall back to normal reading if unsupported",
+					EnvVars: []string{"BACKEND_MMAP"},
+				},
+				&cli.StringSliceFlag{
+					Name:    "concurrency-per-backend",
+					Usage:   "Override the number of blob parts uploaded concurrently for a backend type formatted like 'type=concurrency', can be repeated, the 'concurrency' in backend config takes precedence",
+					EnvVars: []string{"CONCURRENCY_PER_BACKEND"},
+				},
+				&cli.StringFlag{
+					Name:    "upload-part-size",
+					Usage:   "Size of the blob parts uploaded by multipart to storage backend like '64MiB', default to 200MiB, should be at least 5MiB for 's3' and 100KiB for 'oss', the 'part_size' in backend config takes precedence",
+					EnvVars: []string{"UPLOAD_PART_SIZE"},
+				},
 
 				&cli.StringFlag{
 					Name:    "chunk-dict",
@@ -914,9 +1902,26 @@ func main() {
 				&cli.StringFlag{
 					Name:    "chunk-size",
 					Value:   "0x100000",
-					Usage:   "size of nydus image data chunk, must be power of two and between 0x1000-0x100000, [default: 0x100000]",
+					Usage:   "size of nydus image data chunk, must be power of two and between 0x1000-0x1000000, [default: 0x100000]",
 					EnvVars: []string{"CHUNK_SIZE"},
 				},
+				&cli.BoolFlag{
+					Name:    "keep-unpacked-source-dir",
+					Value:   false,
+					Usage:   "Keep the directory unpacked from the source tar stream of '--source-dir -' after building, and log its path, for debugging packing issues, it has no effect on '--source-dir <dir>' which isn't unpacked",
+					EnvVars: []string{"KEEP_UNPACKED_SOURCE_DIR"},
+				},
+				&cli.StringFlag{
+					Name:    "whiteout-policy",
+					Value:   utils.WhiteoutPolicyPreserve,
+					Usage:   "Policy translating the whiteouts of the source tar stream of '--source-dir -', 'preserve' keeps the OCI whiteouts, 'overlayfs' converts them to overlayfs whiteouts and opaque directories, 'error' fails on the ambiguous whiteouts (aufs meta files, entries removed and added in the same layer)",
+					EnvVars: []string{"WHITEOUT_POLICY"},
+				},
+				&cli.StringSliceFlag{
+					Name:    "rafs-feature",
+					Usage:   "Toggle a RAFS feature of builder formatted like 'key=on', can be repeated, supported features: " + build.RafsFeatureUsage(),
+					EnvVars: []string{"RAFS_FEATURE"},
+				},
 
 				&cli.StringFlag{
 					Name:    "nydus-image",
@@ -927,6 +1932,9 @@ func main() {
 			},
 			Before: func(ctx *cli.Context) error {
 				sourcePath := ctx.String("source-dir")
+				if sourcePath == "-" {
+					return nil
+				}
 				fi, err := os.Stat(sourcePath)
 				if err != nil {
 					return errors.Wrapf(err, "failed to check source directory")
@@ -940,10 +1948,11 @@ func main() {
 				setupLogLevel(c)
 
 				var (
-					p             *packer.Packer
-					res           packer.PackResult
-					backendConfig packer.BackendConfig
-					err           error
+					p              *packer.Packer
+					res            packer.PackResult
+					backendConfig  packer.BackendConfig
+					backendOptions backend.Options
+					err            error
 				)
 
 				// if backend-push is specified, we should make sure backend-config-file exists
@@ -958,6 +1967,23 @@ func main() {
 						return errors.Errorf("failed to parse backend-config '%s', err = %v", _backendConfig, err)
 					}
 					backendConfig = cfg
+					if backendOptions, err = getBackendOptions(c, _backendType); err != nil {
+						return err
+					}
+				}
+
+				chunkSize, err := getChunkSize(c, "chunk-size")
+				if err != nil {
+					return err
+				}
+
+				rafsFeatures, err := build.ParseRafsFeatures(c.StringSlice("rafs-feature"), c.String("fs-version"))
+				if err != nil {
+					return errors.Wrap(err, "invalid --rafs-feature option")
+				}
+
+				if !isPossibleValue(utils.WhiteoutPolicies, c.String("whiteout-policy")) {
+					return fmt.Errorf("--whiteout-policy should be one of %v", utils.WhiteoutPolicies)
 				}
 
 				if p, err = packer.New(packer.Opt{
@@ -965,17 +1991,28 @@ func main() {
 					NydusImagePath: c.String("nydus-image"),
 					OutputDir:      c.String("output-dir"),
 					BackendConfig:  backendConfig,
+					BackendOptions: backendOptions,
 				}); err != nil {
 					return err
 				}
 
+				sourceDir := c.String("source-dir")
+				var sourceTar io.Reader
+				if sourceDir == "-" {
+					sourceDir, sourceTar = "", os.Stdin
+				}
+
 				if res, err = p.Pack(context.Background(), packer.PackRequest{
-					SourceDir:    c.String("source-dir"),
-					ImageName:    c.String("name"),
-					PushToRemote: c.Bool("backend-push"),
-					FsVersion:    c.String("fs-version"),
-					Compressor:   c.String("compressor"),
-					ChunkSize:    c.String("chunk-size"),
+					SourceDir:      sourceDir,
+					SourceTar:      sourceTar,
+					KeepSourceDir:  c.Bool("keep-unpacked-source-dir"),
+					WhiteoutPolicy: c.String("whiteout-policy"),
+					ImageName:      c.String("name"),
+					PushToRemote:   c.Bool("backend-push"),
+					FsVersion:      c.String("fs-version"),
+					Compressor:     c.String("compressor"),
+					ChunkSize:      chunkSize,
+					RafsFeatures:   rafsFeatures,
 
 					ChunkDict:         c.String("chunk-dict"),
 					Parent:            c.String("parent-bootstrap"),
@@ -1165,6 +2202,18 @@ func main() {
 					Usage:    "The external directory (for example mountpoint) in container that need to be committed",
 					EnvVars:  []string{"WITH_PATH"},
 				},
+				&cli.BoolFlag{
+					Name:    "stream-push",
+					Value:   false,
+					Usage:   "Compress and stream the bootstrap layer to target registry in one pass without staging it in work directory",
+					EnvVars: []string{"STREAM_PUSH"},
+				},
+				&cli.Int64Flag{
+					Name:    "stream-push-chunk-size",
+					Value:   0,
+					Usage:   "Upload the streamed layer in the chunks of the size in bytes buffered in memory, for the registries requiring Content-Length, 0 uploads the layer in a single request without Content-Length",
+					EnvVars: []string{"STREAM_PUSH_CHUNK_SIZE"},
+				},
 			},
 			Action: func(c *cli.Context) error {
 				setupLogLevel(c)
@@ -1198,6 +2247,11 @@ func main() {
 					MaximumTimes:      c.Int("maximum-times"),
 					WithPaths:         withPaths,
 					WithoutPaths:      withoutPaths,
+					StreamPush:        c.Bool("stream-push"),
+					StreamChunkSize:   c.Int64("stream-push-chunk-size"),
+				}
+				if opt.StreamChunkSize < 0 {
+					return fmt.Errorf("--stream-push-chunk-size should not be negative")
 				}
 				cm, err := committer.NewCommitter(opt)
 				if err != nil {
@@ -1206,6 +2260,271 @@ func main() {
 				return cm.Commit(c.Context, opt)
 			},
 		},
+		{
+			Name:  "bench-backend",
+			Usage: "Benchmark the upload throughput of storage backend with synthetic blobs",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "backend-type",
+					Value:    "",
+					Required: true,
+					Usage:    "Type of storage backend, possible values: 'oss', 's3'",
+					EnvVars:  []string{"BACKEND_TYPE"},
+				},
+				&cli.StringFlag{
+					Name:    "backend-config",
+					Value:   "",
+					Usage:   "Json configuration string for storage backend",
+					EnvVars: []string{"BACKEND_CONFIG"},
+				},
+				&cli.PathFlag{
+					Name:      "backend-config-file",
+					Value:     "",
+					TakesFile: true,
+					Usage:     "Json configuration file for storage backend",
+					EnvVars:   []string{"BACKEND_CONFIG_FILE"},
+				},
+				&cli.StringSliceFlag{
+					Name:    "blob-size",
+					Value:   cli.NewStringSlice("1MiB", "16MiB"),
+					Usage:   "Size of synthetic blobs, can be specified multiple times, e.g. --blob-size 4MiB --blob-size 64MiB",
+					EnvVars: []string{"BLOB_SIZE"},
+				},
+				&cli.IntFlag{
+					Name:    "count",
+					Value:   8,
+					Usage:   "Number of synthetic blobs uploaded for each blob size",
+					EnvVars: []string{"COUNT"},
+				},
+				&cli.IntFlag{
+					Name:    "concurrency",
+					Value:   4,
+					Usage:   "Number of concurrent uploads",
+					EnvVars: []string{"CONCURRENCY"},
+				},
+				&cli.StringSliceFlag{
+					Name:    "concurrency-per-backend",
+					Usage:   "Override the number of blob parts uploaded concurrently for a backend type formatted like 'type=concurrency', can be repeated, the 'concurrency' in backend config takes precedence",
+					EnvVars: []string{"CONCURRENCY_PER_BACKEND"},
+				},
+				&cli.StringFlag{
+					Name:    "upload-part-size",
+					Usage:   "Size of the blob parts uploaded by multipart to storage backend like '64MiB', default to 200MiB, should be at least 5MiB for 's3' and 100KiB for 'oss', the 'part_size' in backend config takes precedence",
+					EnvVars: []string{"UPLOAD_PART_SIZE"},
+				},
+				&cli.StringFlag{
+					Name:    "work-dir",
+					Value:   "./tmp",
+					Usage:   "Working directory for synthetic blobs, will be cleaned up after benchmark",
+					EnvVars: []string{"WORK_DIR"},
+				},
+			},
+			Action: func(c *cli.Context) error {
+				setupLogLevel(c)
+
+				backendType, backendConfig, err := getBackendConfig(c, "", true)
+				if err != nil {
+					return err
+				}
+				backendOptions, err := getBackendOptions(c, backendType)
+				if err != nil {
+					return err
+				}
+				blobBackend, err := backend.NewBackendWithOptions(backendType, []byte(backendConfig), nil, backendOptions)
+				if err != nil {
+					return errors.Wrap(err, "init backend")
+				}
+
+				blobSizes := []int64{}
+				for _, size := range c.StringSlice("blob-size") {
+					blobSize, err := humanize.ParseBytes(size)
+					if err != nil {
+						return errors.Wrapf(err, "parse blob size %s", size)
+					}
+					blobSizes = append(blobSizes, int64(blobSize))
+				}
+
+				workDir := c.String("work-dir")
+				if err := os.MkdirAll(workDir, 0755); err != nil {
+					return errors.Wrap(err, "create work directory")
+				}
+
+				result, err := backend.Bench(c.Context, blobBackend, backend.BenchOption{
+					WorkDir:     workDir,
+					BlobSizes:   blobSizes,
+					Count:       c.Int("count"),
+					Concurrency: c.Int("concurrency"),
+				})
+				if err != nil {
+					return err
+				}
+				logrus.Infof("benchmark %s backend: %s", backendType, result)
+
+				return nil
+			},
+		},
+		{
+			Name:  "migrate-backend",
+			Usage: "Migrate the Nydus blobs referenced by Nydus images from a storage backend to another",
+			Flags: []cli.Flag{
+				&cli.StringSliceFlag{
+					Name:     "ref",
+					Required: true,
+					Usage:    "Nydus image reference referencing the blobs to migrate, can be specified multiple times",
+					EnvVars:  []string{"REF"},
+				},
+				&cli.BoolFlag{
+					Name:    "insecure",
+					Usage:   "Skip verifying server certs for HTTPS registry",
+					EnvVars: []string{"INSECURE"},
+				},
+
+				&cli.StringFlag{
+					Name:    "source-backend-type",
+					Value:   "",
+					Usage:   "Type of source storage backend, possible values: 'oss', 's3'",
+					EnvVars: []string{"SOURCE_BACKEND_TYPE"},
+				},
+				&cli.StringFlag{
+					Name:    "source-backend-config",
+					Value:   "",
+					Usage:   "Json configuration string for source storage backend",
+					EnvVars: []string{"SOURCE_BACKEND_CONFIG"},
+				},
+				&cli.PathFlag{
+					Name:      "source-backend-config-file",
+					Value:     "",
+					TakesFile: true,
+					Usage:     "Json configuration file for source storage backend",
+					EnvVars:   []string{"SOURCE_BACKEND_CONFIG_FILE"},
+				},
+				&cli.StringFlag{
+					Name:    "target-backend-type",
+					Value:   "",
+					Usage:   "Type of target storage backend, possible values: 'oss', 's3'",
+					EnvVars: []string{"TARGET_BACKEND_TYPE"},
+				},
+				&cli.StringFlag{
+					Name:    "target-backend-config",
+					Value:   "",
+					Usage:   "Json configuration string for target storage backend",
+					EnvVars: []string{"TARGET_BACKEND_CONFIG"},
+				},
+				&cli.PathFlag{
+					Name:      "target-backend-config-file",
+					Value:     "",
+					TakesFile: true,
+					Usage:     "Json configuration file for target storage backend",
+					EnvVars:   []string{"TARGET_BACKEND_CONFIG_FILE"},
+				},
+
+				&cli.IntFlag{
+					Name:    "concurrency",
+					Value:   4,
+					Usage:   "Number of blobs migrated concurrently",
+					EnvVars: []string{"CONCURRENCY"},
+				},
+				&cli.BoolFlag{
+					Name:    "force-push",
+					Usage:   "Upload the blobs existing in target storage backend",
+					EnvVars: []string{"FORCE_PUSH"},
+				},
+				&cli.StringFlag{
+					Name:    "upload-part-size",
+					Usage:   "Size of the blob parts uploaded by multipart to storage backend like '64MiB', default to 200MiB, should be at least 5MiB for 's3' and 100KiB for 'oss', the 'part_size' in backend config takes precedence",
+					EnvVars: []string{"UPLOAD_PART_SIZE"},
+				},
+				&cli.BoolFlag{
+					Name:    "rewrite-manifest",
+					Usage:   "Push the manifests of images in place with the bootstrap layers annotated by the target backend type after migrated",
+					EnvVars: []string{"REWRITE_MANIFEST"},
+				},
+
+				&cli.StringFlag{
+					Name:    "work-dir",
+					Value:   "./tmp",
+					Usage:   "Working directory for staging the migrated blobs, will be cleaned up after migration",
+					EnvVars: []string{"WORK_DIR"},
+				},
+				&cli.StringFlag{
+					Name:    "nydus-image",
+					Value:   "nydus-image",
+					Usage:   "Path to the nydus-image binary, default to search in PATH",
+					EnvVars: []string{"NYDUS_IMAGE"},
+				},
+			},
+			Action: func(c *cli.Context) error {
+				setupLogLevel(c)
+
+				sourceBackendType, sourceBackendConfig, err := getBackendConfig(c, "source-", true)
+				if err != nil {
+					return err
+				}
+				targetBackendType, targetBackendConfig, err := getBackendConfig(c, "target-", true)
+				if err != nil {
+					return err
+				}
+				targetBackendOptions, err := getBackendOptions(c, targetBackendType)
+				if err != nil {
+					return err
+				}
+
+				result, err := migrator.Migrate(c.Context, migrator.Opt{
+					WorkDir:        c.String("work-dir"),
+					NydusImagePath: c.String("nydus-image"),
+
+					Refs:     c.StringSlice("ref"),
+					Insecure: c.Bool("insecure"),
+
+					SourceBackendType:    sourceBackendType,
+					SourceBackendConfig:  sourceBackendConfig,
+					TargetBackendType:    targetBackendType,
+					TargetBackendConfig:  targetBackendConfig,
+					TargetBackendOptions: targetBackendOptions,
+
+					Concurrency:     c.Int("concurrency"),
+					ForcePush:       c.Bool("force-push"),
+					RewriteManifest: c.Bool("rewrite-manifest"),
+				})
+				if err != nil {
+					return err
+				}
+				logrus.Infof(
+					"migrated blobs from %s backend to %s backend: migrated %d (%s), skipped %d",
+					sourceBackendType, targetBackendType, len(result.Migrated),
+					humanize.IBytes(uint64(result.Bytes)), len(result.Skipped),
+				)
+
+				return nil
+			},
+		},
+		{
+			Name:  "keyprovider",
+			Usage: "Serve the ocicrypt key provider protocol in stdin and stdout by KMS, for decrypting the layers encrypted for 'provider:kms:<key-id>' recipients with OCICRYPT_KEYPROVIDER_CONFIG",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "kms-command",
+					Required: true,
+					Usage:    "Command to access KMS, invoked as '<command> encrypt|decrypt <key-id>' with the data key or wrapped key in stdin, and the result in stdout",
+					EnvVars:  []string{"KMS_COMMAND"},
+				},
+				&cli.StringFlag{
+					Name:    "provider",
+					Value:   kms.ProviderName,
+					Usage:   "Name of the key provider in OCICRYPT_KEYPROVIDER_CONFIG",
+					EnvVars: []string{"KEY_PROVIDER"},
+				},
+			},
+			Action: func(c *cli.Context) error {
+				setupLogLevel(c)
+
+				kmsClient, err := kms.NewCommandKMS(c.String("kms-command"))
+				if err != nil {
+					return err
+				}
+				return kms.ServeKeyProvider(c.Context, c.String("provider"), kmsClient, os.Stdin, os.Stdout)
+			},
+		},
 	}
 
 	if !utils.IsSupportedArch(runtime.GOARCH) {
@@ -1218,11 +2537,15 @@ func main() {
 }
 
 func setupLogLevel(c *cli.Context) {
-	// global `-D` has the highest priority
-	if c.Bool("D") {
+	// global `-D` and `--verbose` have the highest priority
+	if c.Bool("D") || c.Bool("verbose") {
 		logrus.SetLevel(logrus.DebugLevel)
 		return
 	}
+	if c.Bool("quiet") {
+		logrus.SetLevel(logrus.ErrorLevel)
+		return
+	}
 
 	lvl := c.String("log-level")
 	logLevel, err := logrus.ParseLevel(lvl)
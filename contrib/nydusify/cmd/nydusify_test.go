@@ -9,10 +9,15 @@ import (
 	"encoding/json"
 	"flag"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/require"
 	"github.com/urfave/cli/v2"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/backend"
 )
 
 func TestIsPossibleValue(t *testing.T) {
@@ -176,12 +181,11 @@ func TestGetBackendConfig(t *testing.T) {
 	require.Empty(t, backendConfig)
 }
 
-func TestGetTargetReference(t *testing.T) {
+func TestGetTargetReferences(t *testing.T) {
 	app := &cli.App{
 		Flags: []cli.Flag{
-			&cli.StringFlag{
-				Name:  "target",
-				Value: "",
+			&cli.StringSliceFlag{
+				Name: "target",
 			},
 			&cli.StringFlag{
 				Name:  "target-suffix",
@@ -195,43 +199,50 @@ func TestGetTargetReference(t *testing.T) {
 	}
 	ctx := cli.NewContext(app, nil, nil)
 
-	target, err := getTargetReference(ctx)
+	targets, err := getTargetReferences(ctx)
 	require.Error(t, err)
 	require.Contains(t, err.Error(), "--target or --target-suffix is required")
-	require.Empty(t, target)
+	require.Empty(t, targets)
 
 	flagSet := flag.NewFlagSet("test1", flag.PanicOnError)
-	flagSet.String("target", "testTarget", "")
+	flagSet.Var(cli.NewStringSlice("testTarget"), "target", "")
 	flagSet.String("target-suffix", "testSuffix", "")
 	ctx = cli.NewContext(app, flagSet, nil)
-	target, err = getTargetReference(ctx)
+	targets, err = getTargetReferences(ctx)
 	require.Error(t, err)
 	require.Contains(t, err.Error(), "-target conflicts with --target-suffix")
-	require.Empty(t, target)
+	require.Empty(t, targets)
 
 	flagSet = flag.NewFlagSet("test2", flag.PanicOnError)
 	flagSet.String("target-suffix", "-nydus", "")
 	flagSet.String("source", "localhost:5000/nginx:latest", "")
 	ctx = cli.NewContext(app, flagSet, nil)
-	target, err = getTargetReference(ctx)
+	targets, err = getTargetReferences(ctx)
 	require.NoError(t, err)
-	require.Equal(t, "localhost:5000/nginx:latest-nydus", target)
+	require.Equal(t, []string{"localhost:5000/nginx:latest-nydus"}, targets)
 
 	flagSet = flag.NewFlagSet("test3", flag.PanicOnError)
 	flagSet.String("target-suffix", "-nydus", "")
 	flagSet.String("source", "localhost:5000\nginx:latest", "")
 	ctx = cli.NewContext(app, flagSet, nil)
-	target, err = getTargetReference(ctx)
+	targets, err = getTargetReferences(ctx)
 	require.Error(t, err)
 	require.Contains(t, err.Error(), "invalid source image reference")
-	require.Empty(t, target)
+	require.Empty(t, targets)
 
 	flagSet = flag.NewFlagSet("test4", flag.PanicOnError)
-	flagSet.String("target", "testTarget", "")
+	flagSet.Var(cli.NewStringSlice("testTarget"), "target", "")
 	ctx = cli.NewContext(app, flagSet, nil)
-	target, err = getTargetReference(ctx)
+	targets, err = getTargetReferences(ctx)
 	require.NoError(t, err)
-	require.Equal(t, "testTarget", target)
+	require.Equal(t, []string{"testTarget"}, targets)
+
+	flagSet = flag.NewFlagSet("test5", flag.PanicOnError)
+	flagSet.Var(cli.NewStringSlice("localhost:5000/nginx:nydus", "localhost:5001/nginx:nydus"), "target", "")
+	ctx = cli.NewContext(app, flagSet, nil)
+	targets, err = getTargetReferences(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []string{"localhost:5000/nginx:nydus", "localhost:5001/nginx:nydus"}, targets)
 }
 
 func TestGetCacheReferencet(t *testing.T) {
@@ -289,6 +300,10 @@ func TestGetPrefetchPatterns(t *testing.T) {
 				Name:  "prefetch-patterns",
 				Value: false,
 			},
+			&cli.StringFlag{
+				Name:  "access-hints",
+				Value: "",
+			},
 		},
 	}
 	ctx := cli.NewContext(app, nil, nil)
@@ -319,4 +334,187 @@ func TestGetPrefetchPatterns(t *testing.T) {
 	patterns, err = getPrefetchPatterns(ctx)
 	require.NoError(t, err)
 	require.Equal(t, "/", patterns)
+
+	hints := filepath.Join(t.TempDir(), "hints")
+	require.NoError(t, os.WriteFile(hints, []byte("/etc/hosts\n5 /usr/bin/app\n"), 0644))
+	flagSet = flag.NewFlagSet("test4", flag.PanicOnError)
+	flagSet.String("access-hints", hints, "")
+	ctx = cli.NewContext(app, flagSet, nil)
+	patterns, err = getPrefetchPatterns(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "/usr/bin/app\n/etc/hosts", patterns)
+
+	flagSet = flag.NewFlagSet("test5", flag.PanicOnError)
+	flagSet.String("access-hints", hints, "")
+	flagSet.String("prefetch-dir", "/etc", "")
+	ctx = cli.NewContext(app, flagSet, nil)
+	_, err = getPrefetchPatterns(ctx)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "--access-hints conflicts with")
+}
+
+func TestGetChunkSize(t *testing.T) {
+	app := &cli.App{
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "chunk-size",
+				Value: "0x100000",
+			},
+		},
+	}
+	for value, expected := range map[string]string{
+		"0x1000":    "0x1000",
+		"0X1000000": "0x1000000",
+		"65536":     "0x10000",
+		"":          "",
+	} {
+		flagSet := flag.NewFlagSet("test", flag.PanicOnError)
+		flagSet.String("chunk-size", value, "")
+		ctx := cli.NewContext(app, flagSet, nil)
+		chunkSize, err := getChunkSize(ctx, "chunk-size")
+		require.NoError(t, err)
+		require.Equal(t, expected, chunkSize)
+	}
+
+	for _, value := range []string{"0x800", "0x2000000", "0x3000", "abc"} {
+		flagSet := flag.NewFlagSet("test", flag.PanicOnError)
+		flagSet.String("chunk-size", value, "")
+		ctx := cli.NewContext(app, flagSet, nil)
+		_, err := getChunkSize(ctx, "chunk-size")
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "--chunk-size")
+	}
+}
+
+func TestGetConcurrencyPerBackend(t *testing.T) {
+	newContext := func(values ...string) *cli.Context {
+		flagSet := flag.NewFlagSet("test", flag.PanicOnError)
+		slice := cli.NewStringSlice(values...)
+		flagSet.Var(slice, "concurrency-per-backend", "")
+		return cli.NewContext(&cli.App{}, flagSet, nil)
+	}
+
+	concurrency, err := getConcurrencyPerBackend(newContext("s3=16", "oss=2"))
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{"s3": 16, "oss": 2}, concurrency)
+	concurrency, err = getConcurrencyPerBackend(newContext())
+	require.NoError(t, err)
+	require.Empty(t, concurrency)
+
+	for _, value := range []string{"s3", "registry=4", "oss=0", "oss=abc"} {
+		_, err := getConcurrencyPerBackend(newContext(value))
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "--concurrency-per-backend")
+	}
+}
+
+func TestGetUploadPartSize(t *testing.T) {
+	newContext := func(value string) *cli.Context {
+		flagSet := flag.NewFlagSet("test", flag.PanicOnError)
+		flagSet.String("upload-part-size", value, "")
+		return cli.NewContext(&cli.App{}, flagSet, nil)
+	}
+
+	partSize, err := getUploadPartSize(newContext("64MiB"))
+	require.NoError(t, err)
+	require.Equal(t, int64(64<<20), partSize)
+	partSize, err = getUploadPartSize(newContext(""))
+	require.NoError(t, err)
+	require.Equal(t, int64(0), partSize)
+
+	for _, value := range []string{"0", "abc"} {
+		_, err := getUploadPartSize(newContext(value))
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "--upload-part-size")
+	}
+}
+
+func TestGetBackendOptions(t *testing.T) {
+	flagSet := flag.NewFlagSet("test", flag.PanicOnError)
+	flagSet.Bool("backend-mmap", true, "")
+	flagSet.Var(cli.NewStringSlice("s3=16"), "concurrency-per-backend", "")
+	flagSet.String("upload-part-size", "64MiB", "")
+	ctx := cli.NewContext(&cli.App{}, flagSet, nil)
+
+	opts, err := getBackendOptions(ctx, "s3")
+	require.NoError(t, err)
+	require.Equal(t, backend.Options{Mmap: true, Concurrency: 16, PartSize: 64 << 20}, opts)
+	// The backend type without the concurrency keeps its default.
+	opts, err = getBackendOptions(ctx, "oss")
+	require.NoError(t, err)
+	require.Equal(t, backend.Options{Mmap: true, PartSize: 64 << 20}, opts)
+}
+
+func TestGetRegistryTimeouts(t *testing.T) {
+	newContext := func(values ...string) *cli.Context {
+		flagSet := flag.NewFlagSet("test", flag.PanicOnError)
+		slice := cli.NewStringSlice(values...)
+		flagSet.Var(slice, "registry-timeout", "")
+		return cli.NewContext(&cli.App{}, flagSet, nil)
+	}
+
+	manifestTimeout, blobTimeout, err := getRegistryTimeouts(newContext("manifest=30s", "blob=30m"))
+	require.NoError(t, err)
+	require.Equal(t, 30*time.Second, manifestTimeout)
+	require.Equal(t, 30*time.Minute, blobTimeout)
+	manifestTimeout, blobTimeout, err = getRegistryTimeouts(newContext())
+	require.NoError(t, err)
+	require.Zero(t, manifestTimeout)
+	require.Zero(t, blobTimeout)
+
+	for _, value := range []string{"30s", "manifest=abc", "blob=-1s", "token=30s"} {
+		_, _, err := getRegistryTimeouts(newContext(value))
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "--registry-timeout")
+	}
+}
+
+func TestGetLayerCompressors(t *testing.T) {
+	newContext := func(values ...string) *cli.Context {
+		flagSet := flag.NewFlagSet("test", flag.PanicOnError)
+		slice := cli.NewStringSlice(values...)
+		flagSet.Var(slice, "layer-compressor", "")
+		return cli.NewContext(&cli.App{}, flagSet, nil)
+	}
+
+	dgst := "sha256:6cdd1b26d54d5852fbea95a81cbb25383975b70b4ffad9f9b6d25c7a434a51eb"
+	compressors, err := getLayerCompressors(newContext("2=none", dgst+"=lz4_block"))
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"2": "none", dgst: "lz4_block"}, compressors)
+	compressors, err = getLayerCompressors(newContext())
+	require.NoError(t, err)
+	require.Empty(t, compressors)
+
+	for _, value := range []string{"none", "=none", "2="} {
+		_, err := getLayerCompressors(newContext(value))
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "--layer-compressor")
+	}
+}
+
+func TestSetupLogLevel(t *testing.T) {
+	level := logrus.GetLevel()
+	defer logrus.SetLevel(level)
+
+	for _, tc := range []struct {
+		args     []string
+		expected logrus.Level
+	}{
+		{[]string{}, logrus.InfoLevel},
+		{[]string{"--log-level", "warn"}, logrus.WarnLevel},
+		{[]string{"--log-level", "invalid"}, logrus.InfoLevel},
+		{[]string{"--quiet"}, logrus.ErrorLevel},
+		{[]string{"--verbose"}, logrus.DebugLevel},
+		{[]string{"-D", "--quiet"}, logrus.DebugLevel},
+		{[]string{"--verbose", "--quiet", "--log-level", "error"}, logrus.DebugLevel},
+	} {
+		flagSet := flag.NewFlagSet("test", flag.ContinueOnError)
+		flagSet.Bool("D", false, "")
+		flagSet.Bool("quiet", false, "")
+		flagSet.Bool("verbose", false, "")
+		flagSet.String("log-level", "info", "")
+		require.NoError(t, flagSet.Parse(tc.args))
+		setupLogLevel(cli.NewContext(&cli.App{}, flagSet, nil))
+		require.Equal(t, tc.expected, logrus.GetLevel())
+	}
 }
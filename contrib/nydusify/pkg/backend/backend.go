@@ -2,6 +2,10 @@
 //
 // SPDX-License-Identifier: Apache-2.0
 
+// Package backend provides the storage backends of nydus blobs, external
+// tools can construct a backend by NewBackend with the same JSON configuration
+// accepted by `nydusify convert --backend-config`. The Backend interface, the
+// configuration types and NewBackend are kept compatible across releases.
 package backend
 
 import (
@@ -9,6 +13,9 @@ import (
 	"fmt"
 	"io"
 
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	humanize "github.com/dustin/go-humanize"
+
 	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/remote"
 	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
 	"github.com/opencontainers/go-digest"
@@ -19,24 +26,110 @@ import (
 // 1. registry: complying to OCI distribution specification, push blob file
 // to registry and use the registry as a storage.
 // 2. oss: A object storage backend, which uses its SDK to transer blob file.
+// 3. s3: An AWS S3 compatible object storage backend.
 type Backend interface {
+	// Upload uploads the blob file in blobPath as blobID, which is the hex
+	// of blob sha256 digest, the existing blob is skipped unless forcePush.
+	//
 	// TODO: Hopefully, we can pass `Layer` struct in, thus to be able to cook both
 	// file handle and file path.
 	Upload(ctx context.Context, blobID, blobPath string, blobSize int64, forcePush bool) (*ocispec.Descriptor, error)
+	// Finalize completes or aborts (if cancel) the pending uploads.
 	Finalize(cancel bool) error
+	// Check reports whether the blob exists in backend.
 	Check(blobID string) (bool, error)
+	// Type returns the backend type.
 	Type() Type
+	// Reader opens the blob for reading, it isn't supported by registry backend.
 	Reader(blobID string) (io.ReadCloser, error)
+	// Size returns the blob size, it isn't supported by registry backend.
 	Size(blobID string) (int64, error)
 }
 
+// ObjectLocator is implemented by the backends storing blobs as objects, it
+// returns the key of the blob object in storage, e.g. the object key of OSS
+// and S3. It's kept apart from Backend for the compatibility of external
+// implementations.
+type ObjectLocator interface {
+	ObjectKey(blobID string) string
+}
+
+// Remover is implemented by the backends able to remove blobs, it's used to
+// clean up the probe and benchmark blobs. It's kept apart from Backend for
+// the compatibility of external implementations.
+type Remover interface {
+	Remove(blobID string) error
+}
+
 // TODO: Directly forward blob data to storage backend
 
+// Options are the options of storage backend given by the caller rather than
+// the backend configuration, the `concurrency` and `part_size` in backend
+// configuration take precedence.
+type Options struct {
+	// Mmap reads the staged blob file by mmap during upload, which reduces
+	// the data copies for large blobs, it falls back to normal reading on the
+	// platforms not supporting mmap.
+	Mmap bool
+	// Concurrency is the number of the parts of a blob uploaded concurrently
+	// to object storage backends, 0 keeps the default of backend type, which
+	// is unbounded for OSS and the SDK default for S3.
+	Concurrency int
+	// PartSize is the size of the parts of a blob uploaded by multipart to
+	// object storage backends, 0 means multipartChunkSize.
+	PartSize int64
+}
+
+// uploadConcurrency returns the upload concurrency with the concurrency
+// configured in backend configuration.
+func uploadConcurrency(configured int, opts Options) int {
+	if configured > 0 {
+		return configured
+	}
+	return opts.Concurrency
+}
+
+// partSizeLimit is the range of multipart part size allowed by storage.
+type partSizeLimit struct {
+	min int64
+	max int64
+}
+
+var partSizeLimits = map[string]partSizeLimit{
+	"oss": {min: 100 << 10, max: 5 << 30},
+	"s3":  {min: manager.MinUploadPartSize, max: 5 << 30},
+}
+
+// uploadPartSize returns the multipart part size of backend type bt with
+// the part size configured in backend configuration, which is validated by
+// the limits of backend type.
+func uploadPartSize(bt string, configured int64, opts Options) (int64, error) {
+	partSize := configured
+	if partSize <= 0 {
+		partSize = opts.PartSize
+	}
+	if partSize <= 0 {
+		partSize = multipartChunkSize
+	}
+	if limit, ok := partSizeLimits[bt]; ok && (partSize < limit.min || partSize > limit.max) {
+		return 0, fmt.Errorf(
+			"invalid part size %s of %s backend, it should be between %s and %s",
+			humanize.IBytes(uint64(partSize)), bt, humanize.IBytes(uint64(limit.min)), humanize.IBytes(uint64(limit.max)),
+		)
+	}
+	return partSize, nil
+}
+
+// Type is the type of storage backend.
 type Type = int
 
 const (
+	// OssBackend stores blobs in Aliyun OSS, configured by OSSConfig.
 	OssBackend Type = iota
+	// RegistryBackend stores blobs as image layers in the target registry.
 	RegistryBackend
+	// S3backend stores blobs in AWS S3 or compatible storage, configured by
+	// S3Config.
 	S3backend
 )
 
@@ -57,21 +150,28 @@ func blobDesc(size int64, blobID string) ocispec.Descriptor {
 	return desc
 }
 
+// NewBackend creates the storage backend of type bt: "oss", "s3" or "registry".
+//
 // Nydusify majorly works for registry backend, which means blob is stored in
 // registry as per OCI distribution specification. But nydus can also make OSS
 // as rafs backend storage. Therefore, nydusify better have the ability to upload
-// blob into OSS. OSS is configured via a json string input. Currently, it has
-// no effect to registry backend now.
-// Save byte slice here because I don't find a way to represent
-// all the backend types at the same time
+// blob into OSS. OSS and S3 are configured via a json string input in the format
+// of OSSConfig and S3Config, the config has no effect to registry backend,
+// which pushes blobs by remote instead, and remote is unused by other backends.
 func NewBackend(bt string, config []byte, remote *remote.Remote) (Backend, error) {
+	return NewBackendWithOptions(bt, config, remote, Options{})
+}
+
+// NewBackendWithOptions is NewBackend with the options of backend, see
+// Options.
+func NewBackendWithOptions(bt string, config []byte, remote *remote.Remote, opts Options) (Backend, error) {
 	switch bt {
 	case "oss":
-		return newOSSBackend(config)
+		return newOSSBackend(config, opts)
 	case "registry":
-		return newRegistryBackend(config, remote)
+		return newRegistryBackend(config, remote, opts)
 	case "s3":
-		return newS3Backend(config)
+		return newS3Backend(config, opts)
 	default:
 		return nil, fmt.Errorf("unsupported backend type %s", bt)
 	}
@@ -8,6 +8,7 @@ import (
 	"encoding/json"
 	"testing"
 
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/provider"
 	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
 	"github.com/stretchr/testify/require"
@@ -64,3 +65,87 @@ func TestNewBackend(t *testing.T) {
 	require.Contains(t, err.Error(), "unsupported backend type")
 	require.Nil(t, backend)
 }
+
+func TestUploadConcurrency(t *testing.T) {
+	ossConfigJSON := `
+	{
+		"bucket_name": "test",
+		"endpoint": "region.oss.com",
+		"object_prefix": "blob",
+		"concurrency": 2
+	}`
+	ossBackend, err := newOSSBackend([]byte(ossConfigJSON), Options{})
+	require.NoError(t, err)
+	require.Equal(t, 2, ossBackend.concurrency)
+
+	s3ConfigJSON := `
+	{
+		"bucket_name": "test",
+		"region": "region1",
+		"object_prefix": "blob",
+		"concurrency": 16
+	}`
+	s3Backend, err := newS3Backend([]byte(s3ConfigJSON), Options{})
+	require.NoError(t, err)
+	require.Equal(t, 16, s3Backend.concurrency)
+	require.Equal(t, 16, s3Backend.uploader().Concurrency)
+
+	// The backend without configured concurrency uses the concurrency of
+	// options, or the default of backend type.
+	s3Backend, err = newS3Backend([]byte(`{"bucket_name": "test", "region": "region1"}`), Options{Concurrency: 8})
+	require.NoError(t, err)
+	require.Equal(t, 8, s3Backend.uploader().Concurrency)
+	s3Backend, err = newS3Backend([]byte(s3ConfigJSON), Options{Concurrency: 8})
+	require.NoError(t, err)
+	require.Equal(t, 16, s3Backend.uploader().Concurrency)
+	s3Backend, err = newS3Backend([]byte(`{"bucket_name": "test", "region": "region1"}`), Options{})
+	require.NoError(t, err)
+	require.Equal(t, manager.DefaultUploadConcurrency, s3Backend.uploader().Concurrency)
+	// The parts are uploaded to OSS without limit by default.
+	ossBackend, err = newOSSBackend([]byte(`{"bucket_name": "test", "endpoint": "region.oss.com"}`), Options{})
+	require.NoError(t, err)
+	require.Equal(t, 0, ossBackend.concurrency)
+}
+
+func TestUploadPartSize(t *testing.T) {
+	ossBackend, err := newOSSBackend([]byte(`{"bucket_name": "test", "endpoint": "region.oss.com", "part_size": 1048576}`), Options{})
+	require.NoError(t, err)
+	require.Equal(t, int64(1<<20), ossBackend.partSize)
+	s3Backend, err := newS3Backend([]byte(`{"bucket_name": "test", "region": "region1", "part_size": 67108864}`), Options{PartSize: 16 << 20})
+	require.NoError(t, err)
+	require.Equal(t, int64(64<<20), s3Backend.uploader().PartSize)
+
+	// The backend without configured part size uses the part size of
+	// options, or multipartChunkSize.
+	s3Backend, err = newS3Backend([]byte(`{"bucket_name": "test", "region": "region1"}`), Options{})
+	require.NoError(t, err)
+	require.Equal(t, int64(multipartChunkSize), s3Backend.uploader().PartSize)
+	s3Backend, err = newS3Backend([]byte(`{"bucket_name": "test", "region": "region1"}`), Options{PartSize: 16 << 20})
+	require.NoError(t, err)
+	require.Equal(t, int64(16<<20), s3Backend.uploader().PartSize)
+	ossBackend, err = newOSSBackend([]byte(`{"bucket_name": "test", "endpoint": "region.oss.com"}`), Options{PartSize: 16 << 20})
+	require.NoError(t, err)
+	require.Equal(t, int64(16<<20), ossBackend.partSize)
+
+	// The part size is limited by backend type, S3 requires 5MiB at least
+	// while OSS accepts 100KiB.
+	_, err = newS3Backend([]byte(`{"bucket_name": "test", "region": "region1"}`), Options{PartSize: 1 << 20})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid part size 1.0 MiB of s3 backend")
+	_, err = newOSSBackend([]byte(`{"bucket_name": "test", "endpoint": "region.oss.com"}`), Options{PartSize: 1 << 20})
+	require.NoError(t, err)
+	for _, config := range []string{
+		`{"bucket_name": "test", "endpoint": "region.oss.com", "part_size": 102399}`,
+		`{"bucket_name": "test", "endpoint": "region.oss.com", "part_size": 5368709121}`,
+	} {
+		_, err = newOSSBackend([]byte(config), Options{})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "of oss backend")
+	}
+	_, err = newS3Backend([]byte(`{"bucket_name": "test", "region": "region1", "part_size": 5368709121}`), Options{})
+	require.Error(t, err)
+
+	// The S3 part size is enlarged for the blob exceeding the maximum parts.
+	require.Equal(t, int64(5<<20), s3PartSize(100<<20, 5<<20))
+	require.Equal(t, int64(5<<20)+1, s3PartSize(10000*(5<<20), 5<<20))
+}
@@ -0,0 +1,236 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+)
+
+// BenchOption configures the synthetic blobs uploaded by Bench.
+type BenchOption struct {
+	// WorkDir holds the synthetic blob files, which are generated ahead of
+	// the uploads by at most Concurrency blobs and removed once uploaded,
+	// the system temporary directory is used if empty.
+	WorkDir string
+	// BlobSizes are the sizes of synthetic blobs, Count blobs are
+	// uploaded for each size.
+	BlobSizes []int64
+	// Count is the number of blobs uploaded for each size.
+	Count int
+	// Concurrency is the number of concurrent uploads.
+	Concurrency int
+}
+
+// BenchResult is the statistics of the uploads in Bench.
+type BenchResult struct {
+	// Uploads is the number of attempted uploads.
+	Uploads int
+	// Errors is the number of failed uploads.
+	Errors int
+	// Bytes is the total size of succeeded uploads.
+	Bytes int64
+	// Elapsed is the wall time of all uploads, including the finalizing.
+	Elapsed time.Duration
+	// Latencies are the sorted durations of succeeded uploads.
+	Latencies []time.Duration
+}
+
+// Throughput returns the uploaded bytes per second.
+func (result *BenchResult) Throughput() float64 {
+	if result.Elapsed <= 0 {
+		return 0
+	}
+	return float64(result.Bytes) / result.Elapsed.Seconds()
+}
+
+// ErrorRate returns the ratio of failed uploads.
+func (result *BenchResult) ErrorRate() float64 {
+	if result.Uploads == 0 {
+		return 0
+	}
+	return float64(result.Errors) / float64(result.Uploads)
+}
+
+// Percentile returns the upload latency at percentile p in [0, 100] by the
+// nearest rank method, it's zero without succeeded uploads.
+func (result *BenchResult) Percentile(p float64) time.Duration {
+	if len(result.Latencies) == 0 {
+		return 0
+	}
+	rank := int(p/100*float64(len(result.Latencies))+0.5) - 1
+	if rank < 0 {
+		rank = 0
+	} else if rank >= len(result.Latencies) {
+		rank = len(result.Latencies) - 1
+	}
+	return result.Latencies[rank]
+}
+
+func (result *BenchResult) String() string {
+	return fmt.Sprintf(
+		"uploads %d, errors %d (%.2f%%), bytes %s, elapsed %s, throughput %s/s, latency p50 %s, p90 %s, p99 %s",
+		result.Uploads, result.Errors, result.ErrorRate()*100, humanize.IBytes(uint64(result.Bytes)),
+		result.Elapsed, humanize.IBytes(uint64(result.Throughput())),
+		result.Percentile(50), result.Percentile(90), result.Percentile(99),
+	)
+}
+
+type benchBlob struct {
+	id   string
+	path string
+	size int64
+}
+
+// writeBenchBlob writes a blob of random data in size to dir.
+func writeBenchBlob(dir string, size int64) (*benchBlob, error) {
+	file, err := os.CreateTemp(dir, "blob-")
+	if err != nil {
+		return nil, errors.Wrap(err, "create blob file")
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.CopyN(io.MultiWriter(file, hash), rand.Reader, size); err != nil {
+		return nil, errors.Wrap(err, "write blob file")
+	}
+
+	return &benchBlob{
+		id:   hex.EncodeToString(hash.Sum(nil)),
+		path: file.Name(),
+		size: size,
+	}, nil
+}
+
+// Bench uploads synthetic blobs of random data to backend, and reports the
+// throughput, latencies and error rate of the uploads. The blobs are always
+// force pushed, so that the existing blobs in backend don't skew the result,
+// and removed from backend after measuring if it implements Remover.
+func Bench(ctx context.Context, backend Backend, opt BenchOption) (*BenchResult, error) {
+	if opt.Count <= 0 {
+		return nil, fmt.Errorf("invalid blob count %d", opt.Count)
+	}
+	if len(opt.BlobSizes) == 0 {
+		return nil, fmt.Errorf("blob sizes are empty")
+	}
+	for _, size := range opt.BlobSizes {
+		if size <= 0 {
+			return nil, fmt.Errorf("invalid blob size %d", size)
+		}
+	}
+	concurrency := opt.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	dir, err := os.MkdirTemp(opt.WorkDir, "nydusify-bench-")
+	if err != nil {
+		return nil, errors.Wrap(err, "create bench directory")
+	}
+	defer os.RemoveAll(dir)
+
+	// The blobs are generated while uploading rather than all up front, so
+	// that the disk usage is bounded by the concurrency.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	blobs := make(chan *benchBlob, concurrency)
+	var genErr error
+	go func() {
+		defer close(blobs)
+		for _, size := range opt.BlobSizes {
+			for i := 0; i < opt.Count; i++ {
+				blob, err := writeBenchBlob(dir, size)
+				if err != nil {
+					genErr = err
+					return
+				}
+				select {
+				case blobs <- blob:
+				case <-ctx.Done():
+					os.Remove(blob.path)
+					return
+				}
+			}
+		}
+	}()
+
+	result := &BenchResult{}
+	var uploaded []string
+	var mutex sync.Mutex
+	eg := errgroup.Group{}
+	eg.SetLimit(concurrency)
+
+	start := time.Now()
+	for blob := range blobs {
+		blob := blob
+		result.Uploads++
+		eg.Go(func() error {
+			defer os.Remove(blob.path)
+			blobStart := time.Now()
+			_, err := backend.Upload(ctx, blob.id, blob.path, blob.size, true)
+			latency := time.Since(blobStart)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				logrus.Warnf("upload blob %s: %s", blob.id, err)
+				result.Errors++
+				return nil
+			}
+			uploaded = append(uploaded, blob.id)
+			result.Bytes += blob.size
+			result.Latencies = append(result.Latencies, latency)
+			return nil
+		})
+	}
+	_ = eg.Wait()
+
+	finalizeErr := backend.Finalize(genErr != nil)
+	result.Elapsed = time.Since(start)
+	removeBenchBlobs(backend, uploaded)
+	if genErr != nil {
+		return nil, genErr
+	}
+	if finalizeErr != nil {
+		return nil, errors.Wrap(finalizeErr, "finalize backend")
+	}
+
+	sort.Slice(result.Latencies, func(i, j int) bool {
+		return result.Latencies[i] < result.Latencies[j]
+	})
+
+	return result, nil
+}
+
+// removeBenchBlobs removes the uploaded synthetic blobs from backend, they
+// are left with a warning if backend can't remove blobs.
+func removeBenchBlobs(backend Backend, blobIDs []string) {
+	if len(blobIDs) == 0 {
+		return
+	}
+	remover, ok := backend.(Remover)
+	if !ok {
+		logrus.Warnf("%d synthetic blobs are left in backend as it can't remove blobs", len(blobIDs))
+		return
+	}
+	for _, blobID := range blobIDs {
+		if err := remover.Remove(blobID); err != nil {
+			logrus.Warnf("remove synthetic blob %s: %s", blobID, err)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+type benchBackend struct {
+	mutex     sync.Mutex
+	uploaded  map[string]int64
+	removed   int
+	failEvery int
+	uploads   int
+	finalized bool
+	// workDir is checked for the synthetic blob files on disk.
+	workDir  string
+	maxFiles int
+}
+
+func (b *benchBackend) Upload(_ context.Context, blobID, blobPath string, blobSize int64, forcePush bool) (*ocispec.Descriptor, error) {
+	data, err := os.ReadFile(blobPath)
+	if err != nil {
+		return nil, err
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.uploads++
+	if b.workDir != "" {
+		files, err := filepath.Glob(filepath.Join(b.workDir, "*", "blob-*"))
+		if err != nil {
+			return nil, err
+		}
+		if len(files) > b.maxFiles {
+			b.maxFiles = len(files)
+		}
+	}
+	if b.failEvery > 0 && b.uploads%b.failEvery == 0 {
+		return nil, fmt.Errorf("mock failure")
+	}
+	if !forcePush || int64(len(data)) != blobSize {
+		return nil, fmt.Errorf("unexpected upload of %s", blobID)
+	}
+	b.uploaded[blobID] = blobSize
+	desc := blobDesc(blobSize, blobID)
+	return &desc, nil
+}
+
+func (b *benchBackend) Finalize(bool) error {
+	b.finalized = true
+	return nil
+}
+
+func (b *benchBackend) Check(blobID string) (bool, error) {
+	_, ok := b.uploaded[blobID]
+	return ok, nil
+}
+
+func (b *benchBackend) Remove(blobID string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.uploaded, blobID)
+	b.removed++
+	return nil
+}
+
+func (b *benchBackend) Type() Type { return OssBackend }
+
+func (b *benchBackend) Reader(string) (io.ReadCloser, error) { return nil, fmt.Errorf("not supported") }
+
+func (b *benchBackend) Size(blobID string) (int64, error) { return b.uploaded[blobID], nil }
+
+func TestBench(t *testing.T) {
+	_, err := Bench(context.Background(), &benchBackend{}, BenchOption{BlobSizes: []int64{1024}})
+	require.Error(t, err)
+	_, err = Bench(context.Background(), &benchBackend{}, BenchOption{Count: 1})
+	require.Error(t, err)
+
+	workDir := t.TempDir()
+	backend := &benchBackend{uploaded: map[string]int64{}, workDir: workDir}
+	result, err := Bench(context.Background(), backend, BenchOption{
+		WorkDir:     workDir,
+		BlobSizes:   []int64{1024, 4096},
+		Count:       8,
+		Concurrency: 2,
+	})
+	require.NoError(t, err)
+	require.True(t, backend.finalized)
+	// The uploaded blobs are removed from backend after measuring.
+	require.Equal(t, 16, backend.removed)
+	require.Empty(t, backend.uploaded)
+	// Besides the uploading blobs, at most concurrency blobs are generated
+	// ahead, one is waiting for an upload slot and one is being generated.
+	require.LessOrEqual(t, backend.maxFiles, 2+2+1+1)
+	require.Equal(t, 16, result.Uploads)
+	require.Equal(t, 0, result.Errors)
+	require.Equal(t, int64(8*1024+8*4096), result.Bytes)
+	require.Len(t, result.Latencies, 16)
+	require.True(t, result.Throughput() > 0)
+	require.True(t, result.Percentile(50) <= result.Percentile(99))
+	require.Equal(t, result.Latencies[15], result.Percentile(99))
+	require.Contains(t, result.String(), "uploads 16, errors 0")
+
+	// The synthetic blobs are removed after the bench.
+	entries, err := os.ReadDir(workDir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	backend = &benchBackend{uploaded: map[string]int64{}, failEvery: 4}
+	result, err = Bench(context.Background(), backend, BenchOption{BlobSizes: []int64{512}, Count: 8})
+	require.NoError(t, err)
+	require.Equal(t, 8, result.Uploads)
+	require.Equal(t, 2, result.Errors)
+	require.Equal(t, 0.25, result.ErrorRate())
+	require.Equal(t, int64(6*512), result.Bytes)
+	require.Equal(t, 6, backend.removed)
+}
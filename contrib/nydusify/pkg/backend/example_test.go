@@ -0,0 +1,38 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend_test
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/backend"
+)
+
+func ExampleNewBackend() {
+	config, err := json.Marshal(backend.S3Config{
+		Endpoint:     "localhost:9000",
+		Scheme:       "http",
+		BucketName:   "nydus",
+		Region:       "us-east-1",
+		ObjectPrefix: "blobs/",
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	// The remote is only required by registry backend.
+	b, err := backend.NewBackend("s3", config, nil)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(b.Type() == backend.S3backend)
+
+	_, err = backend.NewBackend("s3", []byte(`{"bucket_name": "nydus"}`), nil)
+	fmt.Println(err)
+	// Output:
+	// true
+	// invalid S3 configuration: missing 'bucket_name' or 'region'
+}
@@ -0,0 +1,145 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+)
+
+// MigrateOption configures the blobs migrated by Migrate.
+type MigrateOption struct {
+	// WorkDir holds the blob files staged for uploading, which are removed
+	// after uploaded, the system temporary directory is used if empty.
+	WorkDir string
+	// Concurrency is the number of blobs migrated concurrently.
+	Concurrency int
+	// ForcePush uploads the blobs existing in the destination backend.
+	ForcePush bool
+}
+
+// MigrateResult is the statistics of the blobs in Migrate.
+type MigrateResult struct {
+	// Migrated are the sorted IDs of the blobs uploaded to destination.
+	Migrated []string
+	// Skipped are the sorted IDs of the blobs existing in destination.
+	Skipped []string
+	// Bytes is the total size of the migrated blobs.
+	Bytes int64
+}
+
+// stageBlob reads the blob from backend into a file of dir, the blob data
+// is verified by blobID, which is the hex of blob sha256 digest.
+func stageBlob(backend Backend, dir, blobID string) (string, int64, error) {
+	reader, err := backend.Reader(blobID)
+	if err != nil {
+		return "", 0, errors.Wrap(err, "open blob")
+	}
+	defer reader.Close()
+
+	file, err := os.CreateTemp(dir, "blob-")
+	if err != nil {
+		return "", 0, errors.Wrap(err, "create blob file")
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(file, hash), reader)
+	if err != nil {
+		return "", 0, errors.Wrap(err, "read blob")
+	}
+	if actual := hex.EncodeToString(hash.Sum(nil)); actual != blobID {
+		return "", 0, errors.Errorf("blob digest mismatch, got sha256:%s", actual)
+	}
+
+	return file.Name(), size, nil
+}
+
+// Migrate copies the blobs of blobIDs from the src backend to dst backend,
+// each blob is staged in a file of the work directory since Upload accepts
+// only the blob file, which is verified by the blob ID before uploading.
+// The blobs existing in dst are skipped unless opt.ForcePush, the pending
+// uploads of dst are aborted if any blob fails.
+func Migrate(ctx context.Context, src, dst Backend, blobIDs []string, opt MigrateOption) (*MigrateResult, error) {
+	concurrency := opt.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	dir, err := os.MkdirTemp(opt.WorkDir, "nydusify-migrate-")
+	if err != nil {
+		return nil, errors.Wrap(err, "create migrate directory")
+	}
+	defer os.RemoveAll(dir)
+
+	result := &MigrateResult{}
+	var mutex sync.Mutex
+	eg, ctx := errgroup.WithContext(ctx)
+	eg.SetLimit(concurrency)
+
+	visited := map[string]bool{}
+	for _, blobID := range blobIDs {
+		if visited[blobID] {
+			continue
+		}
+		visited[blobID] = true
+		blobID := blobID
+		eg.Go(func() error {
+			if !opt.ForcePush {
+				exist, err := dst.Check(blobID)
+				if err != nil {
+					return errors.Wrapf(err, "check blob %s in destination", blobID)
+				}
+				if exist {
+					logrus.Infof("skip blob %s existing in destination", blobID)
+					mutex.Lock()
+					result.Skipped = append(result.Skipped, blobID)
+					mutex.Unlock()
+					return nil
+				}
+			}
+
+			blobPath, size, err := stageBlob(src, dir, blobID)
+			if err != nil {
+				return errors.Wrapf(err, "read blob %s from source", blobID)
+			}
+			defer os.Remove(blobPath)
+			if _, err := dst.Upload(ctx, blobID, blobPath, size, opt.ForcePush); err != nil {
+				return errors.Wrapf(err, "upload blob %s to destination", blobID)
+			}
+			logrus.Infof("migrated blob %s", blobID)
+
+			mutex.Lock()
+			result.Migrated = append(result.Migrated, blobID)
+			result.Bytes += size
+			mutex.Unlock()
+			return nil
+		})
+	}
+
+	if err := eg.Wait(); err != nil {
+		if cancelErr := dst.Finalize(true); cancelErr != nil {
+			logrus.Warnf("cancel uploads of destination: %s", cancelErr)
+		}
+		return nil, err
+	}
+	if err := dst.Finalize(false); err != nil {
+		return nil, errors.Wrap(err, "finalize destination backend")
+	}
+
+	sort.Strings(result.Migrated)
+	sort.Strings(result.Skipped)
+
+	return result, nil
+}
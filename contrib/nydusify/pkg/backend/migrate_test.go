@@ -0,0 +1,134 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"testing"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryBackend stores the blobs in memory.
+type memoryBackend struct {
+	mutex     sync.Mutex
+	blobs     map[string][]byte
+	uploads   int
+	finalized bool
+	canceled  bool
+}
+
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{blobs: map[string][]byte{}}
+}
+
+func (b *memoryBackend) put(data []byte) string {
+	hash := sha256.Sum256(data)
+	blobID := hex.EncodeToString(hash[:])
+	b.blobs[blobID] = data
+	return blobID
+}
+
+func (b *memoryBackend) Upload(_ context.Context, blobID, blobPath string, blobSize int64, _ bool) (*ocispec.Descriptor, error) {
+	data, err := os.ReadFile(blobPath)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != blobSize {
+		return nil, fmt.Errorf("unexpected size of %s", blobID)
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.uploads++
+	b.blobs[blobID] = data
+	desc := blobDesc(blobSize, blobID)
+	return &desc, nil
+}
+
+func (b *memoryBackend) Finalize(cancel bool) error {
+	b.finalized = true
+	b.canceled = cancel
+	return nil
+}
+
+func (b *memoryBackend) Check(blobID string) (bool, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	_, ok := b.blobs[blobID]
+	return ok, nil
+}
+
+func (b *memoryBackend) Type() Type { return S3backend }
+
+func (b *memoryBackend) Reader(blobID string) (io.ReadCloser, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	data, ok := b.blobs[blobID]
+	if !ok {
+		return nil, fmt.Errorf("blob %s not found", blobID)
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (b *memoryBackend) Size(blobID string) (int64, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return int64(len(b.blobs[blobID])), nil
+}
+
+func TestMigrate(t *testing.T) {
+	src := newMemoryBackend()
+	first := src.put([]byte("first blob"))
+	second := src.put([]byte("second blob"))
+	third := src.put([]byte("third blob"))
+	dst := newMemoryBackend()
+	dst.blobs[third] = []byte("third blob")
+
+	workDir := t.TempDir()
+	result, err := Migrate(context.Background(), src, dst, []string{first, second, third, first}, MigrateOption{
+		WorkDir:     workDir,
+		Concurrency: 2,
+	})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{first, second}, result.Migrated)
+	require.Equal(t, []string{third}, result.Skipped)
+	require.Equal(t, int64(len("first blob")+len("second blob")), result.Bytes)
+	require.Equal(t, 2, dst.uploads)
+	require.True(t, dst.finalized)
+	require.False(t, dst.canceled)
+	for _, blobID := range []string{first, second, third} {
+		require.Equal(t, src.blobs[blobID], dst.blobs[blobID])
+	}
+	entries, err := os.ReadDir(workDir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	// The existing blobs are uploaded again by force push.
+	result, err = Migrate(context.Background(), src, dst, []string{first, third}, MigrateOption{WorkDir: workDir, ForcePush: true})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(result.Migrated))
+	require.Empty(t, result.Skipped)
+	require.Equal(t, 4, dst.uploads)
+
+	// The blob missing or corrupted in source aborts the uploads.
+	corrupted := src.put([]byte("corrupted blob"))
+	src.blobs[corrupted] = []byte("modified blob")
+	for _, blobID := range []string{corrupted, "0000000000000000000000000000000000000000000000000000000000000000"} {
+		dst := newMemoryBackend()
+		_, err = Migrate(context.Background(), src, dst, []string{blobID}, MigrateOption{WorkDir: workDir})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), blobID)
+		require.Empty(t, dst.blobs)
+		require.True(t, dst.canceled)
+	}
+}
@@ -25,7 +25,8 @@ import (
 
 const (
 	// For multipart uploads, OSS has a maximum number of 10000 chunks,
-	// so we can only upload blob size of about 10000 * multipartChunkSize.
+	// so we can only upload blob size of about 10000 * part size, the
+	// default part size is multipartChunkSize.
 	multipartChunkSize = 200 * 1024 * 1024 /// 200MB
 )
 
@@ -44,25 +45,48 @@ type OSSBackend struct {
 	bucket       *oss.Bucket
 	ms           []multipartStatus
 	msMutex      sync.Mutex
+	// concurrency is the number of parts uploaded concurrently, 0 means
+	// unbounded.
+	concurrency int
+	// partSize is the size of the parts of multipart upload.
+	partSize int64
 }
 
-func newOSSBackend(rawConfig []byte) (*OSSBackend, error) {
-	var configMap map[string]string
-	if err := json.Unmarshal(rawConfig, &configMap); err != nil {
+// OSSConfig is the configuration of OSS storage backend, the endpoint and
+// bucket_name are required.
+type OSSConfig struct {
+	Endpoint        string `json:"endpoint,omitempty"`
+	BucketName      string `json:"bucket_name,omitempty"`
+	AccessKeyID     string `json:"access_key_id,omitempty"`
+	AccessKeySecret string `json:"access_key_secret,omitempty"`
+	ObjectPrefix    string `json:"object_prefix,omitempty"`
+	// Concurrency overrides the upload concurrency of backend type.
+	Concurrency int `json:"concurrency,omitempty"`
+	// PartSize overrides the multipart part size in bytes of backend type.
+	PartSize int64 `json:"part_size,omitempty"`
+}
+
+func newOSSBackend(rawConfig []byte, opts Options) (*OSSBackend, error) {
+	cfg := &OSSConfig{}
+	if err := json.Unmarshal(rawConfig, cfg); err != nil {
 		return nil, errors.Wrap(err, "Parse OSS storage backend configuration")
 	}
 
-	endpoint := configMap["endpoint"]
-	bucketName := configMap["bucket_name"]
+	endpoint := cfg.Endpoint
+	bucketName := cfg.BucketName
 
 	// Below items are not mandatory
-	accessKeyID := configMap["access_key_id"]
-	accessKeySecret := configMap["access_key_secret"]
-	objectPrefix := configMap["object_prefix"]
+	accessKeyID := cfg.AccessKeyID
+	accessKeySecret := cfg.AccessKeySecret
+	objectPrefix := cfg.ObjectPrefix
 
 	if endpoint == "" || bucketName == "" {
 		return nil, fmt.Errorf("invalid OSS configuration: missing 'endpoint' or 'bucket'")
 	}
+	partSize, err := uploadPartSize("oss", cfg.PartSize, opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid OSS configuration")
+	}
 
 	client, err := oss.New(endpoint, accessKeyID, accessKeySecret)
 	if err != nil {
@@ -77,6 +101,8 @@ func newOSSBackend(rawConfig []byte) (*OSSBackend, error) {
 	return &OSSBackend{
 		objectPrefix: objectPrefix,
 		bucket:       bucket,
+		concurrency:  uploadConcurrency(cfg.Concurrency, opts),
+		partSize:     partSize,
 	}, nil
 }
 
@@ -138,7 +164,7 @@ func (b *OSSBackend) Upload(_ context.Context, blobID, blobPath string, size int
 	}()
 
 	logrus.Debugf("upload %s using multipart method", blobObjectKey)
-	chunks, err := oss.SplitFileByPartSize(blobPath, multipartChunkSize)
+	chunks, err := oss.SplitFileByPartSize(blobPath, b.partSize)
 	if err != nil {
 		return nil, errors.Wrap(err, "split file by part size")
 	}
@@ -149,6 +175,9 @@ func (b *OSSBackend) Upload(_ context.Context, blobID, blobPath string, size int
 	}
 
 	eg := new(errgroup.Group)
+	if b.concurrency > 0 {
+		eg.SetLimit(b.concurrency)
+	}
 	partsChan := make(chan oss.UploadPart, len(chunks))
 	for _, chunk := range chunks {
 		ck := chunk
@@ -157,6 +186,9 @@ func (b *OSSBackend) Upload(_ context.Context, blobID, blobPath string, size int
 			if err != nil {
 				return errors.Wrap(err, "upload part from file")
 			}
+			if err := verifyOSSPart(blobPath, ck, p); err != nil {
+				return err
+			}
 			partsChan <- p
 			return nil
 		})
@@ -272,13 +304,23 @@ func (b *OSSBackend) Size(blobID string) (int64, error) {
 		return 0, errors.Wrap(err, "get object size")
 	}
 	sizeStr := headers.Get("Content-Length")
-	size, err := strconv.ParseInt(sizeStr, 10, 0)
+	size, err := strconv.ParseInt(sizeStr, 10, 64)
 	if err != nil {
 		return 0, errors.Wrap(err, "parse content-length header")
 	}
 	return size, nil
 }
 
+// Remove deletes the blob object from bucket.
+func (b *OSSBackend) Remove(blobID string) error {
+	return b.bucket.DeleteObject(b.objectPrefix + blobID)
+}
+
+// ObjectKey returns the object key of blob in bucket.
+func (b *OSSBackend) ObjectKey(blobID string) string {
+	return b.objectPrefix + blobID
+}
+
 func (b *OSSBackend) remoteID(blobID string) string {
 	return fmt.Sprintf("oss://%s/%s%s", b.bucket.BucketName, b.objectPrefix, blobID)
 }
@@ -22,7 +22,7 @@ func tempOSSBackend() *OSSBackend {
 		"access_key_secret": "testSK",
 		"object_prefix": "blob"
 	}`
-	backend, _ := newOSSBackend([]byte(ossConfigJSON))
+	backend, _ := newOSSBackend([]byte(ossConfigJSON), Options{})
 	return backend
 }
 
@@ -49,6 +49,8 @@ func TestOSSRemoteID(t *testing.T) {
 	ossBackend := tempOSSBackend()
 	id := ossBackend.remoteID("111")
 	require.Equal(t, "oss://test/blob111", id)
+	var locator ObjectLocator = ossBackend
+	require.Equal(t, "blob111", locator.ObjectKey("111"))
 }
 
 func TestNewOSSBackend(t *testing.T) {
@@ -61,7 +63,7 @@ func TestNewOSSBackend(t *testing.T) {
 		"object_prefix": "blob"
 	}`
 	require.True(t, json.Valid([]byte(ossConfigJSON1)))
-	backend, err := newOSSBackend([]byte(ossConfigJSON1))
+	backend, err := newOSSBackend([]byte(ossConfigJSON1), Options{})
 	require.NoError(t, err)
 	require.Equal(t, "test", backend.bucket.BucketName)
 	require.Equal(t, "blob", backend.objectPrefix)
@@ -74,7 +76,7 @@ func TestNewOSSBackend(t *testing.T) {
 		"object_prefix": "blob"
 	}`
 	require.True(t, json.Valid([]byte(ossConfigJSON2)))
-	backend, err = newOSSBackend([]byte(ossConfigJSON2))
+	backend, err = newOSSBackend([]byte(ossConfigJSON2), Options{})
 	require.Error(t, err)
 	require.Contains(t, err.Error(), "invalid OSS configuration: missing 'endpoint' or 'bucket'")
 	require.Nil(t, backend)
@@ -87,7 +89,7 @@ func TestNewOSSBackend(t *testing.T) {
 		"object_prefix": "blob"
 	}`
 	require.True(t, json.Valid([]byte(ossConfigJSON3)))
-	backend, err = newOSSBackend([]byte(ossConfigJSON3))
+	backend, err = newOSSBackend([]byte(ossConfigJSON3), Options{})
 	require.Error(t, err)
 	require.Contains(t, err.Error(), "invalid OSS configuration: missing 'endpoint' or 'bucket'")
 	require.Nil(t, backend)
@@ -101,7 +103,7 @@ func TestNewOSSBackend(t *testing.T) {
 		"object_prefix": "blob"
 	}`
 	require.True(t, json.Valid([]byte(ossConfigJSON4)))
-	backend, err = newOSSBackend([]byte(ossConfigJSON4))
+	backend, err = newOSSBackend([]byte(ossConfigJSON4), Options{})
 	require.Error(t, err)
 	require.Contains(t, err.Error(), "Create bucket")
 	require.Contains(t, err.Error(), "len is between [3-63],now is")
@@ -116,7 +118,7 @@ func TestNewOSSBackend(t *testing.T) {
 		"object_prefix": "blob"
 	}`
 	require.True(t, json.Valid([]byte(ossConfigJSON5)))
-	backend, err = newOSSBackend([]byte(ossConfigJSON5))
+	backend, err = newOSSBackend([]byte(ossConfigJSON5), Options{})
 	require.Error(t, err)
 	require.Contains(t, err.Error(), "Create bucket")
 	require.Contains(t, err.Error(), "can only include lowercase letters, numbers, and -")
@@ -130,7 +132,7 @@ func TestNewOSSBackend(t *testing.T) {
 		"access_key_secret": "testSK",
 		"object_prefix": "blob",
 	}`
-	backend, err = newOSSBackend([]byte(ossConfigJSON6))
+	backend, err = newOSSBackend([]byte(ossConfigJSON6), Options{})
 	require.Error(t, err)
 	require.Contains(t, err.Error(), "Parse OSS storage backend configuration")
 	require.Nil(t, backend)
@@ -3,15 +3,16 @@ package backend
 import (
 	"context"
 	"io"
-	"os"
 
 	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/remote"
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 )
 
 type Registry struct {
 	remote *remote.Remote
+	mmap   bool
 }
 
 func (r *Registry) Upload(
@@ -22,7 +23,7 @@ func (r *Registry) Upload(
 
 	desc := blobDesc(size, blobID)
 
-	blobFile, err := os.Open(blobPath)
+	blobFile, err := utils.OpenBlob(blobPath, r.mmap)
 	if err != nil {
 		return nil, errors.Wrap(err, "Open blob file")
 	}
@@ -55,6 +56,6 @@ func (r *Registry) Size(_ string) (int64, error) {
 	panic("not implemented")
 }
 
-func newRegistryBackend(_ []byte, remote *remote.Remote) (Backend, error) {
-	return &Registry{remote: remote}, nil
+func newRegistryBackend(_ []byte, remote *remote.Remote, opts Options) (Backend, error) {
+	return &Registry{remote: remote, mmap: opts.Mmap}, nil
 }
@@ -11,7 +11,6 @@ import (
 	"io"
 	"net/http"
 	"net/url"
-	"os"
 	"path"
 	"time"
 
@@ -25,6 +24,8 @@ import (
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
 )
 
 type S3Backend struct {
@@ -36,8 +37,18 @@ type S3Backend struct {
 	bucketName         string
 	endpointWithScheme string
 	client             *s3.Client
+	// concurrency is the number of parts uploaded concurrently, 0 means
+	// the default of uploader.
+	concurrency int
+	// partSize is the size of the parts of multipart upload.
+	partSize int64
+	// mmap reads the blob file by mmap, see Options.
+	mmap bool
 }
 
+// S3Config is the configuration of S3 storage backend, the bucket_name and
+// region are required, the endpoint defaults to `s3.amazonaws.com` and the
+// scheme defaults to `https`.
 type S3Config struct {
 	AccessKeyID     string `json:"access_key_id,omitempty"`
 	AccessKeySecret string `json:"access_key_secret,omitempty"`
@@ -46,9 +57,13 @@ type S3Config struct {
 	BucketName      string `json:"bucket_name,omitempty"`
 	Region          string `json:"region,omitempty"`
 	ObjectPrefix    string `json:"object_prefix,omitempty"`
+	// Concurrency overrides the upload concurrency of backend type.
+	Concurrency int `json:"concurrency,omitempty"`
+	// PartSize overrides the multipart part size in bytes of backend type.
+	PartSize int64 `json:"part_size,omitempty"`
 }
 
-func newS3Backend(rawConfig []byte) (*S3Backend, error) {
+func newS3Backend(rawConfig []byte, opts Options) (*S3Backend, error) {
 	cfg := &S3Config{}
 	if err := json.Unmarshal(rawConfig, cfg); err != nil {
 		return nil, errors.Wrap(err, "parse S3 storage backend configuration")
@@ -64,6 +79,10 @@ func newS3Backend(rawConfig []byte) (*S3Backend, error) {
 	if cfg.BucketName == "" || cfg.Region == "" {
 		return nil, fmt.Errorf("invalid S3 configuration: missing 'bucket_name' or 'region'")
 	}
+	partSize, err := uploadPartSize("s3", cfg.PartSize, opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid S3 configuration")
+	}
 
 	s3AWSConfig, err := awscfg.LoadDefaultConfig(context.TODO())
 	if err != nil {
@@ -85,6 +104,9 @@ func newS3Backend(rawConfig []byte) (*S3Backend, error) {
 		bucketName:         cfg.BucketName,
 		endpointWithScheme: endpointWithScheme,
 		client:             client,
+		concurrency:        uploadConcurrency(cfg.Concurrency, opts),
+		partSize:           partSize,
+		mmap:               opts.Mmap,
 	}, nil
 }
 
@@ -105,23 +127,34 @@ func (b *S3Backend) Upload(ctx context.Context, blobID, blobPath string, size in
 
 	start := time.Now()
 
-	blobFile, err := os.Open(blobPath)
+	blobFile, err := utils.OpenBlob(blobPath, b.mmap)
 	if err != nil {
 		return nil, errors.Wrap(err, "open blob file")
 	}
 	defer blobFile.Close()
 
-	uploader := manager.NewUploader(b.client, func(u *manager.Uploader) {
-		u.PartSize = multipartChunkSize
-	})
-	_, err = uploader.Upload(ctx, &s3.PutObjectInput{
+	partChecksums := withS3PartChecksums(blobPath, blobFile.Size(), s3PartSize(blobFile.Size(), b.partSize))
+	if _, err := b.uploader(func(u *manager.Uploader) {
+		u.ClientOptions = append(u.ClientOptions, partChecksums)
+	}).Upload(ctx, &s3.PutObjectInput{
 		Bucket:            aws.String(b.bucketName),
 		Key:               aws.String(blobObjectKey),
 		Body:              blobFile,
-		ChecksumAlgorithm: types.ChecksumAlgorithmCrc32,
-	})
-	if err != nil {
-		return nil, errors.Wrap(err, "upload blob to s3 backend")
+		ChecksumAlgorithm: types.ChecksumAlgorithmSha256,
+	}); err != nil {
+		// The object stored corrupted in a single part is removed, otherwise
+		// it's skipped as existing by the next upload, the parts of multipart
+		// upload are aborted by uploader.
+		var corrupted *partCorruptedError
+		if errors.As(err, &corrupted) {
+			if _, delErr := b.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+				Bucket: aws.String(b.bucketName),
+				Key:    aws.String(blobObjectKey),
+			}); delErr != nil {
+				logrus.WithError(delErr).Warnf("delete corrupted object %s", blobObjectKey)
+			}
+		}
+		return nil, errors.Wrapf(err, "upload blob %s to s3 backend", blobID)
 	}
 
 	logrus.Debugf("uploaded blob %s to s3 backend, costs %s", blobObjectKey, time.Since(start))
@@ -129,6 +162,25 @@ func (b *S3Backend) Upload(ctx context.Context, blobID, blobPath string, size in
 	return &desc, nil
 }
 
+// s3PartSize returns the part size of the blob in size uploaded by the
+// uploader with partSize, which is enlarged like the uploader to fit in the
+// maximum number of parts.
+func s3PartSize(size, partSize int64) int64 {
+	if size/partSize >= int64(manager.MaxUploadParts) {
+		return size/int64(manager.MaxUploadParts) + 1
+	}
+	return partSize
+}
+
+func (b *S3Backend) uploader(optFns ...func(*manager.Uploader)) *manager.Uploader {
+	return manager.NewUploader(b.client, append([]func(*manager.Uploader){func(u *manager.Uploader) {
+		u.PartSize = b.partSize
+		if b.concurrency > 0 {
+			u.Concurrency = b.concurrency
+		}
+	}}, optFns...)...)
+}
+
 func (b *S3Backend) Finalize(_ bool) error {
 	return nil
 }
@@ -160,6 +212,21 @@ func (b *S3Backend) blobObjectKey(blobID string) string {
 	return b.objectPrefix + blobID
 }
 
+// Remove deletes the blob object from bucket.
+func (b *S3Backend) Remove(blobID string) error {
+	objectKey := b.blobObjectKey(blobID)
+	_, err := b.client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
+		Bucket: &b.bucketName,
+		Key:    &objectKey,
+	})
+	return err
+}
+
+// ObjectKey returns the object key of blob in bucket.
+func (b *S3Backend) ObjectKey(blobID string) string {
+	return b.blobObjectKey(blobID)
+}
+
 func (b *S3Backend) Reader(blobID string) (io.ReadCloser, error) {
 	objectKey := b.blobObjectKey(blobID)
 	output, err := b.client.GetObject(context.TODO(), &s3.GetObjectInput{
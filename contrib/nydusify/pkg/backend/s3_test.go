@@ -24,7 +24,7 @@ func tempS3Backend() *S3Backend {
 		"scheme": "https",
 		"region": "region1"
 	}`
-	backend, _ := newS3Backend([]byte(s3ConfigJSON))
+	backend, _ := newS3Backend([]byte(s3ConfigJSON), Options{})
 	return backend
 }
 
@@ -38,6 +38,8 @@ func TestBlobObjectKey(t *testing.T) {
 	s3Backend := tempS3Backend()
 	blobObjectKey := s3Backend.blobObjectKey("111")
 	require.Equal(t, "blob111", blobObjectKey)
+	var locator ObjectLocator = s3Backend
+	require.Equal(t, "blob111", locator.ObjectKey("111"))
 }
 
 func TestNewS3Backend(t *testing.T) {
@@ -52,7 +54,7 @@ func TestNewS3Backend(t *testing.T) {
 		"region": "region1"
 	}`
 	require.True(t, json.Valid([]byte(s3ConfigJSON1)))
-	backend, err := newS3Backend([]byte(s3ConfigJSON1))
+	backend, err := newS3Backend([]byte(s3ConfigJSON1), Options{})
 	require.NoError(t, err)
 	require.Equal(t, "blob", backend.objectPrefix)
 	require.Equal(t, "test", backend.bucketName)
@@ -74,7 +76,7 @@ func TestNewS3Backend(t *testing.T) {
 		"scheme": "https",
 		"region": "region1",
 	}`
-	backend, err = newS3Backend([]byte(s3ConfigJSON2))
+	backend, err = newS3Backend([]byte(s3ConfigJSON2), Options{})
 	require.Error(t, err)
 	require.Contains(t, err.Error(), "parse S3 storage backend configuration")
 	require.Nil(t, backend)
@@ -90,7 +92,7 @@ func TestNewS3Backend(t *testing.T) {
 		"region": "region1"
 	}`
 	require.True(t, json.Valid([]byte(s3ConfigJSON3)))
-	backend, err = newS3Backend([]byte(s3ConfigJSON3))
+	backend, err = newS3Backend([]byte(s3ConfigJSON3), Options{})
 	require.NoError(t, err)
 	require.Equal(t, "blob", backend.objectPrefix)
 	require.Equal(t, "test", backend.bucketName)
@@ -112,7 +114,7 @@ func TestNewS3Backend(t *testing.T) {
 		"region": ""
 	}`
 	require.True(t, json.Valid([]byte(s3ConfigJSON4)))
-	backend, err = newS3Backend([]byte(s3ConfigJSON4))
+	backend, err = newS3Backend([]byte(s3ConfigJSON4), Options{})
 	require.Error(t, err)
 	require.Contains(t, err.Error(), "invalid S3 configuration: missing 'bucket_name' or 'region'")
 	require.Nil(t, backend)
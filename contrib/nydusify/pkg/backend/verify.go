@@ -0,0 +1,140 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go/middleware"
+	"github.com/pkg/errors"
+)
+
+// sumRange returns the hash of the range of file in path.
+func sumRange(path string, offset, size int64, h hash.Hash) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "open blob file")
+	}
+	defer file.Close()
+	if _, err := io.Copy(h, io.NewSectionReader(file, offset, size)); err != nil {
+		return nil, errors.Wrap(err, "read blob file")
+	}
+	return h.Sum(nil), nil
+}
+
+// verifyOSSPart compares the ETag of part stored in OSS, which is the MD5 of
+// part, with the part of blob file to catch the silent corruption before
+// completing the multipart upload.
+func verifyOSSPart(blobPath string, chunk oss.FileChunk, part oss.UploadPart) error {
+	etag := strings.Trim(part.ETag, `"`)
+	if etag == "" {
+		return nil
+	}
+	sum, err := sumRange(blobPath, chunk.Offset, chunk.Size, md5.New())
+	if err != nil {
+		return err
+	}
+	if expected := hex.EncodeToString(sum); !strings.EqualFold(etag, expected) {
+		return errors.Errorf("part %d is corrupted in backend, ETag %s, expected %s", chunk.Number, etag, expected)
+	}
+	return nil
+}
+
+// partCorruptedError is the error of the part verified corrupted in backend.
+type partCorruptedError struct {
+	number   int32
+	checksum string
+	expected string
+}
+
+func (err *partCorruptedError) Error() string {
+	return fmt.Sprintf("part %d is corrupted in backend, SHA256 %s, expected %s", err.number, err.checksum, err.expected)
+}
+
+// s3PartRange returns the range of part number in the blob in size split by
+// partSize, the part number starts from 1. The offset is computed in int64,
+// which exceeds 32-bit for the blobs larger than 4GB.
+func s3PartRange(number int32, size, partSize int64) (int64, int64) {
+	offset := int64(number-1) * partSize
+	length := partSize
+	if offset+length > size {
+		length = size - offset
+	}
+	return offset, length
+}
+
+// withS3PartChecksums sets the SHA256 checksum of each part uploaded to S3,
+// which is computed from the part of blob file split by partSize, or the
+// whole blob file if it's uploaded in a single part. S3 rejects the part
+// corrupted in transit as soon as it's uploaded, instead of completing the
+// multipart upload of corrupted object. The checksum of part stored in S3 is
+// compared too, the one not returned by backend is skipped. The ETag isn't
+// compared, which isn't the MD5 of part for the object encrypted by KMS.
+func withS3PartChecksums(blobPath string, size, partSize int64) func(*s3.Options) {
+	checksum := func(number int32, offset, length int64) (string, error) {
+		sum, err := sumRange(blobPath, offset, length, sha256.New())
+		if err != nil {
+			return "", errors.Wrapf(err, "checksum part %d", number)
+		}
+		return base64.StdEncoding.EncodeToString(sum), nil
+	}
+	verify := middleware.InitializeMiddlewareFunc("NydusPartChecksum", func(
+		ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler,
+	) (middleware.InitializeOutput, middleware.Metadata, error) {
+		var number int32
+		var expected string
+		var err error
+		switch input := in.Parameters.(type) {
+		case *s3.PutObjectInput:
+			number = 1
+			if expected, err = checksum(number, 0, size); err != nil {
+				return middleware.InitializeOutput{}, middleware.Metadata{}, err
+			}
+			input.ChecksumSHA256 = aws.String(expected)
+		case *s3.UploadPartInput:
+			number = aws.ToInt32(input.PartNumber)
+			offset, length := s3PartRange(number, size, partSize)
+			if expected, err = checksum(number, offset, length); err != nil {
+				return middleware.InitializeOutput{}, middleware.Metadata{}, err
+			}
+			input.ChecksumSHA256 = aws.String(expected)
+		default:
+			return next.HandleInitialize(ctx, in)
+		}
+
+		out, metadata, err := next.HandleInitialize(ctx, in)
+		if err != nil {
+			return out, metadata, err
+		}
+		var stored *string
+		switch output := out.Result.(type) {
+		case *s3.PutObjectOutput:
+			stored = output.ChecksumSHA256
+		case *s3.UploadPartOutput:
+			stored = output.ChecksumSHA256
+		}
+		if stored != nil && *stored != "" && *stored != expected {
+			return out, metadata, &partCorruptedError{number: number, checksum: *stored, expected: expected}
+		}
+		return out, metadata, nil
+	})
+	return func(o *s3.Options) {
+		o.APIOptions = append(o.APIOptions, func(stack *middleware.Stack) error {
+			return stack.Initialize.Add(verify, middleware.Before)
+		})
+	}
+}
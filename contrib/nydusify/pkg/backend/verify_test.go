@@ -0,0 +1,207 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTempBlob(t *testing.T, data []byte) string {
+	blobPath := filepath.Join(t.TempDir(), "blob")
+	require.NoError(t, os.WriteFile(blobPath, data, 0644))
+	return blobPath
+}
+
+func TestOSSVerifyPart(t *testing.T) {
+	data := []byte("nydus blob data")
+	sum := md5.Sum(data)
+	etag := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	var mutex sync.Mutex
+	aborted := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		query := r.URL.Query()
+		switch {
+		case r.Method == http.MethodPost && query.Has("uploads"):
+			fmt.Fprint(w, `<InitiateMultipartUploadResult><Bucket>test</Bucket><Key>blob</Key><UploadId>upload</UploadId></InitiateMultipartUploadResult>`)
+		case r.Method == http.MethodPut && query.Get("partNumber") != "":
+			mutex.Lock()
+			w.Header().Set("ETag", `"`+etag+`"`)
+			mutex.Unlock()
+		case r.Method == http.MethodDelete && query.Get("uploadId") != "":
+			mutex.Lock()
+			aborted = true
+			mutex.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+	}))
+	defer server.Close()
+
+	backend, err := newOSSBackend([]byte(`{"endpoint": "`+server.URL+`", "bucket_name": "test"}`), Options{})
+	require.NoError(t, err)
+	blobPath := writeTempBlob(t, data)
+	_, err = backend.Upload(context.Background(), "blob", blobPath, int64(len(data)), true)
+	require.NoError(t, err)
+	require.False(t, aborted)
+
+	// The part stored with a different ETag is corrupted.
+	mutex.Lock()
+	etag = "0123456789ABCDEF0123456789ABCDEF"
+	mutex.Unlock()
+	_, err = backend.Upload(context.Background(), "blob", blobPath, int64(len(data)), true)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "part 1 is corrupted in backend")
+	require.True(t, aborted)
+}
+
+func TestLargeBlobParts(t *testing.T) {
+	// The last parts of blob larger than 4GB are located beyond the 32-bit
+	// offsets, the blob file is sparse and only the tail is written.
+	const size = int64(5<<30 + 3)
+	tail := []byte("tail")
+	blobPath := filepath.Join(t.TempDir(), "blob")
+	file, err := os.Create(blobPath)
+	require.NoError(t, err)
+	require.NoError(t, file.Truncate(size))
+	_, err = file.WriteAt(tail, size-int64(len(tail)))
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	partSize := int64(multipartChunkSize)
+	parts := int32((size + partSize - 1) / partSize)
+	offset, length := s3PartRange(parts, size, partSize)
+	require.Equal(t, int64(parts-1)*partSize, offset)
+	require.Equal(t, size, offset+length)
+	require.Greater(t, offset, int64(1<<32-1))
+	require.Equal(t, int64(20<<30)/int64(10000)+1, s3PartSize(20<<30, 1<<20))
+
+	chunks, err := oss.SplitFileByPartSize(blobPath, partSize)
+	require.NoError(t, err)
+	require.Len(t, chunks, int(parts))
+	last := chunks[len(chunks)-1]
+	require.Equal(t, offset, last.Offset)
+	require.Equal(t, length, last.Size)
+
+	sum, err := sumRange(blobPath, size-int64(len(tail)), int64(len(tail)), md5.New())
+	require.NoError(t, err)
+	expected := md5.Sum(tail)
+	require.Equal(t, expected[:], sum)
+}
+
+func TestS3VerifyParts(t *testing.T) {
+	var mutex sync.Mutex
+	// corruptPart is the number of part corrupted in transit, storedChecksum
+	// overrides the checksum of stored part if not empty.
+	corruptPart, storedChecksum := "", ""
+	var parts []string
+	completed, aborted, deleted := false, false, false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mutex.Lock()
+		defer mutex.Unlock()
+		query := r.URL.Query()
+		switch {
+		case r.Method == http.MethodPost && query.Has("uploads"):
+			fmt.Fprint(w, `<InitiateMultipartUploadResult><Bucket>test</Bucket><Key>blob</Key><UploadId>upload</UploadId></InitiateMultipartUploadResult>`)
+		case r.Method == http.MethodPost && query.Get("uploadId") != "":
+			completed = true
+			fmt.Fprint(w, `<CompleteMultipartUploadResult><Bucket>test</Bucket><Key>blob</Key><ETag>"etag"</ETag></CompleteMultipartUploadResult>`)
+		case r.Method == http.MethodPut:
+			if corruptPart != "" && query.Get("partNumber") == corruptPart {
+				body = append(body, 'x')
+			}
+			sum := sha256.Sum256(body)
+			checksum := base64.StdEncoding.EncodeToString(sum[:])
+			if r.Header.Get("x-amz-checksum-sha256") != checksum {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `<Error><Code>BadDigest</Code><Message>checksum mismatch</Message></Error>`)
+				return
+			}
+			parts = append(parts, query.Get("partNumber"))
+			if storedChecksum != "" {
+				checksum = storedChecksum
+			}
+			w.Header().Set("ETag", `"etag"`)
+			w.Header().Set("x-amz-checksum-sha256", checksum)
+		case r.Method == http.MethodDelete && query.Get("uploadId") != "":
+			aborted = true
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodDelete:
+			deleted = true
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+	}))
+	defer server.Close()
+
+	backend, err := newS3Backend([]byte(`{
+		"endpoint": "`+strings.TrimPrefix(server.URL, "http://")+`",
+		"scheme": "http",
+		"bucket_name": "test",
+		"region": "region1",
+		"access_key_id": "testAK",
+		"access_key_secret": "testSK"
+	}`), Options{PartSize: 5 << 20})
+	require.NoError(t, err)
+	data := []byte("nydus blob data")
+	blobPath := writeTempBlob(t, data)
+	_, err = backend.Upload(context.Background(), "blob", blobPath, int64(len(data)), true)
+	require.NoError(t, err)
+	require.False(t, deleted)
+
+	// The object stored with a different checksum is corrupted, and removed.
+	mutex.Lock()
+	storedChecksum = "AAAAAA=="
+	mutex.Unlock()
+	_, err = backend.Upload(context.Background(), "blob", blobPath, int64(len(data)), true)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "part 1 is corrupted in backend")
+	require.True(t, deleted)
+
+	// The part corrupted in transit is rejected by backend on uploading it,
+	// and the multipart upload is aborted without completing.
+	data = bytes.Repeat([]byte("nydus blob data "), (6<<20)/16)
+	blobPath = writeTempBlob(t, data)
+	mutex.Lock()
+	parts, storedChecksum, corruptPart = nil, "", "2"
+	mutex.Unlock()
+	_, err = backend.Upload(context.Background(), "blob", blobPath, int64(len(data)), true)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "BadDigest")
+	require.NotContains(t, parts, "2")
+	require.True(t, aborted)
+	require.False(t, completed)
+
+	// The parts are verified one by one before completing.
+	mutex.Lock()
+	parts, corruptPart, aborted = nil, "", false
+	mutex.Unlock()
+	_, err = backend.Upload(context.Background(), "blob", blobPath, int64(len(data)), true)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"1", "2"}, parts)
+	require.True(t, completed)
+	require.False(t, aborted)
+}
@@ -29,6 +29,8 @@ type BuilderOption struct {
 	Compressor   string
 	ChunkSize    string
 	FsVersion    string
+	// RafsFeatures toggles the RAFS features, see ParseRafsFeatures.
+	RafsFeatures map[string]bool
 }
 
 type CompactOption struct {
@@ -108,9 +110,14 @@ func (builder *Builder) Run(option BuilderOption) error {
 			option.ParentBootstrapPath,
 		}
 	}
+	features := map[string]bool{}
+	for name, enabled := range option.RafsFeatures {
+		features[name] = enabled
+	}
 	if option.AlignedChunk {
-		args = append(args, "--aligned-chunk")
+		features["aligned-chunk"] = true
 	}
+	args = append(args, rafsFeatureArgs(features)...)
 	if option.ChunkDict != "" {
 		args = append(args, "--chunk-dict", option.ChunkDict)
 	}
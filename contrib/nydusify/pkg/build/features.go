@@ -0,0 +1,118 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package build
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// rafsFeature describes a RAFS feature toggled by the builder arguments.
+type rafsFeature struct {
+	// fsVersions are the RAFS versions supporting the feature.
+	fsVersions []string
+	// enabled is the default state of the feature in builder.
+	enabled bool
+	on      []string
+	off     []string
+}
+
+// rafsFeatures are the RAFS features known by `nydus-image create`.
+var rafsFeatures = map[string]rafsFeature{
+	"blob-toc": {
+		fsVersions: []string{"6"},
+		on:         []string{"--features", "blob-toc"},
+	},
+	"aligned-chunk": {
+		fsVersions: []string{"5"},
+		on:         []string{"--aligned-chunk"},
+	},
+}
+
+// ParseRafsFeatures parses the feature toggles formatted like `key=on` or
+// `key=off`, and validates them against the known features of fsVersion,
+// only the features having builder arguments to disable them take `key=off`.
+func ParseRafsFeatures(toggles []string, fsVersion string) (map[string]bool, error) {
+	features := map[string]bool{}
+	for _, toggle := range toggles {
+		key, value, ok := strings.Cut(strings.TrimSpace(toggle), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid RAFS feature %q, should be formatted like key=on or key=off", toggle)
+		}
+		feature, ok := rafsFeatures[key]
+		if !ok {
+			return nil, fmt.Errorf("unknown RAFS feature %s, possible values: %s", key, strings.Join(RafsFeatureNames(), ", "))
+		}
+		supported := false
+		for _, version := range feature.fsVersions {
+			if version == fsVersion {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			return nil, fmt.Errorf("RAFS feature %s is not supported by fs version %s", key, fsVersion)
+		}
+		switch value {
+		case "on":
+			features[key] = true
+		case "off":
+			// The features off by default have no builder arguments to
+			// disable them, `key=off` would be silently ignored.
+			if len(feature.off) == 0 {
+				return nil, fmt.Errorf("RAFS feature %s can't be disabled, possible value: on", key)
+			}
+			features[key] = false
+		default:
+			return nil, fmt.Errorf("invalid value %q of RAFS feature %s, possible values: on, off", value, key)
+		}
+	}
+	return features, nil
+}
+
+// RafsFeatureNames returns the sorted names of known RAFS features.
+func RafsFeatureNames() []string {
+	names := make([]string, 0, len(rafsFeatures))
+	for name := range rafsFeatures {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// RafsFeatureUsage describes the known RAFS features with their possible
+// values and the fs versions supporting them.
+func RafsFeatureUsage() string {
+	var usages []string
+	for _, name := range RafsFeatureNames() {
+		feature := rafsFeatures[name]
+		values := "on"
+		if len(feature.off) > 0 {
+			values = "on|off"
+		}
+		usages = append(usages, fmt.Sprintf("%s=%s (fs version %s)", name, values, strings.Join(feature.fsVersions, ", ")))
+	}
+	return strings.Join(usages, ", ")
+}
+
+// rafsFeatureArgs returns the builder arguments of the features differing
+// from the defaults, in the order of feature names.
+func rafsFeatureArgs(features map[string]bool) []string {
+	var args []string
+	for _, name := range RafsFeatureNames() {
+		enabled, ok := features[name]
+		if !ok {
+			continue
+		}
+		feature := rafsFeatures[name]
+		if enabled && !feature.enabled {
+			args = append(args, feature.on...)
+		} else if !enabled && feature.enabled {
+			args = append(args, feature.off...)
+		}
+	}
+	return args
+}
@@ -0,0 +1,66 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRafsFeatures(t *testing.T) {
+	features, err := ParseRafsFeatures([]string{"blob-toc=on"}, "6")
+	require.NoError(t, err)
+	require.Equal(t, map[string]bool{"blob-toc": true}, features)
+
+	for _, toggles := range [][]string{
+		{"unknown=on"},
+		{"blob-toc"},
+		{"blob-toc=yes"},
+		// Blob TOC is off by default and can't be disabled.
+		{"blob-toc=off"},
+		// Aligned chunk is only for RAFS v5.
+		{"aligned-chunk=on"},
+	} {
+		_, err := ParseRafsFeatures(toggles, "6")
+		require.Error(t, err, toggles[0])
+	}
+	_, err = ParseRafsFeatures([]string{"aligned-chunk=on"}, "5")
+	require.NoError(t, err)
+	// Blob TOC is only for RAFS v6.
+	_, err = ParseRafsFeatures([]string{"blob-toc=on"}, "5")
+	require.Error(t, err)
+
+	require.Equal(t, "aligned-chunk=on (fs version 5), blob-toc=on (fs version 6)", RafsFeatureUsage())
+}
+
+func TestBuilderRafsFeatures(t *testing.T) {
+	// The fake builder records its arguments line by line.
+	dir := t.TempDir()
+	argsPath := filepath.Join(dir, "args")
+	builderPath := filepath.Join(dir, "nydus-image")
+	require.NoError(t, os.WriteFile(builderPath, []byte("#!/bin/sh\nfor arg in \"$@\"; do echo \"$arg\"; done > "+argsPath+"\n"), 0755))
+
+	features, err := ParseRafsFeatures([]string{"aligned-chunk=on"}, "5")
+	require.NoError(t, err)
+	builder := NewBuilder(builderPath)
+	require.NoError(t, builder.Run(BuilderOption{
+		BootstrapPath:  filepath.Join(dir, "bootstrap"),
+		BlobPath:       filepath.Join(dir, "blob"),
+		OutputJSONPath: filepath.Join(dir, "output.json"),
+		RootfsPath:     dir,
+		WhiteoutSpec:   "oci",
+		FsVersion:      "5",
+		RafsFeatures:   features,
+	}))
+
+	data, err := os.ReadFile(argsPath)
+	require.NoError(t, err)
+	args := strings.Join(strings.Split(strings.TrimSpace(string(data)), "\n"), " ")
+	require.Contains(t, args, "--aligned-chunk")
+}
@@ -34,6 +34,14 @@ type Opt struct {
 	BackendType    string
 	BackendConfig  string
 	ExpectedArch   string
+	// ExpectedVariant selects the variant of ExpectedArch, e.g. `v7` of arm.
+	ExpectedVariant string
+	// DecompressLayers is the number of source layers pulled and
+	// decompressed at once, 0 means rule.WorkerCount.
+	DecompressLayers uint
+	// DecompressThreads is the number of threads decompressing each source
+	// layer, 0 means the default, see utils.SetDecompressThreads.
+	DecompressThreads int
 }
 
 // Checker validates Nydus image manifest, bootstrap and mounts filesystem
@@ -55,6 +63,7 @@ func New(opt Opt) (*Checker, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create parser")
 	}
+	targetParser.SetVariant(opt.ExpectedVariant)
 
 	var sourceParser *parser.Parser
 	if opt.Source != "" {
@@ -66,8 +75,13 @@ func New(opt Opt) (*Checker, error) {
 		if sourceParser == nil {
 			return nil, errors.Wrap(err, "failed to create parser")
 		}
+		sourceParser.SetVariant(opt.ExpectedVariant)
 	}
 
+	// The source layers are decompressed in the process, the threads are
+	// shared by the decompressions of all the layers.
+	utils.SetDecompressThreads(opt.DecompressThreads)
+
 	checker := &Checker{
 		Opt:          opt,
 		sourceParser: sourceParser,
@@ -145,11 +159,12 @@ func (checker *Checker) check(ctx context.Context) error {
 
 	rules := []rule.Rule{
 		&rule.ManifestRule{
-			SourceParsed:  sourceParsed,
-			TargetParsed:  targetParsed,
-			MultiPlatform: checker.MultiPlatform,
-			BackendType:   checker.BackendType,
-			ExpectedArch:  checker.ExpectedArch,
+			SourceParsed:    sourceParsed,
+			TargetParsed:    targetParsed,
+			MultiPlatform:   checker.MultiPlatform,
+			BackendType:     checker.BackendType,
+			ExpectedArch:    checker.ExpectedArch,
+			ExpectedVariant: checker.ExpectedVariant,
 		},
 		&rule.BootstrapRule{
 			Parsed:          targetParsed,
@@ -159,14 +174,15 @@ func (checker *Checker) check(ctx context.Context) error {
 			DebugOutputPath: filepath.Join(checker.WorkDir, "nydus_bootstrap_debug.json"),
 		},
 		&rule.FilesystemRule{
-			Source:          checker.Source,
-			SourceMountPath: filepath.Join(checker.WorkDir, "fs/source_mounted"),
-			SourceParsed:    sourceParsed,
-			SourcePath:      filepath.Join(checker.WorkDir, "fs/source"),
-			SourceRemote:    sourceRemote,
-			Target:          checker.Target,
-			TargetInsecure:  checker.TargetInsecure,
-			PlainHTTP:       checker.targetParser.Remote.IsWithHTTP(),
+			Source:           checker.Source,
+			SourceMountPath:  filepath.Join(checker.WorkDir, "fs/source_mounted"),
+			SourceParsed:     sourceParsed,
+			SourcePath:       filepath.Join(checker.WorkDir, "fs/source"),
+			SourceRemote:     sourceRemote,
+			Target:           checker.Target,
+			TargetInsecure:   checker.TargetInsecure,
+			PlainHTTP:        checker.targetParser.Remote.IsWithHTTP(),
+			LayerConcurrency: checker.DecompressLayers,
 			NydusdConfig: tool.NydusdConfig{
 				NydusdPath:     checker.NydusdPath,
 				BackendType:    checker.BackendType,
@@ -30,6 +30,10 @@ import (
 // WorkerCount specifies source layer pull concurrency
 var WorkerCount uint = 8
 
+// unpackLayer decompresses and unpacks the source layer, it's replaced in
+// test to observe the concurrency.
+var unpackLayer = utils.UnpackLayer
+
 // FilesystemRule compares file metadata and data in the two mountpoints:
 // Mounted by Nydusd for Nydus image,
 // Mounted by Overlayfs for OCI image.
@@ -43,6 +47,9 @@ type FilesystemRule struct {
 	Target          string
 	TargetInsecure  bool
 	PlainHTTP       bool
+	// LayerConcurrency is the number of source layers pulled and
+	// decompressed at once, 0 means WorkerCount.
+	LayerConcurrency uint
 }
 
 // Node records file metadata and file data hash.
@@ -170,7 +177,11 @@ func (rule *FilesystemRule) walk(rootfs string) (map[string]Node, error) {
 
 func (rule *FilesystemRule) pullSourceImage() (*tool.Image, error) {
 	layers := rule.SourceParsed.OCIImage.Manifest.Layers
-	worker := utils.NewWorkerPool(WorkerCount, uint(len(layers)))
+	concurrency := rule.LayerConcurrency
+	if concurrency == 0 {
+		concurrency = WorkerCount
+	}
+	worker := utils.NewWorkerPool(concurrency, uint(len(layers)))
 
 	for idx := range layers {
 		worker.Put(func(idx int) func() error {
@@ -181,7 +192,7 @@ func (rule *FilesystemRule) pullSourceImage() (*tool.Image, error) {
 					return errors.Wrap(err, "pull source image layers from the remote registry")
 				}
 
-				if err = utils.UnpackTargz(context.Background(), filepath.Join(rule.SourcePath, fmt.Sprintf("layer-%d", idx)), reader, true); err != nil {
+				if err = unpackLayer(context.Background(), filepath.Join(rule.SourcePath, fmt.Sprintf("layer-%d", idx)), reader, utils.LayerMediaType(layer), true); err != nil {
 					return errors.Wrap(err, "unpack source image layers")
 				}
 
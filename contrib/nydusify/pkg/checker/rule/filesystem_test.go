@@ -0,0 +1,106 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package rule
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/parser"
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/remote"
+)
+
+func TestPullSourceImageConcurrency(t *testing.T) {
+	blobs := map[digest.Digest][]byte{}
+	var layers []ocispec.Descriptor
+	for idx := 0; idx < 6; idx++ {
+		data := []byte(fmt.Sprintf("layer %d", idx))
+		desc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: digest.FromBytes(data), Size: int64(len(data))}
+		blobs[desc.Digest] = data
+		layers = append(layers, desc)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := blobs[digest.Digest(r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:])]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(data)
+	}))
+	defer server.Close()
+	sourceRemote, err := remote.New(strings.TrimPrefix(server.URL, "http://")+"/library/source:latest", func(bool) remotes.Resolver {
+		return docker.NewResolver(docker.ResolverOptions{
+			Hosts: docker.ConfigureDefaultRegistries(docker.WithPlainHTTP(docker.MatchAllHosts)),
+		})
+	})
+	require.NoError(t, err)
+
+	// The instrumented decompressor records the layers decompressed at once.
+	var mutex sync.Mutex
+	var running, maxRunning int
+	unpacked := map[string]bool{}
+	defer func(original func(context.Context, string, io.Reader, string, bool) error) {
+		unpackLayer = original
+	}(unpackLayer)
+	unpackLayer = func(_ context.Context, dst string, reader io.Reader, _ string, _ bool) error {
+		mutex.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mutex.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		data, err := io.ReadAll(reader)
+		mutex.Lock()
+		running--
+		unpacked[dst] = true
+		mutex.Unlock()
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(string(data), "layer ") {
+			return fmt.Errorf("unexpected layer data %q", data)
+		}
+		return nil
+	}
+
+	defer func(count uint) {
+		WorkerCount = count
+	}(WorkerCount)
+	WorkerCount = 3
+	for _, tc := range []struct {
+		concurrency uint
+		expected    int
+	}{
+		{concurrency: 2, expected: 2},
+		{concurrency: 0, expected: 3},
+	} {
+		maxRunning = 0
+		unpacked = map[string]bool{}
+		rule := &FilesystemRule{
+			SourceParsed:     &parser.Parsed{OCIImage: &parser.Image{Manifest: ocispec.Manifest{Layers: layers}}},
+			SourcePath:       t.TempDir(),
+			SourceRemote:     sourceRemote,
+			LayerConcurrency: tc.concurrency,
+		}
+		_, err := rule.pullSourceImage()
+		require.NoError(t, err)
+		require.Len(t, unpacked, len(layers))
+		require.Equal(t, tc.expected, maxRunning, tc.concurrency)
+	}
+}
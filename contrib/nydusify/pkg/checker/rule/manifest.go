@@ -22,6 +22,8 @@ type ManifestRule struct {
 	MultiPlatform bool
 	BackendType   string
 	ExpectedArch  string
+	// ExpectedVariant is the variant of ExpectedArch, empty matches any.
+	ExpectedVariant string
 }
 
 func (rule *ManifestRule) Name() string {
@@ -43,7 +45,8 @@ func (rule *ManifestRule) Validate() error {
 			if desc.Platform == nil {
 				continue
 			}
-			if desc.Platform.Architecture == rule.ExpectedArch && desc.Platform.OS == "linux" {
+			if desc.Platform.Architecture == rule.ExpectedArch && desc.Platform.OS == "linux" &&
+				utils.MatchPlatformVariant(desc.Platform, rule.ExpectedVariant) {
 				if utils.IsNydusPlatform(desc.Platform) {
 					foundNydusDesc = true
 				} else {
@@ -78,6 +81,36 @@ func (rule *ManifestRule) Validate() error {
 		}
 	}
 
+	// Check the source digest recorded by converter
+	sourceDigest := rule.TargetParsed.NydusImage.Manifest.Annotations[utils.ManifestNydusSourceDigest]
+	labels := rule.TargetParsed.NydusImage.Config.Config.Labels
+	if label, ok := labels[utils.ManifestNydusSourceDigest]; ok {
+		if label != sourceDigest {
+			return errors.Errorf("source digest %s in nydus image config mismatches %s in nydus manifest", label, sourceDigest)
+		}
+		// The label is added by converter, so ignore it on comparing config.
+		trimmed := make(map[string]string, len(labels))
+		for key, value := range labels {
+			if key != utils.ManifestNydusSourceDigest {
+				trimmed[key] = value
+			}
+		}
+		if len(trimmed) == 0 {
+			trimmed = nil
+		}
+		rule.TargetParsed.NydusImage.Config.Config.Labels = trimmed
+	}
+	if sourceDigest != "" {
+		logrus.Infof("Nydus image is converted from source manifest %s", sourceDigest)
+		if rule.SourceParsed.OCIImage != nil && rule.SourceParsed.OCIImage.Desc.Digest != "" &&
+			rule.SourceParsed.OCIImage.Desc.Digest.String() != sourceDigest {
+			return errors.Errorf(
+				"source digest %s recorded in nydus manifest mismatches the source manifest %s",
+				sourceDigest, rule.SourceParsed.OCIImage.Desc.Digest,
+			)
+		}
+	}
+
 	// Check Nydus image config with OCI image
 	if rule.SourceParsed.OCIImage != nil {
 
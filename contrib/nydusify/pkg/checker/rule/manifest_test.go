@@ -9,6 +9,7 @@ import (
 
 	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/parser"
 	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+	"github.com/opencontainers/go-digest"
 	"github.com/stretchr/testify/require"
 
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -168,3 +169,42 @@ func TestManifestRuleValidate_TargetLayer(t *testing.T) {
 	}
 	require.NoError(t, rule.Validate())
 }
+
+func TestManifestRuleValidate_SourceDigest(t *testing.T) {
+	sourceDigest := digest.FromString("source manifest")
+	source := &parser.Parsed{
+		OCIImage: &parser.Image{
+			Desc: ocispec.Descriptor{Digest: sourceDigest},
+			Config: ocispec.Image{
+				Config: ocispec.ImageConfig{Labels: map[string]string{"app": "test"}},
+			},
+		},
+	}
+	target := &parser.Parsed{
+		NydusImage: &parser.Image{
+			Manifest: ocispec.Manifest{
+				Annotations: map[string]string{utils.ManifestNydusSourceDigest: sourceDigest.String()},
+			},
+			Config: ocispec.Image{
+				Config: ocispec.ImageConfig{Labels: map[string]string{
+					"app":                           "test",
+					utils.ManifestNydusSourceDigest: sourceDigest.String(),
+				}},
+			},
+		},
+	}
+	rule := ManifestRule{
+		SourceParsed: source,
+		TargetParsed: target,
+	}
+	require.NoError(t, rule.Validate())
+
+	target.NydusImage.Config.Config.Labels[utils.ManifestNydusSourceDigest] = digest.FromString("other").String()
+	require.Error(t, rule.Validate())
+	require.Contains(t, rule.Validate().Error(), "in nydus image config mismatches")
+
+	delete(target.NydusImage.Config.Config.Labels, utils.ManifestNydusSourceDigest)
+	source.OCIImage.Desc.Digest = digest.FromString("other source manifest")
+	require.Error(t, rule.Validate())
+	require.Contains(t, rule.Validate().Error(), "mismatches the source manifest")
+}
@@ -8,6 +8,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 
 	"github.com/pkg/errors"
 )
@@ -74,3 +78,111 @@ func (p *Inspector) Inspect(option InspectOption) (interface{}, error) {
 	}
 	return nil, fmt.Errorf("not support method %d", option.Operation)
 }
+
+// ChunkInfo is a chunk of file data in nydus blob.
+type ChunkInfo struct {
+	BlobID           string
+	FileOffset       uint64
+	CompressedOffset uint64
+	CompressedSize   uint64
+	DecompressedSize uint64
+}
+
+// FileInfo is a regular file in bootstrap with its chunks, Compressors are
+// the compressors of the blobs keyed by blob ID.
+type FileInfo struct {
+	Size        uint64
+	Chunks      []ChunkInfo
+	Compressors map[string]string
+}
+
+var (
+	statModePattern  = regexp.MustCompile(`(?m)^Mode:\s+0x([0-9A-Fa-f]+)`)
+	statSizePattern  = regexp.MustCompile(`(?m)^Size:\s+(\d+)`)
+	statChunkPattern = regexp.MustCompile(`file offset: (\d+), chunk index: \d+\s+compressed size: (\d+), decompressed size: (\d+)\s+compressed offset: (\d+), decompressed offset: \d+\s+blob id: (\S+)`)
+	blobIDPattern    = regexp.MustCompile(`(?m)^Blob ID:\s+(\S+)`)
+	blobCompPattern  = regexp.MustCompile(`(?m)^Compressor:\s+(\S+)`)
+)
+
+// modeFormatMask and modeRegular are the file type bits of inode mode.
+const (
+	modeFormatMask = 0xF000
+	modeRegular    = 0x8000
+)
+
+// StatFile reads the chunks of the regular file specified by the absolute
+// path in bootstrap. The request mode of `nydus-image inspect` doesn't output
+// the chunks of file, so the commands are fed to its interactive mode, the
+// path components containing white spaces aren't supported.
+func (p *Inspector) StatFile(bootstrap, path string) (*FileInfo, error) {
+	components := strings.Split(strings.TrimPrefix(filepath.Clean("/"+path), "/"), "/")
+	if components[0] == "" {
+		return nil, fmt.Errorf("%s is not a regular file", path)
+	}
+	var commands strings.Builder
+	for idx, component := range components {
+		if strings.ContainsAny(component, " \t\n") {
+			return nil, fmt.Errorf("unsupported path with white spaces %s", path)
+		}
+		if idx < len(components)-1 {
+			fmt.Fprintf(&commands, "cd %s\n", component)
+		}
+	}
+	fmt.Fprintf(&commands, "stat %s\nblobs\nexit\n", components[len(components)-1])
+
+	cmd := exec.Command(p.binaryPath, "inspect", bootstrap)
+	cmd.Stdin = strings.NewReader(commands.String())
+	msg, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, errors.Wrap(err, string(msg))
+	}
+	return parseStatFile(string(msg), path)
+}
+
+// parseStatFile parses the output of `stat` and `blobs` commands in the
+// interactive mode of `nydus-image inspect`.
+func parseStatFile(output, path string) (*FileInfo, error) {
+	mode := statModePattern.FindStringSubmatch(output)
+	size := statSizePattern.FindStringSubmatch(output)
+	if mode == nil || size == nil {
+		return nil, fmt.Errorf("not found file %s in bootstrap", path)
+	}
+	fileMode, err := strconv.ParseUint(mode[1], 16, 32)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse mode of %s", path)
+	}
+	if fileMode&modeFormatMask != modeRegular {
+		return nil, fmt.Errorf("%s is not a regular file", path)
+	}
+
+	info := FileInfo{Compressors: map[string]string{}}
+	if info.Size, err = strconv.ParseUint(size[1], 10, 64); err != nil {
+		return nil, errors.Wrapf(err, "parse size of %s", path)
+	}
+	for _, match := range statChunkPattern.FindAllStringSubmatch(output, -1) {
+		var numbers [4]uint64
+		for idx := range numbers {
+			if numbers[idx], err = strconv.ParseUint(match[idx+1], 10, 64); err != nil {
+				return nil, errors.Wrapf(err, "parse chunk of %s", path)
+			}
+		}
+		info.Chunks = append(info.Chunks, ChunkInfo{
+			BlobID:           match[5],
+			FileOffset:       numbers[0],
+			CompressedSize:   numbers[1],
+			DecompressedSize: numbers[2],
+			CompressedOffset: numbers[3],
+		})
+	}
+
+	blobIDs := blobIDPattern.FindAllStringSubmatch(output, -1)
+	compressors := blobCompPattern.FindAllStringSubmatch(output, -1)
+	if len(blobIDs) != len(compressors) {
+		return nil, fmt.Errorf("unexpected blob table of bootstrap")
+	}
+	for idx := range blobIDs {
+		info.Compressors[blobIDs[idx][1]] = compressors[idx][1]
+	}
+
+	return &info, nil
+}
@@ -0,0 +1,69 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package tool
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const statOutput = `Inspecting RAFS :> Inspecting RAFS :> 
+Inode Number:       12
+Name:               "large"
+Size:               1048580
+Parent:             3
+Mode:               0x81A4
+Permissions:        644
+Nlink:              1
+UID:                0
+GID:                0
+Mtime:              0
+MtimeNsec:          0
+Blocks:             2048
+  Chunk list:
+        0 ->
+        file offset: 0, chunk index: 0
+        compressed size: 305, decompressed size: 1048576
+        compressed offset: 0, decompressed offset: 0
+        blob id: blob-1
+        chunk id: 1a2b
+    
+        1 ->
+        file offset: 1048576, chunk index: 1
+        compressed size: 4, decompressed size: 4
+        compressed offset: 305, decompressed offset: 1048576
+        blob id: blob-1
+        chunk id: 3c4d
+    
+Inspecting RAFS :> 
+Blob Index:             0
+Blob ID:                blob-1
+Raw Blob ID:            blob-1
+Blob Size:              309
+Compressor:             Zstd
+Digester:               Sha256
+Meta Compressor:        Lz4Block
+Inspecting RAFS :> `
+
+func TestParseStatFile(t *testing.T) {
+	info, err := parseStatFile(statOutput, "/usr/lib/large")
+	require.NoError(t, err)
+	require.Equal(t, &FileInfo{
+		Size: 1048580,
+		Chunks: []ChunkInfo{
+			{BlobID: "blob-1", FileOffset: 0, CompressedOffset: 0, CompressedSize: 305, DecompressedSize: 1048576},
+			{BlobID: "blob-1", FileOffset: 1048576, CompressedOffset: 305, CompressedSize: 4, DecompressedSize: 4},
+		},
+		Compressors: map[string]string{"blob-1": "Zstd"},
+	}, info)
+
+	_, err = parseStatFile("Inspecting RAFS :> Inspecting RAFS :> ", "/not-exist")
+	require.ErrorContains(t, err, "not found file /not-exist")
+
+	dirOutput := "\nInode Number: 3\nSize: 4096\nMode: 0x41ED\n"
+	_, err = parseStatFile(dirOutput, "/usr")
+	require.ErrorContains(t, err, "/usr is not a regular file")
+}
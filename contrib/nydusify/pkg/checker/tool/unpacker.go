@@ -0,0 +1,57 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package tool
+
+import (
+	"os/exec"
+
+	"github.com/pkg/errors"
+)
+
+type UnpackOption struct {
+	BootstrapPath string
+	// ConfigPath is the nydusd style config file which describes the
+	// storage backend hosting the data blobs.
+	ConfigPath string
+	// BlobDir is the local directory hosting the data blobs, it
+	// conflicts with ConfigPath.
+	BlobDir    string
+	OutputPath string
+}
+
+type Unpacker struct {
+	binaryPath string
+}
+
+func NewUnpacker(binaryPath string) *Unpacker {
+	return &Unpacker{binaryPath: binaryPath}
+}
+
+// Unpack calls `nydus-image unpack` to reassemble the files of Nydus
+// image from the chunks in data blobs and output them to a tar file.
+func (unpacker *Unpacker) Unpack(option UnpackOption) error {
+	args := []string{
+		"unpack",
+		"--log-level",
+		"warn",
+		"--bootstrap",
+		option.BootstrapPath,
+		"--output",
+		option.OutputPath,
+	}
+	if option.ConfigPath != "" {
+		args = append(args, "--config", option.ConfigPath)
+	} else if option.BlobDir != "" {
+		args = append(args, "--blob-dir", option.BlobDir)
+	}
+
+	cmd := exec.Command(unpacker.binaryPath, args...)
+	msg, err := cmd.CombinedOutput()
+	if err != nil {
+		return errors.Wrap(err, string(msg))
+	}
+
+	return nil
+}
@@ -24,6 +24,8 @@ type Opt struct {
 	SourceInsecure bool
 	NydusImagePath string
 	ExpectedArch   string
+	// ExpectedVariant selects the variant of ExpectedArch, e.g. `v7` of arm.
+	ExpectedVariant string
 }
 
 // Generator generates chunkdict by deduplicating multiple nydus images
@@ -47,6 +49,7 @@ func New(opt Opt) (*Generator, error) {
 		if err != nil {
 			return nil, errors.Wrap(err, "Failed to create parser")
 		}
+		sourceParser.SetVariant(opt.ExpectedVariant)
 	}
 
 	generator := &Generator{
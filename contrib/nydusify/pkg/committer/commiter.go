@@ -25,6 +25,7 @@ import (
 	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/committer/diff"
 	parserPkg "github.com/dragonflyoss/nydus/contrib/nydusify/pkg/parser"
 	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/provider"
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/remote"
 	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
 	"github.com/dustin/go-humanize"
 	"github.com/opencontainers/go-digest"
@@ -49,12 +50,22 @@ type Opt struct {
 
 	WithPaths    []string
 	WithoutPaths []string
+
+	// StreamPush compresses and streams the bootstrap layer to registry in
+	// one pass without staging it in work directory, the layer is uploaded
+	// without Content-Length, or in the chunks of StreamChunkSize buffered
+	// in memory if it's greater than 0 for the registries requiring it.
+	StreamPush      bool
+	StreamChunkSize int64
 }
 
 type Committer struct {
 	workDir string
 	builder string
 	manager *Manager
+
+	streamPush      bool
+	streamChunkSize int64
 }
 
 func NewCommitter(opt Opt) (*Committer, error) {
@@ -75,6 +86,9 @@ func NewCommitter(opt Opt) (*Committer, error) {
 		workDir: workDir,
 		builder: opt.NydusImagePath,
 		manager: cm,
+
+		streamPush:      opt.StreamPush,
+		streamChunkSize: opt.StreamChunkSize,
 	}, nil
 }
 
@@ -411,82 +425,116 @@ func (cm *Committer) pushManifest(
 	}
 
 	// Push bootstrap layer
+	commitBlobs := []string{}
+	for idx := range mountBlobs {
+		mountBlob := mountBlobs[idx]
+		commitBlobs = append(commitBlobs, mountBlob.Desc.Digest.String())
+	}
+	commitBlobs = append(commitBlobs, upperBlob.Desc.Digest.String())
+
+	bootstrapDesc, err := cm.pushBootstrap(ctx, remoter, bootstrapName, map[string]string{
+		converter.LayerAnnotationFSVersion:      fsversion,
+		converter.LayerAnnotationNydusBootstrap: "true",
+		utils.LayerAnnotationNydusCommitBlobs:   strings.Join(commitBlobs, ","),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Push image manifest
+	layers := lowerBlobLayers
+	for idx := range mountBlobs {
+		mountBlob := mountBlobs[idx]
+		layers = append(layers, mountBlob.Desc)
+	}
+	layers = append(layers, upperBlob.Desc)
+	layers = append(layers, *bootstrapDesc)
+
+	nydusImage.Manifest.Config = *configDesc
+	nydusImage.Manifest.Layers = layers
+
+	manifestBytes, manifestDesc, err := cm.makeDesc(nydusImage.Manifest, nydusImage.Desc)
+	if err != nil {
+		return errors.Wrap(err, "make config desc")
+	}
+	if err := remoter.Push(ctx, *manifestDesc, false, bytes.NewReader(manifestBytes)); err != nil {
+		return errors.Wrap(err, "push image manifest")
+	}
+
+	return nil
+}
+
+// pushBootstrap compresses the bootstrap tar in work directory to the
+// bootstrap layer with annotations, and pushes it by remoter. The layer is
+// compressed to work directory before pushing, or streamed to registry on
+// the fly if streamPush.
+func (cm *Committer) pushBootstrap(ctx context.Context, remoter *remote.Remote, bootstrapName string, annotations map[string]string) (*ocispec.Descriptor, error) {
 	bootstrapTarPath := filepath.Join(cm.workDir, bootstrapName)
 	bootstrapTar, err := os.Open(bootstrapTarPath)
 	if err != nil {
-		return errors.Wrap(err, "open bootstrap tar file")
+		return nil, errors.Wrap(err, "open bootstrap tar file")
+	}
+	defer bootstrapTar.Close()
+
+	if cm.streamPush {
+		reader, writer := io.Pipe()
+		go func() {
+			gzWriter := gzip.NewWriter(writer)
+			if _, err := io.Copy(gzWriter, bootstrapTar); err != nil {
+				writer.CloseWithError(errors.Wrap(err, "compress bootstrap tar to tar.gz"))
+				return
+			}
+			writer.CloseWithError(gzWriter.Close())
+		}()
+		defer reader.Close()
+		bootstrapDesc, err := remoter.PushStream(ctx, ocispec.Descriptor{
+			MediaType:   ocispec.MediaTypeImageLayerGzip,
+			Annotations: annotations,
+		}, reader, cm.streamChunkSize)
+		if err != nil {
+			return nil, errors.Wrap(err, "push bootstrap layer")
+		}
+		return bootstrapDesc, nil
 	}
 
 	bootstrapTarGzPath := filepath.Join(cm.workDir, bootstrapName+".gz")
 	bootstrapTarGz, err := os.Create(bootstrapTarGzPath)
 	if err != nil {
-		return errors.Wrap(err, "create bootstrap tar.gz file")
+		return nil, errors.Wrap(err, "create bootstrap tar.gz file")
 	}
 	defer bootstrapTarGz.Close()
 
 	digester := digest.SHA256.Digester()
 	gzWriter := gzip.NewWriter(io.MultiWriter(bootstrapTarGz, digester.Hash()))
 	if _, err := io.Copy(gzWriter, bootstrapTar); err != nil {
-		return errors.Wrap(err, "compress bootstrap tar to tar.gz")
+		return nil, errors.Wrap(err, "compress bootstrap tar to tar.gz")
 	}
 	if err := gzWriter.Close(); err != nil {
-		return errors.Wrap(err, "close gzip writer")
+		return nil, errors.Wrap(err, "close gzip writer")
 	}
 
 	ra, err := local.OpenReader(bootstrapTarGzPath)
 	if err != nil {
-		return errors.Wrap(err, "open reader for upper blob")
+		return nil, errors.Wrap(err, "open reader for upper blob")
 	}
 	defer ra.Close()
 
-	commitBlobs := []string{}
-	for idx := range mountBlobs {
-		mountBlob := mountBlobs[idx]
-		commitBlobs = append(commitBlobs, mountBlob.Desc.Digest.String())
-	}
-	commitBlobs = append(commitBlobs, upperBlob.Desc.Digest.String())
-
 	bootstrapDesc := ocispec.Descriptor{
-		Digest:    digester.Digest(),
-		Size:      ra.Size(),
-		MediaType: ocispec.MediaTypeImageLayerGzip,
-		Annotations: map[string]string{
-			converter.LayerAnnotationFSVersion:      fsversion,
-			converter.LayerAnnotationNydusBootstrap: "true",
-			utils.LayerAnnotationNydusCommitBlobs:   strings.Join(commitBlobs, ","),
-		},
+		Digest:      digester.Digest(),
+		Size:        ra.Size(),
+		MediaType:   ocispec.MediaTypeImageLayerGzip,
+		Annotations: annotations,
 	}
 
 	bootstrapRc, err := os.Open(bootstrapTarGzPath)
 	if err != nil {
-		return errors.Wrapf(err, "open bootstrap %s", bootstrapTarGzPath)
+		return nil, errors.Wrapf(err, "open bootstrap %s", bootstrapTarGzPath)
 	}
 	defer bootstrapRc.Close()
 	if err := remoter.Push(ctx, bootstrapDesc, true, bootstrapRc); err != nil {
-		return errors.Wrap(err, "push bootstrap layer")
-	}
-
-	// Push image manifest
-	layers := lowerBlobLayers
-	for idx := range mountBlobs {
-		mountBlob := mountBlobs[idx]
-		layers = append(layers, mountBlob.Desc)
-	}
-	layers = append(layers, upperBlob.Desc)
-	layers = append(layers, bootstrapDesc)
-
-	nydusImage.Manifest.Config = *configDesc
-	nydusImage.Manifest.Layers = layers
-
-	manifestBytes, manifestDesc, err := cm.makeDesc(nydusImage.Manifest, nydusImage.Desc)
-	if err != nil {
-		return errors.Wrap(err, "make config desc")
+		return nil, errors.Wrap(err, "push bootstrap layer")
 	}
-	if err := remoter.Push(ctx, *manifestDesc, false, bytes.NewReader(manifestBytes)); err != nil {
-		return errors.Wrap(err, "push image manifest")
-	}
-
-	return nil
+	return &bootstrapDesc, nil
 }
 
 func (cm *Committer) makeDesc(x interface{}, oldDesc ocispec.Descriptor) ([]byte, *ocispec.Descriptor, error) {
@@ -0,0 +1,84 @@
+// Copyright 2024 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package committer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/remote"
+)
+
+func TestPushBootstrapStream(t *testing.T) {
+	var uploaded []byte
+	var pushed digest.Digest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		location := "/v2/library/test/blobs/uploads/1"
+		switch r.Method {
+		case http.MethodPost:
+			w.Header().Set("Location", location)
+			w.WriteHeader(http.StatusAccepted)
+		case http.MethodPatch:
+			// The layer is streamed without Content-Length.
+			require.Equal(t, int64(-1), r.ContentLength)
+			uploaded, _ = io.ReadAll(r.Body)
+			w.Header().Set("Location", location)
+			w.WriteHeader(http.StatusAccepted)
+		case http.MethodPut:
+			pushed = digest.Digest(r.URL.Query().Get("digest"))
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	hostsFunc := func(bool) docker.RegistryHosts {
+		return docker.ConfigureDefaultRegistries(docker.WithPlainHTTP(docker.MatchAllHosts))
+	}
+	remoter, err := remote.New(strings.TrimPrefix(server.URL, "http://")+"/library/test:latest", func(insecure bool) remotes.Resolver {
+		return docker.NewResolver(docker.ResolverOptions{Hosts: hostsFunc(insecure)})
+	})
+	require.NoError(t, err)
+	remoter.SetRegistryHosts(hostsFunc)
+
+	workDir := t.TempDir()
+	bootstrap := bytes.Repeat([]byte("bootstrap"), 1024)
+	require.NoError(t, os.WriteFile(filepath.Join(workDir, "bootstrap-merged.tar"), bootstrap, 0644))
+	cm := &Committer{workDir: workDir, streamPush: true}
+	annotations := map[string]string{"key": "value"}
+	desc, err := cm.pushBootstrap(context.Background(), remoter, "bootstrap-merged.tar", annotations)
+	require.NoError(t, err)
+	require.Equal(t, digest.FromBytes(uploaded), desc.Digest)
+	require.Equal(t, pushed, desc.Digest)
+	require.Equal(t, int64(len(uploaded)), desc.Size)
+	require.Equal(t, ocispec.MediaTypeImageLayerGzip, desc.MediaType)
+	require.Equal(t, annotations, desc.Annotations)
+
+	reader, err := gzip.NewReader(bytes.NewReader(uploaded))
+	require.NoError(t, err)
+	data, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, bootstrap, data)
+
+	// The compressed layer isn't staged in work directory.
+	entries, err := os.ReadDir(workDir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "bootstrap-merged.tar", entries[0].Name())
+}
@@ -0,0 +1,49 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/pkg/errors"
+)
+
+// checkAllowedRegistries rejects the references of conversion outside the
+// allowed registries, an empty list allows all the registries. The registry
+// is matched by the host of normalized reference, e.g. `docker.io` for the
+// Docker Hub images.
+func checkAllowedRegistries(opt Opt) error {
+	if len(opt.AllowedRegistries) == 0 {
+		return nil
+	}
+	allowed := map[string]bool{}
+	for _, registry := range opt.AllowedRegistries {
+		allowed[registry] = true
+	}
+
+	refs := [][2]string{
+		{"source", opt.Source},
+		{"target", opt.Target},
+		{"cache", opt.CacheRef},
+		{"chunk dict", opt.ChunkDictRef},
+		{"base nydus", opt.BaseNydus},
+	}
+	for _, target := range opt.ExtraTargets {
+		refs = append(refs, [2]string{"extra target", target})
+	}
+	for _, item := range refs {
+		kind, ref := item[0], item[1]
+		if ref == "" {
+			continue
+		}
+		named, err := docker.ParseDockerRef(ref)
+		if err != nil {
+			return errors.Wrapf(err, "parse %s reference %s", kind, ref)
+		}
+		if registry := docker.Domain(named); !allowed[registry] {
+			return errors.Errorf("%s %s is in registry %s, which isn't in the allowed registries %v", kind, ref, registry, opt.AllowedRegistries)
+		}
+	}
+	return nil
+}
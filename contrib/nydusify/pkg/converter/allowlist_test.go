@@ -0,0 +1,52 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAllowedRegistries(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	workDir := filepath.Join(t.TempDir(), "work")
+	opt := Opt{
+		WorkDir:           workDir,
+		Source:            "untrusted.example.com/library/busybox:latest",
+		Target:            host + "/library/busybox:nydus",
+		AllowedRegistries: []string{host, "docker.io"},
+	}
+	err := Convert(context.Background(), opt)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "source untrusted.example.com/library/busybox:latest is in registry untrusted.example.com, which isn't in the allowed registries")
+	// The conversion is rejected before any network call.
+	require.Equal(t, int32(0), atomic.LoadInt32(&requests))
+	_, err = os.Stat(workDir)
+	require.True(t, os.IsNotExist(err))
+
+	// The Docker Hub image is matched by the normalized registry host.
+	opt.Source = "busybox:latest"
+	opt.ExtraTargets = []string{"ghcr.io/library/busybox:nydus"}
+	err = Convert(context.Background(), opt)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "extra target ghcr.io/library/busybox:nydus is in registry ghcr.io")
+	require.NoError(t, checkAllowedRegistries(Opt{Source: "busybox", Target: host + "/busybox:nydus", AllowedRegistries: opt.AllowedRegistries}))
+	require.NoError(t, checkAllowedRegistries(Opt{Source: "busybox", Target: "ghcr.io/busybox:nydus"}))
+}
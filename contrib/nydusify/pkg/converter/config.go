@@ -6,6 +6,13 @@ package converter
 
 import (
 	"strconv"
+	"strings"
+
+	"github.com/containerd/nydus-snapshotter/pkg/backend"
+	nydusify "github.com/containerd/nydus-snapshotter/pkg/converter"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/converter/provider"
 )
 
 func getConfig(opt Opt) map[string]string {
@@ -22,10 +29,16 @@ func getConfig(opt Opt) map[string]string {
 	cfg["docker2oci"] = strconv.FormatBool(opt.Docker2OCI)
 	cfg["merge_manifest"] = strconv.FormatBool(opt.MergePlatform)
 	cfg["oci_ref"] = strconv.FormatBool(opt.OCIRef)
-	cfg["with_referrer"] = strconv.FormatBool(opt.WithReferrer)
+	cfg["with_referrer"] = strconv.FormatBool(opt.WithReferrer || opt.HarborAccessory)
+	cfg["encrypt_recipients"] = strings.Join(opt.EncryptRecipients, ",")
 
 	cfg["prefetch_patterns"] = opt.PrefetchPatterns
 	cfg["compressor"] = opt.Compressor
+	if opt.Compressor == provider.CompressorAuto {
+		// The layers chosen to be uncompressed are built before conversion,
+		// see provider.SetAutoCompressor.
+		cfg["compressor"] = "zstd"
+	}
 	cfg["fs_version"] = opt.FsVersion
 	cfg["fs_align_chunk"] = strconv.FormatBool(opt.FsAlignChunk)
 	cfg["fs_chunk_size"] = opt.ChunkSize
@@ -37,3 +50,42 @@ func getConfig(opt Opt) map[string]string {
 
 	return cfg
 }
+
+// getPackOption returns the option of the nydus driver building the layers
+// by driver config cfg, for the layers built by nydusify with compressors
+// other than the one of driver, see provider.SetAutoCompressor and
+// provider.SetLayerCompressors.
+func getPackOption(opt Opt, cfg map[string]string) (*nydusify.PackOption, error) {
+	// The chunk dict bootstrap is pulled by driver on converting, and the
+	// OCI ref blobs aren't compressed by builder.
+	if opt.ChunkDictRef != "" {
+		return nil, errors.New("per-layer compressors aren't supported with chunk dict")
+	}
+	if opt.OCIRef {
+		return nil, errors.New("per-layer compressors aren't supported with OCI ref")
+	}
+
+	fsVersion := cfg["fs_version"]
+	if fsVersion == "" {
+		fsVersion = "6"
+	}
+	packOpt := &nydusify.PackOption{
+		WorkDir:          cfg["work_dir"],
+		BuilderPath:      cfg["builder"],
+		FsVersion:        fsVersion,
+		PrefetchPatterns: cfg["prefetch_patterns"],
+		Compressor:       cfg["compressor"],
+		AlignedChunk:     opt.FsAlignChunk,
+		ChunkSize:        cfg["fs_chunk_size"],
+		BatchSize:        cfg["batch_size"],
+		Encrypt:          len(opt.EncryptRecipients) != 0,
+	}
+	if opt.BackendType != "" && opt.BackendConfig != "" {
+		blobBackend, err := backend.NewBackend(opt.BackendType, []byte(opt.BackendConfig), opt.BackendForcePush)
+		if err != nil {
+			return nil, errors.Wrap(err, "create blob backend")
+		}
+		packOpt.Backend = blobBackend
+	}
+	return packOpt, nil
+}
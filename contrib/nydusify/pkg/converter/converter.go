@@ -6,12 +6,24 @@ package converter
 
 import (
 	"context"
+	"encoding/json"
 	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/containerd/log"
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/backend"
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/checker/tool"
 	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/converter/provider"
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/kms"
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+	humanize "github.com/dustin/go-humanize"
 	"github.com/goharbor/acceleration-service/pkg/converter"
 	"github.com/goharbor/acceleration-service/pkg/platformutil"
+	"github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 )
 
@@ -23,15 +35,47 @@ type Opt struct {
 	Source       string
 	Target       string
 	ChunkDictRef string
+	// ExtraTargets are the additional target references, the converted
+	// image is pushed to them after Target without being built again.
+	ExtraTargets []string
 
 	SourceInsecure    bool
 	TargetInsecure    bool
 	ChunkDictInsecure bool
 
+	// SourceSocket, TargetSocket, ChunkDictSocket and CacheSocket are the
+	// unix domain socket endpoints of registry, like `unix:///run/registry.sock`.
+	// They apply to the registry requests only, the storage backend of
+	// BackendType is accessed over TCP.
+	SourceSocket    string
+	TargetSocket    string
+	ChunkDictSocket string
+	CacheSocket     string
+
 	CacheRef        string
 	CacheInsecure   bool
 	CacheVersion    string
 	CacheMaxRecords uint
+	CachePolicy     string
+	// NoCache rebuilds all layers without reading or writing the remote
+	// cache and the build cache directory. CacheReadOnly only reads the
+	// remote cache without pushing the cache records back.
+	NoCache       bool
+	CacheReadOnly bool
+	// BuildCacheDir persists the blobs of local content store, including
+	// the pulled source layers and the built nydus blobs, to be reused by
+	// subsequent conversions. The content metadata isn't persisted, it's
+	// rebuilt from the existing blobs in each conversion.
+	BuildCacheDir string
+	// MaxDiskUsage limits the disk usage of the work directory and content
+	// directory in bytes, including the temporary files of builder, see
+	// provider.SetMaxDiskUsage, zero means no limitation.
+	MaxDiskUsage int64
+	// Resume keeps the content store and a per-layer checkpoint in WorkDir
+	// if the conversion fails or gets killed, the conversion restarted with
+	// the same source, target and build options skips the layers pulled,
+	// built and pushed in checkpoint.
+	Resume bool
 
 	BackendType      string
 	BackendConfig    string
@@ -45,21 +89,230 @@ type Opt struct {
 	ChunkSize        string
 	BatchSize        string
 	PrefetchPatterns string
+	MaxBlobSize      int64
 	OCIRef           bool
 	WithReferrer     bool
+	// EncryptRecipients encrypts the bootstrap layers of target image for
+	// the ocicrypt recipients, e.g. `jwe:/path/to/pubkey.pem`, or
+	// `provider:kms:<key-id>` to wrap the data keys by KMS.
+	EncryptRecipients []string
+	// KMS wraps the data keys for the `provider:kms:<key-id>` recipients,
+	// see kms.Register.
+	KMS kms.KMS
+	// HarborAccessory pushes the target image as the accessory of source
+	// image in Harbor, it implies WithReferrer.
+	HarborAccessory bool
+	// SourceDigestLabel records the source manifest digest, which is always
+	// annotated in nydus manifest, into the labels of nydus image config.
+	SourceDigestLabel bool
+	// StripHistory removes the history inherited from source image in nydus
+	// image config, which may leak the build commands.
+	StripHistory bool
+	// HistoryComment appends a history entry of the comment in nydus image
+	// config to note the conversion, empty means not to append.
+	HistoryComment string
+	// SkipBlobPush skips pushing the nydus blob layers, which are uploaded
+	// into target repository separately, and checks they exist instead.
+	SkipBlobPush bool
+	// CheckBlobReferences checks every blob referenced by the bootstrap is
+	// pushed in target image or exists in the storage backend before
+	// publishing the manifest, see provider.SetBlobReferenceCheck.
+	CheckBlobReferences bool
+	// ExistingTargetPolicy is the policy for the target tag existing before
+	// conversion: overwrite, skip or error, see provider.CheckExistingTarget.
+	ExistingTargetPolicy string
+	// CheckPushPermission probes the push permission of target repository
+	// before pulling and building, see provider.CheckPushPermission.
+	CheckPushPermission bool
+	// MaxSourceAge refuses the source image created earlier than the age,
+	// zero means no limitation, see provider.CheckSourceAge.
+	MaxSourceAge time.Duration
+	// MountFrom is the repository on target registry to mount the blobs
+	// from before uploading them, see provider.SetMountFrom.
+	MountFrom string
+	// BaseNydus is the nydus image converted from the base image of source
+	// with the same build options, the source layers shared with the base
+	// image reuse its blobs instead of building, see
+	// provider.LoadBaseNydus.
+	BaseNydus string
+	// ReferenceBaseBlobs references the blobs of BaseNydus in registry by
+	// digest instead of fetching and pushing them again, see
+	// provider.SetReferenceBaseBlobs.
+	ReferenceBaseBlobs bool
+	// DigestAlgorithm is the digest algorithm of the index, manifests,
+	// configs and bootstrap layers in target image: sha256 or sha512.
+	DigestAlgorithm string
+	// LayerNameTemplate is the text/template to name the nydus blob and
+	// bootstrap layers in target image, see provider.LayerName.
+	LayerNameTemplate string
+	// DialTimeout and ReadTimeout limit the connection establishment and
+	// each read from registry, zero ReadTimeout means no limitation.
+	DialTimeout time.Duration
+	ReadTimeout time.Duration
+	// ManifestTimeout and BlobTimeout limit each manifest request and blob
+	// request to registry respectively, zero means no limitation, see
+	// provider.SetRegistryTimeouts.
+	ManifestTimeout time.Duration
+	BlobTimeout     time.Duration
+	// MinConcurrency and MaxConcurrency bound the pulling and pushing
+	// concurrency adapted to the observed latency and errors of registry,
+	// zero MaxConcurrency uses the static concurrency.
+	MinConcurrency int
+	MaxConcurrency int
+	// HTTPVersion is the HTTP version of registry transport, 1.1 or 2, and
+	// HTTP2MaxConcurrentStreams limits the requests multiplexed to a
+	// registry host over HTTP/2, zero means the limit of registry only.
+	HTTPVersion               string
+	HTTP2MaxConcurrentStreams uint32
+	// BootstrapCompressor recompresses the bootstrap layers of target image
+	// with none, gzip or zstd, empty keeps the gzip layers built.
+	BootstrapCompressor string
+	// BlobMediaType overrides the media type of nydus blob layers in target
+	// image, see provider.BlobMediaTypes.
+	BlobMediaType string
+	// ManifestFormat converts the target image to the OCI or Docker media
+	// types, empty keeps the format of source image, see
+	// provider.SetManifestFormat.
+	ManifestFormat string
+	// BlobOrder orders the nydus blob layers in target manifest by digest,
+	// layer, size or access, see provider.BlobOrders, empty keeps the order.
+	BlobOrder string
+	// ArtifactTypePolicy is the policy for the artifact type declared by
+	// OCI source manifest: keep or nydus, see provider.ArtifactTypePolicies.
+	ArtifactTypePolicy string
+	// GenerateSBOM pushes an SPDX SBOM of the packages in source image as
+	// the OCI referrer of each nydus manifest.
+	GenerateSBOM bool
+	// LazyIndex pushes the lazy-loading index of blobs and their chunk maps
+	// as the OCI referrer of each nydus manifest, see provider.SetLazyIndex.
+	LazyIndex bool
+	// FileManifest pushes the manifest of the file paths and sizes in source
+	// image as the OCI referrer of each nydus manifest, for tuning the
+	// prefetch later.
+	FileManifest bool
+	// ExcludePaths are the globs of absolute paths removed from the source
+	// layers before building, see provider.SetExcludePaths.
+	ExcludePaths []string
+	// IncludeGlobs and ExcludeGlobs filter the files in source layers
+	// before building, see provider.SetGlobFilter.
+	IncludeGlobs []string
+	ExcludeGlobs []string
+	// TarNormalization normalizes the metadata of entries in source layers
+	// before building, nil means not to normalize, see
+	// provider.TarNormalization.
+	TarNormalization *provider.TarNormalization
+	// AllowedRegistries restricts the source, target, cache and chunk dict
+	// references to the registry hosts, empty means no restriction.
+	AllowedRegistries []string
+	// Session shares the source resolution and the converted images across
+	// the conversions in process, the source resolved to a digest converted
+	// with the same options in session is tagged in the target repository
+	// without building, see provider.Session. The extra targets and output
+	// JSON are skipped for such conversions.
+	Session *provider.Session
+	// CredentialProvider resolves the registry credentials, defaults to
+	// the provider reading docker config.
+	CredentialProvider CredentialProvider
+	// SourceAuth and TargetAuth are the credentials in `username:password`
+	// format to pull the source and to push the target respectively, they
+	// take precedence over CredentialProvider.
+	SourceAuth string
+	TargetAuth string
+	// MountFromAuth is the credential in `username:password` format to
+	// mount the blobs from MountFrom, defaults to the credential of target,
+	// it's required to pull MountFrom and push the target.
+	MountFromAuth string
+	// NotifyURL is posted with a Notification after the target image is
+	// pushed, e.g. to trigger a node to prefetch the image.
+	NotifyURL string
+	// Publisher publishes the lifecycle events of conversion, nil means
+	// not to publish.
+	Publisher Publisher
 
 	AllPlatforms bool
 	Platforms    string
+	// SourcePlatform selects the manifest of source image index, or asserts
+	// the platform of single manifest source image. TargetPlatform is written
+	// into the config of target image.
+	SourcePlatform string
+	TargetPlatform string
+
+	// BuildRetries retries the conversion up to the times with backoff if
+	// the builder fails transiently, e.g. killed under memory pressure, the
+	// builder rejecting the source layers isn't retried.
+	BuildRetries int
+	// PushBlobRetries retries the blobs failed to push up to the times after
+	// the other blobs are pushed, instead of failing on the first one.
+	PushBlobRetries int
+
+	// SmallImageThreshold batches the layers of the source image smaller
+	// than the threshold in total into a single build, see
+	// provider.SetSmallImageThreshold.
+	SmallImageThreshold int64
+	// MaxConcurrentBuilds limits the source layers built concurrently, see
+	// provider.SetMaxConcurrentBuilds.
+	MaxConcurrentBuilds int
+	// DecompressLayers limits the source layers decompressed at once in the
+	// process, see utils.SetDecompressLayers.
+	DecompressLayers int
+	// DecompressThreads is the number of threads decompressing each source
+	// layer, 0 means the default, see utils.SetDecompressThreads.
+	DecompressThreads int
+	// SourceDiffIDs supplies the diff IDs of source layers by their digests,
+	// which are verified against the source image config rather than
+	// computed, see provider.SetSourceDiffIDs.
+	SourceDiffIDs map[digest.Digest]digest.Digest
+	// LayerCompressors overrides the compressor of source layers keyed by
+	// the layer index or digest, see provider.SetLayerCompressors.
+	LayerCompressors map[string]string
+
+	// BackendObjectsOutput is the file path to save the list of the nydus
+	// blob objects written to the storage backend by conversion in JSON.
+	BackendObjectsOutput string
 
 	OutputJSON string
 }
 
-func Convert(ctx context.Context, opt Opt) error {
+func Convert(ctx context.Context, opt Opt) (retErr error) {
+	start := time.Now()
+	var metric *converter.Metric
+	// The output is written on failure too, unless the successful output
+	// has been written before a later step fails.
+	outputDumped := false
+	events := newEventEmitter(opt)
+	events.emit(ctx, Event{Type: EventStarted})
+	ctx = events.withLogger(ctx)
+	defer func() {
+		if retErr != nil && opt.OutputJSON != "" && !outputDumped {
+			if err := dumpOutput(failedOutput(opt, metric, time.Since(start), retErr), opt.OutputJSON); err != nil {
+				log.G(ctx).Warnf("write output of failed conversion: %s", err)
+			}
+		}
+		events.done(ctx, retErr)
+	}()
+	if err := checkAllowedRegistries(opt); err != nil {
+		return err
+	}
 	ctx = namespaces.WithNamespace(ctx, "nydusify")
 	platformMC, err := platformutil.ParsePlatforms(opt.AllPlatforms, opt.Platforms)
 	if err != nil {
 		return err
 	}
+	sourcePlatform, err := provider.ParsePlatform(opt.SourcePlatform)
+	if err != nil {
+		return err
+	}
+	targetPlatform, err := provider.ParsePlatform(opt.TargetPlatform)
+	if err != nil {
+		return err
+	}
+	digestAlgorithm, err := provider.ParseDigestAlgorithm(opt.DigestAlgorithm)
+	if err != nil {
+		return err
+	}
+	if sourcePlatform != nil {
+		platformMC = platforms.OnlyStrict(*sourcePlatform)
+	}
 
 	if _, err := os.Stat(opt.WorkDir); err != nil {
 		if errors.Is(err, os.ErrNotExist) {
@@ -68,33 +321,432 @@ func Convert(ctx context.Context, opt Opt) error {
 			}
 			// We should only clean up when the work directory not exists
 			// before, otherwise it may delete user data by mistake.
-			defer os.RemoveAll(opt.WorkDir)
+			defer func() {
+				if retErr == nil || !opt.Resume {
+					os.RemoveAll(opt.WorkDir)
+				}
+			}()
 		} else {
 			return errors.Wrap(err, "stat work directory")
 		}
 	}
-	tmpDir, err := os.MkdirTemp(opt.WorkDir, "nydusify-")
-	if err != nil {
+	var tmpDir string
+	if opt.Resume {
+		if tmpDir, err = checkpointDir(opt); err != nil {
+			return err
+		}
+	} else if tmpDir, err = os.MkdirTemp(opt.WorkDir, "nydusify-"); err != nil {
 		return errors.Wrap(err, "create temp directory")
 	}
-	pvd, err := provider.New(tmpDir, hosts(opt), opt.CacheMaxRecords, opt.CacheVersion, platformMC, 0)
+	defer func() {
+		if retErr == nil || !opt.Resume {
+			os.RemoveAll(tmpDir)
+		} else {
+			log.G(ctx).Infof("checkpoint is kept in %s, restart with --resume to continue", tmpDir)
+		}
+	}()
+
+	contentDir := filepath.Join(tmpDir, "content")
+	if opt.NoCache && (opt.CacheRef != "" || opt.BuildCacheDir != "") {
+		log.G(ctx).Infof("ignore build cache because of --no-cache")
+	}
+	if opt.BuildCacheDir != "" && !opt.NoCache {
+		lock, err := lockBuildCacheDir(ctx, opt.BuildCacheDir)
+		if err != nil {
+			return err
+		}
+		defer lock.Unlock()
+		contentDir = filepath.Join(opt.BuildCacheDir, "content")
+	}
+
+	hostFunc, err := hosts(opt)
+	if err != nil {
+		return err
+	}
+	pvd, err := provider.NewWithContentDir(tmpDir, contentDir, hostFunc, opt.CacheMaxRecords, opt.CacheVersion, platformMC, 0)
 	if err != nil {
 		return err
 	}
-	defer os.RemoveAll(tmpDir)
+	if err := useUnixSockets(pvd, opt); err != nil {
+		return err
+	}
+	pvd.SetMaxBlobSize(opt.MaxBlobSize)
+	pvd.SetSmallImageThreshold(opt.SmallImageThreshold)
+	pvd.SetMaxConcurrentBuilds(opt.MaxConcurrentBuilds)
+	// The source layers are decompressed in the process for rewriting,
+	// splitting, batching and sampling, the layers and threads are shared
+	// by the decompressions of all the layers.
+	utils.SetDecompressLayers(opt.DecompressLayers)
+	utils.SetDecompressThreads(opt.DecompressThreads)
+	pvd.SetSourceDiffIDs(opt.SourceDiffIDs)
+	pvd.SetMaxDiskUsage(opt.MaxDiskUsage, tmpDir, contentDir)
+	pvd.SetPlatform(sourcePlatform, targetPlatform)
+	pvd.SetHarborAccessory(opt.HarborAccessory)
+	pvd.SetSourceDigestLabel(opt.SourceDigestLabel)
+	pvd.SetHistory(opt.StripHistory, opt.HistoryComment)
+	pvd.SetSkipBlobPush(opt.SkipBlobPush)
+	pvd.SetBlobRetries(opt.PushBlobRetries)
+	if opt.CheckBlobReferences {
+		var exists provider.BlobExists
+		if opt.BackendType != "" {
+			blobBackend, err := backend.NewBackend(opt.BackendType, []byte(opt.BackendConfig), nil)
+			if err != nil {
+				return errors.Wrap(err, "init storage backend")
+			}
+			exists = blobBackend.Check
+		}
+		pvd.SetBlobReferenceCheck(tool.NewInspector(opt.NydusImagePath), exists)
+	}
+	if err := pvd.SetMountFrom(opt.MountFrom); err != nil {
+		return err
+	}
+	if opt.KMS != nil {
+		kms.Register(ctx, kms.ProviderName, opt.KMS)
+	}
+	pvd.SetDigestAlgorithm(digestAlgorithm)
+	pvd.SetTimeouts(opt.DialTimeout, opt.ReadTimeout)
+	pvd.SetRegistryTimeouts(opt.ManifestTimeout, opt.BlobTimeout)
+	if opt.MaxConcurrency > 0 {
+		pvd.SetAdaptiveConcurrency(opt.MinConcurrency, opt.MaxConcurrency)
+	}
+	if err := pvd.SetHTTPVersion(opt.HTTPVersion, opt.HTTP2MaxConcurrentStreams); err != nil {
+		return err
+	}
+	if err := pvd.SetBlobMediaType(opt.BlobMediaType); err != nil {
+		return err
+	}
+	if err := pvd.SetManifestFormat(opt.ManifestFormat); err != nil {
+		return err
+	}
+	var blobOrderInspector provider.BlobInspector
+	if opt.BlobOrder == provider.BlobOrderLayer || opt.BlobOrder == provider.BlobOrderAccess {
+		blobOrderInspector = tool.NewInspector(opt.NydusImagePath)
+	}
+	if err := pvd.SetBlobOrder(opt.BlobOrder, blobOrderInspector); err != nil {
+		return err
+	}
+	if err := pvd.SetArtifactTypePolicy(opt.ArtifactTypePolicy); err != nil {
+		return err
+	}
+	if err := pvd.SetBootstrapCompressor(opt.BootstrapCompressor); err != nil {
+		return err
+	}
+	pvd.SetGenerateSBOM(opt.GenerateSBOM)
+	if opt.LazyIndex {
+		pvd.SetLazyIndex(tool.NewInspector(opt.NydusImagePath))
+	}
+	pvd.SetFileManifest(opt.FileManifest)
+	if err := pvd.SetExcludePaths(opt.ExcludePaths); err != nil {
+		return err
+	}
+	if err := pvd.SetGlobFilter(opt.IncludeGlobs, opt.ExcludeGlobs); err != nil {
+		return err
+	}
+	pvd.SetTarNormalization(opt.TarNormalization)
+	if err := pvd.SetLayerNameTemplate(opt.LayerNameTemplate); err != nil {
+		return err
+	}
+	if opt.CachePolicy != "" {
+		pvd.SetCachePolicy(opt.CachePolicy)
+	}
+	pvd.SetNoCache(opt.NoCache)
+	if opt.Session != nil {
+		pvd.SetSession(opt.Session)
+	}
+	pvd.SetCacheReadOnly(opt.CacheReadOnly)
+	if opt.Resume {
+		checkpoint, err := provider.LoadCheckpoint(ctx, filepath.Join(tmpDir, "checkpoint.json"))
+		if err != nil {
+			return err
+		}
+		pvd.SetCheckpoint(checkpoint)
+	}
+	events.observe(ctx, pvd)
+
+	if opt.ExistingTargetPolicy != "" {
+		source, err := normalizeRef(opt.Source)
+		if err != nil {
+			return err
+		}
+		target, err := normalizeRef(opt.Target)
+		if err != nil {
+			return err
+		}
+		skip, err := pvd.CheckExistingTarget(ctx, source, target, opt.ExistingTargetPolicy)
+		if err != nil {
+			return err
+		}
+		if skip {
+			log.G(ctx).Infof("target %s is converted from source %s already, skip conversion", target, source)
+			return nil
+		}
+	}
+
+	if opt.MaxSourceAge > 0 {
+		source, err := normalizeRef(opt.Source)
+		if err != nil {
+			return err
+		}
+		if err := pvd.CheckSourceAge(ctx, source, opt.MaxSourceAge); err != nil {
+			return err
+		}
+	}
+
+	if opt.CheckPushPermission {
+		target, err := normalizeRef(opt.Target)
+		if err != nil {
+			return err
+		}
+		if err := pvd.CheckPushPermission(ctx, target); err != nil {
+			return err
+		}
+	}
+
+	if opt.BaseNydus != "" {
+		baseNydus, err := normalizeRef(opt.BaseNydus)
+		if err != nil {
+			return err
+		}
+		pvd.SetReferenceBaseBlobs(opt.ReferenceBaseBlobs)
+		if err := pvd.LoadBaseNydus(ctx, baseNydus); err != nil {
+			return err
+		}
+	}
+
+	cfg := getConfig(opt)
+	// The temporary files of builder are limited by the disk quota as well,
+	// see provider.SetMaxDiskUsage.
+	if opt.MaxDiskUsage > 0 {
+		cfg["work_dir"] = tmpDir
+	}
+	if opt.Compressor == provider.CompressorAuto || len(opt.LayerCompressors) > 0 {
+		packOpt, err := getPackOption(opt, cfg)
+		if err != nil {
+			return err
+		}
+		if opt.Compressor == provider.CompressorAuto {
+			pvd.SetAutoCompressor(*packOpt)
+		}
+		if len(opt.LayerCompressors) > 0 {
+			if err := pvd.SetLayerCompressors(*packOpt, opt.LayerCompressors); err != nil {
+				return err
+			}
+		}
+	}
 
 	cvt, err := converter.New(
 		converter.WithProvider(pvd),
-		converter.WithDriver("nydus", getConfig(opt)),
+		converter.WithDriver("nydus", cfg),
 		converter.WithPlatform(platformMC),
 	)
 	if err != nil {
 		return err
 	}
 
-	metric, err := cvt.Convert(ctx, opt.Source, opt.Target, opt.CacheRef)
-	if opt.OutputJSON != "" {
-		dumpMetric(metric, opt.OutputJSON)
+	converted, err := convertOnce(ctx, opt, pvd, func() error {
+		// The source layers pulled are kept in content store, only the
+		// building is repeated on retry.
+		return buildWithRetries(ctx, opt.BuildRetries, func() error {
+			metric, err = cvt.Convert(ctx, opt.Source, opt.Target, opt.CacheRef)
+			return err
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if !converted {
+		if opt.NotifyURL != "" {
+			if err := notifyTarget(ctx, opt, pvd); err != nil {
+				return errors.Wrap(err, "target image is tagged, but failed to notify")
+			}
+		}
+		return nil
+	}
+	if len(opt.ExtraTargets) > 0 {
+		if err := pushExtraTargets(ctx, opt, pvd); err != nil {
+			return err
+		}
+	}
+	for destination, size := range pvd.PushedBytesByDestination() {
+		log.G(ctx).Infof("pushed %s to %s", humanize.IBytes(uint64(size)), destination)
+	}
+	if opt.BackendObjectsOutput != "" {
+		if err := dumpBackendObjects(ctx, opt, pvd); err != nil {
+			return errors.Wrap(err, "target image is pushed, but failed to save backend objects")
+		}
+	}
+
+	output, err := newOutput(ctx, opt, pvd, metric, time.Since(start))
+	if err != nil {
+		if opt.OutputJSON != "" {
+			return errors.Wrap(err, "collect conversion output")
+		}
+		// The summary is informative only without output JSON.
+		log.G(ctx).Warn("collect conversion summary: " + err.Error())
+	} else {
+		for _, warning := range output.Warnings {
+			log.G(ctx).Warn(warning)
+		}
+		log.G(ctx).Info(output.Summary)
+		if opt.OutputJSON != "" {
+			if err := dumpOutput(output, opt.OutputJSON); err != nil {
+				return err
+			}
+			outputDumped = true
+		}
+	}
+
+	if opt.NotifyURL != "" {
+		if err := notifyTarget(ctx, opt, pvd); err != nil {
+			return errors.Wrap(err, "target image is pushed, but failed to notify")
+		}
+	}
+
+	return nil
+}
+
+func pushExtraTargets(ctx context.Context, opt Opt, pvd *provider.Provider) error {
+	targetRef, err := normalizeRef(opt.Target)
+	if err != nil {
+		return err
+	}
+	var extraRefs []string
+	for _, target := range opt.ExtraTargets {
+		extraRef, err := normalizeRef(target)
+		if err != nil {
+			return err
+		}
+		extraRefs = append(extraRefs, extraRef)
+	}
+	return pvd.PushTargets(ctx, targetRef, extraRefs)
+}
+
+func notifyTarget(ctx context.Context, opt Opt, pvd *provider.Provider) error {
+	sourceRef, err := normalizeRef(opt.Source)
+	if err != nil {
+		return err
+	}
+	targetRef, err := normalizeRef(opt.Target)
+	if err != nil {
+		return err
+	}
+	targetDesc, err := pvd.Image(ctx, targetRef)
+	if err != nil {
+		return errors.Wrap(err, "get target image")
+	}
+	return notify(ctx, opt.NotifyURL, Notification{
+		Source:    sourceRef,
+		Target:    targetRef,
+		Digest:    targetDesc.Digest.String(),
+		MediaType: targetDesc.MediaType,
+	})
+}
+
+// optionsDigest returns the digest of options excluding the references,
+// credentials and the options not affecting the conversion result.
+func optionsDigest(opt Opt) (digest.Digest, error) {
+	options := opt
+	options.Source, options.Target, options.ExtraTargets = "", "", nil
+	options.SourceAuth, options.TargetAuth, options.MountFromAuth = "", "", ""
+	options.CredentialProvider, options.Session = nil, nil
+	options.NotifyURL, options.OutputJSON, options.Publisher = "", "", nil
+	options.KMS, options.BuildRetries, options.PushBlobRetries = nil, 0, 0
+	data, err := json.Marshal(options)
+	if err != nil {
+		return "", err
+	}
+	return digest.FromBytes(data), nil
+}
+
+// convertOnce converts by convert unless the source digest has been
+// converted with the same options in session, the session key is the digest
+// of options, see optionsDigest.
+func convertOnce(ctx context.Context, opt Opt, pvd *provider.Provider, convert func() error) (bool, error) {
+	sourceRef, err := normalizeRef(opt.Source)
+	if err != nil {
+		return false, err
+	}
+	targetRef, err := normalizeRef(opt.Target)
+	if err != nil {
+		return false, err
+	}
+	options, err := optionsDigest(opt)
+	if err != nil {
+		return false, err
+	}
+	return pvd.ConvertOnce(ctx, sourceRef, targetRef, options.Encoded(), convert)
+}
+
+// checkpointDir creates the directory in work directory to keep the content
+// store and checkpoint across restarts, it's named by the digest of source,
+// target and options like convertOnce, so that the checkpoint is only
+// resumed by the same conversion.
+func checkpointDir(opt Opt) (string, error) {
+	options, err := optionsDigest(opt)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(struct {
+		Source  string
+		Target  string
+		Options digest.Digest
+	}{opt.Source, opt.Target, options})
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(opt.WorkDir, "checkpoint-"+digest.FromBytes(data).Encoded()[:16])
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", errors.Wrap(err, "create checkpoint directory")
+	}
+	return dir, nil
+}
+
+// lockBuildCacheDir prevents the build cache directory from being used by
+// concurrent conversions, it waits until the directory is released.
+func lockBuildCacheDir(ctx context.Context, dir string) (*utils.FileLock, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "prepare build cache directory")
+	}
+	lockPath := filepath.Join(dir, "nydusify.lock")
+	lock, err := utils.LockFile(lockPath, false)
+	if errors.Is(err, utils.ErrLocked) {
+		log.G(ctx).Infof("waiting for build cache directory %s used by other conversion", dir)
+		lock, err = utils.LockFile(lockPath, true)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "lock build cache directory")
+	}
+	return lock, nil
+}
+
+func normalizeRef(ref string) (string, error) {
+	named, err := docker.ParseDockerRef(ref)
+	if err != nil {
+		return "", errors.Wrapf(err, "parse reference %s", ref)
+	}
+	return named.String(), nil
+}
+
+// useUnixSockets lets the provider access the registries of source, target,
+// chunk dict and cache image through their unix domain sockets if specified.
+func useUnixSockets(pvd *provider.Provider, opt Opt) error {
+	for _, item := range []struct {
+		ref      string
+		endpoint string
+	}{
+		{opt.Source, opt.SourceSocket},
+		{opt.Target, opt.TargetSocket},
+		{opt.ChunkDictRef, opt.ChunkDictSocket},
+		{opt.CacheRef, opt.CacheSocket},
+	} {
+		if item.ref == "" || item.endpoint == "" {
+			continue
+		}
+		socketPath, err := provider.ParseUnixSocket(item.endpoint)
+		if err != nil {
+			return err
+		}
+		pvd.UseUnixSocket(item.ref, socketPath)
 	}
-	return err
+	return nil
 }
@@ -0,0 +1,47 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckpointDir(t *testing.T) {
+	opt := Opt{
+		WorkDir:          t.TempDir(),
+		Source:           "localhost:5000/nginx:latest",
+		Target:           "localhost:5000/nginx:nydus",
+		Compressor:       "zstd",
+		LayerCompressors: map[string]string{"0": "lz4_block"},
+		Resume:           true,
+	}
+	dir, err := checkpointDir(opt)
+	require.NoError(t, err)
+	require.DirExists(t, dir)
+
+	// The checkpoint is resumed by the restart with other credentials.
+	restart := opt
+	restart.SourceAuth = "user:password"
+	resumed, err := checkpointDir(restart)
+	require.NoError(t, err)
+	require.Equal(t, dir, resumed)
+
+	// The layers are rebuilt from scratch by the restart with other
+	// options, including the ones collapsed in the builder config.
+	for _, change := range []func(opt *Opt){
+		func(opt *Opt) { opt.LayerCompressors = map[string]string{"0": "zstd"} },
+		func(opt *Opt) { opt.Compressor = "auto" },
+		func(opt *Opt) { opt.SmallImageThreshold = 1 << 20 },
+		func(opt *Opt) { opt.Target = "localhost:5000/nginx:nydus-v6" },
+	} {
+		restart := opt
+		change(&restart)
+		rebuilt, err := checkpointDir(restart)
+		require.NoError(t, err)
+		require.NotEqual(t, dir, rebuilt)
+	}
+}
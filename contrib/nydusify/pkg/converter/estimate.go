@@ -0,0 +1,118 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/log"
+	humanize "github.com/dustin/go-humanize"
+	"github.com/goharbor/acceleration-service/pkg/platformutil"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/converter/provider"
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+// EstimateSize pulls the source image and estimates the size of the nydus
+// image converted from it by the build options of opt without building or
+// pushing, see provider.EstimateSize. The estimates are logged, and saved to
+// OutputJSON if specified.
+func EstimateSize(ctx context.Context, opt Opt) ([]provider.SizeEstimate, error) {
+	if err := checkAllowedRegistries(opt); err != nil {
+		return nil, err
+	}
+	ctx = namespaces.WithNamespace(ctx, "nydusify")
+	platformMC, err := platformutil.ParsePlatforms(opt.AllPlatforms, opt.Platforms)
+	if err != nil {
+		return nil, err
+	}
+	estimateOpt := provider.EstimateOption{
+		FsVersion:  opt.FsVersion,
+		Compressor: opt.Compressor,
+	}
+	if opt.ChunkSize != "" {
+		if estimateOpt.ChunkSize, err = strconv.ParseInt(opt.ChunkSize, 0, 64); err != nil {
+			return nil, errors.Wrapf(err, "invalid chunk size %s", opt.ChunkSize)
+		}
+	}
+
+	if opt.WorkDir != "" {
+		if err := os.MkdirAll(opt.WorkDir, 0755); err != nil {
+			return nil, errors.Wrap(err, "prepare work directory")
+		}
+	}
+	tmpDir, err := os.MkdirTemp(opt.WorkDir, "nydusify-")
+	if err != nil {
+		return nil, errors.Wrap(err, "create temp directory")
+	}
+	defer os.RemoveAll(tmpDir)
+	contentDir := filepath.Join(tmpDir, "content")
+	if opt.BuildCacheDir != "" && !opt.NoCache {
+		lock, err := lockBuildCacheDir(ctx, opt.BuildCacheDir)
+		if err != nil {
+			return nil, err
+		}
+		defer lock.Unlock()
+		contentDir = filepath.Join(opt.BuildCacheDir, "content")
+	}
+
+	ref, err := normalizeRef(opt.Source)
+	if err != nil {
+		return nil, err
+	}
+	hostFunc, err := hosts(opt)
+	if err != nil {
+		return nil, err
+	}
+	pvd, err := provider.NewWithContentDir(tmpDir, contentDir, hostFunc, opt.CacheMaxRecords, opt.CacheVersion, platformMC, 0)
+	if err != nil {
+		return nil, err
+	}
+	pvd.SetTimeouts(opt.DialTimeout, opt.ReadTimeout)
+	pvd.SetRegistryTimeouts(opt.ManifestTimeout, opt.BlobTimeout)
+	if err := pvd.Pull(ctx, ref); err != nil {
+		if !utils.RetryWithHTTP(err) {
+			return nil, errors.Wrapf(err, "pull source image %s", ref)
+		}
+		log.G(ctx).Infof("try to pull with plain HTTP for %s", ref)
+		pvd.UsePlainHTTP()
+		if err := pvd.Pull(ctx, ref); err != nil {
+			return nil, errors.Wrapf(err, "try to pull source image %s", ref)
+		}
+	}
+	desc, err := pvd.Image(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	estimates, err := pvd.EstimateSize(ctx, *desc, estimateOpt)
+	if err != nil {
+		return nil, err
+	}
+	for _, estimate := range estimates {
+		log.G(ctx).Infof(
+			"estimated nydus image size of %s %s: %s (blobs %s, bootstrap %s), source layers %s",
+			ref, estimate.Platform, humanize.IBytes(uint64(estimate.Size)), humanize.IBytes(uint64(estimate.BlobSize)),
+			humanize.IBytes(uint64(estimate.BootstrapSize)), humanize.IBytes(uint64(estimate.SourceSize)),
+		)
+	}
+	if opt.OutputJSON != "" {
+		data, err := json.MarshalIndent(estimates, "", "  ")
+		if err != nil {
+			return nil, errors.Wrap(err, "marshal estimates")
+		}
+		if err := os.WriteFile(opt.OutputJSON, data, 0644); err != nil {
+			return nil, errors.Wrap(err, "write estimates")
+		}
+	}
+
+	return estimates, nil
+}
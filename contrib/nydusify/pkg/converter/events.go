@@ -0,0 +1,273 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/containerd/log"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/converter/provider"
+)
+
+// The types of conversion lifecycle events.
+const (
+	EventStarted   = "started"
+	EventLayerDone = "layer-done"
+	EventCompleted = "completed"
+	EventFailed    = "failed"
+	// EventProgress reports the stage of conversion, or a message logged
+	// by conversion for the caller to render instead of parsing the logs.
+	EventProgress = "progress"
+)
+
+// Event is a conversion lifecycle event published by Publisher.
+type Event struct {
+	Type   string    `json:"type"`
+	Time   time.Time `json:"time"`
+	Source string    `json:"source"`
+	Target string    `json:"target"`
+	// Layer and Blob are the source layer and the nydus blob built from it
+	// for the layer-done event.
+	Layer string `json:"layer,omitempty"`
+	Blob  string `json:"blob,omitempty"`
+	// Digest is the target image digest for the completed event, it's empty
+	// if the conversion is skipped before resolving the target.
+	Digest string `json:"digest,omitempty"`
+	// Error is the failure of the failed event.
+	Error string `json:"error,omitempty"`
+	// Stage is the stage of progress event started, i.e. pull, build or
+	// push, see provider.StageObserver, it's empty for the messages logged.
+	// The progress event of build stage is published for each source
+	// layer.
+	Stage string `json:"stage,omitempty"`
+	// Level and Message are the logging level, like info or warning, and
+	// the message of progress event.
+	Level   string `json:"level,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// Publisher publishes the conversion lifecycle events to external systems,
+// like a message queue. Publish may be called concurrently for the
+// events of layers, the failed publishing is logged without failing the
+// conversion.
+type Publisher interface {
+	Publish(ctx context.Context, event Event) error
+}
+
+type writerPublisher struct {
+	mutex   sync.Mutex
+	encoder *json.Encoder
+}
+
+// NewWriterPublisher publishes the events to writer in JSON lines.
+func NewWriterPublisher(writer io.Writer) Publisher {
+	return &writerPublisher{encoder: json.NewEncoder(writer)}
+}
+
+func (publisher *writerPublisher) Publish(_ context.Context, event Event) error {
+	publisher.mutex.Lock()
+	defer publisher.mutex.Unlock()
+	return publisher.encoder.Encode(event)
+}
+
+type channelPublisher struct {
+	events chan<- Event
+}
+
+// NewChannelPublisher publishes the events to channel events for the
+// caller embedding the conversion, e.g. to render the progress in UI. The
+// publishing blocks until the event is received or the conversion is
+// canceled, the channel isn't closed after the conversion.
+func NewChannelPublisher(events chan<- Event) Publisher {
+	return &channelPublisher{events: events}
+}
+
+func (publisher *channelPublisher) Publish(ctx context.Context, event Event) error {
+	select {
+	case publisher.events <- event:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// eventEmitter publishes the events of a conversion, it does nothing if
+// the publisher isn't set.
+type eventEmitter struct {
+	publisher Publisher
+	source    string
+	target    string
+	pvd       *provider.Provider
+}
+
+func newEventEmitter(opt Opt) *eventEmitter {
+	emitter := &eventEmitter{publisher: opt.Publisher, source: opt.Source, target: opt.Target}
+	if source, err := normalizeRef(opt.Source); err == nil {
+		emitter.source = source
+	}
+	if target, err := normalizeRef(opt.Target); err == nil {
+		emitter.target = target
+	}
+	return emitter
+}
+
+func (emitter *eventEmitter) emit(ctx context.Context, event Event) {
+	if emitter.publisher == nil {
+		return
+	}
+	event.Time = time.Now()
+	event.Source, event.Target = emitter.source, emitter.target
+	if err := emitter.publisher.Publish(ctx, event); err != nil {
+		logrus.WithError(&publishError{err: err}).Warnf("publish %s event of conversion", event.Type)
+	}
+}
+
+// publishError is the error of publishing logged by the standard logger,
+// the entry isn't published by stdLogHook, otherwise a publisher failing
+// for every event loops forever.
+type publishError struct {
+	err error
+}
+
+func (err *publishError) Error() string {
+	return err.err.Error()
+}
+
+// logHook publishes the entries logged by the logger of a conversion in
+// its progress events.
+type logHook struct {
+	ctx     context.Context
+	emitter *eventEmitter
+}
+
+func (hook *logHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (hook *logHook) Fire(entry *logrus.Entry) error {
+	hook.emitter.emit(hook.ctx, Event{Type: EventProgress, Level: entry.Level.String(), Message: entry.Message})
+	return nil
+}
+
+// stdLogHook publishes the entries logged by the standard logger in the
+// progress events of the conversions running, which are logged by the
+// dependencies not logging by log.G, e.g. the nydus driver of
+// acceleration-service. Such entries can't be told apart by conversion, so
+// they're published to all the conversions running in the process.
+type stdLogHook struct {
+	mutex    sync.Mutex
+	emitters map[*eventEmitter]context.Context
+}
+
+var (
+	stdHook     = &stdLogHook{emitters: map[*eventEmitter]context.Context{}}
+	stdHookOnce sync.Once
+)
+
+func (hook *stdLogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (hook *stdLogHook) Fire(entry *logrus.Entry) error {
+	if _, ok := entry.Data[logrus.ErrorKey].(*publishError); ok {
+		return nil
+	}
+	hook.mutex.Lock()
+	emitters := make(map[*eventEmitter]context.Context, len(hook.emitters))
+	for emitter, ctx := range hook.emitters {
+		emitters[emitter] = ctx
+	}
+	hook.mutex.Unlock()
+	for emitter, ctx := range emitters {
+		emitter.emit(ctx, Event{Type: EventProgress, Level: entry.Level.String(), Message: entry.Message})
+	}
+	return nil
+}
+
+func (hook *stdLogHook) add(ctx context.Context, emitter *eventEmitter) {
+	stdHookOnce.Do(func() {
+		logrus.AddHook(hook)
+	})
+	hook.mutex.Lock()
+	defer hook.mutex.Unlock()
+	hook.emitters[emitter] = ctx
+}
+
+func (hook *stdLogHook) remove(emitter *eventEmitter) {
+	hook.mutex.Lock()
+	defer hook.mutex.Unlock()
+	delete(hook.emitters, emitter)
+}
+
+// withLogger returns ctx carrying the logger of the conversion, see log.G,
+// which logs like the standard logger and publishes the entries in the
+// progress events of the conversion, only the levels enabled by the
+// standard logger are published. The concurrent conversions in a process
+// don't receive the entries logged by each other, but all of them receive
+// the entries logged by the standard logger until done, see stdLogHook.
+func (emitter *eventEmitter) withLogger(ctx context.Context) context.Context {
+	if emitter.publisher == nil {
+		return ctx
+	}
+	stdHook.add(ctx, emitter)
+	std := logrus.StandardLogger()
+	logger := logrus.New()
+	logger.SetOutput(std.Out)
+	logger.SetFormatter(std.Formatter)
+	logger.SetLevel(std.GetLevel())
+	logger.SetReportCaller(std.ReportCaller)
+	logger.ExitFunc = std.ExitFunc
+	logger.AddHook(&logHook{ctx: ctx, emitter: emitter})
+	return log.WithLogger(ctx, logger.WithFields(log.G(ctx).Data))
+}
+
+// observe publishes the progress events of the stages and the layer-done
+// events of the layers built by pvd, and resolves the target digest of
+// completed event by pvd.
+func (emitter *eventEmitter) observe(ctx context.Context, pvd *provider.Provider) {
+	if emitter.publisher == nil {
+		return
+	}
+	emitter.pvd = pvd
+	pvd.SetStageObserver(func(stage, ref string, layer digest.Digest) {
+		event := Event{Type: EventProgress, Stage: stage, Level: logrus.InfoLevel.String()}
+		switch stage {
+		case provider.StagePull:
+			event.Message = "pull source image " + ref
+		case provider.StageBuild:
+			event.Layer = layer.String()
+			event.Message = "build source layer " + layer.String()
+		case provider.StagePush:
+			event.Message = "push image " + ref
+		}
+		emitter.emit(ctx, event)
+	})
+	pvd.SetLayerObserver(func(source, blob digest.Digest) {
+		emitter.emit(ctx, Event{Type: EventLayerDone, Layer: source.String(), Blob: blob.String()})
+	})
+}
+
+// done publishes the completed or failed event by the conversion error.
+func (emitter *eventEmitter) done(ctx context.Context, err error) {
+	stdHook.remove(emitter)
+	if err != nil {
+		emitter.emit(ctx, Event{Type: EventFailed, Error: err.Error()})
+		return
+	}
+	event := Event{Type: EventCompleted}
+	if emitter.pvd != nil {
+		if desc, err := emitter.pvd.Image(ctx, emitter.target); err == nil {
+			event.Digest = desc.Digest.String()
+		}
+	}
+	emitter.emit(ctx, event)
+}
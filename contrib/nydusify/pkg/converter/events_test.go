@@ -0,0 +1,214 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/log"
+	"github.com/goharbor/acceleration-service/pkg/remote"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/converter/provider"
+)
+
+type fakePublisher struct {
+	mutex  sync.Mutex
+	events []Event
+}
+
+func (publisher *fakePublisher) Publish(_ context.Context, event Event) error {
+	publisher.mutex.Lock()
+	defer publisher.mutex.Unlock()
+	publisher.events = append(publisher.events, event)
+	return nil
+}
+
+func (publisher *fakePublisher) types() []string {
+	publisher.mutex.Lock()
+	defer publisher.mutex.Unlock()
+	var types []string
+	for _, event := range publisher.events {
+		types = append(types, event.Type)
+	}
+	return types
+}
+
+func TestConvertFailedEvents(t *testing.T) {
+	publisher := &fakePublisher{}
+	err := Convert(context.Background(), Opt{
+		Source:            "docker.io/library/nginx:latest",
+		Target:            "docker.io/library/nginx:nydus",
+		AllowedRegistries: []string{"registry.example.com"},
+		Publisher:         publisher,
+	})
+	require.Error(t, err)
+	require.Equal(t, []string{EventStarted, EventFailed}, publisher.types())
+	failed := publisher.events[1]
+	require.Equal(t, "docker.io/library/nginx:latest", failed.Source)
+	require.Equal(t, "docker.io/library/nginx:nydus", failed.Target)
+	require.Equal(t, err.Error(), failed.Error)
+}
+
+func TestConvertLogEvents(t *testing.T) {
+	publisher := &fakePublisher{}
+	err := Convert(context.Background(), Opt{
+		WorkDir:  t.TempDir(),
+		Source:   "localhost:1/nginx:latest",
+		Target:   "localhost:1/nginx:nydus",
+		CacheRef: "localhost:1/nginx:cache",
+		NoCache:  true,
+		// Make the nydus driver warn by the standard logger.
+		OCIRef:    true,
+		FsVersion: "5",
+		Publisher: publisher,
+	})
+	require.Error(t, err)
+	logrus.Info("logged after conversion")
+
+	var messages []string
+	for _, event := range publisher.events {
+		if event.Type == EventProgress && event.Stage == "" {
+			messages = append(messages, event.Message)
+		}
+	}
+	require.Contains(t, messages, "ignore build cache because of --no-cache")
+	require.Contains(t, messages, "forcibly using fs version 6 when oci_ref option enabled")
+	require.NotContains(t, messages, "logged after conversion")
+	require.Equal(t, EventFailed, publisher.events[len(publisher.events)-1].Type)
+}
+
+func TestLayerDoneEvents(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	hosts := func(string) (remote.CredentialFunc, bool, error) {
+		return func(string) (string, string, error) { return "", "", nil }, false, nil
+	}
+	pvd, err := provider.New(t.TempDir(), hosts, 200, "v1", platforms.All, 0)
+	require.NoError(t, err)
+
+	publisher := &fakePublisher{}
+	emitter := newEventEmitter(Opt{Source: "nginx", Target: "nginx:nydus", Publisher: publisher})
+	emitter.emit(ctx, Event{Type: EventStarted})
+	emitter.observe(ctx, pvd)
+
+	// The nydus blob is written by the layer converter with the ingest
+	// reference named by the source layer.
+	source := digest.FromString("source layer")
+	blob := []byte("nydus blob")
+	require.NoError(t, content.WriteBlob(ctx, pvd.ContentStore(), "convert-nydus-from-"+source.String(), bytes.NewReader(blob), ocispec.Descriptor{
+		Digest: digest.FromBytes(blob),
+		Size:   int64(len(blob)),
+	}))
+	// Other content isn't a layer built.
+	config := []byte("config")
+	require.NoError(t, content.WriteBlob(ctx, pvd.ContentStore(), "config", bytes.NewReader(config), ocispec.Descriptor{
+		Digest: digest.FromBytes(config),
+		Size:   int64(len(config)),
+	}))
+	emitter.done(ctx, nil)
+
+	require.Equal(t, []string{EventStarted, EventProgress, EventLayerDone, EventCompleted}, publisher.types())
+	layerDone := publisher.events[2]
+	require.Equal(t, source.String(), layerDone.Layer)
+	require.Equal(t, digest.FromBytes(blob).String(), layerDone.Blob)
+	require.Equal(t, "docker.io/library/nginx:nydus", layerDone.Target)
+}
+
+func TestWriterPublisher(t *testing.T) {
+	var buf bytes.Buffer
+	publisher := NewWriterPublisher(&buf)
+	require.NoError(t, publisher.Publish(context.Background(), Event{Type: EventStarted, Source: "source"}))
+	require.NoError(t, publisher.Publish(context.Background(), Event{Type: EventFailed, Error: "failure"}))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+	var event Event
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &event))
+	require.Equal(t, EventFailed, event.Type)
+	require.Equal(t, "failure", event.Error)
+}
+
+func TestProgressEvents(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	hosts := func(string) (remote.CredentialFunc, bool, error) {
+		return func(string) (string, string, error) { return "", "", nil }, true, nil
+	}
+	pvd, err := provider.New(t.TempDir(), hosts, 200, "v1", platforms.All, 0)
+	require.NoError(t, err)
+
+	events := make(chan Event)
+	emitter := newEventEmitter(Opt{Source: host + "/nginx", Target: host + "/nginx:nydus", Publisher: NewChannelPublisher(events)})
+	emitter.observe(ctx, pvd)
+
+	var received []Event
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		for event := range events {
+			received = append(received, event)
+		}
+	}()
+
+	emitter.emit(ctx, Event{Type: EventStarted})
+	require.Error(t, pvd.Pull(ctx, host+"/library/nginx:latest"))
+	source := digest.FromString("source layer")
+	blob := []byte("nydus blob")
+	blobDesc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayer,
+		Digest:    digest.FromBytes(blob),
+		Size:      int64(len(blob)),
+	}
+	require.NoError(t, content.WriteBlob(ctx, pvd.ContentStore(), "convert-nydus-from-"+source.String(), bytes.NewReader(blob), blobDesc))
+	require.Error(t, pvd.Push(ctx, blobDesc, host+"/library/nginx:nydus"))
+	log.G(emitter.withLogger(ctx)).Warn("layer is too large")
+	// The logger of another conversion doesn't publish in the events of
+	// conversion, but the standard logger does for both of them.
+	other := newEventEmitter(Opt{Publisher: &fakePublisher{}})
+	log.G(other.withLogger(ctx)).Warn("logged by other conversion")
+	logrus.Error("logged by standard logger")
+	other.done(ctx, nil)
+	emitter.done(ctx, nil)
+	logrus.Error("logged after conversion")
+	close(events)
+	<-drained
+
+	type step struct{ typ, stage, layer, level string }
+	var steps []step
+	for _, event := range received {
+		steps = append(steps, step{event.Type, event.Stage, event.Layer, event.Level})
+	}
+	require.Equal(t, []step{
+		{EventStarted, "", "", ""},
+		{EventProgress, provider.StagePull, "", "info"},
+		{EventProgress, provider.StageBuild, source.String(), "info"},
+		{EventLayerDone, "", source.String(), ""},
+		{EventProgress, provider.StagePush, "", "info"},
+		{EventProgress, "", "", "warning"},
+		{EventProgress, "", "", "error"},
+		{EventCompleted, "", "", ""},
+	}, steps)
+	require.Equal(t, "pull source image "+host+"/library/nginx:latest", received[1].Message)
+	require.Equal(t, "layer is too large", received[5].Message)
+	require.Equal(t, "logged by standard logger", received[6].Message)
+	otherPublisher := other.publisher.(*fakePublisher)
+	require.Equal(t, []string{EventProgress, EventProgress, EventCompleted}, otherPublisher.types())
+	require.Equal(t, "logged by standard logger", otherPublisher.events[1].Message)
+}
@@ -0,0 +1,57 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ParseAccessHints converts the file access hints into the prefetch patterns
+// of builder, which places the prefetched files at the beginning of blob in
+// the order of patterns, so that the hot files are fetched first on lazy
+// loading. Each line of hints is either a path accessed once or a path with
+// its access count in the `uniq -c` format, e.g. "  42 /usr/bin/nginx", the
+// paths are ordered by total access count, then by first appearance. Empty
+// lines and lines beginning with '#' are ignored.
+func ParseAccessHints(reader io.Reader) (string, error) {
+	counts := map[string]uint64{}
+	var paths []string
+
+	scanner := bufio.NewScanner(reader)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		count, file := uint64(1), line
+		if fields := strings.SplitN(line, " ", 2); len(fields) == 2 {
+			if n, err := strconv.ParseUint(fields[0], 10, 64); err == nil {
+				count, file = n, strings.TrimSpace(fields[1])
+			}
+		}
+		if !path.IsAbs(file) {
+			return "", fmt.Errorf("invalid access hint at line %d: %q is not an absolute path", lineNo, file)
+		}
+		file = path.Clean(file)
+		if _, ok := counts[file]; !ok {
+			paths = append(paths, file)
+		}
+		counts[file] += count
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	sort.SliceStable(paths, func(i, j int) bool {
+		return counts[paths[i]] > counts[paths[j]]
+	})
+	return strings.Join(paths, "\n"), nil
+}
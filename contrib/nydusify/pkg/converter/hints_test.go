@@ -0,0 +1,34 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAccessHints(t *testing.T) {
+	patterns, err := ParseAccessHints(strings.NewReader(`
+# access log of nginx
+/etc/nginx/nginx.conf
+   3 /usr/sbin/nginx
+/lib/x86_64-linux-gnu/libc.so.6
+   2 /lib/x86_64-linux-gnu/libc.so.6
+/etc/nginx/./mime.types
+`))
+	require.NoError(t, err)
+	require.Equal(t, strings.Join([]string{
+		"/usr/sbin/nginx",
+		"/lib/x86_64-linux-gnu/libc.so.6",
+		"/etc/nginx/nginx.conf",
+		"/etc/nginx/mime.types",
+	}, "\n"), patterns)
+
+	_, err = ParseAccessHints(strings.NewReader("/etc/passwd\n10 etc/shadow\n"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "line 2")
+}
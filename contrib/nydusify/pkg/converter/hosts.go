@@ -5,17 +5,117 @@
 package converter
 
 import (
+	"strings"
+
 	"github.com/goharbor/acceleration-service/pkg/remote"
+	"github.com/pkg/errors"
 )
 
-func hosts(opt Opt) remote.HostFunc {
-	maps := map[string]bool{
-		opt.Source:       opt.SourceInsecure,
-		opt.Target:       opt.TargetInsecure,
-		opt.ChunkDictRef: opt.ChunkDictInsecure,
-		opt.CacheRef:     opt.CacheInsecure,
+// CredentialProvider resolves the credentials of registry host, it's called
+// on each authentication to registry, so that the credentials can be fetched
+// dynamically, for example from a secrets manager.
+type CredentialProvider interface {
+	// Credential returns the username and secret of host, the empty
+	// username and secret mean anonymous access.
+	Credential(host string) (string, string, error)
+}
+
+// CredentialProviderFunc adapts a function to CredentialProvider.
+type CredentialProviderFunc func(host string) (string, string, error)
+
+func (fn CredentialProviderFunc) Credential(host string) (string, string, error) {
+	return fn(host)
+}
+
+// NewDockerConfigCredentialProvider returns the default CredentialProvider,
+// which reads the credentials from `$DOCKER_CONFIG/config.json`.
+func NewDockerConfigCredentialProvider() CredentialProvider {
+	return CredentialProviderFunc(remote.NewDockerConfigCredFunc())
+}
+
+// staticCredential parses the credential in `username:password` format,
+// which is used for all the hosts.
+func staticCredential(auth string) (remote.CredentialFunc, error) {
+	username, password, ok := strings.Cut(auth, ":")
+	if !ok || username == "" {
+		return nil, errors.New("invalid credential, expected username:password")
 	}
-	return func(ref string) (remote.CredentialFunc, bool, error) {
-		return remote.NewDockerConfigCredFunc(), maps[ref], nil
+	return func(string) (string, string, error) {
+		return username, password, nil
+	}, nil
+}
+
+// refKeys returns the keys of ref in the host maps, the ref passed to
+// provider is either as specified or normalized, e.g. `nginx` is pulled as
+// `docker.io/library/nginx:latest`.
+func refKeys(ref string) []string {
+	if ref == "" {
+		return nil
+	}
+	keys := []string{ref}
+	if normalized, err := normalizeRef(ref); err == nil && normalized != ref {
+		keys = append(keys, normalized)
 	}
+	return keys
+}
+
+func hosts(opt Opt) (remote.HostFunc, error) {
+	maps := map[string]bool{}
+	setInsecure := func(ref string, insecure bool) {
+		for _, key := range refKeys(ref) {
+			maps[key] = insecure
+		}
+	}
+	setInsecure(opt.Source, opt.SourceInsecure)
+	setInsecure(opt.Target, opt.TargetInsecure)
+	setInsecure(opt.ChunkDictRef, opt.ChunkDictInsecure)
+	setInsecure(opt.CacheRef, opt.CacheInsecure)
+	setInsecure(opt.MountFrom, opt.TargetInsecure)
+	for _, target := range opt.ExtraTargets {
+		setInsecure(target, opt.TargetInsecure)
+	}
+	credentialProvider := opt.CredentialProvider
+	if credentialProvider == nil {
+		credentialProvider = NewDockerConfigCredentialProvider()
+	}
+
+	// The source is pulled with SourceAuth, and the target, extra targets
+	// and cache are pushed with TargetAuth, even if they're in same host.
+	// The blobs are mounted with MountFromAuth if it's specified.
+	credentials := map[string]remote.CredentialFunc{}
+	setCredential := func(ref string, credFunc remote.CredentialFunc) {
+		for _, key := range refKeys(ref) {
+			credentials[key] = credFunc
+		}
+	}
+	if opt.SourceAuth != "" {
+		credFunc, err := staticCredential(opt.SourceAuth)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse source auth")
+		}
+		setCredential(opt.Source, credFunc)
+	}
+	if opt.TargetAuth != "" {
+		credFunc, err := staticCredential(opt.TargetAuth)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse target auth")
+		}
+		for _, ref := range append([]string{opt.Target, opt.CacheRef, opt.MountFrom}, opt.ExtraTargets...) {
+			setCredential(ref, credFunc)
+		}
+	}
+	if opt.MountFromAuth != "" {
+		credFunc, err := staticCredential(opt.MountFromAuth)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse mount from auth")
+		}
+		setCredential(opt.MountFrom, credFunc)
+	}
+
+	return func(ref string) (remote.CredentialFunc, bool, error) {
+		if credFunc, ok := credentials[ref]; ok {
+			return credFunc, maps[ref], nil
+		}
+		return credentialProvider.Credential, maps[ref], nil
+	}, nil
 }
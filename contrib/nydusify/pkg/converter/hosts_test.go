@@ -0,0 +1,161 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/converter/provider"
+)
+
+func TestCredentialProvider(t *testing.T) {
+	manifest := []byte(`{"schemaVersion":2}`)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if username, password, ok := r.BasicAuth(); !ok || username != "robot" || password != "secret" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", ocispec.MediaTypeImageManifest)
+		w.Header().Set("Docker-Content-Digest", digest.FromBytes(manifest).String())
+		w.Header().Set("Content-Length", strconv.Itoa(len(manifest)))
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(manifest)
+		}
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	var consulted []string
+	opt := Opt{
+		Source: "docker.io/library/nginx:latest",
+		Target: host + "/library/nginx:nydus",
+		CredentialProvider: CredentialProviderFunc(func(host string) (string, string, error) {
+			consulted = append(consulted, host)
+			return "robot", "secret", nil
+		}),
+	}
+	hostFunc, err := hosts(opt)
+	require.NoError(t, err)
+	pvd, err := provider.New(t.TempDir(), hostFunc, 200, "v1", platforms.All, 0)
+	require.NoError(t, err)
+	pvd.UsePlainHTTP()
+
+	resolver, err := pvd.Resolver(opt.Target)
+	require.NoError(t, err)
+	_, desc, err := resolver.Resolve(context.Background(), opt.Target)
+	require.NoError(t, err)
+	require.Equal(t, digest.FromBytes(manifest), desc.Digest)
+	require.Contains(t, consulted, host)
+}
+
+func TestSourceTargetAuth(t *testing.T) {
+	manifest := []byte(`{"schemaVersion":2}`)
+	// The source repository is readable by reader, and the target repository
+	// is only accessible by writer in same registry.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		expected := "writer:write-secret"
+		if strings.HasPrefix(r.URL.Path, "/v2/source/") {
+			expected = "reader:read-secret"
+		}
+		username, password, ok := r.BasicAuth()
+		if !ok || username+":"+password != expected {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", ocispec.MediaTypeImageManifest)
+		w.Header().Set("Docker-Content-Digest", digest.FromBytes(manifest).String())
+		w.Header().Set("Content-Length", strconv.Itoa(len(manifest)))
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(manifest)
+		}
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	opt := Opt{
+		Source:     host + "/source:latest",
+		Target:     host + "/target:nydus",
+		SourceAuth: "reader:read-secret",
+		TargetAuth: "writer:write-secret",
+		CredentialProvider: CredentialProviderFunc(func(string) (string, string, error) {
+			return "", "", nil
+		}),
+	}
+	hostFunc, err := hosts(opt)
+	require.NoError(t, err)
+	pvd, err := provider.New(t.TempDir(), hostFunc, 200, "v1", platforms.All, 0)
+	require.NoError(t, err)
+	pvd.UsePlainHTTP()
+
+	for _, ref := range []string{opt.Source, opt.Target} {
+		resolver, err := pvd.Resolver(ref)
+		require.NoError(t, err)
+		_, desc, err := resolver.Resolve(context.Background(), ref)
+		require.NoError(t, err, ref)
+		require.Equal(t, digest.FromBytes(manifest), desc.Digest)
+	}
+
+	// The chunk dict isn't accessible by the target credential.
+	opt.ChunkDictRef = host + "/source:dict"
+	hostFunc, err = hosts(opt)
+	require.NoError(t, err)
+	pvd, err = provider.New(t.TempDir(), hostFunc, 200, "v1", platforms.All, 0)
+	require.NoError(t, err)
+	pvd.UsePlainHTTP()
+	resolver, err := pvd.Resolver(opt.ChunkDictRef)
+	require.NoError(t, err)
+	_, _, err = resolver.Resolve(context.Background(), opt.ChunkDictRef)
+	require.Error(t, err)
+
+	// The untagged references are pulled and pushed by the normalized ones.
+	opt.Source, opt.Target, opt.ChunkDictRef = host+"/source", host+"/target", ""
+	hostFunc, err = hosts(opt)
+	require.NoError(t, err)
+	pvd, err = provider.New(t.TempDir(), hostFunc, 200, "v1", platforms.All, 0)
+	require.NoError(t, err)
+	pvd.UsePlainHTTP()
+	for _, ref := range []string{opt.Source, opt.Target} {
+		normalized, err := normalizeRef(ref)
+		require.NoError(t, err)
+		require.Equal(t, ref+":latest", normalized)
+		resolver, err := pvd.Resolver(normalized)
+		require.NoError(t, err)
+		_, desc, err := resolver.Resolve(context.Background(), normalized)
+		require.NoError(t, err, normalized)
+		require.Equal(t, digest.FromBytes(manifest), desc.Digest)
+	}
+
+	hostFunc, err = hosts(Opt{
+		Source:         "nginx",
+		SourceAuth:     "reader:read-secret",
+		SourceInsecure: true,
+		CredentialProvider: CredentialProviderFunc(func(string) (string, string, error) {
+			return "", "", nil
+		}),
+	})
+	require.NoError(t, err)
+	credFunc, insecure, err := hostFunc("docker.io/library/nginx:latest")
+	require.NoError(t, err)
+	require.True(t, insecure)
+	username, secret, err := credFunc("docker.io")
+	require.NoError(t, err)
+	require.Equal(t, "reader:read-secret", username+":"+secret)
+
+	opt.TargetAuth = "writer"
+	_, err = hosts(opt)
+	require.Error(t, err)
+}
@@ -0,0 +1,33 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"time"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/converter/provider"
+)
+
+// ParseTarNormalization returns the normalization forcing the uid and gid
+// if they're not negative, clamping the modification times to the unix
+// timestamp maxModTime if it's not negative, and normalizing the modes, or
+// nil if nothing is normalized.
+func ParseTarNormalization(uid, gid int, maxModTime int64, modes bool) *provider.TarNormalization {
+	if uid < 0 && gid < 0 && maxModTime < 0 && !modes {
+		return nil
+	}
+	normalization := &provider.TarNormalization{Modes: modes}
+	if uid >= 0 {
+		normalization.UID = &uid
+	}
+	if gid >= 0 {
+		normalization.GID = &gid
+	}
+	if maxModTime >= 0 {
+		clamp := time.Unix(maxModTime, 0)
+		normalization.MaxModTime = &clamp
+	}
+	return normalization
+}
@@ -0,0 +1,84 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/containerd/log"
+	"github.com/pkg/errors"
+)
+
+// notifyRetries is the total attempts of posting the notification.
+const notifyRetries = 3
+
+// notifyRetryInterval is the interval between the notification attempts,
+// it's doubled after each failure.
+var notifyRetryInterval = time.Second
+
+// notifyTimeout limits each notification attempt, so that an unresponsive
+// endpoint doesn't block the conversion after the target image is pushed.
+var notifyTimeout = 30 * time.Second
+
+// Notification is posted in JSON to the `--notify-url` after the target
+// image is pushed, so that a node agent can start prefetching the image.
+type Notification struct {
+	Source    string `json:"source"`
+	Target    string `json:"target"`
+	Digest    string `json:"digest"`
+	MediaType string `json:"media_type"`
+}
+
+func postNotification(ctx context.Context, url string, data []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Timeout: notifyTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// notify posts the notification to url, the failed post is retried.
+func notify(ctx context.Context, url string, notification Notification) error {
+	data, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+
+	interval := notifyRetryInterval
+	for attempt := 1; ; attempt++ {
+		err = postNotification(ctx, url, data)
+		if err == nil {
+			log.G(ctx).Infof("notified %s of target image %s", url, notification.Target)
+			return nil
+		}
+		if attempt >= notifyRetries {
+			return errors.Wrapf(err, "post notification to %s", url)
+		}
+		log.G(ctx).WithError(err).Warnf("post notification to %s, retry (remain %d times)", url, notifyRetries-attempt)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+		interval *= 2
+	}
+}
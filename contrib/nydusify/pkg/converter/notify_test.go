@@ -0,0 +1,70 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNotify(t *testing.T) {
+	interval := notifyRetryInterval
+	notifyRetryInterval = 10 * time.Millisecond
+	defer func() { notifyRetryInterval = interval }()
+
+	var attempts int
+	var received []Notification
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		// The first attempt fails and is retried.
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		require.Equal(t, http.MethodPost, r.Method)
+		require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		var notification Notification
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&notification))
+		received = append(received, notification)
+	}))
+	defer server.Close()
+
+	notification := Notification{
+		Source:    "docker.io/library/nginx:latest",
+		Target:    "docker.io/library/nginx:latest-nydus",
+		Digest:    "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		MediaType: "application/vnd.oci.image.manifest.v1+json",
+	}
+	require.NoError(t, notify(context.Background(), server.URL, notification))
+	require.Equal(t, 2, attempts)
+	require.Equal(t, []Notification{notification}, received)
+
+	// Give up after all the attempts are failed.
+	failed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failed.Close()
+	require.Error(t, notify(context.Background(), failed.URL, notification))
+
+	// Each attempt to the unresponsive endpoint is timed out.
+	timeout := notifyTimeout
+	notifyTimeout = 50 * time.Millisecond
+	defer func() { notifyTimeout = timeout }()
+	done := make(chan struct{})
+	stalled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer stalled.Close()
+	defer close(done)
+	start := time.Now()
+	require.Error(t, notify(context.Background(), stalled.URL, notification))
+	require.Less(t, time.Since(start), 5*time.Second)
+}
@@ -0,0 +1,294 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/goharbor/acceleration-service/pkg/converter"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/backend"
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/checker/tool"
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/converter/provider"
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+// OutputVersion is the schema version of conversion output, it should be
+// bumped on any incompatible change of the Output structure.
+const OutputVersion = "v1"
+
+// Output is the structured result of conversion, only the version, the
+// references, the error and the elapsed time are recorded if it fails.
+type Output struct {
+	Version string       `json:"version"`
+	Source  ImageOutput  `json:"source"`
+	Target  ImageOutput  `json:"target"`
+	Backend string       `json:"backend"`
+	Cache   *CacheOutput `json:"cache,omitempty"`
+	// Bytes of content actually written to target registry,
+	// excluding the content already existing in registry.
+	PushedBytes int64         `json:"pushed_bytes"`
+	Elapsed     ElapsedOutput `json:"elapsed"`
+	// Bytes of content written to each repository, keyed by repository
+	// name, e.g. the target repository and the build cache repository.
+	PushedBytesByDestination map[string]int64 `json:"pushed_bytes_by_destination,omitempty"`
+	// Summary is the single line summary printed on exit, and Warnings
+	// are the issues of conversion which may need actions.
+	Summary  string   `json:"summary,omitempty"`
+	Warnings []string `json:"warnings,omitempty"`
+	Error    string   `json:"error,omitempty"`
+
+	// The flat metric fields written before the output is versioned, they
+	// are kept for the existing consumers, the durations are in nanoseconds.
+	SourceImageSize   int64 `json:"SourceImageSize"`
+	TargetImageSize   int64 `json:"TargetImageSize"`
+	SourcePullElapsed int64 `json:"SourcePullElapsed"`
+	ConversionElapsed int64 `json:"ConversionElapsed"`
+	TargetPushElapsed int64 `json:"TargetPushElapsed"`
+}
+
+type ImageOutput struct {
+	Reference string           `json:"reference"`
+	Digest    string           `json:"digest"`
+	MediaType string           `json:"media_type"`
+	Size      int64            `json:"size"`
+	Manifests []ManifestOutput `json:"manifests"`
+}
+
+type ManifestOutput struct {
+	Digest   string            `json:"digest"`
+	Platform *ocispec.Platform `json:"platform,omitempty"`
+	// SourceDigest is the digest of source manifest which the nydus
+	// manifest is converted from.
+	SourceDigest string        `json:"source_digest,omitempty"`
+	Layers       []LayerOutput `json:"layers"`
+}
+
+type LayerOutput struct {
+	Digest    string `json:"digest"`
+	MediaType string `json:"media_type"`
+	Size      int64  `json:"size"`
+}
+
+type CacheOutput struct {
+	Reference string `json:"reference"`
+	Cached    uint   `json:"cached"`
+	Total     uint   `json:"total"`
+}
+
+// ElapsedOutput records the durations of conversion stages in milliseconds.
+type ElapsedOutput struct {
+	SourcePull int64 `json:"source_pull_ms"`
+	Conversion int64 `json:"conversion_ms"`
+	TargetPush int64 `json:"target_push_ms"`
+	Total      int64 `json:"total_ms"`
+}
+
+func imageOutput(ctx context.Context, store content.Store, ref string, desc ocispec.Descriptor) (*ImageOutput, error) {
+	output := ImageOutput{
+		Reference: ref,
+		Digest:    desc.Digest.String(),
+		MediaType: desc.MediaType,
+		Manifests: []ManifestOutput{},
+	}
+
+	handler := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		switch desc.MediaType {
+		case ocispec.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList:
+			children, err := images.Children(ctx, store, desc)
+			if err != nil {
+				return nil, err
+			}
+			// Skip the manifests not pulled or converted, for example,
+			// the manifests of unspecified platforms in source index.
+			var existed []ocispec.Descriptor
+			for _, child := range children {
+				if _, err := store.Info(ctx, child.Digest); err == nil {
+					existed = append(existed, child)
+				}
+			}
+			return existed, nil
+		case ocispec.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest:
+			data, err := content.ReadBlob(ctx, store, desc)
+			if err != nil {
+				return nil, errors.Wrapf(err, "read manifest %s", desc.Digest)
+			}
+			var manifest ocispec.Manifest
+			if err := json.Unmarshal(data, &manifest); err != nil {
+				return nil, errors.Wrapf(err, "unmarshal manifest %s", desc.Digest)
+			}
+			manifestOutput := ManifestOutput{
+				Digest:       desc.Digest.String(),
+				Platform:     desc.Platform,
+				SourceDigest: manifest.Annotations[utils.ManifestNydusSourceDigest],
+				Layers:       []LayerOutput{},
+			}
+			output.Size += desc.Size + manifest.Config.Size
+			for _, layer := range manifest.Layers {
+				manifestOutput.Layers = append(manifestOutput.Layers, LayerOutput{
+					Digest:    layer.Digest.String(),
+					MediaType: layer.MediaType,
+					Size:      layer.Size,
+				})
+				output.Size += layer.Size
+			}
+			output.Manifests = append(output.Manifests, manifestOutput)
+		}
+		return nil, nil
+	})
+	if err := images.Walk(ctx, handler, desc); err != nil {
+		return nil, err
+	}
+
+	return &output, nil
+}
+
+func newOutput(ctx context.Context, opt Opt, pvd *provider.Provider, metric *converter.Metric, elapsed time.Duration) (*Output, error) {
+	sourceRef, err := normalizeRef(opt.Source)
+	if err != nil {
+		return nil, err
+	}
+	targetRef, err := normalizeRef(opt.Target)
+	if err != nil {
+		return nil, err
+	}
+	sourceDesc, err := pvd.Image(ctx, sourceRef)
+	if err != nil {
+		return nil, errors.Wrap(err, "get source image")
+	}
+	targetDesc, err := pvd.Image(ctx, targetRef)
+	if err != nil {
+		return nil, errors.Wrap(err, "get target image")
+	}
+
+	source, err := imageOutput(ctx, pvd.ContentStore(), sourceRef, *sourceDesc)
+	if err != nil {
+		return nil, errors.Wrap(err, "collect source image")
+	}
+	target, err := imageOutput(ctx, pvd.ContentStore(), targetRef, *targetDesc)
+	if err != nil {
+		return nil, errors.Wrap(err, "collect target image")
+	}
+
+	output := failedOutput(opt, metric, elapsed, nil)
+	output.Source = *source
+	output.Target = *target
+	output.PushedBytes = pvd.PushedBytes()
+	output.PushedBytesByDestination = pvd.PushedBytesByDestination()
+	output.Warnings = conversionWarnings(opt, target)
+	if opt.CacheRef != "" && !opt.NoCache {
+		output.Cache = &CacheOutput{Reference: opt.CacheRef}
+		if hit := pvd.CacheHit(sourceRef); hit != nil {
+			output.Cache.Cached = hit.Cached
+			output.Cache.Total = hit.Total
+		}
+	}
+	output.Summary = summarize(output)
+
+	return output, nil
+}
+
+// failedOutput is the output of conversion aborted by err, the image details
+// are not collected since the target image may not be pushed, metric is nil
+// if the conversion is aborted before converting.
+func failedOutput(opt Opt, metric *converter.Metric, elapsed time.Duration, err error) *Output {
+	backend := opt.BackendType
+	if backend == "" {
+		backend = "registry"
+	}
+
+	output := Output{
+		Version: OutputVersion,
+		Source:  ImageOutput{Reference: opt.Source, Manifests: []ManifestOutput{}},
+		Target:  ImageOutput{Reference: opt.Target, Manifests: []ManifestOutput{}},
+		Backend: backend,
+		Elapsed: ElapsedOutput{Total: elapsed.Milliseconds()},
+	}
+	if err != nil {
+		output.Error = err.Error()
+	}
+	if metric != nil {
+		output.Elapsed.SourcePull = metric.SourcePullElapsed.Milliseconds()
+		output.Elapsed.Conversion = metric.ConversionElapsed.Milliseconds()
+		output.Elapsed.TargetPush = metric.TargetPushElapsed.Milliseconds()
+		output.SourceImageSize = metric.SourceImageSize
+		output.TargetImageSize = metric.TargetImageSize
+		output.SourcePullElapsed = int64(metric.SourcePullElapsed)
+		output.ConversionElapsed = int64(metric.ConversionElapsed)
+		output.TargetPushElapsed = int64(metric.TargetPushElapsed)
+	}
+
+	return &output
+}
+
+func dumpOutput(output *Output, path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return errors.Wrap(err, "Create file for output")
+	}
+	defer file.Close()
+
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(output); err != nil {
+		return errors.Wrap(err, "Encode JSON from output")
+	}
+	return nil
+}
+
+// BackendObjectsOutput is the list of the nydus blob objects written to the
+// storage backend by conversion.
+type BackendObjectsOutput struct {
+	Version string                   `json:"version"`
+	Target  string                   `json:"target"`
+	Backend string                   `json:"backend"`
+	Objects []provider.BackendObject `json:"objects"`
+}
+
+// dumpBackendObjects saves the blob objects of the converted target image
+// written to backend into opt.BackendObjectsOutput, the object keys are
+// resolved by the backend if it implements backend.ObjectLocator.
+func dumpBackendObjects(ctx context.Context, opt Opt, pvd *provider.Provider) error {
+	blobBackend, err := backend.NewBackend(opt.BackendType, []byte(opt.BackendConfig), nil)
+	if err != nil {
+		return errors.Wrap(err, "init storage backend")
+	}
+	key := func(blobID string) string {
+		return blobID
+	}
+	if locator, ok := blobBackend.(backend.ObjectLocator); ok {
+		key = locator.ObjectKey
+	}
+	targetRef, err := normalizeRef(opt.Target)
+	if err != nil {
+		return err
+	}
+	targetDesc, err := pvd.Image(ctx, targetRef)
+	if err != nil {
+		return err
+	}
+	objects, err := pvd.BackendObjects(ctx, *targetDesc, tool.NewInspector(opt.NydusImagePath), key)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(BackendObjectsOutput{
+		Version: OutputVersion,
+		Target:  targetRef,
+		Backend: opt.BackendType,
+		Objects: objects,
+	}, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "marshal backend objects")
+	}
+	return os.WriteFile(opt.BackendObjectsOutput, data, 0644)
+}
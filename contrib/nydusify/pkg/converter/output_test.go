@@ -0,0 +1,170 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/goharbor/acceleration-service/pkg/converter"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func writeJSONBlob(t *testing.T, store content.Store, mediaType string, obj interface{}) ocispec.Descriptor {
+	data, err := json.Marshal(obj)
+	require.NoError(t, err)
+	desc := ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+	require.NoError(t, content.WriteBlob(context.Background(), store, desc.Digest.String(), bytes.NewReader(data), desc))
+	return desc
+}
+
+func TestImageOutput(t *testing.T) {
+	ctx := context.Background()
+	store, err := local.NewStore(t.TempDir())
+	require.NoError(t, err)
+
+	config := writeJSONBlob(t, store, ocispec.MediaTypeImageConfig, ocispec.Image{})
+	manifest := writeJSONBlob(t, store, ocispec.MediaTypeImageManifest, ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers: []ocispec.Descriptor{
+			{
+				MediaType: "application/vnd.oci.image.layer.nydus.blob.v1",
+				Digest:    digest.FromString("blob"),
+				Size:      1000,
+			},
+			{
+				MediaType: ocispec.MediaTypeImageLayerGzip,
+				Digest:    digest.FromString("bootstrap"),
+				Size:      100,
+			},
+		},
+	})
+	manifest.Platform = &ocispec.Platform{OS: "linux", Architecture: "amd64"}
+	index := writeJSONBlob(t, store, ocispec.MediaTypeImageIndex, ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{
+			manifest,
+			// Not pulled manifest should be skipped.
+			{
+				MediaType: ocispec.MediaTypeImageManifest,
+				Digest:    digest.FromString("arm64"),
+				Size:      10,
+				Platform:  &ocispec.Platform{OS: "linux", Architecture: "arm64"},
+			},
+		},
+	})
+
+	output, err := imageOutput(ctx, store, "docker.io/library/nginx:latest-nydus", index)
+	require.NoError(t, err)
+	require.Equal(t, index.Digest.String(), output.Digest)
+	require.Equal(t, ocispec.MediaTypeImageIndex, output.MediaType)
+	require.Equal(t, manifest.Size+config.Size+1100, output.Size)
+	require.Len(t, output.Manifests, 1)
+	require.Equal(t, manifest.Digest.String(), output.Manifests[0].Digest)
+	require.Equal(t, "amd64", output.Manifests[0].Platform.Architecture)
+	require.Equal(t, []LayerOutput{
+		{Digest: digest.FromString("blob").String(), MediaType: "application/vnd.oci.image.layer.nydus.blob.v1", Size: 1000},
+		{Digest: digest.FromString("bootstrap").String(), MediaType: ocispec.MediaTypeImageLayerGzip, Size: 100},
+	}, output.Manifests[0].Layers)
+}
+
+func TestDumpOutput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "output.json")
+	output := &Output{
+		Version: OutputVersion,
+		Source: ImageOutput{
+			Reference: "docker.io/library/nginx:latest",
+			Manifests: []ManifestOutput{},
+		},
+		Target: ImageOutput{
+			Reference: "docker.io/library/nginx:latest-nydus",
+			Manifests: []ManifestOutput{{Digest: digest.FromString("manifest").String(), Layers: []LayerOutput{}}},
+		},
+		Backend:     "registry",
+		Cache:       &CacheOutput{Reference: "docker.io/library/nginx:cache", Cached: 1, Total: 2},
+		PushedBytes: 1024,
+		Elapsed:     ElapsedOutput{SourcePull: 1, Conversion: 2, TargetPush: 3},
+	}
+	require.NoError(t, dumpOutput(output, path))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	// Stable schema consumed by external tools.
+	var raw map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &raw))
+	for _, key := range []string{"version", "source", "target", "backend", "cache", "pushed_bytes", "elapsed"} {
+		require.Contains(t, raw, key)
+	}
+	require.Equal(t, "v1", raw["version"])
+	target := raw["target"].(map[string]interface{})
+	for _, key := range []string{"reference", "digest", "media_type", "size", "manifests"} {
+		require.Contains(t, target, key)
+	}
+	elapsed := raw["elapsed"].(map[string]interface{})
+	for _, key := range []string{"source_pull_ms", "conversion_ms", "target_push_ms"} {
+		require.Contains(t, elapsed, key)
+	}
+	cache := raw["cache"].(map[string]interface{})
+	for _, key := range []string{"reference", "cached", "total"} {
+		require.Contains(t, cache, key)
+	}
+
+	var decoded Output
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	require.Equal(t, *output, decoded)
+}
+
+func TestFailedOutput(t *testing.T) {
+	opt := Opt{Source: "nginx:latest", Target: "nginx:latest-nydus"}
+	metric := &converter.Metric{
+		SourceImageSize:   1024,
+		SourcePullElapsed: 2 * time.Second,
+	}
+	output := failedOutput(opt, metric, 3*time.Second, errors.New("build failed"))
+	require.Equal(t, "build failed", output.Error)
+	require.Equal(t, "registry", output.Backend)
+	require.Equal(t, int64(3000), output.Elapsed.Total)
+	require.Equal(t, int64(2000), output.Elapsed.SourcePull)
+
+	path := filepath.Join(t.TempDir(), "output.json")
+	require.NoError(t, dumpOutput(output, path))
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	// The flat metric fields are still readable by the old consumers.
+	var legacy struct {
+		SourceImageSize   int64
+		TargetImageSize   int64
+		SourcePullElapsed int64
+	}
+	require.NoError(t, json.Unmarshal(data, &legacy))
+	require.Equal(t, int64(1024), legacy.SourceImageSize)
+	require.Equal(t, int64(0), legacy.TargetImageSize)
+	require.Equal(t, int64(2*time.Second), legacy.SourcePullElapsed)
+
+	// Aborted before converting.
+	output = failedOutput(opt, nil, time.Second, errors.New("invalid platform"))
+	require.Equal(t, "nginx:latest", output.Source.Reference)
+	require.Equal(t, int64(0), output.SourceImageSize)
+}
@@ -0,0 +1,87 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/log"
+	"github.com/goharbor/acceleration-service/pkg/platformutil"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/converter/provider"
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+// PrefetchSources pulls the source images into the content store of
+// BuildCacheDir without building or pushing, so that the subsequent
+// conversions with the same build cache directory don't pull the layers
+// again. The source options of opt, e.g. SourceInsecure, SourceAuth and the
+// platforms, are applied to each of sources.
+func PrefetchSources(ctx context.Context, opt Opt, sources []string) error {
+	if opt.BuildCacheDir == "" {
+		return errors.New("build cache directory is required to prefetch source images")
+	}
+	ctx = namespaces.WithNamespace(ctx, "nydusify")
+	platformMC, err := platformutil.ParsePlatforms(opt.AllPlatforms, opt.Platforms)
+	if err != nil {
+		return err
+	}
+
+	if opt.WorkDir != "" {
+		if err := os.MkdirAll(opt.WorkDir, 0755); err != nil {
+			return errors.Wrap(err, "prepare work directory")
+		}
+	}
+	tmpDir, err := os.MkdirTemp(opt.WorkDir, "nydusify-")
+	if err != nil {
+		return errors.Wrap(err, "create temp directory")
+	}
+	defer os.RemoveAll(tmpDir)
+
+	lock, err := lockBuildCacheDir(ctx, opt.BuildCacheDir)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	contentDir := filepath.Join(opt.BuildCacheDir, "content")
+
+	for _, source := range sources {
+		ref, err := normalizeRef(source)
+		if err != nil {
+			return err
+		}
+		opt.Source = ref
+		if err := checkAllowedRegistries(opt); err != nil {
+			return err
+		}
+		hostFunc, err := hosts(opt)
+		if err != nil {
+			return err
+		}
+		pvd, err := provider.NewWithContentDir(tmpDir, contentDir, hostFunc, opt.CacheMaxRecords, opt.CacheVersion, platformMC, 0)
+		if err != nil {
+			return err
+		}
+		pvd.SetTimeouts(opt.DialTimeout, opt.ReadTimeout)
+		pvd.SetRegistryTimeouts(opt.ManifestTimeout, opt.BlobTimeout)
+		if err := pvd.Pull(ctx, ref); err != nil {
+			if !utils.RetryWithHTTP(err) {
+				return errors.Wrapf(err, "pull source image %s", ref)
+			}
+			log.G(ctx).Infof("try to pull with plain HTTP for %s", ref)
+			pvd.UsePlainHTTP()
+			if err := pvd.Pull(ctx, ref); err != nil {
+				return errors.Wrapf(err, "try to pull source image %s", ref)
+			}
+		}
+		log.G(ctx).Infof("prefetched source image %s into %s", ref, opt.BuildCacheDir)
+	}
+
+	return nil
+}
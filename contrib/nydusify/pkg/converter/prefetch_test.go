@@ -0,0 +1,148 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/goharbor/acceleration-service/pkg/remote"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/converter/provider"
+)
+
+// sourceRegistry serves a single manifest image read-only, and counts the
+// blob downloads.
+type sourceRegistry struct {
+	mutex     sync.Mutex
+	blobs     map[digest.Digest][]byte
+	manifest  ocispec.Descriptor
+	downloads map[digest.Digest]int
+}
+
+func newSourceRegistry(t *testing.T) (*sourceRegistry, string) {
+	registry := &sourceRegistry{blobs: map[digest.Digest][]byte{}, downloads: map[digest.Digest]int{}}
+	add := func(mediaType string, data []byte) ocispec.Descriptor {
+		desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(data), Size: int64(len(data))}
+		registry.blobs[desc.Digest] = data
+		return desc
+	}
+	layer := add(ocispec.MediaTypeImageLayer, []byte("source layer"))
+	configData, err := json.Marshal(ocispec.Image{
+		Platform: ocispec.Platform{OS: "linux", Architecture: "amd64"},
+		RootFS:   ocispec.RootFS{Type: "layers", DiffIDs: []digest.Digest{layer.Digest}},
+	})
+	require.NoError(t, err)
+	manifestData, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    add(ocispec.MediaTypeImageConfig, configData),
+		Layers:    []ocispec.Descriptor{layer},
+	})
+	require.NoError(t, err)
+	registry.manifest = add(ocispec.MediaTypeImageManifest, manifestData)
+
+	server := httptest.NewServer(registry)
+	t.Cleanup(server.Close)
+	return registry, strings.TrimPrefix(server.URL, "http://")
+}
+
+func (registry *sourceRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	var desc ocispec.Descriptor
+	switch {
+	case r.URL.Path == "/v2/":
+		return
+	case strings.Contains(r.URL.Path, "/manifests/"):
+		desc = registry.manifest
+	case strings.Contains(r.URL.Path, "/blobs/"):
+		dgst := digest.Digest(r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:])
+		data, ok := registry.blobs[dgst]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		desc = ocispec.Descriptor{MediaType: "application/octet-stream", Digest: dgst, Size: int64(len(data))}
+		if r.Method == http.MethodGet {
+			registry.downloads[dgst]++
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", desc.MediaType)
+	w.Header().Set("Docker-Content-Digest", desc.Digest.String())
+	w.Header().Set("Content-Length", strconv.FormatInt(desc.Size, 10))
+	if r.Method == http.MethodGet {
+		_, _ = w.Write(registry.blobs[desc.Digest])
+	}
+}
+
+func (registry *sourceRegistry) Downloads() map[digest.Digest]int {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	downloads := map[digest.Digest]int{}
+	for dgst, count := range registry.downloads {
+		downloads[dgst] = count
+	}
+	return downloads
+}
+
+func TestPrefetchSources(t *testing.T) {
+	registry, host := newSourceRegistry(t)
+	ref := host + "/library/source:latest"
+	cacheDir := t.TempDir()
+
+	require.Error(t, PrefetchSources(context.Background(), Opt{WorkDir: t.TempDir()}, []string{ref}))
+	require.Error(t, PrefetchSources(context.Background(), Opt{
+		WorkDir:           t.TempDir(),
+		BuildCacheDir:     cacheDir,
+		AllowedRegistries: []string{"registry.example.com"},
+	}, []string{ref}))
+
+	require.NoError(t, PrefetchSources(context.Background(), Opt{
+		WorkDir:        t.TempDir(),
+		BuildCacheDir:  cacheDir,
+		SourceInsecure: true,
+		AllPlatforms:   true,
+	}, []string{ref}))
+	downloads := registry.Downloads()
+	require.Len(t, downloads, 2)
+	for dgst, count := range downloads {
+		require.Equal(t, 1, count)
+		_, err := os.Stat(filepath.Join(cacheDir, "content", "blobs", dgst.Algorithm().String(), dgst.Encoded()))
+		require.NoError(t, err)
+	}
+
+	// The conversion with the build cache directory pulls the source from
+	// the cache without downloading the blobs again.
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	hosts := func(string) (remote.CredentialFunc, bool, error) {
+		return func(string) (string, string, error) { return "", "", nil }, true, nil
+	}
+	pvd, err := provider.NewWithContentDir(t.TempDir(), filepath.Join(cacheDir, "content"), hosts, 200, "v1", platforms.All, 0)
+	require.NoError(t, err)
+	pvd.UsePlainHTTP()
+	require.NoError(t, pvd.Pull(ctx, ref))
+	require.Equal(t, downloads, registry.Downloads())
+	desc, err := pvd.Image(ctx, ref)
+	require.NoError(t, err)
+	require.Equal(t, registry.manifest.Digest, desc.Digest)
+}
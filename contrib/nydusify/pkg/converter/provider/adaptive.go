@@ -0,0 +1,278 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/log"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// latencyTolerance is the multiple of the lowest latency observed, beyond
+// which the registry is considered to be overloaded.
+const latencyTolerance = 2
+
+// AdaptiveLimiter limits the concurrent requests to registry by AIMD
+// (additive increase, multiplicative decrease): the limit grows by one
+// after a window of requests succeeded in time, and is halved once a request
+// fails or its latency exceeds the tolerance of the lowest latency observed,
+// so that the throughput is maximized without triggering the rate limit of
+// registry. The limit is bounded by [min, max].
+type AdaptiveLimiter struct {
+	mutex      sync.Mutex
+	min        int
+	max        int
+	limit      float64
+	inflight   int
+	minLatency time.Duration
+	// generation is increased on each decrease, the requests acquired
+	// before the decrease don't decrease the limit again.
+	generation uint64
+	wait       chan struct{}
+}
+
+// NewAdaptiveLimiter creates a limiter starting from the min limit.
+func NewAdaptiveLimiter(min, max int) *AdaptiveLimiter {
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+	return &AdaptiveLimiter{
+		min:   min,
+		max:   max,
+		limit: float64(min),
+		wait:  make(chan struct{}),
+	}
+}
+
+// Limit returns the current concurrency limit.
+func (limiter *AdaptiveLimiter) Limit() int {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	return int(limiter.limit)
+}
+
+// Acquire waits for a slot under the current limit, the returned generation
+// must be passed to Release.
+func (limiter *AdaptiveLimiter) Acquire(ctx context.Context) (uint64, error) {
+	for {
+		limiter.mutex.Lock()
+		if limiter.inflight < int(limiter.limit) {
+			limiter.inflight++
+			generation := limiter.generation
+			limiter.mutex.Unlock()
+			return generation, nil
+		}
+		wait := limiter.wait
+		limiter.mutex.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-wait:
+		}
+	}
+}
+
+// Release releases the slot and adjusts the limit by the latency and error
+// of request.
+func (limiter *AdaptiveLimiter) Release(ctx context.Context, generation uint64, latency time.Duration, err error) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	limiter.inflight--
+	defer func() {
+		close(limiter.wait)
+		limiter.wait = make(chan struct{})
+	}()
+
+	if isExpectedError(err) {
+		return
+	}
+	if err == nil && (limiter.minLatency == 0 || latency < limiter.minLatency) {
+		limiter.minLatency = latency
+	}
+	if err != nil || latency > latencyTolerance*limiter.minLatency {
+		if generation != limiter.generation {
+			return
+		}
+		limiter.generation++
+		limit := limiter.limit / 2
+		if limit < float64(limiter.min) {
+			limit = float64(limiter.min)
+		}
+		if int(limit) != int(limiter.limit) {
+			log.G(ctx).Debugf("decrease concurrency limit to %d, latency %s, error %v", int(limit), latency, err)
+		}
+		limiter.limit = limit
+		return
+	}
+
+	limit := limiter.limit + 1/limiter.limit
+	if limit > float64(limiter.max) {
+		limit = float64(limiter.max)
+	}
+	if int(limit) != int(limiter.limit) {
+		log.G(ctx).Debugf("increase concurrency limit to %d", int(limit))
+	}
+	limiter.limit = limit
+}
+
+// isExpectedError returns true for the error which isn't caused by the
+// registry load, e.g. pushing the content already existing in registry.
+func isExpectedError(err error) bool {
+	return err != nil && (errdefs.IsAlreadyExists(err) || errdefs.IsNotFound(err) ||
+		errors.Is(err, context.Canceled))
+}
+
+// SetAdaptiveConcurrency replaces the static LayerConcurrentLimit with an
+// AdaptiveLimiter bounded by [min, max] for pulling and pushing layers.
+func (pvd *Provider) SetAdaptiveConcurrency(min, max int) {
+	pvd.limiter = NewAdaptiveLimiter(min, max)
+}
+
+func (pvd *Provider) concurrencyLimit() int {
+	if pvd.limiter != nil {
+		return pvd.limiter.max
+	}
+	return LayerConcurrentLimit
+}
+
+func (pvd *Provider) limitedResolver(resolver remotes.Resolver) remotes.Resolver {
+	if pvd.limiter == nil {
+		return resolver
+	}
+	return &limitedResolver{Resolver: resolver, limiter: pvd.limiter}
+}
+
+// limitedResolver limits the concurrent fetching and pushing of content by
+// AdaptiveLimiter, the latency is measured until the response of registry
+// is received, rather than the whole transfer depending on content size.
+type limitedResolver struct {
+	remotes.Resolver
+	limiter *AdaptiveLimiter
+}
+
+func (resolver *limitedResolver) Fetcher(ctx context.Context, ref string) (remotes.Fetcher, error) {
+	fetcher, err := resolver.Resolver.Fetcher(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	return &limitedFetcher{Fetcher: fetcher, limiter: resolver.limiter}, nil
+}
+
+func (resolver *limitedResolver) Pusher(ctx context.Context, ref string) (remotes.Pusher, error) {
+	pusher, err := resolver.Resolver.Pusher(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	return &limitedPusher{Pusher: pusher, limiter: resolver.limiter}, nil
+}
+
+type limitedFetcher struct {
+	remotes.Fetcher
+	limiter *AdaptiveLimiter
+}
+
+func (fetcher *limitedFetcher) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	generation, err := fetcher.limiter.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	reader, err := fetcher.Fetcher.Fetch(ctx, desc)
+	if err != nil {
+		fetcher.limiter.Release(ctx, generation, time.Since(start), err)
+		return nil, err
+	}
+	return &limitedReader{
+		ReadCloser: reader,
+		slot:       slot{ctx: ctx, limiter: fetcher.limiter, generation: generation, latency: time.Since(start)},
+	}, nil
+}
+
+type limitedPusher struct {
+	remotes.Pusher
+	limiter *AdaptiveLimiter
+}
+
+func (pusher *limitedPusher) Push(ctx context.Context, desc ocispec.Descriptor) (content.Writer, error) {
+	generation, err := pusher.limiter.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	writer, err := pusher.Pusher.Push(ctx, desc)
+	if err != nil {
+		pusher.limiter.Release(ctx, generation, time.Since(start), err)
+		return nil, err
+	}
+	return &limitedWriter{
+		Writer: writer,
+		slot:   slot{ctx: ctx, limiter: pusher.limiter, generation: generation, latency: time.Since(start)},
+	}, nil
+}
+
+// slot is held by the reader or writer until it's closed.
+type slot struct {
+	once       sync.Once
+	ctx        context.Context
+	limiter    *AdaptiveLimiter
+	generation uint64
+	latency    time.Duration
+	err        error
+}
+
+func (slot *slot) release() {
+	slot.once.Do(func() {
+		slot.limiter.Release(slot.ctx, slot.generation, slot.latency, slot.err)
+	})
+}
+
+type limitedReader struct {
+	io.ReadCloser
+	slot slot
+}
+
+func (reader *limitedReader) Read(p []byte) (int, error) {
+	n, err := reader.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		reader.slot.err = err
+	}
+	return n, err
+}
+
+func (reader *limitedReader) Close() error {
+	defer reader.slot.release()
+	return reader.ReadCloser.Close()
+}
+
+type limitedWriter struct {
+	content.Writer
+	slot slot
+}
+
+func (writer *limitedWriter) Commit(ctx context.Context, size int64, expected digest.Digest, opts ...content.Opt) error {
+	err := writer.Writer.Commit(ctx, size, expected, opts...)
+	writer.slot.err = err
+	writer.slot.release()
+	return err
+}
+
+func (writer *limitedWriter) Close() error {
+	defer writer.slot.release()
+	return writer.Writer.Close()
+}
@@ -0,0 +1,96 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// loadedFetcher is a backend whose latency rises with the concurrent
+// requests, and fails the requests once the max concurrency is exceeded.
+type loadedFetcher struct {
+	inflight    int32
+	maxInflight int32
+	rateLimit   int32
+}
+
+func (fetcher *loadedFetcher) Fetch(_ context.Context, _ ocispec.Descriptor) (io.ReadCloser, error) {
+	inflight := atomic.AddInt32(&fetcher.inflight, 1)
+	defer atomic.AddInt32(&fetcher.inflight, -1)
+	for {
+		max := atomic.LoadInt32(&fetcher.maxInflight)
+		if inflight <= max || atomic.CompareAndSwapInt32(&fetcher.maxInflight, max, inflight) {
+			break
+		}
+	}
+	if inflight > fetcher.rateLimit {
+		return nil, fmt.Errorf("too many requests")
+	}
+	time.Sleep(time.Duration(inflight) * 5 * time.Millisecond)
+	return io.NopCloser(strings.NewReader("data")), nil
+}
+
+func TestAdaptiveLimiter(t *testing.T) {
+	limiter := NewAdaptiveLimiter(1, 16)
+	backend := &loadedFetcher{rateLimit: 8}
+	fetcher := &limitedFetcher{Fetcher: backend, limiter: limiter}
+
+	var maxLimit int
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for worker := 0; worker < 16; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				reader, err := fetcher.Fetch(context.Background(), ocispec.Descriptor{})
+				if err == nil {
+					_, _ = io.ReadAll(reader)
+					reader.Close()
+				}
+				mutex.Lock()
+				if limit := limiter.Limit(); limit > maxLimit {
+					maxLimit = limit
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// The concurrency grows from the min limit, then backs off as the
+	// latency rises, never reaching the max limit or the rate limit.
+	require.Greater(t, maxLimit, 1)
+	require.Less(t, limiter.Limit(), 16)
+	require.Less(t, atomic.LoadInt32(&backend.maxInflight), int32(16))
+	require.LessOrEqual(t, int(atomic.LoadInt32(&backend.maxInflight)), maxLimit)
+
+	// The errors halve the limit down to the min limit.
+	backend.rateLimit = 0
+	for i := 0; i < 5; i++ {
+		_, err := fetcher.Fetch(context.Background(), ocispec.Descriptor{})
+		require.Error(t, err)
+	}
+	require.Equal(t, 1, limiter.Limit())
+
+	// The acquiring is canceled with context.
+	generation, err := limiter.Acquire(context.Background())
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = limiter.Acquire(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	limiter.Release(context.Background(), generation, 0, nil)
+}
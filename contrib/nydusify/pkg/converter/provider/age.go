@@ -0,0 +1,58 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"time"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// CheckSourceAge refuses the source image ref created more than maxAge ago,
+// by the created time in the configs of manifests matched by platform,
+// before pulling the layers. The image config without created time is
+// refused too, its age is unknown.
+func (pvd *Provider) CheckSourceAge(ctx context.Context, ref string, maxAge time.Duration) error {
+	resolver, err := pvd.Resolver(ref)
+	if err != nil {
+		return err
+	}
+	name, _, err := resolver.Resolve(ctx, ref)
+	if err != nil {
+		return errors.Wrapf(err, "resolve source image %s", ref)
+	}
+	fetcher, err := resolver.Fetcher(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	var configs []ocispec.Descriptor
+	if _, err := pvd.walkManifests(ctx, ref, pvd.platformMC, func(manifest ocispec.Manifest, _ ocispec.Descriptor) string {
+		configs = append(configs, manifest.Config)
+		return ""
+	}); err != nil {
+		return errors.Wrapf(err, "get source image %s", ref)
+	}
+
+	oldest := time.Now().Add(-maxAge)
+	for _, desc := range configs {
+		if err := fetchToStore(ctx, pvd.store, fetcher, desc); err != nil {
+			return err
+		}
+		var config ocispec.Image
+		if err := readJSON(ctx, pvd.store, desc, &config); err != nil {
+			return errors.Wrapf(err, "read config %s", desc.Digest)
+		}
+		if config.Created == nil {
+			return errors.Errorf("source image %s has no created time in config %s, refuse to convert with max source age %s", ref, desc.Digest, maxAge)
+		}
+		if config.Created.Before(oldest) {
+			return errors.Errorf("source image %s created at %s is older than max source age %s, refuse to convert", ref, config.Created.Format(time.RFC3339), maxAge)
+		}
+	}
+	return nil
+}
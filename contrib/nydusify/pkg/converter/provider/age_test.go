@@ -0,0 +1,53 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckSourceAge(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	registry := newPushableRegistry(t)
+	addImage := func(tag string, created *time.Time) string {
+		configData, err := json.Marshal(ocispec.Image{
+			Created:  created,
+			Platform: ocispec.Platform{OS: "linux", Architecture: "amd64"},
+		})
+		require.NoError(t, err)
+		manifestData, err := json.Marshal(ocispec.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: ocispec.MediaTypeImageManifest,
+			Config:    registry.AddBlob(ocispec.MediaTypeImageConfig, configData),
+			Layers:    []ocispec.Descriptor{registry.AddBlob(ocispec.MediaTypeImageLayerGzip, []byte("layer "+tag))},
+		})
+		require.NoError(t, err)
+		manifest := registry.AddBlob(ocispec.MediaTypeImageManifest, manifestData)
+		registry.SetTag("library/source", tag, manifest.Digest)
+		return registry.host + "/library/source:" + tag
+	}
+	old := time.Now().Add(-90 * 24 * time.Hour)
+	recent := time.Now().Add(-time.Hour)
+	maxAge := 30 * 24 * time.Hour
+
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+	err := pvd.CheckSourceAge(ctx, addImage("old", &old), maxAge)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "is older than max source age")
+	err = pvd.CheckSourceAge(ctx, addImage("unknown", nil), maxAge)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "has no created time")
+
+	require.NoError(t, pvd.CheckSourceAge(ctx, addImage("recent", &recent), maxAge))
+}
@@ -0,0 +1,105 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containerd/containerd/content"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+// ArtifactTypeNydus is the artifact type of nydus manifest converted from
+// the source manifest declaring an artifact type with the nydus policy.
+const ArtifactTypeNydus = "application/vnd.nydus.image.v1"
+
+// The policies for the artifact type declared by OCI source manifest.
+const (
+	// ArtifactTypePolicyKeep preserves the artifact type of source manifest
+	// in nydus manifest.
+	ArtifactTypePolicyKeep = "keep"
+	// ArtifactTypePolicyNydus replaces the artifact type of source manifest
+	// with ArtifactTypeNydus in nydus manifest.
+	ArtifactTypePolicyNydus = "nydus"
+)
+
+// ArtifactTypePolicies are the policies accepted by SetArtifactTypePolicy.
+var ArtifactTypePolicies = []string{ArtifactTypePolicyKeep, ArtifactTypePolicyNydus}
+
+// SetArtifactTypePolicy sets the policy for the artifact type declared by
+// source manifest, empty policy means ArtifactTypePolicyKeep. The nydus
+// manifest converted from the source manifest without artifact type
+// doesn't declare it either.
+func (pvd *Provider) SetArtifactTypePolicy(policy string) error {
+	if policy == "" {
+		policy = ArtifactTypePolicyKeep
+	}
+	for _, known := range ArtifactTypePolicies {
+		if policy == known {
+			pvd.artifactTypePolicy = policy
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported artifact type policy %s, possible values: %v", policy, ArtifactTypePolicies)
+}
+
+// sourceArtifactType returns the artifact type of the source manifest of
+// nydus manifest, it returns the artifact type of nydus manifest if the
+// source manifest isn't in store.
+func sourceArtifactType(ctx context.Context, store content.Store, manifest ocispec.Manifest) (string, error) {
+	sourceDigest, err := digest.Parse(manifest.Annotations[utils.ManifestNydusSourceDigest])
+	if err != nil {
+		return manifest.ArtifactType, nil
+	}
+	info, err := store.Info(ctx, sourceDigest)
+	if err != nil {
+		return manifest.ArtifactType, nil
+	}
+	var sourceManifest ocispec.Manifest
+	if err := readJSON(ctx, store, ocispec.Descriptor{Digest: info.Digest, Size: info.Size}, &sourceManifest); err != nil {
+		return "", errors.Wrap(err, "read source manifest")
+	}
+	return sourceManifest.ArtifactType, nil
+}
+
+// setManifestArtifactType sets the artifact type of nydus manifest by the
+// artifact type of its source manifest and policy, the docker manifest
+// doesn't support the artifact type so it's kept as is.
+func setManifestArtifactType(ctx context.Context, store content.Store, desc *ocispec.Descriptor, manifest *ocispec.Manifest, policy string) (bool, error) {
+	if desc.MediaType != ocispec.MediaTypeImageManifest {
+		return false, nil
+	}
+	if !isNydusManifest(manifest) {
+		return false, nil
+	}
+
+	artifactType, err := sourceArtifactType(ctx, store, *manifest)
+	if err != nil {
+		return false, err
+	}
+	if artifactType != "" && policy == ArtifactTypePolicyNydus {
+		artifactType = ArtifactTypeNydus
+	}
+	if manifest.ArtifactType == artifactType {
+		return false, nil
+	}
+	manifest.ArtifactType = artifactType
+	desc.ArtifactType = artifactType
+
+	return true, nil
+}
+
+// setArtifactType sets the artifact type of all the nydus manifests in
+// image, see setManifestArtifactType.
+func setArtifactType(ctx context.Context, store content.Store, desc ocispec.Descriptor, policy string) (*ocispec.Descriptor, error) {
+	return rewriteManifests(ctx, store, desc, nil, func(manifestDesc *ocispec.Descriptor, manifest *ocispec.Manifest) (bool, error) {
+		return setManifestArtifactType(ctx, store, manifestDesc, manifest, policy)
+	})
+}
@@ -0,0 +1,87 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"testing"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+func TestPushArtifactType(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+	require.Error(t, pvd.SetArtifactTypePolicy("drop"))
+
+	// The source manifest declares an artifact type, which is missing in
+	// the nydus manifest built from it.
+	config, err := writeJSON(ctx, pvd.store, ocispec.Image{Platform: ocispec.Platform{OS: "linux", Architecture: "amd64"}}, ocispec.MediaTypeImageConfig)
+	require.NoError(t, err)
+	layer, err := writeJSON(ctx, pvd.store, map[string]string{"layer": "data"}, ocispec.MediaTypeImageLayerGzip)
+	require.NoError(t, err)
+	const artifactType = "application/vnd.example.wasm.v1"
+	source, err := writeJSON(ctx, pvd.store, ocispec.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    ocispec.MediaTypeImageManifest,
+		ArtifactType: artifactType,
+		Config:       *config,
+		Layers:       []ocispec.Descriptor{*layer},
+	}, ocispec.MediaTypeImageManifest)
+	require.NoError(t, err)
+	writeNydus := func(sourceDigest string) ocispec.Descriptor {
+		nydus, _, _ := writeNydusImage(t, ctx, pvd)
+		var manifest ocispec.Manifest
+		require.NoError(t, readJSON(ctx, pvd.store, nydus, &manifest))
+		manifest.Annotations[utils.ManifestNydusSourceDigest] = sourceDigest
+		desc, err := writeJSON(ctx, pvd.store, manifest, ocispec.MediaTypeImageManifest)
+		require.NoError(t, err)
+		return *desc
+	}
+	nydus := writeNydus(source.Digest.String())
+
+	registry := newPushableRegistry(t)
+	pushedArtifactType := func(ref string) string {
+		desc, err := pvd.Image(ctx, ref)
+		require.NoError(t, err)
+		var manifest ocispec.Manifest
+		require.NoError(t, readJSON(ctx, pvd.store, *desc, &manifest))
+		return manifest.ArtifactType
+	}
+
+	// The artifact type of source is kept by default.
+	ref := registry.host + "/artifact:keep"
+	require.NoError(t, pvd.Push(ctx, nydus, ref))
+	require.Equal(t, artifactType, pushedArtifactType(ref))
+
+	// It's replaced by the nydus artifact type with the nydus policy.
+	require.NoError(t, pvd.SetArtifactTypePolicy(ArtifactTypePolicyNydus))
+	ref = registry.host + "/artifact:nydus"
+	require.NoError(t, pvd.Push(ctx, nydus, ref))
+	require.Equal(t, ArtifactTypeNydus, pushedArtifactType(ref))
+
+	// The nydus manifest of source image without artifact type doesn't
+	// declare it.
+	image, err := writeJSON(ctx, pvd.store, ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    *config,
+		Layers:    []ocispec.Descriptor{*layer},
+	}, ocispec.MediaTypeImageManifest)
+	require.NoError(t, err)
+	nydus = writeNydus(image.Digest.String())
+	ref = registry.host + "/artifact:image"
+	require.NoError(t, pvd.Push(ctx, nydus, ref))
+	require.Empty(t, pushedArtifactType(ref))
+	pushed, err := pvd.Image(ctx, ref)
+	require.NoError(t, err)
+	require.Equal(t, nydus.Digest, pushed.Digest)
+}
@@ -0,0 +1,120 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"sync"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/log"
+	humanize "github.com/dustin/go-humanize"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+)
+
+// pushAtomic pushes the image in three phases to avoid publishing a target
+// image referring to missing content:
+//
+//  1. push all blobs, bootstrap and manifests by digest, the tag isn't touched;
+//  2. confirm that all the pushed content exists in remote;
+//  3. push the root manifest by ref to publish the tag.
+//
+// Registries usually disable the deletion API, so the content pushed by digest
+// isn't deleted on failure, it's unreferenced and will be garbage collected by
+// registry, and will be skipped by the next push.
+func (pvd *Provider) pushAtomic(ctx context.Context, rc *containerd.RemoteContext, desc ocispec.Descriptor, ref string) error {
+	named, err := docker.ParseDockerRef(ref)
+	if err != nil {
+		return errors.Wrapf(err, "parse reference %s", ref)
+	}
+	digestRef := named.Name() + "@" + desc.Digest.String()
+
+	existingBytes := pvd.ExistingBytes()
+	if pvd.blobRetries > 0 {
+		if err := pvd.pushBlobs(ctx, rc, desc, digestRef); err != nil {
+			return errors.Wrapf(err, "push blobs of %s, target image is not published", ref)
+		}
+	}
+	if err := push(ctx, pvd.store, rc, desc, digestRef); err != nil {
+		return errors.Wrapf(err, "push content of %s, target image is not published", ref)
+	}
+	if skipped := pvd.ExistingBytes() - existingBytes; skipped > 0 {
+		log.G(ctx).Infof("skipped pushing %s of content already existing in %s", humanize.IBytes(uint64(skipped)), named.Name())
+	}
+
+	resolver, err := pvd.Resolver(ref)
+	if err != nil {
+		return err
+	}
+	if err := pvd.confirmPushed(ctx, resolver, named.Name(), desc); err != nil {
+		log.G(ctx).Warnf("content of %s is left in remote as %s, but not published", ref, digestRef)
+		return errors.Wrapf(err, "confirm pushed content of %s, target image is not published", ref)
+	}
+
+	// The status tracker of previous resolver has recorded the root manifest
+	// as committed, so a new resolver is required to push the tag.
+	publishCtx := *rc
+	publishCtx.Resolver = pvd.countingResolver(resolver)
+	if err := push(ctx, pvd.store, &publishCtx, desc, ref); err != nil {
+		return errors.Wrapf(err, "publish target image %s", ref)
+	}
+
+	return nil
+}
+
+// confirmPushed checks that all the content of image exists in the remote
+// repository of name.
+func (pvd *Provider) confirmPushed(ctx context.Context, resolver remotes.Resolver, name string, desc ocispec.Descriptor) error {
+	var mutex sync.Mutex
+	var descs []ocispec.Descriptor
+	handler := images.FilterPlatforms(images.ChildrenHandler(pvd.store), pvd.platformMC)
+	if err := images.Walk(ctx, images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		// The foreign layers are referred by their URLs.
+		if images.IsNonDistributable(desc.MediaType) {
+			return nil, nil
+		}
+		mutex.Lock()
+		descs = append(descs, desc)
+		mutex.Unlock()
+		return handler.Handle(ctx, desc)
+	}), desc); err != nil {
+		return errors.Wrap(err, "walk image content")
+	}
+
+	eg, ctx := errgroup.WithContext(ctx)
+	eg.SetLimit(LayerConcurrentLimit)
+	for _, desc := range descs {
+		desc := desc
+		eg.Go(func() error {
+			err := confirmContent(ctx, resolver, name, desc)
+			// The content recorded as pushed in checkpoint is pushed again
+			// on restart.
+			if err != nil && pvd.checkpoint != nil {
+				pvd.checkpoint.unpush(ctx, name, desc.Digest)
+			}
+			return err
+		})
+	}
+
+	return eg.Wait()
+}
+
+// confirmContent checks that desc exists in the remote repository of name
+// with the expected size.
+func confirmContent(ctx context.Context, resolver remotes.Resolver, name string, desc ocispec.Descriptor) error {
+	_, remoteDesc, err := resolver.Resolve(ctx, name+"@"+desc.Digest.String())
+	if err != nil {
+		return errors.Wrapf(err, "resolve %s %s", desc.MediaType, desc.Digest)
+	}
+	if remoteDesc.Size != desc.Size {
+		return errors.Errorf("size of %s %s mismatches: expected %d, got %d", desc.MediaType, desc.Digest, desc.Size, remoteDesc.Size)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+// writeNydusImage writes a nydus manifest with a blob layer and a bootstrap
+// layer into content store.
+func writeNydusImage(t *testing.T, ctx context.Context, pvd *Provider) (ocispec.Descriptor, ocispec.Descriptor, ocispec.Descriptor) {
+	config, err := writeJSON(ctx, pvd.store, ocispec.Image{Platform: ocispec.Platform{OS: "linux", Architecture: "amd64"}}, ocispec.MediaTypeImageConfig)
+	require.NoError(t, err)
+	blob, err := writeJSON(ctx, pvd.store, map[string]string{"blob": "data"}, utils.MediaTypeNydusBlob)
+	require.NoError(t, err)
+	bootstrap, err := writeJSON(ctx, pvd.store, map[string]string{"bootstrap": "data"}, ocispec.MediaTypeImageLayerGzip)
+	require.NoError(t, err)
+	// The capability annotations are set like pushed, so that the manifest
+	// isn't rewritten on pushing.
+	bootstrap.Annotations = map[string]string{
+		utils.LayerAnnotationNydusBootstrap: "true",
+		utils.LayerAnnotationNydusBlobIDs:   `["` + blob.Digest.Hex() + `"]`,
+	}
+
+	manifest, err := writeJSON(ctx, pvd.store, ocispec.Manifest{
+		Versioned:   specs.Versioned{SchemaVersion: 2},
+		MediaType:   ocispec.MediaTypeImageManifest,
+		Config:      *config,
+		Layers:      []ocispec.Descriptor{*blob, *bootstrap},
+		Annotations: map[string]string{utils.ManifestNydusSnapshotter: snapshotterNydus},
+	}, ocispec.MediaTypeImageManifest)
+	require.NoError(t, err)
+	return *manifest, *blob, *bootstrap
+}
+
+func TestPushAtomic(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+	manifest, blob, bootstrap := writeNydusImage(t, ctx, pvd)
+
+	for _, tc := range []struct {
+		name   string
+		onBlob func(dgst digest.Digest) (int, bool)
+	}{
+		{
+			// Upload of the blob fails in the middle of push.
+			name: "fail",
+			onBlob: func(dgst digest.Digest) (int, bool) {
+				if dgst == blob.Digest {
+					return http.StatusInternalServerError, false
+				}
+				return 0, false
+			},
+		},
+		{
+			// Registry acknowledges the upload of bootstrap but loses it.
+			name: "drop",
+			onBlob: func(dgst digest.Digest) (int, bool) {
+				return 0, dgst == bootstrap.Digest
+			},
+		},
+	} {
+		// The blobs are shared by repositories in test registry.
+		registry := newPushableRegistry(t)
+		registry.Override(onBlobPush(tc.onBlob))
+
+		ref := registry.host + "/" + tc.name + ":latest"
+		require.Error(t, pvd.Push(ctx, manifest, ref), tc.name)
+		_, _, ok := registry.Tag(tc.name, "latest")
+		require.False(t, ok, tc.name)
+		_, err := pvd.Image(ctx, ref)
+		require.Error(t, err, tc.name)
+	}
+
+	registry := newPushableRegistry(t)
+	ref := registry.host + "/ok:latest"
+	require.NoError(t, pvd.Push(ctx, manifest, ref))
+	dgst, _, ok := registry.Tag("ok", "latest")
+	require.True(t, ok)
+	require.Equal(t, manifest.Digest, dgst)
+	for _, desc := range []ocispec.Descriptor{blob, bootstrap} {
+		_, ok := registry.Blob(desc.Digest)
+		require.True(t, ok)
+	}
+}
+
+func TestPushResume(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+	manifest, blob, bootstrap := writeNydusImage(t, ctx, pvd)
+
+	// The first push is interrupted after the blob has been uploaded.
+	registry := newPushableRegistry(t)
+	registry.Override(onBlobPush(func(dgst digest.Digest) (int, bool) {
+		return 0, dgst == bootstrap.Digest
+	}))
+	ref := registry.host + "/resume:latest"
+	require.Error(t, pvd.Push(ctx, manifest, ref))
+
+	var uploaded []digest.Digest
+	registry.Override(recordBlobs(&uploaded))
+	existingBytes := pvd.ExistingBytes()
+	require.NoError(t, pvd.Push(ctx, manifest, ref))
+	require.Equal(t, []digest.Digest{bootstrap.Digest}, uploaded)
+	require.GreaterOrEqual(t, pvd.ExistingBytes()-existingBytes, blob.Size)
+	dgst, _, ok := registry.Tag("resume", "latest")
+	require.True(t, ok)
+	require.Equal(t, manifest.Digest, dgst)
+}
+
+func TestPushedBytesByDestination(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+	manifest, blob, bootstrap := writeNydusImage(t, ctx, pvd)
+	var nydusManifest ocispec.Manifest
+	require.NoError(t, readJSON(ctx, pvd.store, manifest, &nydusManifest))
+
+	registry := newPushableRegistry(t)
+	require.NoError(t, pvd.Push(ctx, manifest, registry.host+"/first:latest"))
+	// The content is shared by repositories in test registry, only the
+	// manifest is pushed again by tag to the second repository.
+	require.NoError(t, pvd.Push(ctx, manifest, registry.host+"/second:latest"))
+
+	// The manifest is pushed by digest and then by tag.
+	total := nydusManifest.Config.Size + blob.Size + bootstrap.Size + manifest.Size*2
+	require.Equal(t, map[string]int64{
+		registry.host + "/first":  total,
+		registry.host + "/second": manifest.Size,
+	}, pvd.PushedBytesByDestination())
+	require.Equal(t, total+manifest.Size, pvd.PushedBytes())
+}
+
+func TestPushTargets(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+	manifest, blob, bootstrap := writeNydusImage(t, ctx, pvd)
+
+	first, second := newPushableRegistry(t), newPushableRegistry(t)
+	ref := first.host + "/first:latest"
+	require.Error(t, pvd.PushTargets(ctx, ref, []string{second.host + "/second:latest"}))
+	require.NoError(t, pvd.Push(ctx, manifest, ref))
+	require.NoError(t, pvd.PushTargets(ctx, ref, []string{second.host + "/second:latest"}))
+
+	firstDigest, _, ok := first.Tag("first", "latest")
+	require.True(t, ok)
+	secondDigest, _, ok := second.Tag("second", "latest")
+	require.True(t, ok)
+	require.Equal(t, manifest.Digest, firstDigest)
+	require.Equal(t, firstDigest, secondDigest)
+	for _, desc := range []ocispec.Descriptor{blob, bootstrap} {
+		_, ok := second.Blob(desc.Digest)
+		require.True(t, ok)
+	}
+}
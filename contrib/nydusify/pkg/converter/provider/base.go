@@ -0,0 +1,267 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"sync"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/log"
+	"github.com/containerd/nydus-snapshotter/pkg/converter"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/identity"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+// annotationSourceReference records the source image reference in nydus
+// manifest, it's annotated by the nydus driver of acceleration service.
+const annotationSourceReference = "containerd.io/snapshot/nydus-source-reference"
+
+// baseNydus is the nydus blobs of pinned base image by the chain IDs of
+// their source layers.
+type baseNydus struct {
+	mutex   sync.Mutex
+	blobs   map[digest.Digest]baseBlob
+	fetcher remotes.Fetcher
+	// reused maps the source layer of image to the base blob reused.
+	reused map[digest.Digest]digest.Digest
+	// reference references the base blobs in registry without fetching,
+	// see SetReferenceBaseBlobs.
+	reference  bool
+	referenced map[digest.Digest]*referencedBlob
+}
+
+type baseBlob struct {
+	desc ocispec.Descriptor
+	ref  string
+}
+
+// LoadBaseNydus loads the nydus blobs of base nydus image ref converted by
+// nydusify, the source layers sharing the chain IDs with the source of base
+// image are not built in later Pull, the base blobs are reused instead.
+// The source of base image is found by the source reference and digest
+// annotated in nydus manifests.
+func (pvd *Provider) LoadBaseNydus(ctx context.Context, ref string) error {
+	resolver, err := pvd.Resolver(ref)
+	if err != nil {
+		return err
+	}
+	name, _, err := resolver.Resolve(ctx, ref)
+	if err != nil {
+		return errors.Wrapf(err, "resolve base nydus image %s", ref)
+	}
+	fetcher, err := resolver.Fetcher(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	var manifests []ocispec.Manifest
+	if _, err := pvd.walkManifests(ctx, ref, pvd.platformMC, func(manifest ocispec.Manifest, _ ocispec.Descriptor) string {
+		manifests = append(manifests, manifest)
+		return ""
+	}); err != nil {
+		return errors.Wrapf(err, "get base nydus image %s", ref)
+	}
+
+	base := &baseNydus{
+		blobs:      map[digest.Digest]baseBlob{},
+		fetcher:    fetcher,
+		reused:     map[digest.Digest]digest.Digest{},
+		reference:  pvd.referenceBaseBlobs,
+		referenced: map[digest.Digest]*referencedBlob{},
+	}
+	for _, manifest := range manifests {
+		chainIDs, err := pvd.baseSourceChainIDs(ctx, manifest)
+		if err != nil {
+			return errors.Wrapf(err, "get source of base nydus image %s", ref)
+		}
+		var blobs []ocispec.Descriptor
+		for _, layer := range manifest.Layers {
+			if layer.Annotations[utils.LayerAnnotationNydusBootstrap] != "true" {
+				blobs = append(blobs, layer)
+			}
+		}
+		if chainIDs == nil {
+			log.G(ctx).Warnf("skip the manifest of base nydus image %s, its source isn't annotated", ref)
+			continue
+		}
+		// The blob is built from each source layer in order.
+		if len(chainIDs) != len(blobs) {
+			log.G(ctx).Warnf("skip the manifest of base nydus image %s, its blobs don't match the source layers", ref)
+			continue
+		}
+		for idx, chainID := range chainIDs {
+			base.blobs[chainID] = baseBlob{desc: blobs[idx], ref: ref}
+		}
+	}
+	log.G(ctx).Infof("loaded %d blobs of base nydus image %s", len(base.blobs), ref)
+
+	pvd.base = base
+	pvd.wrapStore(func(store content.Store) content.Store {
+		return &baseStore{Store: store, base: base}
+	})
+	return nil
+}
+
+// baseSourceChainIDs returns the chain IDs of the source layers of nydus
+// manifest, or nil if the source isn't annotated.
+func (pvd *Provider) baseSourceChainIDs(ctx context.Context, manifest ocispec.Manifest) ([]digest.Digest, error) {
+	source, sourceDigest := manifest.Annotations[annotationSourceReference], manifest.Annotations[utils.ManifestNydusSourceDigest]
+	if source == "" || sourceDigest == "" {
+		return nil, nil
+	}
+	named, err := docker.ParseDockerRef(source)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse source reference %s", source)
+	}
+	ref := named.Name() + "@" + sourceDigest
+	resolver, err := pvd.Resolver(ref)
+	if err != nil {
+		return nil, err
+	}
+	name, desc, err := resolver.Resolve(ctx, ref)
+	if err != nil {
+		return nil, errors.Wrapf(err, "resolve %s", ref)
+	}
+	fetcher, err := resolver.Fetcher(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if err := fetchToStore(ctx, pvd.store, fetcher, desc); err != nil {
+		return nil, err
+	}
+	var sourceManifest ocispec.Manifest
+	if err := readJSON(ctx, pvd.store, desc, &sourceManifest); err != nil {
+		return nil, errors.Wrapf(err, "read manifest %s", ref)
+	}
+	if err := fetchToStore(ctx, pvd.store, fetcher, sourceManifest.Config); err != nil {
+		return nil, err
+	}
+	var config ocispec.Image
+	if err := readJSON(ctx, pvd.store, sourceManifest.Config, &config); err != nil {
+		return nil, errors.Wrapf(err, "read config of %s", ref)
+	}
+	return identity.ChainIDs(config.RootFS.DiffIDs), nil
+}
+
+// reuseBaseBlobs fetches the base blobs matched by the chain IDs of source
+// layers of image desc, the source layers are labeled with the base blobs
+// in content store, so that their building is skipped by
+// converter.LayerConvertFunc.
+func (pvd *Provider) reuseBaseBlobs(ctx context.Context, desc ocispec.Descriptor) error {
+	handler := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		switch desc.MediaType {
+		case ocispec.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList:
+			return images.Children(ctx, pvd.store, desc)
+		case ocispec.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest:
+		default:
+			return nil, nil
+		}
+		var manifest ocispec.Manifest
+		if err := readJSON(ctx, pvd.store, desc, &manifest); err != nil {
+			return nil, errors.Wrapf(err, "read manifest %s", desc.Digest)
+		}
+		var config ocispec.Image
+		if err := readJSON(ctx, pvd.store, manifest.Config, &config); err != nil {
+			return nil, errors.Wrapf(err, "read config %s", manifest.Config.Digest)
+		}
+		chainIDs := identity.ChainIDs(config.RootFS.DiffIDs)
+		for idx, layer := range manifest.Layers {
+			if idx >= len(chainIDs) {
+				break
+			}
+			blob, ok := pvd.base.blobs[chainIDs[idx]]
+			if !ok {
+				continue
+			}
+			if pvd.base.reference {
+				log.G(ctx).Infof("reference blob %s of base nydus image %s in registry for layer %s", blob.desc.Digest, blob.ref, layer.Digest)
+				pvd.base.mutex.Lock()
+				if _, ok := pvd.base.referenced[blob.desc.Digest]; !ok {
+					pvd.base.referenced[blob.desc.Digest] = &referencedBlob{blob: blob, labels: map[string]string{}}
+				}
+				pvd.base.reused[layer.Digest] = blob.desc.Digest
+				pvd.base.mutex.Unlock()
+				continue
+			}
+			if err := fetchToStore(ctx, pvd.store, pvd.base.fetcher, blob.desc); err != nil {
+				return nil, errors.Wrapf(err, "fetch blob of base nydus image %s", blob.ref)
+			}
+			log.G(ctx).Infof("reuse blob %s of base nydus image %s for layer %s", blob.desc.Digest, blob.ref, layer.Digest)
+			pvd.base.mutex.Lock()
+			pvd.base.reused[layer.Digest] = blob.desc.Digest
+			pvd.base.mutex.Unlock()
+		}
+		return nil, nil
+	})
+	return images.Walk(ctx, images.FilterPlatforms(handler, pvd.platformMC), desc)
+}
+
+// baseStore labels the source layer matched by base nydus image with the
+// target digest like checkpointStore does, and serves the base blobs
+// referenced in registry which aren't in the content store.
+type baseStore struct {
+	content.Store
+	base *baseNydus
+}
+
+func (store *baseStore) Info(ctx context.Context, dgst digest.Digest) (content.Info, error) {
+	info, err := store.Store.Info(ctx, dgst)
+	if err != nil {
+		if blob, ok := store.base.referencedBlob(dgst); ok && errdefs.IsNotFound(err) {
+			store.base.mutex.Lock()
+			defer store.base.mutex.Unlock()
+			return blob.info(), nil
+		}
+		return info, err
+	}
+	store.base.mutex.Lock()
+	blob, ok := store.base.reused[dgst]
+	store.base.mutex.Unlock()
+	if !ok {
+		return info, nil
+	}
+	labels := make(map[string]string, len(info.Labels)+1)
+	for key, value := range info.Labels {
+		labels[key] = value
+	}
+	labels[converter.LayerAnnotationNydusTargetDigest] = blob.String()
+	info.Labels = labels
+	return info, nil
+}
+
+func (store *baseStore) Update(ctx context.Context, info content.Info, fieldpaths ...string) (content.Info, error) {
+	blob, ok := store.base.referencedBlob(info.Digest)
+	if !ok {
+		return store.Store.Update(ctx, info, fieldpaths...)
+	}
+	if _, err := store.Store.Info(ctx, info.Digest); !errdefs.IsNotFound(err) {
+		return store.Store.Update(ctx, info, fieldpaths...)
+	}
+	store.base.mutex.Lock()
+	defer store.base.mutex.Unlock()
+	for key, value := range info.Labels {
+		blob.labels[key] = value
+	}
+	return blob.info(), nil
+}
+
+func (store *baseStore) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	ra, err := store.Store.ReaderAt(ctx, desc)
+	if err != nil {
+		if blob, ok := store.base.referencedBlob(desc.Digest); ok && errdefs.IsNotFound(err) {
+			return store.base.readerAt(ctx, blob)
+		}
+	}
+	return ra, err
+}
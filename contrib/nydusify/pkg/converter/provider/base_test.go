@@ -0,0 +1,96 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/nydus-snapshotter/pkg/converter"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+func TestLoadBaseNydus(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	registry := newPushableRegistry(t)
+	addImage := func(name string, config interface{}, layers []ocispec.Descriptor, annotations map[string]string) ocispec.Descriptor {
+		configData, err := json.Marshal(config)
+		require.NoError(t, err)
+		manifestData, err := json.Marshal(ocispec.Manifest{
+			Versioned:   specs.Versioned{SchemaVersion: 2},
+			MediaType:   ocispec.MediaTypeImageManifest,
+			Config:      registry.AddBlob(ocispec.MediaTypeImageConfig, configData),
+			Layers:      layers,
+			Annotations: annotations,
+		})
+		require.NoError(t, err)
+		manifest := registry.AddBlob(ocispec.MediaTypeImageManifest, manifestData)
+		registry.SetTag("library/"+name, "latest", manifest.Digest)
+		return manifest
+	}
+	sourceConfig := func(diffIDs ...digest.Digest) ocispec.Image {
+		return ocispec.Image{
+			Platform: ocispec.Platform{OS: "linux", Architecture: "amd64"},
+			RootFS:   ocispec.RootFS{Type: "layers", DiffIDs: diffIDs},
+		}
+	}
+
+	baseLayer := registry.AddBlob(ocispec.MediaTypeImageLayerGzip, []byte("base layer"))
+	baseSource := addImage("base", sourceConfig(digest.FromString("base diff")), []ocispec.Descriptor{baseLayer}, nil)
+	baseBlob := registry.AddBlob(utils.MediaTypeNydusBlob, []byte("base blob"))
+	bootstrap := registry.AddBlob(ocispec.MediaTypeImageLayerGzip, []byte("base bootstrap"))
+	bootstrap.Annotations = map[string]string{utils.LayerAnnotationNydusBootstrap: "true"}
+	addImage("base-nydus", ocispec.Image{Platform: ocispec.Platform{OS: "linux", Architecture: "amd64"}}, []ocispec.Descriptor{baseBlob, bootstrap}, map[string]string{
+		utils.ManifestNydusSourceDigest: baseSource.Digest.String(),
+		annotationSourceReference:       registry.host + "/library/base:latest",
+	})
+
+	// The child image is built on the base layer, only the base layer is
+	// matched by chain ID.
+	childLayer := registry.AddBlob(ocispec.MediaTypeImageLayerGzip, []byte("child layer"))
+	addImage("child", sourceConfig(digest.FromString("base diff"), digest.FromString("child diff")), []ocispec.Descriptor{baseLayer, childLayer}, nil)
+
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+	require.NoError(t, pvd.LoadBaseNydus(ctx, registry.host+"/library/base-nydus:latest"))
+	require.NoError(t, pvd.Pull(ctx, registry.host+"/library/child:latest"))
+
+	info, err := pvd.ContentStore().Info(ctx, baseLayer.Digest)
+	require.NoError(t, err)
+	require.Equal(t, baseBlob.Digest.String(), info.Labels[converter.LayerAnnotationNydusTargetDigest])
+	info, err = pvd.ContentStore().Info(ctx, childLayer.Digest)
+	require.NoError(t, err)
+	require.Empty(t, info.Labels[converter.LayerAnnotationNydusTargetDigest])
+	data, err := content.ReadBlob(ctx, pvd.ContentStore(), baseBlob)
+	require.NoError(t, err)
+	require.Equal(t, []byte("base blob"), data)
+
+	// The nydus image of child refers the base blob, which isn't pushed
+	// again.
+	childBlob, err := writeJSON(ctx, pvd.store, map[string]string{"blob": "child"}, utils.MediaTypeNydusBlob)
+	require.NoError(t, err)
+	config, err := writeJSON(ctx, pvd.store, ocispec.Image{Platform: ocispec.Platform{OS: "linux", Architecture: "amd64"}}, ocispec.MediaTypeImageConfig)
+	require.NoError(t, err)
+	manifest, err := writeJSON(ctx, pvd.store, ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    *config,
+		Layers:    []ocispec.Descriptor{baseBlob, *childBlob},
+	}, ocispec.MediaTypeImageManifest)
+	require.NoError(t, err)
+	var uploaded []digest.Digest
+	registry.Override(recordBlobs(&uploaded))
+	require.NoError(t, pvd.Push(ctx, *manifest, registry.host+"/library/child:nydus"))
+	require.Contains(t, uploaded, childBlob.Digest)
+	require.NotContains(t, uploaded, baseBlob.Digest)
+}
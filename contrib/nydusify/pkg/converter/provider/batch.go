@@ -0,0 +1,283 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/log"
+	humanize "github.com/dustin/go-humanize"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// errUnbatchable means the layers can't be merged into a single layer with
+// the same files, they are built one by one as usual.
+var errUnbatchable = errors.New("layers can't be batched")
+
+// SetSmallImageThreshold batches the layers of the source image smaller than
+// threshold in total into a single layer on pulling, so that the small image
+// is built by a single builder invocation instead of one per layer, zero
+// means disabled. The layers aren't batched if the build cache or the base
+// nydus image is used, which match the source layers one by one.
+func (pvd *Provider) SetSmallImageThreshold(threshold int64) {
+	pvd.smallImageThreshold = threshold
+}
+
+// batchEntry is a file of the merged layer, in the order of being added.
+type batchEntry struct {
+	hdr   *tar.Header
+	data  []byte
+	layer int
+	// link is the entry linked by the hard link entry.
+	link *batchEntry
+}
+
+// layerBatch merges the layers applied in order like the overlay filesystem
+// of container, the whiteouts are applied rather than kept.
+type layerBatch struct {
+	entries []*batchEntry
+	paths   map[string]*batchEntry
+}
+
+// remove removes the entry of name if self is set and its children, which
+// are added by the layers below layer.
+func (batch *layerBatch) remove(name string, layer int, self bool) {
+	prefix := name + "/"
+	if name == "/" {
+		prefix = "/"
+	}
+	for key, entry := range batch.paths {
+		if entry.layer >= layer {
+			continue
+		}
+		if (self && key == name) || strings.HasPrefix(key, prefix) {
+			delete(batch.paths, key)
+		}
+	}
+}
+
+func (batch *layerBatch) apply(reader io.Reader, layer int) error {
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Clean("/" + hdr.Name)
+		dir, base := path.Split(name)
+		dir = path.Clean(dir)
+
+		switch {
+		case base == whiteoutOpaque:
+			batch.remove(dir, layer, false)
+			continue
+		case strings.HasPrefix(base, whiteoutPrefix):
+			batch.remove(path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)), layer, true)
+			continue
+		}
+
+		entry := &batchEntry{hdr: hdr, layer: layer}
+		if hdr.Typeflag == tar.TypeLink {
+			if entry.link = batch.paths[path.Clean("/"+hdr.Linkname)]; entry.link == nil {
+				return errors.Wrapf(errUnbatchable, "hard link %s to %s in lower layer", hdr.Name, hdr.Linkname)
+			}
+		}
+		if existing := batch.paths[name]; existing != nil {
+			if existing.hdr.Typeflag == tar.TypeDir && hdr.Typeflag == tar.TypeDir {
+				existing.hdr = hdr
+				continue
+			}
+			batch.remove(name, layer+1, true)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if entry.data, err = io.ReadAll(tr); err != nil {
+				return err
+			}
+		}
+		batch.paths[name] = entry
+		batch.entries = append(batch.entries, entry)
+	}
+}
+
+// write writes the merged files in tar, it fails with errUnbatchable if the
+// file linked by a hard link is removed or replaced by upper layers.
+func (batch *layerBatch) write(writer io.Writer) error {
+	tw := tar.NewWriter(writer)
+	written := map[*batchEntry]bool{}
+	for _, entry := range batch.entries {
+		if batch.paths[path.Clean("/"+entry.hdr.Name)] != entry {
+			continue
+		}
+		if entry.link != nil && !written[entry.link] {
+			return errors.Wrapf(errUnbatchable, "hard link %s to replaced %s", entry.hdr.Name, entry.hdr.Linkname)
+		}
+		if err := tw.WriteHeader(entry.hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(entry.data); err != nil {
+			return err
+		}
+		written[entry] = true
+	}
+	return tw.Close()
+}
+
+// batchLayers merges the layers into a gzip layer written into store, the
+// layers are small enough to be merged in memory. It returns the new layer
+// and its diff ID.
+func batchLayers(ctx context.Context, store content.Store, layers []ocispec.Descriptor) (*ocispec.Descriptor, digest.Digest, error) {
+	batch := &layerBatch{paths: map[string]*batchEntry{}}
+	for idx, layer := range layers {
+		if err := func() error {
+			ra, err := store.ReaderAt(ctx, layer)
+			if err != nil {
+				return err
+			}
+			defer ra.Close()
+			reader, err := utils.DecompressLayer(content.NewReader(ra), layer.MediaType)
+			if err != nil {
+				return err
+			}
+			defer reader.Close()
+			return batch.apply(reader, idx)
+		}(); err != nil {
+			return nil, "", errors.Wrapf(err, "apply layer %s", layer.Digest)
+		}
+	}
+
+	var blob bytes.Buffer
+	diffDigester := digest.Canonical.Digester()
+	gw := gzip.NewWriter(&blob)
+	if err := batch.write(io.MultiWriter(gw, diffDigester.Hash())); err != nil {
+		return nil, "", err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, "", err
+	}
+
+	mediaType := ocispec.MediaTypeImageLayerGzip
+	if strings.HasPrefix(layers[0].MediaType, "application/vnd.docker.") {
+		mediaType = images.MediaTypeDockerSchema2LayerGzip
+	}
+	desc := ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(blob.Bytes()),
+		Size:      int64(blob.Len()),
+	}
+	if err := content.WriteBlob(ctx, store, desc.Digest.String(), bytes.NewReader(blob.Bytes()), desc); err != nil {
+		return nil, "", errors.Wrap(err, "write layer")
+	}
+
+	return &desc, diffDigester.Digest(), nil
+}
+
+// batchManifestLayers replaces the layers of manifest smaller than threshold
+// in total by the layer merged from them, and the diff IDs and history of
+// config accordingly.
+func batchManifestLayers(ctx context.Context, store content.Store, desc ocispec.Descriptor, manifest *ocispec.Manifest, threshold int64) (bool, error) {
+	if len(manifest.Layers) < 2 {
+		return false, nil
+	}
+	var size int64
+	for _, layer := range manifest.Layers {
+		size += layer.Size
+	}
+	if size > threshold {
+		return false, nil
+	}
+
+	layer, diffID, err := batchLayers(ctx, store, manifest.Layers)
+	if err != nil {
+		if errors.Is(err, errUnbatchable) {
+			log.G(ctx).Infof("build layers of manifest %s one by one: %s", desc.Digest, err)
+			return false, nil
+		}
+		return false, errors.Wrap(err, "batch layers")
+	}
+
+	// Keep the unknown fields of image config and history.
+	var config map[string]json.RawMessage
+	if err := readJSON(ctx, store, manifest.Config, &config); err != nil {
+		return false, errors.Wrap(err, "read image config")
+	}
+	var rootfs ocispec.RootFS
+	if err := json.Unmarshal(config["rootfs"], &rootfs); err != nil {
+		return false, errors.Wrap(err, "unmarshal rootfs of image config")
+	}
+	rootfs.DiffIDs = []digest.Digest{diffID}
+	data, err := json.Marshal(rootfs)
+	if err != nil {
+		return false, err
+	}
+	config["rootfs"] = data
+
+	// Only the last history of non-empty layer refers to the merged layer.
+	if config["history"] != nil {
+		var history []map[string]json.RawMessage
+		if err := json.Unmarshal(config["history"], &history); err != nil {
+			return false, errors.Wrap(err, "unmarshal history of image config")
+		}
+		last := true
+		for idx := len(history) - 1; idx >= 0; idx-- {
+			var empty bool
+			if history[idx]["empty_layer"] != nil {
+				if err := json.Unmarshal(history[idx]["empty_layer"], &empty); err != nil {
+					return false, errors.Wrap(err, "unmarshal history of image config")
+				}
+			}
+			if empty {
+				continue
+			}
+			if !last {
+				history[idx]["empty_layer"] = json.RawMessage("true")
+			}
+			last = false
+		}
+		if config["history"], err = json.Marshal(history); err != nil {
+			return false, err
+		}
+	}
+
+	configDesc, err := writeJSON(ctx, store, config, manifest.Config.MediaType)
+	if err != nil {
+		return false, errors.Wrap(err, "write image config")
+	}
+	configDesc.Annotations = manifest.Config.Annotations
+	manifest.Config = *configDesc
+	batched := len(manifest.Layers)
+	manifest.Layers = []ocispec.Descriptor{*layer}
+	log.G(ctx).Infof("batched %d layers of %s into layer %s", batched, humanize.IBytes(uint64(size)), layer.Digest)
+
+	return true, nil
+}
+
+// batchImageLayers batches the layers of the small source image pulled into
+// store, see SetSmallImageThreshold and rewriteSourceManifests.
+func (pvd *Provider) batchImageLayers(ctx context.Context, desc ocispec.Descriptor) (*ocispec.Descriptor, error) {
+	return pvd.rewriteSourceManifests(ctx, desc, func(manifestDesc *ocispec.Descriptor, manifest *ocispec.Manifest) (bool, error) {
+		return batchManifestLayers(ctx, pvd.store, *manifestDesc, manifest, pvd.smallImageThreshold)
+	})
+}
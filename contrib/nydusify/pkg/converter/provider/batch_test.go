@@ -0,0 +1,165 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"os/exec"
+	"testing"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	accelconverter "github.com/goharbor/acceleration-service/pkg/converter"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// pushLayersImage pushes the image of layers to registry, the history
+// has an empty layer.
+func pushLayersImage(t testing.TB, ctx context.Context, pvd *Provider, ref string, layers []ocispec.Descriptor) ocispec.Descriptor {
+	image := ocispec.Image{
+		Platform: ocispec.Platform{OS: "linux", Architecture: "amd64"},
+		RootFS:   ocispec.RootFS{Type: "layers"},
+		History:  []ocispec.History{{CreatedBy: "ENV PATH=/usr/bin", EmptyLayer: true}},
+	}
+	for idx, layer := range layers {
+		image.RootFS.DiffIDs = append(image.RootFS.DiffIDs, digest.FromString(layer.Digest.String()))
+		image.History = append(image.History, ocispec.History{CreatedBy: fmt.Sprintf("RUN layer %d", idx)})
+	}
+	config, err := writeJSON(ctx, pvd.store, image, ocispec.MediaTypeImageConfig)
+	require.NoError(t, err)
+	manifest, err := writeJSON(ctx, pvd.store, ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    *config,
+		Layers:    layers,
+	}, ocispec.MediaTypeImageManifest)
+	require.NoError(t, err)
+	require.NoError(t, pvd.Push(ctx, *manifest, ref))
+	return *manifest
+}
+
+func TestPullBatchLayers(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	registry := newPushableRegistry(t)
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+	lower := writeHeaderLayer(t, ctx, pvd.store, []*tar.Header{
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644, Size: 1},
+		{Name: "etc/hosts", Typeflag: tar.TypeReg, Mode: 0644, Size: 1},
+		{Name: "var/lib/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "var/lib/old", Typeflag: tar.TypeReg, Mode: 0644, Size: 1},
+		{Name: "usr/bin/app", Typeflag: tar.TypeReg, Mode: 0755, Size: 1},
+		{Name: "usr/bin/app-link", Typeflag: tar.TypeLink, Linkname: "usr/bin/app"},
+	})
+	upper := writeHeaderLayer(t, ctx, pvd.store, []*tar.Header{
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0700},
+		{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0600, Size: 2},
+		{Name: "etc/.wh.hosts", Typeflag: tar.TypeReg},
+		{Name: "var/lib/.wh..wh..opq", Typeflag: tar.TypeReg},
+		{Name: "var/lib/new", Typeflag: tar.TypeReg, Mode: 0644, Size: 1},
+	})
+	source := pushLayersImage(t, ctx, pvd, registry.host+"/source:latest", []ocispec.Descriptor{lower, upper})
+
+	// The image larger than threshold isn't batched.
+	pvd = newPlatformProvider(t, platforms.All, "", "")
+	pvd.SetSmallImageThreshold(lower.Size)
+	require.NoError(t, pvd.Pull(ctx, registry.host+"/source:latest"))
+	desc, err := pvd.Image(ctx, registry.host+"/source:latest")
+	require.NoError(t, err)
+	require.Equal(t, source.Digest, desc.Digest)
+
+	pvd = newPlatformProvider(t, platforms.All, "", "")
+	pvd.SetSmallImageThreshold(1 << 20)
+	require.NoError(t, pvd.Pull(ctx, registry.host+"/source:latest"))
+	desc, err = pvd.Image(ctx, registry.host+"/source:latest")
+	require.NoError(t, err)
+	require.NotEqual(t, source.Digest, desc.Digest)
+	require.Equal(t, source.Digest, pvd.originalSources()[desc.Digest])
+
+	var pulled ocispec.Manifest
+	require.NoError(t, readJSON(ctx, pvd.store, *desc, &pulled))
+	require.Len(t, pulled.Layers, 1)
+	names, diffID := readTarLayer(t, ctx, pvd.store, pulled.Layers[0])
+	require.ElementsMatch(t, []string{"etc/", "etc/passwd", "var/lib/", "usr/bin/app", "usr/bin/app-link", "var/lib/new"}, names)
+
+	var config ocispec.Image
+	require.NoError(t, readJSON(ctx, pvd.store, pulled.Config, &config))
+	require.Equal(t, []digest.Digest{diffID}, config.RootFS.DiffIDs)
+	var empty []bool
+	for _, history := range config.History {
+		empty = append(empty, history.EmptyLayer)
+	}
+	require.Equal(t, []bool{true, true, false}, empty)
+	require.Equal(t, "RUN layer 1", config.History[2].CreatedBy)
+}
+
+func TestPullBatchLayersHardLink(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	registry := newPushableRegistry(t)
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+	lower := writeHeaderLayer(t, ctx, pvd.store, []*tar.Header{
+		{Name: "usr/bin/app", Typeflag: tar.TypeReg, Mode: 0755, Size: 1},
+		{Name: "usr/bin/app-link", Typeflag: tar.TypeLink, Linkname: "usr/bin/app"},
+	})
+	// The hard link in lower layer still refers to the replaced file in
+	// container, which can't be represented by a single layer.
+	upper := writeHeaderLayer(t, ctx, pvd.store, []*tar.Header{
+		{Name: "usr/bin/app", Typeflag: tar.TypeReg, Mode: 0755, Size: 2},
+	})
+	source := pushLayersImage(t, ctx, pvd, registry.host+"/source:latest", []ocispec.Descriptor{lower, upper})
+
+	pvd = newPlatformProvider(t, platforms.All, "", "")
+	pvd.SetSmallImageThreshold(1 << 20)
+	require.NoError(t, pvd.Pull(ctx, registry.host+"/source:latest"))
+	desc, err := pvd.Image(ctx, registry.host+"/source:latest")
+	require.NoError(t, err)
+	require.Equal(t, source.Digest, desc.Digest)
+}
+
+// BenchmarkConvertSmallImage converts a small image of many layers by the
+// nydus driver with and without batching the layers.
+func BenchmarkConvertSmallImage(b *testing.B) {
+	builderPath, err := exec.LookPath("nydus-image")
+	if err != nil {
+		b.Skip("nydus-image binary isn't found")
+	}
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	registry := newPushableRegistry(b)
+	source := registry.host + "/source:latest"
+	pvd := newPlatformProvider(b, platforms.All, "", "")
+	var layers []ocispec.Descriptor
+	for idx := 0; idx < 8; idx++ {
+		layers = append(layers, writeHeaderLayer(b, ctx, pvd.store, []*tar.Header{
+			{Name: fmt.Sprintf("layer-%d/", idx), Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: fmt.Sprintf("layer-%d/file", idx), Typeflag: tar.TypeReg, Mode: 0644, Size: 64 << 10},
+		}))
+	}
+	pushLayersImage(b, ctx, pvd, source, layers)
+
+	for _, threshold := range []int64{0, 16 << 20} {
+		b.Run(fmt.Sprintf("threshold-%d", threshold), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				pvd := newPlatformProvider(b, platforms.All, "", "")
+				pvd.SetSmallImageThreshold(threshold)
+				cvt, err := accelconverter.New(
+					accelconverter.WithProvider(pvd),
+					accelconverter.WithDriver("nydus", map[string]string{
+						"work_dir": b.TempDir(),
+						"builder":  builderPath,
+					}),
+					accelconverter.WithPlatform(platforms.All),
+				)
+				require.NoError(b, err)
+				_, err = cvt.Convert(ctx, source, fmt.Sprintf("%s/target:%d", registry.host, i), "")
+				require.NoError(b, err)
+			}
+		})
+	}
+}
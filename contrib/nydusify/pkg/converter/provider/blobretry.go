@@ -0,0 +1,89 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"sync"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/log"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+)
+
+// SetBlobRetries retries the blobs failed to push up to retries times after
+// the other blobs of image are pushed, instead of failing the whole push on
+// the first failed blob, 0 disables the retries.
+func (pvd *Provider) SetBlobRetries(retries int) {
+	pvd.blobRetries = retries
+}
+
+// pushBlobs pushes the blobs and configs of image desc to ref before the
+// manifests, the failed ones are retried by pvd.blobRetries after all the
+// others are done. The pushed content is skipped by the following push of
+// image with the same resolver.
+func (pvd *Provider) pushBlobs(ctx context.Context, rc *containerd.RemoteContext, desc ocispec.Descriptor, ref string) error {
+	var mutex sync.Mutex
+	var blobs []ocispec.Descriptor
+	handler := images.FilterPlatforms(images.ChildrenHandler(pvd.store), pvd.platformMC)
+	if err := images.Walk(ctx, images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		if !images.IsManifestType(desc.MediaType) && !images.IsIndexType(desc.MediaType) {
+			if !images.IsNonDistributable(desc.MediaType) {
+				mutex.Lock()
+				blobs = append(blobs, desc)
+				mutex.Unlock()
+			}
+			return nil, nil
+		}
+		return handler.Handle(ctx, desc)
+	}), desc); err != nil {
+		return errors.Wrap(err, "walk image content")
+	}
+
+	pusher, err := rc.Resolver.Pusher(ctx, ref)
+	if err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		var failed []ocispec.Descriptor
+		var lastErr error
+		eg, egCtx := errgroup.WithContext(ctx)
+		if rc.MaxConcurrentUploadedLayers > 0 {
+			eg.SetLimit(rc.MaxConcurrentUploadedLayers)
+		}
+		for _, blob := range blobs {
+			blob := blob
+			eg.Go(func() error {
+				if err := remotes.PushContent(egCtx, pusher, blob, pvd.store, nil, nil, nil); err != nil {
+					if egCtx.Err() != nil {
+						return egCtx.Err()
+					}
+					mutex.Lock()
+					failed = append(failed, blob)
+					lastErr = err
+					mutex.Unlock()
+				}
+				return nil
+			})
+		}
+		if err := eg.Wait(); err != nil {
+			return err
+		}
+		if len(failed) == 0 {
+			return nil
+		}
+		if attempt >= pvd.blobRetries {
+			return errors.Wrapf(lastErr, "push %d blobs after %d retries", len(failed), attempt)
+		}
+		for _, blob := range failed {
+			log.G(ctx).Warnf("failed to push blob %s, retry %d of %d", blob.Digest, attempt+1, pvd.blobRetries)
+		}
+		blobs = failed
+	}
+}
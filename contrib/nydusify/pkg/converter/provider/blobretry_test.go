@@ -0,0 +1,63 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPushBlobRetries(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+	manifest, blob, bootstrap := writeNydusImage(t, ctx, pvd)
+
+	for _, tc := range []struct {
+		name    string
+		retries int
+		ok      bool
+	}{
+		{name: "retried", retries: 2, ok: true},
+		{name: "exhausted", retries: 1, ok: false},
+	} {
+		// The blob fails twice, the bootstrap is uploaded before the retries.
+		registry := newPushableRegistry(t)
+		var uploaded []digest.Digest
+		failures := 0
+		registry.Override(onBlobPush(func(dgst digest.Digest) (int, bool) {
+			if dgst == blob.Digest && failures < 2 {
+				failures++
+				return http.StatusInternalServerError, false
+			}
+			uploaded = append(uploaded, dgst)
+			return 0, false
+		}))
+		pvd.SetBlobRetries(tc.retries)
+
+		ref := registry.host + "/" + tc.name + ":latest"
+		err := pvd.Push(ctx, manifest, ref)
+		_, _, published := registry.Tag(tc.name, "latest")
+		require.Equal(t, tc.ok, published, tc.name)
+		if !tc.ok {
+			require.Error(t, err, tc.name)
+			require.Contains(t, err.Error(), "push 1 blobs after 1 retries", tc.name)
+			require.Equal(t, 2, failures, tc.name)
+			continue
+		}
+		require.NoError(t, err, tc.name)
+		require.Equal(t, 2, failures, tc.name)
+		require.Contains(t, uploaded, bootstrap.Digest, tc.name)
+		require.Equal(t, blob.Digest, uploaded[len(uploaded)-1], tc.name)
+		_, ok := registry.Blob(blob.Digest)
+		require.True(t, ok, tc.name)
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/checker/tool"
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+// BlobInspector inspects the blob table of bootstrap file, it's implemented
+// by tool.Inspector with the `nydus-image` binary.
+type BlobInspector interface {
+	Inspect(option tool.InspectOption) (interface{}, error)
+}
+
+// Blob is a blob in the blob table of nydus bootstrap.
+type Blob struct {
+	tool.BlobInfo
+	// Layer is the blob layer in nydus manifest, it's nil for the blob
+	// stored in the storage backend other than registry.
+	Layer *ocispec.Descriptor `json:"layer,omitempty"`
+}
+
+// ListBlobs lists the blobs referenced by the bootstrap of nydus image ref
+// matched by platform. Only the manifests and the bootstrap layer are
+// fetched, rather than the whole image.
+func (pvd *Provider) ListBlobs(ctx context.Context, ref string, inspector BlobInspector) ([]Blob, error) {
+	resolver, err := pvd.Resolver(ref)
+	if err != nil {
+		return nil, err
+	}
+	name, desc, err := resolver.Resolve(ctx, ref)
+	if err != nil {
+		return nil, errors.Wrapf(err, "resolve reference %s", ref)
+	}
+	fetcher, err := resolver.Fetcher(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	handler := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		switch desc.MediaType {
+		case ocispec.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest:
+			return nil, fetchToStore(ctx, pvd.store, fetcher, desc)
+		case ocispec.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList:
+			if err := fetchToStore(ctx, pvd.store, fetcher, desc); err != nil {
+				return nil, err
+			}
+			return images.Children(ctx, pvd.store, desc)
+		}
+		return nil, nil
+	})
+	if err := images.Walk(ctx, images.FilterPlatforms(handler, pvd.platformMC), desc); err != nil {
+		return nil, errors.Wrapf(err, "fetch manifest of %s", ref)
+	}
+	manifest, err := images.Manifest(ctx, pvd.store, desc, pvd.platformMC)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read manifest of %s", ref)
+	}
+	if len(manifest.Layers) == 0 || manifest.Layers[len(manifest.Layers)-1].Annotations[utils.LayerAnnotationNydusBootstrap] != "true" {
+		return nil, fmt.Errorf("not found nydus bootstrap layer in manifest of %s", ref)
+	}
+	bootstrapDesc := manifest.Layers[len(manifest.Layers)-1]
+	if err := fetchToStore(ctx, pvd.store, fetcher, bootstrapDesc); err != nil {
+		return nil, errors.Wrap(err, "fetch bootstrap layer")
+	}
+
+	infos, err := inspectBlobs(ctx, pvd.store, bootstrapDesc, inspector)
+	if err != nil {
+		return nil, err
+	}
+
+	layers := map[string]ocispec.Descriptor{}
+	for _, layer := range manifest.Layers[:len(manifest.Layers)-1] {
+		layers[layer.Digest.Encoded()] = layer
+	}
+	blobs := make([]Blob, 0, len(infos))
+	for _, info := range infos {
+		blob := Blob{BlobInfo: info}
+		if layer, ok := layers[info.BlobID]; ok {
+			blob.Layer = &layer
+		}
+		blobs = append(blobs, blob)
+	}
+
+	return blobs, nil
+}
+
+// inspectBlobs unpacks the bootstrap file from the bootstrap layer in store,
+// and inspects the blob table of it by inspector.
+func inspectBlobs(ctx context.Context, store content.Store, bootstrapDesc ocispec.Descriptor, inspector BlobInspector) (tool.BlobInfoList, error) {
+	dir, err := os.MkdirTemp("", "nydusify-blobs-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	bootstrapPath := filepath.Join(dir, "image.boot")
+	ra, err := store.ReaderAt(ctx, bootstrapDesc)
+	if err != nil {
+		return nil, errors.Wrap(err, "read bootstrap layer")
+	}
+	defer ra.Close()
+	if err := utils.UnpackFile(content.NewReader(ra), utils.BootstrapFileNameInLayer, bootstrapPath); err != nil {
+		return nil, errors.Wrap(err, "unpack bootstrap layer")
+	}
+
+	item, err := inspector.Inspect(tool.InspectOption{
+		Operation: tool.GetBlobs,
+		Bootstrap: bootstrapPath,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "inspect blobs of bootstrap")
+	}
+	infos, ok := item.(tool.BlobInfoList)
+	if !ok {
+		return nil, fmt.Errorf("unexpected blob list type %T", item)
+	}
+
+	return infos, nil
+}
+
+// BackendObject is a nydus blob written to the storage backend.
+type BackendObject struct {
+	ID   string `json:"id"`
+	Size int64  `json:"size"`
+	// Key is the destination of blob in backend, e.g. the object key.
+	Key string `json:"key"`
+}
+
+// walkBackendBlobs calls fn with the IDs of the blobs referenced by the
+// bootstraps of nydus manifests in desc but not in the manifest layers, i.e.
+// the blobs stored in the storage backend other than registry.
+func (pvd *Provider) walkBackendBlobs(ctx context.Context, desc ocispec.Descriptor, inspector BlobInspector, fn func(blobID string) error) error {
+	handler := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		switch desc.MediaType {
+		case ocispec.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList:
+			return images.Children(ctx, pvd.store, desc)
+		case ocispec.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest:
+		default:
+			return nil, nil
+		}
+		var manifest ocispec.Manifest
+		if err := readJSON(ctx, pvd.store, desc, &manifest); err != nil {
+			return nil, errors.Wrap(err, "read manifest")
+		}
+		if len(manifest.Layers) == 0 || manifest.Layers[len(manifest.Layers)-1].Annotations[utils.LayerAnnotationNydusBootstrap] != "true" {
+			return nil, nil
+		}
+		infos, err := inspectBlobs(ctx, pvd.store, manifest.Layers[len(manifest.Layers)-1], inspector)
+		if err != nil {
+			return nil, errors.Wrapf(err, "list blobs of manifest %s", desc.Digest)
+		}
+		layers := map[string]bool{}
+		for _, layer := range manifest.Layers {
+			layers[layer.Digest.Encoded()] = true
+		}
+		for _, info := range infos {
+			if layers[info.BlobID] {
+				continue
+			}
+			dgst := digest.NewDigestFromEncoded(digest.SHA256, info.BlobID)
+			if dgst.Validate() != nil {
+				continue
+			}
+			if err := fn(info.BlobID); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	})
+	return images.Walk(ctx, handler, desc)
+}
+
+// BackendBlobs lists the IDs of the blobs of the nydus image desc in content
+// store which are stored in the storage backend rather than as the image
+// layers, including the blobs of chunk dict or reused by build cache. The
+// IDs are sorted.
+func (pvd *Provider) BackendBlobs(ctx context.Context, desc ocispec.Descriptor, inspector BlobInspector) ([]string, error) {
+	var mutex sync.Mutex
+	blobs := map[string]bool{}
+	if err := pvd.walkBackendBlobs(ctx, desc, inspector, func(blobID string) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		blobs[blobID] = true
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	list := make([]string, 0, len(blobs))
+	for blobID := range blobs {
+		list = append(list, blobID)
+	}
+	sort.Strings(list)
+	return list, nil
+}
+
+// BackendObjects lists the blobs of the nydus image desc in content store
+// which are written to the storage backend rather than as the image layers,
+// i.e. the blobs referenced by bootstrap but not in manifest. Only the blobs
+// built into content store are listed, the blobs of chunk dict or reused by
+// build cache aren't written by the conversion. The key of each blob is
+// returned by key, the blobs are sorted by ID.
+func (pvd *Provider) BackendObjects(ctx context.Context, desc ocispec.Descriptor, inspector BlobInspector, key func(blobID string) string) ([]BackendObject, error) {
+	var mutex sync.Mutex
+	objects := map[string]BackendObject{}
+	if err := pvd.walkBackendBlobs(ctx, desc, inspector, func(blobID string) error {
+		blobInfo, err := pvd.store.Info(ctx, digest.NewDigestFromEncoded(digest.SHA256, blobID))
+		if err != nil {
+			if errdefs.IsNotFound(err) {
+				return nil
+			}
+			return errors.Wrapf(err, "stat blob %s", blobID)
+		}
+		mutex.Lock()
+		objects[blobID] = BackendObject{ID: blobID, Size: blobInfo.Size, Key: key(blobID)}
+		mutex.Unlock()
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	list := make([]BackendObject, 0, len(objects))
+	for _, object := range objects {
+		list = append(list, object)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+	return list, nil
+}
@@ -0,0 +1,147 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/checker/tool"
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+type blobInspector func(option tool.InspectOption) (interface{}, error)
+
+func (inspector blobInspector) Inspect(option tool.InspectOption) (interface{}, error) {
+	return inspector(option)
+}
+
+func TestListBlobs(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+
+	blob, err := writeJSON(ctx, pvd.store, map[string]string{"blob": "data"}, utils.MediaTypeNydusBlob)
+	require.NoError(t, err)
+	bootstrap := writeTarLayer(t, ctx, pvd.store, map[string]string{utils.BootstrapFileNameInLayer: "bootstrap"})
+	bootstrap.Annotations = map[string]string{utils.LayerAnnotationNydusBootstrap: "true"}
+	config, err := writeJSON(ctx, pvd.store, ocispec.Image{}, ocispec.MediaTypeImageConfig)
+	require.NoError(t, err)
+	manifest, err := writeJSON(ctx, pvd.store, ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    *config,
+		Layers:    []ocispec.Descriptor{*blob, bootstrap},
+	}, ocispec.MediaTypeImageManifest)
+	require.NoError(t, err)
+
+	registry := newPushableRegistry(t)
+	ref := registry.host + "/nydus:latest"
+	require.NoError(t, pvd.Push(ctx, *manifest, ref))
+
+	// The blob table contains a blob in the pushed layers, and a blob in
+	// another storage backend.
+	infos := tool.BlobInfoList{
+		{BlobID: blob.Digest.Encoded(), CompressedSize: uint64(blob.Size), DecompressedSize: 1024},
+		{BlobID: "backend-blob", CompressedSize: 10, DecompressedSize: 20},
+	}
+	inspector := blobInspector(func(option tool.InspectOption) (interface{}, error) {
+		require.Equal(t, tool.GetBlobs, option.Operation)
+		data, err := os.ReadFile(option.Bootstrap)
+		require.NoError(t, err)
+		require.Equal(t, "bootstrap", string(data))
+		return infos, nil
+	})
+
+	pvd = newPlatformProvider(t, platforms.All, "", "")
+	blobs, err := pvd.ListBlobs(ctx, ref, inspector)
+	require.NoError(t, err)
+	require.Len(t, blobs, 2)
+	require.Equal(t, infos[0], blobs[0].BlobInfo)
+	require.NotNil(t, blobs[0].Layer)
+	require.Equal(t, blob.Digest, blobs[0].Layer.Digest)
+	require.Equal(t, infos[1], blobs[1].BlobInfo)
+	require.Nil(t, blobs[1].Layer)
+
+	// The nydus blob isn't fetched for listing.
+	_, err = pvd.store.Info(ctx, blob.Digest)
+	require.Error(t, err)
+}
+
+func TestBackendObjects(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+
+	// The blobs written to backend are built into content store, but not in
+	// the manifest layers.
+	layer, err := writeJSON(ctx, pvd.store, map[string]string{"blob": "layer"}, utils.MediaTypeNydusBlob)
+	require.NoError(t, err)
+	var objects []*ocispec.Descriptor
+	for _, data := range []string{"object1", "object2"} {
+		object, err := writeJSON(ctx, pvd.store, map[string]string{"blob": data}, utils.MediaTypeNydusBlob)
+		require.NoError(t, err)
+		objects = append(objects, object)
+	}
+	bootstrap := writeTarLayer(t, ctx, pvd.store, map[string]string{utils.BootstrapFileNameInLayer: "bootstrap"})
+	bootstrap.Annotations = map[string]string{utils.LayerAnnotationNydusBootstrap: "true"}
+	config, err := writeJSON(ctx, pvd.store, ocispec.Image{}, ocispec.MediaTypeImageConfig)
+	require.NoError(t, err)
+	manifest, err := writeJSON(ctx, pvd.store, ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    *config,
+		Layers:    []ocispec.Descriptor{*layer, bootstrap},
+	}, ocispec.MediaTypeImageManifest)
+	require.NoError(t, err)
+	// The manifests of platforms share the blobs.
+	index, err := writeJSON(ctx, pvd.store, ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{*manifest, *manifest},
+	}, ocispec.MediaTypeImageIndex)
+	require.NoError(t, err)
+
+	// The blob table contains a blob of chunk dict not built by conversion.
+	chunkDict, err := writeJSON(ctx, newPlatformProvider(t, platforms.All, "", "").store, map[string]string{"blob": "dict"}, utils.MediaTypeNydusBlob)
+	require.NoError(t, err)
+	inspector := blobInspector(func(option tool.InspectOption) (interface{}, error) {
+		return tool.BlobInfoList{
+			{BlobID: objects[1].Digest.Encoded()},
+			{BlobID: chunkDict.Digest.Encoded()},
+			{BlobID: layer.Digest.Encoded()},
+			{BlobID: objects[0].Digest.Encoded()},
+		}, nil
+	})
+
+	list, err := pvd.BackendObjects(ctx, *index, inspector, func(blobID string) string {
+		return "blobs/" + blobID
+	})
+	require.NoError(t, err)
+	expected := []BackendObject{}
+	for _, object := range objects {
+		expected = append(expected, BackendObject{
+			ID:   object.Digest.Encoded(),
+			Size: object.Size,
+			Key:  "blobs/" + object.Digest.Encoded(),
+		})
+	}
+	if expected[0].ID > expected[1].ID {
+		expected[0], expected[1] = expected[1], expected[0]
+	}
+	require.Equal(t, expected, list)
+
+	// The blobs stored in backend include the blob of chunk dict.
+	blobIDs, err := pvd.BackendBlobs(ctx, *index, inspector)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{expected[0].ID, expected[1].ID, chunkDict.Digest.Encoded()}, blobIDs)
+	require.True(t, sort.StringsAreSorted(blobIDs))
+}
@@ -0,0 +1,133 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+
+	"github.com/containerd/containerd/archive/compression"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/log"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+// SetBootstrapCompressor recompresses the bootstrap layers of target image,
+// which are gzip compressed by builder, with the compressor: none, gzip or
+// zstd, empty compressor keeps the bootstrap layers as built.
+func (pvd *Provider) SetBootstrapCompressor(compressor string) error {
+	if compressor == "" {
+		pvd.bootstrapCompressor = nil
+		return nil
+	}
+	comp, err := utils.ParseCompression(compressor)
+	if err != nil {
+		return errors.Wrap(err, "parse bootstrap compressor")
+	}
+	pvd.bootstrapCompressor = &comp
+	return nil
+}
+
+// bootstrapMediaType returns the layer media type of compression in the
+// style of manifest media type, the zstd layers are in the OCI media type
+// for both, see dockerMediaTypes.
+func bootstrapMediaType(comp compression.Compression, docker bool) string {
+	switch comp {
+	case compression.Gzip:
+		if docker {
+			return images.MediaTypeDockerSchema2LayerGzip
+		}
+		return ocispec.MediaTypeImageLayerGzip
+	case compression.Zstd:
+		return ocispec.MediaTypeImageLayerZstd
+	}
+	if docker {
+		return images.MediaTypeDockerSchema2Layer
+	}
+	return ocispec.MediaTypeImageLayer
+}
+
+// compressBootstrap writes the bootstrap layer compressed by comp into store,
+// the annotations of layer are kept, as the uncompressed content is the same.
+func compressBootstrap(ctx context.Context, store content.Store, layer ocispec.Descriptor, comp compression.Compression, docker bool) (*ocispec.Descriptor, error) {
+	ra, err := store.ReaderAt(ctx, layer)
+	if err != nil {
+		return nil, errors.Wrap(err, "open bootstrap layer")
+	}
+	defer ra.Close()
+	reader, err := utils.DecompressLayer(content.NewReader(ra), layer.MediaType)
+	if err != nil {
+		return nil, errors.Wrap(err, "decompress bootstrap layer")
+	}
+	defer reader.Close()
+
+	var buf bytes.Buffer
+	writer, err := compression.CompressStream(&buf, comp)
+	if err != nil {
+		return nil, errors.Wrap(err, "create compressor")
+	}
+	if _, err := io.Copy(writer, reader); err != nil {
+		return nil, errors.Wrap(err, "compress bootstrap layer")
+	}
+	if err := writer.Close(); err != nil {
+		return nil, errors.Wrap(err, "close compressor")
+	}
+
+	desc := ocispec.Descriptor{
+		MediaType:   bootstrapMediaType(comp, docker),
+		Digest:      digest.FromBytes(buf.Bytes()),
+		Size:        int64(buf.Len()),
+		Annotations: layer.Annotations,
+	}
+	if err := content.WriteBlob(ctx, store, desc.Digest.String(), bytes.NewReader(buf.Bytes()), desc); err != nil {
+		return nil, errors.Wrap(err, "write bootstrap layer")
+	}
+	log.G(ctx).Debugf("compressed bootstrap layer %s to %s, size %d", layer.Digest, desc.Digest, desc.Size)
+
+	return &desc, nil
+}
+
+// setManifestBootstrapCompressor recompresses the bootstrap layer of
+// manifest unless it's already compressed by comp, the bootstrap layer of
+// unknown media type, e.g. encrypted, is kept.
+func setManifestBootstrapCompressor(ctx context.Context, store content.Store, desc ocispec.Descriptor, manifest *ocispec.Manifest, comp compression.Compression) (bool, error) {
+	changed := false
+	docker := strings.HasPrefix(desc.MediaType, "application/vnd.docker.")
+	for idx, layer := range manifest.Layers {
+		if layer.Annotations[utils.LayerAnnotationNydusBootstrap] != "true" {
+			continue
+		}
+		current, ok := utils.LayerCompression(layer.MediaType)
+		if !ok {
+			log.G(ctx).Warnf("skip compressing bootstrap layer %s of media type %s", layer.Digest, layer.MediaType)
+			continue
+		}
+		if current == comp {
+			continue
+		}
+		layerDesc, err := compressBootstrap(ctx, store, layer, comp, docker)
+		if err != nil {
+			return false, err
+		}
+		manifest.Layers[idx] = *layerDesc
+		changed = true
+	}
+	return changed, nil
+}
+
+// setBootstrapCompressor recompresses the bootstrap layers of all the
+// manifests in target image.
+func setBootstrapCompressor(ctx context.Context, store content.Store, desc ocispec.Descriptor, comp compression.Compression) (*ocispec.Descriptor, error) {
+	return rewriteManifests(ctx, store, desc, nil, func(manifestDesc *ocispec.Descriptor, manifest *ocispec.Manifest) (bool, error) {
+		return setManifestBootstrapCompressor(ctx, store, *manifestDesc, manifest, comp)
+	})
+}
@@ -0,0 +1,105 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+func TestPushBootstrapCompressor(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+
+	// The bootstrap layer is a gzip tar containing `image/image.boot` as
+	// written by builder.
+	bootstrapData := []byte("nydus bootstrap")
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: utils.BootstrapFileNameInLayer, Mode: 0644, Size: int64(len(bootstrapData)), Typeflag: tar.TypeReg}))
+	_, err := tw.Write(bootstrapData)
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+
+	for _, tc := range []struct {
+		compressor string
+		format     string
+		mediaType  string
+	}{
+		{"none", "", ocispec.MediaTypeImageLayer},
+		{"zstd", "", ocispec.MediaTypeImageLayerZstd},
+		{"gzip", "", ocispec.MediaTypeImageLayerGzip},
+		{"gzip", ManifestFormatDocker, images.MediaTypeDockerSchema2LayerGzip},
+		// Docker defines no zstd layer media type.
+		{"zstd", ManifestFormatDocker, ocispec.MediaTypeImageLayerZstd},
+	} {
+		pvd := newPlatformProvider(t, platforms.All, "", "")
+		require.Error(t, pvd.SetBootstrapCompressor("lz4"))
+		require.NoError(t, pvd.SetBootstrapCompressor(tc.compressor))
+		require.NoError(t, pvd.SetManifestFormat(tc.format))
+
+		config, err := writeJSON(ctx, pvd.store, ocispec.Image{Platform: ocispec.Platform{OS: "linux", Architecture: "amd64"}}, ocispec.MediaTypeImageConfig)
+		require.NoError(t, err)
+		blob, err := writeJSON(ctx, pvd.store, map[string]string{"blob": "data"}, utils.MediaTypeNydusBlob)
+		require.NoError(t, err)
+		bootstrap := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: digest.FromBytes(buf.Bytes()), Size: int64(buf.Len())}
+		require.NoError(t, content.WriteBlob(ctx, pvd.store, bootstrap.Digest.String(), bytes.NewReader(buf.Bytes()), bootstrap))
+		bootstrap.Annotations = map[string]string{utils.LayerAnnotationNydusBootstrap: "true"}
+		manifest, err := writeJSON(ctx, pvd.store, ocispec.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: ocispec.MediaTypeImageManifest,
+			Config:    *config,
+			Layers:    []ocispec.Descriptor{*blob, bootstrap},
+		}, ocispec.MediaTypeImageManifest)
+		require.NoError(t, err)
+
+		registry := newPushableRegistry(t)
+		require.NoError(t, pvd.Push(ctx, *manifest, registry.host+"/bootstrap:latest"))
+		_, data, ok := registry.Tag("bootstrap", "latest")
+		require.True(t, ok)
+		var pushed ocispec.Manifest
+		require.NoError(t, json.Unmarshal(data, &pushed))
+
+		require.Len(t, pushed.Layers, 2)
+		layer := pushed.Layers[1]
+		require.Equal(t, tc.mediaType, layer.MediaType, tc.compressor)
+		require.Equal(t, "true", layer.Annotations[utils.LayerAnnotationNydusBootstrap])
+		if tc.compressor == "gzip" {
+			// The bootstrap layer already in gzip is kept as is.
+			require.Equal(t, bootstrap.Digest, layer.Digest)
+		}
+
+		// The pushed bootstrap layer decompresses to the same bootstrap.
+		layerData, ok := registry.Blob(layer.Digest)
+		require.True(t, ok)
+		require.Equal(t, layer.Size, int64(len(layerData)))
+		target := filepath.Join(t.TempDir(), "image.boot")
+		reader, err := utils.DecompressLayer(bytes.NewReader(layerData), layer.MediaType)
+		require.NoError(t, err)
+		require.NoError(t, utils.UnpackFile(reader, utils.BootstrapFileNameInLayer, target))
+		require.NoError(t, reader.Close())
+		unpacked, err := os.ReadFile(target)
+		require.NoError(t, err)
+		require.Equal(t, bootstrapData, unpacked)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/containerd/containerd/content"
+)
+
+// SetMaxConcurrentBuilds limits the source layers built concurrently to
+// limit, zero means all the layers of an image are built concurrently. Each
+// layer is built by a builder process, which is held until its nydus blob
+// is written into the content store. It limits the builder processes rather
+// than the threads of a builder compressing the chunks, which the builder
+// doesn't expose, so the CPU used is bounded only by the number of layers
+// built at once.
+func (pvd *Provider) SetMaxConcurrentBuilds(limit int) {
+	if limit <= 0 {
+		return
+	}
+	pvd.wrapStore(func(store content.Store) content.Store {
+		return &buildLimitStore{Store: store, slots: make(chan struct{}, limit)}
+	})
+}
+
+// buildLimitStore takes a slot for each nydus blob being built, which is
+// written with the ref of buildRefPrefix, until the blob writer is closed.
+type buildLimitStore struct {
+	content.Store
+	slots chan struct{}
+}
+
+func (store *buildLimitStore) Writer(ctx context.Context, opts ...content.WriterOpt) (content.Writer, error) {
+	var wopts content.WriterOpts
+	for _, opt := range opts {
+		if err := opt(&wopts); err != nil {
+			return nil, err
+		}
+	}
+	if !strings.HasPrefix(wopts.Ref, buildRefPrefix) {
+		return store.Store.Writer(ctx, opts...)
+	}
+
+	select {
+	case store.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	writer, err := store.Store.Writer(ctx, opts...)
+	if err != nil {
+		<-store.slots
+		return nil, err
+	}
+	return &buildLimitWriter{Writer: writer, slots: store.slots}, nil
+}
+
+// buildLimitWriter releases the slot once it's closed, the builder has
+// exited by then since the blob is written by converter.LayerConvertFunc
+// until the builder output ends.
+type buildLimitWriter struct {
+	content.Writer
+	slots chan struct{}
+	once  sync.Once
+}
+
+func (writer *buildLimitWriter) Close() error {
+	defer writer.once.Do(func() {
+		<-writer.slots
+	})
+	return writer.Writer.Close()
+}
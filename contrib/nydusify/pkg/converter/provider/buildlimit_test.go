@@ -0,0 +1,157 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	accelconverter "github.com/goharbor/acceleration-service/pkg/converter"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+func TestMaxConcurrentBuilds(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+	pvd.SetMaxConcurrentBuilds(2)
+	openBuildWriter := func(ctx context.Context, layer string) (content.Writer, error) {
+		return content.OpenWriter(ctx, pvd.ContentStore(), content.WithRef(buildRefPrefix+digest.FromString(layer).String()))
+	}
+
+	first, err := openBuildWriter(ctx, "first")
+	require.NoError(t, err)
+	second, err := openBuildWriter(ctx, "second")
+	require.NoError(t, err)
+
+	// The third build waits for a slot, while the other writings, e.g.
+	// pulling a layer, aren't limited.
+	opened := make(chan content.Writer, 1)
+	go func() {
+		writer, err := openBuildWriter(ctx, "third")
+		if err == nil {
+			opened <- writer
+		}
+	}()
+	pulling, err := content.OpenWriter(ctx, pvd.ContentStore(), content.WithRef("layer-pulling"))
+	require.NoError(t, err)
+	require.NoError(t, pulling.Close())
+	select {
+	case <-opened:
+		t.Fatal("third build isn't limited")
+	case <-time.After(100 * time.Millisecond):
+	}
+	require.NoError(t, first.Close())
+	select {
+	case third := <-opened:
+		// Closing a writer twice releases the slot only once.
+		require.NoError(t, third.Close())
+		_ = third.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("third build isn't started after a slot is released")
+	}
+
+	// The build waiting for a slot is aborted by the canceled context.
+	fourth, err := openBuildWriter(ctx, "fourth")
+	require.NoError(t, err)
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = openBuildWriter(canceled, "canceled")
+	require.ErrorIs(t, err, context.Canceled)
+	require.NoError(t, fourth.Close())
+	require.NoError(t, second.Close())
+}
+
+// convertLayersImage converts the image of layers pushed to registry by the
+// nydus driver with builderPath, and returns the target manifest.
+func convertLayersImage(t testing.TB, ctx context.Context, pvd *Provider, builderPath, source, target string) ocispec.Manifest {
+	cvt, err := accelconverter.New(
+		accelconverter.WithProvider(pvd),
+		accelconverter.WithDriver("nydus", map[string]string{
+			"work_dir": t.TempDir(),
+			"builder":  builderPath,
+		}),
+		accelconverter.WithPlatform(platforms.All),
+	)
+	require.NoError(t, err)
+	_, err = cvt.Convert(ctx, source, target, "")
+	require.NoError(t, err)
+
+	desc, err := pvd.Image(ctx, target)
+	require.NoError(t, err)
+	var manifest ocispec.Manifest
+	require.NoError(t, readJSON(ctx, pvd.store, *desc, &manifest))
+	return manifest
+}
+
+// pushBuildImage pushes an image of layers with compressible files to
+// registry.
+func pushBuildImage(t testing.TB, ctx context.Context, pvd *Provider, ref string, layers int, fileSize int64) {
+	var descs []ocispec.Descriptor
+	for idx := 0; idx < layers; idx++ {
+		descs = append(descs, writeHeaderLayer(t, ctx, pvd.store, []*tar.Header{
+			{Name: fmt.Sprintf("layer-%d/", idx), Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: fmt.Sprintf("layer-%d/file", idx), Typeflag: tar.TypeReg, Mode: 0644, Size: fileSize},
+		}))
+	}
+	pushLayersImage(t, ctx, pvd, ref, descs)
+}
+
+func TestMaxConcurrentBuildsConvert(t *testing.T) {
+	builderPath, err := exec.LookPath("nydus-image")
+	if err != nil {
+		t.Skip("nydus-image binary isn't found")
+	}
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	registry := newPushableRegistry(t)
+	source := registry.host + "/source:latest"
+	pushBuildImage(t, ctx, newPlatformProvider(t, platforms.All, "", ""), source, 4, 1<<20)
+
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+	pvd.SetMaxConcurrentBuilds(2)
+	manifest := convertLayersImage(t, ctx, pvd, builderPath, source, registry.host+"/target:latest")
+	// The bootstrap is merged from all the blobs built concurrently.
+	require.Len(t, manifest.Layers, 5)
+	for _, layer := range manifest.Layers[:4] {
+		require.Equal(t, utils.MediaTypeNydusBlob, layer.MediaType)
+		info, err := pvd.ContentStore().Info(ctx, layer.Digest)
+		require.NoError(t, err)
+		require.Equal(t, layer.Size, info.Size)
+	}
+	require.Equal(t, "true", manifest.Layers[4].Annotations[utils.LayerAnnotationNydusBootstrap])
+}
+
+// BenchmarkMaxConcurrentBuilds converts an image of many layers by the nydus driver
+// with the different limits of concurrent builds.
+func BenchmarkMaxConcurrentBuilds(b *testing.B) {
+	builderPath, err := exec.LookPath("nydus-image")
+	if err != nil {
+		b.Skip("nydus-image binary isn't found")
+	}
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	registry := newPushableRegistry(b)
+	source := registry.host + "/source:latest"
+	pushBuildImage(b, ctx, newPlatformProvider(b, platforms.All, "", ""), source, 8, 16<<20)
+
+	for _, limit := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("builds-%d", limit), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				pvd := newPlatformProvider(b, platforms.All, "", "")
+				pvd.SetMaxConcurrentBuilds(limit)
+				convertLayersImage(b, ctx, pvd, builderPath, source, fmt.Sprintf("%s/target:%d", registry.host, i))
+			}
+		})
+	}
+}
@@ -0,0 +1,243 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/log"
+	accelcache "github.com/goharbor/acceleration-service/pkg/cache"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+const (
+	// CachePolicyOverwrite pushes the local cache records to overwrite the
+	// remote cache image.
+	CachePolicyOverwrite = "overwrite"
+	// CachePolicyMerge merges the local cache records with the latest remote
+	// cache image before pushing, and retries if the remote cache is changed
+	// by other conversions concurrently.
+	CachePolicyMerge = "merge"
+)
+
+var cacheMergeRetries = 5
+
+// SetCachePolicy sets the policy to push the cache image, see CachePolicy*.
+func (pvd *Provider) SetCachePolicy(policy string) {
+	pvd.cachePolicy = policy
+}
+
+// SetNoCache bypasses the remote cache entirely, all the layers are rebuilt
+// and the cache image is neither fetched nor pushed.
+func (pvd *Provider) SetNoCache(noCache bool) {
+	pvd.noCache = noCache
+}
+
+// SetCacheReadOnly makes the remote cache only be used to skip building the
+// cached layers, the cache records of conversion are not pushed back.
+func (pvd *Provider) SetCacheReadOnly(readOnly bool) {
+	pvd.cacheReadOnly = readOnly
+}
+
+func (pvd *Provider) isCacheIndex(desc ocispec.Descriptor, ref string) bool {
+	return pvd.cache != nil && pvd.cache.Ref == ref && pvd.cachePolicy == CachePolicyMerge &&
+		(desc.MediaType == ocispec.MediaTypeImageIndex || desc.MediaType == images.MediaTypeDockerSchema2ManifestList)
+}
+
+// pushCache pushes the cache index with optimistic concurrency, the local
+// cache index is merged with the remote one if it has been changed, then
+// the remote cache is verified after pushing, to avoid the cache records
+// of concurrent conversions being clobbered.
+func (pvd *Provider) pushCache(ctx context.Context, desc ocispec.Descriptor, ref string, pushFunc func(ocispec.Descriptor) error) error {
+	for retry := 0; retry <= cacheMergeRetries; retry++ {
+		remoteDesc, err := pvd.fetchRemoteCache(ctx, ref)
+		if err != nil {
+			return errors.Wrap(err, "fetch remote cache")
+		}
+		if remoteDesc != nil && remoteDesc.Digest != desc.Digest {
+			merged, err := mergeCacheIndex(ctx, pvd.store, *remoteDesc, desc, pvd.cacheSize)
+			if err != nil {
+				return errors.Wrap(err, "merge remote cache")
+			}
+			desc = *merged
+		}
+
+		if err := pushFunc(desc); err != nil {
+			return err
+		}
+
+		pushedDesc, err := pvd.fetchRemoteCache(ctx, ref)
+		if err != nil {
+			return errors.Wrap(err, "verify remote cache")
+		}
+		if pushedDesc != nil && pushedDesc.Digest == desc.Digest {
+			return nil
+		}
+		log.G(ctx).Infof("remote cache %s is changed by other conversion, retry to merge", ref)
+	}
+
+	log.G(ctx).Warnf("remote cache %s is still conflicted after %d retries, cache records may be lost", ref, cacheMergeRetries)
+	return nil
+}
+
+// fetchRemoteCache fetches the cache index and manifests from remote into
+// content store, returns nil if the cache image doesn't exist.
+func (pvd *Provider) fetchRemoteCache(ctx context.Context, ref string) (*ocispec.Descriptor, error) {
+	resolver, err := pvd.Resolver(ref)
+	if err != nil {
+		return nil, err
+	}
+	name, desc, err := resolver.Resolve(ctx, ref)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	fetcher, err := resolver.Fetcher(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := fetchToStore(ctx, pvd.store, fetcher, desc); err != nil {
+		return nil, err
+	}
+	var index ocispec.Index
+	if err := readJSON(ctx, pvd.store, desc, &index); err != nil {
+		return nil, err
+	}
+	for _, manifest := range index.Manifests {
+		if err := fetchToStore(ctx, pvd.store, fetcher, manifest); err != nil {
+			return nil, err
+		}
+	}
+
+	return &desc, nil
+}
+
+func fetchToStore(ctx context.Context, store content.Store, fetcher remotes.Fetcher, desc ocispec.Descriptor) error {
+	if _, err := store.Info(ctx, desc.Digest); err == nil {
+		return nil
+	}
+	reader, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return errors.Wrapf(err, "fetch %s", desc.Digest)
+	}
+	defer reader.Close()
+	return content.WriteBlob(ctx, store, desc.Digest.String(), reader, desc)
+}
+
+func readJSON(ctx context.Context, store content.Store, desc ocispec.Descriptor, obj interface{}) error {
+	data, err := content.ReadBlob(ctx, store, desc)
+	if err != nil {
+		return errors.Wrapf(err, "read %s", desc.Digest)
+	}
+	return json.Unmarshal(data, obj)
+}
+
+func writeJSON(ctx context.Context, store content.Store, obj interface{}, mediaType string) (*ocispec.Descriptor, error) {
+	desc, data, err := utils.MarshalToDesc(obj, mediaType)
+	if err != nil {
+		return nil, err
+	}
+	if err := content.WriteBlob(ctx, store, desc.Digest.String(), bytes.NewReader(data), *desc); err != nil {
+		return nil, err
+	}
+	return desc, nil
+}
+
+func platformKey(platform *ocispec.Platform) string {
+	if platform == nil {
+		return ""
+	}
+	return platforms.Format(platforms.Normalize(*platform))
+}
+
+// mergeCacheIndex unions the cache records of remote and local cache index
+// by platform, the remote records take precedence in order so that the
+// merging of concurrent conversions converges.
+func mergeCacheIndex(ctx context.Context, store content.Store, remoteDesc, localDesc ocispec.Descriptor, size int) (*ocispec.Descriptor, error) {
+	var remoteIndex, localIndex ocispec.Index
+	if err := readJSON(ctx, store, remoteDesc, &remoteIndex); err != nil {
+		return nil, errors.Wrap(err, "read remote cache index")
+	}
+	if err := readJSON(ctx, store, localDesc, &localIndex); err != nil {
+		return nil, errors.Wrap(err, "read local cache index")
+	}
+
+	localManifests := map[string]ocispec.Descriptor{}
+	for _, desc := range localIndex.Manifests {
+		localManifests[platformKey(desc.Platform)] = desc
+	}
+
+	merged := remoteIndex
+	merged.Manifests = []ocispec.Descriptor{}
+	for _, remoteManifestDesc := range remoteIndex.Manifests {
+		key := platformKey(remoteManifestDesc.Platform)
+		localManifestDesc, ok := localManifests[key]
+		if !ok {
+			merged.Manifests = append(merged.Manifests, remoteManifestDesc)
+			continue
+		}
+		delete(localManifests, key)
+
+		var remoteManifest, localManifest ocispec.Manifest
+		if err := readJSON(ctx, store, remoteManifestDesc, &remoteManifest); err != nil {
+			return nil, errors.Wrap(err, "read remote cache manifest")
+		}
+		if err := readJSON(ctx, store, localManifestDesc, &localManifest); err != nil {
+			return nil, errors.Wrap(err, "read local cache manifest")
+		}
+		// Drop the remote records of a different cache version.
+		if remoteManifest.Annotations[accelcache.LayerAnnotationCacheVersion] != localManifest.Annotations[accelcache.LayerAnnotationCacheVersion] {
+			merged.Manifests = append(merged.Manifests, localManifestDesc)
+			continue
+		}
+
+		existed := map[digest.Digest]bool{}
+		for _, layer := range remoteManifest.Layers {
+			existed[layer.Digest] = true
+		}
+		layers := remoteManifest.Layers
+		for _, layer := range localManifest.Layers {
+			if !existed[layer.Digest] {
+				layers = append(layers, layer)
+			}
+		}
+		if size > 0 && len(layers) > size {
+			layers = layers[:size]
+		}
+		remoteManifest.Layers = layers
+
+		mergedManifestDesc, err := writeJSON(ctx, store, remoteManifest, remoteManifestDesc.MediaType)
+		if err != nil {
+			return nil, errors.Wrap(err, "write merged cache manifest")
+		}
+		mergedManifestDesc.Platform = remoteManifestDesc.Platform
+		merged.Manifests = append(merged.Manifests, *mergedManifestDesc)
+	}
+	for _, desc := range localIndex.Manifests {
+		if _, ok := localManifests[platformKey(desc.Platform)]; ok {
+			merged.Manifests = append(merged.Manifests, desc)
+		}
+	}
+
+	mergedDesc, err := writeJSON(ctx, store, merged, remoteDesc.MediaType)
+	if err != nil {
+		return nil, errors.Wrap(err, "write merged cache index")
+	}
+	return mergedDesc, nil
+}
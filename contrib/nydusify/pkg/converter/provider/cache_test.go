@@ -0,0 +1,162 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	accelcache "github.com/goharbor/acceleration-service/pkg/cache"
+	"github.com/goharbor/acceleration-service/pkg/remote"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func newCacheProvider(t *testing.T, ctx context.Context, cacheRef string) (context.Context, *Provider) {
+	hosts := func(string) (remote.CredentialFunc, bool, error) {
+		return func(string) (string, string, error) { return "", "", nil }, false, nil
+	}
+	pvd, err := New(t.TempDir(), hosts, 200, "v1", platforms.All, 0)
+	require.NoError(t, err)
+	pvd.UsePlainHTTP()
+	ctx, _ = pvd.NewRemoteCache(ctx, cacheRef)
+	return ctx, pvd
+}
+
+// writeCacheIndex writes a cache index like acceleration-service does, which
+// contains a manifest of linux/amd64 recording the specified layers.
+func writeCacheIndex(t *testing.T, ctx context.Context, pvd *Provider, layers ...string) ocispec.Descriptor {
+	config, err := writeJSON(ctx, pvd.store, ocispec.ImageConfig{}, ocispec.MediaTypeImageConfig)
+	require.NoError(t, err)
+
+	var descs []ocispec.Descriptor
+	for _, layer := range layers {
+		desc, err := writeJSON(ctx, pvd.store, map[string]string{"layer": layer}, ocispec.MediaTypeImageLayerGzip)
+		require.NoError(t, err)
+		desc.Annotations = map[string]string{"containerd.io/snapshot/nydus-source-digest": digest.FromString(layer).String()}
+		descs = append(descs, *desc)
+	}
+	manifest, err := writeJSON(ctx, pvd.store, ocispec.Manifest{
+		Versioned:   specs.Versioned{SchemaVersion: 2},
+		MediaType:   ocispec.MediaTypeImageManifest,
+		Config:      *config,
+		Layers:      descs,
+		Annotations: map[string]string{accelcache.LayerAnnotationCacheVersion: "v1"},
+	}, ocispec.MediaTypeImageManifest)
+	require.NoError(t, err)
+	manifest.Platform = &ocispec.Platform{OS: "linux", Architecture: "amd64"}
+
+	index, err := writeJSON(ctx, pvd.store, ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{*manifest},
+	}, ocispec.MediaTypeImageIndex)
+	require.NoError(t, err)
+	return *index
+}
+
+func remoteCacheLayers(t *testing.T, registry *testRegistry) []digest.Digest {
+	_, data, ok := registry.Tag("cache", "latest")
+	require.True(t, ok)
+	var index ocispec.Index
+	require.NoError(t, json.Unmarshal(data, &index))
+	require.Len(t, index.Manifests, 1)
+
+	data, ok = registry.Blob(index.Manifests[0].Digest)
+	require.True(t, ok)
+	var manifest ocispec.Manifest
+	require.NoError(t, json.Unmarshal(data, &manifest))
+	var layers []digest.Digest
+	for _, layer := range manifest.Layers {
+		_, ok := registry.Blob(layer.Digest)
+		require.True(t, ok)
+		layers = append(layers, layer.Digest)
+	}
+	return layers
+}
+
+func TestPushCacheMerge(t *testing.T) {
+	registry := newPushableRegistry(t)
+	cacheRef := registry.host + "/cache:latest"
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+
+	// Both conversions fetched the empty remote cache before pushing.
+	ctxA, pvdA := newCacheProvider(t, ctx, cacheRef)
+	indexA := writeCacheIndex(t, ctxA, pvdA, "a1", "a2")
+	ctxB, pvdB := newCacheProvider(t, ctx, cacheRef)
+	indexB := writeCacheIndex(t, ctxB, pvdB, "b1")
+
+	require.NoError(t, pvdB.Push(ctxB, indexB, cacheRef))
+	require.Len(t, remoteCacheLayers(t, registry), 1)
+
+	// The stale cache of conversion A doesn't clobber the one of B.
+	require.NoError(t, pvdA.Push(ctxA, indexA, cacheRef))
+	layers := remoteCacheLayers(t, registry)
+	require.Len(t, layers, 3)
+
+	// Pushing again converges without duplicated records.
+	require.NoError(t, pvdB.Push(ctxB, indexB, cacheRef))
+	require.ElementsMatch(t, layers, remoteCacheLayers(t, registry))
+}
+
+func TestPushCacheOverwrite(t *testing.T) {
+	registry := newPushableRegistry(t)
+	cacheRef := registry.host + "/cache:latest"
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+
+	ctxA, pvdA := newCacheProvider(t, ctx, cacheRef)
+	pvdA.SetCachePolicy(CachePolicyOverwrite)
+	indexA := writeCacheIndex(t, ctxA, pvdA, "a1", "a2")
+	ctxB, pvdB := newCacheProvider(t, ctx, cacheRef)
+	indexB := writeCacheIndex(t, ctxB, pvdB, "b1")
+
+	require.NoError(t, pvdB.Push(ctxB, indexB, cacheRef))
+	require.NoError(t, pvdA.Push(ctxA, indexA, cacheRef))
+	require.Len(t, remoteCacheLayers(t, registry), 2)
+}
+
+func TestNoCache(t *testing.T) {
+	registry := newPushableRegistry(t)
+	cacheRef := registry.host + "/cache:latest"
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+
+	cacheCtx, pvd := newCacheProvider(t, ctx, cacheRef)
+	require.NoError(t, pvd.Push(cacheCtx, writeCacheIndex(t, cacheCtx, pvd, "a1"), cacheRef))
+	fetches := registry.BlobFetches()
+
+	pvd, err := New(t.TempDir(), pvd.hosts, 200, "v1", platforms.All, 0)
+	require.NoError(t, err)
+	pvd.UsePlainHTTP()
+	pvd.SetNoCache(true)
+	ctx, cache := pvd.NewRemoteCache(ctx, cacheRef)
+	require.Nil(t, cache)
+
+	// The conversion never sees the cache records, and nothing is read from
+	// or written to the cache image.
+	rc, _ := accelcache.Get(ctx, digest.FromString("a1"))
+	require.Nil(t, rc)
+	require.Equal(t, fetches, registry.BlobFetches())
+	require.Len(t, remoteCacheLayers(t, registry), 1)
+}
+
+func TestPushCacheReadOnly(t *testing.T) {
+	registry := newPushableRegistry(t)
+	cacheRef := registry.host + "/cache:latest"
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+
+	ctx, pvd := newCacheProvider(t, ctx, cacheRef)
+	pvd.SetCacheReadOnly(true)
+	index := writeCacheIndex(t, ctx, pvd, "a1")
+	require.NoError(t, pvd.Push(ctx, index, cacheRef))
+	_, _, ok := registry.Tag("cache", "latest")
+	require.False(t, ok)
+	_, ok = registry.Blob(index.Digest)
+	require.False(t, ok)
+}
@@ -0,0 +1,65 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/containerd/containerd/content"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+// snapshotterNydus is the value of utils.ManifestNydusSnapshotter.
+const snapshotterNydus = "nydus"
+
+// setManifestCapability annotates nydus manifest with the snapshotter to
+// lazily load it, and the bootstrap layer with the IDs of the nydus blobs
+// in manifest, so that the orchestrators inspecting the annotations can
+// select nydus snapshotter. The manifest without bootstrap layer is kept
+// as is.
+func setManifestCapability(manifest *ocispec.Manifest) (bool, error) {
+	if !isNydusManifest(manifest) {
+		return false, nil
+	}
+
+	blobIDs := []string{}
+	for _, layer := range manifest.Layers {
+		if layer.MediaType == utils.MediaTypeNydusBlob || layer.Annotations[utils.LayerAnnotationNydusBlob] == "true" {
+			blobIDs = append(blobIDs, layer.Digest.Hex())
+		}
+	}
+	data, err := json.Marshal(blobIDs)
+	if err != nil {
+		return false, err
+	}
+	for idx, layer := range manifest.Layers {
+		if layer.Annotations[utils.LayerAnnotationNydusBootstrap] != "true" {
+			continue
+		}
+		annotations := map[string]string{}
+		for key, value := range layer.Annotations {
+			annotations[key] = value
+		}
+		annotations[utils.LayerAnnotationNydusBlobIDs] = string(data)
+		manifest.Layers[idx].Annotations = annotations
+	}
+	if manifest.Annotations == nil {
+		manifest.Annotations = map[string]string{}
+	}
+	manifest.Annotations[utils.ManifestNydusSnapshotter] = snapshotterNydus
+
+	return true, nil
+}
+
+// setCapability annotates all the nydus manifests in image, see
+// setManifestCapability.
+func setCapability(ctx context.Context, store content.Store, desc ocispec.Descriptor) (*ocispec.Descriptor, error) {
+	return rewriteManifests(ctx, store, desc, nil, func(_ *ocispec.Descriptor, manifest *ocispec.Manifest) (bool, error) {
+		return setManifestCapability(manifest)
+	})
+}
@@ -0,0 +1,87 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+func TestPushCapability(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+
+	config, err := writeJSON(ctx, pvd.store, ocispec.Image{Platform: ocispec.Platform{OS: "linux", Architecture: "amd64"}}, ocispec.MediaTypeImageConfig)
+	require.NoError(t, err)
+	var blobIDs []string
+	var layers []ocispec.Descriptor
+	for _, data := range []string{"a", "b"} {
+		blob, err := writeJSON(ctx, pvd.store, map[string]string{"blob": data}, utils.MediaTypeNydusBlob)
+		require.NoError(t, err)
+		layers = append(layers, *blob)
+		blobIDs = append(blobIDs, blob.Digest.Hex())
+	}
+	bootstrap, err := writeJSON(ctx, pvd.store, map[string]string{"bootstrap": "data"}, ocispec.MediaTypeImageLayerGzip)
+	require.NoError(t, err)
+	bootstrap.Annotations = map[string]string{utils.LayerAnnotationNydusBootstrap: "true"}
+	layers = append(layers, *bootstrap)
+	nydus, err := writeJSON(ctx, pvd.store, ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    *config,
+		Layers:    layers,
+	}, ocispec.MediaTypeImageManifest)
+	require.NoError(t, err)
+
+	registry := newPushableRegistry(t)
+	ref := registry.host + "/capability:nydus"
+	require.NoError(t, pvd.Push(ctx, *nydus, ref))
+	desc, err := pvd.Image(ctx, ref)
+	require.NoError(t, err)
+	require.NotEqual(t, nydus.Digest, desc.Digest)
+	var manifest ocispec.Manifest
+	require.NoError(t, readJSON(ctx, pvd.store, *desc, &manifest))
+	require.Equal(t, "nydus", manifest.Annotations[utils.ManifestNydusSnapshotter])
+	require.Len(t, manifest.Layers, 3)
+	pushedBootstrap := manifest.Layers[2]
+	require.Equal(t, bootstrap.Digest, pushedBootstrap.Digest)
+	require.Equal(t, "true", pushedBootstrap.Annotations[utils.LayerAnnotationNydusBootstrap])
+	var pushedBlobIDs []string
+	require.NoError(t, json.Unmarshal([]byte(pushedBootstrap.Annotations[utils.LayerAnnotationNydusBlobIDs]), &pushedBlobIDs))
+	require.ElementsMatch(t, blobIDs, pushedBlobIDs)
+	for _, blob := range manifest.Layers[:2] {
+		require.Contains(t, pushedBlobIDs, blob.Digest.Hex())
+	}
+
+	// The annotated manifest is pushed as is.
+	ref = registry.host + "/capability:again"
+	require.NoError(t, pvd.Push(ctx, *desc, ref))
+	again, err := pvd.Image(ctx, ref)
+	require.NoError(t, err)
+	require.Equal(t, desc.Digest, again.Digest)
+
+	// The manifest without bootstrap isn't annotated.
+	oci, err := writeJSON(ctx, pvd.store, ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    *config,
+		Layers:    layers[:1],
+	}, ocispec.MediaTypeImageManifest)
+	require.NoError(t, err)
+	ref = registry.host + "/capability:oci"
+	require.NoError(t, pvd.Push(ctx, *oci, ref))
+	pushed, err := pvd.Image(ctx, ref)
+	require.NoError(t, err)
+	require.Equal(t, oci.Digest, pushed.Digest)
+}
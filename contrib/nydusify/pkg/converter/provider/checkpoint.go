@@ -0,0 +1,286 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/log"
+	"github.com/containerd/nydus-snapshotter/pkg/converter"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// buildRefPrefix is the ingest reference prefix of the nydus blob built from
+// a source layer by converter.LayerConvertFunc, followed by the source
+// layer digest.
+const buildRefPrefix = "convert-nydus-from-"
+
+// Checkpoint records the progress of conversion per layer in a file, which
+// is written on each layer pulled, built or pushed, so that a conversion
+// restarted after being interrupted skips the completed layers rather than
+// computing them again. The content store must be persisted along with the
+// checkpoint.
+type Checkpoint struct {
+	mutex sync.Mutex
+	path  string
+	state checkpointState
+}
+
+type checkpointState struct {
+	// Pulled are the source layers fetched into content store.
+	Pulled map[digest.Digest]bool `json:"pulled"`
+	// Built maps the source layer to the nydus blob built from it.
+	Built map[digest.Digest]digest.Digest `json:"built"`
+	// Pushed are the layers pushed to remote, in the form of
+	// `repository@digest`.
+	Pushed map[string]bool `json:"pushed"`
+}
+
+// LoadCheckpoint loads the checkpoint from path, a new checkpoint is
+// created if the file doesn't exist.
+func LoadCheckpoint(ctx context.Context, path string) (*Checkpoint, error) {
+	checkpoint := &Checkpoint{
+		path: path,
+		state: checkpointState{
+			Pulled: map[digest.Digest]bool{},
+			Built:  map[digest.Digest]digest.Digest{},
+			Pushed: map[string]bool{},
+		},
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return checkpoint, nil
+		}
+		return nil, errors.Wrap(err, "read checkpoint")
+	}
+	if err := json.Unmarshal(data, &checkpoint.state); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal checkpoint %s", path)
+	}
+	log.G(ctx).Infof("resume from checkpoint %s, %d layers pulled, %d layers built, %d layers pushed",
+		path, len(checkpoint.state.Pulled), len(checkpoint.state.Built), len(checkpoint.state.Pushed))
+	return checkpoint, nil
+}
+
+// update applies fn to the state and writes the checkpoint file atomically.
+func (checkpoint *Checkpoint) update(ctx context.Context, fn func(state *checkpointState)) {
+	checkpoint.mutex.Lock()
+	defer checkpoint.mutex.Unlock()
+	fn(&checkpoint.state)
+
+	data, err := json.Marshal(checkpoint.state)
+	if err == nil {
+		tmpPath := checkpoint.path + ".tmp"
+		if err = os.WriteFile(tmpPath, data, 0644); err == nil {
+			err = os.Rename(tmpPath, checkpoint.path)
+		}
+	}
+	// The conversion proceeds without the checkpoint, it's recomputed
+	// on the next restart.
+	if err != nil {
+		log.G(ctx).Warnf("write checkpoint %s: %s", checkpoint.path, err)
+	}
+}
+
+func (checkpoint *Checkpoint) pulled(layer digest.Digest) bool {
+	checkpoint.mutex.Lock()
+	defer checkpoint.mutex.Unlock()
+	return checkpoint.state.Pulled[layer]
+}
+
+func (checkpoint *Checkpoint) built(layer digest.Digest) (digest.Digest, bool) {
+	checkpoint.mutex.Lock()
+	defer checkpoint.mutex.Unlock()
+	blob, ok := checkpoint.state.Built[layer]
+	return blob, ok
+}
+
+func (checkpoint *Checkpoint) pushed(repository string, layer digest.Digest) bool {
+	checkpoint.mutex.Lock()
+	defer checkpoint.mutex.Unlock()
+	return checkpoint.state.Pushed[repository+"@"+layer.String()]
+}
+
+// unpush removes the layer missing in remote from the pushed layers, so that
+// it's pushed again on restart.
+func (checkpoint *Checkpoint) unpush(ctx context.Context, repository string, layer digest.Digest) {
+	checkpoint.update(ctx, func(state *checkpointState) {
+		delete(state.Pushed, repository+"@"+layer.String())
+	})
+}
+
+// SetCheckpoint records the progress of Pull, Push and the layer building
+// through ContentStore into checkpoint, and skips the layers completed in
+// checkpoint.
+func (pvd *Provider) SetCheckpoint(checkpoint *Checkpoint) {
+	pvd.checkpoint = checkpoint
+	pvd.wrapStore(func(store content.Store) content.Store {
+		return &checkpointStore{Store: store, checkpoint: checkpoint}
+	})
+}
+
+// checkpointHandlerWrapper records the pulled layers, and skips fetching the
+// layers pulled in checkpoint if they still exist in content store.
+func (pvd *Provider) checkpointHandlerWrapper(handler images.Handler) images.Handler {
+	if pvd.checkpoint == nil {
+		return handler
+	}
+	return images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		if !images.IsLayerType(desc.MediaType) {
+			return handler.Handle(ctx, desc)
+		}
+		if pvd.checkpoint.pulled(desc.Digest) {
+			if _, err := pvd.store.Info(ctx, desc.Digest); err == nil {
+				log.G(ctx).Debugf("skip pulling layer %s, pulled in checkpoint", desc.Digest)
+				return nil, nil
+			}
+		}
+		children, err := handler.Handle(ctx, desc)
+		if err == nil {
+			pvd.checkpoint.update(ctx, func(state *checkpointState) {
+				state.Pulled[desc.Digest] = true
+			})
+		}
+		return children, err
+	})
+}
+
+func (pvd *Provider) checkpointResolver(resolver remotes.Resolver) remotes.Resolver {
+	if pvd.checkpoint == nil {
+		return resolver
+	}
+	return &checkpointResolver{Resolver: resolver, checkpoint: pvd.checkpoint}
+}
+
+// checkpointResolver records the pushed layers, including the ones already
+// existing in remote, and skips pushing the layers pushed to the same
+// repository in checkpoint.
+type checkpointResolver struct {
+	remotes.Resolver
+	checkpoint *Checkpoint
+}
+
+func (resolver *checkpointResolver) Pusher(ctx context.Context, ref string) (remotes.Pusher, error) {
+	pusher, err := resolver.Resolver.Pusher(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	named, err := docker.ParseDockerRef(ref)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse reference %s", ref)
+	}
+	return &checkpointPusher{Pusher: pusher, checkpoint: resolver.checkpoint, repository: named.Name()}, nil
+}
+
+type checkpointPusher struct {
+	remotes.Pusher
+	checkpoint *Checkpoint
+	repository string
+}
+
+func (pusher *checkpointPusher) Push(ctx context.Context, desc ocispec.Descriptor) (content.Writer, error) {
+	if !images.IsLayerType(desc.MediaType) {
+		return pusher.Pusher.Push(ctx, desc)
+	}
+	if pusher.checkpoint.pushed(pusher.repository, desc.Digest) {
+		return nil, errors.Wrapf(errdefs.ErrAlreadyExists, "layer %s pushed in checkpoint", desc.Digest)
+	}
+	done := func(ctx context.Context, _ digest.Digest) {
+		pusher.checkpoint.update(ctx, func(state *checkpointState) {
+			state.Pushed[pusher.repository+"@"+desc.Digest.String()] = true
+		})
+	}
+	writer, err := pusher.Pusher.Push(ctx, desc)
+	if err != nil {
+		// The layer pushed by an interrupted conversion without checkpoint
+		// exists in remote as well.
+		if errdefs.IsAlreadyExists(err) {
+			done(ctx, desc.Digest)
+		}
+		return nil, err
+	}
+	return &checkpointWriter{Writer: writer, done: done}, nil
+}
+
+// checkpointStore records the nydus blobs built from source layers, and
+// labels the source layer built in checkpoint with the target digest like
+// the remote cache does, so that its building is skipped by
+// converter.LayerConvertFunc.
+type checkpointStore struct {
+	content.Store
+	checkpoint *Checkpoint
+}
+
+func (store *checkpointStore) Info(ctx context.Context, dgst digest.Digest) (content.Info, error) {
+	info, err := store.Store.Info(ctx, dgst)
+	if err != nil {
+		return info, err
+	}
+	blob, ok := store.checkpoint.built(dgst)
+	if !ok {
+		return info, nil
+	}
+	if _, err := store.Store.Info(ctx, blob); err != nil {
+		return info, nil
+	}
+	labels := make(map[string]string, len(info.Labels)+1)
+	for key, value := range info.Labels {
+		labels[key] = value
+	}
+	labels[converter.LayerAnnotationNydusTargetDigest] = blob.String()
+	info.Labels = labels
+	return info, nil
+}
+
+func (store *checkpointStore) Writer(ctx context.Context, opts ...content.WriterOpt) (content.Writer, error) {
+	writer, err := store.Store.Writer(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	var wopts content.WriterOpts
+	for _, opt := range opts {
+		if err := opt(&wopts); err != nil {
+			return nil, err
+		}
+	}
+	source, err := digest.Parse(strings.TrimPrefix(wopts.Ref, buildRefPrefix))
+	if !strings.HasPrefix(wopts.Ref, buildRefPrefix) || err != nil {
+		return writer, nil
+	}
+	return &checkpointWriter{Writer: writer, done: func(ctx context.Context, blob digest.Digest) {
+		store.checkpoint.update(ctx, func(state *checkpointState) {
+			state.Built[source] = blob
+		})
+	}}, nil
+}
+
+// checkpointWriter calls done with the content digest once it's committed.
+type checkpointWriter struct {
+	content.Writer
+	done func(context.Context, digest.Digest)
+}
+
+func (writer *checkpointWriter) Commit(ctx context.Context, size int64, expected digest.Digest, opts ...content.Opt) error {
+	err := writer.Writer.Commit(ctx, size, expected, opts...)
+	if err == nil || errdefs.IsAlreadyExists(err) {
+		dgst := expected
+		if dgst == "" {
+			dgst = writer.Writer.Digest()
+		}
+		writer.done(ctx, dgst)
+	}
+	return err
+}
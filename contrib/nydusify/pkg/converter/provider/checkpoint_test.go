@@ -0,0 +1,182 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/nydus-snapshotter/pkg/converter"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// buildLayer builds the layer like converter.LayerConvertFunc, the building
+// is skipped if the layer is labeled with the target blob, it returns true
+// if the layer is built.
+func buildLayer(t *testing.T, ctx context.Context, store content.Store, layer ocispec.Descriptor) bool {
+	info, err := store.Info(ctx, layer.Digest)
+	require.NoError(t, err)
+	if info.Labels[converter.LayerAnnotationNydusTargetDigest] != "" {
+		return false
+	}
+	data, err := content.ReadBlob(ctx, store, layer)
+	require.NoError(t, err)
+	writer, err := content.OpenWriter(ctx, store, content.WithRef(buildRefPrefix+layer.Digest.String()))
+	require.NoError(t, err)
+	defer writer.Close()
+	_, err = writer.Write(append([]byte("nydus "), data...))
+	require.NoError(t, err)
+	require.NoError(t, writer.Commit(ctx, 0, ""))
+	return true
+}
+
+// addSourceImage adds an image of two layers to registry, it returns the
+// reference and layers of image.
+func addSourceImage(t *testing.T, registry *testRegistry) (string, []ocispec.Descriptor) {
+	configData, err := json.Marshal(ocispec.Image{Platform: ocispec.Platform{OS: "linux", Architecture: "amd64"}})
+	require.NoError(t, err)
+	layers := []ocispec.Descriptor{
+		registry.AddBlob(ocispec.MediaTypeImageLayerGzip, []byte(strings.Repeat("lower", 1024))),
+		registry.AddBlob(ocispec.MediaTypeImageLayerGzip, []byte(strings.Repeat("upper", 1024))),
+	}
+	manifestData, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    registry.AddBlob(ocispec.MediaTypeImageConfig, configData),
+		Layers:    layers,
+	})
+	require.NoError(t, err)
+	manifest := registry.AddBlob(ocispec.MediaTypeImageManifest, manifestData)
+	registry.SetTag("library/image", "latest", manifest.Digest)
+	return registry.host + "/library/image:latest", layers
+}
+
+// newCheckpointProvider returns a function creating the provider of each
+// restart and the checkpoint path, the content store and checkpoint are
+// persisted across restarts, see TestPullWithPersistentContent.
+func newCheckpointProvider(t *testing.T) (func() *Provider, string) {
+	var store content.Store
+	checkpointPath := filepath.Join(t.TempDir(), "checkpoint.json")
+	return func() *Provider {
+		pvd := newPlatformProvider(t, platforms.All, "", "")
+		if store == nil {
+			store = pvd.store
+		}
+		pvd.SetContentStore(store)
+		checkpoint, err := LoadCheckpoint(context.Background(), checkpointPath)
+		require.NoError(t, err)
+		pvd.SetCheckpoint(checkpoint)
+		return pvd
+	}, checkpointPath
+}
+
+func TestCheckpointResume(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+
+	registry := newPushableRegistry(t)
+	ref, layers := addSourceImage(t, registry)
+
+	newProvider, checkpointPath := newCheckpointProvider(t)
+
+	// The conversion is killed after the first layer is built.
+	pvd := newProvider()
+	require.NoError(t, pvd.Pull(ctx, ref))
+	require.True(t, buildLayer(t, ctx, pvd.ContentStore(), layers[0]))
+	fetches := registry.BlobFetches()
+
+	data, err := os.ReadFile(checkpointPath)
+	require.NoError(t, err)
+	var state checkpointState
+	require.NoError(t, json.Unmarshal(data, &state))
+	require.Equal(t, map[digest.Digest]bool{layers[0].Digest: true, layers[1].Digest: true}, state.Pulled)
+	require.Len(t, state.Built, 1)
+	require.Contains(t, state.Built, layers[0].Digest)
+
+	// The resumed conversion only builds the second layer without pulling
+	// the layers again.
+	pvd = newProvider()
+	require.NoError(t, pvd.Pull(ctx, ref))
+	require.Equal(t, fetches, registry.BlobFetches())
+	require.False(t, buildLayer(t, ctx, pvd.ContentStore(), layers[0]))
+	require.True(t, buildLayer(t, ctx, pvd.ContentStore(), layers[1]))
+	info, err := pvd.ContentStore().Info(ctx, layers[0].Digest)
+	require.NoError(t, err)
+	require.Equal(t, state.Built[layers[0].Digest].String(), info.Labels[converter.LayerAnnotationNydusTargetDigest])
+
+	// The pushed layers are recorded, and skipped on the next push.
+	target, blob, bootstrap := writeNydusImage(t, ctx, pvd)
+	targetRef := registry.host + "/library/nydus:latest"
+	require.NoError(t, pvd.Push(ctx, target, targetRef))
+	for _, layer := range []ocispec.Descriptor{blob, bootstrap} {
+		require.True(t, pvd.checkpoint.pushed(registry.host+"/library/nydus", layer.Digest))
+	}
+	var uploaded []digest.Digest
+	registry.Override(recordBlobs(&uploaded))
+	pvd = newProvider()
+	target, _, _ = writeNydusImage(t, ctx, pvd)
+	require.NoError(t, pvd.Push(ctx, target, targetRef))
+	require.Empty(t, uploaded)
+	require.GreaterOrEqual(t, pvd.ExistingBytes(), blob.Size+bootstrap.Size)
+}
+
+func TestCheckpointResumePush(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+
+	registry := newPushableRegistry(t)
+	ref, layers := addSourceImage(t, registry)
+	newProvider, _ := newCheckpointProvider(t)
+	targetRef := registry.host + "/library/nydus:latest"
+
+	// The conversion is interrupted after the blob is uploaded, the
+	// bootstrap is lost in remote and the manifest isn't published.
+	pvd := newProvider()
+	require.NoError(t, pvd.Pull(ctx, ref))
+	for _, layer := range layers {
+		require.True(t, buildLayer(t, ctx, pvd.ContentStore(), layer))
+	}
+	target, blob, bootstrap := writeNydusImage(t, ctx, pvd)
+	registry.Override(onBlobPush(func(dgst digest.Digest) (int, bool) {
+		return 0, dgst == bootstrap.Digest
+	}))
+	require.Error(t, pvd.Push(ctx, target, targetRef))
+	require.True(t, pvd.checkpoint.pushed(registry.host+"/library/nydus", blob.Digest))
+	require.False(t, pvd.checkpoint.pushed(registry.host+"/library/nydus", bootstrap.Digest))
+	_, _, ok := registry.Tag("library/nydus", "latest")
+	require.False(t, ok)
+
+	// The rerun neither pulls nor builds the layers again, only the
+	// bootstrap and manifest are pushed.
+	fetches := registry.BlobFetches()
+	var uploaded, manifests []digest.Digest
+	registry.Override(recordBlobs(&uploaded), onManifestPush(func(_ string, dgst digest.Digest, _ []byte) {
+		manifests = append(manifests, dgst)
+	}))
+	pvd = newProvider()
+	require.NoError(t, pvd.Pull(ctx, ref))
+	require.Equal(t, fetches, registry.BlobFetches())
+	for _, layer := range layers {
+		require.False(t, buildLayer(t, ctx, pvd.ContentStore(), layer))
+	}
+	target, _, _ = writeNydusImage(t, ctx, pvd)
+	require.NoError(t, pvd.Push(ctx, target, targetRef))
+	require.Equal(t, []digest.Digest{bootstrap.Digest}, uploaded)
+	require.NotEmpty(t, manifests)
+	for _, dgst := range manifests {
+		require.Equal(t, target.Digest, dgst)
+	}
+	dgst, _, ok := registry.Tag("library/nydus", "latest")
+	require.True(t, ok)
+	require.Equal(t, target.Digest, dgst)
+}
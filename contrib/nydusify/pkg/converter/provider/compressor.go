@@ -0,0 +1,378 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/log"
+	"github.com/containerd/nydus-snapshotter/pkg/converter"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+const (
+	// CompressorAuto chooses the compressor of each source layer by
+	// sampling its file data, see SetAutoCompressor.
+	CompressorAuto = "auto"
+
+	// annotationBlobCompressor records the compressor of the nydus blob
+	// layer built with a compressor other than the one of the image, the
+	// media type of nydus blob doesn't vary with the compressor.
+	annotationBlobCompressor = "containerd.io/snapshot/nydus-compressor"
+
+	// compressorSampleSize is the file data of a layer sampled to choose
+	// its compressor.
+	compressorSampleSize = 8 << 20
+	// incompressibleRatio is the compressed size of the sampled data in
+	// ratio of the raw size, above which the layer is stored uncompressed,
+	// e.g. the already compressed media files.
+	incompressibleRatio = 0.9
+)
+
+// layerBuildFunc builds the nydus blob of source layer desc with compressor
+// into store.
+type layerBuildFunc func(ctx context.Context, store content.Store, desc ocispec.Descriptor, compressor string) (*ocispec.Descriptor, error)
+
+// layerCompressors builds the source layers with the compressors other than
+// the one of the nydus driver before conversion, the driver takes a single
+// compressor for all the layers.
+type layerCompressors struct {
+	// compressor is the compressor of the layers built by the driver.
+	compressor string
+	auto       bool
+	build      layerBuildFunc
+	// overrides maps the layer index or digest to its compressor, see
+	// SetLayerCompressors, and layers maps the source layers resolved from
+	// overrides to their compressors.
+	overrides map[string]string
+	layers    map[digest.Digest]string
+
+	mutex sync.Mutex
+	// built maps the source layer to the nydus blob built from it.
+	built map[digest.Digest]digest.Digest
+	// compressors maps the nydus blob built to its compressor.
+	compressors map[digest.Digest]string
+}
+
+// SetAutoCompressor chooses the compressor of each source layer on pulling,
+// the layers whose sampled file data barely compresses are built without
+// compression, the others by opt.Compressor. The layers are built by opt
+// with the chosen compressor if it differs from opt.Compressor, which the
+// nydus driver builds the rest with, and the built blobs are annotated with
+// their compressors in the target image. The bootstrap records the
+// compressor of each blob, so the blobs of mixed compressors are merged.
+func (pvd *Provider) SetAutoCompressor(opt converter.PackOption) {
+	pvd.useLayerCompressors(opt).auto = true
+}
+
+// SetLayerCompressors builds the source layers with the compressors in
+// overrides rather than opt.Compressor, e.g. an already compressed media
+// layer is better stored uncompressed. The overrides are keyed by the index
+// of layer in source manifest starting from 0, or the digest of layer, the
+// digest takes precedence. The other layers are built with opt.Compressor by
+// the nydus driver, or with the compressors chosen by SetAutoCompressor. The
+// overridden layers are built before conversion and annotated with their
+// compressors in the target image like SetAutoCompressor does. The layers
+// rewritten or batched on pulling don't match the overrides any more, their
+// overrides aren't applied.
+func (pvd *Provider) SetLayerCompressors(opt converter.PackOption, overrides map[string]string) error {
+	for key, compressor := range overrides {
+		switch compressor {
+		case "none", "lz4_block", "zstd":
+		default:
+			return errors.Errorf("unsupported compressor %s of layer %s, possible values: none, lz4_block, zstd", compressor, key)
+		}
+		if _, err := digest.Parse(key); err == nil {
+			continue
+		}
+		if idx, err := strconv.Atoi(key); err != nil || idx < 0 {
+			return errors.Errorf("invalid layer %s of compressor %s, it should be the index or digest of layer", key, compressor)
+		}
+	}
+	pvd.useLayerCompressors(opt).overrides = overrides
+	return nil
+}
+
+// useLayerCompressors returns the layer compressors building the layers by
+// opt, the content store is wrapped on first use.
+func (pvd *Provider) useLayerCompressors(opt converter.PackOption) *layerCompressors {
+	if pvd.layerCompressors == nil {
+		compressors := &layerCompressors{
+			built:       map[digest.Digest]digest.Digest{},
+			compressors: map[digest.Digest]string{},
+		}
+		pvd.layerCompressors = compressors
+		pvd.wrapStore(func(store content.Store) content.Store {
+			return &compressorStore{Store: store, compressors: compressors}
+		})
+	}
+	compressors := pvd.layerCompressors
+	compressors.compressor = opt.Compressor
+	compressors.build = func(ctx context.Context, store content.Store, desc ocispec.Descriptor, compressor string) (*ocispec.Descriptor, error) {
+		opt := opt
+		opt.Compressor = compressor
+		return converter.LayerConvertFunc(opt)(ctx, store, desc)
+	}
+	return compressors
+}
+
+// sampleCompressor chooses the compressor of the decompressed layer read
+// from reader by compressing its file data sampled, it returns "none" for
+// the incompressible layer, or compressor otherwise.
+func sampleCompressor(reader io.Reader, compressor string) (string, error) {
+	estimator, err := newChunkEstimator("zstd")
+	if err != nil {
+		return "", err
+	}
+	defer estimator.close()
+
+	var raw, compressed int64
+	buf := make([]byte, 1<<20)
+	tr := tar.NewReader(reader)
+	for raw < compressorSampleSize {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		for raw < compressorSampleSize {
+			n, err := io.ReadFull(tr, buf)
+			if n > 0 {
+				raw += int64(n)
+				compressed += estimator.size(buf[:n])
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+	if raw > 0 && float64(compressed) >= float64(raw)*incompressibleRatio {
+		return "none", nil
+	}
+	return compressor, nil
+}
+
+// resolveLayerCompressors resolves the overrides of SetLayerCompressors to
+// the source layers of image desc pulled into store, before the layers are
+// stripped or rewritten, the foreign layers aren't built and are skipped.
+func (pvd *Provider) resolveLayerCompressors(ctx context.Context, desc ocispec.Descriptor) error {
+	compressors := pvd.layerCompressors
+	compressors.layers = map[digest.Digest]string{}
+	matched := map[string]bool{}
+	handler := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		switch desc.MediaType {
+		case ocispec.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList:
+			return images.Children(ctx, pvd.store, desc)
+		case ocispec.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest:
+		default:
+			return nil, nil
+		}
+		var manifest ocispec.Manifest
+		if err := readJSON(ctx, pvd.store, desc, &manifest); err != nil {
+			return nil, errors.Wrapf(err, "read manifest %s", desc.Digest)
+		}
+		for idx, layer := range manifest.Layers {
+			key := layer.Digest.String()
+			compressor, ok := compressors.overrides[key]
+			if !ok {
+				key = strconv.Itoa(idx)
+				if compressor, ok = compressors.overrides[key]; !ok {
+					continue
+				}
+			}
+			matched[key] = true
+			if images.IsNonDistributable(layer.MediaType) {
+				continue
+			}
+			if existing, ok := compressors.layers[layer.Digest]; ok && existing != compressor {
+				return nil, errors.Errorf("conflicting compressors %s and %s of layer %s", existing, compressor, layer.Digest)
+			}
+			compressors.layers[layer.Digest] = compressor
+		}
+		return nil, nil
+	})
+	if err := images.Walk(ctx, images.FilterPlatforms(handler, pvd.platformMC), desc); err != nil {
+		return err
+	}
+	for key := range compressors.overrides {
+		if !matched[key] {
+			log.G(ctx).Warnf("layer %s of compressor override isn't found in source image", key)
+		}
+	}
+	return nil
+}
+
+// chooseCompressor returns the compressor of source layer desc.
+func (compressors *layerCompressors) chooseCompressor(ctx context.Context, store content.Store, desc ocispec.Descriptor) (string, error) {
+	if compressor, ok := compressors.layers[desc.Digest]; ok {
+		return compressor, nil
+	}
+	if !compressors.auto {
+		return compressors.compressor, nil
+	}
+	ra, err := store.ReaderAt(ctx, desc)
+	if err != nil {
+		return "", err
+	}
+	defer ra.Close()
+	reader, err := utils.DecompressLayer(content.NewReader(ra), desc.MediaType)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	return sampleCompressor(reader, compressors.compressor)
+}
+
+// buildLayerCompressors builds the source layers of image desc pulled into
+// store whose compressors differ from the one of the nydus driver, the
+// layers are labeled with the built blobs by compressorStore, so that their
+// building is skipped by converter.LayerConvertFunc. The layers built
+// already, e.g. by checkpoint or base nydus image, are skipped.
+func (pvd *Provider) buildLayerCompressors(ctx context.Context, desc ocispec.Descriptor) error {
+	compressors := pvd.layerCompressors
+	layers := map[digest.Digest]ocispec.Descriptor{}
+	handler := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		switch desc.MediaType {
+		case ocispec.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList:
+			return images.Children(ctx, pvd.store, desc)
+		case ocispec.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest:
+		default:
+			return nil, nil
+		}
+		var manifest ocispec.Manifest
+		if err := readJSON(ctx, pvd.store, desc, &manifest); err != nil {
+			return nil, errors.Wrapf(err, "read manifest %s", desc.Digest)
+		}
+		for _, layer := range manifest.Layers {
+			if images.IsLayerType(layer.MediaType) && !converter.IsNydusBlob(layer) && !converter.IsNydusBootstrap(layer) {
+				layers[layer.Digest] = layer
+			}
+		}
+		return nil, nil
+	})
+	if err := images.Walk(ctx, images.FilterPlatforms(handler, pvd.platformMC), desc); err != nil {
+		return err
+	}
+	for layer := range compressors.layers {
+		if _, ok := layers[layer]; !ok {
+			log.G(ctx).Warnf("compressor override of layer %s isn't applied, the layer is rewritten or batched", layer)
+		}
+	}
+
+	eg, ctx := errgroup.WithContext(ctx)
+	for _, layer := range layers {
+		layer := layer
+		eg.Go(func() error {
+			info, err := pvd.store.Info(ctx, layer.Digest)
+			if err != nil {
+				return err
+			}
+			if digest.Digest(info.Labels[converter.LayerAnnotationNydusTargetDigest]).Validate() == nil {
+				return nil
+			}
+			compressor, err := compressors.chooseCompressor(ctx, pvd.store, layer)
+			if err != nil {
+				return errors.Wrapf(err, "choose compressor of layer %s", layer.Digest)
+			}
+			if compressor == compressors.compressor {
+				return nil
+			}
+			blob, err := compressors.build(ctx, pvd.store, layer, compressor)
+			if err != nil {
+				return errors.Wrapf(err, "build layer %s with compressor %s", layer.Digest, compressor)
+			}
+			if blob == nil {
+				return nil
+			}
+			log.G(ctx).Infof("built layer %s with compressor %s into blob %s", layer.Digest, compressor, blob.Digest)
+			compressors.mutex.Lock()
+			defer compressors.mutex.Unlock()
+			compressors.built[layer.Digest] = blob.Digest
+			compressors.compressors[blob.Digest] = compressor
+			return nil
+		})
+	}
+	return eg.Wait()
+}
+
+// blobCompressors returns the compressors of the nydus blobs built by
+// buildLayerCompressors.
+func (compressors *layerCompressors) blobCompressors() map[digest.Digest]string {
+	compressors.mutex.Lock()
+	defer compressors.mutex.Unlock()
+	blobs := make(map[digest.Digest]string, len(compressors.compressors))
+	for blob, compressor := range compressors.compressors {
+		blobs[blob] = compressor
+	}
+	return blobs
+}
+
+// compressorStore labels the source layer built by buildLayerCompressors
+// with the target digest like checkpointStore does.
+type compressorStore struct {
+	content.Store
+	compressors *layerCompressors
+}
+
+func (store *compressorStore) Info(ctx context.Context, dgst digest.Digest) (content.Info, error) {
+	info, err := store.Store.Info(ctx, dgst)
+	if err != nil {
+		return info, err
+	}
+	store.compressors.mutex.Lock()
+	blob, ok := store.compressors.built[dgst]
+	store.compressors.mutex.Unlock()
+	if !ok {
+		return info, nil
+	}
+	labels := make(map[string]string, len(info.Labels)+1)
+	for key, value := range info.Labels {
+		labels[key] = value
+	}
+	labels[converter.LayerAnnotationNydusTargetDigest] = blob.String()
+	info.Labels = labels
+	return info, nil
+}
+
+// setBlobCompressors annotates the nydus blob layers of all the manifests in
+// target image with the compressors in blobs.
+func setBlobCompressors(ctx context.Context, store content.Store, desc ocispec.Descriptor, blobs map[digest.Digest]string) (*ocispec.Descriptor, error) {
+	return rewriteManifests(ctx, store, desc, nil, func(_ *ocispec.Descriptor, manifest *ocispec.Manifest) (bool, error) {
+		changed := false
+		for idx, layer := range manifest.Layers {
+			compressor, ok := blobs[layer.Digest]
+			if !ok || layer.Annotations[annotationBlobCompressor] == compressor {
+				continue
+			}
+			annotations := map[string]string{}
+			for key, value := range layer.Annotations {
+				annotations[key] = value
+			}
+			annotations[annotationBlobCompressor] = compressor
+			manifest.Layers[idx].Annotations = annotations
+			changed = true
+		}
+		return changed, nil
+	})
+}
@@ -0,0 +1,295 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/nydus-snapshotter/pkg/converter"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+// randomString returns the incompressible data of size.
+func randomString(t testing.TB, size int) string {
+	data := make([]byte, size)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	return string(data)
+}
+
+// fakeLayerBuild builds the fake nydus blob of layer recording the
+// compressor, the built layers are recorded in built.
+func fakeLayerBuild(built *sync.Map) layerBuildFunc {
+	return func(ctx context.Context, store content.Store, desc ocispec.Descriptor, compressor string) (*ocispec.Descriptor, error) {
+		data := []byte(compressor + " " + desc.Digest.String())
+		blob := ocispec.Descriptor{
+			MediaType:   utils.MediaTypeNydusBlob,
+			Digest:      digest.FromBytes(data),
+			Size:        int64(len(data)),
+			Annotations: map[string]string{utils.LayerAnnotationNydusBlob: "true"},
+		}
+		if err := content.WriteBlob(ctx, store, buildRefPrefix+desc.Digest.String(), bytes.NewReader(data), blob); err != nil {
+			return nil, err
+		}
+		built.Store(desc.Digest, compressor)
+		return &blob, nil
+	}
+}
+
+func TestSampleCompressor(t *testing.T) {
+	for _, tc := range []struct {
+		files    map[string]string
+		expected string
+	}{
+		{files: map[string]string{"media.mp4": randomString(t, 1<<20)}, expected: "none"},
+		{files: map[string]string{"app.log": strings.Repeat("nydus", 1<<18)}, expected: "zstd"},
+		// The layer without file data is kept with the compressor.
+		{files: map[string]string{}, expected: "zstd"},
+	} {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for name, data := range tc.files {
+			require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg}))
+			_, err := tw.Write([]byte(data))
+			require.NoError(t, err)
+		}
+		require.NoError(t, tw.Close())
+		compressor, err := sampleCompressor(&buf, "zstd")
+		require.NoError(t, err)
+		require.Equal(t, tc.expected, compressor)
+	}
+}
+
+func TestAutoCompressor(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	registry := newPushableRegistry(t)
+	source := registry.host + "/source:latest"
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+	media := writeTarLayer(t, ctx, pvd.store, map[string]string{"media.mp4": randomString(t, 1<<20)})
+	text := writeTarLayer(t, ctx, pvd.store, map[string]string{"app.log": strings.Repeat("nydus", 1<<18)})
+	pushLayersImage(t, ctx, pvd, source, []ocispec.Descriptor{media, text})
+
+	pvd = newPlatformProvider(t, platforms.All, "", "")
+	pvd.SetAutoCompressor(converter.PackOption{Compressor: "zstd"})
+	var built sync.Map
+	pvd.layerCompressors.build = fakeLayerBuild(&built)
+	require.NoError(t, pvd.Pull(ctx, source))
+
+	// Only the incompressible layer is built before conversion, the other
+	// is left to the nydus driver with the compressor of image.
+	compressor, ok := built.Load(media.Digest)
+	require.True(t, ok)
+	require.Equal(t, "none", compressor)
+	_, ok = built.Load(text.Digest)
+	require.False(t, ok)
+
+	info, err := pvd.ContentStore().Info(ctx, media.Digest)
+	require.NoError(t, err)
+	mediaBlob := digest.Digest(info.Labels[converter.LayerAnnotationNydusTargetDigest])
+	require.NoError(t, mediaBlob.Validate())
+	info, err = pvd.ContentStore().Info(ctx, text.Digest)
+	require.NoError(t, err)
+	require.Empty(t, info.Labels[converter.LayerAnnotationNydusTargetDigest])
+
+	mediaInfo, err := pvd.ContentStore().Info(ctx, mediaBlob)
+	require.NoError(t, err)
+	textBlob, err := writeJSON(ctx, pvd.store, map[string]string{"blob": "text"}, utils.MediaTypeNydusBlob)
+	require.NoError(t, err)
+	bootstrap, err := writeJSON(ctx, pvd.store, map[string]string{"bootstrap": "data"}, ocispec.MediaTypeImageLayerGzip)
+	require.NoError(t, err)
+	bootstrap.Annotations = map[string]string{utils.LayerAnnotationNydusBootstrap: "true"}
+	config, err := writeJSON(ctx, pvd.store, ocispec.Image{Platform: ocispec.Platform{OS: "linux", Architecture: "amd64"}}, ocispec.MediaTypeImageConfig)
+	require.NoError(t, err)
+	manifest, err := writeJSON(ctx, pvd.store, ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    *config,
+		Layers: []ocispec.Descriptor{
+			{MediaType: utils.MediaTypeNydusBlob, Digest: mediaBlob, Size: mediaInfo.Size},
+			*textBlob,
+			*bootstrap,
+		},
+	}, ocispec.MediaTypeImageManifest)
+	require.NoError(t, err)
+	require.NoError(t, pvd.Push(ctx, *manifest, registry.host+"/target:latest"))
+
+	_, data, ok := registry.Tag("target", "latest")
+	require.True(t, ok)
+	var pushed ocispec.Manifest
+	require.NoError(t, json.Unmarshal(data, &pushed))
+	require.Len(t, pushed.Layers, 3)
+	// The nydus layers are sorted on pushing, and the blob built by the
+	// driver isn't annotated.
+	for _, layer := range pushed.Layers {
+		if layer.Digest == mediaBlob {
+			require.Equal(t, "none", layer.Annotations[annotationBlobCompressor])
+		} else {
+			require.Empty(t, layer.Annotations[annotationBlobCompressor])
+		}
+	}
+}
+
+func TestLayerCompressors(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	registry := newPushableRegistry(t)
+	source := registry.host + "/source:latest"
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+	media := writeTarLayer(t, ctx, pvd.store, map[string]string{"media.mp4": randomString(t, 1<<20)})
+	lib := writeTarLayer(t, ctx, pvd.store, map[string]string{"lib.so": strings.Repeat("nydus", 1<<18)})
+	text := writeTarLayer(t, ctx, pvd.store, map[string]string{"app.log": strings.Repeat("nydus", 1<<17)})
+	pushLayersImage(t, ctx, pvd, source, []ocispec.Descriptor{media, lib, text})
+
+	pvd = newPlatformProvider(t, platforms.All, "", "")
+	for _, overrides := range []map[string]string{
+		{"0": "gzip"},
+		{"-1": "none"},
+		{"layer": "none"},
+	} {
+		require.Error(t, pvd.SetLayerCompressors(converter.PackOption{Compressor: "zstd"}, overrides))
+	}
+	require.NoError(t, pvd.SetLayerCompressors(converter.PackOption{Compressor: "zstd"}, map[string]string{
+		"0":                 "none",
+		lib.Digest.String(): "lz4_block",
+		// The override of the global compressor is left to the driver.
+		"2": "zstd",
+	}))
+	var built sync.Map
+	pvd.layerCompressors.build = fakeLayerBuild(&built)
+	require.NoError(t, pvd.Pull(ctx, source))
+
+	compressor, ok := built.Load(media.Digest)
+	require.True(t, ok)
+	require.Equal(t, "none", compressor)
+	compressor, ok = built.Load(lib.Digest)
+	require.True(t, ok)
+	require.Equal(t, "lz4_block", compressor)
+	_, ok = built.Load(text.Digest)
+	require.False(t, ok)
+
+	var blobs []ocispec.Descriptor
+	for _, layer := range []ocispec.Descriptor{media, lib} {
+		info, err := pvd.ContentStore().Info(ctx, layer.Digest)
+		require.NoError(t, err)
+		blob := digest.Digest(info.Labels[converter.LayerAnnotationNydusTargetDigest])
+		require.NoError(t, blob.Validate())
+		blobInfo, err := pvd.ContentStore().Info(ctx, blob)
+		require.NoError(t, err)
+		blobs = append(blobs, ocispec.Descriptor{MediaType: utils.MediaTypeNydusBlob, Digest: blob, Size: blobInfo.Size})
+	}
+	textBlob, err := writeJSON(ctx, pvd.store, map[string]string{"blob": "text"}, utils.MediaTypeNydusBlob)
+	require.NoError(t, err)
+	bootstrap, err := writeJSON(ctx, pvd.store, map[string]string{"bootstrap": "data"}, ocispec.MediaTypeImageLayerGzip)
+	require.NoError(t, err)
+	bootstrap.Annotations = map[string]string{utils.LayerAnnotationNydusBootstrap: "true"}
+	config, err := writeJSON(ctx, pvd.store, ocispec.Image{Platform: ocispec.Platform{OS: "linux", Architecture: "amd64"}}, ocispec.MediaTypeImageConfig)
+	require.NoError(t, err)
+	manifest, err := writeJSON(ctx, pvd.store, ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    *config,
+		Layers:    append(blobs, *textBlob, *bootstrap),
+	}, ocispec.MediaTypeImageManifest)
+	require.NoError(t, err)
+	require.NoError(t, pvd.Push(ctx, *manifest, registry.host+"/target:latest"))
+
+	_, data, ok := registry.Tag("target", "latest")
+	require.True(t, ok)
+	var pushed ocispec.Manifest
+	require.NoError(t, json.Unmarshal(data, &pushed))
+	require.Len(t, pushed.Layers, 4)
+	// The media type of nydus blob doesn't vary with the compressor, which
+	// is annotated instead.
+	for _, layer := range pushed.Layers[:3] {
+		require.Equal(t, utils.MediaTypeNydusBlob, layer.MediaType)
+	}
+	compressors := map[digest.Digest]string{}
+	for _, layer := range pushed.Layers {
+		compressors[layer.Digest] = layer.Annotations[annotationBlobCompressor]
+	}
+	require.Equal(t, "none", compressors[blobs[0].Digest])
+	require.Equal(t, "lz4_block", compressors[blobs[1].Digest])
+	require.Empty(t, compressors[textBlob.Digest])
+	require.Empty(t, compressors[bootstrap.Digest])
+}
+
+func TestAutoCompressorConvert(t *testing.T) {
+	builderPath, err := exec.LookPath("nydus-image")
+	if err != nil {
+		t.Skip("nydus-image binary isn't found")
+	}
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	registry := newPushableRegistry(t)
+	source := registry.host + "/source:latest"
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+	media := writeTarLayer(t, ctx, pvd.store, map[string]string{"media.mp4": randomString(t, 1<<20)})
+	text := writeTarLayer(t, ctx, pvd.store, map[string]string{"app.log": strings.Repeat("nydus", 1<<18)})
+	pushLayersImage(t, ctx, pvd, source, []ocispec.Descriptor{media, text})
+
+	pvd = newPlatformProvider(t, platforms.All, "", "")
+	pvd.SetAutoCompressor(converter.PackOption{WorkDir: t.TempDir(), BuilderPath: builderPath, FsVersion: "6", Compressor: "zstd"})
+	convertLayersImage(t, ctx, pvd, builderPath, source, registry.host+"/target:latest")
+
+	_, data, ok := registry.Tag("target", "latest")
+	require.True(t, ok)
+	var pushed ocispec.Manifest
+	require.NoError(t, json.Unmarshal(data, &pushed))
+	// The bootstrap is merged from the blobs of mixed compressors.
+	require.Len(t, pushed.Layers, 3)
+	require.Equal(t, "none", pushed.Layers[0].Annotations[annotationBlobCompressor])
+	require.Empty(t, pushed.Layers[1].Annotations[annotationBlobCompressor])
+	require.Equal(t, "true", pushed.Layers[2].Annotations[utils.LayerAnnotationNydusBootstrap])
+}
+
+func TestLayerCompressorsConvert(t *testing.T) {
+	builderPath, err := exec.LookPath("nydus-image")
+	if err != nil {
+		t.Skip("nydus-image binary isn't found")
+	}
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	registry := newPushableRegistry(t)
+	source := registry.host + "/source:latest"
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+	media := writeTarLayer(t, ctx, pvd.store, map[string]string{"media.mp4": randomString(t, 1<<20)})
+	lib := writeTarLayer(t, ctx, pvd.store, map[string]string{"lib.so": strings.Repeat("nydus", 1<<18)})
+	text := writeTarLayer(t, ctx, pvd.store, map[string]string{"app.log": strings.Repeat("nydus", 1<<17)})
+	pushLayersImage(t, ctx, pvd, source, []ocispec.Descriptor{media, lib, text})
+
+	pvd = newPlatformProvider(t, platforms.All, "", "")
+	require.NoError(t, pvd.SetLayerCompressors(converter.PackOption{WorkDir: t.TempDir(), BuilderPath: builderPath, FsVersion: "6", Compressor: "zstd"}, map[string]string{
+		"0":                 "none",
+		lib.Digest.String(): "lz4_block",
+	}))
+	convertLayersImage(t, ctx, pvd, builderPath, source, registry.host+"/target:latest")
+
+	_, data, ok := registry.Tag("target", "latest")
+	require.True(t, ok)
+	var pushed ocispec.Manifest
+	require.NoError(t, json.Unmarshal(data, &pushed))
+	// The bootstrap is merged from the blobs of mixed compressors.
+	require.Len(t, pushed.Layers, 4)
+	for _, layer := range pushed.Layers[:3] {
+		require.Equal(t, utils.MediaTypeNydusBlob, layer.MediaType)
+	}
+	require.Equal(t, "none", pushed.Layers[0].Annotations[annotationBlobCompressor])
+	require.Equal(t, "lz4_block", pushed.Layers[1].Annotations[annotationBlobCompressor])
+	require.Empty(t, pushed.Layers[2].Annotations[annotationBlobCompressor])
+	require.Equal(t, "true", pushed.Layers[3].Annotations[utils.LayerAnnotationNydusBootstrap])
+}
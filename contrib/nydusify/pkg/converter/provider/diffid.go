@@ -0,0 +1,87 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/labels"
+	"github.com/containerd/log"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// SetSourceDiffIDs supplies the diff IDs of source layers by their digests,
+// which are known by the caller already. The source layers aren't
+// decompressed to compute the diff IDs in conversion, the diff IDs in the
+// source image config are used instead. The supplied diff IDs are verified
+// against the config on pulling, so that the source image not matching them
+// fails the conversion, and the layers are labeled with them in the content
+// store. The compressed digests of layers are verified on fetching.
+func (pvd *Provider) SetSourceDiffIDs(diffIDs map[digest.Digest]digest.Digest) {
+	pvd.sourceDiffIDs = diffIDs
+}
+
+// checkSourceDiffIDs verifies the supplied diff IDs of the source layers of
+// image desc pulled into store, see SetSourceDiffIDs.
+func (pvd *Provider) checkSourceDiffIDs(ctx context.Context, desc ocispec.Descriptor) error {
+	checked := map[digest.Digest]bool{}
+	handler := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		switch desc.MediaType {
+		case ocispec.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList:
+			return images.Children(ctx, pvd.store, desc)
+		case ocispec.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest:
+		default:
+			return nil, nil
+		}
+		var manifest ocispec.Manifest
+		if err := readJSON(ctx, pvd.store, desc, &manifest); err != nil {
+			return nil, errors.Wrapf(err, "read manifest %s", desc.Digest)
+		}
+		var config ocispec.Image
+		if err := readJSON(ctx, pvd.store, manifest.Config, &config); err != nil {
+			return nil, errors.Wrapf(err, "read config %s", manifest.Config.Digest)
+		}
+		if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+			return nil, errors.Errorf("mismatched diff IDs %d and layers %d of manifest %s", len(config.RootFS.DiffIDs), len(manifest.Layers), desc.Digest)
+		}
+		for idx, layer := range manifest.Layers {
+			diffID, ok := pvd.sourceDiffIDs[layer.Digest]
+			if !ok {
+				continue
+			}
+			if diffID != config.RootFS.DiffIDs[idx] {
+				return nil, errors.Errorf("mismatched diff ID of layer %s, supplied %s, but %s in config", layer.Digest, diffID, config.RootFS.DiffIDs[idx])
+			}
+			if checked[layer.Digest] {
+				continue
+			}
+			checked[layer.Digest] = true
+			// The foreign layers aren't fetched into store.
+			if images.IsNonDistributable(layer.MediaType) {
+				continue
+			}
+			if _, err := pvd.store.Update(ctx, content.Info{
+				Digest: layer.Digest,
+				Labels: map[string]string{labels.LabelUncompressed: diffID.String()},
+			}, "labels."+labels.LabelUncompressed); err != nil {
+				return nil, errors.Wrapf(err, "label diff ID of layer %s", layer.Digest)
+			}
+		}
+		return nil, nil
+	})
+	if err := images.Walk(ctx, images.FilterPlatforms(handler, pvd.platformMC), desc); err != nil {
+		return err
+	}
+	for layer := range pvd.sourceDiffIDs {
+		if !checked[layer] {
+			log.G(ctx).Warnf("layer %s of supplied diff ID isn't found in source image", layer)
+		}
+	}
+	return nil
+}
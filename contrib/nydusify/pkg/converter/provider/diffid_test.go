@@ -0,0 +1,41 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"testing"
+
+	"github.com/containerd/containerd/labels"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPullSourceDiffIDs(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	registry := newPushableRegistry(t)
+	source := registry.host + "/source:latest"
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+	lower := writeTarLayer(t, ctx, pvd.store, map[string]string{"etc/hostname": "h"})
+	upper := writeTarLayer(t, ctx, pvd.store, map[string]string{"etc/hosts": "h"})
+	// The diff IDs of image are derived from the layer digests.
+	pushLayersImage(t, ctx, pvd, source, []ocispec.Descriptor{lower, upper})
+	lowerDiffID := digest.FromString(lower.Digest.String())
+
+	pvd = newPlatformProvider(t, platforms.All, "", "")
+	pvd.SetSourceDiffIDs(map[digest.Digest]digest.Digest{lower.Digest: lowerDiffID})
+	require.NoError(t, pvd.Pull(ctx, source))
+	info, err := pvd.ContentStore().Info(ctx, lower.Digest)
+	require.NoError(t, err)
+	require.Equal(t, lowerDiffID.String(), info.Labels[labels.LabelUncompressed])
+
+	// The supplied diff ID not matching the config fails the pulling.
+	pvd = newPlatformProvider(t, platforms.All, "", "")
+	pvd.SetSourceDiffIDs(map[digest.Digest]digest.Digest{upper.Digest: lowerDiffID})
+	require.ErrorContains(t, pvd.Pull(ctx, source), "mismatched diff ID of layer "+upper.Digest.String())
+}
@@ -0,0 +1,172 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	// Register sha512 for go-digest.
+	_ "crypto/sha512"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+// ParseDigestAlgorithm parses the digest algorithm of target image: sha256
+// or sha512, empty means sha256.
+func ParseDigestAlgorithm(name string) (digest.Algorithm, error) {
+	switch name {
+	case "", string(digest.SHA256):
+		return digest.SHA256, nil
+	case string(digest.SHA512):
+		return digest.SHA512, nil
+	}
+	return "", fmt.Errorf("unsupported digest algorithm %s, possible values: sha256, sha512", name)
+}
+
+// SetDigestAlgorithm sets the digest algorithm of the index, manifests,
+// configs and bootstrap layers in target image. The nydus blobs are always
+// digested by sha256, since the blob id recorded in bootstrap is the sha256
+// hex of blob, which is required by nydusd to locate the blob.
+func (pvd *Provider) SetDigestAlgorithm(algorithm digest.Algorithm) {
+	pvd.digestAlgorithm = algorithm
+	if algorithm != digest.Canonical {
+		if _, ok := pvd.store.(*aliasStore); !ok {
+			pvd.store = &aliasStore{Store: pvd.store, aliases: map[digest.Digest]digest.Digest{}}
+		}
+	}
+}
+
+// aliasStore refers the content by the digest of non-canonical algorithm,
+// the content store of containerd only accepts the content digested by
+// sha256, so the content is stored by its sha256 digest and aliased.
+type aliasStore struct {
+	content.Store
+	mutex   sync.RWMutex
+	aliases map[digest.Digest]digest.Digest
+}
+
+func (store *aliasStore) resolve(dgst digest.Digest) digest.Digest {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	if canonical, ok := store.aliases[dgst]; ok {
+		return canonical
+	}
+	return dgst
+}
+
+func (store *aliasStore) alias(dgst, canonical digest.Digest) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.aliases[dgst] = canonical
+}
+
+func (store *aliasStore) Info(ctx context.Context, dgst digest.Digest) (content.Info, error) {
+	info, err := store.Store.Info(ctx, store.resolve(dgst))
+	if err != nil {
+		return info, err
+	}
+	info.Digest = dgst
+	return info, nil
+}
+
+func (store *aliasStore) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	desc.Digest = store.resolve(desc.Digest)
+	return store.Store.ReaderAt(ctx, desc)
+}
+
+func writeJSONDigest(ctx context.Context, store *aliasStore, obj interface{}, mediaType string, algorithm digest.Algorithm) (*ocispec.Descriptor, error) {
+	desc, err := writeJSON(ctx, store, obj, mediaType)
+	if err != nil {
+		return nil, err
+	}
+	return redigestBlob(ctx, store, *desc, algorithm)
+}
+
+// redigestBlob refers the blob in content store by the digest of algorithm,
+// the other fields of descriptor are kept.
+func redigestBlob(ctx context.Context, store *aliasStore, desc ocispec.Descriptor, algorithm digest.Algorithm) (*ocispec.Descriptor, error) {
+	if desc.Digest.Algorithm() == algorithm {
+		return &desc, nil
+	}
+	ra, err := store.ReaderAt(ctx, desc)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open %s", desc.Digest)
+	}
+	defer ra.Close()
+
+	digester := algorithm.Digester()
+	if _, err := io.Copy(digester.Hash(), content.NewReader(ra)); err != nil {
+		return nil, errors.Wrapf(err, "digest %s", desc.Digest)
+	}
+	newDesc := desc
+	newDesc.Digest = digester.Digest()
+	store.alias(newDesc.Digest, store.resolve(desc.Digest))
+	return &newDesc, nil
+}
+
+// redigest rewrites the index, manifests, configs and bootstrap layers of
+// image with the digest of algorithm, the other layers are referred as is.
+func redigest(ctx context.Context, store *aliasStore, desc ocispec.Descriptor, algorithm digest.Algorithm) (*ocispec.Descriptor, error) {
+	var newDesc *ocispec.Descriptor
+
+	switch desc.MediaType {
+	case ocispec.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList:
+		var index ocispec.Index
+		if err := readJSON(ctx, store, desc, &index); err != nil {
+			return nil, errors.Wrap(err, "read image index")
+		}
+		for idx, manifest := range index.Manifests {
+			manifestDesc, err := redigest(ctx, store, manifest, algorithm)
+			if err != nil {
+				return nil, err
+			}
+			index.Manifests[idx] = *manifestDesc
+		}
+		indexDesc, err := writeJSONDigest(ctx, store, index, desc.MediaType, algorithm)
+		if err != nil {
+			return nil, errors.Wrap(err, "write image index")
+		}
+		newDesc = indexDesc
+	case ocispec.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest:
+		var manifest ocispec.Manifest
+		if err := readJSON(ctx, store, desc, &manifest); err != nil {
+			return nil, errors.Wrap(err, "read manifest")
+		}
+		configDesc, err := redigestBlob(ctx, store, manifest.Config, algorithm)
+		if err != nil {
+			return nil, errors.Wrap(err, "redigest image config")
+		}
+		manifest.Config = *configDesc
+		for idx, layer := range manifest.Layers {
+			if layer.Annotations[utils.LayerAnnotationNydusBootstrap] != "true" {
+				continue
+			}
+			layerDesc, err := redigestBlob(ctx, store, layer, algorithm)
+			if err != nil {
+				return nil, errors.Wrap(err, "redigest bootstrap layer")
+			}
+			manifest.Layers[idx] = *layerDesc
+		}
+		manifestDesc, err := writeJSONDigest(ctx, store, manifest, desc.MediaType, algorithm)
+		if err != nil {
+			return nil, errors.Wrap(err, "write manifest")
+		}
+		newDesc = manifestDesc
+	default:
+		return nil, fmt.Errorf("unsupported media type %s", desc.MediaType)
+	}
+
+	newDesc.Annotations = desc.Annotations
+	newDesc.Platform = desc.Platform
+	return newDesc, nil
+}
@@ -0,0 +1,67 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDigestAlgorithm(t *testing.T) {
+	algorithm, err := ParseDigestAlgorithm("")
+	require.NoError(t, err)
+	require.Equal(t, digest.SHA256, algorithm)
+
+	algorithm, err = ParseDigestAlgorithm("sha512")
+	require.NoError(t, err)
+	require.Equal(t, digest.SHA512, algorithm)
+	require.True(t, algorithm.Available())
+
+	_, err = ParseDigestAlgorithm("md5")
+	require.Error(t, err)
+}
+
+func TestPushDigestAlgorithm(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+	pvd.SetDigestAlgorithm(digest.SHA512)
+	manifest, blob, bootstrap := writeNydusImage(t, ctx, pvd)
+
+	registry := newPushableRegistry(t)
+	registry.Override(digestManifests(registry, digest.SHA512))
+	ref := registry.host + "/sha512:latest"
+	require.NoError(t, pvd.Push(ctx, manifest, ref))
+
+	dgst, data, ok := registry.Tag("sha512", "latest")
+	require.True(t, ok)
+	require.Equal(t, digest.SHA512, dgst.Algorithm())
+	require.Equal(t, digest.SHA512.FromBytes(data), dgst)
+	image, err := pvd.Image(ctx, ref)
+	require.NoError(t, err)
+	require.Equal(t, dgst, image.Digest)
+
+	var pushed ocispec.Manifest
+	require.NoError(t, json.Unmarshal(data, &pushed))
+	require.Equal(t, digest.SHA512, pushed.Config.Digest.Algorithm())
+	require.Len(t, pushed.Layers, 2)
+	// The nydus blob is kept as sha256, which is the blob id in bootstrap.
+	require.Equal(t, blob.Digest, pushed.Layers[0].Digest)
+	require.Equal(t, digest.SHA512, pushed.Layers[1].Digest.Algorithm())
+	require.Equal(t, bootstrap.Annotations, pushed.Layers[1].Annotations)
+
+	for _, desc := range append([]ocispec.Descriptor{pushed.Config}, pushed.Layers...) {
+		data, ok := registry.Blob(desc.Digest)
+		require.True(t, ok)
+		require.Equal(t, desc.Digest, desc.Digest.Algorithm().FromBytes(data))
+		require.Equal(t, desc.Size, int64(len(data)))
+	}
+}
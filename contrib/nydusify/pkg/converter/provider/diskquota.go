@@ -0,0 +1,254 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/log"
+	humanize "github.com/dustin/go-humanize"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// ErrDiskQuotaExceeded is returned by the content writing which would make
+// the disk usage of work directory exceed the limit of SetMaxDiskUsage.
+var ErrDiskQuotaExceeded = errors.New("disk quota exceeded")
+
+// diskQuota tracks the disk usage of directories, which is measured on
+// opening and closing each content writer, and increased by the writes in
+// between. The size of content writer is reserved on opening if it's known.
+// The directories are walked without the mutex held, so that the writes in
+// progress aren't blocked by the walking.
+type diskQuota struct {
+	mutex    sync.Mutex
+	cond     *sync.Cond
+	limit    int64
+	dirs     []string
+	usage    int64
+	reserved int64
+	inflight int
+	peak     int64
+}
+
+func newDiskQuota(limit int64, dirs []string) *diskQuota {
+	quota := &diskQuota{limit: limit}
+	quota.cond = sync.NewCond(&quota.mutex)
+	// The nested directories are measured by their ancestors.
+	for _, dir := range dirs {
+		nested := false
+		for _, other := range dirs {
+			if other != dir && strings.HasPrefix(filepath.Clean(dir), filepath.Clean(other)+string(filepath.Separator)) {
+				nested = true
+				break
+			}
+		}
+		if !nested {
+			quota.dirs = append(quota.dirs, dir)
+		}
+	}
+	return quota
+}
+
+// walk walks the directories to measure the disk usage, the files written
+// by others, e.g. the temporary files of builder, are measured as well.
+func (quota *diskQuota) walk() int64 {
+	usage := int64(0)
+	for _, dir := range quota.dirs {
+		_ = filepath.WalkDir(dir, func(_ string, entry fs.DirEntry, err error) error {
+			// The files may be removed during walking.
+			if err != nil || !entry.Type().IsRegular() {
+				return nil
+			}
+			if info, err := entry.Info(); err == nil {
+				usage += info.Size()
+			}
+			return nil
+		})
+	}
+	return usage
+}
+
+// setUsage updates the disk usage measured by walk, the caller must hold the
+// mutex.
+func (quota *diskQuota) setUsage(usage int64) {
+	quota.usage = usage
+	quota.updatePeak()
+}
+
+func (quota *diskQuota) updatePeak() {
+	if quota.usage > quota.peak {
+		quota.peak = quota.usage
+	}
+}
+
+func (quota *diskQuota) exceeded(size int64) error {
+	return errors.Wrapf(ErrDiskQuotaExceeded, "disk usage %s with %s reserved would exceed the limit %s by writing %s",
+		humanize.IBytes(uint64(quota.usage)), humanize.IBytes(uint64(quota.reserved)),
+		humanize.IBytes(uint64(quota.limit)), humanize.IBytes(uint64(size)))
+}
+
+// reserve reserves size for a new writer, it waits for the in-flight writers
+// if there is no room, as the aborted writers and the builder may free the
+// disk, and fails once there is no in-flight writer or ctx is done.
+func (quota *diskQuota) reserve(ctx context.Context, ref string, size int64) error {
+	// Wake up the waiting below once ctx is done, the mutex is held so that
+	// the wakeup isn't lost between checking ctx and waiting.
+	stop := context.AfterFunc(ctx, func() {
+		quota.mutex.Lock()
+		defer quota.mutex.Unlock()
+		quota.cond.Broadcast()
+	})
+	defer stop()
+
+	usage := quota.walk()
+	quota.mutex.Lock()
+	defer quota.mutex.Unlock()
+	quota.setUsage(usage)
+	for quota.usage+quota.reserved+size > quota.limit {
+		if quota.inflight == 0 {
+			return quota.exceeded(size)
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		log.G(ctx).Debugf("pause writing %s to wait for disk usage under the limit %s", ref, humanize.IBytes(uint64(quota.limit)))
+		quota.cond.Wait()
+	}
+	quota.reserved += size
+	quota.inflight++
+	return nil
+}
+
+// write accounts the n bytes to write by a writer with remaining reserved
+// bytes, it returns the reserved bytes left.
+func (quota *diskQuota) write(n, remaining int64) (int64, error) {
+	quota.mutex.Lock()
+	defer quota.mutex.Unlock()
+	consumed := n
+	if consumed > remaining {
+		consumed = remaining
+	}
+	if quota.usage+quota.reserved+n-consumed > quota.limit {
+		return remaining, quota.exceeded(n)
+	}
+	quota.reserved -= consumed
+	quota.usage += n
+	quota.updatePeak()
+	return remaining - consumed, nil
+}
+
+func (quota *diskQuota) release(remaining int64) {
+	usage := quota.walk()
+	quota.mutex.Lock()
+	defer quota.mutex.Unlock()
+	quota.reserved -= remaining
+	quota.inflight--
+	quota.setUsage(usage)
+	quota.cond.Broadcast()
+}
+
+// SetMaxDiskUsage limits the disk usage of dirs, which are usually the work
+// directory and content directory, to limit bytes, zero means no limitation.
+// The content writing, e.g. pulling a source layer or storing a built blob,
+// is paused while other writings are in progress and the limit would be
+// exceeded, and fails with ErrDiskQuotaExceeded if nothing is in progress.
+func (pvd *Provider) SetMaxDiskUsage(limit int64, dirs ...string) {
+	if limit <= 0 {
+		return
+	}
+	pvd.diskQuota = newDiskQuota(limit, dirs)
+	pvd.wrapStore(func(store content.Store) content.Store {
+		return &diskQuotaStore{Store: store, quota: pvd.diskQuota}
+	})
+}
+
+// PeakDiskUsage returns the peak disk usage observed in the directories
+// limited by SetMaxDiskUsage.
+func (pvd *Provider) PeakDiskUsage() int64 {
+	if pvd.diskQuota == nil {
+		return 0
+	}
+	pvd.diskQuota.mutex.Lock()
+	defer pvd.diskQuota.mutex.Unlock()
+	return pvd.diskQuota.peak
+}
+
+type diskQuotaStore struct {
+	content.Store
+	quota *diskQuota
+}
+
+func (store *diskQuotaStore) Writer(ctx context.Context, opts ...content.WriterOpt) (content.Writer, error) {
+	var wopts content.WriterOpts
+	for _, opt := range opts {
+		if err := opt(&wopts); err != nil {
+			return nil, err
+		}
+	}
+	size := int64(0)
+	if wopts.Desc.Size > 0 {
+		size = wopts.Desc.Size
+	}
+	if err := store.quota.reserve(ctx, wopts.Ref, size); err != nil {
+		return nil, err
+	}
+	writer, err := store.Store.Writer(ctx, opts...)
+	if err != nil {
+		store.quota.release(size)
+		return nil, err
+	}
+	return &diskQuotaWriter{Writer: writer, ctx: ctx, store: store.Store, ref: wopts.Ref, quota: store.quota, remaining: size}, nil
+}
+
+type diskQuotaWriter struct {
+	content.Writer
+	ctx       context.Context
+	store     content.Store
+	ref       string
+	quota     *diskQuota
+	remaining int64
+	exceeded  bool
+	once      sync.Once
+}
+
+func (writer *diskQuotaWriter) Write(p []byte) (int, error) {
+	remaining, err := writer.quota.write(int64(len(p)), writer.remaining)
+	if err != nil {
+		writer.exceeded = true
+		return 0, err
+	}
+	writer.remaining = remaining
+	return writer.Writer.Write(p)
+}
+
+func (writer *diskQuotaWriter) Commit(ctx context.Context, size int64, expected digest.Digest, opts ...content.Opt) error {
+	defer writer.release()
+	return writer.Writer.Commit(ctx, size, expected, opts...)
+}
+
+func (writer *diskQuotaWriter) Close() error {
+	defer writer.release()
+	err := writer.Writer.Close()
+	// The partial ingest is removed to free the disk, since the writing
+	// isn't resumable without room.
+	if writer.exceeded {
+		if abortErr := writer.store.Abort(writer.ctx, writer.ref); abortErr != nil {
+			log.G(writer.ctx).Debugf("abort ingest %s: %s", writer.ref, abortErr)
+		}
+	}
+	return err
+}
+
+func (writer *diskQuotaWriter) release() {
+	writer.once.Do(func() {
+		writer.quota.release(writer.remaining)
+	})
+}
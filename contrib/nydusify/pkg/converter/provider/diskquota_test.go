@@ -0,0 +1,123 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/goharbor/acceleration-service/pkg/remote"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func diskUsage(dir string) int64 {
+	return newDiskQuota(0, []string{dir}).walk()
+}
+
+func TestMaxDiskUsage(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+
+	const layerSize = 1 << 20
+	registry := newPushableRegistry(t)
+	configData, err := json.Marshal(ocispec.Image{Platform: ocispec.Platform{OS: "linux", Architecture: "amd64"}})
+	require.NoError(t, err)
+	var layers []ocispec.Descriptor
+	for i := 0; i < 3; i++ {
+		data := make([]byte, layerSize)
+		_, err := rand.Read(data)
+		require.NoError(t, err)
+		layers = append(layers, registry.AddBlob(ocispec.MediaTypeImageLayer, data))
+	}
+	manifestData, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    registry.AddBlob(ocispec.MediaTypeImageConfig, configData),
+		Layers:    layers,
+	})
+	require.NoError(t, err)
+	registry.SetTag("library/large", "latest", registry.AddBlob(ocispec.MediaTypeImageManifest, manifestData).Digest)
+	ref := registry.host + "/library/large:latest"
+
+	hosts := func(string) (remote.CredentialFunc, bool, error) {
+		return func(string) (string, string, error) { return "", "", nil }, false, nil
+	}
+	newProvider := func(root string) *Provider {
+		pvd, err := New(root, hosts, 200, "v1", platforms.All, 0)
+		require.NoError(t, err)
+		pvd.UsePlainHTTP()
+		return pvd
+	}
+
+	// Only two of the layers fit in the limit, the third one is paused
+	// until the others complete, and then fails without exceeding.
+	root := t.TempDir()
+	pvd := newProvider(root)
+	limit := diskUsage(root) + layerSize*5/2
+	pvd.SetMaxDiskUsage(limit, root)
+	err = pvd.Pull(ctx, ref)
+	require.ErrorIs(t, err, ErrDiskQuotaExceeded)
+	require.LessOrEqual(t, pvd.PeakDiskUsage(), limit)
+	require.GreaterOrEqual(t, pvd.PeakDiskUsage(), int64(layerSize*2))
+	require.LessOrEqual(t, diskUsage(root), limit)
+
+	// All the layers are pulled within a sufficient limit.
+	root = t.TempDir()
+	pvd = newProvider(root)
+	limit = diskUsage(root) + layerSize*4
+	pvd.SetMaxDiskUsage(limit, root)
+	require.NoError(t, pvd.Pull(ctx, ref))
+	require.LessOrEqual(t, pvd.PeakDiskUsage(), limit)
+	require.GreaterOrEqual(t, pvd.PeakDiskUsage(), int64(layerSize*3))
+}
+
+func TestDiskQuotaMeasuresOtherFiles(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	quota := newDiskQuota(100, []string{dir})
+
+	// The temporary files written by builder take the room of quota.
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "nydus-converter-1"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "nydus-converter-1", "blob"), make([]byte, 80), 0644))
+	require.ErrorIs(t, quota.reserve(ctx, "layer", 30), ErrDiskQuotaExceeded)
+	require.NoError(t, quota.reserve(ctx, "layer", 10))
+	require.Equal(t, int64(80), quota.usage)
+
+	require.NoError(t, os.RemoveAll(filepath.Join(dir, "nydus-converter-1")))
+	quota.release(10)
+	require.Equal(t, int64(0), quota.usage)
+	require.Equal(t, int64(80), quota.peak)
+}
+
+func TestDiskQuotaReserveCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	quota := newDiskQuota(100, []string{t.TempDir()})
+	require.NoError(t, quota.reserve(ctx, "lower", 80))
+
+	// The reservation waiting for the in-flight writer returns once ctx is
+	// canceled.
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- quota.reserve(ctx, "upper", 30)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-errCh:
+		require.ErrorIs(t, err, context.Canceled)
+	case <-time.After(5 * time.Second):
+		t.Fatal("reservation isn't woken up by the canceled context")
+	}
+	require.Equal(t, int64(80), quota.reserved)
+	require.Equal(t, 1, quota.inflight)
+}
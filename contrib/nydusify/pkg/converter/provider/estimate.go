@@ -0,0 +1,368 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/containerd/containerd/archive/compression"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// The on-disk sizes used to estimate the nydus blob and bootstrap, they
+// follow the RAFS layouts of `nydus-image`, but the alignments and the
+// optional tables are approximated.
+const (
+	defaultEstimateChunkSize = 0x100000
+
+	// blobMetaHeaderSize is the size of blob meta header in blob tail.
+	blobMetaHeaderSize = 4096
+	// blobChunkMetaSize is the size of chunk info and chunk digest of each
+	// chunk in blob meta.
+	blobChunkMetaSize = 16 + 32
+	// blobTarSize is the size of the tar headers of blob data, blob meta,
+	// chunk digests and blob TOC in a nydus blob layer, and the TOC itself.
+	blobTarSize = 4*512 + 4*128
+
+	// rafsV5SuperBlockSize is the size of RAFS v5 super block and tables.
+	rafsV5SuperBlockSize = 8192
+	// rafsV5InodeSize is the size of RAFS v5 inode and its inode table entry.
+	rafsV5InodeSize = 128 + 4
+	// rafsV5ChunkSize is the size of RAFS v5 chunk info.
+	rafsV5ChunkSize = 80
+	// rafsV6SuperBlockSize is the size of RAFS v6 super block and tables.
+	rafsV6SuperBlockSize = 4096 + 1024
+	// rafsV6InodeSize is the size of RAFS v6 extended inode and its dirent.
+	rafsV6InodeSize = 64 + 12
+	// rafsV6DirSize is the average padding of directory block in RAFS v6.
+	rafsV6DirSize = 4096 / 2
+	// rafsV6ChunkSize is the size of RAFS v6 chunk index and the chunk
+	// info in chunk table.
+	rafsV6ChunkSize = 8 + 80
+	// rafsBlobSize is the size of each blob in blob table.
+	rafsBlobSize = 256
+)
+
+// EstimateOption is the build options affecting the size of nydus image.
+type EstimateOption struct {
+	// FsVersion is the RAFS version: 5 or 6, empty means 6.
+	FsVersion string
+	// Compressor compresses the chunks in blob: none, zstd, lz4_block or
+	// auto, empty means zstd. The lz4_block is approximated by the fastest
+	// zstd, as lz4 isn't available without building. The auto is estimated
+	// as zstd, which stores the incompressible chunks as is as well.
+	Compressor string
+	// ChunkSize is the size of chunks in blob, 0 means 1MiB.
+	ChunkSize int64
+}
+
+// LayerEstimate is the estimated nydus blob of a source layer.
+type LayerEstimate struct {
+	Digest digest.Digest `json:"digest"`
+	// Size is the size of source layer.
+	Size int64 `json:"size"`
+	// DataSize is the uncompressed size of the regular files in layer.
+	DataSize int64 `json:"data_size"`
+	// BlobSize is 0 for the layer without file data, nydus doesn't build
+	// blob for such layer.
+	BlobSize int64 `json:"blob_size"`
+}
+
+// SizeEstimate is the estimated size of the nydus manifest converted from a
+// source manifest.
+type SizeEstimate struct {
+	Digest        digest.Digest   `json:"digest"`
+	Platform      string          `json:"platform,omitempty"`
+	Layers        []LayerEstimate `json:"layers"`
+	SourceSize    int64           `json:"source_size"`
+	BlobSize      int64           `json:"blob_size"`
+	BootstrapSize int64           `json:"bootstrap_size"`
+	// Size is the total size of blobs and bootstrap.
+	Size int64 `json:"size"`
+}
+
+// estimateEntry is an inode in the merged filesystem of source layers.
+type estimateEntry struct {
+	dir    bool
+	chunks int64
+	// inline is the size of the data stored in bootstrap, e.g. the symlink
+	// target.
+	inline int64
+}
+
+// chunkEstimator estimates the compressed size of chunks.
+type chunkEstimator struct {
+	encoder *zstd.Encoder
+	buf     []byte
+}
+
+func newChunkEstimator(compressor string) (*chunkEstimator, error) {
+	var level zstd.EncoderLevel
+	switch compressor {
+	case "none":
+		return &chunkEstimator{}, nil
+	case "", "zstd", CompressorAuto:
+		level = zstd.SpeedDefault
+	case "lz4_block":
+		level = zstd.SpeedFastest
+	default:
+		return nil, fmt.Errorf("unsupported compressor %s to estimate, possible values: none, zstd, lz4_block, auto", compressor)
+	}
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(level), zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return &chunkEstimator{encoder: encoder}, nil
+}
+
+// size returns the size of chunk stored in blob, the chunk is stored as is
+// if compression doesn't make it smaller.
+func (estimator *chunkEstimator) size(chunk []byte) int64 {
+	if estimator.encoder == nil {
+		return int64(len(chunk))
+	}
+	estimator.buf = estimator.encoder.EncodeAll(chunk, estimator.buf[:0])
+	if len(estimator.buf) < len(chunk) {
+		return int64(len(estimator.buf))
+	}
+	return int64(len(chunk))
+}
+
+func (estimator *chunkEstimator) close() {
+	if estimator.encoder != nil {
+		estimator.encoder.Close()
+	}
+}
+
+// addEntry adds the entry and its missing parent directories into entries.
+func addEntry(entries map[string]*estimateEntry, name string, entry *estimateEntry) {
+	entries[name] = entry
+	for dir := path.Dir(name); ; dir = path.Dir(dir) {
+		if _, ok := entries[dir]; ok {
+			break
+		}
+		entries[dir] = &estimateEntry{dir: true}
+		if dir == "/" {
+			break
+		}
+	}
+}
+
+// removeEntries removes the entry at name and the entries below name, the
+// entry at name is kept for opaque whiteout.
+func removeEntries(entries map[string]*estimateEntry, name string, opaque bool) {
+	if !opaque {
+		delete(entries, name)
+	}
+	prefix := strings.TrimSuffix(name, "/") + "/"
+	for entryPath := range entries {
+		if strings.HasPrefix(entryPath, prefix) {
+			delete(entries, entryPath)
+		}
+	}
+}
+
+// estimateLayer estimates the nydus blob of the layer in the uncompressed
+// tar stream, the chunks are deduplicated within the layer as `nydus-image`
+// does, and the entries of layer are merged into entries.
+func estimateLayer(reader io.Reader, opt EstimateOption, estimator *chunkEstimator, entries map[string]*estimateEntry) (*LayerEstimate, error) {
+	chunkSize := opt.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultEstimateChunkSize
+	}
+	chunk := make([]byte, chunkSize)
+	chunks := map[digest.Digest]bool{}
+
+	var estimate LayerEstimate
+	// The whiteouts remove the entries of lower layers only, see
+	// scanLayerFiles.
+	var whiteouts, opaques []string
+	layerEntries := map[string]*estimateEntry{}
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := path.Clean("/" + hdr.Name)
+		dir, base := path.Split(name)
+		if base == ".wh..wh..opq" {
+			opaques = append(opaques, path.Clean(dir))
+			continue
+		}
+		if strings.HasPrefix(base, ".wh.") {
+			whiteouts = append(whiteouts, dir+strings.TrimPrefix(base, ".wh."))
+			continue
+		}
+
+		entry := &estimateEntry{dir: hdr.Typeflag == tar.TypeDir}
+		switch hdr.Typeflag {
+		case tar.TypeSymlink:
+			entry.inline = int64(len(hdr.Linkname))
+		case tar.TypeReg:
+			estimate.DataSize += hdr.Size
+			for {
+				n, err := io.ReadFull(tr, chunk)
+				if n > 0 {
+					entry.chunks++
+					dgst := digest.FromBytes(chunk[:n])
+					if !chunks[dgst] {
+						chunks[dgst] = true
+						estimate.BlobSize += estimator.size(chunk[:n])
+					}
+				}
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					break
+				}
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		layerEntries[name] = entry
+	}
+
+	for _, name := range opaques {
+		removeEntries(entries, name, true)
+	}
+	for _, name := range whiteouts {
+		removeEntries(entries, name, false)
+	}
+	for name, entry := range layerEntries {
+		if !entry.dir {
+			removeEntries(entries, name, false)
+		}
+		addEntry(entries, name, entry)
+	}
+
+	if len(chunks) > 0 {
+		estimate.BlobSize += blobMetaHeaderSize + int64(len(chunks))*blobChunkMetaSize + blobTarSize
+	}
+	return &estimate, nil
+}
+
+// estimateBootstrap estimates the size of bootstrap of the merged filesystem
+// entries referencing blobs.
+func estimateBootstrap(entries map[string]*estimateEntry, blobs int, fsVersion string) int64 {
+	var size int64
+	if fsVersion == "5" {
+		size = rafsV5SuperBlockSize
+		for name, entry := range entries {
+			// The name and symlink target are aligned to 8 bytes.
+			size += rafsV5InodeSize + (int64(len(path.Base(name)))+7)/8*8 + (entry.inline+7)/8*8
+			size += entry.chunks * rafsV5ChunkSize
+		}
+	} else {
+		size = rafsV6SuperBlockSize
+		for name, entry := range entries {
+			size += rafsV6InodeSize + int64(len(path.Base(name))) + entry.inline
+			size += entry.chunks * rafsV6ChunkSize
+			if entry.dir {
+				size += rafsV6DirSize
+			}
+		}
+	}
+	return size + int64(blobs)*rafsBlobSize
+}
+
+// estimateManifest estimates the nydus manifest converted from the source
+// manifest in store.
+func estimateManifest(ctx context.Context, store content.Store, desc ocispec.Descriptor, opt EstimateOption) (*SizeEstimate, error) {
+	var manifest ocispec.Manifest
+	if err := readJSON(ctx, store, desc, &manifest); err != nil {
+		return nil, errors.Wrap(err, "read manifest")
+	}
+	estimate := SizeEstimate{Digest: desc.Digest, Layers: []LayerEstimate{}}
+	if desc.Platform != nil {
+		estimate.Platform = platforms.Format(*desc.Platform)
+	} else {
+		var config ocispec.Image
+		if err := readJSON(ctx, store, manifest.Config, &config); err != nil {
+			return nil, errors.Wrap(err, "read image config")
+		}
+		if config.OS != "" {
+			estimate.Platform = platforms.Format(config.Platform)
+		}
+	}
+
+	estimator, err := newChunkEstimator(opt.Compressor)
+	if err != nil {
+		return nil, err
+	}
+	defer estimator.close()
+
+	blobs := 0
+	entries := map[string]*estimateEntry{"/": {dir: true}}
+	for _, layer := range manifest.Layers {
+		layerEstimate, err := func() (*LayerEstimate, error) {
+			ra, err := store.ReaderAt(ctx, layer)
+			if err != nil {
+				return nil, err
+			}
+			defer ra.Close()
+			reader, err := compression.DecompressStream(content.NewReader(ra))
+			if err != nil {
+				return nil, err
+			}
+			defer reader.Close()
+			return estimateLayer(reader, opt, estimator, entries)
+		}()
+		if err != nil {
+			return nil, errors.Wrapf(err, "estimate layer %s", layer.Digest)
+		}
+		layerEstimate.Digest = layer.Digest
+		layerEstimate.Size = layer.Size
+		if layerEstimate.BlobSize > 0 {
+			blobs++
+		}
+		estimate.Layers = append(estimate.Layers, *layerEstimate)
+		estimate.SourceSize += layer.Size
+		estimate.BlobSize += layerEstimate.BlobSize
+	}
+	estimate.BootstrapSize = estimateBootstrap(entries, blobs, opt.FsVersion)
+	estimate.Size = estimate.BlobSize + estimate.BootstrapSize
+
+	return &estimate, nil
+}
+
+// EstimateSize estimates the size of the nydus image converted from the
+// source image desc in content store without building, each manifest matched
+// by platform is estimated by compressing the chunks of its layers, while the
+// bootstrap is estimated from the merged filesystem. The source image should
+// be pulled before.
+func (pvd *Provider) EstimateSize(ctx context.Context, desc ocispec.Descriptor, opt EstimateOption) ([]SizeEstimate, error) {
+	var estimates []SizeEstimate
+	handler := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		switch desc.MediaType {
+		case ocispec.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList:
+			return images.Children(ctx, pvd.store, desc)
+		case ocispec.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest:
+			estimate, err := estimateManifest(ctx, pvd.store, desc, opt)
+			if err != nil {
+				return nil, errors.Wrapf(err, "estimate manifest %s", desc.Digest)
+			}
+			estimates = append(estimates, *estimate)
+		}
+		return nil, nil
+	})
+	if err := images.Walk(ctx, images.FilterPlatforms(handler, pvd.platformMC), desc); err != nil {
+		return nil, err
+	}
+	return estimates, nil
+}
@@ -0,0 +1,178 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/build"
+)
+
+// estimateFixture returns the files of an image layer: the incompressible
+// data, its copy, the zeros and the compressible text.
+func estimateFixture() map[string]string {
+	data := make([]byte, 3<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	return map[string]string{
+		"opt/data/random.bin": string(data),
+		"opt/data/copy.bin":   string(data),
+		"opt/data/zeros.bin":  string(make([]byte, 2<<20)),
+		"etc/app.conf":        strings.Repeat("key = value\n", 4096),
+	}
+}
+
+func writeEstimateImage(t *testing.T, ctx context.Context, pvd *Provider, layers ...map[string]string) ocispec.Descriptor {
+	var descs []ocispec.Descriptor
+	for _, files := range layers {
+		descs = append(descs, writeTarLayer(t, ctx, pvd.store, files))
+	}
+	config, err := writeJSON(ctx, pvd.store, ocispec.Image{
+		Platform: ocispec.Platform{OS: "linux", Architecture: "amd64"},
+	}, ocispec.MediaTypeImageConfig)
+	require.NoError(t, err)
+	manifest, err := writeJSON(ctx, pvd.store, ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    *config,
+		Layers:    descs,
+	}, ocispec.MediaTypeImageManifest)
+	require.NoError(t, err)
+	return *manifest
+}
+
+func TestEstimateSize(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+
+	files := estimateFixture()
+	desc := writeEstimateImage(t, ctx, pvd, files, map[string]string{
+		"opt/data/.wh.copy.bin": "",
+		"etc/.wh..wh..opq":      "",
+	})
+
+	// The uncompressed blob contains the unique chunks: 3 chunks of random
+	// data and a chunk of zeros, the text is in a chunk.
+	estimates, err := pvd.EstimateSize(ctx, desc, EstimateOption{Compressor: "none"})
+	require.NoError(t, err)
+	require.Len(t, estimates, 1)
+	estimate := estimates[0]
+	require.Equal(t, desc.Digest, estimate.Digest)
+	require.Equal(t, "linux/amd64", estimate.Platform)
+	require.Len(t, estimate.Layers, 2)
+	text := int64(len(files["etc/app.conf"]))
+	require.Equal(t, int64(8<<20)+text, estimate.Layers[0].DataSize)
+	require.Equal(t, int64(4<<20)+text+blobMetaHeaderSize+5*blobChunkMetaSize+blobTarSize, estimate.Layers[0].BlobSize)
+	require.Zero(t, estimate.Layers[1].BlobSize)
+	require.Equal(t, estimate.Layers[0].BlobSize, estimate.BlobSize)
+	require.Equal(t, estimate.Layers[0].Size+estimate.Layers[1].Size, estimate.SourceSize)
+	require.Equal(t, estimate.BlobSize+estimate.BootstrapSize, estimate.Size)
+
+	// The zeros and text are compressed, the random data isn't.
+	estimates, err = pvd.EstimateSize(ctx, desc, EstimateOption{Compressor: "zstd"})
+	require.NoError(t, err)
+	compressed := estimates[0]
+	require.Less(t, compressed.BlobSize, estimate.BlobSize)
+	require.Greater(t, compressed.BlobSize, int64(3<<20))
+	require.Less(t, compressed.BlobSize, int64(3<<20)+64<<10)
+
+	// The bootstrap excludes the entries removed by whiteouts.
+	full := writeEstimateImage(t, ctx, pvd, files)
+	estimates, err = pvd.EstimateSize(ctx, full, EstimateOption{Compressor: "zstd"})
+	require.NoError(t, err)
+	require.Greater(t, estimates[0].BootstrapSize, compressed.BootstrapSize)
+
+	// The smaller chunks need more chunk infos.
+	estimates, err = pvd.EstimateSize(ctx, desc, EstimateOption{Compressor: "zstd", ChunkSize: 0x10000})
+	require.NoError(t, err)
+	require.Greater(t, estimates[0].BootstrapSize, compressed.BootstrapSize)
+
+	estimates, err = pvd.EstimateSize(ctx, desc, EstimateOption{Compressor: "zstd", FsVersion: "5"})
+	require.NoError(t, err)
+	require.Equal(t, compressed.BlobSize, estimates[0].BlobSize)
+	require.NotEqual(t, compressed.BootstrapSize, estimates[0].BootstrapSize)
+
+	_, err = pvd.EstimateSize(ctx, desc, EstimateOption{Compressor: "gzip"})
+	require.Error(t, err)
+}
+
+// TestEstimateSizeWithBuilder compares the estimate with the nydus image
+// built from the fixture by `nydus-image`.
+func TestEstimateSizeWithBuilder(t *testing.T) {
+	builderPath, err := exec.LookPath("nydus-image")
+	if err != nil {
+		t.Skip("nydus-image binary isn't found")
+	}
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+
+	files := estimateFixture()
+	rootfs := t.TempDir()
+	for name, data := range files {
+		filePath := filepath.Join(rootfs, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(filePath), 0755))
+		require.NoError(t, os.WriteFile(filePath, []byte(data), 0644))
+	}
+
+	for _, fsVersion := range []string{"5", "6"} {
+		outputDir := t.TempDir()
+		blobPath := filepath.Join(outputDir, "blob")
+		bootstrapPath := filepath.Join(outputDir, "bootstrap")
+		builder := build.NewBuilder(builderPath)
+		require.NoError(t, builder.Run(build.BuilderOption{
+			BootstrapPath:  bootstrapPath,
+			BlobPath:       blobPath,
+			RootfsPath:     rootfs,
+			WhiteoutSpec:   "oci",
+			OutputJSONPath: filepath.Join(outputDir, "output.json"),
+			FsVersion:      fsVersion,
+			Compressor:     "zstd",
+		}), fsVersion)
+		blob, err := os.Stat(blobPath)
+		require.NoError(t, err, fsVersion)
+		bootstrap, err := os.Stat(bootstrapPath)
+		require.NoError(t, err, fsVersion)
+
+		estimates, err := pvd.EstimateSize(ctx, writeEstimateImage(t, ctx, pvd, files), EstimateOption{
+			FsVersion:  fsVersion,
+			Compressor: "zstd",
+		})
+		require.NoError(t, err, fsVersion)
+		require.Len(t, estimates, 1, fsVersion)
+		actual := blob.Size() + bootstrap.Size()
+		require.InDelta(t, actual, estimates[0].Size, float64(actual)/10, fsVersion)
+	}
+}
+
+func TestChunkEstimator(t *testing.T) {
+	for _, compressor := range []string{"none", "zstd", "lz4_block"} {
+		estimator, err := newChunkEstimator(compressor)
+		require.NoError(t, err)
+		zeros := make([]byte, 4096)
+		random := make([]byte, 4096)
+		rand.New(rand.NewSource(1)).Read(random)
+		// The incompressible chunk is stored as is.
+		require.Equal(t, int64(len(random)), estimator.size(random), compressor)
+		if compressor == "none" {
+			require.Equal(t, int64(len(zeros)), estimator.size(zeros))
+		} else {
+			require.Less(t, estimator.size(zeros), int64(len(zeros)/10), compressor)
+		}
+		require.Equal(t, estimator.size(bytes.Repeat([]byte{1}, 4096)), estimator.size(bytes.Repeat([]byte{1}, 4096)))
+		estimator.close()
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"archive/tar"
+	"context"
+	"path"
+
+	"github.com/containerd/log"
+	"github.com/pkg/errors"
+)
+
+// SetExcludePaths removes the files matched by patterns from the source
+// layers after pulling, so that they are absent from the converted image.
+// The pattern is a glob of absolute path in the syntax of path.Match, a
+// matched directory is removed with all its descendants, while the parent
+// directories are kept.
+func (pvd *Provider) SetExcludePaths(patterns []string) error {
+	for _, pattern := range patterns {
+		if !path.IsAbs(pattern) {
+			return errors.Errorf("exclude path %q is not an absolute path", pattern)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.Wrapf(err, "invalid exclude path %q", pattern)
+		}
+	}
+	pvd.excludePaths = patterns
+	return nil
+}
+
+// isExcluded checks whether the entry name in layer or any of its parent
+// directories is matched by patterns.
+func isExcluded(patterns []string, name string) bool {
+	for name = path.Clean("/" + name); name != "/"; name = path.Dir(name) {
+		for _, pattern := range patterns {
+			if matched, _ := path.Match(pattern, name); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// excludeRewriter removes the entries excluded by patterns from layers.
+func excludeRewriter(ctx context.Context, patterns []string) headerRewriter {
+	return func(hdr *tar.Header) (bool, bool) {
+		// The hard link to an excluded file is excluded too.
+		if isExcluded(patterns, hdr.Name) || (hdr.Typeflag == tar.TypeLink && isExcluded(patterns, hdr.Linkname)) {
+			log.G(ctx).Debugf("exclude %s from layer", hdr.Name)
+			return false, true
+		}
+		return true, false
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/containerd/containerd/archive/compression"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+// readTarLayer returns the entry names and the diff ID of layer in store.
+func readTarLayer(t *testing.T, ctx context.Context, store content.Store, layer ocispec.Descriptor) ([]string, digest.Digest) {
+	ra, err := store.ReaderAt(ctx, layer)
+	require.NoError(t, err)
+	defer ra.Close()
+	reader, err := compression.DecompressStream(content.NewReader(ra))
+	require.NoError(t, err)
+	defer reader.Close()
+
+	digester := digest.Canonical.Digester()
+	tr := tar.NewReader(io.TeeReader(reader, digester.Hash()))
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		names = append(names, hdr.Name)
+	}
+	_, err = io.Copy(io.Discard, reader)
+	require.NoError(t, err)
+	return names, digester.Digest()
+}
+
+func TestPullExcludePaths(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+
+	lower := writeTarLayer(t, ctx, pvd.store, map[string]string{
+		"etc/hostname":           "nydus",
+		"etc/ssl/server.key":     "secret",
+		"var/cache/apt/pkgcache": "cache",
+		"var/log/dpkg.log":       "log",
+	})
+	upper := writeTarLayer(t, ctx, pvd.store, map[string]string{
+		"usr/bin/app": "app",
+	})
+	config, err := writeJSON(ctx, pvd.store, ocispec.Image{
+		Platform: ocispec.Platform{OS: "linux", Architecture: "amd64"},
+		RootFS:   ocispec.RootFS{Type: "layers", DiffIDs: []digest.Digest{digest.FromString("lower"), digest.FromString("upper")}},
+	}, ocispec.MediaTypeImageConfig)
+	require.NoError(t, err)
+	manifest, err := writeJSON(ctx, pvd.store, ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    *config,
+		Layers:    []ocispec.Descriptor{lower, upper},
+	}, ocispec.MediaTypeImageManifest)
+	require.NoError(t, err)
+	registry := newPushableRegistry(t)
+	ref := registry.host + "/source:latest"
+	require.NoError(t, pvd.Push(ctx, *manifest, ref))
+
+	pvd = newPlatformProvider(t, platforms.All, "", "")
+	require.Error(t, pvd.SetExcludePaths([]string{"var/cache"}))
+	require.Error(t, pvd.SetExcludePaths([]string{"/var/["}))
+	require.NoError(t, pvd.SetExcludePaths([]string{"/var/cache", "/etc/*/*.key"}))
+	require.NoError(t, pvd.Pull(ctx, ref))
+	desc, err := pvd.Image(ctx, ref)
+	require.NoError(t, err)
+	require.NotEqual(t, manifest.Digest, desc.Digest)
+
+	var pulled ocispec.Manifest
+	require.NoError(t, readJSON(ctx, pvd.store, *desc, &pulled))
+	require.Len(t, pulled.Layers, 2)
+	var pulledConfig ocispec.Image
+	require.NoError(t, readJSON(ctx, pvd.store, pulled.Config, &pulledConfig))
+	require.Equal(t, "amd64", pulledConfig.Architecture)
+
+	// The matched files are removed from the lower layer, the sibling and
+	// parent entries are kept.
+	names, diffID := readTarLayer(t, ctx, pvd.store, pulled.Layers[0])
+	require.ElementsMatch(t, []string{"etc/hostname", "var/log/dpkg.log"}, names)
+	require.Equal(t, diffID, pulledConfig.RootFS.DiffIDs[0])
+
+	// The layer without excluded entries is unchanged.
+	require.Equal(t, upper.Digest, pulled.Layers[1].Digest)
+	require.Equal(t, digest.FromString("upper"), pulledConfig.RootFS.DiffIDs[1])
+
+	// The nydus manifest converted from the rewritten source manifest is
+	// annotated with the original source digest, which exists in registry.
+	target, err := writeJSON(ctx, pvd.store, ocispec.Manifest{
+		Versioned:   specs.Versioned{SchemaVersion: 2},
+		MediaType:   ocispec.MediaTypeImageManifest,
+		Config:      pulled.Config,
+		Layers:      pulled.Layers,
+		Annotations: map[string]string{utils.ManifestNydusSourceDigest: desc.Digest.String()},
+	}, ocispec.MediaTypeImageManifest)
+	require.NoError(t, err)
+	require.NoError(t, pvd.Push(ctx, *target, registry.host+"/target:latest"))
+	_, data, ok := registry.Tag("target", "latest")
+	require.True(t, ok)
+	var pushed ocispec.Manifest
+	require.NoError(t, json.Unmarshal(data, &pushed))
+	require.Equal(t, manifest.Digest.String(), pushed.Annotations[utils.ManifestNydusSourceDigest])
+}
@@ -0,0 +1,142 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+// The policies for the target tag existing before conversion, the existing
+// target is converted from the same source if the source manifest digests
+// recorded in its nydus manifests are the manifests of source matched by
+// platform.
+const (
+	// ExistingTargetOverwrite always converts and overwrites the existing
+	// target, it's the default policy.
+	ExistingTargetOverwrite = "overwrite"
+	// ExistingTargetSkip skips the conversion if the existing target is
+	// converted from the same source, otherwise overwrites it.
+	ExistingTargetSkip = "skip"
+	// ExistingTargetError skips the conversion if the existing target is
+	// converted from the same source, otherwise fails the conversion.
+	ExistingTargetError = "error"
+)
+
+// ExistingTargetPolicies are the supported policies for existing target.
+var ExistingTargetPolicies = []string{ExistingTargetOverwrite, ExistingTargetSkip, ExistingTargetError}
+
+// CheckExistingTarget evaluates the policy against the target image
+// existing in registry, it returns true if the conversion of source to
+// target should be skipped.
+func (pvd *Provider) CheckExistingTarget(ctx context.Context, source, target, policy string) (bool, error) {
+	switch policy {
+	case "", ExistingTargetOverwrite:
+		return false, nil
+	case ExistingTargetSkip, ExistingTargetError:
+	default:
+		return false, errors.Errorf("invalid existing target policy %s, possible values: %v", policy, ExistingTargetPolicies)
+	}
+
+	recorded, err := pvd.walkManifests(ctx, target, platforms.All, func(manifest ocispec.Manifest, _ ocispec.Descriptor) string {
+		return manifest.Annotations[utils.ManifestNydusSourceDigest]
+	})
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return false, nil
+		}
+		return false, errors.Wrapf(err, "get existing target %s", target)
+	}
+	expected, err := pvd.walkManifests(ctx, source, pvd.platformMC, func(_ ocispec.Manifest, desc ocispec.Descriptor) string {
+		return desc.Digest.String()
+	})
+	if err != nil {
+		return false, errors.Wrapf(err, "get source %s", source)
+	}
+
+	if len(recorded) > 0 && equalStrings(recorded, expected) {
+		return true, nil
+	}
+	if policy == ExistingTargetError {
+		return false, errors.Errorf("target %s exists but isn't converted from source %s", target, source)
+	}
+	return false, nil
+}
+
+// walkManifests fetches the manifests of ref matched by platform into
+// content store, and returns the sorted non-empty values by fn of them.
+func (pvd *Provider) walkManifests(ctx context.Context, ref string, platformMC platforms.Matcher, fn func(ocispec.Manifest, ocispec.Descriptor) string) ([]string, error) {
+	resolver, err := pvd.Resolver(ref)
+	if err != nil {
+		return nil, err
+	}
+	name, desc, err := resolver.Resolve(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	fetcher, err := resolver.Fetcher(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var mutex sync.Mutex
+	var values []string
+	handler := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		switch desc.MediaType {
+		case ocispec.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList:
+			if err := fetchToStore(ctx, pvd.store, fetcher, desc); err != nil {
+				return nil, err
+			}
+			return images.Children(ctx, pvd.store, desc)
+		case ocispec.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest:
+			if err := fetchToStore(ctx, pvd.store, fetcher, desc); err != nil {
+				return nil, err
+			}
+			data, err := content.ReadBlob(ctx, pvd.store, desc)
+			if err != nil {
+				return nil, errors.Wrapf(err, "read manifest %s", desc.Digest)
+			}
+			var manifest ocispec.Manifest
+			if err := json.Unmarshal(data, &manifest); err != nil {
+				return nil, errors.Wrapf(err, "unmarshal manifest %s", desc.Digest)
+			}
+			if value := fn(manifest, desc); value != "" {
+				mutex.Lock()
+				values = append(values, value)
+				mutex.Unlock()
+			}
+		}
+		return nil, nil
+	})
+	if err := images.Walk(ctx, images.FilterPlatforms(handler, platformMC), desc); err != nil {
+		return nil, err
+	}
+
+	sort.Strings(values)
+	return values, nil
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for idx := range a {
+		if a[idx] != b[idx] {
+			return false
+		}
+	}
+	return true
+}
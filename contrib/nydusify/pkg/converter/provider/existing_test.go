@@ -0,0 +1,76 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+func TestCheckExistingTarget(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	registry := newPushableRegistry(t)
+	config := registry.AddBlob(ocispec.MediaTypeImageConfig, []byte(`{"architecture":"amd64","os":"linux"}`))
+	addManifest := func(name string, annotations map[string]string) ocispec.Descriptor {
+		data, err := json.Marshal(ocispec.Manifest{
+			Versioned:   specs.Versioned{SchemaVersion: 2},
+			MediaType:   ocispec.MediaTypeImageManifest,
+			Config:      config,
+			Layers:      []ocispec.Descriptor{},
+			Annotations: annotations,
+		})
+		require.NoError(t, err)
+		desc := registry.AddBlob(ocispec.MediaTypeImageManifest, data)
+		registry.SetTag(name, "latest", desc.Digest)
+		return desc
+	}
+	source := addManifest("source", nil)
+	addManifest("same", map[string]string{utils.ManifestNydusSourceDigest: source.Digest.String()})
+	addManifest("different", map[string]string{utils.ManifestNydusSourceDigest: digest.FromString("other").String()})
+	// The target not converted by nydusify is regarded as different.
+	addManifest("plain", nil)
+
+	ref := func(name string) string {
+		return registry.host + "/" + name + ":latest"
+	}
+	for _, tc := range []struct {
+		policy string
+		target string
+		skip   bool
+		err    bool
+	}{
+		{ExistingTargetOverwrite, "same", false, false},
+		{ExistingTargetOverwrite, "different", false, false},
+		{ExistingTargetSkip, "same", true, false},
+		{ExistingTargetSkip, "different", false, false},
+		{ExistingTargetSkip, "plain", false, false},
+		{ExistingTargetSkip, "missing", false, false},
+		{ExistingTargetError, "same", true, false},
+		{ExistingTargetError, "different", false, true},
+		{ExistingTargetError, "plain", false, true},
+		{ExistingTargetError, "missing", false, false},
+		{"unknown", "same", false, true},
+	} {
+		pvd := newPlatformProvider(t, platforms.All, "", "")
+		skip, err := pvd.CheckExistingTarget(ctx, ref("source"), ref(tc.target), tc.policy)
+		name := tc.policy + " " + tc.target
+		if tc.err {
+			require.Error(t, err, name)
+			continue
+		}
+		require.NoError(t, err, name)
+		require.Equal(t, tc.skip, skip, name)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/log"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+// SetSkipBlobPush skips pushing the nydus blob layers of target image, which
+// are uploaded into the target repository separately, only the bootstrap
+// layers, configs and manifests are pushed. The nydus blob layers are
+// required to exist in the target repository, otherwise the push fails
+// before the image is published.
+func (pvd *Provider) SetSkipBlobPush(enabled bool) {
+	pvd.skipBlobPush = enabled
+}
+
+func isNydusBlob(desc ocispec.Descriptor) bool {
+	return desc.MediaType == utils.MediaTypeNydusBlob || desc.Annotations[utils.LayerAnnotationNydusBlob] == "true"
+}
+
+func (pvd *Provider) externalBlobResolver(resolver remotes.Resolver) remotes.Resolver {
+	if !pvd.skipBlobPush {
+		return resolver
+	}
+	return &externalBlobResolver{Resolver: resolver}
+}
+
+// checkExternalBlobs walks the image specified by desc and ensures the
+// nydus blob layers exist in the repository of ref, so that a missing blob
+// fails the push before any content is pushed.
+func checkExternalBlobs(ctx context.Context, store content.Store, resolver remotes.Resolver, desc ocispec.Descriptor, ref string) error {
+	named, err := docker.ParseDockerRef(ref)
+	if err != nil {
+		return errors.Wrapf(err, "parse reference %s", ref)
+	}
+	repository := named.Name()
+	handler := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		switch desc.MediaType {
+		case ocispec.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest,
+			ocispec.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList:
+			return images.Children(ctx, store, desc)
+		}
+		if !isNydusBlob(desc) {
+			return nil, nil
+		}
+		_, remoteDesc, err := resolver.Resolve(ctx, repository+"@"+desc.Digest.String())
+		if err != nil {
+			return nil, errors.Wrapf(err, "nydus blob %s is not uploaded to %s", desc.Digest, repository)
+		}
+		if remoteDesc.Size != desc.Size {
+			return nil, errors.Errorf("size of nydus blob %s in %s mismatches: expected %d, got %d", desc.Digest, repository, desc.Size, remoteDesc.Size)
+		}
+		return nil, nil
+	})
+	return images.Walk(ctx, handler, desc)
+}
+
+// externalBlobResolver skips pushing the nydus blob layers checked by
+// checkExternalBlobs, the other requests are sent as is.
+type externalBlobResolver struct {
+	remotes.Resolver
+}
+
+func (resolver *externalBlobResolver) Pusher(ctx context.Context, ref string) (remotes.Pusher, error) {
+	pusher, err := resolver.Resolver.Pusher(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	return &externalBlobPusher{Pusher: pusher}, nil
+}
+
+type externalBlobPusher struct {
+	remotes.Pusher
+}
+
+func (pusher *externalBlobPusher) Push(ctx context.Context, desc ocispec.Descriptor) (content.Writer, error) {
+	if !isNydusBlob(desc) {
+		return pusher.Pusher.Push(ctx, desc)
+	}
+	log.G(ctx).Debugf("skip pushing nydus blob %s uploaded separately", desc.Digest)
+	return nil, errors.Wrapf(errdefs.ErrAlreadyExists, "nydus blob %s uploaded separately", desc.Digest)
+}
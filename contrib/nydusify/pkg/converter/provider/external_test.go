@@ -0,0 +1,74 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+func TestPushSkipBlob(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+	pvd.SetSkipBlobPush(true)
+
+	config, err := writeJSON(ctx, pvd.store, ocispec.Image{Platform: ocispec.Platform{OS: "linux", Architecture: "amd64"}}, ocispec.MediaTypeImageConfig)
+	require.NoError(t, err)
+	blob, err := writeJSON(ctx, pvd.store, map[string]string{"blob": "data"}, utils.MediaTypeNydusBlob)
+	require.NoError(t, err)
+	bootstrap, err := writeJSON(ctx, pvd.store, map[string]string{"bootstrap": "data"}, ocispec.MediaTypeImageLayerGzip)
+	require.NoError(t, err)
+	bootstrap.Annotations = map[string]string{
+		utils.LayerAnnotationNydusBootstrap: "true",
+		utils.LayerAnnotationNydusBlobIDs:   `["` + blob.Digest.Hex() + `"]`,
+	}
+	manifest, err := writeJSON(ctx, pvd.store, ocispec.Manifest{
+		Versioned:   specs.Versioned{SchemaVersion: 2},
+		MediaType:   ocispec.MediaTypeImageManifest,
+		Config:      *config,
+		Layers:      []ocispec.Descriptor{*blob, *bootstrap},
+		Annotations: map[string]string{utils.ManifestNydusSnapshotter: snapshotterNydus},
+	}, ocispec.MediaTypeImageManifest)
+	require.NoError(t, err)
+
+	registry := newPushableRegistry(t)
+	var uploaded []digest.Digest
+	registry.Override(recordBlobs(&uploaded))
+
+	// The blob isn't uploaded separately, so nothing is pushed.
+	ref := registry.host + "/external:latest"
+	err = pvd.Push(ctx, *manifest, ref)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "is not uploaded")
+	_, _, ok := registry.Tag("external", "latest")
+	require.False(t, ok)
+	require.Empty(t, uploaded)
+
+	// Only the bootstrap, config and manifest are pushed with the blob
+	// uploaded separately.
+	blobData, err := content.ReadBlob(ctx, pvd.store, *blob)
+	require.NoError(t, err)
+	registry.AddBlob(utils.MediaTypeNydusBlob, blobData)
+	require.NoError(t, pvd.Push(ctx, *manifest, ref))
+	dgst, _, ok := registry.Tag("external", "latest")
+	require.True(t, ok)
+	require.Equal(t, manifest.Digest, dgst)
+	require.NotContains(t, uploaded, blob.Digest)
+	for _, desc := range []ocispec.Descriptor{*config, *bootstrap} {
+		_, ok := registry.Blob(desc.Digest)
+		require.True(t, ok)
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/archive/compression"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/log"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// MediaTypeNydusFileManifest is the media type of the file manifest of nydus
+// manifest, it's also the artifact type of the file manifest referrer.
+const MediaTypeNydusFileManifest = "application/vnd.nydus.file-manifest.v1+json"
+
+// FileManifest records the regular files in the filesystem of source image
+// and their sizes, for tuning the prefetch and the layer order later.
+type FileManifest struct {
+	Files []FileManifestEntry `json:"files"`
+	// Size is the total size of the files.
+	Size int64 `json:"size"`
+}
+
+// FileManifestEntry is a regular file in the filesystem, the path is
+// absolute.
+type FileManifestEntry struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// SetFileManifest enables generating the file manifest of the files in
+// source image for each nydus manifest of target image, the file manifest
+// is pushed as an OCI referrer of the nydus manifest.
+func (pvd *Provider) SetFileManifest(enabled bool) {
+	pvd.fileManifest = enabled
+}
+
+// scanFiles reads the regular files in the filesystem of the source layers,
+// the files removed by the whiteouts of upper layers are excluded.
+func scanFiles(ctx context.Context, store content.Store, layers []ocispec.Descriptor) (map[string]int64, error) {
+	files := map[string]int64{}
+	for _, layer := range layers {
+		if err := scanLayerFiles(ctx, store, layer, files); err != nil {
+			return nil, errors.Wrapf(err, "scan layer %s", layer.Digest)
+		}
+	}
+	return files, nil
+}
+
+// removeFiles removes the files at name and below name.
+func removeFiles(files map[string]int64, name string) {
+	delete(files, name)
+	prefix := strings.TrimSuffix(name, "/") + "/"
+	for filePath := range files {
+		if strings.HasPrefix(filePath, prefix) {
+			delete(files, filePath)
+		}
+	}
+}
+
+func scanLayerFiles(ctx context.Context, store content.Store, layer ocispec.Descriptor, files map[string]int64) error {
+	ra, err := store.ReaderAt(ctx, layer)
+	if err != nil {
+		return err
+	}
+	defer ra.Close()
+
+	reader, err := compression.DecompressStream(content.NewReader(ra))
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	// The whiteouts remove the files of lower layers only, they are applied
+	// after the whole layer is read, the entries of the layer override the
+	// files of lower layers.
+	var whiteouts []string
+	entries := map[string]*tar.Header{}
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Clean("/" + hdr.Name)
+		dir, base := path.Split(name)
+		if base == ".wh..wh..opq" {
+			whiteouts = append(whiteouts, path.Clean(dir))
+			continue
+		}
+		if strings.HasPrefix(base, ".wh.") {
+			whiteouts = append(whiteouts, dir+strings.TrimPrefix(base, ".wh."))
+			continue
+		}
+		entries[name] = hdr
+	}
+
+	for _, name := range whiteouts {
+		removeFiles(files, name)
+	}
+	for name, hdr := range entries {
+		delete(files, name)
+		if hdr.Typeflag == tar.TypeReg {
+			files[name] = hdr.Size
+		}
+	}
+	return nil
+}
+
+// writeFileManifest writes the file manifest referrer manifest of the nydus
+// manifest into store, the files are scanned from the source image, see
+// sourceLayers. Nil is returned for the manifest without source.
+func writeFileManifest(ctx context.Context, store content.Store, desc ocispec.Descriptor, sources map[digest.Digest]digest.Digest) (*ocispec.Descriptor, error) {
+	layers, err := sourceLayers(ctx, store, desc, sources)
+	if err != nil || layers == nil {
+		return nil, err
+	}
+
+	files, err := scanFiles(ctx, store, layers)
+	if err != nil {
+		return nil, err
+	}
+	manifest := FileManifest{Files: make([]FileManifestEntry, 0, len(files))}
+	for filePath, size := range files {
+		manifest.Files = append(manifest.Files, FileManifestEntry{Path: filePath, Size: size})
+		manifest.Size += size
+	}
+	sort.Slice(manifest.Files, func(i, j int) bool {
+		return manifest.Files[i].Path < manifest.Files[j].Path
+	})
+
+	manifestDesc, err := writeJSON(ctx, store, manifest, MediaTypeNydusFileManifest)
+	if err != nil {
+		return nil, errors.Wrap(err, "write file manifest")
+	}
+	referrerDesc, err := writeReferrer(ctx, store, desc, MediaTypeNydusFileManifest, *manifestDesc)
+	if err != nil {
+		return nil, errors.Wrap(err, "write file manifest referrer")
+	}
+	log.G(ctx).Infof("generated file manifest of %d files for manifest %s", len(manifest.Files), desc.Digest)
+
+	return referrerDesc, nil
+}
+
+// pushFileManifests generates and pushes the file manifest referrers of the
+// nydus manifests in target image by digest into the repository of ref.
+func (pvd *Provider) pushFileManifests(ctx context.Context, rc *containerd.RemoteContext, desc ocispec.Descriptor, ref string) error {
+	sources := pvd.originalSources()
+	return pvd.pushReferrers(ctx, rc, desc, ref, "file manifest", func(manifest ocispec.Descriptor) (*ocispec.Descriptor, error) {
+		return writeFileManifest(ctx, pvd.store, manifest, sources)
+	})
+}
@@ -0,0 +1,78 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+func TestPushFileManifest(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+	pvd.SetFileManifest(true)
+
+	// The upper layer overrides, removes and masks the files of lower layer.
+	lower := writeTarLayer(t, ctx, pvd.store, map[string]string{
+		"etc/hosts":       "127.0.0.1 localhost\n",
+		"etc/passwd":      "root:x:0:0::/root:/bin/sh\n",
+		"usr/bin/app":     "binary",
+		"var/cache/a.bin": "cached",
+		"var/cache/b.bin": "cached",
+	})
+	upper := writeTarLayer(t, ctx, pvd.store, map[string]string{
+		"./etc/hosts":            "::1 localhost\n127.0.0.1 localhost\n",
+		"etc/.wh.passwd":         "",
+		"var/cache/.wh..wh..opq": "",
+		"var/cache/c.bin":        "new",
+	})
+	config, err := writeJSON(ctx, pvd.store, ocispec.Image{}, ocispec.MediaTypeImageConfig)
+	require.NoError(t, err)
+	source, err := writeJSON(ctx, pvd.store, ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    *config,
+		Layers:    []ocispec.Descriptor{lower, upper},
+	}, ocispec.MediaTypeImageManifest)
+	require.NoError(t, err)
+
+	nydusDesc, _, _ := writeNydusImage(t, ctx, pvd)
+	var nydusManifest ocispec.Manifest
+	require.NoError(t, readJSON(ctx, pvd.store, nydusDesc, &nydusManifest))
+	nydusManifest.Annotations[utils.ManifestNydusSourceDigest] = source.Digest.String()
+	manifest, err := writeJSON(ctx, pvd.store, nydusManifest, ocispec.MediaTypeImageManifest)
+	require.NoError(t, err)
+
+	registry := newPushableRegistry(t)
+	var referrers []ocispec.Manifest
+	registry.Override(recordReferrers(t, &referrers))
+	require.NoError(t, pvd.Push(ctx, *manifest, registry.host+"/files:latest"))
+
+	require.Len(t, referrers, 1)
+	referrer := referrers[0]
+	require.Equal(t, MediaTypeNydusFileManifest, referrer.ArtifactType)
+	require.Equal(t, manifest.Digest, referrer.Subject.Digest)
+	require.Len(t, referrer.Layers, 1)
+	data, ok := registry.Blob(referrer.Layers[0].Digest)
+	require.True(t, ok)
+
+	var files FileManifest
+	require.NoError(t, json.Unmarshal(data, &files))
+	require.Equal(t, []FileManifestEntry{
+		{Path: "/etc/hosts", Size: int64(len("::1 localhost\n127.0.0.1 localhost\n"))},
+		{Path: "/usr/bin/app", Size: int64(len("binary"))},
+		{Path: "/var/cache/c.bin", Size: int64(len("new"))},
+	}, files.Files)
+	require.Equal(t, int64(len("::1 localhost\n127.0.0.1 localhost\n")+len("binary")+len("new")), files.Size)
+}
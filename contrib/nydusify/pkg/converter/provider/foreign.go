@@ -0,0 +1,183 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+// foreignLayer is a non-distributable layer of source manifest, which is
+// kept in target manifest as is, referring to the external URLs.
+type foreignLayer struct {
+	desc   ocispec.Descriptor
+	diffID digest.Digest
+}
+
+// skipForeignHandlerWrapper neither fetches nor pushes the non-distributable
+// (foreign) layers, they are not built into the nydus image but referred by
+// their URLs in target image, see stripForeignLayers.
+func skipForeignHandlerWrapper(handler images.Handler) images.Handler {
+	return images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		if images.IsNonDistributable(desc.MediaType) {
+			return nil, images.ErrSkipDesc
+		}
+		return handler.Handle(ctx, desc)
+	})
+}
+
+// stripManifestForeignLayers removes the foreign layers and their diff IDs
+// from the source manifest, the removed layers are returned in order.
+func stripManifestForeignLayers(ctx context.Context, store content.Store, manifest *ocispec.Manifest) ([]foreignLayer, error) {
+	hasForeign := false
+	for _, layer := range manifest.Layers {
+		if images.IsNonDistributable(layer.MediaType) {
+			hasForeign = true
+			break
+		}
+	}
+	if !hasForeign {
+		return nil, nil
+	}
+
+	// Keep the unknown fields of image config.
+	var config map[string]json.RawMessage
+	if err := readJSON(ctx, store, manifest.Config, &config); err != nil {
+		return nil, errors.Wrap(err, "read image config")
+	}
+	var rootfs ocispec.RootFS
+	if err := json.Unmarshal(config["rootfs"], &rootfs); err != nil {
+		return nil, errors.Wrap(err, "unmarshal rootfs of image config")
+	}
+	if len(rootfs.DiffIDs) != len(manifest.Layers) {
+		return nil, errors.Errorf("mismatched diff IDs %d and layers %d", len(rootfs.DiffIDs), len(manifest.Layers))
+	}
+
+	var foreign []foreignLayer
+	layers := []ocispec.Descriptor{}
+	diffIDs := []digest.Digest{}
+	for idx, layer := range manifest.Layers {
+		if images.IsNonDistributable(layer.MediaType) {
+			foreign = append(foreign, foreignLayer{desc: layer, diffID: rootfs.DiffIDs[idx]})
+			continue
+		}
+		layers = append(layers, layer)
+		diffIDs = append(diffIDs, rootfs.DiffIDs[idx])
+	}
+	if len(layers) == 0 {
+		return nil, errors.New("all layers are non-distributable")
+	}
+	manifest.Layers = layers
+	rootfs.DiffIDs = diffIDs
+
+	data, err := json.Marshal(rootfs)
+	if err != nil {
+		return nil, err
+	}
+	config["rootfs"] = data
+	configDesc, err := writeJSON(ctx, store, config, manifest.Config.MediaType)
+	if err != nil {
+		return nil, errors.Wrap(err, "write image config")
+	}
+	configDesc.Annotations = manifest.Config.Annotations
+	manifest.Config = *configDesc
+
+	return foreign, nil
+}
+
+// stripForeignLayers removes the foreign layers from the source image pulled
+// into store, so that they are neither fetched nor built, the removed layers
+// are recorded by the source manifest digest and restored into the converted
+// nydus manifest by restoreForeignLayers.
+func (pvd *Provider) stripForeignLayers(ctx context.Context, desc ocispec.Descriptor) (*ocispec.Descriptor, error) {
+	return pvd.rewriteSourceManifests(ctx, desc, func(manifestDesc *ocispec.Descriptor, manifest *ocispec.Manifest) (bool, error) {
+		foreign, err := stripManifestForeignLayers(ctx, pvd.store, manifest)
+		if err != nil || len(foreign) == 0 {
+			return false, err
+		}
+		pvd.mutex.Lock()
+		defer pvd.mutex.Unlock()
+		if pvd.foreignLayers == nil {
+			pvd.foreignLayers = map[digest.Digest][]foreignLayer{}
+		}
+		pvd.foreignLayers[manifestDesc.Digest] = foreign
+		return true, nil
+	})
+}
+
+// restoreManifestForeignLayers prepends the foreign layers stripped from the
+// source manifest to the nydus manifest converted from it, the nydus blobs
+// don't contain the files of foreign layers.
+func restoreManifestForeignLayers(ctx context.Context, store content.Store, manifest *ocispec.Manifest, foreignLayers map[digest.Digest][]foreignLayer) (bool, error) {
+	if !isNydusManifest(manifest) {
+		return false, nil
+	}
+	foreign := foreignLayers[digest.Digest(manifest.Annotations[utils.ManifestNydusSourceDigest])]
+	if len(foreign) == 0 {
+		return false, nil
+	}
+
+	// Keep the unknown fields of image config.
+	var config map[string]json.RawMessage
+	if err := readJSON(ctx, store, manifest.Config, &config); err != nil {
+		return false, errors.Wrap(err, "read image config")
+	}
+	var rootfs ocispec.RootFS
+	if err := json.Unmarshal(config["rootfs"], &rootfs); err != nil {
+		return false, errors.Wrap(err, "unmarshal rootfs of image config")
+	}
+
+	layers := []ocispec.Descriptor{}
+	diffIDs := []digest.Digest{}
+	for _, layer := range foreign {
+		layers = append(layers, layer.desc)
+		diffIDs = append(diffIDs, layer.diffID)
+	}
+	manifest.Layers = append(layers, manifest.Layers...)
+	rootfs.DiffIDs = append(diffIDs, rootfs.DiffIDs...)
+
+	data, err := json.Marshal(rootfs)
+	if err != nil {
+		return false, err
+	}
+	config["rootfs"] = data
+	configDesc, err := writeJSON(ctx, store, config, manifest.Config.MediaType)
+	if err != nil {
+		return false, errors.Wrap(err, "write image config")
+	}
+	configDesc.Annotations = manifest.Config.Annotations
+	manifest.Config = *configDesc
+
+	return true, nil
+}
+
+// restoreForeignLayers keeps the foreign layers of source image in the nydus
+// manifests of target image with their URLs, they are not pushed to target
+// registry. It's called after the source digests are restored.
+func restoreForeignLayers(ctx context.Context, store content.Store, desc ocispec.Descriptor, foreignLayers map[digest.Digest][]foreignLayer) (*ocispec.Descriptor, error) {
+	return rewriteManifests(ctx, store, desc, nil, func(_ *ocispec.Descriptor, manifest *ocispec.Manifest) (bool, error) {
+		return restoreManifestForeignLayers(ctx, store, manifest, foreignLayers)
+	})
+}
+
+// strippedForeignLayers returns the foreign layers recorded by
+// stripForeignLayers.
+func (pvd *Provider) strippedForeignLayers() map[digest.Digest][]foreignLayer {
+	pvd.mutex.Lock()
+	defer pvd.mutex.Unlock()
+	foreignLayers := make(map[digest.Digest][]foreignLayer, len(pvd.foreignLayers))
+	for source, layers := range pvd.foreignLayers {
+		foreignLayers[source] = layers
+	}
+	return foreignLayers
+}
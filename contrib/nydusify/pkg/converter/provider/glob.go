@@ -0,0 +1,89 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"archive/tar"
+	"context"
+	"path"
+	"strings"
+
+	"github.com/containerd/log"
+	"github.com/pkg/errors"
+)
+
+// globFilter filters the files in source layers by globs, the directories
+// and whiteouts aren't filtered.
+type globFilter struct {
+	include []string
+	exclude []string
+}
+
+// SetGlobFilter keeps only the files matched by any of include globs if
+// they're set, and removes the files matched by any of exclude globs from
+// the source layers after pulling. The glob is in the syntax of path.Match,
+// it matches the base name of file, e.g. `*.debug`, or the absolute path of
+// file if it contains a slash, e.g. `/usr/share/doc/*/*`. The directories
+// emptied by the filter in a layer are removed, while the directories
+// empty in source layers are kept.
+func (pvd *Provider) SetGlobFilter(include, exclude []string) error {
+	for _, pattern := range append(append([]string{}, include...), exclude...) {
+		if strings.Contains(pattern, "/") && !path.IsAbs(pattern) {
+			return errors.Errorf("glob %q containing slash is not an absolute path", pattern)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.Wrapf(err, "invalid glob %q", pattern)
+		}
+	}
+	if len(include) == 0 && len(exclude) == 0 {
+		pvd.globFilter = nil
+		return nil
+	}
+	pvd.globFilter = &globFilter{include: include, exclude: exclude}
+	return nil
+}
+
+// matchGlobs checks whether the file name in layer is matched by any of
+// patterns.
+func matchGlobs(patterns []string, name string) bool {
+	name = path.Clean("/" + name)
+	for _, pattern := range patterns {
+		target := name
+		if !strings.Contains(pattern, "/") {
+			target = path.Base(name)
+		}
+		if matched, _ := path.Match(pattern, target); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// filtered checks whether the file name is removed by filter.
+func (filter *globFilter) filtered(name string) bool {
+	if len(filter.include) > 0 && !matchGlobs(filter.include, name) {
+		return true
+	}
+	return matchGlobs(filter.exclude, name)
+}
+
+// rewriter returns the header rewriter removing the files filtered, or nil
+// if filter isn't set.
+func (filter *globFilter) rewriter(ctx context.Context) headerRewriter {
+	if filter == nil {
+		return nil
+	}
+	return func(hdr *tar.Header) (bool, bool) {
+		if hdr.Typeflag == tar.TypeDir || strings.HasPrefix(path.Base(hdr.Name), ".wh.") {
+			return true, false
+		}
+		// The hard link to a filtered file is filtered too.
+		if filter.filtered(hdr.Name) || (hdr.Typeflag == tar.TypeLink && filter.filtered(hdr.Linkname)) {
+			log.G(ctx).Debugf("filter %s from layer", hdr.Name)
+			return false, true
+		}
+		return true, false
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"archive/tar"
+	"context"
+	"testing"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGlobFilter(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+	layer := writeHeaderLayer(t, ctx, pvd.store, []*tar.Header{
+		{Name: "tmp/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "usr/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "usr/lib/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "usr/lib/libapp.so", Typeflag: tar.TypeReg, Mode: 0755, Size: 3},
+		{Name: "usr/lib/debug/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "usr/lib/debug/libapp.so.debug", Typeflag: tar.TypeReg, Mode: 0644, Size: 3},
+		{Name: "usr/lib/libapp.so.1", Typeflag: tar.TypeSymlink, Linkname: "libapp.so", Mode: 0777},
+		{Name: "usr/share/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "usr/share/doc/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "usr/share/doc/app/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "usr/share/doc/app/README.md", Typeflag: tar.TypeReg, Mode: 0644, Size: 3},
+		{Name: "usr/share/doc/app/.wh.CHANGES", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "usr/share/man/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "usr/share/man/app.1", Typeflag: tar.TypeReg, Mode: 0644, Size: 3},
+		{Name: "usr/share/man/app.md", Typeflag: tar.TypeLink, Linkname: "usr/share/man/app.1"},
+	})
+
+	require.Error(t, pvd.SetGlobFilter(nil, []string{"lib/*.debug"}))
+	require.Error(t, pvd.SetGlobFilter([]string{"["}, nil))
+
+	// The debug symbols and manuals are removed with the directories
+	// emptied, the directories empty in source and the whiteouts are kept.
+	require.NoError(t, pvd.SetGlobFilter(nil, []string{"*.debug", "/usr/share/man/*"}))
+	newLayer, _, err := rewriteLayer(ctx, pvd.store, layer, pvd.layerRewriter(ctx), true)
+	require.NoError(t, err)
+	require.NotNil(t, newLayer)
+	names, _ := readTarLayer(t, ctx, pvd.store, *newLayer)
+	require.Equal(t, []string{
+		"tmp/",
+		"usr/",
+		"usr/lib/",
+		"usr/lib/libapp.so",
+		"usr/lib/libapp.so.1",
+		"usr/share/",
+		"usr/share/doc/",
+		"usr/share/doc/app/",
+		"usr/share/doc/app/README.md",
+		"usr/share/doc/app/.wh.CHANGES",
+	}, names)
+
+	// Only the shared libraries are kept.
+	require.NoError(t, pvd.SetGlobFilter([]string{"*.so", "*.so.*"}, []string{"*.debug"}))
+	newLayer, _, err = rewriteLayer(ctx, pvd.store, layer, pvd.layerRewriter(ctx), true)
+	require.NoError(t, err)
+	require.NotNil(t, newLayer)
+	names, _ = readTarLayer(t, ctx, pvd.store, *newLayer)
+	require.Equal(t, []string{
+		"tmp/",
+		"usr/",
+		"usr/lib/",
+		"usr/lib/libapp.so",
+		"usr/lib/libapp.so.1",
+		"usr/share/",
+		"usr/share/doc/",
+		"usr/share/doc/app/",
+		"usr/share/doc/app/.wh.CHANGES",
+	}, names)
+
+	require.NoError(t, pvd.SetGlobFilter(nil, nil))
+	require.Nil(t, pvd.layerRewriter(ctx))
+}
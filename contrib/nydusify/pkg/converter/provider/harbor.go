@@ -0,0 +1,89 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/containerd/log"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+// SetHarborAccessory enables pushing the target image as the accessory of
+// source image in Harbor. Harbor links a nydus manifest to the manifest
+// referred by its `subject` field as `build.nydus` accessory only if both of
+// them are in the same repository, so the subject manifests are pushed into
+// the target repository before pushing the target image.
+func (pvd *Provider) SetHarborAccessory(enabled bool) {
+	pvd.harborAccessory = enabled
+}
+
+// subjects returns the subjects of the nydus manifests in target image, all
+// of them should have a subject to be linked as accessory by Harbor.
+func (pvd *Provider) subjects(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+	var manifestDescs []ocispec.Descriptor
+	switch desc.MediaType {
+	case ocispec.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList:
+		var index ocispec.Index
+		if err := readJSON(ctx, pvd.store, desc, &index); err != nil {
+			return nil, errors.Wrap(err, "read image index")
+		}
+		manifestDescs = index.Manifests
+	case ocispec.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest:
+		manifestDescs = []ocispec.Descriptor{desc}
+	default:
+		return nil, fmt.Errorf("unsupported media type %s", desc.MediaType)
+	}
+
+	var subjects []ocispec.Descriptor
+	for _, manifestDesc := range manifestDescs {
+		var manifest ocispec.Manifest
+		if err := readJSON(ctx, pvd.store, manifestDesc, &manifest); err != nil {
+			return nil, errors.Wrap(err, "read manifest")
+		}
+		if len(manifest.Layers) == 0 || manifest.Layers[len(manifest.Layers)-1].Annotations[utils.LayerAnnotationNydusBootstrap] != "true" {
+			return nil, fmt.Errorf("manifest %s is not a nydus manifest, Harbor accessory can't be used with --merge-platform", manifestDesc.Digest)
+		}
+		if manifest.Subject == nil {
+			return nil, fmt.Errorf("nydus manifest %s has no subject", manifestDesc.Digest)
+		}
+		subjects = append(subjects, *manifest.Subject)
+	}
+
+	return subjects, nil
+}
+
+// pushSubjects pushes the subject manifests of target image by digest into
+// the repository of ref, the existing content in repository is skipped.
+func (pvd *Provider) pushSubjects(ctx context.Context, rc *containerd.RemoteContext, desc ocispec.Descriptor, ref string) error {
+	named, err := docker.ParseDockerRef(ref)
+	if err != nil {
+		return errors.Wrapf(err, "parse reference %s", ref)
+	}
+	subjects, err := pvd.subjects(ctx, desc)
+	if err != nil {
+		return err
+	}
+
+	for _, subject := range subjects {
+		if _, err := pvd.store.Info(ctx, subject.Digest); err != nil {
+			return errors.Wrapf(err, "get subject manifest %s", subject.Digest)
+		}
+		subjectRef := named.Name() + "@" + subject.Digest.String()
+		log.G(ctx).Infof("pushing subject manifest %s", subjectRef)
+		if err := push(ctx, pvd.store, rc, subject, subjectRef); err != nil {
+			return errors.Wrapf(err, "push subject manifest %s", subjectRef)
+		}
+	}
+
+	return nil
+}
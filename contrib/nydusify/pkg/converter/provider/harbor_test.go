@@ -0,0 +1,118 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+// harborStub records the accessories like Harbor: a manifest with subject is
+// linked as accessory only if the subject exists in the same repository.
+type harborStub struct {
+	*testRegistry
+	manifests   map[string]bool
+	accessories map[string]string
+}
+
+func newHarborStub(t *testing.T) *harborStub {
+	stub := &harborStub{
+		testRegistry: newPushableRegistry(t),
+		manifests:    make(map[string]bool),
+		accessories:  make(map[string]string),
+	}
+	stub.Override(scopeManifests(func(name string, dgst digest.Digest) bool {
+		return stub.manifests[name+"@"+dgst.String()]
+	}), onManifestPush(func(name string, dgst digest.Digest, data []byte) {
+		stub.manifests[name+"@"+dgst.String()] = true
+		var manifest ocispec.Manifest
+		if err := json.Unmarshal(data, &manifest); err != nil || manifest.Subject == nil {
+			return
+		}
+		if !stub.manifests[name+"@"+manifest.Subject.Digest.String()] {
+			return
+		}
+		layers := manifest.Layers
+		if len(layers) > 0 && layers[len(layers)-1].Annotations[utils.LayerAnnotationNydusBootstrap] == "true" {
+			stub.accessories[name+"@"+manifest.Subject.Digest.String()] = "build.nydus:" + dgst.String()
+		}
+	}))
+	return stub
+}
+
+func (stub *harborStub) Accessory(name string, subject digest.Digest) string {
+	stub.mutex.Lock()
+	defer stub.mutex.Unlock()
+	return stub.accessories[name+"@"+subject.String()]
+}
+
+func writeNydusManifest(t *testing.T, ctx context.Context, pvd *Provider, subject ocispec.Descriptor) ocispec.Descriptor {
+	config, err := writeJSON(ctx, pvd.store, ocispec.Image{Platform: ocispec.Platform{OS: "linux", Architecture: "amd64"}}, ocispec.MediaTypeImageConfig)
+	require.NoError(t, err)
+	blob, err := writeJSON(ctx, pvd.store, map[string]string{"blob": "data"}, utils.MediaTypeNydusBlob)
+	require.NoError(t, err)
+	bootstrap, err := writeJSON(ctx, pvd.store, map[string]string{"bootstrap": "data"}, ocispec.MediaTypeImageLayerGzip)
+	require.NoError(t, err)
+	bootstrap.Annotations = map[string]string{
+		utils.LayerAnnotationNydusBootstrap: "true",
+		utils.LayerAnnotationNydusBlobIDs:   `["` + blob.Digest.Hex() + `"]`,
+	}
+	manifest, err := writeJSON(ctx, pvd.store, ocispec.Manifest{
+		Versioned:   specs.Versioned{SchemaVersion: 2},
+		MediaType:   ocispec.MediaTypeImageManifest,
+		Config:      *config,
+		Layers:      []ocispec.Descriptor{*blob, *bootstrap},
+		Subject:     &subject,
+		Annotations: map[string]string{utils.ManifestNydusSnapshotter: snapshotterNydus},
+	}, ocispec.MediaTypeImageManifest)
+	require.NoError(t, err)
+	return *manifest
+}
+
+func TestPushHarborAccessory(t *testing.T) {
+	stub := newHarborStub(t)
+	source := addTestManifest(t, stub.testRegistry, "linux/amd64", "source layer")
+	stub.SetTag("library/source", "latest", source.Digest)
+	stub.manifests["library/source@"+source.Digest.String()] = true
+	sourceRef := stub.host + "/library/source:latest"
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+
+	for _, enabled := range []bool{false, true} {
+		pvd := newPlatformProvider(t, platforms.All, "", "")
+		pvd.SetHarborAccessory(enabled)
+		require.NoError(t, pvd.Pull(ctx, sourceRef))
+		source.Platform = nil
+		nydus := writeNydusManifest(t, ctx, pvd, source)
+
+		// Target in a different repository from source.
+		repo := fmt.Sprintf("library/target-%t", enabled)
+		require.NoError(t, pvd.Push(ctx, nydus, stub.host+"/"+repo+":nydus"))
+		accessory := stub.Accessory(repo, source.Digest)
+		if !enabled {
+			require.Empty(t, accessory)
+			continue
+		}
+		require.Equal(t, "build.nydus:"+nydus.Digest.String(), accessory)
+	}
+
+	// Non-nydus manifest is rejected.
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+	pvd.SetHarborAccessory(true)
+	require.NoError(t, pvd.Pull(ctx, sourceRef))
+	err := pvd.Push(ctx, source, stub.host+"/library/target:oci")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "is not a nydus manifest")
+}
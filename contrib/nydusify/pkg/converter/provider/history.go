@@ -0,0 +1,114 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+// historyCreatedBy is the `created_by` of the history entry appended by
+// SetHistory.
+const historyCreatedBy = "nydusify convert"
+
+// historyOption rewrites the history in the config of nydus image.
+type historyOption struct {
+	strip   bool
+	comment string
+}
+
+// SetHistory rewrites the history in the config of nydus image: strip
+// removes the history entries inherited from source image, which may leak
+// the build commands, and a non-empty comment appends an entry noting the
+// conversion. The manifests other than nydus, e.g. the OCI manifest of
+// `--merge-platform`, are kept as is.
+func (pvd *Provider) SetHistory(strip bool, comment string) {
+	if !strip && comment == "" {
+		pvd.history = nil
+		return
+	}
+	pvd.history = &historyOption{strip: strip, comment: comment}
+}
+
+func isNydusManifest(manifest *ocispec.Manifest) bool {
+	for _, layer := range manifest.Layers {
+		if layer.Annotations[utils.LayerAnnotationNydusBootstrap] == "true" {
+			return true
+		}
+	}
+	return false
+}
+
+// setManifestHistory rewrites the history of nydus image config, the entry
+// noting the conversion is dated with the image creation time to keep the
+// conversion reproducible, and marked as empty layer since the nydus layers
+// don't correspond to the history of source image.
+func setManifestHistory(ctx context.Context, store content.Store, manifest *ocispec.Manifest, opt historyOption) (bool, error) {
+	if !isNydusManifest(manifest) {
+		return false, nil
+	}
+
+	// Keep the unknown fields of image config.
+	var config map[string]json.RawMessage
+	if err := readJSON(ctx, store, manifest.Config, &config); err != nil {
+		return false, errors.Wrap(err, "read image config")
+	}
+	var history []ocispec.History
+	if data, ok := config["history"]; ok && !opt.strip {
+		if err := json.Unmarshal(data, &history); err != nil {
+			return false, errors.Wrap(err, "unmarshal image history")
+		}
+	}
+	if opt.comment != "" {
+		entry := ocispec.History{
+			CreatedBy:  historyCreatedBy,
+			Comment:    opt.comment,
+			EmptyLayer: true,
+		}
+		if data, ok := config["created"]; ok {
+			var created time.Time
+			if err := json.Unmarshal(data, &created); err == nil {
+				entry.Created = &created
+			}
+		}
+		history = append(history, entry)
+	}
+
+	if len(history) == 0 {
+		delete(config, "history")
+	} else {
+		data, err := json.Marshal(history)
+		if err != nil {
+			return false, err
+		}
+		config["history"] = data
+	}
+	configDesc, err := writeJSON(ctx, store, config, manifest.Config.MediaType)
+	if err != nil {
+		return false, errors.Wrap(err, "write image config")
+	}
+	if configDesc.Digest == manifest.Config.Digest {
+		return false, nil
+	}
+	configDesc.Annotations = manifest.Config.Annotations
+	manifest.Config = *configDesc
+
+	return true, nil
+}
+
+// setHistory rewrites the history in the configs of all the nydus manifests
+// in target image.
+func setHistory(ctx context.Context, store content.Store, desc ocispec.Descriptor, opt historyOption) (*ocispec.Descriptor, error) {
+	return rewriteManifests(ctx, store, desc, nil, func(_ *ocispec.Descriptor, manifest *ocispec.Manifest) (bool, error) {
+		return setManifestHistory(ctx, store, manifest, opt)
+	})
+}
@@ -0,0 +1,71 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+func TestPushStripHistory(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+
+	created := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+	pvd.SetHistory(true, "converted to Nydus image")
+
+	config, err := writeJSON(ctx, pvd.store, ocispec.Image{
+		Created:  &created,
+		Platform: ocispec.Platform{OS: "linux", Architecture: "amd64"},
+		History: []ocispec.History{
+			{CreatedBy: "/bin/sh -c echo $SECRET > /token"},
+			{CreatedBy: "/bin/sh -c #(nop) CMD [\"sh\"]", EmptyLayer: true},
+		},
+	}, ocispec.MediaTypeImageConfig)
+	require.NoError(t, err)
+	blob, err := writeJSON(ctx, pvd.store, map[string]string{"blob": "data"}, utils.MediaTypeNydusBlob)
+	require.NoError(t, err)
+	bootstrap, err := writeJSON(ctx, pvd.store, map[string]string{"bootstrap": "data"}, ocispec.MediaTypeImageLayerGzip)
+	require.NoError(t, err)
+	bootstrap.Annotations = map[string]string{utils.LayerAnnotationNydusBootstrap: "true"}
+	manifest, err := writeJSON(ctx, pvd.store, ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    *config,
+		Layers:    []ocispec.Descriptor{*blob, *bootstrap},
+	}, ocispec.MediaTypeImageManifest)
+	require.NoError(t, err)
+
+	registry := newPushableRegistry(t)
+	require.NoError(t, pvd.Push(ctx, *manifest, registry.host+"/history:latest"))
+	_, data, ok := registry.Tag("history", "latest")
+	require.True(t, ok)
+	var pushed ocispec.Manifest
+	require.NoError(t, json.Unmarshal(data, &pushed))
+	require.NotEqual(t, config.Digest, pushed.Config.Digest)
+
+	configData, ok := registry.Blob(pushed.Config.Digest)
+	require.True(t, ok)
+	var pushedConfig ocispec.Image
+	require.NoError(t, json.Unmarshal(configData, &pushedConfig))
+	require.NotContains(t, string(configData), "SECRET")
+	require.Equal(t, []ocispec.History{{
+		Created:    &created,
+		CreatedBy:  historyCreatedBy,
+		Comment:    "converted to Nydus image",
+		EmptyLayer: true,
+	}}, pushedConfig.History)
+	require.Equal(t, "amd64", pushedConfig.Architecture)
+}
@@ -0,0 +1,100 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/http2"
+)
+
+const (
+	// HTTPVersion1 forces HTTP/1.1 without keep-alive on the registry
+	// transport, it's the default to work with the registries or proxies
+	// having a buggy HTTP/2 implementation.
+	HTTPVersion1 = "1.1"
+	// HTTPVersion2 negotiates HTTP/2 with registry by ALPN, the requests
+	// are multiplexed on the connections kept alive. The plain HTTP and unix
+	// socket connections fall back to HTTP/1.1.
+	HTTPVersion2 = "2"
+)
+
+type http2Option struct {
+	maxConcurrentStreams uint32
+}
+
+// SetHTTPVersion sets the HTTP version of registry transport, empty version
+// means HTTPVersion1. For HTTPVersion2, maxConcurrentStreams limits the
+// requests multiplexed to a registry host at the same time, then the
+// requests are sent on a single connection as long as the limit of registry
+// allows, zero means the limit of registry only.
+func (pvd *Provider) SetHTTPVersion(version string, maxConcurrentStreams uint32) error {
+	switch version {
+	case "", HTTPVersion1:
+		pvd.http2 = nil
+	case HTTPVersion2:
+		pvd.http2 = &http2Option{maxConcurrentStreams: maxConcurrentStreams}
+	default:
+		return errors.Errorf("unsupported HTTP version %q, should be %s or %s", version, HTTPVersion1, HTTPVersion2)
+	}
+	return nil
+}
+
+// configureHTTP2 enables HTTP/2 on transport, returns the round tripper
+// limiting the concurrent streams.
+func configureHTTP2(transport *http.Transport, option *http2Option) (http.RoundTripper, error) {
+	transport.ForceAttemptHTTP2 = true
+	transport2, err := http2.ConfigureTransports(transport)
+	if err != nil {
+		// Only happens if the transport has been configured.
+		return nil, errors.Wrap(err, "configure HTTP/2 transport")
+	}
+	if option.maxConcurrentStreams == 0 {
+		return transport, nil
+	}
+	// Wait for the stream slot of an existing connection rather than
+	// dialing a new one once the limit of registry is reached.
+	transport2.StrictMaxConcurrentStreams = true
+	return &streamLimitedTransport{
+		RoundTripper: transport,
+		streams:      make(chan struct{}, option.maxConcurrentStreams),
+	}, nil
+}
+
+// streamLimitedTransport limits the concurrent requests, a stream is held
+// until the response body is closed.
+type streamLimitedTransport struct {
+	http.RoundTripper
+	streams chan struct{}
+}
+
+func (transport *streamLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	select {
+	case transport.streams <- struct{}{}:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	resp, err := transport.RoundTripper.RoundTrip(req)
+	if err != nil {
+		<-transport.streams
+		return nil, err
+	}
+	resp.Body = &streamBody{ReadCloser: resp.Body, release: func() { <-transport.streams }}
+	return resp, nil
+}
+
+type streamBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (body *streamBody) Close() error {
+	defer body.once.Do(body.release)
+	return body.ReadCloser.Close()
+}
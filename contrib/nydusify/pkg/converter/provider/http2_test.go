@@ -0,0 +1,75 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPVersion(t *testing.T) {
+	var inflight, maxInflight int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := atomic.AddInt32(&inflight, 1)
+		defer atomic.AddInt32(&inflight, -1)
+		for {
+			max := atomic.LoadInt32(&maxInflight)
+			if current <= max || atomic.CompareAndSwapInt32(&maxInflight, max, current) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		_, _ = w.Write([]byte(r.Proto))
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	get := func(client *http.Client, err error) string {
+		require.NoError(t, err)
+		resp, err := client.Get(server.URL)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		proto, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, string(proto), resp.Proto)
+		return string(proto)
+	}
+
+	pvd := &Provider{}
+	require.Error(t, pvd.SetHTTPVersion("3", 0))
+
+	// HTTP/1.1 is forced by default even if the registry supports HTTP/2.
+	require.NoError(t, pvd.SetHTTPVersion("", 0))
+	require.Equal(t, "HTTP/1.1", get(newDefaultClient(true, "", DefaultDialTimeout, 0, pvd.http2)))
+	require.NoError(t, pvd.SetHTTPVersion(HTTPVersion1, 0))
+	require.Equal(t, "HTTP/1.1", get(newDefaultClient(true, "", DefaultDialTimeout, 0, pvd.http2)))
+
+	require.NoError(t, pvd.SetHTTPVersion(HTTPVersion2, 0))
+	require.Equal(t, "HTTP/2.0", get(newDefaultClient(true, "", DefaultDialTimeout, 0, pvd.http2)))
+
+	// The concurrent streams are limited.
+	require.NoError(t, pvd.SetHTTPVersion(HTTPVersion2, 2))
+	client, err := newDefaultClient(true, "", DefaultDialTimeout, 0, pvd.http2)
+	require.NoError(t, err)
+	atomic.StoreInt32(&maxInflight, 0)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require.Equal(t, "HTTP/2.0", get(client, nil))
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int32(2), atomic.LoadInt32(&maxInflight))
+}
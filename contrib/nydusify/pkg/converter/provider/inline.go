@@ -0,0 +1,55 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/log"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// verifyInlineData ensures the data embedded in desc, introduced by OCI
+// image spec v1.1, matches the size and digest of desc.
+func verifyInlineData(desc ocispec.Descriptor) error {
+	if int64(len(desc.Data)) != desc.Size {
+		return fmt.Errorf("size %d of inline data mismatches descriptor size %d", len(desc.Data), desc.Size)
+	}
+	if err := desc.Digest.Validate(); err != nil {
+		return err
+	}
+	if dgst := desc.Digest.Algorithm().FromBytes(desc.Data); dgst != desc.Digest {
+		return fmt.Errorf("digest %s of inline data mismatches descriptor digest %s", dgst, desc.Digest)
+	}
+	return nil
+}
+
+// inlineDataHandlerWrapper writes the content embedded in the data field
+// of descriptor into store, so that it's materialized without fetching from
+// remote, the content with invalid inline data is fetched as usual.
+func inlineDataHandlerWrapper(store content.Store, handler images.Handler) images.Handler {
+	return images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		if len(desc.Data) == 0 {
+			return handler.Handle(ctx, desc)
+		}
+		if err := verifyInlineData(desc); err != nil {
+			log.G(ctx).Warnf("ignore inline data of %s %s: %s", desc.MediaType, desc.Digest, err)
+			return handler.Handle(ctx, desc)
+		}
+		ref := "inline-" + desc.Digest.String()
+		err := content.WriteBlob(ctx, store, ref, bytes.NewReader(desc.Data), desc)
+		if err != nil && !errdefs.IsAlreadyExists(err) {
+			return nil, fmt.Errorf("write inline data of %s: %w", desc.Digest, err)
+		}
+		log.G(ctx).Debugf("materialized %s %s from inline data", desc.MediaType, desc.Digest)
+		// The content existing in store is not fetched again by handler.
+		return handler.Handle(ctx, desc)
+	})
+}
@@ -0,0 +1,187 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/log"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+// MediaTypeNydusLazyIndex is the media type of the lazy-loading index of
+// nydus manifest, it's also the artifact type of the index referrer manifest.
+const MediaTypeNydusLazyIndex = "application/vnd.nydus.lazy-index.v1+json"
+
+const (
+	// blobTocName is the name of the ToC entry at the end of nydus blob.
+	blobTocName = "rafs.blob.toc"
+	// blobTocEntrySize is the size of the on-disk ToC entry.
+	blobTocEntrySize = 128
+	// blobTocHeaderSize is the size of the tar header following the ToC.
+	blobTocHeaderSize = 512
+)
+
+// blobTocCompressors maps the compression flags of ToC entry to compressor.
+var blobTocCompressors = map[uint32]string{
+	0x0001: "none",
+	0x0002: "zstd",
+	0x0004: "lz4_block",
+}
+
+// LazyIndex is the lazy-loading index of nydus manifest, which summarizes
+// where the bootstrap and blobs are, and where the chunk maps (the
+// `blob.meta` entries) are in the blobs, so that the snapshotter can mount
+// the image without probing each blob.
+type LazyIndex struct {
+	Bootstrap ocispec.Descriptor `json:"bootstrap"`
+	Blobs     []LazyIndexBlob    `json:"blobs"`
+}
+
+// LazyIndexBlob is a blob in the blob table of bootstrap, the ToC is empty
+// for the blob without ToC or not in the image.
+type LazyIndexBlob struct {
+	Blob
+	Toc []BlobTocEntry `json:"toc,omitempty"`
+}
+
+// BlobTocEntry is an entry of the ToC at the end of nydus blob.
+type BlobTocEntry struct {
+	Name               string `json:"name"`
+	Compressor         string `json:"compressor"`
+	UncompressedDigest string `json:"uncompressed_digest"`
+	CompressedOffset   uint64 `json:"compressed_offset"`
+	CompressedSize     uint64 `json:"compressed_size"`
+	UncompressedSize   uint64 `json:"uncompressed_size"`
+}
+
+// SetLazyIndex enables generating the lazy-loading index for each nydus
+// manifest of target image from the blob table of bootstrap inspected by
+// inspector and the ToC of blobs, the index is pushed as an OCI referrer
+// of the nydus manifest. The nil inspector disables it.
+func (pvd *Provider) SetLazyIndex(inspector BlobInspector) {
+	pvd.lazyIndexInspector = inspector
+}
+
+// readBlobToc reads the ToC entries at the end of the nydus blob layer in
+// store, nil is returned for the blob without ToC.
+func readBlobToc(ctx context.Context, store content.Store, layer ocispec.Descriptor) ([]BlobTocEntry, error) {
+	if layer.Size < blobTocHeaderSize {
+		return nil, nil
+	}
+	ra, err := store.ReaderAt(ctx, layer)
+	if err != nil {
+		return nil, err
+	}
+	defer ra.Close()
+
+	header := make([]byte, blobTocHeaderSize)
+	if _, err := ra.ReadAt(header, layer.Size-blobTocHeaderSize); err != nil {
+		return nil, errors.Wrap(err, "read ToC header")
+	}
+	hdr, err := tar.NewReader(bytes.NewReader(header)).Next()
+	if err != nil || hdr.Name != blobTocName || hdr.Typeflag != tar.TypeReg {
+		return nil, nil
+	}
+	if hdr.Size%blobTocEntrySize != 0 || hdr.Size > layer.Size-blobTocHeaderSize {
+		return nil, errors.Errorf("invalid ToC size %d", hdr.Size)
+	}
+
+	data := make([]byte, hdr.Size)
+	if _, err := ra.ReadAt(data, layer.Size-blobTocHeaderSize-hdr.Size); err != nil {
+		return nil, errors.Wrap(err, "read ToC")
+	}
+	entries := make([]BlobTocEntry, 0, len(data)/blobTocEntrySize)
+	for pos := 0; pos < len(data); pos += blobTocEntrySize {
+		raw := data[pos : pos+blobTocEntrySize]
+		flags := binary.LittleEndian.Uint32(raw[0:4])
+		compressor, ok := blobTocCompressors[flags&0x000f]
+		if !ok {
+			return nil, errors.Errorf("unknown compression flags 0x%x of ToC entry", flags)
+		}
+		entries = append(entries, BlobTocEntry{
+			Name:               strings.TrimRight(string(raw[8:24]), "\x00"),
+			Compressor:         compressor,
+			UncompressedDigest: "sha256:" + hex.EncodeToString(raw[24:56]),
+			CompressedOffset:   binary.LittleEndian.Uint64(raw[56:64]),
+			CompressedSize:     binary.LittleEndian.Uint64(raw[64:72]),
+			UncompressedSize:   binary.LittleEndian.Uint64(raw[72:80]),
+		})
+	}
+
+	return entries, nil
+}
+
+// writeLazyIndex writes the lazy index referrer manifest of nydus manifest
+// into store. Nil is returned for the manifest without bootstrap layer and
+// the encrypted bootstrap.
+func writeLazyIndex(ctx context.Context, store content.Store, desc ocispec.Descriptor, inspector BlobInspector) (*ocispec.Descriptor, error) {
+	var manifest ocispec.Manifest
+	if err := readJSON(ctx, store, desc, &manifest); err != nil {
+		return nil, errors.Wrap(err, "read manifest")
+	}
+	if len(manifest.Layers) == 0 || manifest.Layers[len(manifest.Layers)-1].Annotations[utils.LayerAnnotationNydusBootstrap] != "true" {
+		return nil, nil
+	}
+	bootstrapDesc := manifest.Layers[len(manifest.Layers)-1]
+	if strings.HasSuffix(bootstrapDesc.MediaType, "+encrypted") {
+		log.G(ctx).Debugf("skip generating lazy index of encrypted bootstrap %s", bootstrapDesc.Digest)
+		return nil, nil
+	}
+
+	infos, err := inspectBlobs(ctx, store, bootstrapDesc, inspector)
+	if err != nil {
+		return nil, err
+	}
+	layers := map[string]ocispec.Descriptor{}
+	for _, layer := range manifest.Layers[:len(manifest.Layers)-1] {
+		layers[layer.Digest.Encoded()] = layer
+	}
+	index := LazyIndex{Bootstrap: bootstrapDesc, Blobs: make([]LazyIndexBlob, 0, len(infos))}
+	for _, info := range infos {
+		blob := LazyIndexBlob{Blob: Blob{BlobInfo: info}}
+		if layer, ok := layers[info.BlobID]; ok {
+			blob.Layer = &layer
+			// The blob layer isn't in store if it's mounted or skipped.
+			toc, err := readBlobToc(ctx, store, layer)
+			if err != nil && !errdefs.IsNotFound(err) {
+				return nil, errors.Wrapf(err, "read ToC of blob %s", info.BlobID)
+			}
+			blob.Toc = toc
+		}
+		index.Blobs = append(index.Blobs, blob)
+	}
+
+	indexDesc, err := writeJSON(ctx, store, index, MediaTypeNydusLazyIndex)
+	if err != nil {
+		return nil, errors.Wrap(err, "write lazy index")
+	}
+	referrerDesc, err := writeReferrer(ctx, store, desc, MediaTypeNydusLazyIndex, *indexDesc)
+	if err != nil {
+		return nil, errors.Wrap(err, "write lazy index manifest")
+	}
+	log.G(ctx).Infof("generated lazy index of %d blobs for manifest %s", len(index.Blobs), desc.Digest)
+
+	return referrerDesc, nil
+}
+
+// pushLazyIndexes generates and pushes the lazy index referrers of the nydus
+// manifests in target image by digest into the repository of ref.
+func (pvd *Provider) pushLazyIndexes(ctx context.Context, rc *containerd.RemoteContext, desc ocispec.Descriptor, ref string) error {
+	return pvd.pushReferrers(ctx, rc, desc, ref, "lazy index", func(manifest ocispec.Descriptor) (*ocispec.Descriptor, error) {
+		return writeLazyIndex(ctx, pvd.store, manifest, pvd.lazyIndexInspector)
+	})
+}
@@ -0,0 +1,124 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/checker/tool"
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+// writeTocBlob writes the nydus blob layer ended with the ToC of a zstd
+// compressed `blob.meta` entry.
+func writeTocBlob(t *testing.T, ctx context.Context, store content.Store) ocispec.Descriptor {
+	data := bytes.Repeat([]byte("chunk"), 200)
+
+	entry := make([]byte, blobTocEntrySize)
+	binary.LittleEndian.PutUint32(entry[0:4], 0x0002)
+	copy(entry[8:24], "blob.meta")
+	binary.LittleEndian.PutUint64(entry[56:64], 100)
+	binary.LittleEndian.PutUint64(entry[64:72], 200)
+	binary.LittleEndian.PutUint64(entry[72:80], 800)
+	data = append(data, entry...)
+
+	var header bytes.Buffer
+	require.NoError(t, tar.NewWriter(&header).WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     blobTocName,
+		Size:     blobTocEntrySize,
+		Mode:     0444,
+		Format:   tar.FormatGNU,
+	}))
+	data = append(data, header.Bytes()[:blobTocHeaderSize]...)
+
+	desc := ocispec.Descriptor{
+		MediaType: utils.MediaTypeNydusBlob,
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+	require.NoError(t, content.WriteBlob(ctx, store, desc.Digest.String(), bytes.NewReader(data), desc))
+	return desc
+}
+
+func TestPushLazyIndex(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+
+	tocBlob := writeTocBlob(t, ctx, pvd.store)
+	blob, err := writeJSON(ctx, pvd.store, map[string]string{"blob": "data"}, utils.MediaTypeNydusBlob)
+	require.NoError(t, err)
+	bootstrap := writeTarLayer(t, ctx, pvd.store, map[string]string{utils.BootstrapFileNameInLayer: "bootstrap"})
+	bootstrap.Annotations = map[string]string{utils.LayerAnnotationNydusBootstrap: "true"}
+	config, err := writeJSON(ctx, pvd.store, ocispec.Image{}, ocispec.MediaTypeImageConfig)
+	require.NoError(t, err)
+	manifest, err := writeJSON(ctx, pvd.store, ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    *config,
+		Layers:    []ocispec.Descriptor{tocBlob, *blob, bootstrap},
+	}, ocispec.MediaTypeImageManifest)
+	require.NoError(t, err)
+
+	// The blob stored in storage backend is referenced besides the layers.
+	const backendBlobID = "d4e5f6a7b8c9d0e1f2a3b4c5d6e7f8a9b0c1d2e3f4a5b6c7d8e9f0a1b2c3d4e5"
+	infos := tool.BlobInfoList{
+		{BlobID: tocBlob.Digest.Encoded(), CompressedSize: uint64(tocBlob.Size), ReadaheadSize: 4096},
+		{BlobID: blob.Digest.Encoded(), CompressedSize: uint64(blob.Size)},
+		{BlobID: backendBlobID, CompressedSize: 1024},
+	}
+	pvd.SetLazyIndex(blobInspector(func(option tool.InspectOption) (interface{}, error) {
+		return infos, nil
+	}))
+
+	registry := newPushableRegistry(t)
+	var referrers []ocispec.Manifest
+	registry.Override(recordReferrers(t, &referrers))
+	require.NoError(t, pvd.Push(ctx, *manifest, registry.host+"/lazy:latest"))
+	pushedDgst, _, ok := registry.Tag("lazy", "latest")
+	require.True(t, ok)
+
+	require.Len(t, referrers, 1)
+	referrer := referrers[0]
+	require.Equal(t, MediaTypeNydusLazyIndex, referrer.ArtifactType)
+	require.Equal(t, pushedDgst, referrer.Subject.Digest)
+	require.Len(t, referrer.Layers, 1)
+	require.Equal(t, MediaTypeNydusLazyIndex, referrer.Layers[0].MediaType)
+	data, ok := registry.Blob(referrer.Layers[0].Digest)
+	require.True(t, ok)
+
+	var index LazyIndex
+	require.NoError(t, json.Unmarshal(data, &index))
+	require.Equal(t, bootstrap.Digest, index.Bootstrap.Digest)
+	require.Len(t, index.Blobs, 3)
+	for idx, info := range infos {
+		require.Equal(t, info, index.Blobs[idx].BlobInfo)
+	}
+	require.Equal(t, tocBlob.Digest, index.Blobs[0].Layer.Digest)
+	require.Equal(t, []BlobTocEntry{{
+		Name:               "blob.meta",
+		Compressor:         "zstd",
+		UncompressedDigest: "sha256:" + string(bytes.Repeat([]byte("0"), 64)),
+		CompressedOffset:   100,
+		CompressedSize:     200,
+		UncompressedSize:   800,
+	}}, index.Blobs[0].Toc)
+	require.Equal(t, blob.Digest, index.Blobs[1].Layer.Digest)
+	require.Empty(t, index.Blobs[1].Toc)
+	require.Nil(t, index.Blobs[2].Layer)
+}
@@ -0,0 +1,42 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	humanize "github.com/dustin/go-humanize"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// checkBlobSize walks the image specified by desc and ensures no layer
+// exceeds maxBlobSize, so that an oversized blob is detected before any
+// content is pushed to the registry which caps the layer size.
+func checkBlobSize(ctx context.Context, store content.Store, desc ocispec.Descriptor, maxBlobSize int64) error {
+	handler := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		switch desc.MediaType {
+		case ocispec.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest,
+			ocispec.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList:
+			return images.Children(ctx, store, desc)
+		case ocispec.MediaTypeImageConfig, images.MediaTypeDockerSchema2Config:
+			return nil, nil
+		}
+		// The foreign layers are not pushed to registry.
+		if images.IsNonDistributable(desc.MediaType) {
+			return nil, nil
+		}
+		if desc.Size > maxBlobSize {
+			return nil, fmt.Errorf(
+				"blob %s size %s exceeds the maximum blob size %s, the bootstrap or a single large file can't be split, please use a storage backend",
+				desc.Digest, humanize.IBytes(uint64(desc.Size)), humanize.IBytes(uint64(maxBlobSize)),
+			)
+		}
+		return nil, nil
+	})
+	return images.Walk(ctx, handler, desc)
+}
@@ -0,0 +1,126 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// The formats of target manifest.
+const (
+	// ManifestFormatOCI produces the OCI image manifest, config and index.
+	ManifestFormatOCI = "oci"
+	// ManifestFormatDocker produces the Docker image manifest v2 schema 2,
+	// config and manifest list, for the registries rejecting OCI manifests.
+	ManifestFormatDocker = "docker"
+)
+
+// ManifestFormats are the formats accepted by SetManifestFormat.
+var ManifestFormats = []string{ManifestFormatOCI, ManifestFormatDocker}
+
+// dockerMediaTypes maps the OCI media types to the Docker media types of the
+// same content, the nydus blob layers keep their media type in both formats.
+// Docker defines no media type of zstd layer, the OCI zstd layers are kept in
+// the Docker manifests as Docker and containerd accept them.
+var dockerMediaTypes = map[string]string{
+	ocispec.MediaTypeImageIndex:     images.MediaTypeDockerSchema2ManifestList,
+	ocispec.MediaTypeImageManifest:  images.MediaTypeDockerSchema2Manifest,
+	ocispec.MediaTypeImageConfig:    images.MediaTypeDockerSchema2Config,
+	ocispec.MediaTypeImageLayer:     images.MediaTypeDockerSchema2Layer,
+	ocispec.MediaTypeImageLayerGzip: images.MediaTypeDockerSchema2LayerGzip,
+}
+
+// SetManifestFormat converts the manifests, configs and indexes of target
+// image with the media types of format, and the bootstrap layers alike,
+// empty format keeps the format of source image. The Docker format doesn't
+// support the subject of manifest, which fails the pushing.
+func (pvd *Provider) SetManifestFormat(format string) error {
+	if format != "" && format != ManifestFormatOCI && format != ManifestFormatDocker {
+		return fmt.Errorf("unsupported manifest format %s, possible values: %v", format, ManifestFormats)
+	}
+	pvd.manifestFormat = format
+	return nil
+}
+
+// formatMediaType returns mediaType in the style of format, the media type
+// unknown to the other format is kept as is.
+func formatMediaType(mediaType, format string) string {
+	for oci, docker := range dockerMediaTypes {
+		if format == ManifestFormatDocker && mediaType == oci {
+			return docker
+		}
+		if format == ManifestFormatOCI && mediaType == docker {
+			return oci
+		}
+	}
+	return mediaType
+}
+
+// setManifestFormat converts the manifest, its config and layers with the
+// media types of format.
+func setManifestFormat(desc *ocispec.Descriptor, manifest *ocispec.Manifest, format string) (bool, error) {
+	mediaType := formatMediaType(desc.MediaType, format)
+	if mediaType == desc.MediaType {
+		return false, nil
+	}
+	if format == ManifestFormatDocker && manifest.Subject != nil {
+		return false, fmt.Errorf("docker manifest doesn't support the subject of manifest %s", desc.Digest)
+	}
+
+	manifest.MediaType = mediaType
+	manifest.Config.MediaType = formatMediaType(manifest.Config.MediaType, format)
+	for idx, layer := range manifest.Layers {
+		manifest.Layers[idx].MediaType = formatMediaType(layer.MediaType, format)
+	}
+	if format == ManifestFormatDocker {
+		manifest.ArtifactType = ""
+		desc.ArtifactType = ""
+	}
+
+	return true, nil
+}
+
+// setFormat converts all the manifests in image and the image index to
+// format, see setManifestFormat.
+func setFormat(ctx context.Context, store content.Store, desc ocispec.Descriptor, format string) (*ocispec.Descriptor, error) {
+	newDesc, err := rewriteManifests(ctx, store, desc, nil, func(manifestDesc *ocispec.Descriptor, manifest *ocispec.Manifest) (bool, error) {
+		return setManifestFormat(manifestDesc, manifest, format)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !images.IsIndexType(desc.MediaType) {
+		return newDesc, nil
+	}
+	mediaType := formatMediaType(desc.MediaType, format)
+	if mediaType == desc.MediaType {
+		return newDesc, nil
+	}
+
+	var index ocispec.Index
+	if err := readJSON(ctx, store, *newDesc, &index); err != nil {
+		return nil, errors.Wrap(err, "read image index")
+	}
+	if format == ManifestFormatDocker {
+		if index.Subject != nil {
+			return nil, fmt.Errorf("docker manifest list doesn't support the subject of index %s", desc.Digest)
+		}
+		index.ArtifactType = ""
+	}
+	index.MediaType = mediaType
+
+	indexDesc, err := writeJSON(ctx, store, index, mediaType)
+	if err != nil {
+		return nil, errors.Wrap(err, "write image index")
+	}
+	indexDesc.Annotations = desc.Annotations
+	return indexDesc, nil
+}
@@ -0,0 +1,73 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+func TestPushManifestFormat(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+	require.Error(t, pvd.SetManifestFormat("schema1"))
+	manifest, blob, bootstrap := writeNydusImage(t, ctx, pvd)
+	require.Equal(t, ocispec.MediaTypeImageManifest, manifest.MediaType)
+
+	registry := newPushableRegistry(t)
+	pushed := func(tag string) (string, ocispec.Manifest) {
+		dgst, data, ok := registry.Tag("format", tag)
+		require.True(t, ok)
+		var pushed ocispec.Manifest
+		require.NoError(t, json.Unmarshal(data, &pushed))
+		registry.mutex.Lock()
+		defer registry.mutex.Unlock()
+		return registry.mediaTypes[dgst], pushed
+	}
+
+	// The manifest, config and bootstrap layer use the Docker media types,
+	// the nydus blob layer keeps its media type.
+	require.NoError(t, pvd.SetManifestFormat(ManifestFormatDocker))
+	require.NoError(t, pvd.Push(ctx, manifest, registry.host+"/format:docker"))
+	mediaType, docker := pushed("docker")
+	require.Equal(t, images.MediaTypeDockerSchema2Manifest, mediaType)
+	require.Equal(t, images.MediaTypeDockerSchema2Manifest, docker.MediaType)
+	require.Equal(t, images.MediaTypeDockerSchema2Config, docker.Config.MediaType)
+	require.Len(t, docker.Layers, 2)
+	require.Equal(t, blob.Digest, docker.Layers[0].Digest)
+	require.Equal(t, utils.MediaTypeNydusBlob, docker.Layers[0].MediaType)
+	require.Equal(t, bootstrap.Digest, docker.Layers[1].Digest)
+	require.Equal(t, images.MediaTypeDockerSchema2LayerGzip, docker.Layers[1].MediaType)
+	require.Equal(t, "true", docker.Layers[1].Annotations[utils.LayerAnnotationNydusBootstrap])
+
+	// The Docker image is converted back to the OCI image.
+	dockerDesc, err := pvd.Image(ctx, registry.host+"/format:docker")
+	require.NoError(t, err)
+	require.NoError(t, pvd.SetManifestFormat(ManifestFormatOCI))
+	require.NoError(t, pvd.Push(ctx, *dockerDesc, registry.host+"/format:oci"))
+	mediaType, oci := pushed("oci")
+	require.Equal(t, ocispec.MediaTypeImageManifest, mediaType)
+	require.Equal(t, ocispec.MediaTypeImageConfig, oci.Config.MediaType)
+	require.Equal(t, utils.MediaTypeNydusBlob, oci.Layers[0].MediaType)
+	require.Equal(t, ocispec.MediaTypeImageLayerGzip, oci.Layers[1].MediaType)
+
+	// The subject isn't supported by Docker manifest.
+	var withSubject ocispec.Manifest
+	require.NoError(t, readJSON(ctx, pvd.store, manifest, &withSubject))
+	withSubject.Subject = &manifest
+	subjectDesc, err := writeJSON(ctx, pvd.store, withSubject, manifest.MediaType)
+	require.NoError(t, err)
+	require.NoError(t, pvd.SetManifestFormat(ManifestFormatDocker))
+	require.Error(t, pvd.Push(ctx, *subjectDesc, registry.host+"/format:subject"))
+}
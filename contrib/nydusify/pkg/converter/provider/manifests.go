@@ -0,0 +1,133 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// manifestRewriter rewrites the manifest of desc in place, the fields of
+// desc referred by image index, e.g. the platform, may be changed as well.
+// It returns false if nothing is changed, then the manifest is kept as is.
+type manifestRewriter func(desc *ocispec.Descriptor, manifest *ocispec.Manifest) (bool, error)
+
+// rewriteManifest rewrites the manifest of desc by rewrite, the new manifest
+// is written with the media type of manifest, which may be changed by
+// rewrite, the annotations and platform of desc are kept. It returns false
+// if neither the manifest nor desc is changed.
+func rewriteManifest(ctx context.Context, store content.Store, desc ocispec.Descriptor, rewrite manifestRewriter) (*ocispec.Descriptor, bool, error) {
+	var manifest ocispec.Manifest
+	if err := readJSON(ctx, store, desc, &manifest); err != nil {
+		return nil, false, errors.Wrap(err, "read manifest")
+	}
+	newDesc := desc
+	changed, err := rewrite(&newDesc, &manifest)
+	if err != nil {
+		return nil, false, err
+	}
+	if !changed {
+		return &desc, false, nil
+	}
+
+	mediaType := desc.MediaType
+	if manifest.MediaType != "" {
+		mediaType = manifest.MediaType
+	}
+	manifestDesc, err := writeJSON(ctx, store, manifest, mediaType)
+	if err != nil {
+		return nil, false, errors.Wrap(err, "write manifest")
+	}
+	newDesc.MediaType = manifestDesc.MediaType
+	newDesc.Digest = manifestDesc.Digest
+	newDesc.Size = manifestDesc.Size
+	if reflect.DeepEqual(newDesc, desc) {
+		return &desc, false, nil
+	}
+
+	return &newDesc, true, nil
+}
+
+// rewriteManifests rewrites the manifest of desc, or all the manifests in
+// the image index of desc matched by platformMC, by rewrite. All manifests
+// are rewritten if platformMC is nil. The index is rewritten only if any of
+// its manifests is changed.
+func rewriteManifests(ctx context.Context, store content.Store, desc ocispec.Descriptor, platformMC platforms.Matcher, rewrite manifestRewriter) (*ocispec.Descriptor, error) {
+	switch desc.MediaType {
+	case ocispec.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList:
+		var index ocispec.Index
+		if err := readJSON(ctx, store, desc, &index); err != nil {
+			return nil, errors.Wrap(err, "read image index")
+		}
+		changed := false
+		for idx, manifest := range index.Manifests {
+			if platformMC != nil && manifest.Platform != nil && !platformMC.Match(*manifest.Platform) {
+				continue
+			}
+			newDesc, rewritten, err := rewriteManifest(ctx, store, manifest, rewrite)
+			if err != nil {
+				return nil, errors.Wrapf(err, "rewrite manifest %s", manifest.Digest)
+			}
+			if rewritten {
+				index.Manifests[idx] = *newDesc
+				changed = true
+			}
+		}
+		if !changed {
+			return &desc, nil
+		}
+
+		indexDesc, err := writeJSON(ctx, store, index, desc.MediaType)
+		if err != nil {
+			return nil, errors.Wrap(err, "write image index")
+		}
+		indexDesc.Annotations = desc.Annotations
+		return indexDesc, nil
+	case ocispec.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest:
+		newDesc, _, err := rewriteManifest(ctx, store, desc, rewrite)
+		return newDesc, err
+	}
+
+	return nil, fmt.Errorf("unsupported media type %s", desc.MediaType)
+}
+
+// rewriteSourceManifests rewrites the manifests of source image pulled into
+// store by rewrite, only the manifests matched by platform are rewritten
+// since the others are not pulled. The original digests of the rewritten
+// manifests are recorded, see recordRewrittenSource.
+func (pvd *Provider) rewriteSourceManifests(ctx context.Context, desc ocispec.Descriptor, rewrite manifestRewriter) (*ocispec.Descriptor, error) {
+	newDesc, err := rewriteManifests(ctx, pvd.store, desc, pvd.platformMC, rewrite)
+	if err != nil || newDesc.Digest == desc.Digest {
+		return newDesc, err
+	}
+
+	switch desc.MediaType {
+	case ocispec.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList:
+		// The manifests are rewritten in place of index.
+		var index, newIndex ocispec.Index
+		if err := readJSON(ctx, pvd.store, desc, &index); err != nil {
+			return nil, errors.Wrap(err, "read image index")
+		}
+		if err := readJSON(ctx, pvd.store, *newDesc, &newIndex); err != nil {
+			return nil, errors.Wrap(err, "read image index")
+		}
+		for idx, manifest := range index.Manifests {
+			if newIndex.Manifests[idx].Digest != manifest.Digest {
+				pvd.recordRewrittenSource(newIndex.Manifests[idx].Digest, manifest.Digest)
+			}
+		}
+	default:
+		pvd.recordRewrittenSource(newDesc.Digest, desc.Digest)
+	}
+
+	return newDesc, nil
+}
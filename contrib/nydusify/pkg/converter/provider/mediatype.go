@@ -0,0 +1,77 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+// BlobMediaTypes are the media types accepted for the nydus blob layer, the
+// nydus snapshotter identifies the blob layer by the annotation
+// `containerd.io/snapshot/nydus-blob`, while some snapshotter versions or
+// registries only accept the plain tar layer types.
+var BlobMediaTypes = []string{
+	utils.MediaTypeNydusBlob,
+	ocispec.MediaTypeImageLayer,
+	images.MediaTypeDockerSchema2Layer,
+}
+
+// SetBlobMediaType overrides the media type of nydus blob layers in target
+// image, empty mediaType keeps the media type set by builder.
+func (pvd *Provider) SetBlobMediaType(mediaType string) error {
+	if mediaType != "" {
+		valid := false
+		for _, known := range BlobMediaTypes {
+			if mediaType == known {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return fmt.Errorf("unsupported blob media type %s, possible values: %v", mediaType, BlobMediaTypes)
+		}
+	}
+	pvd.blobMediaType = mediaType
+	return nil
+}
+
+// setManifestBlobMediaType sets the media type of nydus blob layers in
+// manifest, the blob layers are always annotated as nydus blob, so that
+// they are still recognized with the plain tar layer type.
+func setManifestBlobMediaType(manifest *ocispec.Manifest, mediaType string) bool {
+	changed := false
+	for idx, layer := range manifest.Layers {
+		if layer.MediaType != utils.MediaTypeNydusBlob && layer.Annotations[utils.LayerAnnotationNydusBlob] != "true" {
+			continue
+		}
+		if layer.MediaType == mediaType && layer.Annotations[utils.LayerAnnotationNydusBlob] == "true" {
+			continue
+		}
+		annotations := map[string]string{}
+		for key, value := range layer.Annotations {
+			annotations[key] = value
+		}
+		annotations[utils.LayerAnnotationNydusBlob] = "true"
+		manifest.Layers[idx].MediaType = mediaType
+		manifest.Layers[idx].Annotations = annotations
+		changed = true
+	}
+	return changed
+}
+
+// setBlobMediaType sets the media type of nydus blob layers of all the
+// manifests in target image.
+func setBlobMediaType(ctx context.Context, store content.Store, desc ocispec.Descriptor, mediaType string) (*ocispec.Descriptor, error) {
+	return rewriteManifests(ctx, store, desc, nil, func(_ *ocispec.Descriptor, manifest *ocispec.Manifest) (bool, error) {
+		return setManifestBlobMediaType(manifest, mediaType), nil
+	})
+}
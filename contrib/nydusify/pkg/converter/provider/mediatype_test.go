@@ -0,0 +1,42 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+func TestPushBlobMediaType(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+	require.Error(t, pvd.SetBlobMediaType(ocispec.MediaTypeImageLayerGzip))
+	require.NoError(t, pvd.SetBlobMediaType(ocispec.MediaTypeImageLayer))
+	manifest, blob, bootstrap := writeNydusImage(t, ctx, pvd)
+
+	registry := newPushableRegistry(t)
+	require.NoError(t, pvd.Push(ctx, manifest, registry.host+"/override:latest"))
+	_, data, ok := registry.Tag("override", "latest")
+	require.True(t, ok)
+	var pushed ocispec.Manifest
+	require.NoError(t, json.Unmarshal(data, &pushed))
+
+	// The blob layer is still annotated as nydus blob with the overridden
+	// media type, the bootstrap layer is kept as is.
+	require.Len(t, pushed.Layers, 2)
+	require.Equal(t, blob.Digest, pushed.Layers[0].Digest)
+	require.Equal(t, ocispec.MediaTypeImageLayer, pushed.Layers[0].MediaType)
+	require.Equal(t, "true", pushed.Layers[0].Annotations[utils.LayerAnnotationNydusBlob])
+	require.Equal(t, bootstrap.MediaType, pushed.Layers[1].MediaType)
+}
@@ -0,0 +1,147 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"net"
+	"net/http"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/labels"
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/containerd/containerd/remotes"
+	dockerremote "github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/log"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// SetMountFrom mounts the blobs from the repository, like
+// `registry.example.com/library/nginx`, instead of uploading them if the
+// repository is on the same registry of target. The blob is uploaded as
+// usual if the registry refuses to mount it, for example, the blob doesn't
+// exist in the repository or the repository isn't readable, empty means not
+// to mount. The mount requests are authorized with the credential of
+// repository by the host function of provider, see mountAuthorizer.
+func (pvd *Provider) SetMountFrom(repository string) error {
+	if repository == "" {
+		pvd.mountFrom = nil
+		return nil
+	}
+	named, err := docker.ParseNormalizedNamed(repository)
+	if err != nil {
+		return errors.Wrapf(err, "parse mount repository %s", repository)
+	}
+	if !docker.IsNameOnly(named) {
+		return errors.Errorf("mount repository %s should not have tag or digest", repository)
+	}
+	pvd.mountFrom = &mountSource{ref: repository, domain: docker.Domain(named), path: docker.Path(named)}
+	return nil
+}
+
+// mountSource is the repository to mount blobs from, ref is the repository
+// as specified to resolve its credential.
+type mountSource struct {
+	ref    string
+	domain string
+	path   string
+}
+
+// mountAuthorizer authorizes the requests mounting blobs across
+// repositories by the mount authorizer, since the mount source may require
+// a credential differs from the target. The registry authorizes the mount by
+// a single token with the pull scope of source and the push scope of target
+// repository, so the credential of mount source needs both, the other
+// requests are authorized as usual.
+type mountAuthorizer struct {
+	dockerremote.Authorizer
+	mount dockerremote.Authorizer
+}
+
+func isMountRequest(req *http.Request) bool {
+	return req != nil && req.Method == http.MethodPost && req.URL.Query().Get("mount") != ""
+}
+
+func (authorizer *mountAuthorizer) Authorize(ctx context.Context, req *http.Request) error {
+	if isMountRequest(req) {
+		return authorizer.mount.Authorize(ctx, req)
+	}
+	return authorizer.Authorizer.Authorize(ctx, req)
+}
+
+func (authorizer *mountAuthorizer) AddResponses(ctx context.Context, responses []*http.Response) error {
+	if len(responses) > 0 && isMountRequest(responses[len(responses)-1].Request) {
+		return authorizer.mount.AddResponses(ctx, responses)
+	}
+	return authorizer.Authorizer.AddResponses(ctx, responses)
+}
+
+func (pvd *Provider) mountResolver(resolver remotes.Resolver) remotes.Resolver {
+	if pvd.mountFrom == nil {
+		return resolver
+	}
+	return &mountResolver{Resolver: resolver, from: pvd.mountFrom}
+}
+
+// mountResolver annotates the blobs pushed to the registry of repository
+// from with the distribution source, so that the docker pusher tries to
+// mount them from the repository before uploading.
+type mountResolver struct {
+	remotes.Resolver
+	from *mountSource
+}
+
+func (resolver *mountResolver) Pusher(ctx context.Context, ref string) (remotes.Pusher, error) {
+	pusher, err := resolver.Resolver.Pusher(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	named, err := docker.ParseDockerRef(ref)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse reference %s", ref)
+	}
+	domain := docker.Domain(named)
+	if domain != resolver.from.domain {
+		log.G(ctx).Debugf("skip mounting blobs from %s/%s to %s on other registry", resolver.from.domain, resolver.from.path, named.Name())
+		return pusher, nil
+	}
+	if docker.Path(named) == resolver.from.path {
+		return pusher, nil
+	}
+	// The label key is suffixed with the registry host without port.
+	host := domain
+	if h, _, err := net.SplitHostPort(domain); err == nil {
+		host = h
+	}
+	return &mountPusher{
+		Pusher: pusher,
+		key:    labels.LabelDistributionSource + "." + host,
+		from:   resolver.from.path,
+	}, nil
+}
+
+type mountPusher struct {
+	remotes.Pusher
+	key  string
+	from string
+}
+
+func (pusher *mountPusher) Push(ctx context.Context, desc ocispec.Descriptor) (content.Writer, error) {
+	switch desc.MediaType {
+	case ocispec.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest,
+		ocispec.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList:
+		return pusher.Pusher.Push(ctx, desc)
+	}
+	annotations := make(map[string]string, len(desc.Annotations)+1)
+	for key, value := range desc.Annotations {
+		annotations[key] = value
+	}
+	// The mount repository replaces the sources recorded by pulling.
+	annotations[pusher.key] = pusher.from
+	desc.Annotations = annotations
+	return pusher.Pusher.Push(ctx, desc)
+}
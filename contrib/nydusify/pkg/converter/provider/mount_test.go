@@ -0,0 +1,234 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	"github.com/goharbor/acceleration-service/pkg/remote"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+func TestPushMountBlob(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+	config, err := writeJSON(ctx, pvd.store, ocispec.Image{Platform: ocispec.Platform{OS: "linux", Architecture: "amd64"}}, ocispec.MediaTypeImageConfig)
+	require.NoError(t, err)
+	blob, err := writeJSON(ctx, pvd.store, map[string]string{"blob": "data"}, utils.MediaTypeNydusBlob)
+	require.NoError(t, err)
+	manifest, err := writeJSON(ctx, pvd.store, ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    *config,
+		Layers:    []ocispec.Descriptor{*blob},
+	}, ocispec.MediaTypeImageManifest)
+	require.NoError(t, err)
+
+	registry := newPushableRegistry(t)
+	registry.ScopeBlobs()
+	var uploaded []digest.Digest
+	registry.Override(recordBlobs(&uploaded))
+	blobData, err := content.ReadBlob(ctx, pvd.store, *blob)
+	require.NoError(t, err)
+	registry.AddRepoBlob("library/source", utils.MediaTypeNydusBlob, blobData)
+
+	// The blob existing in the source repository is mounted.
+	require.NoError(t, pvd.SetMountFrom(registry.host+"/library/source"))
+	require.NoError(t, pvd.Push(ctx, *manifest, registry.host+"/library/target:latest"))
+	require.Equal(t, 1, registry.Mounts())
+	require.NotContains(t, uploaded, blob.Digest)
+	require.Contains(t, uploaded, config.Digest)
+
+	// The blob is uploaded if it can't be mounted.
+	uploaded = nil
+	require.NoError(t, pvd.SetMountFrom(registry.host+"/library/empty"))
+	require.NoError(t, pvd.Push(ctx, *manifest, registry.host+"/library/other:latest"))
+	require.Equal(t, 1, registry.Mounts())
+	require.Contains(t, uploaded, blob.Digest)
+
+	require.Error(t, pvd.SetMountFrom(registry.host+"/library/source:latest"))
+}
+
+func TestPushMountBlobWithAuth(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+
+	// The token service grants the requested scopes permitted to accounts,
+	// only reader can pull the mount source repository.
+	accounts := map[string]map[string]string{
+		"writer:write-secret": {"library/target": "pull,push", "library/other": "pull,push"},
+		"reader:read-secret":  {"library/source": "pull", "library/target": "pull,push", "library/other": "pull,push"},
+	}
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, _ := r.BasicAuth()
+		scopes := r.URL.Query()["scope"]
+		if r.Method == http.MethodPost {
+			if err := r.ParseForm(); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			username, password = r.PostForm.Get("username"), r.PostForm.Get("password")
+			scopes = strings.Fields(r.PostForm.Get("scope"))
+		}
+		grants, ok := accounts[username+":"+password]
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var granted []string
+		for _, scope := range scopes {
+			parts := strings.Split(scope, ":")
+			if len(parts) != 3 {
+				continue
+			}
+			for _, action := range strings.Split(parts[2], ",") {
+				if strings.Contains(grants[parts[1]], action) {
+					granted = append(granted, parts[1]+":"+action)
+				}
+			}
+		}
+		token := base64.RawURLEncoding.EncodeToString([]byte(strings.Join(granted, " ")))
+		_ = json.NewEncoder(w).Encode(map[string]string{"token": token, "access_token": token})
+	}))
+	defer tokenServer.Close()
+
+	registry := newPushableRegistry(t)
+	registry.ScopeBlobs()
+	authorize := func(w http.ResponseWriter, r *http.Request, serve http.HandlerFunc) {
+		name, kind, _ := parseRequest(r)
+		if kind == "" {
+			serve(w, r)
+			return
+		}
+		granted := map[string]bool{}
+		if token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); token != "" {
+			data, _ := base64.RawURLEncoding.DecodeString(token)
+			for _, grant := range strings.Fields(string(data)) {
+				granted[grant] = true
+			}
+		}
+		action := "pull"
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			action = "push"
+		}
+		if !granted[name+":"+action] {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test",scope="repository:%s:pull,push"`, tokenServer.URL, name))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		// The mount is ignored without the pull scope of source repository,
+		// like the distribution registry.
+		if from := r.URL.Query().Get("from"); from != "" && !granted[from+":pull"] {
+			r.URL.RawQuery = ""
+		}
+		serve(w, r)
+	}
+	var uploaded []digest.Digest
+	registry.Override(authorize, recordBlobs(&uploaded))
+
+	mountRef := registry.host + "/library/source"
+	mountAuth := "reader:read-secret"
+	hosts := func(ref string) (remote.CredentialFunc, bool, error) {
+		auth := "writer:write-secret"
+		if ref == mountRef {
+			auth = mountAuth
+		}
+		username, password, _ := strings.Cut(auth, ":")
+		return func(string) (string, string, error) { return username, password, nil }, false, nil
+	}
+	pvd, err := New(t.TempDir(), hosts, 200, "v1", platforms.All, 0)
+	require.NoError(t, err)
+	pvd.UsePlainHTTP()
+	manifest, blob, _ := writeNydusImage(t, ctx, pvd)
+	blobData, err := content.ReadBlob(ctx, pvd.store, blob)
+	require.NoError(t, err)
+	registry.AddRepoBlob("library/source", utils.MediaTypeNydusBlob, blobData)
+	require.NoError(t, pvd.SetMountFrom(mountRef))
+
+	// The blob is mounted with the credential of mount source, the other
+	// content is pushed with the credential of target.
+	require.NoError(t, pvd.Push(ctx, manifest, registry.host+"/library/target:latest"))
+	require.Equal(t, 1, registry.Mounts())
+	require.NotContains(t, uploaded, blob.Digest)
+	require.NotEmpty(t, uploaded)
+	_, _, ok := registry.Tag("library/target", "latest")
+	require.True(t, ok)
+
+	// The credential of target can't read the mount source, the blob is
+	// uploaded instead.
+	uploaded = nil
+	mountAuth = "writer:write-secret"
+	require.NoError(t, pvd.Push(ctx, manifest, registry.host+"/library/other:latest"))
+	require.Equal(t, 1, registry.Mounts())
+	require.Contains(t, uploaded, blob.Digest)
+}
+
+func TestPushAcrossRepositories(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+
+	source := newPushableRegistry(t)
+	source.ScopeBlobs()
+	config := source.AddRepoBlob("a/b", ocispec.MediaTypeImageConfig, []byte(`{"architecture":"amd64","os":"linux"}`))
+	layer := source.AddRepoBlob("a/b", ocispec.MediaTypeImageLayerGzip, []byte("layer data"))
+	manifestData, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []ocispec.Descriptor{layer},
+	})
+	require.NoError(t, err)
+	manifest := source.AddBlob(ocispec.MediaTypeImageManifest, manifestData)
+	source.SetTag("a/b", "tag", manifest.Digest)
+
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+	sourceRef := source.host + "/a/b:tag"
+	require.NoError(t, pvd.Pull(ctx, sourceRef))
+	desc, err := pvd.Image(ctx, sourceRef)
+	require.NoError(t, err)
+
+	// The blobs pulled from the source registry are uploaded to the target
+	// registry, rather than mounted from the source repository.
+	target := newPushableRegistry(t)
+	target.ScopeBlobs()
+	require.NoError(t, pvd.Push(ctx, *desc, target.host+"/c/d:tag-nydus"))
+	dgst, _, ok := target.Tag("c/d", "tag-nydus")
+	require.True(t, ok)
+	require.Equal(t, manifest.Digest, dgst)
+	require.Zero(t, target.Mounts())
+	target.mutex.Lock()
+	require.True(t, target.hasRepoBlob("c/d", config.Digest))
+	require.True(t, target.hasRepoBlob("c/d", layer.Digest))
+	target.mutex.Unlock()
+	_, err = pvd.Image(ctx, target.host+"/c/d:tag-nydus")
+	require.NoError(t, err)
+
+	// The blobs are mounted from the source repository into the target
+	// repository on the same registry.
+	require.NoError(t, pvd.Push(ctx, *desc, source.host+"/c/d:tag-nydus"))
+	dgst, _, ok = source.Tag("c/d", "tag-nydus")
+	require.True(t, ok)
+	require.Equal(t, manifest.Digest, dgst)
+	require.Equal(t, 2, source.Mounts())
+	source.mutex.Lock()
+	require.True(t, source.hasRepoBlob("c/d", config.Digest))
+	require.True(t, source.hasRepoBlob("c/d", layer.Digest))
+	source.mutex.Unlock()
+}
@@ -0,0 +1,119 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"bytes"
+	"context"
+	"path"
+	"text/template"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/reference/docker"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+// LayerName is the data to render the layer name template.
+type LayerName struct {
+	// Type is the layer type: "blob" or "bootstrap".
+	Type string
+	// Digest is the sha256 digest of layer, e.g. "sha256:e3b0c44298fc...".
+	Digest string
+	// ShortDigest is the first 12 hex characters of layer digest.
+	ShortDigest string
+	// Image is the short name of target image, e.g. "nginx" for
+	// "docker.io/library/nginx:latest-nydus".
+	Image string
+	// Index is the index of layer in the nydus manifest.
+	Index int
+}
+
+// SetLayerNameTemplate names the nydus blob and bootstrap layers of target
+// image by the text/template tmpl rendered with LayerName, the name is set
+// as the "org.opencontainers.image.title" annotation of layer, for example
+// `{{.Image}}-{{.Type}}-{{.ShortDigest}}`. The empty tmpl disables naming.
+func (pvd *Provider) SetLayerNameTemplate(tmpl string) error {
+	if tmpl == "" {
+		pvd.layerNameTemplate = nil
+		return nil
+	}
+	parsed, err := template.New("layer-name").Parse(tmpl)
+	if err != nil {
+		return errors.Wrapf(err, "parse layer name template %q", tmpl)
+	}
+	// Reject the template referring unknown fields before any conversion.
+	if _, err := renderLayerName(parsed, LayerName{Digest: "sha256:"}); err != nil {
+		return err
+	}
+	pvd.layerNameTemplate = parsed
+	return nil
+}
+
+func renderLayerName(tmpl *template.Template, name LayerName) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, name); err != nil {
+		return "", errors.Wrap(err, "render layer name")
+	}
+	return buf.String(), nil
+}
+
+// setManifestLayerNames annotates the nydus layers of manifest with the
+// names rendered by tmpl, the other layers are kept as is.
+func setManifestLayerNames(manifest *ocispec.Manifest, tmpl *template.Template, image string) (bool, error) {
+	changed := false
+	for idx, layer := range manifest.Layers {
+		var layerType string
+		switch {
+		case layer.Annotations[utils.LayerAnnotationNydusBootstrap] == "true":
+			layerType = "bootstrap"
+		case layer.MediaType == utils.MediaTypeNydusBlob || layer.Annotations[utils.LayerAnnotationNydusBlob] == "true":
+			layerType = "blob"
+		default:
+			continue
+		}
+		shortDigest := layer.Digest.Encoded()
+		if len(shortDigest) > 12 {
+			shortDigest = shortDigest[:12]
+		}
+		name, err := renderLayerName(tmpl, LayerName{
+			Type:        layerType,
+			Digest:      layer.Digest.String(),
+			ShortDigest: shortDigest,
+			Image:       image,
+			Index:       idx,
+		})
+		if err != nil {
+			return false, err
+		}
+		if layer.Annotations[ocispec.AnnotationTitle] == name {
+			continue
+		}
+		annotations := map[string]string{}
+		for key, value := range layer.Annotations {
+			annotations[key] = value
+		}
+		annotations[ocispec.AnnotationTitle] = name
+		manifest.Layers[idx].Annotations = annotations
+		changed = true
+	}
+	return changed, nil
+}
+
+// setLayerNames names the nydus layers of all the manifests in target image
+// of ref by tmpl.
+func setLayerNames(ctx context.Context, store content.Store, desc ocispec.Descriptor, tmpl *template.Template, ref string) (*ocispec.Descriptor, error) {
+	named, err := docker.ParseDockerRef(ref)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse reference %s", ref)
+	}
+	image := path.Base(named.Name())
+
+	return rewriteManifests(ctx, store, desc, nil, func(_ *ocispec.Descriptor, manifest *ocispec.Manifest) (bool, error) {
+		return setManifestLayerNames(manifest, tmpl, image)
+	})
+}
@@ -0,0 +1,74 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"archive/tar"
+	"time"
+)
+
+// TarNormalization normalizes the metadata of the entries in source layers
+// before building, so that the layers of the same files built by different
+// builders are converted to the same nydus blobs. The layers are rewritten
+// in the same tar format if any normalization is set.
+type TarNormalization struct {
+	// UID and GID force the owner of entries if they're set, the owner
+	// names are removed so that only the numeric owner is kept.
+	UID *int
+	GID *int
+	// MaxModTime clamps the modification time of entries later than it if
+	// it's set, the access and change times are removed.
+	MaxModTime *time.Time
+	// Modes normalizes the permission of directories and executable files to
+	// 0755 and the others to 0644, with the setuid, setgid and sticky bits
+	// removed. The permission of symlinks is kept.
+	Modes bool
+}
+
+// The PAX records overriding the normalized header fields.
+var normalizedPAXRecords = []string{"uid", "gid", "uname", "gname", "mtime", "atime", "ctime"}
+
+// SetTarNormalization normalizes the entries of source layers after pulling
+// by normalization, nil means not to normalize.
+func (pvd *Provider) SetTarNormalization(normalization *TarNormalization) {
+	pvd.tarNormalization = normalization
+}
+
+// rewriter returns the header rewriter of normalization, or nil if nothing
+// is normalized.
+func (normalization *TarNormalization) rewriter() headerRewriter {
+	if normalization == nil || (normalization.UID == nil && normalization.GID == nil &&
+		normalization.MaxModTime == nil && !normalization.Modes) {
+		return nil
+	}
+	return func(hdr *tar.Header) (bool, bool) {
+		if normalization.UID != nil {
+			hdr.Uid, hdr.Uname = *normalization.UID, ""
+		}
+		if normalization.GID != nil {
+			hdr.Gid, hdr.Gname = *normalization.GID, ""
+		}
+		if normalization.MaxModTime != nil {
+			if hdr.ModTime.After(*normalization.MaxModTime) {
+				hdr.ModTime = *normalization.MaxModTime
+			}
+			hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+		}
+		if normalization.Modes && hdr.Typeflag != tar.TypeSymlink {
+			if hdr.Typeflag == tar.TypeDir || hdr.Mode&0111 != 0 {
+				hdr.Mode = 0755
+			} else {
+				hdr.Mode = 0644
+			}
+		}
+		for _, key := range normalizedPAXRecords {
+			delete(hdr.PAXRecords, key)
+		}
+		// The entry is always rewritten in the format selected by its
+		// fields, the format of builder isn't kept.
+		hdr.Format = tar.FormatUnknown
+		return true, true
+	}
+}
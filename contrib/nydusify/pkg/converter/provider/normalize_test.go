@@ -0,0 +1,109 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/archive/compression"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func writeHeaderLayer(t testing.TB, ctx context.Context, store content.Store, hdrs []*tar.Header) ocispec.Descriptor {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, hdr := range hdrs {
+		require.NoError(t, tw.WriteHeader(hdr))
+		if hdr.Typeflag == tar.TypeReg {
+			_, err := tw.Write(bytes.Repeat([]byte("x"), int(hdr.Size)))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromBytes(buf.Bytes()),
+		Size:      int64(buf.Len()),
+	}
+	require.NoError(t, content.WriteBlob(ctx, store, desc.Digest.String(), bytes.NewReader(buf.Bytes()), desc))
+	return desc
+}
+
+func TestTarNormalization(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+	epoch := time.Unix(1700000000, 0)
+
+	// The same files built by different builders, with named or numeric
+	// owners, various modes and times, in GNU or PAX format.
+	first := writeHeaderLayer(t, ctx, pvd.store, []*tar.Header{
+		{Name: "usr/", Typeflag: tar.TypeDir, Mode: 0775, Uid: 1000, Gid: 1000, Uname: "builder", Gname: "builder", ModTime: epoch.Add(time.Hour), Format: tar.FormatGNU},
+		{Name: "usr/bin/app", Typeflag: tar.TypeReg, Mode: 04775, Size: 3, Uid: 1000, Gid: 1000, Uname: "builder", Gname: "builder", ModTime: epoch.Add(time.Hour), Format: tar.FormatGNU},
+		{Name: "usr/share/doc", Typeflag: tar.TypeReg, Mode: 0664, Size: 5, Uid: 1000, Gid: 1000, Uname: "builder", Gname: "builder", ModTime: epoch.Add(-time.Hour), Format: tar.FormatGNU},
+		{Name: "usr/bin/link", Typeflag: tar.TypeSymlink, Linkname: "app", Mode: 0777, ModTime: epoch.Add(time.Hour), Format: tar.FormatGNU},
+	})
+	second := writeHeaderLayer(t, ctx, pvd.store, []*tar.Header{
+		{Name: "usr/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: epoch.Add(time.Minute + time.Millisecond), AccessTime: epoch, Format: tar.FormatPAX},
+		{Name: "usr/bin/app", Typeflag: tar.TypeReg, Mode: 0700, Size: 3, ModTime: epoch.Add(time.Minute), Format: tar.FormatPAX},
+		{Name: "usr/share/doc", Typeflag: tar.TypeReg, Mode: 0644, Size: 5, ModTime: epoch.Add(-time.Hour), Format: tar.FormatPAX},
+		{Name: "usr/bin/link", Typeflag: tar.TypeSymlink, Linkname: "app", Mode: 0777, ModTime: epoch.Add(time.Minute), Format: tar.FormatPAX},
+	})
+	require.NotEqual(t, first.Digest, second.Digest)
+
+	uid, gid := 0, 0
+	pvd.SetTarNormalization(&TarNormalization{UID: &uid, GID: &gid, MaxModTime: &epoch, Modes: true})
+	rewrite := pvd.layerRewriter(ctx)
+	require.NotNil(t, rewrite)
+	firstLayer, firstDiffID, err := rewriteLayer(ctx, pvd.store, first, rewrite, false)
+	require.NoError(t, err)
+	secondLayer, secondDiffID, err := rewriteLayer(ctx, pvd.store, second, rewrite, false)
+	require.NoError(t, err)
+	require.Equal(t, firstLayer.Digest, secondLayer.Digest)
+	require.Equal(t, firstDiffID, secondDiffID)
+
+	ra, err := pvd.store.ReaderAt(ctx, *firstLayer)
+	require.NoError(t, err)
+	defer ra.Close()
+	reader, err := compression.DecompressStream(content.NewReader(ra))
+	require.NoError(t, err)
+	defer reader.Close()
+	modes := map[string]int64{}
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		require.Equal(t, 0, hdr.Uid)
+		require.Empty(t, hdr.Uname)
+		require.False(t, hdr.ModTime.After(epoch))
+		modes[hdr.Name] = hdr.Mode
+	}
+	require.Equal(t, map[string]int64{
+		"usr/":          0755,
+		"usr/bin/app":   0755,
+		"usr/share/doc": 0644,
+		"usr/bin/link":  0777,
+	}, modes)
+
+	// Nothing is rewritten without normalization.
+	pvd.SetTarNormalization(&TarNormalization{})
+	require.Nil(t, pvd.layerRewriter(ctx))
+}
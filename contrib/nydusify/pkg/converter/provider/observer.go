@@ -0,0 +1,101 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"strings"
+
+	"github.com/containerd/containerd/content"
+	"github.com/opencontainers/go-digest"
+)
+
+// LayerObserver is called with the source layer digest and the nydus blob
+// digest once the blob built from the source layer is committed.
+type LayerObserver func(source, blob digest.Digest)
+
+// SetLayerObserver observes the nydus blobs built from source layers through
+// ContentStore, the layers reused from build cache or checkpoint aren't built
+// so they're not observed.
+func (pvd *Provider) SetLayerObserver(observer LayerObserver) {
+	pvd.wrapStore(func(store content.Store) content.Store {
+		return &observerStore{Store: store, observer: observer}
+	})
+}
+
+// The stages of conversion observed by StageObserver.
+const (
+	StagePull  = "pull"
+	StageBuild = "build"
+	StagePush  = "push"
+)
+
+// StageObserver is called when a stage of conversion starts, with the
+// image reference for the pull and push stages, or the source layer digest
+// for the build stage of each layer.
+type StageObserver func(stage, ref string, layer digest.Digest)
+
+// SetStageObserver observes the pulling of source image, the building of
+// each source layer through ContentStore and the pushing of target and
+// cache images.
+func (pvd *Provider) SetStageObserver(observer StageObserver) {
+	pvd.stageObserver = observer
+	pvd.wrapStore(func(store content.Store) content.Store {
+		return &stageStore{Store: store, observer: observer}
+	})
+}
+
+func (pvd *Provider) observeStage(stage, ref string) {
+	if pvd.stageObserver != nil {
+		pvd.stageObserver(stage, ref, "")
+	}
+}
+
+type stageStore struct {
+	content.Store
+	observer StageObserver
+}
+
+func (store *stageStore) Writer(ctx context.Context, opts ...content.WriterOpt) (content.Writer, error) {
+	writer, err := store.Store.Writer(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	var wopts content.WriterOpts
+	for _, opt := range opts {
+		if err := opt(&wopts); err != nil {
+			return nil, err
+		}
+	}
+	if source, err := digest.Parse(strings.TrimPrefix(wopts.Ref, buildRefPrefix)); err == nil && strings.HasPrefix(wopts.Ref, buildRefPrefix) {
+		store.observer(StageBuild, "", source)
+	}
+	return writer, nil
+}
+
+type observerStore struct {
+	content.Store
+	observer LayerObserver
+}
+
+func (store *observerStore) Writer(ctx context.Context, opts ...content.WriterOpt) (content.Writer, error) {
+	writer, err := store.Store.Writer(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	var wopts content.WriterOpts
+	for _, opt := range opts {
+		if err := opt(&wopts); err != nil {
+			return nil, err
+		}
+	}
+	source, err := digest.Parse(strings.TrimPrefix(wopts.Ref, buildRefPrefix))
+	if !strings.HasPrefix(wopts.Ref, buildRefPrefix) || err != nil {
+		return writer, nil
+	}
+	return &checkpointWriter{Writer: writer, done: func(_ context.Context, blob digest.Digest) {
+		store.observer(source, blob)
+	}}, nil
+}
@@ -0,0 +1,201 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/containerd/containerd/content"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+// The orders of nydus blob layers in target manifest, the bootstrap layer
+// is always kept at last.
+const (
+	// BlobOrderDigest orders the blobs by digest, so that the manifest digest
+	// is stable regardless of the order in which the layers are built.
+	BlobOrderDigest = "digest"
+	// BlobOrderLayer orders the blobs by the order of source layers, i.e. the
+	// order of blob table in bootstrap, from the lowest layer.
+	BlobOrderLayer = "layer"
+	// BlobOrderSize orders the blobs by size, from the largest blob.
+	BlobOrderSize = "size"
+	// BlobOrderAccess orders the blobs by the size of prefetched data in
+	// them, from the blob prefetched most, the blobs not prefetched follow
+	// in the order of source layers.
+	BlobOrderAccess = "access"
+)
+
+// BlobOrders are the orders accepted by SetBlobOrder.
+var BlobOrders = []string{BlobOrderDigest, BlobOrderLayer, BlobOrderSize, BlobOrderAccess}
+
+// blobOrder is the order of nydus blob layers, the inspector reads the
+// blob table of bootstrap for BlobOrderLayer and BlobOrderAccess.
+type blobOrder struct {
+	order     string
+	inspector BlobInspector
+}
+
+// SetBlobOrder orders the nydus blob layers in target manifest by order, see
+// BlobOrders, empty keeps the layers in the order they are converted. The
+// blobs are referenced by bootstrap with blob ID, their order in manifest
+// only affects the order in which they are pulled. BlobOrderLayer and
+// BlobOrderAccess require inspector to read the blob table of bootstrap.
+func (pvd *Provider) SetBlobOrder(order string, inspector BlobInspector) error {
+	switch order {
+	case "", BlobOrderDigest, BlobOrderSize:
+	case BlobOrderLayer, BlobOrderAccess:
+		if inspector == nil {
+			return fmt.Errorf("blob order %s requires the blob inspector", order)
+		}
+	default:
+		return fmt.Errorf("unsupported blob order %s, possible values: %v", order, BlobOrders)
+	}
+	pvd.blobOrder = blobOrder{order: order, inspector: inspector}
+	return nil
+}
+
+// blobLess returns the less function of blobs by order for sorting.
+func blobLess(ctx context.Context, store content.Store, blobs []ocispec.Descriptor, bootstrap ocispec.Descriptor, order blobOrder) (func(i, j int) bool, error) {
+	byDigest := func(i, j int) bool {
+		return blobs[i].Digest < blobs[j].Digest
+	}
+	// The blobs unknown to bootstrap keep their order after the known ones.
+	byLayer := func(positions map[string]int) func(i, j int) bool {
+		return func(i, j int) bool {
+			pi, iok := positions[blobs[i].Digest.Encoded()]
+			pj, jok := positions[blobs[j].Digest.Encoded()]
+			if iok && jok {
+				return pi < pj
+			}
+			return iok && !jok
+		}
+	}
+
+	switch order.order {
+	case BlobOrderSize:
+		return func(i, j int) bool {
+			if blobs[i].Size != blobs[j].Size {
+				return blobs[i].Size > blobs[j].Size
+			}
+			return byDigest(i, j)
+		}, nil
+	case BlobOrderLayer, BlobOrderAccess:
+		infos, err := inspectBlobs(ctx, store, bootstrap, order.inspector)
+		if err != nil {
+			return nil, err
+		}
+		// The blob table of bootstrap is in the order of source layers.
+		positions := map[string]int{}
+		readahead := map[string]uint32{}
+		for idx, info := range infos {
+			if _, ok := positions[info.BlobID]; !ok {
+				positions[info.BlobID] = idx
+			}
+			readahead[info.BlobID] = info.ReadaheadSize
+		}
+		layerLess := byLayer(positions)
+		if order.order == BlobOrderLayer {
+			return layerLess, nil
+		}
+		return func(i, j int) bool {
+			ri, rj := readahead[blobs[i].Digest.Encoded()], readahead[blobs[j].Digest.Encoded()]
+			if ri != rj {
+				return ri > rj
+			}
+			return layerLess(i, j)
+		}, nil
+	}
+	return byDigest, nil
+}
+
+// sortManifestLayers orders the nydus blob layers of manifest by order and
+// keeps the bootstrap layer at last, see SetBlobOrder. The diff IDs in
+// config are reordered accordingly. The manifest containing non-nydus
+// layers is kept as is.
+func sortManifestLayers(ctx context.Context, store content.Store, manifest *ocispec.Manifest, order blobOrder) (bool, error) {
+	layers := manifest.Layers
+	if len(layers) < 3 || layers[len(layers)-1].Annotations[utils.LayerAnnotationNydusBootstrap] != "true" {
+		return false, nil
+	}
+	blobs := layers[:len(layers)-1]
+	for _, layer := range blobs {
+		if layer.MediaType != utils.MediaTypeNydusBlob && layer.Annotations[utils.LayerAnnotationNydusBlob] != "true" {
+			return false, nil
+		}
+	}
+	less, err := blobLess(ctx, store, blobs, layers[len(layers)-1], order)
+	if err != nil {
+		return false, errors.Wrapf(err, "order blobs by %s", order.order)
+	}
+
+	// The diff IDs are moved together with the layers, the config is always
+	// rewritten in the canonical form of sorted keys, so that the config of
+	// sorted layers is identical to the one of unsorted layers.
+	configData, err := content.ReadBlob(ctx, store, manifest.Config)
+	if err != nil {
+		return false, errors.Wrap(err, "read image config")
+	}
+	var config map[string]json.RawMessage
+	if err := json.Unmarshal(configData, &config); err != nil {
+		return false, errors.Wrap(err, "unmarshal image config")
+	}
+	var rootfs ocispec.RootFS
+	if config["rootfs"] != nil {
+		if err := json.Unmarshal(config["rootfs"], &rootfs); err != nil {
+			return false, errors.Wrap(err, "unmarshal rootfs of image config")
+		}
+	}
+	withDiffIDs := len(rootfs.DiffIDs) == len(layers)
+	indexes := make([]int, len(blobs))
+	for idx := range indexes {
+		indexes[idx] = idx
+	}
+	sort.SliceStable(indexes, func(i, j int) bool {
+		return less(indexes[i], indexes[j])
+	})
+	sortedLayers := make([]ocispec.Descriptor, 0, len(layers))
+	sortedDiffIDs := make([]digest.Digest, 0, len(rootfs.DiffIDs))
+	for _, idx := range indexes {
+		sortedLayers = append(sortedLayers, blobs[idx])
+		if withDiffIDs {
+			sortedDiffIDs = append(sortedDiffIDs, rootfs.DiffIDs[idx])
+		}
+	}
+	manifest.Layers = append(sortedLayers, layers[len(layers)-1])
+
+	if withDiffIDs {
+		rootfs.DiffIDs = append(sortedDiffIDs, rootfs.DiffIDs[len(layers)-1])
+		if config["rootfs"], err = json.Marshal(rootfs); err != nil {
+			return false, errors.Wrap(err, "marshal rootfs of image config")
+		}
+		configDesc, err := writeJSON(ctx, store, config, manifest.Config.MediaType)
+		if err != nil {
+			return false, errors.Wrap(err, "write image config")
+		}
+		configDesc.Annotations = manifest.Config.Annotations
+		manifest.Config = *configDesc
+	}
+
+	return true, nil
+}
+
+// sortLayers orders the nydus layers of all the manifests in image, see
+// sortManifestLayers. The image is kept as is if no order is set.
+func sortLayers(ctx context.Context, store content.Store, desc ocispec.Descriptor, order blobOrder) (*ocispec.Descriptor, error) {
+	if order.order == "" {
+		return &desc, nil
+	}
+	return rewriteManifests(ctx, store, desc, nil, func(_ *ocispec.Descriptor, manifest *ocispec.Manifest) (bool, error) {
+		return sortManifestLayers(ctx, store, manifest, order)
+	})
+}
@@ -0,0 +1,184 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"testing"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/checker/tool"
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+func TestPushSortedLayers(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+
+	var blobs []ocispec.Descriptor
+	for _, data := range []string{"a", "b", "c"} {
+		blob, err := writeJSON(ctx, pvd.store, map[string]string{"blob": data}, utils.MediaTypeNydusBlob)
+		require.NoError(t, err)
+		blobs = append(blobs, *blob)
+	}
+	bootstrap, err := writeJSON(ctx, pvd.store, map[string]string{"bootstrap": "data"}, ocispec.MediaTypeImageLayerGzip)
+	require.NoError(t, err)
+	bootstrap.Annotations = map[string]string{utils.LayerAnnotationNydusBootstrap: "true"}
+
+	// The manifest assembled from the layers built in the order of order.
+	writeManifest := func(order ...int) ocispec.Descriptor {
+		var layers []ocispec.Descriptor
+		var diffIDs []digest.Digest
+		for _, idx := range order {
+			layers = append(layers, blobs[idx])
+			diffIDs = append(diffIDs, blobs[idx].Digest)
+		}
+		layers = append(layers, *bootstrap)
+		diffIDs = append(diffIDs, digest.FromString("bootstrap"))
+		config, err := writeJSON(ctx, pvd.store, ocispec.Image{
+			Platform: ocispec.Platform{OS: "linux", Architecture: "amd64"},
+			RootFS:   ocispec.RootFS{Type: "layers", DiffIDs: diffIDs},
+		}, ocispec.MediaTypeImageConfig)
+		require.NoError(t, err)
+		manifest, err := writeJSON(ctx, pvd.store, ocispec.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: ocispec.MediaTypeImageManifest,
+			Config:    *config,
+			Layers:    layers,
+		}, ocispec.MediaTypeImageManifest)
+		require.NoError(t, err)
+		return *manifest
+	}
+
+	// The layers are kept in the order of conversion by default.
+	registry := newPushableRegistry(t)
+	unsorted := writeManifest(2, 0, 1)
+	require.NoError(t, pvd.Push(ctx, unsorted, registry.host+"/unsorted:latest"))
+	desc, err := pvd.Image(ctx, registry.host+"/unsorted:latest")
+	require.NoError(t, err)
+	var manifest ocispec.Manifest
+	require.NoError(t, readJSON(ctx, pvd.store, *desc, &manifest))
+	for idx, want := range []int{2, 0, 1} {
+		require.Equal(t, blobs[want].Digest, manifest.Layers[idx].Digest)
+	}
+
+	require.NoError(t, pvd.SetBlobOrder(BlobOrderDigest, nil))
+	var digests []digest.Digest
+	for idx, order := range [][]int{{0, 1, 2}, {2, 0, 1}, {1, 2, 0}} {
+		ref := registry.host + "/sorted:" + []string{"a", "b", "c"}[idx]
+		require.NoError(t, pvd.Push(ctx, writeManifest(order...), ref))
+		desc, err := pvd.Image(ctx, ref)
+		require.NoError(t, err)
+		digests = append(digests, desc.Digest)
+	}
+	require.Equal(t, digests[0], digests[1])
+	require.Equal(t, digests[0], digests[2])
+
+	desc, err = pvd.Image(ctx, registry.host+"/sorted:a")
+	require.NoError(t, err)
+	manifest = ocispec.Manifest{}
+	require.NoError(t, readJSON(ctx, pvd.store, *desc, &manifest))
+	require.Len(t, manifest.Layers, 4)
+	require.Equal(t, bootstrap.Digest, manifest.Layers[3].Digest)
+	var config ocispec.Image
+	require.NoError(t, readJSON(ctx, pvd.store, manifest.Config, &config))
+	for idx, layer := range manifest.Layers[:3] {
+		if idx > 0 {
+			require.True(t, manifest.Layers[idx-1].Digest < layer.Digest)
+		}
+		require.Equal(t, layer.Digest, config.RootFS.DiffIDs[idx])
+	}
+}
+
+func TestPushBlobOrder(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+
+	// The blobs are sized 1, 3 and 2 bytes in data, the blob table of
+	// bootstrap is in the order of 2, 0, 1, and only blob 0 is prefetched.
+	var blobs []ocispec.Descriptor
+	for _, data := range []string{"a", "bbb", "cc"} {
+		blob, err := writeJSON(ctx, pvd.store, map[string]string{"blob": data}, utils.MediaTypeNydusBlob)
+		require.NoError(t, err)
+		blobs = append(blobs, *blob)
+	}
+	table := []int{2, 0, 1}
+	var infos tool.BlobInfoList
+	for _, idx := range table {
+		info := tool.BlobInfo{BlobID: blobs[idx].Digest.Encoded(), CompressedSize: uint64(blobs[idx].Size)}
+		if idx == 0 {
+			info.ReadaheadSize = 4096
+		}
+		infos = append(infos, info)
+	}
+	bootstrap := writeTarLayer(t, ctx, pvd.store, map[string]string{utils.BootstrapFileNameInLayer: "bootstrap"})
+	bootstrap.Annotations = map[string]string{utils.LayerAnnotationNydusBootstrap: "true"}
+	inspector := blobInspector(func(option tool.InspectOption) (interface{}, error) {
+		require.Equal(t, tool.GetBlobs, option.Operation)
+		return infos, nil
+	})
+
+	var diffIDs []digest.Digest
+	for _, blob := range blobs {
+		diffIDs = append(diffIDs, blob.Digest)
+	}
+	config, err := writeJSON(ctx, pvd.store, ocispec.Image{
+		Platform: ocispec.Platform{OS: "linux", Architecture: "amd64"},
+		RootFS:   ocispec.RootFS{Type: "layers", DiffIDs: append(diffIDs, digest.FromString("bootstrap"))},
+	}, ocispec.MediaTypeImageConfig)
+	require.NoError(t, err)
+	manifest, err := writeJSON(ctx, pvd.store, ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    *config,
+		Layers:    append(append([]ocispec.Descriptor{}, blobs...), bootstrap),
+	}, ocispec.MediaTypeImageManifest)
+	require.NoError(t, err)
+
+	byDigest := []int{0, 1, 2}
+	sort.Slice(byDigest, func(i, j int) bool {
+		return blobs[byDigest[i]].Digest < blobs[byDigest[j]].Digest
+	})
+	registry := newPushableRegistry(t)
+	for _, tc := range []struct {
+		order string
+		want  []int
+	}{
+		{order: "", want: []int{0, 1, 2}},
+		{order: BlobOrderDigest, want: byDigest},
+		{order: BlobOrderLayer, want: table},
+		{order: BlobOrderSize, want: []int{1, 2, 0}},
+		{order: BlobOrderAccess, want: []int{0, 2, 1}},
+	} {
+		require.NoError(t, pvd.SetBlobOrder(tc.order, inspector), tc.order)
+		ref := registry.host + "/ordered:order-" + tc.order
+		require.NoError(t, pvd.Push(ctx, *manifest, ref), tc.order)
+
+		var pushed ocispec.Manifest
+		_, data, ok := registry.Tag("ordered", "order-"+tc.order)
+		require.True(t, ok, tc.order)
+		require.NoError(t, json.Unmarshal(data, &pushed), tc.order)
+		require.Len(t, pushed.Layers, 4, tc.order)
+		require.Equal(t, bootstrap.Digest, pushed.Layers[3].Digest, tc.order)
+		var pushedConfig ocispec.Image
+		require.NoError(t, readJSON(ctx, pvd.store, pushed.Config, &pushedConfig), tc.order)
+		for idx, want := range tc.want {
+			require.Equal(t, blobs[want].Digest, pushed.Layers[idx].Digest, tc.order)
+			require.Equal(t, blobs[want].Digest, pushedConfig.RootFS.DiffIDs[idx], tc.order)
+		}
+	}
+
+	require.Error(t, pvd.SetBlobOrder("random", inspector))
+	require.Error(t, pvd.SetBlobOrder(BlobOrderLayer, nil))
+	require.Error(t, pvd.SetBlobOrder(BlobOrderAccess, nil))
+}
@@ -0,0 +1,27 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/remote"
+)
+
+// CheckPushPermission probes the push permission of the repository of ref
+// by a canceled blob upload, see remote.ProbePush, so that the missing
+// permission fails fast before pulling and building.
+func (pvd *Provider) CheckPushPermission(ctx context.Context, ref string) error {
+	resolver, err := pvd.Resolver(ref)
+	if err != nil {
+		return err
+	}
+	if err := remote.ProbePush(ctx, resolver, ref); err != nil {
+		return errors.Wrapf(err, "no permission to push to %s", ref)
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"testing"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckPushPermission(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	var uploaded int
+	registry := newPushableRegistry(t, denyUploads("library/readonly"), onBlobPush(func(_ digest.Digest) (int, bool) {
+		uploaded++
+		return 0, false
+	}))
+
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+	require.NoError(t, pvd.CheckPushPermission(ctx, registry.host+"/library/writable:nydus"))
+	// The probe upload is canceled without any blob.
+	require.Equal(t, 0, uploaded)
+
+	err := pvd.CheckPushPermission(ctx, registry.host+"/library/readonly:nydus")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "no permission to push to "+registry.host+"/library/readonly:nydus")
+	require.Contains(t, err.Error(), "403")
+}
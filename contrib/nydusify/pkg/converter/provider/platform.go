@@ -0,0 +1,163 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// ParsePlatform parses the platform specifier like `linux/arm64/v8`,
+// returns nil if the specifier is empty.
+func ParsePlatform(specifier string) (*ocispec.Platform, error) {
+	if specifier == "" {
+		return nil, nil
+	}
+	platform, err := platforms.Parse(specifier)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid platform %s", specifier)
+	}
+	platform = platforms.Normalize(platform)
+	return &platform, nil
+}
+
+// SetPlatform sets the platform asserted for source image and the platform
+// written into the config of target image, nil means not to check or modify.
+func (pvd *Provider) SetPlatform(source, target *ocispec.Platform) {
+	pvd.sourcePlatform = source
+	pvd.targetPlatform = target
+}
+
+func readConfigPlatform(ctx context.Context, store content.Store, manifestDesc ocispec.Descriptor) (*ocispec.Manifest, *ocispec.Platform, error) {
+	var manifest ocispec.Manifest
+	if err := readJSON(ctx, store, manifestDesc, &manifest); err != nil {
+		return nil, nil, errors.Wrap(err, "read manifest")
+	}
+	var config ocispec.Image
+	if err := readJSON(ctx, store, manifest.Config, &config); err != nil {
+		return nil, nil, errors.Wrap(err, "read image config")
+	}
+	platform := platforms.Normalize(config.Platform)
+	return &manifest, &platform, nil
+}
+
+// checkPlatform checks that the pulled image matches the platform: an image
+// index should include a manifest of the platform, and the config of a single
+// manifest should declare the platform.
+func checkPlatform(ctx context.Context, store content.Store, desc ocispec.Descriptor, platform ocispec.Platform) error {
+	matcher := platforms.OnlyStrict(platform)
+
+	switch desc.MediaType {
+	case ocispec.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList:
+		var index ocispec.Index
+		if err := readJSON(ctx, store, desc, &index); err != nil {
+			return errors.Wrap(err, "read image index")
+		}
+		for _, manifest := range index.Manifests {
+			if manifest.Platform != nil && matcher.Match(*manifest.Platform) {
+				return nil
+			}
+		}
+		return fmt.Errorf("no manifest matches platform %s in image index", platforms.Format(platform))
+	case ocispec.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest:
+		_, configPlatform, err := readConfigPlatform(ctx, store, desc)
+		if err != nil {
+			return err
+		}
+		if !matcher.Match(*configPlatform) {
+			return fmt.Errorf(
+				"image platform %s mismatches the specified platform %s",
+				platforms.Format(*configPlatform), platforms.Format(platform),
+			)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unsupported media type %s", desc.MediaType)
+}
+
+// setManifestPlatform rewrites the platform fields of image config.
+func setManifestPlatform(ctx context.Context, store content.Store, manifest *ocispec.Manifest, platform ocispec.Platform) (bool, error) {
+	var image ocispec.Image
+	if err := readJSON(ctx, store, manifest.Config, &image); err != nil {
+		return false, errors.Wrap(err, "read image config")
+	}
+	if platforms.Format(platforms.Normalize(image.Platform)) == platforms.Format(platform) {
+		return false, nil
+	}
+
+	// Keep the unknown fields of image config.
+	var config map[string]json.RawMessage
+	if err := readJSON(ctx, store, manifest.Config, &config); err != nil {
+		return false, errors.Wrap(err, "read image config")
+	}
+	for key, value := range map[string]string{
+		"os":           platform.OS,
+		"architecture": platform.Architecture,
+		"variant":      platform.Variant,
+	} {
+		if value == "" {
+			delete(config, key)
+			continue
+		}
+		data, err := json.Marshal(value)
+		if err != nil {
+			return false, err
+		}
+		config[key] = data
+	}
+	configDesc, err := writeJSON(ctx, store, config, manifest.Config.MediaType)
+	if err != nil {
+		return false, errors.Wrap(err, "write image config")
+	}
+	configDesc.Annotations = manifest.Config.Annotations
+	manifest.Config = *configDesc
+
+	return true, nil
+}
+
+// setPlatform rewrites the platform of target image, an image index is only
+// allowed to contain the manifests of same platform, for example, the nydus
+// and OCI manifests generated by `--merge-platform`.
+func setPlatform(ctx context.Context, store content.Store, desc ocispec.Descriptor, platform ocispec.Platform) (*ocispec.Descriptor, error) {
+	isIndex := images.IsIndexType(desc.MediaType)
+	if isIndex {
+		var index ocispec.Index
+		if err := readJSON(ctx, store, desc, &index); err != nil {
+			return nil, errors.Wrap(err, "read image index")
+		}
+		keys := map[string]bool{}
+		for _, manifest := range index.Manifests {
+			keys[platformKey(manifest.Platform)] = true
+		}
+		if len(keys) > 1 {
+			return nil, fmt.Errorf("can't set platform %s for multi-platform image", platforms.Format(platform))
+		}
+	}
+
+	return rewriteManifests(ctx, store, desc, nil, func(manifestDesc *ocispec.Descriptor, manifest *ocispec.Manifest) (bool, error) {
+		changed, err := setManifestPlatform(ctx, store, manifest, platform)
+		if err != nil || !isIndex {
+			return changed, err
+		}
+		newPlatform := platform
+		if manifestDesc.Platform != nil {
+			newPlatform.OSFeatures = manifestDesc.Platform.OSFeatures
+		}
+		if manifestDesc.Platform == nil || !reflect.DeepEqual(*manifestDesc.Platform, newPlatform) {
+			manifestDesc.Platform = &newPlatform
+			changed = true
+		}
+		return changed, nil
+	})
+}
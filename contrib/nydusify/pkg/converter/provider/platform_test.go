@@ -0,0 +1,146 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/goharbor/acceleration-service/pkg/remote"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func addTestManifest(t *testing.T, registry *testRegistry, platform string, layer string) ocispec.Descriptor {
+	p, err := ParsePlatform(platform)
+	require.NoError(t, err)
+	configData, err := json.Marshal(ocispec.Image{Platform: *p})
+	require.NoError(t, err)
+	config := registry.AddBlob(ocispec.MediaTypeImageConfig, configData)
+	manifestData, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []ocispec.Descriptor{registry.AddBlob(ocispec.MediaTypeImageLayerGzip, []byte(layer))},
+	})
+	require.NoError(t, err)
+	manifest := registry.AddBlob(ocispec.MediaTypeImageManifest, manifestData)
+	manifest.Platform = p
+	return manifest
+}
+
+func newPlatformProvider(t testing.TB, platformMC platforms.MatchComparer, source, target string) *Provider {
+	hosts := func(string) (remote.CredentialFunc, bool, error) {
+		return func(string) (string, string, error) { return "", "", nil }, false, nil
+	}
+	sourcePlatform, err := ParsePlatform(source)
+	require.NoError(t, err)
+	targetPlatform, err := ParsePlatform(target)
+	require.NoError(t, err)
+	if sourcePlatform != nil {
+		platformMC = platforms.OnlyStrict(*sourcePlatform)
+	}
+	pvd, err := New(t.TempDir(), hosts, 200, "v1", platformMC, 0)
+	require.NoError(t, err)
+	pvd.UsePlainHTTP()
+	pvd.SetPlatform(sourcePlatform, targetPlatform)
+	return pvd
+}
+
+func TestParsePlatform(t *testing.T) {
+	platform, err := ParsePlatform("")
+	require.NoError(t, err)
+	require.Nil(t, platform)
+
+	platform, err = ParsePlatform("linux/aarch64")
+	require.NoError(t, err)
+	require.Equal(t, "linux/arm64", platforms.Format(*platform))
+
+	_, err = ParsePlatform("linux/amd64/v2/invalid")
+	require.Error(t, err)
+}
+
+func TestSourcePlatformManifest(t *testing.T) {
+	registry := newPushableRegistry(t)
+	manifest := addTestManifest(t, registry, "linux/arm64", "arm64 layer")
+	registry.SetTag("library/single", "latest", manifest.Digest)
+	ref := registry.host + "/library/single:latest"
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+
+	pvd := newPlatformProvider(t, platforms.All, "linux/arm64", "")
+	require.NoError(t, pvd.Pull(ctx, ref))
+
+	pvd = newPlatformProvider(t, platforms.All, "linux/amd64", "")
+	err := pvd.Pull(ctx, ref)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "image platform linux/arm64 mismatches the specified platform linux/amd64")
+}
+
+func TestSourcePlatformIndex(t *testing.T) {
+	registry := newPushableRegistry(t)
+	amd64 := addTestManifest(t, registry, "linux/amd64", "amd64 layer")
+	arm64 := addTestManifest(t, registry, "linux/arm64", "arm64 layer")
+	indexData, err := json.Marshal(ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{amd64, arm64},
+	})
+	require.NoError(t, err)
+	index := registry.AddBlob(ocispec.MediaTypeImageIndex, indexData)
+	registry.SetTag("library/multi", "latest", index.Digest)
+	ref := registry.host + "/library/multi:latest"
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+
+	// Only the manifest of specified platform is pulled.
+	pvd := newPlatformProvider(t, platforms.All, "linux/arm64", "")
+	require.NoError(t, pvd.Pull(ctx, ref))
+	_, err = pvd.ContentStore().Info(ctx, arm64.Digest)
+	require.NoError(t, err)
+	_, err = pvd.ContentStore().Info(ctx, amd64.Digest)
+	require.Error(t, err)
+
+	pvd = newPlatformProvider(t, platforms.All, "linux/s390x", "")
+	err = pvd.Pull(ctx, ref)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "no manifest matches platform linux/s390x")
+}
+
+func TestTargetPlatform(t *testing.T) {
+	registry := newPushableRegistry(t)
+	manifest := addTestManifest(t, registry, "linux/amd64", "amd64 layer")
+	registry.SetTag("library/single", "latest", manifest.Digest)
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+
+	pvd := newPlatformProvider(t, platforms.All, "", "linux/arm64")
+	source := registry.host + "/library/single:latest"
+	require.NoError(t, pvd.Pull(ctx, source))
+	desc, err := pvd.Image(ctx, source)
+	require.NoError(t, err)
+
+	target := registry.host + "/library/single:nydus"
+	require.NoError(t, pvd.Push(ctx, *desc, target))
+	targetDesc, err := pvd.Image(ctx, target)
+	require.NoError(t, err)
+	require.NotEqual(t, desc.Digest, targetDesc.Digest)
+	dgst, _, ok := registry.Tag("library/single", "nydus")
+	require.True(t, ok)
+	require.Equal(t, targetDesc.Digest, dgst)
+
+	_, platform, err := readConfigPlatform(ctx, pvd.ContentStore(), *targetDesc)
+	require.NoError(t, err)
+	require.Equal(t, "linux/arm64", platforms.Format(*platform))
+
+	// Unknown fields of config are kept.
+	var targetManifest ocispec.Manifest
+	require.NoError(t, readJSON(ctx, pvd.ContentStore(), *targetDesc, &targetManifest))
+	data, err := content.ReadBlob(ctx, pvd.ContentStore(), targetManifest.Config)
+	require.NoError(t, err)
+	require.Contains(t, string(data), `"rootfs"`)
+}
@@ -18,6 +18,7 @@ import (
 
 	// nolint:staticcheck
 	"github.com/containerd/containerd/remotes/docker/schema1"
+	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"golang.org/x/sync/semaphore"
 )
@@ -155,6 +156,7 @@ func push(ctx context.Context, store content.Store, pushCtx *containerd.RemoteCo
 	if err != nil {
 		return err
 	}
+	pusher = &cancelablePusher{Pusher: pusher}
 
 	var wrapper func(images.Handler) images.Handler
 
@@ -177,3 +179,54 @@ func push(ctx context.Context, store content.Store, pushCtx *containerd.RemoteCo
 
 	return remotes.PushContent(ctx, pusher, desc, store, limiter, pushCtx.PlatformMatcher, wrapper)
 }
+
+// cancelablePusher returns the writers aborting the blocked write once the
+// context of push is done. The docker pusher hands the request body pipe to
+// the writer, the pipe is never read if the request is canceled after the
+// pipe is created, so that the write hangs forever when the push of another
+// blob fails.
+type cancelablePusher struct {
+	remotes.Pusher
+}
+
+func (pusher *cancelablePusher) Push(ctx context.Context, desc ocispec.Descriptor) (content.Writer, error) {
+	writer, err := pusher.Pusher.Push(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	// Closing the writer closes the request body pipe, which releases
+	// the blocked write with io.ErrClosedPipe.
+	stop := context.AfterFunc(ctx, func() {
+		writer.Close()
+	})
+	return &cancelableWriter{Writer: writer, ctx: ctx, stop: stop}, nil
+}
+
+type cancelableWriter struct {
+	content.Writer
+	ctx  context.Context
+	stop func() bool
+}
+
+// Write returns the error of context instead of the closed pipe error if
+// the write is aborted by the done context.
+func (writer *cancelableWriter) Write(p []byte) (int, error) {
+	if err := writer.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := writer.Writer.Write(p)
+	if err != nil && writer.ctx.Err() != nil {
+		return n, writer.ctx.Err()
+	}
+	return n, err
+}
+
+func (writer *cancelableWriter) Commit(ctx context.Context, size int64, expected digest.Digest, opts ...content.Opt) error {
+	writer.stop()
+	return writer.Writer.Commit(ctx, size, expected, opts...)
+}
+
+func (writer *cancelableWriter) Close() error {
+	writer.stop()
+	return writer.Writer.Close()
+}
@@ -0,0 +1,86 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/containerd/containerd/content"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+// SetSourceDigestLabel enables recording the source manifest digest, which
+// is annotated in nydus manifest by converter, into the labels of nydus image
+// config, so that it's kept by the tools only preserving image config.
+func (pvd *Provider) SetSourceDigestLabel(enabled bool) {
+	pvd.sourceDigestLabel = enabled
+}
+
+// setManifestSourceDigestLabel writes the source digest annotated in nydus
+// manifest into the config labels, the manifest without the annotation, for
+// example the OCI manifest of `--merge-platform`, is kept as is.
+func setManifestSourceDigestLabel(ctx context.Context, store content.Store, manifest *ocispec.Manifest) (bool, error) {
+	sourceDigest := manifest.Annotations[utils.ManifestNydusSourceDigest]
+	if sourceDigest == "" {
+		return false, nil
+	}
+
+	// Keep the unknown fields of image config.
+	var config map[string]json.RawMessage
+	if err := readJSON(ctx, store, manifest.Config, &config); err != nil {
+		return false, errors.Wrap(err, "read image config")
+	}
+	var imageConfig map[string]json.RawMessage
+	if data, ok := config["config"]; ok {
+		if err := json.Unmarshal(data, &imageConfig); err != nil {
+			return false, errors.Wrap(err, "unmarshal image config")
+		}
+	}
+	if imageConfig == nil {
+		imageConfig = map[string]json.RawMessage{}
+	}
+	labels := map[string]string{}
+	if data, ok := imageConfig["Labels"]; ok {
+		if err := json.Unmarshal(data, &labels); err != nil {
+			return false, errors.Wrap(err, "unmarshal image labels")
+		}
+	}
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	if labels[utils.ManifestNydusSourceDigest] == sourceDigest {
+		return false, nil
+	}
+	labels[utils.ManifestNydusSourceDigest] = sourceDigest
+
+	data, err := json.Marshal(labels)
+	if err != nil {
+		return false, err
+	}
+	imageConfig["Labels"] = data
+	if config["config"], err = json.Marshal(imageConfig); err != nil {
+		return false, err
+	}
+	configDesc, err := writeJSON(ctx, store, config, manifest.Config.MediaType)
+	if err != nil {
+		return false, errors.Wrap(err, "write image config")
+	}
+	configDesc.Annotations = manifest.Config.Annotations
+	manifest.Config = *configDesc
+
+	return true, nil
+}
+
+// setSourceDigestLabel records the source digest in the config labels of all
+// the nydus manifests in target image.
+func setSourceDigestLabel(ctx context.Context, store content.Store, desc ocispec.Descriptor) (*ocispec.Descriptor, error) {
+	return rewriteManifests(ctx, store, desc, nil, func(_ *ocispec.Descriptor, manifest *ocispec.Manifest) (bool, error) {
+		return setManifestSourceDigestLabel(ctx, store, manifest)
+	})
+}
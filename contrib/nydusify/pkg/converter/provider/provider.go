@@ -7,23 +7,31 @@ package provider
 import (
 	"context"
 	"crypto/tls"
+	"fmt"
 	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"text/template"
 	"time"
 
 	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/archive/compression"
 	"github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/platforms"
 	"github.com/containerd/containerd/remotes"
 	"github.com/containerd/containerd/remotes/docker"
+	"github.com/distribution/reference"
 	"github.com/goharbor/acceleration-service/pkg/cache"
 	accelcontent "github.com/goharbor/acceleration-service/pkg/content"
 	"github.com/goharbor/acceleration-service/pkg/remote"
+	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
 )
 
 var LayerConcurrentLimit = 5
@@ -38,10 +46,83 @@ type Provider struct {
 	cacheSize    int
 	cacheVersion string
 	chunkSize    int64
+	sockets      map[string]string
+	maxBlobSize  int64
+	pushedBytes  int64
+	cache        *cache.RemoteCache
+	cacheHits    map[string]*CacheHit
+	cachePolicy  string
+
+	noCache       bool
+	cacheReadOnly bool
+
+	sourcePlatform *ocispec.Platform
+	targetPlatform *ocispec.Platform
+
+	harborAccessory bool
+
+	existingBytes int64
+	destinations  destinationBytes
+
+	dialTimeout     time.Duration
+	readTimeout     time.Duration
+	manifestTimeout time.Duration
+	blobTimeout     time.Duration
+	limiter         *AdaptiveLimiter
+	http2           *http2Option
+
+	sourceDigestLabel bool
+	digestAlgorithm   digest.Algorithm
+	layerNameTemplate *template.Template
+	generateSBOM      bool
+	excludePaths      []string
+	// rewrittenSources are the original digests of the source manifests
+	// rewritten on pulling by the rewritten ones.
+	rewrittenSources map[digest.Digest]digest.Digest
+	// foreignLayers are the foreign layers stripped from the source
+	// manifests on pulling by the original source manifest digests.
+	foreignLayers map[digest.Digest][]foreignLayer
+	checkpoint    *Checkpoint
+	blobMediaType string
+	attempts      transferAttempts
+	diskQuota     *diskQuota
+	// bootstrapCompressor is nil to keep the bootstrap layers as built.
+	bootstrapCompressor *compression.Compression
+	// layerCompressors is nil if all the layers are built by the nydus
+	// driver with the same compressor.
+	layerCompressors    *layerCompressors
+	sourceDiffIDs       map[digest.Digest]digest.Digest
+	session             *Session
+	history             *historyOption
+	skipBlobPush        bool
+	mountFrom           *mountSource
+	base                *baseNydus
+	referenceBaseBlobs  bool
+	tarNormalization    *TarNormalization
+	globFilter          *globFilter
+	artifactTypePolicy  string
+	blobReferenceCheck  *blobReferenceCheck
+	manifestFormat      string
+	lazyIndexInspector  BlobInspector
+	fileManifest        bool
+	subjectRecorder     subjectRecorder
+	blobOrder           blobOrder
+	blobRetries         int
+	stageObserver       StageObserver
+	smallImageThreshold int64
 }
 
 func New(root string, hosts remote.HostFunc, cacheSize uint, cacheVersion string, platformMC platforms.MatchComparer, chunkSize int64) (*Provider, error) {
-	contentDir := filepath.Join(root, "content")
+	return NewWithContentDir(root, filepath.Join(root, "content"), hosts, cacheSize, cacheVersion, platformMC, chunkSize)
+}
+
+// NewWithContentDir creates the provider with the content blobs stored in
+// contentDir, which can be persisted to be reused by subsequent conversions.
+// The content metadata is always stored in root, so a persisted contentDir is
+// reopened against a fresh metadata DB, the blobs existing in contentDir are
+// still reused without fetching since the metadata DB adopts the blobs of
+// backend store by the shared content policy of containerd.
+func NewWithContentDir(root, contentDir string, hosts remote.HostFunc, cacheSize uint, cacheVersion string, platformMC platforms.MatchComparer, chunkSize int64) (*Provider, error) {
 	if err := os.MkdirAll(contentDir, 0755); err != nil {
 		return nil, err
 	}
@@ -58,40 +139,108 @@ func New(root string, hosts remote.HostFunc, cacheSize uint, cacheVersion string
 		platformMC:   platformMC,
 		cacheVersion: cacheVersion,
 		chunkSize:    chunkSize,
+		sockets:      make(map[string]string),
+		cacheHits:    make(map[string]*CacheHit),
+		cachePolicy:  CachePolicyMerge,
+		dialTimeout:  DefaultDialTimeout,
 	}, nil
 }
 
-func newDefaultClient(skipTLSVerify bool) *http.Client {
-	return &http.Client{
-		Transport: &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-			DialContext: (&net.Dialer{
-				Timeout:   30 * time.Second,
-				KeepAlive: 30 * time.Second,
-				DualStack: true,
-			}).DialContext,
-			MaxIdleConns:          10,
-			IdleConnTimeout:       30 * time.Second,
-			TLSHandshakeTimeout:   10 * time.Second,
-			ExpectContinueTimeout: 5 * time.Second,
-			DisableKeepAlives:     true,
-			TLSNextProto:          make(map[string]func(authority string, c *tls.Conn) http.RoundTripper),
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: skipTLSVerify,
-			},
+// ParseUnixSocket parses the socket path from endpoint in the format
+// of `unix:///path/to/registry.sock`.
+func ParseUnixSocket(endpoint string) (string, error) {
+	socketPath := strings.TrimPrefix(endpoint, "unix://")
+	if socketPath == endpoint || !filepath.IsAbs(socketPath) {
+		return "", fmt.Errorf("invalid unix socket endpoint %s, should be in the format 'unix:///path/to/socket'", endpoint)
+	}
+	return socketPath, nil
+}
+
+func newDefaultClient(skipTLSVerify bool, socketPath string, dialTimeout, readTimeout time.Duration, http2 *http2Option) (*http.Client, error) {
+	dialer := &net.Dialer{
+		Timeout:   dialTimeout,
+		KeepAlive: 30 * time.Second,
+		DualStack: true,
+	}
+	dialContext := dialer.DialContext
+	if socketPath != "" {
+		// Ignore the address of registry host, all connections are
+		// established to the unix domain socket.
+		dialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socketPath)
+		}
+	}
+	tlsHandshakeTimeout := 10 * time.Second
+	if readTimeout > 0 && readTimeout < tlsHandshakeTimeout {
+		tlsHandshakeTimeout = readTimeout
+	}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialContext,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       30 * time.Second,
+		TLSHandshakeTimeout:   tlsHandshakeTimeout,
+		ExpectContinueTimeout: 5 * time.Second,
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: skipTLSVerify,
 		},
 	}
+	var roundTripper http.RoundTripper = transport
+	if http2 == nil {
+		transport.DisableKeepAlives = true
+		transport.TLSNextProto = make(map[string]func(authority string, c *tls.Conn) http.RoundTripper)
+	} else {
+		var err error
+		if roundTripper, err = configureHTTP2(transport, http2); err != nil {
+			return nil, err
+		}
+	}
+	if readTimeout > 0 {
+		roundTripper = &readTimeoutTransport{RoundTripper: roundTripper, timeout: readTimeout}
+	}
+	return &http.Client{Transport: roundTripper}, nil
 }
 
-func newResolver(insecure, plainHTTP bool, credFunc remote.CredentialFunc, chunkSize int64) remotes.Resolver {
-	registryHosts := docker.ConfigureDefaultRegistries(
-		docker.WithAuthorizer(
-			docker.NewDockerAuthorizer(
-				docker.WithAuthClient(newDefaultClient(insecure)),
-				docker.WithAuthCreds(credFunc),
+func newResolver(insecure, plainHTTP bool, credFunc, mountCredFunc remote.CredentialFunc, chunkSize int64, socketPath string, dialTimeout, readTimeout, manifestTimeout, blobTimeout time.Duration, http2 *http2Option, subjects *subjectRecorder) (remotes.Resolver, error) {
+	client, err := newDefaultClient(insecure, socketPath, dialTimeout, readTimeout, http2)
+	if err != nil {
+		return nil, err
+	}
+	if manifestTimeout > 0 || blobTimeout > 0 {
+		client.Transport = &requestTimeoutTransport{
+			RoundTripper:    client.Transport,
+			manifestTimeout: manifestTimeout,
+			blobTimeout:     blobTimeout,
+		}
+	}
+	client.Transport = &retryAfterTransport{RoundTripper: client.Transport}
+	if subjects != nil {
+		client.Transport = &subjectTransport{RoundTripper: client.Transport, recorder: subjects}
+	}
+	authClient, err := newDefaultClient(insecure, socketPath, dialTimeout, readTimeout, http2)
+	if err != nil {
+		return nil, err
+	}
+	authorizer := docker.NewDockerAuthorizer(
+		docker.WithAuthClient(authClient),
+		docker.WithAuthCreds(credFunc),
+	)
+	if mountCredFunc != nil {
+		mountAuthClient, err := newDefaultClient(insecure, socketPath, dialTimeout, readTimeout, http2)
+		if err != nil {
+			return nil, err
+		}
+		authorizer = &mountAuthorizer{
+			Authorizer: authorizer,
+			mount: docker.NewDockerAuthorizer(
+				docker.WithAuthClient(mountAuthClient),
+				docker.WithAuthCreds(mountCredFunc),
 			),
-		),
-		docker.WithClient(newDefaultClient(insecure)),
+		}
+	}
+	registryHosts := docker.ConfigureDefaultRegistries(
+		docker.WithAuthorizer(authorizer),
+		docker.WithClient(client),
 		docker.WithPlainHTTP(func(_ string) (bool, error) {
 			return plainHTTP, nil
 		}),
@@ -100,56 +249,363 @@ func newResolver(insecure, plainHTTP bool, credFunc remote.CredentialFunc, chunk
 
 	return docker.NewResolver(docker.ResolverOptions{
 		Hosts: registryHosts,
-	})
+	}), nil
 }
 
 func (pvd *Provider) UsePlainHTTP() {
 	pvd.usePlainHTTP = true
 }
 
+// socketKey normalizes ref to its repository name, so that the equivalent
+// refs like `nginx` and `docker.io/library/nginx:latest` share the socket.
+func socketKey(ref string) string {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return ref
+	}
+	return named.Name()
+}
+
+// UseUnixSocket sends the registry requests of the repository of ref over
+// the unix domain socket at socketPath, the requests use plain HTTP since
+// the socket is node-local.
+func (pvd *Provider) UseUnixSocket(ref, socketPath string) {
+	pvd.mutex.Lock()
+	defer pvd.mutex.Unlock()
+	pvd.sockets[socketKey(ref)] = socketPath
+}
+
+// SetMaxBlobSize splits the source layers whose file data exceeds size on
+// pulling, so that each nydus blob built from the split layers is smaller
+// than size, see splitImageLayers. The image is still rejected before
+// pushing if any of its blobs is larger than size, e.g. the bootstrap or the
+// blob of a single large file which can't be split. Zero means no
+// limitation.
+func (pvd *Provider) SetMaxBlobSize(size int64) {
+	pvd.maxBlobSize = size
+}
+
+func (pvd *Provider) countingResolver(resolver remotes.Resolver) remotes.Resolver {
+	return &countingResolver{
+		Resolver:      resolver,
+		pushedBytes:   &pvd.pushedBytes,
+		existingBytes: &pvd.existingBytes,
+		destinations:  &pvd.destinations,
+	}
+}
+
 func (pvd *Provider) Resolver(ref string) (remotes.Resolver, error) {
 	credFunc, insecure, err := pvd.hosts(ref)
 	if err != nil {
 		return nil, err
 	}
-	return newResolver(insecure, pvd.usePlainHTTP, credFunc, pvd.chunkSize), nil
+	pvd.mutex.Lock()
+	socketPath := pvd.sockets[socketKey(ref)]
+	pvd.mutex.Unlock()
+	plainHTTP := pvd.usePlainHTTP || socketPath != ""
+	var mountCredFunc remote.CredentialFunc
+	if pvd.mountFrom != nil {
+		if mountCredFunc, _, err = pvd.hosts(pvd.mountFrom.ref); err != nil {
+			return nil, err
+		}
+	}
+	return newResolver(insecure, plainHTTP, credFunc, mountCredFunc, pvd.chunkSize, socketPath, pvd.dialTimeout, pvd.readTimeout, pvd.manifestTimeout, pvd.blobTimeout, pvd.http2, &pvd.subjectRecorder)
 }
 
 func (pvd *Provider) Pull(ctx context.Context, ref string) error {
+	pvd.observeStage(StagePull, ref)
 	resolver, err := pvd.Resolver(ref)
 	if err != nil {
 		return err
 	}
 	rc := &containerd.RemoteContext{
-		Resolver:               resolver,
+		Resolver:               pvd.sessionResolver(pvd.limitedResolver(pvd.timingResolver(resolver))),
 		PlatformMatcher:        pvd.platformMC,
-		MaxConcurrentDownloads: LayerConcurrentLimit,
+		MaxConcurrentDownloads: pvd.concurrencyLimit(),
+		// The legacy docker schema1 manifest is converted to OCI manifest
+		// on pulling, so that it's built like other source images.
+		ConvertSchema1: true, // nolint:staticcheck
+		HandlerWrapper: func(handler images.Handler) images.Handler {
+			return pvd.checkpointHandlerWrapper(debugHandlerWrapper(inlineDataHandlerWrapper(pvd.store, skipForeignHandlerWrapper(handler))))
+		},
 	}
 
 	img, err := fetch(ctx, pvd.store, rc, ref, 0)
 	if err != nil {
 		return err
 	}
+	if pvd.sourcePlatform != nil {
+		if err := checkPlatform(ctx, pvd.store, img.Target, *pvd.sourcePlatform); err != nil {
+			return errors.Wrapf(err, "check platform of image %s", ref)
+		}
+	}
+	if len(pvd.sourceDiffIDs) > 0 {
+		if err := pvd.checkSourceDiffIDs(ctx, img.Target); err != nil {
+			return errors.Wrapf(err, "check source diff IDs of image %s", ref)
+		}
+	}
+	if pvd.layerCompressors != nil && len(pvd.layerCompressors.overrides) > 0 {
+		if err := pvd.resolveLayerCompressors(ctx, img.Target); err != nil {
+			return errors.Wrapf(err, "resolve layer compressors of image %s", ref)
+		}
+	}
+	newDesc, err := pvd.stripForeignLayers(ctx, img.Target)
+	if err != nil {
+		return errors.Wrapf(err, "strip foreign layers of image %s", ref)
+	}
+	img.Target = *newDesc
+	newDesc, err = pvd.rewriteImageLayers(ctx, img.Target, pvd.layerRewriter(ctx))
+	if err != nil {
+		return errors.Wrapf(err, "rewrite layers of image %s", ref)
+	}
+	img.Target = *newDesc
+	if pvd.smallImageThreshold > 0 && pvd.base == nil && pvd.cache == nil {
+		newDesc, err = pvd.batchImageLayers(ctx, img.Target)
+		if err != nil {
+			return errors.Wrapf(err, "batch layers of image %s", ref)
+		}
+		img.Target = *newDesc
+	}
+
+	if pvd.maxBlobSize > 0 {
+		newDesc, err = pvd.splitImageLayers(ctx, img.Target)
+		if err != nil {
+			return errors.Wrapf(err, "split layers of image %s", ref)
+		}
+		img.Target = *newDesc
+	}
+
+	if pvd.base != nil {
+		if err := pvd.reuseBaseBlobs(ctx, img.Target); err != nil {
+			return errors.Wrapf(err, "reuse base nydus blobs for image %s", ref)
+		}
+	}
+	if pvd.layerCompressors != nil {
+		if err := pvd.buildLayerCompressors(ctx, img.Target); err != nil {
+			return errors.Wrapf(err, "build layers with compressors for image %s", ref)
+		}
+	}
+
+	// Count the cache hit before conversion, the cache will be updated
+	// by the converted layers.
+	var cacheHit *CacheHit
+	if pvd.cache != nil {
+		if cached, total, err := pvd.cache.HitCount(ctx, img.Target, pvd.platformMC); err == nil {
+			cacheHit = &CacheHit{Cached: cached, Total: total}
+		}
+	}
 
 	pvd.mutex.Lock()
 	defer pvd.mutex.Unlock()
 	pvd.images[ref] = &img.Target
+	if cacheHit != nil {
+		pvd.cacheHits[ref] = cacheHit
+	}
 
 	return nil
 }
 
 func (pvd *Provider) Push(ctx context.Context, desc ocispec.Descriptor, ref string) error {
+	// The cache records are dropped for read-only cache.
+	if pvd.cacheReadOnly && pvd.cache != nil && pvd.cache.Ref == ref {
+		return nil
+	}
+	pvd.observeStage(StagePush, ref)
+
 	resolver, err := pvd.Resolver(ref)
 	if err != nil {
 		return err
 	}
+	if pvd.skipBlobPush {
+		if err := checkExternalBlobs(ctx, pvd.store, resolver, desc, ref); err != nil {
+			return err
+		}
+	}
+	if pvd.base != nil && pvd.base.reference {
+		if err := pvd.checkReferencedBlobs(ctx, resolver, desc, ref); err != nil {
+			return err
+		}
+	}
 	rc := &containerd.RemoteContext{
-		Resolver:                    resolver,
+		HandlerWrapper:              skipForeignHandlerWrapper,
+		Resolver:                    pvd.limitedResolver(pvd.uploadResolver(pvd.countingResolver(pvd.timingResolver(pvd.checkpointResolver(pvd.externalBlobResolver(pvd.mountResolver(resolver))))))),
 		PlatformMatcher:             pvd.platformMC,
-		MaxConcurrentUploadedLayers: LayerConcurrentLimit,
+		MaxConcurrentUploadedLayers: pvd.concurrencyLimit(),
+	}
+
+	isCache := pvd.cache != nil && pvd.cache.Ref == ref
+	if sources := pvd.originalSources(); len(sources) > 0 && !isCache {
+		newDesc, err := restoreSourceDigests(ctx, pvd.store, desc, sources)
+		if err != nil {
+			return errors.Wrapf(err, "restore source digests of image %s", ref)
+		}
+		desc = *newDesc
+	}
+
+	if pvd.blobReferenceCheck != nil && !isCache {
+		if err := checkBlobReferences(ctx, pvd.store, desc, *pvd.blobReferenceCheck); err != nil {
+			return errors.Wrapf(err, "check blob references of image %s", ref)
+		}
+	}
+
+	if pvd.targetPlatform != nil && !isCache {
+		newDesc, err := setPlatform(ctx, pvd.store, desc, *pvd.targetPlatform)
+		if err != nil {
+			return errors.Wrapf(err, "set platform of image %s", ref)
+		}
+		desc = *newDesc
+	}
+
+	if pvd.sourceDigestLabel && !isCache {
+		newDesc, err := setSourceDigestLabel(ctx, pvd.store, desc)
+		if err != nil {
+			return errors.Wrapf(err, "set source digest label of image %s", ref)
+		}
+		desc = *newDesc
+	}
+
+	if pvd.history != nil && !isCache {
+		newDesc, err := setHistory(ctx, pvd.store, desc, *pvd.history)
+		if err != nil {
+			return errors.Wrapf(err, "set history of image %s", ref)
+		}
+		desc = *newDesc
 	}
 
-	return push(ctx, pvd.store, rc, desc, ref)
+	if pvd.manifestFormat != "" && !isCache {
+		newDesc, err := setFormat(ctx, pvd.store, desc, pvd.manifestFormat)
+		if err != nil {
+			return errors.Wrapf(err, "set manifest format of image %s", ref)
+		}
+		desc = *newDesc
+	}
+
+	if pvd.blobMediaType != "" && !isCache {
+		newDesc, err := setBlobMediaType(ctx, pvd.store, desc, pvd.blobMediaType)
+		if err != nil {
+			return errors.Wrapf(err, "set blob media type of image %s", ref)
+		}
+		desc = *newDesc
+	}
+
+	if pvd.layerCompressors != nil && !isCache {
+		newDesc, err := setBlobCompressors(ctx, pvd.store, desc, pvd.layerCompressors.blobCompressors())
+		if err != nil {
+			return errors.Wrapf(err, "set blob compressors of image %s", ref)
+		}
+		desc = *newDesc
+	}
+
+	if pvd.bootstrapCompressor != nil && !isCache {
+		newDesc, err := setBootstrapCompressor(ctx, pvd.store, desc, *pvd.bootstrapCompressor)
+		if err != nil {
+			return errors.Wrapf(err, "set bootstrap compressor of image %s", ref)
+		}
+		desc = *newDesc
+	}
+
+	if !isCache {
+		newDesc, err := sortLayers(ctx, pvd.store, desc, pvd.blobOrder)
+		if err != nil {
+			return errors.Wrapf(err, "sort layers of image %s", ref)
+		}
+		desc = *newDesc
+	}
+
+	if !isCache {
+		newDesc, err := setCapability(ctx, pvd.store, desc)
+		if err != nil {
+			return errors.Wrapf(err, "set capability annotations of image %s", ref)
+		}
+		desc = *newDesc
+	}
+
+	if !isCache {
+		newDesc, err := setArtifactType(ctx, pvd.store, desc, pvd.artifactTypePolicy)
+		if err != nil {
+			return errors.Wrapf(err, "set artifact type of image %s", ref)
+		}
+		desc = *newDesc
+	}
+
+	if pvd.layerNameTemplate != nil && !isCache {
+		newDesc, err := setLayerNames(ctx, pvd.store, desc, pvd.layerNameTemplate, ref)
+		if err != nil {
+			return errors.Wrapf(err, "set layer names of image %s", ref)
+		}
+		desc = *newDesc
+	}
+
+	if foreignLayers := pvd.strippedForeignLayers(); len(foreignLayers) > 0 && !isCache {
+		newDesc, err := restoreForeignLayers(ctx, pvd.store, desc, foreignLayers)
+		if err != nil {
+			return errors.Wrapf(err, "restore foreign layers of image %s", ref)
+		}
+		desc = *newDesc
+	}
+
+	if store, ok := pvd.store.(*aliasStore); ok && !isCache {
+		newDesc, err := redigest(ctx, store, desc, pvd.digestAlgorithm)
+		if err != nil {
+			return errors.Wrapf(err, "digest image %s by %s", ref, pvd.digestAlgorithm)
+		}
+		desc = *newDesc
+	}
+
+	// The bootstrap layer is recompressed by the manifest rewrites above,
+	// so the sizes are checked against the final manifest to be pushed.
+	if pvd.maxBlobSize > 0 {
+		if err := checkBlobSize(ctx, pvd.store, desc, pvd.maxBlobSize); err != nil {
+			return err
+		}
+	}
+
+	if pvd.harborAccessory && !isCache {
+		if err := pvd.pushSubjects(ctx, rc, desc, ref); err != nil {
+			return err
+		}
+	}
+
+	if pvd.isCacheIndex(desc, ref) {
+		err = pvd.pushCache(ctx, desc, ref, func(desc ocispec.Descriptor) error {
+			return push(ctx, pvd.store, rc, desc, ref)
+		})
+	} else {
+		err = pvd.pushAtomic(ctx, rc, desc, ref)
+	}
+	if err != nil {
+		return err
+	}
+
+	if pvd.generateSBOM && !isCache {
+		if err := pvd.pushSBOMs(ctx, rc, desc, ref); err != nil {
+			return err
+		}
+	}
+
+	if pvd.lazyIndexInspector != nil && !isCache {
+		if err := pvd.pushLazyIndexes(ctx, rc, desc, ref); err != nil {
+			return err
+		}
+	}
+
+	if pvd.fileManifest && !isCache {
+		if err := pvd.pushFileManifests(ctx, rc, desc, ref); err != nil {
+			return err
+		}
+	}
+
+	if !isCache {
+		if err := pvd.pushSubjectsFallback(ctx, rc, desc, ref); err != nil {
+			return err
+		}
+	}
+
+	pvd.mutex.Lock()
+	defer pvd.mutex.Unlock()
+	pvd.images[ref] = &desc
+
+	return nil
 }
 
 func (pvd *Provider) Image(_ context.Context, ref string) (*ocispec.Descriptor, error) {
@@ -169,9 +625,20 @@ func (pvd *Provider) SetContentStore(store content.Store) {
 	pvd.store = store
 }
 
+// wrapStore wraps the content store by wrap, the aliasStore is kept
+// outermost, since it's asserted on pushing.
+func (pvd *Provider) wrapStore(wrap func(content.Store) content.Store) {
+	if store, ok := pvd.store.(*aliasStore); ok {
+		store.Store = wrap(store.Store)
+		return
+	}
+	pvd.store = wrap(pvd.store)
+}
+
 func (pvd *Provider) NewRemoteCache(ctx context.Context, ref string) (context.Context, *cache.RemoteCache) {
-	if ref != "" {
-		return cache.New(ctx, ref, "", pvd.cacheSize, pvd)
+	if ref != "" && !pvd.noCache {
+		ctx, pvd.cache = cache.New(ctx, ref, "", pvd.cacheSize, pvd)
+		return ctx, pvd.cache
 	}
 	return ctx, nil
 }
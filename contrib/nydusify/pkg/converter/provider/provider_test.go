@@ -0,0 +1,732 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/goharbor/acceleration-service/pkg/remote"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+func TestParseUnixSocket(t *testing.T) {
+	socketPath, err := ParseUnixSocket("unix:///run/registry.sock")
+	require.NoError(t, err)
+	require.Equal(t, "/run/registry.sock", socketPath)
+
+	for _, endpoint := range []string{"/run/registry.sock", "unix://run/registry.sock", "tcp://127.0.0.1:5000"} {
+		_, err := ParseUnixSocket(endpoint)
+		require.Error(t, err)
+	}
+}
+
+func TestResolverWithUnixSocket(t *testing.T) {
+	manifest := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","layers":[]}`)
+	manifestDigest := digest.FromBytes(manifest)
+
+	socketPath := filepath.Join(t.TempDir(), "registry.sock")
+	listener, err := net.Listen("unix", socketPath)
+	require.NoError(t, err)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/", "/v2":
+			w.WriteHeader(http.StatusOK)
+		case "/v2/library/nginx/manifests/latest", "/v2/library/nginx/manifests/" + manifestDigest.String():
+			w.Header().Set("Content-Type", ocispec.MediaTypeImageManifest)
+			w.Header().Set("Docker-Content-Digest", manifestDigest.String())
+			w.Header().Set("Content-Length", strconv.Itoa(len(manifest)))
+			if r.Method == http.MethodGet {
+				_, _ = w.Write(manifest)
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})}
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	defer server.Close()
+
+	hosts := func(string) (remote.CredentialFunc, bool, error) {
+		return func(string) (string, string, error) { return "", "", nil }, false, nil
+	}
+	pvd, err := New(t.TempDir(), hosts, 200, "v1", platforms.All, 0)
+	require.NoError(t, err)
+
+	// The registry host doesn't need to be resolvable, since all
+	// connections are made through the unix domain socket.
+	ref := "registry.invalid/library/nginx:latest"
+	pvd.UseUnixSocket(ref, socketPath)
+
+	resolver, err := pvd.Resolver(ref)
+	require.NoError(t, err)
+	_, desc, err := resolver.Resolve(context.Background(), ref)
+	require.NoError(t, err)
+	require.Equal(t, manifestDigest, desc.Digest)
+
+	fetcher, err := resolver.Fetcher(context.Background(), ref)
+	require.NoError(t, err)
+	reader, err := fetcher.Fetch(context.Background(), desc)
+	require.NoError(t, err)
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, manifest, data)
+
+	// The equivalent ref of the same repository goes through the socket too.
+	digestRef := "registry.invalid/library/nginx@" + manifestDigest.String()
+	resolver, err = pvd.Resolver(digestRef)
+	require.NoError(t, err)
+	_, desc, err = resolver.Resolve(context.Background(), digestRef)
+	require.NoError(t, err)
+	require.Equal(t, manifestDigest, desc.Digest)
+}
+
+func TestSocketKey(t *testing.T) {
+	require.Equal(t, socketKey("nginx"), socketKey("docker.io/library/nginx:latest"))
+	require.Equal(t, socketKey("localhost:5000/app:v1"), socketKey("localhost:5000/app@sha256:"+strings.Repeat("a", 64)))
+	require.NotEqual(t, socketKey("localhost:5000/app"), socketKey("localhost:5001/app"))
+	require.Equal(t, "INVALID REF", socketKey("INVALID REF"))
+}
+
+func TestCheckBlobSize(t *testing.T) {
+	ctx := context.Background()
+	store, err := local.NewStore(t.TempDir())
+	require.NoError(t, err)
+
+	writeJSON := func(mediaType string, obj interface{}) ocispec.Descriptor {
+		data, err := json.Marshal(obj)
+		require.NoError(t, err)
+		desc := ocispec.Descriptor{
+			MediaType: mediaType,
+			Digest:    digest.FromBytes(data),
+			Size:      int64(len(data)),
+		}
+		require.NoError(t, content.WriteBlob(ctx, store, desc.Digest.String(), bytes.NewReader(data), desc))
+		return desc
+	}
+
+	config := writeJSON(ocispec.MediaTypeImageConfig, ocispec.Image{})
+	manifest := writeJSON(ocispec.MediaTypeImageManifest, ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers: []ocispec.Descriptor{
+			{
+				MediaType: "application/vnd.oci.image.layer.nydus.blob.v1",
+				Digest:    digest.FromString("blob"),
+				Size:      2 << 20,
+			},
+			{
+				MediaType: ocispec.MediaTypeImageLayerGzip,
+				Digest:    digest.FromString("bootstrap"),
+				Size:      1 << 10,
+			},
+		},
+	})
+	index := writeJSON(ocispec.MediaTypeImageIndex, ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{manifest},
+	})
+
+	require.NoError(t, checkBlobSize(ctx, store, manifest, 2<<20))
+	require.NoError(t, checkBlobSize(ctx, store, index, 4<<20))
+
+	err = checkBlobSize(ctx, store, index, 1<<20)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), digest.FromString("blob").String())
+	require.Contains(t, err.Error(), "exceeds the maximum blob size 1.0 MiB")
+}
+
+func TestConvertForeignLayer(t *testing.T) {
+	foreignFetches := 0
+	foreignServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		foreignFetches++
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer foreignServer.Close()
+	foreignDiffID := digest.FromString("foreign diff")
+	foreign := ocispec.Descriptor{
+		MediaType: images.MediaTypeDockerSchema2LayerForeignGzip,
+		Digest:    digest.FromString("foreign layer data"),
+		Size:      1 << 30,
+		URLs:      []string{foreignServer.URL + "/layers/foreign.tar.gz"},
+	}
+
+	registry := newPushableRegistry(t)
+	layerDiffID := digest.FromString("layer diff")
+	configData, err := json.Marshal(ocispec.Image{
+		Platform: ocispec.Platform{OS: "linux", Architecture: "amd64"},
+		RootFS:   ocispec.RootFS{Type: "layers", DiffIDs: []digest.Digest{foreignDiffID, layerDiffID}},
+	})
+	require.NoError(t, err)
+	config := registry.AddBlob(images.MediaTypeDockerSchema2Config, configData)
+	layer := registry.AddBlob(images.MediaTypeDockerSchema2LayerGzip, []byte("normal layer data"))
+	manifestData, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: images.MediaTypeDockerSchema2Manifest,
+		Config:    config,
+		Layers:    []ocispec.Descriptor{foreign, layer},
+	})
+	require.NoError(t, err)
+	manifest := registry.AddBlob(images.MediaTypeDockerSchema2Manifest, manifestData)
+	registry.SetTag("library/mixed", "latest", manifest.Digest)
+
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+	sourceRef := registry.host + "/library/mixed:latest"
+	require.NoError(t, pvd.Pull(ctx, sourceRef))
+
+	// The foreign layer is neither fetched nor built.
+	require.Zero(t, foreignFetches)
+	source, err := pvd.Image(ctx, sourceRef)
+	require.NoError(t, err)
+	var sourceManifest ocispec.Manifest
+	require.NoError(t, readJSON(ctx, pvd.store, *source, &sourceManifest))
+	require.Equal(t, []ocispec.Descriptor{layer}, sourceManifest.Layers)
+	var sourceConfig ocispec.Image
+	require.NoError(t, readJSON(ctx, pvd.store, sourceManifest.Config, &sourceConfig))
+	require.Equal(t, []digest.Digest{layerDiffID}, sourceConfig.RootFS.DiffIDs)
+
+	// The nydus manifest converted from the stripped source manifest.
+	blob, err := writeJSON(ctx, pvd.store, map[string]string{"blob": "data"}, utils.MediaTypeNydusBlob)
+	require.NoError(t, err)
+	bootstrap, err := writeJSON(ctx, pvd.store, map[string]string{"bootstrap": "data"}, ocispec.MediaTypeImageLayerGzip)
+	require.NoError(t, err)
+	bootstrap.Annotations = map[string]string{utils.LayerAnnotationNydusBootstrap: "true"}
+	nydusConfig, err := writeJSON(ctx, pvd.store, ocispec.Image{
+		Platform: ocispec.Platform{OS: "linux", Architecture: "amd64"},
+		RootFS:   ocispec.RootFS{Type: "layers", DiffIDs: []digest.Digest{blob.Digest, bootstrap.Digest}},
+	}, images.MediaTypeDockerSchema2Config)
+	require.NoError(t, err)
+	nydusManifest, err := writeJSON(ctx, pvd.store, ocispec.Manifest{
+		Versioned:   specs.Versioned{SchemaVersion: 2},
+		MediaType:   images.MediaTypeDockerSchema2Manifest,
+		Config:      *nydusConfig,
+		Layers:      []ocispec.Descriptor{*blob, *bootstrap},
+		Annotations: map[string]string{utils.ManifestNydusSourceDigest: source.Digest.String()},
+	}, images.MediaTypeDockerSchema2Manifest)
+	require.NoError(t, err)
+
+	require.NoError(t, pvd.Push(ctx, *nydusManifest, registry.host+"/library/mixed:nydus"))
+	_, data, ok := registry.Tag("library/mixed", "nydus")
+	require.True(t, ok)
+	var pushed ocispec.Manifest
+	require.NoError(t, json.Unmarshal(data, &pushed))
+
+	// The foreign layer is kept with its URLs, and not pushed to registry.
+	require.Len(t, pushed.Layers, 3)
+	require.Equal(t, foreign, pushed.Layers[0])
+	require.Equal(t, foreign.URLs, pushed.Layers[0].URLs)
+	require.Equal(t, bootstrap.Digest, pushed.Layers[2].Digest)
+	require.Equal(t, manifest.Digest.String(), pushed.Annotations[utils.ManifestNydusSourceDigest])
+	_, ok = registry.Blob(foreign.Digest)
+	require.False(t, ok)
+	require.Zero(t, foreignFetches)
+
+	pushedConfigData, ok := registry.Blob(pushed.Config.Digest)
+	require.True(t, ok)
+	var pushedConfig ocispec.Image
+	require.NoError(t, json.Unmarshal(pushedConfigData, &pushedConfig))
+	require.Equal(t, []digest.Digest{foreignDiffID, blob.Digest, bootstrap.Digest}, pushedConfig.RootFS.DiffIDs)
+}
+
+func TestPullInlineDataLayer(t *testing.T) {
+	registry := newPushableRegistry(t)
+	config := registry.AddBlob(ocispec.MediaTypeImageConfig, []byte(`{"architecture":"amd64","os":"linux"}`))
+
+	// The inline layer doesn't exist in registry.
+	inlineData := []byte("inline layer data")
+	inline := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromBytes(inlineData),
+		Size:      int64(len(inlineData)),
+		Data:      inlineData,
+	}
+	// The layer with corrupted inline data is fetched from registry.
+	corrupted := registry.AddBlob(ocispec.MediaTypeImageLayerGzip, []byte("normal layer data"))
+	corrupted.Data = []byte("corrupted layer data")
+
+	manifestData, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []ocispec.Descriptor{inline, corrupted},
+	})
+	require.NoError(t, err)
+	manifest := registry.AddBlob(ocispec.MediaTypeImageManifest, manifestData)
+	registry.SetTag("library/inline", "latest", manifest.Digest)
+
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+	require.NoError(t, pvd.Pull(ctx, registry.host+"/library/inline:latest"))
+	require.Equal(t, 2, registry.BlobFetches())
+
+	data, err := content.ReadBlob(ctx, pvd.ContentStore(), inline)
+	require.NoError(t, err)
+	require.Equal(t, inlineData, data)
+	data, err = content.ReadBlob(ctx, pvd.ContentStore(), corrupted)
+	require.NoError(t, err)
+	require.Equal(t, []byte("normal layer data"), data)
+}
+
+func TestPullSchema1(t *testing.T) {
+	registry := newPushableRegistry(t)
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	_, err := gw.Write([]byte("layer data"))
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+	layer := registry.AddBlob(images.MediaTypeDockerSchema2LayerGzip, buf.Bytes())
+
+	// The schema1 manifest is signed by JWS, the payload is recovered by
+	// the format length and tail in protected header.
+	payload, err := json.MarshalIndent(map[string]interface{}{
+		"schemaVersion": 1,
+		"name":          "library/legacy",
+		"tag":           "latest",
+		"architecture":  "amd64",
+		"fsLayers":      []map[string]string{{"blobSum": layer.Digest.String()}},
+		"history": []map[string]string{{
+			"v1Compatibility": `{"id":"1","architecture":"amd64","os":"linux","created":"2023-01-01T00:00:00Z"}`,
+		}},
+	}, "", "   ")
+	require.NoError(t, err)
+	formatLength := len(payload) - 2
+	protected, err := json.Marshal(map[string]interface{}{
+		"formatLength": formatLength,
+		"formatTail":   base64.RawURLEncoding.EncodeToString(payload[formatLength:]),
+	})
+	require.NoError(t, err)
+	signed := string(payload[:formatLength]) + `,
+   "signatures": [{"protected": "` + base64.RawURLEncoding.EncodeToString(protected) + `"}]
+}`
+	manifest := registry.AddBlob(images.MediaTypeDockerSchema1Manifest, []byte(signed))
+	registry.SetTag("library/legacy", "latest", manifest.Digest)
+
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+	ref := registry.host + "/library/legacy:latest"
+	require.NoError(t, pvd.Pull(ctx, ref))
+
+	// The converted OCI manifest is built like other source images.
+	desc, err := pvd.Image(ctx, ref)
+	require.NoError(t, err)
+	require.Equal(t, ocispec.MediaTypeImageManifest, desc.MediaType)
+	var converted ocispec.Manifest
+	data, err := content.ReadBlob(ctx, pvd.ContentStore(), *desc)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, &converted))
+	require.Len(t, converted.Layers, 1)
+	require.Equal(t, layer.Digest, converted.Layers[0].Digest)
+
+	var config ocispec.Image
+	data, err = content.ReadBlob(ctx, pvd.ContentStore(), converted.Config)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, &config))
+	require.Equal(t, "amd64", config.Architecture)
+	require.Equal(t, "linux", config.OS)
+	require.Equal(t, []digest.Digest{digest.FromString("layer data")}, config.RootFS.DiffIDs)
+}
+
+func TestPullWithPersistentContent(t *testing.T) {
+	registry := newPushableRegistry(t)
+	manifest := addTestManifest(t, registry, "linux/amd64", strings.Repeat("layer data", 1<<20))
+	registry.SetTag("library/image", "latest", manifest.Digest)
+	ref := registry.host + "/library/image:latest"
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+
+	hosts := func(string) (remote.CredentialFunc, bool, error) {
+		return func(string) (string, string, error) { return "", "", nil }, false, nil
+	}
+	contentDir := filepath.Join(t.TempDir(), "content")
+	pull := func() time.Duration {
+		pvd, err := NewWithContentDir(t.TempDir(), contentDir, hosts, 200, "v1", platforms.All, 0)
+		require.NoError(t, err)
+		pvd.UsePlainHTTP()
+		start := time.Now()
+		require.NoError(t, pvd.Pull(ctx, ref))
+		return time.Since(start)
+	}
+
+	cold := pull()
+	fetches := registry.BlobFetches()
+	require.Equal(t, 2, fetches)
+
+	// The warmed content is reused by a fresh metadata DB without fetching
+	// the blobs again.
+	warm := pull()
+	require.Equal(t, fetches, registry.BlobFetches())
+	t.Logf("pull elapsed: cold %s, warm %s", cold, warm)
+}
+
+func TestPullDebugLog(t *testing.T) {
+	registry := newPushableRegistry(t)
+	manifest := addTestManifest(t, registry, "linux/amd64", "layer data")
+	registry.SetTag("library/image", "latest", manifest.Digest)
+	ref := registry.host + "/library/image:latest"
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+
+	level := logrus.GetLevel()
+	defer logrus.SetLevel(level)
+	defer logrus.SetOutput(os.Stderr)
+
+	pull := func(level logrus.Level) string {
+		var buf bytes.Buffer
+		logrus.SetOutput(&buf)
+		logrus.SetLevel(level)
+		pvd := newPlatformProvider(t, platforms.All, "", "")
+		require.NoError(t, pvd.Pull(ctx, ref))
+		require.NoError(t, pvd.Push(ctx, manifest, registry.host+"/library/image:copy"))
+		return buf.String()
+	}
+
+	output := pull(logrus.InfoLevel)
+	require.NotContains(t, output, "fetched ")
+	require.NotContains(t, output, "skip pushing ")
+
+	output = pull(logrus.DebugLevel)
+	require.Contains(t, output, "fetched "+ocispec.MediaTypeImageManifest+" "+manifest.Digest.String())
+	require.Contains(t, output, "skip pushing "+ocispec.MediaTypeImageLayerGzip)
+}
+
+func TestTransferDebugLog(t *testing.T) {
+	registry := newPushableRegistry(t)
+	manifest := addTestManifest(t, registry, "linux/amd64", "layer data")
+	registry.SetTag("library/image", "latest", manifest.Digest)
+	ref := registry.host + "/library/image:latest"
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	var image ocispec.Manifest
+	require.NoError(t, json.Unmarshal(registry.blobs[manifest.Digest], &image))
+	layer := image.Layers[0]
+
+	level := logrus.GetLevel()
+	defer logrus.SetLevel(level)
+	defer logrus.SetOutput(os.Stderr)
+	var buf bytes.Buffer
+	logrus.SetOutput(&buf)
+	logrus.SetLevel(logrus.DebugLevel)
+
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+	require.NoError(t, pvd.Pull(ctx, ref))
+	target := newPushableRegistry(t)
+	require.NoError(t, pvd.Push(ctx, manifest, target.host+"/library/image:latest"))
+
+	// The statistics are logged for each layer, but not for the manifest
+	// and config.
+	lines := strings.Split(buf.String(), "\n")
+	for _, prefix := range []string{"pulled layer ", "pushed layer "} {
+		var found []string
+		for _, line := range lines {
+			if strings.Contains(line, prefix) {
+				found = append(found, line)
+			}
+		}
+		require.Len(t, found, 1, prefix)
+		require.Contains(t, found[0], prefix+layer.Digest.String()+", size "+strconv.FormatInt(layer.Size, 10))
+		for _, field := range []string{"ttfb=", "elapsed=", "throughput=", "retries=0"} {
+			require.Contains(t, found[0], field)
+		}
+	}
+}
+
+func TestSetLayerNameTemplate(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+	require.Error(t, pvd.SetLayerNameTemplate("{{.Unknown}}"))
+	require.NoError(t, pvd.SetLayerNameTemplate("{{.Image}}-{{.Type}}-{{.ShortDigest}}"))
+	manifest, blob, bootstrap := writeNydusImage(t, ctx, pvd)
+
+	registry := newPushableRegistry(t)
+	ref := registry.host + "/library/nginx:latest"
+	require.NoError(t, pvd.Push(ctx, manifest, ref))
+	_, data, ok := registry.Tag("library/nginx", "latest")
+	require.True(t, ok)
+
+	var pushed ocispec.Manifest
+	require.NoError(t, json.Unmarshal(data, &pushed))
+	require.Len(t, pushed.Layers, 2)
+	require.Equal(t, "nginx-blob-"+blob.Digest.Encoded()[:12], pushed.Layers[0].Annotations[ocispec.AnnotationTitle])
+	require.Equal(t, "nginx-bootstrap-"+bootstrap.Digest.Encoded()[:12], pushed.Layers[1].Annotations[ocispec.AnnotationTitle])
+	require.Equal(t, "true", pushed.Layers[1].Annotations[utils.LayerAnnotationNydusBootstrap])
+}
+
+func TestPullReadTimeout(t *testing.T) {
+	// The server accepts the connections but never responds.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				<-done
+				conn.Close()
+			}()
+		}
+	}()
+
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+	pvd.SetTimeouts(0, 200*time.Millisecond)
+	start := time.Now()
+	require.Error(t, pvd.Pull(ctx, listener.Addr().String()+"/library/stall:latest"))
+	require.Less(t, time.Since(start), 5*time.Second)
+
+	// The server stalls in the middle of response body.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1024")
+		_, _ = w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+	client, err := newDefaultClient(false, "", DefaultDialTimeout, 200*time.Millisecond, nil)
+	require.NoError(t, err)
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	start = time.Now()
+	_, err = io.ReadAll(resp.Body)
+	require.Error(t, err)
+	require.Less(t, time.Since(start), 5*time.Second)
+}
+
+// slowReader returns a chunk of data after each delay.
+type slowReader struct {
+	chunks int
+	delay  time.Duration
+}
+
+func (reader *slowReader) Read(b []byte) (int, error) {
+	if reader.chunks == 0 {
+		return 0, io.EOF
+	}
+	reader.chunks--
+	time.Sleep(reader.delay)
+	return copy(b, "chunk"), nil
+}
+
+func TestReadTimeoutLongUpload(t *testing.T) {
+	// The server responds after the whole request body is received.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write(data)
+	}))
+	defer server.Close()
+
+	// The upload lasts longer than the read timeout but keeps progressing.
+	client, err := newDefaultClient(false, "", DefaultDialTimeout, 200*time.Millisecond, nil)
+	require.NoError(t, err)
+	resp, err := client.Post(server.URL, "application/octet-stream", &slowReader{chunks: 10, delay: 50 * time.Millisecond})
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, strings.Repeat("chunk", 10), string(data))
+}
+
+func TestPushRegistryTimeouts(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	// The blob uploads and manifest requests are delayed by the registry.
+	var blobDelay, manifestDelay time.Duration
+	registry := newPushableRegistry(t, func(w http.ResponseWriter, r *http.Request, serve http.HandlerFunc) {
+		switch _, kind, _ := parseRequest(r); {
+		case kind == "blobs/uploads" && r.Method == http.MethodPut:
+			time.Sleep(blobDelay)
+		case kind == "manifests":
+			time.Sleep(manifestDelay)
+		}
+		serve(w, r)
+	})
+	host := registry.host
+
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+	layer, err := writeJSON(ctx, pvd.store, map[string]string{"layer": "slow"}, ocispec.MediaTypeImageLayerGzip)
+	require.NoError(t, err)
+	config, err := writeJSON(ctx, pvd.store, ocispec.Image{Platform: ocispec.Platform{OS: "linux", Architecture: "amd64"}}, ocispec.MediaTypeImageConfig)
+	require.NoError(t, err)
+	manifest, err := writeJSON(ctx, pvd.store, ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    *config,
+		Layers:    []ocispec.Descriptor{*layer},
+	}, ocispec.MediaTypeImageManifest)
+	require.NoError(t, err)
+
+	// The blob upload longer than the manifest timeout isn't aborted.
+	blobDelay = 300 * time.Millisecond
+	pvd.SetRegistryTimeouts(100*time.Millisecond, 0)
+	require.NoError(t, pvd.Push(ctx, *manifest, host+"/library/slow:blob"))
+	_, _, ok := registry.Tag("library/slow", "blob")
+	require.True(t, ok)
+
+	// The stalled manifest request is aborted by the manifest timeout.
+	blobDelay, manifestDelay = 0, 300*time.Millisecond
+	err = pvd.Push(ctx, *manifest, host+"/library/slow:manifest")
+	require.Error(t, err)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	_, _, ok = registry.Tag("library/slow", "manifest")
+	require.False(t, ok)
+}
+
+// slowStore reads the content slowly but steadily like a slow disk.
+type slowStore struct {
+	content.Store
+}
+
+func (store *slowStore) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	ra, err := store.Store.ReaderAt(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	return &slowReaderAt{ReaderAt: ra}, nil
+}
+
+type slowReaderAt struct {
+	content.ReaderAt
+}
+
+func (ra *slowReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if len(p) > 1024 {
+		p = p[:1024]
+	}
+	time.Sleep(20 * time.Millisecond)
+	return ra.ReaderAt.ReadAt(p, off)
+}
+
+func TestPushRegistryTimeoutsLongUpload(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	// The registry verifies the uploaded blob longer than the read timeout
+	// before responding.
+	registry := newPushableRegistry(t, func(w http.ResponseWriter, r *http.Request, serve http.HandlerFunc) {
+		if _, kind, _ := parseRequest(r); kind == "blobs/uploads" && r.Method == http.MethodPut {
+			if _, err := readBody(r); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			time.Sleep(300 * time.Millisecond)
+		}
+		serve(w, r)
+	})
+	host := registry.host
+
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+	layer, err := writeJSON(ctx, pvd.store, map[string]string{"layer": strings.Repeat("nydus", 8<<10)}, ocispec.MediaTypeImageLayerGzip)
+	require.NoError(t, err)
+	config, err := writeJSON(ctx, pvd.store, ocispec.Image{Platform: ocispec.Platform{OS: "linux", Architecture: "amd64"}}, ocispec.MediaTypeImageConfig)
+	require.NoError(t, err)
+	manifest, err := writeJSON(ctx, pvd.store, ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    *config,
+		Layers:    []ocispec.Descriptor{*layer},
+	}, ocispec.MediaTypeImageManifest)
+	require.NoError(t, err)
+
+	// The layer upload lasts about 800ms, longer than the manifest timeout
+	// and the read timeout, but keeps progressing.
+	pvd.wrapStore(func(store content.Store) content.Store {
+		return &slowStore{Store: store}
+	})
+	pvd.SetTimeouts(0, 200*time.Millisecond)
+	pvd.SetRegistryTimeouts(100*time.Millisecond, 10*time.Second)
+	start := time.Now()
+	require.NoError(t, pvd.Push(ctx, *manifest, host+"/library/slow:latest"))
+	require.Greater(t, time.Since(start), 500*time.Millisecond)
+	_, _, ok := registry.Tag("library/slow", "latest")
+	require.True(t, ok)
+}
+
+// blockingWriter blocks the write until it's closed like the docker push
+// writer whose request body pipe is never read.
+type blockingWriter struct {
+	content.Writer
+	closed chan struct{}
+}
+
+func (writer *blockingWriter) Write(p []byte) (int, error) {
+	<-writer.closed
+	return 0, io.ErrClosedPipe
+}
+
+func (writer *blockingWriter) Close() error {
+	select {
+	case <-writer.closed:
+	default:
+		close(writer.closed)
+	}
+	return nil
+}
+
+type blockingPusher struct {
+	writer *blockingWriter
+}
+
+func (pusher *blockingPusher) Push(ctx context.Context, desc ocispec.Descriptor) (content.Writer, error) {
+	return pusher.writer, nil
+}
+
+func TestCancelableWriter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	blocking := &blockingWriter{closed: make(chan struct{})}
+	pusher := &cancelablePusher{Pusher: &blockingPusher{writer: blocking}}
+	writer, err := pusher.Push(ctx, ocispec.Descriptor{})
+	require.NoError(t, err)
+
+	errC := make(chan error, 1)
+	go func() {
+		_, err := writer.Write([]byte("data"))
+		errC <- err
+	}()
+	cancel()
+	select {
+	case err := <-errC:
+		require.ErrorIs(t, err, context.Canceled)
+	case <-time.After(10 * time.Second):
+		t.Fatal("write is not released by the canceled context")
+	}
+	_, err = writer.Write([]byte("data"))
+	require.ErrorIs(t, err, context.Canceled)
+	require.NoError(t, writer.Close())
+}
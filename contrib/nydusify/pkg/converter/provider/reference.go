@@ -0,0 +1,169 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/labels"
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/log"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// SetReferenceBaseBlobs references the blobs of base nydus image loaded by
+// LoadBaseNydus in registry by digest instead of fetching them, only the
+// bootstraps at the tail of blobs are read by range requests for merging.
+// The referenced blobs are never uploaded on pushing, they're mounted from
+// the repository of base image if they don't exist in target repository,
+// otherwise the push fails before any content is pushed.
+func (pvd *Provider) SetReferenceBaseBlobs(enabled bool) {
+	pvd.referenceBaseBlobs = enabled
+}
+
+// referencedBlob is the base blob referenced in registry, the labels are
+// updated by converter in place of content store.
+type referencedBlob struct {
+	blob   baseBlob
+	labels map[string]string
+}
+
+func (base *baseNydus) referencedBlob(dgst digest.Digest) (*referencedBlob, bool) {
+	base.mutex.Lock()
+	defer base.mutex.Unlock()
+	blob, ok := base.referenced[dgst]
+	return blob, ok
+}
+
+func (blob *referencedBlob) info() content.Info {
+	info := content.Info{
+		Digest: blob.blob.desc.Digest,
+		Size:   blob.blob.desc.Size,
+		Labels: make(map[string]string, len(blob.labels)),
+	}
+	for key, value := range blob.labels {
+		info.Labels[key] = value
+	}
+	return info
+}
+
+// remoteReaderAt reads the blob by seeking the reader fetched from
+// registry, which sends the range request from offset.
+type remoteReaderAt struct {
+	mutex  sync.Mutex
+	reader io.ReadSeekCloser
+	size   int64
+}
+
+func (ra *remoteReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	ra.mutex.Lock()
+	defer ra.mutex.Unlock()
+	if _, err := ra.reader.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(ra.reader, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (ra *remoteReaderAt) Size() int64 {
+	return ra.size
+}
+
+func (ra *remoteReaderAt) Close() error {
+	return ra.reader.Close()
+}
+
+func (base *baseNydus) readerAt(ctx context.Context, blob *referencedBlob) (content.ReaderAt, error) {
+	reader, err := base.fetcher.Fetch(ctx, blob.blob.desc)
+	if err != nil {
+		return nil, errors.Wrapf(err, "fetch blob %s of base nydus image %s", blob.blob.desc.Digest, blob.blob.ref)
+	}
+	seeker, ok := reader.(io.ReadSeekCloser)
+	if !ok {
+		reader.Close()
+		return nil, errors.Errorf("blob %s of base nydus image %s isn't seekable", blob.blob.desc.Digest, blob.blob.ref)
+	}
+	return &remoteReaderAt{reader: seeker, size: blob.blob.desc.Size}, nil
+}
+
+// checkReferencedBlobs walks the image specified by desc and ensures the
+// referenced base blobs exist in the repository of ref before any content is
+// pushed, they're mounted from the repository of base image on the same
+// registry if missing.
+func (pvd *Provider) checkReferencedBlobs(ctx context.Context, resolver remotes.Resolver, desc ocispec.Descriptor, ref string) error {
+	target, err := docker.ParseDockerRef(ref)
+	if err != nil {
+		return errors.Wrapf(err, "parse reference %s", ref)
+	}
+	pusher, err := resolver.Pusher(ctx, ref)
+	if err != nil {
+		return err
+	}
+	handler := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		switch desc.MediaType {
+		case ocispec.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest,
+			ocispec.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList:
+			return images.Children(ctx, pvd.store, desc)
+		}
+		blob, ok := pvd.base.referencedBlob(desc.Digest)
+		if !ok {
+			return nil, nil
+		}
+		if err := pushReferencedBlob(ctx, pusher, target, desc, blob); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	})
+	return images.Walk(ctx, handler, desc)
+}
+
+// pushReferencedBlob pushes the referenced blob by the docker pusher, which
+// confirms the blob exists in target repository or mounts it, the blob is
+// never uploaded since its data isn't in local.
+func pushReferencedBlob(ctx context.Context, pusher remotes.Pusher, target docker.Named, desc ocispec.Descriptor, blob *referencedBlob) error {
+	named, err := docker.ParseDockerRef(blob.blob.ref)
+	if err != nil {
+		return errors.Wrapf(err, "parse reference %s", blob.blob.ref)
+	}
+	domain := docker.Domain(target)
+	if docker.Domain(named) == domain && named.Name() != target.Name() {
+		// The label key is suffixed with the registry host without port.
+		host := domain
+		if h, _, err := net.SplitHostPort(domain); err == nil {
+			host = h
+		}
+		annotations := make(map[string]string, len(desc.Annotations)+1)
+		for key, value := range desc.Annotations {
+			annotations[key] = value
+		}
+		annotations[labels.LabelDistributionSource+"."+host] = docker.Path(named)
+		desc.Annotations = annotations
+	}
+	// The upload is started in background by docker pusher if the blob isn't
+	// found or mounted, it's aborted by the context without writing.
+	pushCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	_, err = pusher.Push(pushCtx, desc)
+	if errdefs.IsAlreadyExists(err) {
+		log.G(ctx).Infof("referenced blob %s of base nydus image %s exists in %s", desc.Digest, blob.blob.ref, target.Name())
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "check referenced blob %s in %s", desc.Digest, target.Name())
+	}
+	return errors.Errorf("referenced blob %s of base nydus image %s doesn't exist in %s", desc.Digest, blob.blob.ref, target.Name())
+}
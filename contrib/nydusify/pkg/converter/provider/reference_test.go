@@ -0,0 +1,164 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"math/rand"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/nydus-snapshotter/pkg/converter"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+// nydusTarEntry appends the entry of name to the nydus formatted tar
+// stream, the data is followed by its tar header.
+func nydusTarEntry(t *testing.T, buf *bytes.Buffer, name string, data []byte) {
+	buf.Write(data)
+	var header bytes.Buffer
+	require.NoError(t, tar.NewWriter(&header).WriteHeader(&tar.Header{
+		Name:     name,
+		Size:     int64(len(data)),
+		Mode:     0444,
+		Typeflag: tar.TypeReg,
+	}))
+	buf.Write(header.Bytes())
+}
+
+func TestReferenceBaseBlobs(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	registry := newPushableRegistry(t)
+	addImage := func(name string, config interface{}, layers []ocispec.Descriptor, annotations map[string]string) ocispec.Descriptor {
+		configData, err := json.Marshal(config)
+		require.NoError(t, err)
+		manifestData, err := json.Marshal(ocispec.Manifest{
+			Versioned:   specs.Versioned{SchemaVersion: 2},
+			MediaType:   ocispec.MediaTypeImageManifest,
+			Config:      registry.AddBlob(ocispec.MediaTypeImageConfig, configData),
+			Layers:      layers,
+			Annotations: annotations,
+		})
+		require.NoError(t, err)
+		manifest := registry.AddBlob(ocispec.MediaTypeImageManifest, manifestData)
+		registry.SetTag("library/"+name, "latest", manifest.Digest)
+		return manifest
+	}
+	platform := ocispec.Platform{OS: "linux", Architecture: "amd64"}
+
+	baseLayer := registry.AddBlob(ocispec.MediaTypeImageLayerGzip, []byte("base layer"))
+	baseSource := addImage("base", ocispec.Image{
+		Platform: platform,
+		RootFS:   ocispec.RootFS{Type: "layers", DiffIDs: []digest.Digest{digest.FromString("base diff")}},
+	}, []ocispec.Descriptor{baseLayer}, nil)
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	bootstrapData := []byte("base bootstrap")
+	var blobData bytes.Buffer
+	nydusTarEntry(t, &blobData, converter.EntryBlob, data)
+	nydusTarEntry(t, &blobData, converter.EntryBootstrap, bootstrapData)
+	baseBlob := registry.AddBlob(utils.MediaTypeNydusBlob, blobData.Bytes())
+	bootstrap := registry.AddBlob(ocispec.MediaTypeImageLayerGzip, []byte("base bootstrap layer"))
+	bootstrap.Annotations = map[string]string{utils.LayerAnnotationNydusBootstrap: "true"}
+	addImage("base-nydus", ocispec.Image{Platform: platform}, []ocispec.Descriptor{baseBlob, bootstrap}, map[string]string{
+		utils.ManifestNydusSourceDigest: baseSource.Digest.String(),
+		annotationSourceReference:       registry.host + "/library/base:latest",
+	})
+	addImage("child", ocispec.Image{
+		Platform: platform,
+		RootFS:   ocispec.RootFS{Type: "layers", DiffIDs: []digest.Digest{digest.FromString("base diff")}},
+	}, []ocispec.Descriptor{baseLayer}, nil)
+
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+	pvd.SetReferenceBaseBlobs(true)
+	require.NoError(t, pvd.LoadBaseNydus(ctx, registry.host+"/library/base-nydus:latest"))
+	require.NoError(t, pvd.Pull(ctx, registry.host+"/library/child:latest"))
+
+	// The base blob referenced isn't fetched into content store, but it's
+	// available for converter.
+	info, err := pvd.ContentStore().Info(ctx, baseLayer.Digest)
+	require.NoError(t, err)
+	require.Equal(t, baseBlob.Digest.String(), info.Labels[converter.LayerAnnotationNydusTargetDigest])
+	_, err = pvd.store.(*baseStore).Store.Info(ctx, baseBlob.Digest)
+	require.True(t, errdefs.IsNotFound(err))
+	info, err = pvd.ContentStore().Info(ctx, baseBlob.Digest)
+	require.NoError(t, err)
+	require.Equal(t, baseBlob.Size, info.Size)
+	info.Labels = map[string]string{"containerd.io/uncompressed": baseBlob.Digest.String()}
+	_, err = pvd.ContentStore().Update(ctx, info)
+	require.NoError(t, err)
+	info, err = pvd.ContentStore().Info(ctx, baseBlob.Digest)
+	require.NoError(t, err)
+	require.Equal(t, baseBlob.Digest.String(), info.Labels["containerd.io/uncompressed"])
+
+	// Only the tail of base blob is read to merge its bootstrap.
+	fetched := registry.BlobBytes()
+	ra, err := pvd.ContentStore().ReaderAt(ctx, baseBlob)
+	require.NoError(t, err)
+	require.Equal(t, baseBlob.Size, ra.Size())
+	var unpacked bytes.Buffer
+	_, err = converter.UnpackEntry(ra, converter.EntryBootstrap, &unpacked)
+	require.NoError(t, err)
+	require.NoError(t, ra.Close())
+	require.Equal(t, bootstrapData, unpacked.Bytes())
+	require.Less(t, registry.BlobBytes()-fetched, int64(len(data)))
+
+	// The nydus image of child refers the base blob in registry, which is
+	// mounted from the repository of base image instead of uploading.
+	childBootstrap, err := writeJSON(ctx, pvd.store, map[string]string{"bootstrap": "child"}, ocispec.MediaTypeImageLayerGzip)
+	require.NoError(t, err)
+	childBootstrap.Annotations = map[string]string{
+		utils.LayerAnnotationNydusBootstrap: "true",
+		utils.LayerAnnotationNydusBlobIDs:   `["` + baseBlob.Digest.Hex() + `"]`,
+	}
+	config, err := writeJSON(ctx, pvd.store, ocispec.Image{Platform: platform}, ocispec.MediaTypeImageConfig)
+	require.NoError(t, err)
+	manifest, err := writeJSON(ctx, pvd.store, ocispec.Manifest{
+		Versioned:   specs.Versioned{SchemaVersion: 2},
+		MediaType:   ocispec.MediaTypeImageManifest,
+		Config:      *config,
+		Layers:      []ocispec.Descriptor{baseBlob, *childBootstrap},
+		Annotations: map[string]string{utils.ManifestNydusSnapshotter: snapshotterNydus},
+	}, ocispec.MediaTypeImageManifest)
+	require.NoError(t, err)
+	registry.ScopeBlobs()
+	registry.AddRepoBlob("library/base-nydus", utils.MediaTypeNydusBlob, blobData.Bytes())
+	var uploaded []digest.Digest
+	registry.Override(recordBlobs(&uploaded))
+	fetched = registry.BlobBytes()
+	require.NoError(t, pvd.Push(ctx, *manifest, registry.host+"/library/child:nydus"))
+	require.Contains(t, uploaded, childBootstrap.Digest)
+	require.NotContains(t, uploaded, baseBlob.Digest)
+	require.Equal(t, 1, registry.Mounts())
+	require.Equal(t, fetched, registry.BlobBytes())
+	_, manifestData, ok := registry.Tag("library/child", "nydus")
+	require.True(t, ok)
+	var pushed ocispec.Manifest
+	require.NoError(t, json.Unmarshal(manifestData, &pushed))
+	require.Equal(t, baseBlob.Digest, pushed.Layers[0].Digest)
+	require.Equal(t, `["`+baseBlob.Digest.Hex()+`"]`, pushed.Layers[1].Annotations[utils.LayerAnnotationNydusBlobIDs])
+
+	// The referenced blob missing in the registry of target fails the push
+	// without uploading it.
+	other := newPushableRegistry(t)
+	uploaded = nil
+	other.Override(recordBlobs(&uploaded))
+	err = pvd.Push(ctx, *manifest, other.host+"/library/child:nydus")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "doesn't exist in")
+	require.NotContains(t, uploaded, baseBlob.Digest)
+	_, _, ok = other.Tag("library/child", "nydus")
+	require.False(t, ok)
+}
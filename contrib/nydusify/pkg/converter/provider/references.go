@@ -0,0 +1,108 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"strings"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/log"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+// BlobExists reports whether the blob of blobID exists outside of the
+// image, e.g. in the storage backend.
+type BlobExists func(blobID string) (bool, error)
+
+type blobReferenceCheck struct {
+	inspector BlobInspector
+	exists    BlobExists
+}
+
+// SetBlobReferenceCheck checks the blobs referenced by the bootstrap of
+// nydus image before pushing it, every referenced blob must be a layer of
+// the nydus manifest to push, or reported by exists if not nil, so that a
+// bootstrap referencing a blob which no layer provides fails the push
+// before the manifest is published. The nil inspector disables the check.
+func (pvd *Provider) SetBlobReferenceCheck(inspector BlobInspector, exists BlobExists) {
+	if inspector == nil {
+		pvd.blobReferenceCheck = nil
+		return
+	}
+	pvd.blobReferenceCheck = &blobReferenceCheck{inspector: inspector, exists: exists}
+}
+
+// checkManifestBlobReferences checks the blobs referenced by the bootstrap
+// of nydus manifest, see SetBlobReferenceCheck. The manifest without
+// bootstrap layer and the encrypted bootstrap are skipped.
+func checkManifestBlobReferences(ctx context.Context, store content.Store, desc ocispec.Descriptor, check blobReferenceCheck) error {
+	var manifest ocispec.Manifest
+	if err := readJSON(ctx, store, desc, &manifest); err != nil {
+		return errors.Wrap(err, "read manifest")
+	}
+
+	var bootstrapDesc *ocispec.Descriptor
+	layers := map[string]bool{}
+	for idx, layer := range manifest.Layers {
+		if layer.Annotations[utils.LayerAnnotationNydusBootstrap] == "true" {
+			bootstrapDesc = &manifest.Layers[idx]
+			continue
+		}
+		layers[layer.Digest.Encoded()] = true
+	}
+	if bootstrapDesc == nil {
+		return nil
+	}
+	if strings.HasSuffix(bootstrapDesc.MediaType, "+encrypted") {
+		log.G(ctx).Debugf("skip checking blob references of encrypted bootstrap %s", bootstrapDesc.Digest)
+		return nil
+	}
+
+	infos, err := inspectBlobs(ctx, store, *bootstrapDesc, check.inspector)
+	if err != nil {
+		return err
+	}
+	missing := []string{}
+	for _, info := range infos {
+		if layers[info.BlobID] {
+			continue
+		}
+		if check.exists != nil {
+			exists, err := check.exists(info.BlobID)
+			if err != nil {
+				return errors.Wrapf(err, "check existence of blob %s", info.BlobID)
+			}
+			if exists {
+				continue
+			}
+		}
+		missing = append(missing, info.BlobID)
+	}
+	if len(missing) > 0 {
+		return errors.Errorf("bootstrap of manifest %s references the blobs neither pushed nor present: %s", desc.Digest, strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// checkBlobReferences checks the blobs referenced by the bootstraps of all
+// the nydus manifests in image, see checkManifestBlobReferences.
+func checkBlobReferences(ctx context.Context, store content.Store, desc ocispec.Descriptor, check blobReferenceCheck) error {
+	handler := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		switch desc.MediaType {
+		case ocispec.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList:
+			return images.Children(ctx, store, desc)
+		case ocispec.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest:
+			return nil, checkManifestBlobReferences(ctx, store, desc, check)
+		}
+		return nil, nil
+	})
+	return images.Walk(ctx, handler, desc)
+}
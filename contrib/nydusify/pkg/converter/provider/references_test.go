@@ -0,0 +1,64 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"testing"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/checker/tool"
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+func TestPushBlobReferences(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+
+	blob, err := writeJSON(ctx, pvd.store, map[string]string{"blob": "data"}, utils.MediaTypeNydusBlob)
+	require.NoError(t, err)
+	bootstrap := writeTarLayer(t, ctx, pvd.store, map[string]string{utils.BootstrapFileNameInLayer: "bootstrap"})
+	bootstrap.Annotations = map[string]string{utils.LayerAnnotationNydusBootstrap: "true"}
+	config, err := writeJSON(ctx, pvd.store, ocispec.Image{}, ocispec.MediaTypeImageConfig)
+	require.NoError(t, err)
+	manifest, err := writeJSON(ctx, pvd.store, ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    *config,
+		Layers:    []ocispec.Descriptor{*blob, bootstrap},
+	}, ocispec.MediaTypeImageManifest)
+	require.NoError(t, err)
+
+	// The bootstrap references a dangling blob besides the blob layer.
+	const danglingBlobID = "d4e5f6a7b8c9d0e1f2a3b4c5d6e7f8a9b0c1d2e3f4a5b6c7d8e9f0a1b2c3d4e5"
+	inspector := blobInspector(func(option tool.InspectOption) (interface{}, error) {
+		return tool.BlobInfoList{{BlobID: blob.Digest.Encoded()}, {BlobID: danglingBlobID}}, nil
+	})
+	registry := newPushableRegistry(t)
+
+	pvd.SetBlobReferenceCheck(inspector, nil)
+	err = pvd.Push(ctx, *manifest, registry.host+"/nydus:dangling")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), danglingBlobID)
+	require.NotContains(t, err.Error(), blob.Digest.Encoded())
+	_, _, ok := registry.Tag("nydus", "dangling")
+	require.False(t, ok)
+
+	// The blob present in storage backend is known.
+	pvd.SetBlobReferenceCheck(inspector, func(blobID string) (bool, error) {
+		return blobID == danglingBlobID, nil
+	})
+	require.NoError(t, pvd.Push(ctx, *manifest, registry.host+"/nydus:backend"))
+	_, _, ok = registry.Tag("nydus", "backend")
+	require.True(t, ok)
+
+	pvd.SetBlobReferenceCheck(nil, nil)
+	require.NoError(t, pvd.Push(ctx, *manifest, registry.host+"/nydus:unchecked"))
+}
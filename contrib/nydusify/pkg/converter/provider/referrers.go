@@ -0,0 +1,207 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/log"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// subjectRecorder records whether the registry responded to the push of
+// the manifests with the `OCI-Subject` header, which indicates the registry
+// supports the referrers API, see https://github.com/opencontainers/distribution-spec/blob/main/spec.md#pushing-manifests-with-subject.
+type subjectRecorder struct {
+	mutex sync.Mutex
+	// supported is keyed by `repository@digest` of the pushed manifests.
+	supported map[string]bool
+	// warned are the repositories warned for the lack of referrers API.
+	warned map[string]bool
+}
+
+func (recorder *subjectRecorder) record(repository string, dgst digest.Digest, supported bool) {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	if recorder.supported == nil {
+		recorder.supported = map[string]bool{}
+	}
+	recorder.supported[repository+"@"+dgst.String()] = supported
+}
+
+// lookup returns whether the registry supports the referrers API by the
+// push of the manifest, false ok means the manifest isn't pushed, e.g. it
+// exists in registry already.
+func (recorder *subjectRecorder) lookup(repository string, dgst digest.Digest) (supported, ok bool) {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	supported, ok = recorder.supported[repository+"@"+dgst.String()]
+	return
+}
+
+// warn returns true only on the first call for repository.
+func (recorder *subjectRecorder) warn(repository string) bool {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	if recorder.warned == nil {
+		recorder.warned = map[string]bool{}
+	}
+	if recorder.warned[repository] {
+		return false
+	}
+	recorder.warned[repository] = true
+	return true
+}
+
+// subjectTransport records the `OCI-Subject` header of the responses to
+// the manifest pushes into recorder.
+type subjectTransport struct {
+	http.RoundTripper
+	recorder *subjectRecorder
+}
+
+func (transport *subjectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := transport.RoundTripper.RoundTrip(req)
+	if err != nil || req.Method != http.MethodPut || resp.StatusCode != http.StatusCreated {
+		return resp, err
+	}
+	path := req.URL.Path
+	idx := strings.LastIndex(path, "/manifests/")
+	if idx < 0 || !strings.HasPrefix(path, "/v2/") {
+		return resp, nil
+	}
+	repository := path[len("/v2/"):idx]
+	dgst, err := digest.Parse(resp.Header.Get("Docker-Content-Digest"))
+	if err != nil {
+		if dgst, err = digest.Parse(path[idx+len("/manifests/"):]); err != nil {
+			return resp, nil
+		}
+	}
+	transport.recorder.record(repository, dgst, resp.Header.Get("OCI-Subject") != "")
+	return resp, nil
+}
+
+// referrersTag returns the tag of the referrers index of subject by the
+// referrers tag schema, i.e. `<alg>-<ref>`.
+func referrersTag(subject digest.Digest) string {
+	tag := subject.Algorithm().String() + "-" + subject.Encoded()
+	if len(tag) > 128 {
+		tag = tag[:128]
+	}
+	return tag
+}
+
+// pushReferrersFallback adds the referrer manifest to the referrers index
+// tagged by the referrers tag schema in the repository of ref, if the
+// registry ignored the subject of the pushed referrer, so that the referrer
+// can still be discovered by the clients following the OCI distribution
+// spec. Nothing is done if the registry supports the referrers API, or the
+// referrer isn't pushed by this provider.
+func (pvd *Provider) pushReferrersFallback(ctx context.Context, rc *containerd.RemoteContext, ref string, referrer ocispec.Descriptor, subject ocispec.Descriptor) error {
+	named, err := docker.ParseDockerRef(ref)
+	if err != nil {
+		return errors.Wrapf(err, "parse reference %s", ref)
+	}
+	repository := docker.Path(named)
+	if supported, ok := pvd.subjectRecorder.lookup(repository, referrer.Digest); supported || !ok {
+		return nil
+	}
+	if pvd.subjectRecorder.warn(named.Name()) {
+		log.G(ctx).Warnf("registry doesn't support the referrers API for %s, fall back to the referrers tag schema", named.Name())
+	}
+
+	tagRef := named.Name() + ":" + referrersTag(subject.Digest)
+	index := ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{},
+	}
+	_, indexDesc, err := rc.Resolver.Resolve(ctx, tagRef)
+	if err == nil {
+		fetcher, err := rc.Resolver.Fetcher(ctx, tagRef)
+		if err != nil {
+			return err
+		}
+		if err := fetchToStore(ctx, pvd.store, fetcher, indexDesc); err != nil {
+			return errors.Wrapf(err, "fetch referrers index %s", tagRef)
+		}
+		if err := readJSON(ctx, pvd.store, indexDesc, &index); err != nil {
+			return errors.Wrapf(err, "read referrers index %s", tagRef)
+		}
+	} else if !errdefs.IsNotFound(err) {
+		return errors.Wrapf(err, "resolve referrers index %s", tagRef)
+	}
+
+	for _, manifest := range index.Manifests {
+		if manifest.Digest == referrer.Digest {
+			return nil
+		}
+	}
+	var manifest ocispec.Manifest
+	if err := readJSON(ctx, pvd.store, referrer, &manifest); err != nil {
+		return errors.Wrap(err, "read referrer manifest")
+	}
+	artifactType := manifest.ArtifactType
+	if artifactType == "" {
+		artifactType = manifest.Config.MediaType
+	}
+	index.Manifests = append(index.Manifests, ocispec.Descriptor{
+		MediaType:    referrer.MediaType,
+		ArtifactType: artifactType,
+		Digest:       referrer.Digest,
+		Size:         referrer.Size,
+		Annotations:  manifest.Annotations,
+	})
+
+	newIndexDesc, err := writeJSON(ctx, pvd.store, index, ocispec.MediaTypeImageIndex)
+	if err != nil {
+		return errors.Wrap(err, "write referrers index")
+	}
+	// Only the index is pushed, the other referrers in it may not be in the
+	// content store.
+	pusher, err := rc.Resolver.Pusher(ctx, tagRef)
+	if err != nil {
+		return err
+	}
+	if err := remotes.PushContent(ctx, pusher, *newIndexDesc, pvd.store, nil, nil, nil); err != nil && !errdefs.IsAlreadyExists(err) {
+		return errors.Wrapf(err, "push referrers index %s", tagRef)
+	}
+	log.G(ctx).Infof("pushed referrers index %s of %d referrers", tagRef, len(index.Manifests))
+
+	return nil
+}
+
+// pushSubjectsFallback calls pushReferrersFallback for the manifests with
+// subject in target image, e.g. the nydus manifests referring to the source
+// manifests by `--with-referrer`.
+func (pvd *Provider) pushSubjectsFallback(ctx context.Context, rc *containerd.RemoteContext, desc ocispec.Descriptor, ref string) error {
+	handler := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		switch desc.MediaType {
+		case ocispec.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList:
+			return images.Children(ctx, pvd.store, desc)
+		case ocispec.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest:
+			var manifest ocispec.Manifest
+			if err := readJSON(ctx, pvd.store, desc, &manifest); err != nil {
+				return nil, errors.Wrap(err, "read manifest")
+			}
+			if manifest.Subject != nil {
+				return nil, pvd.pushReferrersFallback(ctx, rc, ref, desc, *manifest.Subject)
+			}
+		}
+		return nil, nil
+	})
+	return images.Walk(ctx, handler, desc)
+}
@@ -0,0 +1,74 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPushReferrersFallback(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+
+	// The nydus manifests refer to the source manifest like `--with-referrer`.
+	source := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromString("source manifest"),
+		Size:      int64(len("source manifest")),
+	}
+	nydusDesc, _, _ := writeNydusImage(t, ctx, pvd)
+	writeReferrer := func(variant string) ocispec.Descriptor {
+		var manifest ocispec.Manifest
+		require.NoError(t, readJSON(ctx, pvd.store, nydusDesc, &manifest))
+		manifest.Subject = &source
+		manifest.Annotations["variant"] = variant
+		desc, err := writeJSON(ctx, pvd.store, manifest, ocispec.MediaTypeImageManifest)
+		require.NoError(t, err)
+		return *desc
+	}
+	first, second := writeReferrer("first"), writeReferrer("second")
+	fallbackTag := "sha256-" + source.Digest.Encoded()
+
+	// The referrers are added into the index tagged by referrers tag schema.
+	registry := newPushableRegistry(t)
+	require.NoError(t, pvd.Push(ctx, first, registry.host+"/nydus:first"))
+	require.NoError(t, pvd.Push(ctx, second, registry.host+"/nydus:second"))
+	_, data, ok := registry.Tag("nydus", fallbackTag)
+	require.True(t, ok)
+	var index ocispec.Index
+	require.NoError(t, json.Unmarshal(data, &index))
+	require.Equal(t, ocispec.MediaTypeImageIndex, index.MediaType)
+	require.Len(t, index.Manifests, 2)
+	for idx, variant := range []string{"first", "second"} {
+		dgst, _, ok := registry.Tag("nydus", variant)
+		require.True(t, ok)
+		require.Equal(t, dgst, index.Manifests[idx].Digest)
+		require.Equal(t, ocispec.MediaTypeImageConfig, index.Manifests[idx].ArtifactType)
+		require.Equal(t, variant, index.Manifests[idx].Annotations["variant"])
+	}
+
+	// The referrer already in the index isn't added again.
+	require.NoError(t, pvd.Push(ctx, first, registry.host+"/nydus:again"))
+	_, data, ok = registry.Tag("nydus", fallbackTag)
+	require.True(t, ok)
+	require.NoError(t, json.Unmarshal(data, &index))
+	require.Len(t, index.Manifests, 2)
+
+	// No fallback for the registry supporting the referrers API.
+	registry = newPushableRegistry(t, referrersAPI())
+	require.NoError(t, pvd.Push(ctx, first, registry.host+"/nydus:first"))
+	_, _, ok = registry.Tag("nydus", "first")
+	require.True(t, ok)
+	_, _, ok = registry.Tag("nydus", fallbackTag)
+	require.False(t, ok)
+}
@@ -0,0 +1,488 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// testRegistry is a minimal in-memory registry supporting pull and push in
+// plain HTTP, it's shared by the tests in this package.
+type testRegistry struct {
+	mutex      sync.Mutex
+	blobs      map[digest.Digest][]byte
+	mediaTypes map[digest.Digest]string
+	tags       map[string]digest.Digest
+	uploads    map[string][]byte
+	host       string
+	// blobFetches counts the GET requests of blobs.
+	blobFetches int
+	// blobBytes counts the bytes of blobs served by GET requests.
+	blobBytes int64
+	// tagResolves counts the requests of manifests by `name:tag`.
+	tagResolves map[string]int
+	// repoBlobs are the blobs in each repository if it's enabled by
+	// ScopeBlobs, otherwise the blobs are shared by repositories.
+	repoBlobs map[string]map[digest.Digest]bool
+	// mounts counts the blobs mounted across repositories.
+	mounts int
+	// maxUploads is the maximum of the blob uploads in progress.
+	maxUploads int
+	// overrides override the handling of requests, see Override.
+	overrides []registryOverride
+}
+
+// registryOverride overrides the handling of a request by testRegistry, it
+// responds to the request itself, or calls serve to let the registry serve
+// the request, possibly observing or amending the request and response. It's
+// called with the lock of registry held.
+type registryOverride func(w http.ResponseWriter, r *http.Request, serve http.HandlerFunc)
+
+func newPushableRegistry(t testing.TB, overrides ...registryOverride) *testRegistry {
+	registry := &testRegistry{
+		blobs:       make(map[digest.Digest][]byte),
+		mediaTypes:  make(map[digest.Digest]string),
+		tags:        make(map[string]digest.Digest),
+		uploads:     make(map[string][]byte),
+		tagResolves: make(map[string]int),
+		overrides:   overrides,
+	}
+	server := httptest.NewServer(registry)
+	t.Cleanup(server.Close)
+	registry.host = strings.TrimPrefix(server.URL, "http://")
+	return registry
+}
+
+// Override replaces the overrides of registry, the first override handles
+// the request first, and none restores the default handling.
+func (registry *testRegistry) Override(overrides ...registryOverride) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.overrides = overrides
+}
+
+func (registry *testRegistry) Tag(name, tag string) (digest.Digest, []byte, bool) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	dgst, ok := registry.tags[name+":"+tag]
+	if !ok {
+		return "", nil, false
+	}
+	return dgst, registry.blobs[dgst], true
+}
+
+// AddBlob adds a blob or manifest into registry, the manifest can be tagged
+// by SetTag.
+func (registry *testRegistry) AddBlob(mediaType string, data []byte) ocispec.Descriptor {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	dgst := digest.FromBytes(data)
+	registry.blobs[dgst] = data
+	registry.mediaTypes[dgst] = mediaType
+	return ocispec.Descriptor{MediaType: mediaType, Digest: dgst, Size: int64(len(data))}
+}
+
+// ScopeBlobs makes the blobs only visible in the repositories they're
+// pushed, mounted or added by AddRepoBlob, like a registry checking the
+// repository of blob.
+func (registry *testRegistry) ScopeBlobs() {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.repoBlobs = make(map[string]map[digest.Digest]bool)
+}
+
+// AddRepoBlob adds a blob into the repository of name, see ScopeBlobs.
+func (registry *testRegistry) AddRepoBlob(name, mediaType string, data []byte) ocispec.Descriptor {
+	desc := registry.AddBlob(mediaType, data)
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.addRepoBlob(name, desc.Digest)
+	return desc
+}
+
+func (registry *testRegistry) addRepoBlob(name string, dgst digest.Digest) {
+	if registry.repoBlobs == nil {
+		return
+	}
+	if registry.repoBlobs[name] == nil {
+		registry.repoBlobs[name] = make(map[digest.Digest]bool)
+	}
+	registry.repoBlobs[name][dgst] = true
+}
+
+func (registry *testRegistry) hasRepoBlob(name string, dgst digest.Digest) bool {
+	if _, ok := registry.blobs[dgst]; !ok {
+		return false
+	}
+	return registry.repoBlobs == nil || registry.repoBlobs[name][dgst]
+}
+
+func (registry *testRegistry) Mounts() int {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	return registry.mounts
+}
+
+func (registry *testRegistry) MaxUploads() int {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	return registry.maxUploads
+}
+
+func (registry *testRegistry) SetTag(name, tag string, dgst digest.Digest) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.tags[name+":"+tag] = dgst
+}
+
+func (registry *testRegistry) BlobFetches() int {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	return registry.blobFetches
+}
+
+func (registry *testRegistry) BlobBytes() int64 {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	return registry.blobBytes
+}
+
+func (registry *testRegistry) TagResolves(name, tag string) int {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	return registry.tagResolves[name+":"+tag]
+}
+
+func (registry *testRegistry) Blob(dgst digest.Digest) ([]byte, bool) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	data, ok := registry.blobs[dgst]
+	return data, ok
+}
+
+func (registry *testRegistry) serveContent(w http.ResponseWriter, r *http.Request, dgst digest.Digest) {
+	data, ok := registry.blobs[dgst]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if mediaType := registry.mediaTypes[dgst]; mediaType != "" {
+		w.Header().Set("Content-Type", mediaType)
+	}
+	w.Header().Set("Docker-Content-Digest", dgst.String())
+	// Only the range from offset to end is requested by containerd.
+	var offset int
+	if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &offset); err == nil && offset > 0 && offset < len(data) {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, len(data)-1, len(data)))
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)-offset))
+		w.WriteHeader(http.StatusPartialContent)
+	} else {
+		offset = 0
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	}
+	if r.Method == http.MethodGet {
+		n, _ := w.Write(data[offset:])
+		if !strings.Contains(r.URL.Path, "/manifests/") {
+			registry.blobBytes += int64(n)
+		}
+	}
+}
+
+// parseRequest returns the repository name, the kind and the reference of
+// request r, the kind is "manifests", "blobs/uploads" or "blobs", and the
+// reference is the tag or digest of manifest, the session of blob upload or
+// the digest of blob. The kind is empty for the other requests.
+func parseRequest(r *http.Request) (name, kind, reference string) {
+	path := strings.TrimPrefix(r.URL.Path, "/v2/")
+	for _, kind := range []string{"manifests", "blobs/uploads", "blobs"} {
+		if idx := strings.Index(path, "/"+kind+"/"); idx >= 0 {
+			return path[:idx], kind, path[idx+len(kind)+2:]
+		}
+	}
+	return "", "", ""
+}
+
+// readBody reads the body of request r, which is kept readable by the
+// registry.
+func readBody(r *http.Request) ([]byte, error) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(data))
+	return data, nil
+}
+
+// onManifestPush calls fn with the manifest pushed to repository name once
+// it's stored.
+func onManifestPush(fn func(name string, dgst digest.Digest, data []byte)) registryOverride {
+	return func(w http.ResponseWriter, r *http.Request, serve http.HandlerFunc) {
+		name, kind, _ := parseRequest(r)
+		if kind != "manifests" || r.Method != http.MethodPut {
+			serve(w, r)
+			return
+		}
+		data, err := readBody(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		serve(w, r)
+		if dgst := digest.Digest(w.Header().Get("Docker-Content-Digest")); dgst != "" {
+			fn(name, dgst, data)
+		}
+	}
+}
+
+// recordReferrers records the manifests with subject pushed to registry
+// in referrers.
+func recordReferrers(t testing.TB, referrers *[]ocispec.Manifest) registryOverride {
+	return onManifestPush(func(_ string, _ digest.Digest, data []byte) {
+		var manifest ocispec.Manifest
+		require.NoError(t, json.Unmarshal(data, &manifest))
+		if manifest.Subject != nil {
+			*referrers = append(*referrers, manifest)
+		}
+	})
+}
+
+// scopeManifests serves the manifests requested by digest only from the
+// repositories has returns true for, otherwise all the manifests are shared
+// by repositories.
+func scopeManifests(has func(name string, dgst digest.Digest) bool) registryOverride {
+	return func(w http.ResponseWriter, r *http.Request, serve http.HandlerFunc) {
+		name, kind, reference := parseRequest(r)
+		dgst := digest.Digest(reference)
+		if kind == "manifests" && r.Method != http.MethodPut && dgst.Validate() == nil && !has(name, dgst) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		serve(w, r)
+	}
+}
+
+// onBlobPush calls fn with the digest of blob before its upload is
+// completed, the upload fails with the returned status code if it's not 0,
+// and the blob is acknowledged but not stored if drop is true.
+func onBlobPush(fn func(dgst digest.Digest) (status int, drop bool)) registryOverride {
+	return func(w http.ResponseWriter, r *http.Request, serve http.HandlerFunc) {
+		_, kind, _ := parseRequest(r)
+		dgst := digest.Digest(r.URL.Query().Get("digest"))
+		if kind != "blobs/uploads" || r.Method != http.MethodPut || dgst.Validate() != nil {
+			serve(w, r)
+			return
+		}
+		// The blob is received before responding like a registry, otherwise
+		// the client may block on sending the rest of it.
+		if _, err := readBody(r); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		status, drop := fn(dgst)
+		if status != 0 {
+			w.WriteHeader(status)
+			return
+		}
+		if drop {
+			w.Header().Set("Docker-Content-Digest", dgst.String())
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		serve(w, r)
+	}
+}
+
+// recordBlobs records the digests of blobs pushed to registry in blobs.
+func recordBlobs(blobs *[]digest.Digest) registryOverride {
+	return onBlobPush(func(dgst digest.Digest) (int, bool) {
+		*blobs = append(*blobs, dgst)
+		return 0, false
+	})
+}
+
+// denyUploads denies the blob uploads to the repositories of names, like a
+// registry the user can only pull from.
+func denyUploads(names ...string) registryOverride {
+	return func(w http.ResponseWriter, r *http.Request, serve http.HandlerFunc) {
+		name, kind, _ := parseRequest(r)
+		if kind == "blobs/uploads" && r.Method == http.MethodPost && slices.Contains(names, name) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"errors":[{"code":"DENIED","message":"requested access to the resource is denied"}]}`))
+			return
+		}
+		serve(w, r)
+	}
+}
+
+// digestManifests digests the manifests pushed to registry by tag with
+// algorithm rather than sha256.
+func digestManifests(registry *testRegistry, algorithm digest.Algorithm) registryOverride {
+	return func(w http.ResponseWriter, r *http.Request, serve http.HandlerFunc) {
+		name, kind, reference := parseRequest(r)
+		if kind != "manifests" || r.Method != http.MethodPut || digest.Digest(reference).Validate() == nil {
+			serve(w, r)
+			return
+		}
+		data, err := readBody(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		dgst := algorithm.FromBytes(data)
+		r.URL.Path = strings.TrimSuffix(r.URL.Path, reference) + dgst.String()
+		serve(w, r)
+		if w.Header().Get("Docker-Content-Digest") == dgst.String() {
+			registry.tags[name+":"+reference] = dgst
+		}
+	}
+}
+
+// referrersAPI responds to the push of manifest with subject by the
+// `OCI-Subject` header, like a registry supporting the referrers API.
+func referrersAPI() registryOverride {
+	return func(w http.ResponseWriter, r *http.Request, serve http.HandlerFunc) {
+		if _, kind, _ := parseRequest(r); kind == "manifests" && r.Method == http.MethodPut {
+			data, err := readBody(r)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			var manifest ocispec.Manifest
+			if json.Unmarshal(data, &manifest) == nil && manifest.Subject != nil {
+				w.Header().Set("OCI-Subject", manifest.Subject.Digest.String())
+			}
+		}
+		serve(w, r)
+	}
+}
+
+func (registry *testRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	serve := registry.serve
+	for idx := len(registry.overrides) - 1; idx >= 0; idx-- {
+		override, next := registry.overrides[idx], serve
+		serve = func(w http.ResponseWriter, r *http.Request) {
+			override(w, r, next)
+		}
+	}
+	serve(w, r)
+}
+
+func (registry *testRegistry) serve(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/v2/" || r.URL.Path == "/v2" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	name, kind, reference := parseRequest(r)
+	switch kind {
+	case "manifests":
+		if r.Method == http.MethodPut {
+			data, err := io.ReadAll(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			dgst := digest.Digest(reference)
+			if dgst.Validate() == nil {
+				if dgst != dgst.Algorithm().FromBytes(data) {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+			} else {
+				dgst = digest.FromBytes(data)
+				registry.tags[name+":"+reference] = dgst
+			}
+			registry.blobs[dgst] = data
+			registry.mediaTypes[dgst] = r.Header.Get("Content-Type")
+			w.Header().Set("Docker-Content-Digest", dgst.String())
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		dgst := digest.Digest(reference)
+		if dgst.Validate() != nil {
+			registry.tagResolves[name+":"+reference]++
+			dgst = registry.tags[name+":"+reference]
+		}
+		registry.serveContent(w, r, dgst)
+	case "blobs/uploads":
+		session := reference
+		switch r.Method {
+		case http.MethodPost:
+			query := r.URL.Query()
+			if dgst, from := digest.Digest(query.Get("mount")), query.Get("from"); from != "" && registry.hasRepoBlob(from, dgst) {
+				registry.addRepoBlob(name, dgst)
+				registry.mounts++
+				w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", name, dgst))
+				w.Header().Set("Docker-Content-Digest", dgst.String())
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+			session = strconv.Itoa(len(registry.uploads) + 1)
+			registry.uploads[session] = nil
+			if len(registry.uploads) > registry.maxUploads {
+				registry.maxUploads = len(registry.uploads)
+			}
+			w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s", name, session))
+			w.Header().Set("Range", "0-0")
+			w.WriteHeader(http.StatusAccepted)
+		case http.MethodPatch, http.MethodPut:
+			data, err := io.ReadAll(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			registry.uploads[session] = append(registry.uploads[session], data...)
+			if r.Method == http.MethodPatch {
+				w.Header().Set("Location", r.URL.Path)
+				w.Header().Set("Range", fmt.Sprintf("0-%d", len(registry.uploads[session])-1))
+				w.WriteHeader(http.StatusAccepted)
+				return
+			}
+			data = registry.uploads[session]
+			delete(registry.uploads, session)
+			dgst := digest.Digest(r.URL.Query().Get("digest"))
+			if dgst.Validate() != nil || dgst != dgst.Algorithm().FromBytes(data) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			registry.blobs[dgst] = data
+			registry.addRepoBlob(name, dgst)
+			w.Header().Set("Docker-Content-Digest", dgst.String())
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	case "blobs":
+		dgst := digest.Digest(reference)
+		if r.Method == http.MethodGet {
+			registry.blobFetches++
+		}
+		if !registry.hasRepoBlob(name, dgst) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		registry.serveContent(w, r, dgst)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containerd/log"
+)
+
+// maxRetryAfter bounds the wait requested by the Retry-After header, so that
+// a misbehaving registry can't stall the conversion.
+var maxRetryAfter = 2 * time.Minute
+
+// parseRetryAfter parses the Retry-After header in either delay-seconds or
+// HTTP-date form into the duration to wait from now, false is returned for
+// the invalid header.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		if seconds > int64(maxRetryAfter/time.Second) {
+			return maxRetryAfter, true
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	wait := date.Sub(now)
+	if wait < 0 {
+		wait = 0
+	}
+	if wait > maxRetryAfter {
+		wait = maxRetryAfter
+	}
+	return wait, true
+}
+
+// retryAfterTransport honors the Retry-After header of the responses the
+// docker resolver retries immediately, i.e. 429 Too Many Requests and 408
+// Request Timeout: the response is returned after the requested wait, so
+// that the request isn't retried too soon.
+type retryAfterTransport struct {
+	http.RoundTripper
+}
+
+func (transport *retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := transport.RoundTripper.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusRequestTimeout {
+		return resp, nil
+	}
+	wait, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	if !ok || wait == 0 {
+		return resp, nil
+	}
+
+	// Release the connection during the wait, the error body is kept for
+	// the error message.
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+
+	log.G(req.Context()).Warnf("registry responded with status %d for %s %s, retry after %s", resp.StatusCode, req.Method, req.URL.Redacted(), wait)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	case <-timer.C:
+	}
+	return resp, nil
+}
@@ -0,0 +1,110 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/goharbor/acceleration-service/pkg/remote"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2023, 10, 1, 8, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		value string
+		wait  time.Duration
+		ok    bool
+	}{
+		{value: "3", wait: 3 * time.Second, ok: true},
+		{value: " 0 ", wait: 0, ok: true},
+		{value: "86400", wait: maxRetryAfter, ok: true},
+		{value: "Sun, 01 Oct 2023 08:00:05 GMT", wait: 5 * time.Second, ok: true},
+		{value: "Sun, 01 Oct 2023 07:59:00 GMT", wait: 0, ok: true},
+		{value: "-1"},
+		{value: "soon"},
+		{value: ""},
+	} {
+		wait, ok := parseRetryAfter(tc.value, now)
+		require.Equal(t, tc.ok, ok, tc.value)
+		require.Equal(t, tc.wait, wait, tc.value)
+	}
+}
+
+func TestPullRetryAfter(t *testing.T) {
+	registry := newPushableRegistry(t)
+	config := registry.AddBlob(ocispec.MediaTypeImageConfig, []byte(`{"architecture":"amd64","os":"linux"}`))
+	layer := registry.AddBlob(ocispec.MediaTypeImageLayerGzip, []byte("layer data"))
+	manifestData, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []ocispec.Descriptor{layer},
+	})
+	require.NoError(t, err)
+	manifest := registry.AddBlob(ocispec.MediaTypeImageManifest, manifestData)
+	registry.SetTag("library/limited", "latest", manifest.Digest)
+
+	hosts := func(string) (remote.CredentialFunc, bool, error) {
+		return func(string) (string, string, error) { return "", "", nil }, false, nil
+	}
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+
+	for _, tc := range []struct {
+		name       string
+		retryAfter func() string
+		wait       time.Duration
+	}{
+		{
+			name:       "seconds",
+			retryAfter: func() string { return "1" },
+			wait:       time.Second,
+		},
+		{
+			name: "date",
+			retryAfter: func() string {
+				// The HTTP-date has the precision of second.
+				return time.Now().Add(2 * time.Second).UTC().Format(http.TimeFormat)
+			},
+			wait: time.Second,
+		},
+	} {
+		// The overrides are called with the lock of registry held.
+		var limitedAt, retriedAt time.Time
+		registry.Override(func(w http.ResponseWriter, r *http.Request, serve http.HandlerFunc) {
+			if _, kind, reference := parseRequest(r); kind == "blobs" && reference == layer.Digest.String() && r.Method == http.MethodGet {
+				if limitedAt.IsZero() {
+					limitedAt = time.Now()
+					w.Header().Set("Retry-After", tc.retryAfter())
+					w.WriteHeader(http.StatusTooManyRequests)
+					return
+				}
+				if retriedAt.IsZero() {
+					retriedAt = time.Now()
+				}
+			}
+			serve(w, r)
+		})
+
+		pvd, err := New(t.TempDir(), hosts, 200, "v1", platforms.All, 0)
+		require.NoError(t, err)
+		pvd.UsePlainHTTP()
+		require.NoError(t, pvd.Pull(ctx, registry.host+"/library/limited:latest"), tc.name)
+
+		registry.mutex.Lock()
+		require.False(t, limitedAt.IsZero(), tc.name)
+		require.False(t, retriedAt.IsZero(), tc.name)
+		require.GreaterOrEqual(t, retriedAt.Sub(limitedAt), tc.wait, tc.name)
+		registry.mutex.Unlock()
+	}
+}
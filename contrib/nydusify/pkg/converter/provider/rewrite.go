@@ -0,0 +1,384 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/containerd/containerd/archive/compression"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/log"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+// headerRewriter rewrites the header of entry in layer in place, returns
+// whether the entry is kept and whether it's changed.
+type headerRewriter func(hdr *tar.Header) (keep bool, changed bool)
+
+// chainRewriters rewrites the header by rewriters in order, nil rewriters
+// are skipped, it returns nil if all rewriters are nil.
+func chainRewriters(rewriters ...headerRewriter) headerRewriter {
+	var chained []headerRewriter
+	for _, rewriter := range rewriters {
+		if rewriter != nil {
+			chained = append(chained, rewriter)
+		}
+	}
+	if len(chained) == 0 {
+		return nil
+	}
+	return func(hdr *tar.Header) (bool, bool) {
+		changed := false
+		for _, rewriter := range chained {
+			keep, rewritten := rewriter(hdr)
+			if !keep {
+				return false, true
+			}
+			changed = changed || rewritten
+		}
+		return true, changed
+	}
+}
+
+// layerRewriter returns the rewriter of source layers excluding paths,
+// filtering files and normalizing entries, or nil if the layers aren't
+// rewritten.
+func (pvd *Provider) layerRewriter(ctx context.Context) headerRewriter {
+	var exclude headerRewriter
+	if len(pvd.excludePaths) > 0 {
+		exclude = excludeRewriter(ctx, pvd.excludePaths)
+	}
+	return chainRewriters(exclude, pvd.globFilter.rewriter(ctx), pvd.tarNormalization.rewriter())
+}
+
+// emptiedDirs returns the directories in layer having entries but none of
+// them kept by rewrite, the directories empty in layer aren't returned.
+func emptiedDirs(ctx context.Context, store content.Store, layer ocispec.Descriptor, rewrite headerRewriter) (map[string]bool, error) {
+	ra, err := store.ReaderAt(ctx, layer)
+	if err != nil {
+		return nil, err
+	}
+	defer ra.Close()
+	reader, err := utils.DecompressLayer(content.NewReader(ra), layer.MediaType)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	// The directories having entries in layer, and whether any of the
+	// entries is kept.
+	dirs := map[string]bool{}
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			continue
+		}
+		copied := *hdr
+		keep, _ := rewrite(&copied)
+		for dir := path.Dir(path.Clean("/" + hdr.Name)); dir != "/"; dir = path.Dir(dir) {
+			dirs[dir] = dirs[dir] || keep
+		}
+	}
+
+	emptied := map[string]bool{}
+	for dir, kept := range dirs {
+		if !kept {
+			emptied[dir] = true
+		}
+	}
+	return emptied, nil
+}
+
+// legacyCompressed checks whether the layer of plain tar or unknown media
+// type is compressed by bzip2 or xz, which the layer building of nydus
+// doesn't decompress, see utils.IsLegacyCompressed.
+func legacyCompressed(ctx context.Context, store content.Store, layer ocispec.Descriptor) (bool, error) {
+	if comp, ok := utils.LayerCompression(layer.MediaType); ok && comp != compression.Uncompressed {
+		return false, nil
+	}
+	ra, err := store.ReaderAt(ctx, layer)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer ra.Close()
+	header := make([]byte, 10)
+	n, err := ra.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	return utils.IsLegacyCompressed(header[:n]), nil
+}
+
+// rewriteLayer writes a gzip layer of the entries of layer rewritten by
+// rewrite into store, returns the new layer and its diff ID, or nil if
+// nothing is changed. The directories emptied by rewrite are removed too if
+// pruneDirs is set, see emptiedDirs. The bzip2 or xz layer is always
+// rewritten into gzip, the entries are kept as is if rewrite is nil.
+func rewriteLayer(ctx context.Context, store content.Store, layer ocispec.Descriptor, rewrite headerRewriter, pruneDirs bool) (*ocispec.Descriptor, digest.Digest, error) {
+	legacy, err := legacyCompressed(ctx, store, layer)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "detect layer compression")
+	}
+	if rewrite == nil && !legacy {
+		return nil, "", nil
+	}
+
+	var emptied map[string]bool
+	if pruneDirs && rewrite != nil {
+		var err error
+		if emptied, err = emptiedDirs(ctx, store, layer, rewrite); err != nil {
+			return nil, "", errors.Wrap(err, "find emptied directories")
+		}
+	}
+
+	ra, err := store.ReaderAt(ctx, layer)
+	if err != nil {
+		return nil, "", err
+	}
+	defer ra.Close()
+	reader, err := utils.DecompressLayer(content.NewReader(ra), layer.MediaType)
+	if err != nil {
+		return nil, "", err
+	}
+	defer reader.Close()
+
+	// The new layer is written into store directly rather than a temporary
+	// file, so that it's limited by the disk quota, see SetMaxDiskUsage.
+	ref := "rewrite-" + layer.Digest.String()
+	writer, err := content.OpenWriter(ctx, store, content.WithRef(ref))
+	if err != nil {
+		return nil, "", err
+	}
+	committed := false
+	defer func() {
+		writer.Close()
+		if !committed {
+			if err := store.Abort(ctx, ref); err != nil && !errdefs.IsNotFound(err) {
+				log.G(ctx).Debugf("abort ingest %s: %s", ref, err)
+			}
+		}
+	}()
+	if err := writer.Truncate(0); err != nil {
+		return nil, "", err
+	}
+
+	diffDigester := digest.Canonical.Digester()
+	gw := gzip.NewWriter(writer)
+	tw := tar.NewWriter(io.MultiWriter(gw, diffDigester.Hash()))
+
+	removed, modified := 0, 0
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		keep, changed := true, false
+		if rewrite != nil {
+			keep, changed = rewrite(hdr)
+		}
+		if !keep || (hdr.Typeflag == tar.TypeDir && emptied[path.Clean("/"+hdr.Name)]) {
+			removed++
+			continue
+		}
+		if changed {
+			modified++
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, "", err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return nil, "", err
+		}
+	}
+	if removed == 0 && modified == 0 && !legacy {
+		return nil, "", nil
+	}
+	if err := tw.Close(); err != nil {
+		return nil, "", err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, "", err
+	}
+	status, err := writer.Status()
+	if err != nil {
+		return nil, "", err
+	}
+
+	mediaType := ocispec.MediaTypeImageLayerGzip
+	if strings.HasPrefix(layer.MediaType, "application/vnd.docker.") {
+		mediaType = images.MediaTypeDockerSchema2LayerGzip
+	}
+	desc := ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    writer.Digest(),
+		Size:      status.Offset,
+	}
+	if err := writer.Commit(ctx, desc.Size, desc.Digest); err != nil && !errdefs.IsAlreadyExists(err) {
+		return nil, "", errors.Wrap(err, "write layer")
+	}
+	committed = true
+	log.G(ctx).Infof("rewrote layer %s with %d entries removed and %d entries modified, new layer %s", layer.Digest, removed, modified, desc.Digest)
+
+	return &desc, diffDigester.Digest(), nil
+}
+
+// rewriteManifestLayers rewrites the layers of manifest changed by rewrite,
+// and the diff IDs of config accordingly.
+func rewriteManifestLayers(ctx context.Context, store content.Store, manifest *ocispec.Manifest, rewrite headerRewriter, pruneDirs bool) (bool, error) {
+	if rewrite == nil {
+		legacy := false
+		for _, layer := range manifest.Layers {
+			var err error
+			if legacy, err = legacyCompressed(ctx, store, layer); err != nil {
+				return false, errors.Wrapf(err, "detect compression of layer %s", layer.Digest)
+			}
+			if legacy {
+				break
+			}
+		}
+		if !legacy {
+			return false, nil
+		}
+	}
+	// Keep the unknown fields of image config.
+	var config map[string]json.RawMessage
+	if err := readJSON(ctx, store, manifest.Config, &config); err != nil {
+		return false, errors.Wrap(err, "read image config")
+	}
+	var rootfs ocispec.RootFS
+	if err := json.Unmarshal(config["rootfs"], &rootfs); err != nil {
+		return false, errors.Wrap(err, "unmarshal rootfs of image config")
+	}
+	if len(rootfs.DiffIDs) != len(manifest.Layers) {
+		return false, errors.Errorf("mismatched diff IDs %d and layers %d", len(rootfs.DiffIDs), len(manifest.Layers))
+	}
+
+	changed := false
+	for idx, layer := range manifest.Layers {
+		newLayer, diffID, err := rewriteLayer(ctx, store, layer, rewrite, pruneDirs)
+		if err != nil {
+			return false, errors.Wrapf(err, "rewrite layer %s", layer.Digest)
+		}
+		if newLayer == nil {
+			continue
+		}
+		manifest.Layers[idx] = *newLayer
+		rootfs.DiffIDs[idx] = diffID
+		changed = true
+	}
+	if !changed {
+		return false, nil
+	}
+
+	data, err := json.Marshal(rootfs)
+	if err != nil {
+		return false, err
+	}
+	config["rootfs"] = data
+	configDesc, err := writeJSON(ctx, store, config, manifest.Config.MediaType)
+	if err != nil {
+		return false, errors.Wrap(err, "write image config")
+	}
+	configDesc.Annotations = manifest.Config.Annotations
+	manifest.Config = *configDesc
+
+	return true, nil
+}
+
+// rewriteImageLayers rewrites the layers of source image pulled into store
+// by rewrite, see rewriteSourceManifests. The directories emptied by the glob
+// filter are removed. The bzip2 or xz layers are rewritten into gzip even if
+// rewrite is nil, see rewriteLayer.
+func (pvd *Provider) rewriteImageLayers(ctx context.Context, desc ocispec.Descriptor, rewrite headerRewriter) (*ocispec.Descriptor, error) {
+	pruneDirs := pvd.globFilter != nil
+	return pvd.rewriteSourceManifests(ctx, desc, func(_ *ocispec.Descriptor, manifest *ocispec.Manifest) (bool, error) {
+		return rewriteManifestLayers(ctx, pvd.store, manifest, rewrite, pruneDirs)
+	})
+}
+
+// recordRewrittenSource records the original digest of the rewritten source
+// manifest, which only exists in local store.
+func (pvd *Provider) recordRewrittenSource(rewritten, original digest.Digest) {
+	pvd.mutex.Lock()
+	defer pvd.mutex.Unlock()
+	if pvd.rewrittenSources == nil {
+		pvd.rewrittenSources = map[digest.Digest]digest.Digest{}
+	}
+	// The manifest may be rewritten more than once on pulling.
+	if source, ok := pvd.rewrittenSources[original]; ok {
+		delete(pvd.rewrittenSources, original)
+		original = source
+	}
+	pvd.rewrittenSources[rewritten] = original
+}
+
+// originalSources returns the original source manifest digests by the
+// rewritten ones, see recordRewrittenSource.
+func (pvd *Provider) originalSources() map[digest.Digest]digest.Digest {
+	pvd.mutex.Lock()
+	defer pvd.mutex.Unlock()
+	sources := make(map[digest.Digest]digest.Digest, len(pvd.rewrittenSources))
+	for rewritten, original := range pvd.rewrittenSources {
+		sources[rewritten] = original
+	}
+	return sources
+}
+
+// rewrittenSource returns the rewritten source manifest of the original one,
+// or the original one if it's not rewritten.
+func rewrittenSource(sources map[digest.Digest]digest.Digest, original digest.Digest) digest.Digest {
+	for rewritten, source := range sources {
+		if source == original {
+			return rewritten
+		}
+	}
+	return original
+}
+
+// restoreManifestSourceDigest replaces the rewritten source digest annotated
+// in nydus manifest by the original one in sources.
+func restoreManifestSourceDigest(manifest *ocispec.Manifest, sources map[digest.Digest]digest.Digest) bool {
+	original, ok := sources[digest.Digest(manifest.Annotations[utils.ManifestNydusSourceDigest])]
+	if !ok {
+		return false
+	}
+	manifest.Annotations[utils.ManifestNydusSourceDigest] = original.String()
+	return true
+}
+
+// restoreSourceDigests annotates the nydus manifests converted from the
+// rewritten source manifests with the original source digests, which exist
+// in source registry, so that the provenance of target image is traceable.
+func restoreSourceDigests(ctx context.Context, store content.Store, desc ocispec.Descriptor, sources map[digest.Digest]digest.Digest) (*ocispec.Descriptor, error) {
+	return rewriteManifests(ctx, store, desc, nil, func(_ *ocispec.Descriptor, manifest *ocispec.Manifest) (bool, error) {
+		return restoreManifestSourceDigest(manifest, sources), nil
+	})
+}
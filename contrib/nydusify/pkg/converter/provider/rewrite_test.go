@@ -0,0 +1,129 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/goharbor/acceleration-service/pkg/remote"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPullLegacyCompressedLayers(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	registry := newPushableRegistry(t)
+
+	for _, fixture := range []string{"layer.tar.bz2", "layer.tar.xz"} {
+		if filepath.Ext(fixture) == ".xz" {
+			if _, err := exec.LookPath("xz"); err != nil {
+				t.Logf("skip %s as xz binary isn't found", fixture)
+				continue
+			}
+		}
+		data, err := os.ReadFile(filepath.Join("..", "..", "utils", "testdata", fixture))
+		require.NoError(t, err)
+
+		pvd := newPlatformProvider(t, platforms.All, "", "")
+		legacy := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayer, Digest: digest.FromBytes(data), Size: int64(len(data))}
+		require.NoError(t, content.WriteBlob(ctx, pvd.store, legacy.Digest.String(), bytes.NewReader(data), legacy))
+		upper := writeTarLayer(t, ctx, pvd.store, map[string]string{"usr/bin/app": "app"})
+		config, err := writeJSON(ctx, pvd.store, ocispec.Image{
+			Platform: ocispec.Platform{OS: "linux", Architecture: "amd64"},
+			RootFS:   ocispec.RootFS{Type: "layers", DiffIDs: []digest.Digest{digest.FromString("legacy"), digest.FromString("upper")}},
+		}, ocispec.MediaTypeImageConfig)
+		require.NoError(t, err)
+		manifest, err := writeJSON(ctx, pvd.store, ocispec.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: ocispec.MediaTypeImageManifest,
+			Config:    *config,
+			Layers:    []ocispec.Descriptor{legacy, upper},
+		}, ocispec.MediaTypeImageManifest)
+		require.NoError(t, err)
+		ref := registry.host + "/legacy:" + filepath.Ext(fixture)[1:]
+		require.NoError(t, pvd.Push(ctx, *manifest, ref))
+
+		// The legacy layer is rewritten into gzip for the layer building,
+		// the other layers are unchanged.
+		pvd = newPlatformProvider(t, platforms.All, "", "")
+		require.NoError(t, pvd.Pull(ctx, ref))
+		desc, err := pvd.Image(ctx, ref)
+		require.NoError(t, err)
+		var pulled ocispec.Manifest
+		require.NoError(t, readJSON(ctx, pvd.store, *desc, &pulled))
+		require.Len(t, pulled.Layers, 2)
+		require.Equal(t, ocispec.MediaTypeImageLayerGzip, pulled.Layers[0].MediaType, fixture)
+		var pulledConfig ocispec.Image
+		require.NoError(t, readJSON(ctx, pvd.store, pulled.Config, &pulledConfig))
+		names, diffID := readTarLayer(t, ctx, pvd.store, pulled.Layers[0])
+		require.Contains(t, names, "dir/file", fixture)
+		require.Equal(t, diffID, pulledConfig.RootFS.DiffIDs[0], fixture)
+		require.Equal(t, upper.Digest, pulled.Layers[1].Digest, fixture)
+	}
+
+	// The image without legacy layers is kept as is.
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+	layer := writeTarLayer(t, ctx, pvd.store, map[string]string{"usr/bin/app": "app"})
+	config, err := writeJSON(ctx, pvd.store, ocispec.Image{
+		Platform: ocispec.Platform{OS: "linux", Architecture: "amd64"},
+		RootFS:   ocispec.RootFS{Type: "layers", DiffIDs: []digest.Digest{digest.FromString("layer")}},
+	}, ocispec.MediaTypeImageConfig)
+	require.NoError(t, err)
+	manifest, err := writeJSON(ctx, pvd.store, ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    *config,
+		Layers:    []ocispec.Descriptor{layer},
+	}, ocispec.MediaTypeImageManifest)
+	require.NoError(t, err)
+	ref := registry.host + "/legacy:none"
+	require.NoError(t, pvd.Push(ctx, *manifest, ref))
+	pvd = newPlatformProvider(t, platforms.All, "", "")
+	require.NoError(t, pvd.Pull(ctx, ref))
+	desc, err := pvd.Image(ctx, ref)
+	require.NoError(t, err)
+	require.Equal(t, manifest.Digest, desc.Digest)
+}
+
+func TestRewriteLayerDiskQuota(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	hosts := func(string) (remote.CredentialFunc, bool, error) {
+		return func(string) (string, string, error) { return "", "", nil }, false, nil
+	}
+	app := randomString(t, 1<<20)
+	rewrite := excludeRewriter(ctx, []string{"/usr/bin/tool"})
+	newProvider := func(quota int64) (*Provider, ocispec.Descriptor) {
+		root := t.TempDir()
+		pvd, err := New(root, hosts, 200, "v1", platforms.All, 0)
+		require.NoError(t, err)
+		layer := writeTarLayer(t, ctx, pvd.store, map[string]string{"usr/bin/app": app, "usr/bin/tool": "tool"})
+		pvd.SetMaxDiskUsage(diskUsage(root)+quota, root)
+		return pvd, layer
+	}
+
+	// The new layer is written into the store limited by the disk quota.
+	pvd, layer := newProvider(512 << 10)
+	_, _, err := rewriteLayer(ctx, pvd.store, layer, rewrite, false)
+	require.ErrorIs(t, err, ErrDiskQuotaExceeded)
+	statuses, err := pvd.store.ListStatuses(ctx)
+	require.NoError(t, err)
+	require.Empty(t, statuses)
+
+	pvd, layer = newProvider(2 << 20)
+	newLayer, _, err := rewriteLayer(ctx, pvd.store, layer, rewrite, false)
+	require.NoError(t, err)
+	names, _ := readTarLayer(t, ctx, pvd.store, *newLayer)
+	require.Equal(t, []string{"usr/bin/app"}, names)
+}
@@ -0,0 +1,358 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/archive/compression"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/containerd/log"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+// MediaTypeSPDX is the media type of SPDX SBOM document in JSON format, it's
+// also the artifact type of the SBOM referrer manifest.
+const MediaTypeSPDX = "application/spdx+json"
+
+// packageDatabases are the package databases scanned in source layers, the
+// key is the database path and the value is the package manager.
+var packageDatabases = map[string]string{
+	"var/lib/dpkg/status":  "deb",
+	"lib/apk/db/installed": "apk",
+}
+
+// SPDXDocument is the subset of SPDX 2.3 document generated for the target
+// image.
+type SPDXDocument struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      SPDXCreationInfo   `json:"creationInfo"`
+	Packages          []SPDXPackage      `json:"packages"`
+	Relationships     []SPDXRelationship `json:"relationships,omitempty"`
+}
+
+// SPDXCreationInfo is the creation information of SPDX document.
+type SPDXCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+// SPDXPackage is a package installed in the image.
+type SPDXPackage struct {
+	Name             string `json:"name"`
+	SPDXID           string `json:"SPDXID"`
+	VersionInfo      string `json:"versionInfo,omitempty"`
+	DownloadLocation string `json:"downloadLocation"`
+	Supplier         string `json:"supplier,omitempty"`
+}
+
+// SPDXRelationship relates the document to the packages it describes.
+type SPDXRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+// SetGenerateSBOM enables generating an SPDX SBOM of the packages installed
+// in source image for each nydus manifest of target image, the SBOM is pushed
+// as an OCI referrer of the nydus manifest. Only the dpkg and apk databases
+// are recognized.
+func (pvd *Provider) SetGenerateSBOM(enabled bool) {
+	pvd.generateSBOM = enabled
+}
+
+// scanPackages reads the package databases from the source layers, the
+// database in upper layer overrides the one in lower layers.
+func scanPackages(ctx context.Context, store content.Store, layers []ocispec.Descriptor) (map[string][]byte, error) {
+	databases := map[string][]byte{}
+	for _, layer := range layers {
+		if err := scanLayer(ctx, store, layer, databases); err != nil {
+			return nil, errors.Wrapf(err, "scan layer %s", layer.Digest)
+		}
+	}
+	return databases, nil
+}
+
+func scanLayer(ctx context.Context, store content.Store, layer ocispec.Descriptor, databases map[string][]byte) error {
+	ra, err := store.ReaderAt(ctx, layer)
+	if err != nil {
+		return err
+	}
+	defer ra.Close()
+
+	reader, err := compression.DecompressStream(content.NewReader(ra))
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+		dir, base := path.Split(name)
+		if base == ".wh..wh..opq" {
+			for dbPath := range databases {
+				if strings.HasPrefix(dbPath, dir) {
+					delete(databases, dbPath)
+				}
+			}
+			continue
+		}
+		if strings.HasPrefix(base, ".wh.") {
+			delete(databases, dir+strings.TrimPrefix(base, ".wh."))
+			continue
+		}
+		if _, ok := packageDatabases[name]; !ok || hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		databases[name] = data
+	}
+}
+
+// parsePackageDatabase parses the packages installed in dpkg status or apk
+// installed database, both of them are stanzas separated by empty lines.
+func parsePackageDatabase(manager string, data []byte) []SPDXPackage {
+	nameKey, versionKey, sep := "Package", "Version", ": "
+	if manager == "apk" {
+		nameKey, versionKey, sep = "P", "V", ":"
+	}
+
+	var packages []SPDXPackage
+	fields := map[string]string{}
+	flush := func() {
+		name := fields[nameKey]
+		// The dpkg status keeps the removed packages with config files.
+		installed := manager != "deb" || strings.HasSuffix(fields["Status"], " installed")
+		if name != "" && installed {
+			packages = append(packages, SPDXPackage{
+				Name:             name,
+				VersionInfo:      fields[versionKey],
+				DownloadLocation: "NOASSERTION",
+				Supplier:         "NOASSERTION",
+			})
+		}
+		fields = map[string]string{}
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			flush()
+			continue
+		}
+		if key, value, ok := strings.Cut(line, sep); ok && !strings.HasPrefix(line, " ") {
+			fields[key] = strings.TrimSpace(value)
+		}
+	}
+	flush()
+
+	for idx := range packages {
+		packages[idx].SPDXID = fmt.Sprintf("SPDXRef-Package-%s-%s", manager, spdxIDString(packages[idx].Name))
+	}
+	return packages
+}
+
+// spdxIDString replaces the characters not allowed in SPDX identifier.
+func spdxIDString(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '-'
+	}, s)
+}
+
+// newSBOM generates the SPDX document of the packages in databases for the
+// nydus manifest of ref.
+func newSBOM(databases map[string][]byte, ref string, manifest ocispec.Descriptor) SPDXDocument {
+	doc := SPDXDocument{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              ref,
+		DocumentNamespace: fmt.Sprintf("https://github.com/dragonflyoss/nydus/sbom/%s", manifest.Digest.Encoded()),
+		CreationInfo: SPDXCreationInfo{
+			Created:  time.Now().UTC().Format(time.RFC3339),
+			Creators: []string{"Tool: nydusify"},
+		},
+		Packages: []SPDXPackage{},
+	}
+
+	dbPaths := make([]string, 0, len(databases))
+	for dbPath := range databases {
+		dbPaths = append(dbPaths, dbPath)
+	}
+	sort.Strings(dbPaths)
+	for _, dbPath := range dbPaths {
+		for _, pkg := range parsePackageDatabase(packageDatabases[dbPath], databases[dbPath]) {
+			doc.Packages = append(doc.Packages, pkg)
+			doc.Relationships = append(doc.Relationships, SPDXRelationship{
+				SPDXElementID:      doc.SPDXID,
+				RelationshipType:   "DESCRIBES",
+				RelatedSPDXElement: pkg.SPDXID,
+			})
+		}
+	}
+
+	return doc
+}
+
+// sourceLayers returns the layers of the source image annotated in nydus
+// manifest, which must have been pulled into store, the rewritten source
+// manifest in sources is used if any, see recordRewrittenSource. Nil is
+// returned for the manifest without source, for example the OCI manifest of
+// `--merge-platform`.
+func sourceLayers(ctx context.Context, store content.Store, desc ocispec.Descriptor, sources map[digest.Digest]digest.Digest) ([]ocispec.Descriptor, error) {
+	var manifest ocispec.Manifest
+	if err := readJSON(ctx, store, desc, &manifest); err != nil {
+		return nil, errors.Wrap(err, "read manifest")
+	}
+	if manifest.Annotations[utils.ManifestNydusSourceDigest] == "" {
+		return nil, nil
+	}
+	sourceDigest, err := digest.Parse(manifest.Annotations[utils.ManifestNydusSourceDigest])
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid source digest of nydus manifest %s", desc.Digest)
+	}
+	sourceDigest = rewrittenSource(sources, sourceDigest)
+	info, err := store.Info(ctx, sourceDigest)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get source manifest %s", sourceDigest)
+	}
+	var sourceManifest ocispec.Manifest
+	if err := readJSON(ctx, store, ocispec.Descriptor{Digest: info.Digest, Size: info.Size}, &sourceManifest); err != nil {
+		return nil, errors.Wrap(err, "read source manifest")
+	}
+	if sourceManifest.Layers == nil {
+		sourceManifest.Layers = []ocispec.Descriptor{}
+	}
+	return sourceManifest.Layers, nil
+}
+
+// writeSBOM writes the SBOM referrer manifest of the nydus manifest into
+// store, the packages are scanned from the source image, see sourceLayers.
+// Nil is returned for the manifest without source.
+func writeSBOM(ctx context.Context, store content.Store, desc ocispec.Descriptor, ref string, sources map[digest.Digest]digest.Digest) (*ocispec.Descriptor, error) {
+	layers, err := sourceLayers(ctx, store, desc, sources)
+	if err != nil || layers == nil {
+		return nil, err
+	}
+
+	databases, err := scanPackages(ctx, store, layers)
+	if err != nil {
+		return nil, err
+	}
+	doc := newSBOM(databases, ref, desc)
+	sbomDesc, err := writeJSON(ctx, store, doc, MediaTypeSPDX)
+	if err != nil {
+		return nil, errors.Wrap(err, "write SBOM")
+	}
+	referrerDesc, err := writeReferrer(ctx, store, desc, MediaTypeSPDX, *sbomDesc)
+	if err != nil {
+		return nil, errors.Wrap(err, "write SBOM manifest")
+	}
+	log.G(ctx).Infof("generated SBOM of %d packages for manifest %s", len(doc.Packages), desc.Digest)
+
+	return referrerDesc, nil
+}
+
+// writeReferrer writes the OCI referrer manifest of subject into store,
+// which has the empty config and the single layer of artifactType.
+func writeReferrer(ctx context.Context, store content.Store, subject ocispec.Descriptor, artifactType string, layer ocispec.Descriptor) (*ocispec.Descriptor, error) {
+	emptyDesc, err := writeJSON(ctx, store, struct{}{}, ocispec.MediaTypeEmptyJSON)
+	if err != nil {
+		return nil, errors.Wrap(err, "write empty config")
+	}
+	subject = ocispec.Descriptor{MediaType: subject.MediaType, Digest: subject.Digest, Size: subject.Size}
+	return writeJSON(ctx, store, ocispec.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    ocispec.MediaTypeImageManifest,
+		ArtifactType: artifactType,
+		Config:       *emptyDesc,
+		Layers:       []ocispec.Descriptor{layer},
+		Subject:      &subject,
+	}, ocispec.MediaTypeImageManifest)
+}
+
+// pushSBOMs generates and pushes the SBOM referrers of the nydus manifests
+// in target image by digest into the repository of ref.
+func (pvd *Provider) pushSBOMs(ctx context.Context, rc *containerd.RemoteContext, desc ocispec.Descriptor, ref string) error {
+	sources := pvd.originalSources()
+	return pvd.pushReferrers(ctx, rc, desc, ref, "SBOM", func(manifest ocispec.Descriptor) (*ocispec.Descriptor, error) {
+		return writeSBOM(ctx, pvd.store, manifest, ref, sources)
+	})
+}
+
+// pushReferrers pushes the referrers written by write for the manifests in
+// target image by digest into the repository of ref, write returns nil to
+// skip the manifest. The kind names the referrer in logs and errors.
+func (pvd *Provider) pushReferrers(ctx context.Context, rc *containerd.RemoteContext, desc ocispec.Descriptor, ref, kind string, write func(ocispec.Descriptor) (*ocispec.Descriptor, error)) error {
+	named, err := docker.ParseDockerRef(ref)
+	if err != nil {
+		return errors.Wrapf(err, "parse reference %s", ref)
+	}
+
+	manifests := []ocispec.Descriptor{desc}
+	if desc.MediaType == ocispec.MediaTypeImageIndex || desc.MediaType == images.MediaTypeDockerSchema2ManifestList {
+		var index ocispec.Index
+		if err := readJSON(ctx, pvd.store, desc, &index); err != nil {
+			return errors.Wrap(err, "read image index")
+		}
+		manifests = index.Manifests
+	}
+
+	for _, manifest := range manifests {
+		referrer, err := write(manifest)
+		if err != nil {
+			return errors.Wrapf(err, "generate %s of manifest %s", kind, manifest.Digest)
+		}
+		if referrer == nil {
+			continue
+		}
+		referrerRef := named.Name() + "@" + referrer.Digest.String()
+		log.G(ctx).Infof("pushing %s %s", kind, referrerRef)
+		if err := push(ctx, pvd.store, rc, *referrer, referrerRef); err != nil {
+			return errors.Wrapf(err, "push %s %s", kind, referrerRef)
+		}
+		if err := pvd.pushReferrersFallback(ctx, rc, ref, *referrer, manifest); err != nil {
+			return errors.Wrapf(err, "push %s %s by referrers tag schema", kind, referrerRef)
+		}
+	}
+
+	return nil
+}
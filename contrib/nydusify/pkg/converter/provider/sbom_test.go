@@ -0,0 +1,105 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+// writeTarLayer writes a gzip layer of files into content store.
+func writeTarLayer(t *testing.T, ctx context.Context, store content.Store, files map[string]string) ocispec.Descriptor {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for name, data := range files {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg}))
+		_, err := tw.Write([]byte(data))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromBytes(buf.Bytes()),
+		Size:      int64(buf.Len()),
+	}
+	require.NoError(t, content.WriteBlob(ctx, store, desc.Digest.String(), bytes.NewReader(buf.Bytes()), desc))
+	return desc
+}
+
+func TestPushSBOM(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+	pvd.SetGenerateSBOM(true)
+
+	// The source image has a removed deb package and an apk database masked
+	// by the upper layer.
+	lower := writeTarLayer(t, ctx, pvd.store, map[string]string{
+		"var/lib/dpkg/status": "Package: libc6\nStatus: install ok installed\nVersion: 2.36-9\n\n" +
+			"Package: vim\nStatus: deinstall ok config-files\nVersion: 2:9.0\n",
+		"lib/apk/db/installed": "P:musl\nV:1.2.4-r1\n",
+	})
+	upper := writeTarLayer(t, ctx, pvd.store, map[string]string{
+		"./lib/apk/db/.wh.installed": "",
+	})
+	config, err := writeJSON(ctx, pvd.store, ocispec.Image{}, ocispec.MediaTypeImageConfig)
+	require.NoError(t, err)
+	source, err := writeJSON(ctx, pvd.store, ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    *config,
+		Layers:    []ocispec.Descriptor{lower, upper},
+	}, ocispec.MediaTypeImageManifest)
+	require.NoError(t, err)
+
+	nydusDesc, _, _ := writeNydusImage(t, ctx, pvd)
+	var nydusManifest ocispec.Manifest
+	require.NoError(t, readJSON(ctx, pvd.store, nydusDesc, &nydusManifest))
+	nydusManifest.Annotations[utils.ManifestNydusSourceDigest] = source.Digest.String()
+	manifest, err := writeJSON(ctx, pvd.store, nydusManifest, ocispec.MediaTypeImageManifest)
+	require.NoError(t, err)
+
+	registry := newPushableRegistry(t)
+	var referrers []ocispec.Manifest
+	registry.Override(recordReferrers(t, &referrers))
+	require.NoError(t, pvd.Push(ctx, *manifest, registry.host+"/sbom:latest"))
+
+	require.Len(t, referrers, 1)
+	referrer := referrers[0]
+	require.Equal(t, MediaTypeSPDX, referrer.ArtifactType)
+	require.Equal(t, manifest.Digest, referrer.Subject.Digest)
+	require.Equal(t, ocispec.MediaTypeEmptyJSON, referrer.Config.MediaType)
+	require.Len(t, referrer.Layers, 1)
+	data, ok := registry.Blob(referrer.Layers[0].Digest)
+	require.True(t, ok)
+
+	var doc SPDXDocument
+	require.NoError(t, json.Unmarshal(data, &doc))
+	require.Equal(t, "SPDX-2.3", doc.SPDXVersion)
+	require.Len(t, doc.Packages, 1)
+	require.Equal(t, "libc6", doc.Packages[0].Name)
+	require.Equal(t, "2.36-9", doc.Packages[0].VersionInfo)
+	require.Equal(t, []SPDXRelationship{{
+		SPDXElementID:      "SPDXRef-DOCUMENT",
+		RelationshipType:   "DESCRIBES",
+		RelatedSPDXElement: doc.Packages[0].SPDXID,
+	}}, doc.Relationships)
+}
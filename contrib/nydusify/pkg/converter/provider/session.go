@@ -0,0 +1,254 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/log"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+const (
+	// sessionMaxRecords bounds the resolutions and the conversions recorded
+	// in session, the oldest ones are evicted first.
+	sessionMaxRecords = 1024
+	// sessionResolveTTL is how long the resolution of reference is cached in
+	// session, as the tag may be moved to another image.
+	sessionResolveTTL = 10 * time.Minute
+)
+
+// Session is shared by the conversions in a process, e.g. converting many
+// tags of a repository, it caches the resolution of image references and
+// records the target images converted from each source digest, so that
+// the references resolved to a converted digest are only tagged.
+type Session struct {
+	mutex    sync.Mutex
+	resolved map[string]resolvedImage
+	// converted maps the conversion key to the target reference.
+	converted map[string]string
+	// resolvedOrder and convertedOrder are the keys of records in the order
+	// of insertion for eviction.
+	resolvedOrder  []string
+	convertedOrder []string
+	maxRecords     int
+	resolveTTL     time.Duration
+	// uploads bounds the concurrent blob uploads of the conversions in
+	// session if it's set by SetUploadLimit.
+	uploads chan struct{}
+}
+
+type resolvedImage struct {
+	name       string
+	desc       ocispec.Descriptor
+	resolvedAt time.Time
+}
+
+// NewSession creates an empty session.
+func NewSession() *Session {
+	return &Session{
+		resolved:   map[string]resolvedImage{},
+		converted:  map[string]string{},
+		maxRecords: sessionMaxRecords,
+		resolveTTL: sessionResolveTTL,
+	}
+}
+
+// lookupResolved returns the resolution of ref unless it has expired, the
+// caller must hold the mutex.
+func (session *Session) lookupResolved(ref string) (resolvedImage, bool) {
+	resolved, ok := session.resolved[ref]
+	if !ok || time.Since(resolved.resolvedAt) >= session.resolveTTL {
+		return resolvedImage{}, false
+	}
+	return resolved, true
+}
+
+// addResolved records the resolution of ref and evicts the oldest records
+// beyond the limit, the caller must hold the mutex.
+func (session *Session) addResolved(ref string, resolved resolvedImage) {
+	if _, ok := session.resolved[ref]; !ok {
+		session.resolvedOrder = append(session.resolvedOrder, ref)
+	}
+	session.resolved[ref] = resolved
+	for len(session.resolvedOrder) > session.maxRecords {
+		delete(session.resolved, session.resolvedOrder[0])
+		session.resolvedOrder = session.resolvedOrder[1:]
+	}
+}
+
+// addConverted records the target converted by key and evicts the oldest
+// records beyond the limit, the caller must hold the mutex.
+func (session *Session) addConverted(key, target string) {
+	if _, ok := session.converted[key]; ok {
+		return
+	}
+	session.converted[key] = target
+	session.convertedOrder = append(session.convertedOrder, key)
+	for len(session.convertedOrder) > session.maxRecords {
+		delete(session.converted, session.convertedOrder[0])
+		session.convertedOrder = session.convertedOrder[1:]
+	}
+}
+
+// SetSession resolves the image references through session.
+func (pvd *Provider) SetSession(session *Session) {
+	pvd.session = session
+}
+
+func (pvd *Provider) sessionResolver(resolver remotes.Resolver) remotes.Resolver {
+	if pvd.session == nil {
+		return resolver
+	}
+	return &sessionResolver{Resolver: resolver, session: pvd.session}
+}
+
+// sessionResolver resolves each reference once in session, the other
+// requests are sent as is.
+type sessionResolver struct {
+	remotes.Resolver
+	session *Session
+}
+
+func (resolver *sessionResolver) Resolve(ctx context.Context, ref string) (string, ocispec.Descriptor, error) {
+	resolver.session.mutex.Lock()
+	resolved, ok := resolver.session.lookupResolved(ref)
+	resolver.session.mutex.Unlock()
+	if ok {
+		log.G(ctx).Debugf("resolved %s to %s in session", ref, resolved.desc.Digest)
+		return resolved.name, resolved.desc, nil
+	}
+
+	name, desc, err := resolver.Resolver.Resolve(ctx, ref)
+	if err != nil {
+		return "", ocispec.Descriptor{}, err
+	}
+	resolver.session.mutex.Lock()
+	resolver.session.addResolved(ref, resolvedImage{name: name, desc: desc, resolvedAt: time.Now()})
+	resolver.session.mutex.Unlock()
+	return name, desc, nil
+}
+
+// Resolve resolves the image reference to its root descriptor, the
+// resolution is cached in session if it's set.
+func (pvd *Provider) Resolve(ctx context.Context, ref string) (*ocispec.Descriptor, error) {
+	resolver, err := pvd.Resolver(ref)
+	if err != nil {
+		return nil, err
+	}
+	_, desc, err := pvd.sessionResolver(resolver).Resolve(ctx, ref)
+	if err != nil {
+		return nil, errors.Wrapf(err, "resolve %s", ref)
+	}
+	return &desc, nil
+}
+
+// ConvertOnce calls convert to convert source to target unless the source
+// digest has been converted with the same options key in session, in which
+// case the previous target image is tagged as target without converting, or
+// nothing is done for the same target. It returns true if converted. The
+// previous target must be in the same repository as target, since only the
+// root manifest or index is pushed, otherwise source is converted again.
+func (pvd *Provider) ConvertOnce(ctx context.Context, source, target, key string, convert func() error) (bool, error) {
+	if pvd.session == nil {
+		return true, convert()
+	}
+	desc, err := pvd.Resolve(ctx, source)
+	if err != nil {
+		return false, err
+	}
+	key = key + "@" + desc.Digest.String()
+
+	pvd.session.mutex.Lock()
+	previous, ok := pvd.session.converted[key]
+	pvd.session.mutex.Unlock()
+	if ok && previous == target {
+		log.G(ctx).Infof("source %s has been converted to %s in session", source, target)
+		return false, nil
+	}
+	if ok {
+		if sameRepository(previous, target) {
+			log.G(ctx).Infof("source %s has been converted to %s in session, tagging it as %s", source, previous, target)
+			return false, pvd.tag(ctx, previous, target)
+		}
+		log.G(ctx).Infof("source %s has been converted to %s in session, converting again for different repository", source, previous)
+	}
+
+	if err := convert(); err != nil {
+		return true, err
+	}
+	pvd.session.mutex.Lock()
+	pvd.session.addConverted(key, target)
+	pvd.session.mutex.Unlock()
+	return true, nil
+}
+
+func sameRepository(ref, other string) bool {
+	named, err := docker.ParseDockerRef(ref)
+	if err != nil {
+		return false
+	}
+	otherNamed, err := docker.ParseDockerRef(other)
+	if err != nil {
+		return false
+	}
+	return named.Name() == otherNamed.Name()
+}
+
+// tag pushes the root manifest or index of image ref as target, the blobs
+// and manifests referred by it already exist in the repository.
+func (pvd *Provider) tag(ctx context.Context, ref, target string) error {
+	resolver, err := pvd.Resolver(ref)
+	if err != nil {
+		return err
+	}
+	// The target image is resolved without session, as it's pushed
+	// during session.
+	_, desc, err := resolver.Resolve(ctx, ref)
+	if err != nil {
+		return errors.Wrapf(err, "resolve %s", ref)
+	}
+	fetcher, err := resolver.Fetcher(ctx, ref)
+	if err != nil {
+		return errors.Wrap(err, "get fetcher")
+	}
+	reader, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return errors.Wrapf(err, "fetch %s", desc.Digest)
+	}
+	defer reader.Close()
+
+	targetResolver, err := pvd.Resolver(target)
+	if err != nil {
+		return err
+	}
+	pusher, err := pvd.countingResolver(targetResolver).Pusher(ctx, target)
+	if err != nil {
+		return errors.Wrap(err, "get pusher")
+	}
+	writer, err := pusher.Push(ctx, desc)
+	if err != nil && !errdefs.IsAlreadyExists(err) {
+		return errors.Wrapf(err, "push %s", desc.Digest)
+	}
+	// The target may have been tagged with the image.
+	if err == nil {
+		defer writer.Close()
+		if err := content.Copy(ctx, writer, reader, desc.Size, desc.Digest); err != nil {
+			return errors.Wrapf(err, "push %s", desc.Digest)
+		}
+	}
+
+	pvd.mutex.Lock()
+	defer pvd.mutex.Unlock()
+	pvd.images[target] = &desc
+	return nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionConvertOnce(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+
+	registry := newPushableRegistry(t)
+	configData, err := json.Marshal(ocispec.Image{Platform: ocispec.Platform{OS: "linux", Architecture: "amd64"}})
+	require.NoError(t, err)
+	manifestData, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    registry.AddBlob(ocispec.MediaTypeImageConfig, configData),
+		Layers:    []ocispec.Descriptor{registry.AddBlob(ocispec.MediaTypeImageLayerGzip, []byte("layer"))},
+	})
+	require.NoError(t, err)
+	manifest := registry.AddBlob(ocispec.MediaTypeImageManifest, manifestData)
+	registry.SetTag("library/source", "v1", manifest.Digest)
+	registry.SetTag("library/source", "latest", manifest.Digest)
+
+	session := NewSession()
+	builds := 0
+	convert := func(source, target, key string) bool {
+		// Each conversion creates its own provider sharing the session.
+		pvd := newPlatformProvider(t, platforms.All, "", "")
+		pvd.SetSession(session)
+		converted, err := pvd.ConvertOnce(ctx, source, target, key, func() error {
+			builds++
+			if err := pvd.Pull(ctx, source); err != nil {
+				return err
+			}
+			desc, _, _ := writeNydusImage(t, ctx, pvd)
+			return pvd.Push(ctx, desc, target)
+		})
+		require.NoError(t, err)
+		return converted
+	}
+
+	// The tags of the same digest are built once, the second tag is only
+	// pushed as the new target tag.
+	require.True(t, convert(registry.host+"/library/source:v1", registry.host+"/library/nydus:v1", "options"))
+	require.False(t, convert(registry.host+"/library/source:latest", registry.host+"/library/nydus:latest", "options"))
+	require.Equal(t, 1, builds)
+	v1, _, ok := registry.Tag("library/nydus", "v1")
+	require.True(t, ok)
+	latest, _, ok := registry.Tag("library/nydus", "latest")
+	require.True(t, ok)
+	require.Equal(t, v1, latest)
+
+	// The source reference is resolved once in session, either by the
+	// check or by pulling.
+	require.False(t, convert(registry.host+"/library/source:v1", registry.host+"/library/nydus:v1", "options"))
+	require.Equal(t, 1, registry.TagResolves("library/source", "v1"))
+	require.Equal(t, 1, registry.TagResolves("library/source", "latest"))
+
+	// The conversion with different options or to a different repository
+	// is built again.
+	require.True(t, convert(registry.host+"/library/source:latest", registry.host+"/library/nydus:other", "other"))
+	require.True(t, convert(registry.host+"/library/source:latest", registry.host+"/library/mirror:latest", "options"))
+	require.Equal(t, 3, builds)
+}
+
+func TestSessionEviction(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+
+	registry := newPushableRegistry(t)
+	manifest := registry.AddBlob(ocispec.MediaTypeImageManifest, []byte(`{"schemaVersion":2}`))
+	registry.SetTag("library/source", "v1", manifest.Digest)
+	registry.SetTag("library/source", "v2", manifest.Digest)
+
+	session := NewSession()
+	session.maxRecords = 1
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+	pvd.SetSession(session)
+
+	// The oldest resolution is evicted beyond the limit.
+	for _, tag := range []string{"v1", "v2", "v1"} {
+		_, err := pvd.Resolve(ctx, registry.host+"/library/source:"+tag)
+		require.NoError(t, err)
+	}
+	require.Len(t, session.resolved, 1)
+	require.Equal(t, 2, registry.TagResolves("library/source", "v1"))
+	require.Equal(t, 1, registry.TagResolves("library/source", "v2"))
+
+	// The expired resolution is resolved again.
+	session.resolveTTL = 0
+	_, err := pvd.Resolve(ctx, registry.host+"/library/source:v1")
+	require.NoError(t, err)
+	require.Equal(t, 3, registry.TagResolves("library/source", "v1"))
+
+	session.addConverted("a", "target:a")
+	session.addConverted("b", "target:b")
+	require.Equal(t, map[string]string{"b": "target:b"}, session.converted)
+}
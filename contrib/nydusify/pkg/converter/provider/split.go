@@ -0,0 +1,331 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/log"
+	humanize "github.com/dustin/go-humanize"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+// splitOverheadRatio is the part of the maximum blob size reserved for the
+// blob metadata like chunk infos and TOC, which is appended to the file data
+// compressed in nydus blob.
+const splitOverheadRatio = 16
+
+// splitEntry is an entry of the layer to split.
+type splitEntry struct {
+	name string
+	part int
+}
+
+// splitPlan assigns the entries of a layer to the parts, in the order of
+// entries in layer.
+type splitPlan struct {
+	entries []splitEntry
+	// dirs is the last header of each directory in layer, which is written
+	// into each part having the entries under the directory.
+	dirs  map[string]*tar.Header
+	parts int
+}
+
+// planSplit assigns the entries of layer read from reader to the parts of
+// file data up to limit, each part has at least a file, so a file larger
+// than limit makes a part alone. The whiteouts are assigned to the first
+// part, they only apply to the layers below. The hard links are assigned to
+// the parts of their targets, which the builder resolves in the same layer.
+func planSplit(reader io.Reader, limit int64) (*splitPlan, error) {
+	plan := &splitPlan{dirs: map[string]*tar.Header{}, parts: 1}
+	parts := map[string]int{}
+	var size int64
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return plan, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := path.Clean("/" + hdr.Name)
+		part := plan.parts - 1
+		switch {
+		case strings.HasPrefix(path.Base(name), whiteoutPrefix):
+			part = 0
+		case hdr.Typeflag == tar.TypeDir:
+			copied := *hdr
+			plan.dirs[name] = &copied
+		case hdr.Typeflag == tar.TypeLink:
+			if target, ok := parts[path.Clean("/"+hdr.Linkname)]; ok {
+				part = target
+			}
+		case hdr.Typeflag == tar.TypeReg:
+			if size > 0 && size+hdr.Size > limit {
+				plan.parts++
+				part, size = plan.parts-1, 0
+			}
+			size += hdr.Size
+		}
+		parts[name] = part
+		plan.entries = append(plan.entries, splitEntry{name: name, part: part})
+	}
+}
+
+// splitPart is a layer split from the source layer being written.
+type splitPart struct {
+	writer       content.Writer
+	gw           *gzip.Writer
+	tw           *tar.Writer
+	diffDigester digest.Digester
+	size         int64
+	// written records the directories written into the part.
+	written map[string]bool
+}
+
+func (part *splitPart) Write(b []byte) (int, error) {
+	n, err := part.writer.Write(b)
+	part.size += int64(n)
+	return n, err
+}
+
+// writeHeader writes hdr of the entry name into the part, with the headers
+// of its ancestor directories in layer not written yet.
+func (part *splitPart) writeHeader(plan *splitPlan, name string, hdr *tar.Header) error {
+	var ancestors []string
+	for dir := path.Dir(name); dir != "/"; dir = path.Dir(dir) {
+		ancestors = append(ancestors, dir)
+	}
+	for idx := len(ancestors) - 1; idx >= 0; idx-- {
+		dir := ancestors[idx]
+		if part.written[dir] || plan.dirs[dir] == nil {
+			continue
+		}
+		if err := part.tw.WriteHeader(plan.dirs[dir]); err != nil {
+			return err
+		}
+		part.written[dir] = true
+	}
+	if hdr.Typeflag == tar.TypeDir {
+		if part.written[name] {
+			return nil
+		}
+		part.written[name] = true
+		hdr = plan.dirs[name]
+	}
+	return part.tw.WriteHeader(hdr)
+}
+
+// splitLayer splits layer in store into the gzip layers of file data up to
+// limit written into store, see planSplit. The layers are applied in order
+// to the same files as layer. It returns the new layers and their diff IDs,
+// or nil if layer isn't larger than limit.
+func splitLayer(ctx context.Context, store content.Store, layer ocispec.Descriptor, limit int64) ([]ocispec.Descriptor, []digest.Digest, error) {
+	open := func() (io.ReadCloser, func(), error) {
+		ra, err := store.ReaderAt(ctx, layer)
+		if err != nil {
+			return nil, nil, err
+		}
+		reader, err := utils.DecompressLayer(content.NewReader(ra), layer.MediaType)
+		if err != nil {
+			ra.Close()
+			return nil, nil, err
+		}
+		return reader, func() {
+			reader.Close()
+			ra.Close()
+		}, nil
+	}
+
+	reader, done, err := open()
+	if err != nil {
+		return nil, nil, err
+	}
+	plan, err := planSplit(reader, limit)
+	done()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "plan split")
+	}
+	if plan.parts == 1 {
+		return nil, nil, nil
+	}
+
+	parts := make([]*splitPart, plan.parts)
+	defer func() {
+		for _, part := range parts {
+			if part != nil {
+				part.writer.Close()
+			}
+		}
+	}()
+	for idx := range parts {
+		writer, err := content.OpenWriter(ctx, store, content.WithRef(fmt.Sprintf("split-%s-%d", layer.Digest, idx)))
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := writer.Truncate(0); err != nil {
+			writer.Close()
+			return nil, nil, err
+		}
+		part := &splitPart{writer: writer, diffDigester: digest.Canonical.Digester(), written: map[string]bool{}}
+		part.gw = gzip.NewWriter(part)
+		part.tw = tar.NewWriter(io.MultiWriter(part.gw, part.diffDigester.Hash()))
+		parts[idx] = part
+	}
+
+	reader, done, err = open()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer done()
+	tr := tar.NewReader(reader)
+	for _, entry := range plan.entries {
+		hdr, err := tr.Next()
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "read layer changed since planned")
+		}
+		part := parts[entry.part]
+		if err := part.writeHeader(plan, entry.name, hdr); err != nil {
+			return nil, nil, err
+		}
+		if _, err := io.Copy(part.tw, tr); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	mediaType := ocispec.MediaTypeImageLayerGzip
+	if strings.HasPrefix(layer.MediaType, "application/vnd.docker.") {
+		mediaType = images.MediaTypeDockerSchema2LayerGzip
+	}
+	var layers []ocispec.Descriptor
+	var diffIDs []digest.Digest
+	for idx, part := range parts {
+		if err := part.tw.Close(); err != nil {
+			return nil, nil, err
+		}
+		if err := part.gw.Close(); err != nil {
+			return nil, nil, err
+		}
+		desc := ocispec.Descriptor{MediaType: mediaType, Digest: part.writer.Digest(), Size: part.size}
+		if err := part.writer.Commit(ctx, desc.Size, desc.Digest); err != nil && !errdefs.IsAlreadyExists(err) {
+			return nil, nil, errors.Wrapf(err, "commit part %d", idx)
+		}
+		layers = append(layers, desc)
+		diffIDs = append(diffIDs, part.diffDigester.Digest())
+	}
+	return layers, diffIDs, nil
+}
+
+// splitManifestLayers replaces the layers of manifest larger than limit by
+// the layers split from them, and the diff IDs and history of config
+// accordingly, the history of a split layer is repeated for its parts.
+func splitManifestLayers(ctx context.Context, store content.Store, manifest *ocispec.Manifest, limit int64) (bool, error) {
+	// Keep the unknown fields of image config and history.
+	var config map[string]json.RawMessage
+	if err := readJSON(ctx, store, manifest.Config, &config); err != nil {
+		return false, errors.Wrap(err, "read image config")
+	}
+	var rootfs ocispec.RootFS
+	if err := json.Unmarshal(config["rootfs"], &rootfs); err != nil {
+		return false, errors.Wrap(err, "unmarshal rootfs of image config")
+	}
+	if len(rootfs.DiffIDs) != len(manifest.Layers) {
+		return false, errors.Errorf("mismatched diff IDs %d and layers %d", len(rootfs.DiffIDs), len(manifest.Layers))
+	}
+
+	// The number of parts of each layer, 1 for the layer not split.
+	counts := make([]int, len(manifest.Layers))
+	var layers []ocispec.Descriptor
+	var diffIDs []digest.Digest
+	for idx, layer := range manifest.Layers {
+		counts[idx] = 1
+		parts, partDiffIDs, err := splitLayer(ctx, store, layer, limit)
+		if err != nil {
+			return false, errors.Wrapf(err, "split layer %s", layer.Digest)
+		}
+		if parts == nil {
+			layers = append(layers, layer)
+			diffIDs = append(diffIDs, rootfs.DiffIDs[idx])
+			continue
+		}
+		log.G(ctx).Infof("split layer %s into %d layers of file data up to %s", layer.Digest, len(parts), humanize.IBytes(uint64(limit)))
+		counts[idx] = len(parts)
+		layers = append(layers, parts...)
+		diffIDs = append(diffIDs, partDiffIDs...)
+	}
+	if len(layers) == len(manifest.Layers) {
+		return false, nil
+	}
+	rootfs.DiffIDs = diffIDs
+	data, err := json.Marshal(rootfs)
+	if err != nil {
+		return false, err
+	}
+	config["rootfs"] = data
+
+	if config["history"] != nil {
+		var history []map[string]json.RawMessage
+		if err := json.Unmarshal(config["history"], &history); err != nil {
+			return false, errors.Wrap(err, "unmarshal history of image config")
+		}
+		var newHistory []map[string]json.RawMessage
+		layer := 0
+		for _, item := range history {
+			var empty bool
+			if item["empty_layer"] != nil {
+				if err := json.Unmarshal(item["empty_layer"], &empty); err != nil {
+					return false, errors.Wrap(err, "unmarshal history of image config")
+				}
+			}
+			repeat := 1
+			if !empty && layer < len(counts) {
+				repeat = counts[layer]
+				layer++
+			}
+			for i := 0; i < repeat; i++ {
+				newHistory = append(newHistory, item)
+			}
+		}
+		if config["history"], err = json.Marshal(newHistory); err != nil {
+			return false, err
+		}
+	}
+
+	configDesc, err := writeJSON(ctx, store, config, manifest.Config.MediaType)
+	if err != nil {
+		return false, errors.Wrap(err, "write image config")
+	}
+	configDesc.Annotations = manifest.Config.Annotations
+	manifest.Config = *configDesc
+	manifest.Layers = layers
+
+	return true, nil
+}
+
+// splitImageLayers splits the layers of source image pulled into store whose
+// file data exceeds the maximum blob size minus the reserved blob metadata,
+// so that the nydus blob built from each part fits, see SetMaxBlobSize and
+// rewriteSourceManifests.
+func (pvd *Provider) splitImageLayers(ctx context.Context, desc ocispec.Descriptor) (*ocispec.Descriptor, error) {
+	limit := pvd.maxBlobSize - pvd.maxBlobSize/splitOverheadRatio
+	return pvd.rewriteSourceManifests(ctx, desc, func(_ *ocispec.Descriptor, manifest *ocispec.Manifest) (bool, error) {
+		return splitManifestLayers(ctx, pvd.store, manifest, limit)
+	})
+}
@@ -0,0 +1,141 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"archive/tar"
+	"context"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+// applyLayers applies the layers in order like the overlay filesystem, it
+// returns the files of the merged layers.
+func applyLayers(t *testing.T, ctx context.Context, store content.Store, layers []ocispec.Descriptor) map[string]tar.Header {
+	batch := &layerBatch{paths: map[string]*batchEntry{}}
+	for idx, layer := range layers {
+		ra, err := store.ReaderAt(ctx, layer)
+		require.NoError(t, err)
+		reader, err := utils.DecompressLayer(content.NewReader(ra), layer.MediaType)
+		require.NoError(t, err)
+		require.NoError(t, batch.apply(reader, idx))
+		reader.Close()
+		ra.Close()
+	}
+	files := map[string]tar.Header{}
+	for name, entry := range batch.paths {
+		files[name] = tar.Header{Typeflag: entry.hdr.Typeflag, Mode: entry.hdr.Mode, Size: entry.hdr.Size, Linkname: entry.hdr.Linkname}
+	}
+	return files
+}
+
+func TestSplitLayer(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+	lower := writeHeaderLayer(t, ctx, pvd.store, []*tar.Header{
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "etc/hosts", Typeflag: tar.TypeReg, Mode: 0644, Size: 1},
+		{Name: "var/lib/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "var/lib/old", Typeflag: tar.TypeReg, Mode: 0644, Size: 1},
+	})
+	layer := writeHeaderLayer(t, ctx, pvd.store, []*tar.Header{
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0700},
+		{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0600, Size: 600},
+		{Name: "usr/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "usr/bin/", Typeflag: tar.TypeDir, Mode: 0711},
+		{Name: "usr/bin/app", Typeflag: tar.TypeReg, Mode: 0755, Size: 800},
+		{Name: "usr/bin/tool", Typeflag: tar.TypeReg, Mode: 0755, Size: 700},
+		{Name: "usr/bin/sh", Typeflag: tar.TypeSymlink, Linkname: "app"},
+		// The file larger than limit makes a part alone.
+		{Name: "usr/lib/big", Typeflag: tar.TypeReg, Mode: 0644, Size: 3000},
+		{Name: "usr/bin/app-link", Typeflag: tar.TypeLink, Linkname: "usr/bin/app"},
+		{Name: "etc/.wh.hosts", Typeflag: tar.TypeReg},
+		{Name: "var/lib/.wh..wh..opq", Typeflag: tar.TypeReg},
+		{Name: "var/lib/new", Typeflag: tar.TypeReg, Mode: 0644, Size: 900},
+	})
+
+	parts, diffIDs, err := splitLayer(ctx, pvd.store, layer, 1<<20)
+	require.NoError(t, err)
+	require.Nil(t, parts)
+
+	parts, diffIDs, err = splitLayer(ctx, pvd.store, layer, 1500)
+	require.NoError(t, err)
+	require.Len(t, parts, 4)
+	require.Len(t, diffIDs, 4)
+	for idx, part := range parts {
+		names, diffID := readTarLayer(t, ctx, pvd.store, part)
+		require.Equal(t, diffIDs[idx], diffID)
+		// The whiteouts are in the first part, the hard link is with its
+		// target, and the ancestor directories are in each part.
+		switch idx {
+		case 0:
+			require.Equal(t, []string{"etc/", "etc/passwd", "usr/", "usr/bin/", "usr/bin/app", "usr/bin/app-link", "etc/.wh.hosts", "var/lib/.wh..wh..opq"}, names)
+		case 1:
+			require.Equal(t, []string{"usr/", "usr/bin/", "usr/bin/tool", "usr/bin/sh"}, names)
+		case 2:
+			require.Equal(t, []string{"usr/", "usr/lib/big"}, names)
+		case 3:
+			require.Equal(t, []string{"var/lib/new"}, names)
+		}
+	}
+
+	// The parts are reassembled to the same files as the layer.
+	expected := applyLayers(t, ctx, pvd.store, []ocispec.Descriptor{lower, layer})
+	require.Equal(t, expected, applyLayers(t, ctx, pvd.store, append([]ocispec.Descriptor{lower}, parts...)))
+	require.Equal(t, tar.Header{Typeflag: tar.TypeDir, Mode: 0700}, expected["/etc"])
+	require.NotContains(t, expected, "/etc/hosts")
+	require.NotContains(t, expected, "/var/lib/old")
+}
+
+func TestPullSplitLayers(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	registry := newPushableRegistry(t)
+	pvd := newPlatformProvider(t, platforms.All, "", "")
+	small := writeHeaderLayer(t, ctx, pvd.store, []*tar.Header{
+		{Name: "etc/hosts", Typeflag: tar.TypeReg, Mode: 0644, Size: 100},
+	})
+	large := writeHeaderLayer(t, ctx, pvd.store, []*tar.Header{
+		{Name: "data/a", Typeflag: tar.TypeReg, Mode: 0644, Size: 3 << 10},
+		{Name: "data/b", Typeflag: tar.TypeReg, Mode: 0644, Size: 3 << 10},
+		{Name: "data/c", Typeflag: tar.TypeReg, Mode: 0644, Size: 3 << 10},
+	})
+	source := pushLayersImage(t, ctx, pvd, registry.host+"/source:latest", []ocispec.Descriptor{small, large})
+
+	pvd = newPlatformProvider(t, platforms.All, "", "")
+	pvd.SetMaxBlobSize(8 << 10)
+	require.NoError(t, pvd.Pull(ctx, registry.host+"/source:latest"))
+	desc, err := pvd.Image(ctx, registry.host+"/source:latest")
+	require.NoError(t, err)
+	require.Equal(t, source.Digest, pvd.originalSources()[desc.Digest])
+
+	// The large layer is split into two layers of file data up to 7.5KiB.
+	var pulled ocispec.Manifest
+	require.NoError(t, readJSON(ctx, pvd.store, *desc, &pulled))
+	require.Len(t, pulled.Layers, 3)
+	require.Equal(t, small.Digest, pulled.Layers[0].Digest)
+	var diffIDs []digest.Digest
+	for _, layer := range pulled.Layers[1:] {
+		_, diffID := readTarLayer(t, ctx, pvd.store, layer)
+		diffIDs = append(diffIDs, diffID)
+	}
+
+	var config ocispec.Image
+	require.NoError(t, readJSON(ctx, pvd.store, pulled.Config, &config))
+	require.Len(t, config.RootFS.DiffIDs, 3)
+	require.Equal(t, diffIDs, config.RootFS.DiffIDs[1:])
+	var createdBy []string
+	for _, history := range config.History {
+		createdBy = append(createdBy, history.CreatedBy)
+	}
+	require.Equal(t, []string{"ENV PATH=/usr/bin", "RUN layer 0", "RUN layer 1", "RUN layer 1"}, createdBy)
+}
@@ -0,0 +1,146 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/log"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+// CacheHit is the hit count of the build cache for an image.
+type CacheHit struct {
+	Cached uint
+	Total  uint
+}
+
+// countingResolver records the bytes of content actually written to
+// remote, the content already existing in remote is counted separately.
+type countingResolver struct {
+	remotes.Resolver
+	pushedBytes   *int64
+	existingBytes *int64
+	destinations  *destinationBytes
+}
+
+func (resolver *countingResolver) Pusher(ctx context.Context, ref string) (remotes.Pusher, error) {
+	pusher, err := resolver.Resolver.Pusher(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	destination := ref
+	if named, err := docker.ParseDockerRef(ref); err == nil {
+		destination = named.Name()
+	}
+	return &countingPusher{
+		Pusher:        pusher,
+		pushedBytes:   resolver.pushedBytes,
+		existingBytes: resolver.existingBytes,
+		destinations:  resolver.destinations,
+		destination:   destination,
+	}, nil
+}
+
+type countingPusher struct {
+	remotes.Pusher
+	pushedBytes   *int64
+	existingBytes *int64
+	destinations  *destinationBytes
+	destination   string
+}
+
+// destinationBytes records the bytes written to each repository.
+type destinationBytes struct {
+	mutex sync.Mutex
+	bytes map[string]int64
+}
+
+func (dest *destinationBytes) add(destination string, size int64) {
+	dest.mutex.Lock()
+	defer dest.mutex.Unlock()
+	if dest.bytes == nil {
+		dest.bytes = map[string]int64{}
+	}
+	dest.bytes[destination] += size
+}
+
+func (pusher *countingPusher) Push(ctx context.Context, desc ocispec.Descriptor) (content.Writer, error) {
+	writer, err := pusher.Pusher.Push(ctx, desc)
+	if err != nil {
+		if errdefs.IsAlreadyExists(err) {
+			log.G(ctx).Debugf("skip pushing %s %s, already exists", desc.MediaType, desc.Digest)
+			atomic.AddInt64(pusher.existingBytes, desc.Size)
+		}
+		return nil, err
+	}
+	log.G(ctx).Debugf("pushing %s %s, size %d", desc.MediaType, desc.Digest, desc.Size)
+	atomic.AddInt64(pusher.pushedBytes, desc.Size)
+	pusher.destinations.add(pusher.destination, desc.Size)
+	return writer, nil
+}
+
+// debugHandlerWrapper logs the detail of each fetched content at debug level.
+func debugHandlerWrapper(handler images.Handler) images.Handler {
+	return images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		if !logrus.IsLevelEnabled(logrus.DebugLevel) {
+			return handler.Handle(ctx, desc)
+		}
+		start := time.Now()
+		children, err := handler.Handle(ctx, desc)
+		if err == nil {
+			log.G(ctx).Debugf("fetched %s %s, size %d, elapsed %s", desc.MediaType, desc.Digest, desc.Size, time.Since(start))
+			if utils.IsZstdChunkedLayer(desc) {
+				log.G(ctx).Debugf("layer %s is in zstd:chunked format, its TOC will be ignored", desc.Digest)
+			}
+		}
+		return children, err
+	})
+}
+
+// PushedBytes returns the total bytes of content written to remote
+// registry by Push.
+func (pvd *Provider) PushedBytes() int64 {
+	return atomic.LoadInt64(&pvd.pushedBytes)
+}
+
+// PushedBytesByDestination returns the bytes of content written to each
+// remote repository by Push, e.g. the target repository and the build
+// cache repository.
+func (pvd *Provider) PushedBytesByDestination() map[string]int64 {
+	pvd.destinations.mutex.Lock()
+	defer pvd.destinations.mutex.Unlock()
+	result := make(map[string]int64, len(pvd.destinations.bytes))
+	for destination, size := range pvd.destinations.bytes {
+		result[destination] = size
+	}
+	return result
+}
+
+// ExistingBytes returns the total bytes of content skipped by Push since
+// it has existed in remote registry, for example, the blobs pushed by an
+// interrupted conversion.
+func (pvd *Provider) ExistingBytes() int64 {
+	return atomic.LoadInt64(&pvd.existingBytes)
+}
+
+// CacheHit returns the build cache hit count of the image pulled by ref,
+// it's only available if the build cache is enabled.
+func (pvd *Provider) CacheHit(ref string) *CacheHit {
+	pvd.mutex.Lock()
+	defer pvd.mutex.Unlock()
+	return pvd.cacheHits[ref]
+}
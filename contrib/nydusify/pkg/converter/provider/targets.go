@@ -0,0 +1,30 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+
+	"github.com/containerd/log"
+	"github.com/pkg/errors"
+)
+
+// PushTargets pushes the image which has been pushed by ref to the other
+// targets, the content in store is reused so that the image is built once.
+// The image is processed as same as Push for each target, thus the digests
+// are identical unless the layer name template refers the target image.
+func (pvd *Provider) PushTargets(ctx context.Context, ref string, targets []string) error {
+	desc, err := pvd.Image(ctx, ref)
+	if err != nil {
+		return errors.Wrapf(err, "get image %s", ref)
+	}
+	for _, target := range targets {
+		log.G(ctx).Infof("pushing image %s to %s", ref, target)
+		if err := pvd.Push(ctx, *desc, target); err != nil {
+			return errors.Wrapf(err, "push image to %s", target)
+		}
+	}
+	return nil
+}
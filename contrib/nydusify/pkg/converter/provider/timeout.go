@@ -0,0 +1,222 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultDialTimeout is the timeout of establishing a connection to registry.
+const DefaultDialTimeout = 30 * time.Second
+
+// SetTimeouts sets the timeout of establishing a connection to registry and
+// the timeout of waiting for each response and each read of its body, so
+// that a stalled transfer in Pull or Push fails fast rather than waiting for
+// the whole conversion to be canceled. Zero dialTimeout means
+// DefaultDialTimeout, zero readTimeout means no limitation.
+func (pvd *Provider) SetTimeouts(dialTimeout, readTimeout time.Duration) {
+	if dialTimeout <= 0 {
+		dialTimeout = DefaultDialTimeout
+	}
+	pvd.dialTimeout = dialTimeout
+	pvd.readTimeout = readTimeout
+}
+
+// readTimeoutTransport fails the request if no response header is received
+// within timeout after the request body is sent, or no data of response body
+// is received within timeout. Unlike a read deadline of the connection, it
+// isn't armed while the request body is being written, so a long upload
+// waiting for the response isn't interrupted. The wait for the response
+// header of a manifest or blob request is limited by its request timeout
+// instead if any, see requestTimeoutTransport, the registry may take longer
+// to verify a large blob uploaded.
+type readTimeoutTransport struct {
+	http.RoundTripper
+	timeout time.Duration
+}
+
+func (transport *readTimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	req = req.WithContext(ctx)
+	timer := &headerTimer{timeout: transport.timeout, cancel: cancel}
+	if _, ok := ctx.Value(requestTimeoutKey{}).(time.Duration); !ok {
+		if req.Body == nil || req.Body == http.NoBody {
+			timer.start()
+		} else {
+			req.Body = &sentBody{ReadCloser: req.Body, timer: timer}
+		}
+	}
+	resp, err := transport.RoundTripper.RoundTrip(req)
+	timer.stop()
+	if err != nil {
+		cancel()
+		if timer.expired.Load() {
+			return nil, errors.Wrapf(os.ErrDeadlineExceeded, "no response received from registry within %s", transport.timeout)
+		}
+		return nil, err
+	}
+	resp.Body = &readTimeoutBody{ReadCloser: resp.Body, timeout: transport.timeout, cancel: cancel}
+	return resp, nil
+}
+
+// headerTimer cancels the request if no response header is received within
+// timeout after it's started, it isn't started again once stopped.
+type headerTimer struct {
+	timeout time.Duration
+	cancel  context.CancelFunc
+	mutex   sync.Mutex
+	timer   *time.Timer
+	stopped bool
+	expired atomic.Bool
+}
+
+func (timer *headerTimer) start() {
+	timer.mutex.Lock()
+	defer timer.mutex.Unlock()
+	if timer.timer != nil || timer.stopped {
+		return
+	}
+	timer.timer = time.AfterFunc(timer.timeout, func() {
+		timer.expired.Store(true)
+		timer.cancel()
+	})
+}
+
+func (timer *headerTimer) stop() {
+	timer.mutex.Lock()
+	defer timer.mutex.Unlock()
+	timer.stopped = true
+	if timer.timer != nil {
+		timer.timer.Stop()
+	}
+}
+
+// sentBody starts the header timer once the request body is read to the end
+// or closed by the transport.
+type sentBody struct {
+	io.ReadCloser
+	timer *headerTimer
+}
+
+func (body *sentBody) Read(b []byte) (int, error) {
+	n, err := body.ReadCloser.Read(b)
+	if err == io.EOF {
+		body.timer.start()
+	}
+	return n, err
+}
+
+func (body *sentBody) Close() error {
+	body.timer.start()
+	return body.ReadCloser.Close()
+}
+
+// readTimeoutBody cancels the request if a read of the response body is
+// blocked longer than timeout, the time spent by the caller between reads
+// isn't counted.
+type readTimeoutBody struct {
+	io.ReadCloser
+	timeout time.Duration
+	cancel  context.CancelFunc
+	timer   *time.Timer
+	expired atomic.Bool
+}
+
+func (body *readTimeoutBody) Read(b []byte) (int, error) {
+	if body.timer == nil {
+		body.timer = time.AfterFunc(body.timeout, func() {
+			body.expired.Store(true)
+			body.cancel()
+		})
+	} else {
+		body.timer.Reset(body.timeout)
+	}
+	n, err := body.ReadCloser.Read(b)
+	body.timer.Stop()
+	if err != nil && err != io.EOF && body.expired.Load() {
+		return n, errors.Wrapf(os.ErrDeadlineExceeded, "no data received from registry within %s", body.timeout)
+	}
+	return n, err
+}
+
+func (body *readTimeoutBody) Close() error {
+	if body.timer != nil {
+		body.timer.Stop()
+	}
+	defer body.cancel()
+	return body.ReadCloser.Close()
+}
+
+// SetRegistryTimeouts limits the duration of each manifest request and each
+// blob request to registry respectively, including reading the response
+// body, since a blob transfer legitimately takes much longer than a
+// manifest request. The wait for the response header of these requests is
+// limited by them rather than the read timeout of SetTimeouts, while the
+// reads of response body are still limited by the read timeout. Zero means
+// no limitation.
+func (pvd *Provider) SetRegistryTimeouts(manifestTimeout, blobTimeout time.Duration) {
+	pvd.manifestTimeout = manifestTimeout
+	pvd.blobTimeout = blobTimeout
+}
+
+// requestTimeoutKey is the context key of the request timeout of a manifest
+// or blob request.
+type requestTimeoutKey struct{}
+
+// requestTimeoutTransport limits the duration of the manifest and blob
+// requests of registry API by their paths, the other requests like token
+// requests aren't limited.
+type requestTimeoutTransport struct {
+	http.RoundTripper
+	manifestTimeout time.Duration
+	blobTimeout     time.Duration
+}
+
+func (transport *requestTimeoutTransport) timeout(path string) time.Duration {
+	manifest, blob := strings.LastIndex(path, "/manifests/"), strings.LastIndex(path, "/blobs/")
+	switch {
+	case manifest > blob:
+		return transport.manifestTimeout
+	case blob > manifest:
+		return transport.blobTimeout
+	}
+	return 0
+}
+
+func (transport *requestTimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	timeout := transport.timeout(req.URL.Path)
+	if timeout <= 0 {
+		return transport.RoundTripper.RoundTrip(req)
+	}
+	ctx, cancel := context.WithTimeout(context.WithValue(req.Context(), requestTimeoutKey{}, timeout), timeout)
+	resp, err := transport.RoundTripper.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelReadCloser{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelReadCloser cancels the request context once the response body is
+// closed.
+type cancelReadCloser struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (body *cancelReadCloser) Close() error {
+	defer body.cancel()
+	return body.ReadCloser.Close()
+}
@@ -0,0 +1,205 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/log"
+	humanize "github.com/dustin/go-humanize"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var errUncommitted = errors.New("closed before commit")
+
+// transferAttempts counts the transfers of each layer in both directions,
+// the transfers beyond the first one are retries, e.g. the pull retried
+// with plain HTTP or the push resumed after a failure.
+type transferAttempts struct {
+	mutex    sync.Mutex
+	attempts map[string]int
+}
+
+func (attempts *transferAttempts) add(direction string, dgst digest.Digest) int {
+	attempts.mutex.Lock()
+	defer attempts.mutex.Unlock()
+	if attempts.attempts == nil {
+		attempts.attempts = map[string]int{}
+	}
+	key := direction + " " + dgst.String()
+	attempts.attempts[key]++
+	return attempts.attempts[key] - 1
+}
+
+// timingResolver logs the transfer statistics of each layer at debug
+// level: the time to first byte, the total transfer time, the average
+// throughput and the retry count.
+func (pvd *Provider) timingResolver(resolver remotes.Resolver) remotes.Resolver {
+	if !logrus.IsLevelEnabled(logrus.DebugLevel) {
+		return resolver
+	}
+	return &timingResolver{Resolver: resolver, attempts: &pvd.attempts}
+}
+
+type timingResolver struct {
+	remotes.Resolver
+	attempts *transferAttempts
+}
+
+func (resolver *timingResolver) Fetcher(ctx context.Context, ref string) (remotes.Fetcher, error) {
+	fetcher, err := resolver.Resolver.Fetcher(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	return &timingFetcher{Fetcher: fetcher, attempts: resolver.attempts}, nil
+}
+
+func (resolver *timingResolver) Pusher(ctx context.Context, ref string) (remotes.Pusher, error) {
+	pusher, err := resolver.Resolver.Pusher(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	return &timingPusher{Pusher: pusher, attempts: resolver.attempts}, nil
+}
+
+type timingFetcher struct {
+	remotes.Fetcher
+	attempts *transferAttempts
+}
+
+func (fetcher *timingFetcher) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	if !images.IsLayerType(desc.MediaType) {
+		return fetcher.Fetcher.Fetch(ctx, desc)
+	}
+	stat := &transferStat{
+		logger:    log.G(ctx),
+		direction: "pull",
+		desc:      desc,
+		retries:   fetcher.attempts.add("pull", desc.Digest),
+		start:     time.Now(),
+	}
+	reader, err := fetcher.Fetcher.Fetch(ctx, desc)
+	if err != nil {
+		stat.log(err)
+		return nil, err
+	}
+	stat.ttfb = time.Since(stat.start)
+	return &timingReader{ReadCloser: reader, stat: stat}, nil
+}
+
+type timingPusher struct {
+	remotes.Pusher
+	attempts *transferAttempts
+}
+
+func (pusher *timingPusher) Push(ctx context.Context, desc ocispec.Descriptor) (content.Writer, error) {
+	if !images.IsLayerType(desc.MediaType) {
+		return pusher.Pusher.Push(ctx, desc)
+	}
+	stat := &transferStat{
+		logger:    log.G(ctx),
+		direction: "push",
+		desc:      desc,
+		retries:   pusher.attempts.add("push", desc.Digest),
+		start:     time.Now(),
+	}
+	writer, err := pusher.Pusher.Push(ctx, desc)
+	if err != nil {
+		// The layer existing in remote is logged by countingPusher.
+		if !errdefs.IsAlreadyExists(err) {
+			stat.log(err)
+		}
+		return nil, err
+	}
+	stat.ttfb = time.Since(stat.start)
+	return &timingWriter{Writer: writer, stat: stat}, nil
+}
+
+// transferStat is the statistics of a layer transfer, the time to first
+// byte is measured until the response of registry is received for pulling,
+// or until the upload is started for pushing.
+type transferStat struct {
+	once      sync.Once
+	logger    *logrus.Entry
+	direction string
+	desc      ocispec.Descriptor
+	retries   int
+	start     time.Time
+	ttfb      time.Duration
+	bytes     int64
+}
+
+func (stat *transferStat) log(err error) {
+	stat.once.Do(func() {
+		elapsed := time.Since(stat.start)
+		throughput := uint64(0)
+		if elapsed > 0 {
+			throughput = uint64(float64(stat.bytes) / elapsed.Seconds())
+		}
+		entry := stat.logger.WithFields(logrus.Fields{
+			"ttfb":       stat.ttfb,
+			"elapsed":    elapsed,
+			"throughput": humanize.IBytes(throughput) + "/s",
+			"retries":    stat.retries,
+		})
+		if err != nil {
+			entry.Debugf("failed to %s layer %s, size %d, transferred %d: %s", stat.direction, stat.desc.Digest, stat.desc.Size, stat.bytes, err)
+			return
+		}
+		entry.Debugf("%sed layer %s, size %d", stat.direction, stat.desc.Digest, stat.bytes)
+	})
+}
+
+type timingReader struct {
+	io.ReadCloser
+	stat *transferStat
+	err  error
+}
+
+func (reader *timingReader) Read(p []byte) (int, error) {
+	n, err := reader.ReadCloser.Read(p)
+	reader.stat.bytes += int64(n)
+	if err != nil && err != io.EOF {
+		reader.err = err
+	}
+	return n, err
+}
+
+func (reader *timingReader) Close() error {
+	defer reader.stat.log(reader.err)
+	return reader.ReadCloser.Close()
+}
+
+type timingWriter struct {
+	content.Writer
+	stat *transferStat
+}
+
+func (writer *timingWriter) Write(p []byte) (int, error) {
+	n, err := writer.Writer.Write(p)
+	writer.stat.bytes += int64(n)
+	return n, err
+}
+
+func (writer *timingWriter) Commit(ctx context.Context, size int64, expected digest.Digest, opts ...content.Opt) error {
+	err := writer.Writer.Commit(ctx, size, expected, opts...)
+	writer.stat.log(err)
+	return err
+}
+
+func (writer *timingWriter) Close() error {
+	defer writer.stat.log(errUncommitted)
+	return writer.Writer.Close()
+}
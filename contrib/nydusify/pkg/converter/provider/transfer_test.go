@@ -0,0 +1,82 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/stretchr/testify/require"
+)
+
+// zeroReader reads the endless zeros.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for idx := range p {
+		p[idx] = 0
+	}
+	return len(p), nil
+}
+
+// discardWriter discards the written content.
+type discardWriter struct {
+	content.Writer
+}
+
+func (discardWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func TestLargeLayerQuota(t *testing.T) {
+	// The quota of layers larger than 4GB is accounted without streaming,
+	// see TestLargeLayerAccounting for the streaming.
+	const size = int64(5<<30 + 512)
+	quota := newDiskQuota(2*size, nil)
+	require.NoError(t, quota.reserve(context.Background(), "large", size))
+	remaining := size
+	for _, n := range []int64{3 << 30, 2 << 30, 512} {
+		var err error
+		remaining, err = quota.write(n, remaining)
+		require.NoError(t, err)
+	}
+	require.Zero(t, remaining)
+	require.Equal(t, size, quota.usage)
+	require.Equal(t, size, quota.peak)
+	require.Zero(t, quota.reserved)
+
+	// Writing beyond the limit fails.
+	_, err := quota.write(size+1, 0)
+	require.Error(t, err)
+}
+
+func TestLargeLayerAccounting(t *testing.T) {
+	// Streaming the layer larger than 4GB is too slow for the tests of CI
+	// running with race detector, it's run only with the environment
+	// variable set, e.g. by `make test-large`.
+	if testing.Short() || os.Getenv("NYDUSIFY_TEST_LARGE_LAYER") == "" {
+		t.Skip("skip streaming the layer larger than 4GB without NYDUSIFY_TEST_LARGE_LAYER")
+	}
+
+	// The layer size overflows the 32-bit integers.
+	const size = int64(4<<30 + 512)
+	quota := newDiskQuota(2*size, nil)
+	require.NoError(t, quota.reserve(context.Background(), "large", size))
+	writer := &diskQuotaWriter{Writer: discardWriter{}, quota: quota, remaining: size}
+	stat := &transferStat{direction: "pull"}
+	reader := &timingReader{ReadCloser: io.NopCloser(io.LimitReader(zeroReader{}, size)), stat: stat}
+
+	written, err := io.CopyBuffer(writer, reader, make([]byte, 1<<20))
+	require.NoError(t, err)
+	require.Equal(t, size, written)
+	require.Equal(t, size, stat.bytes)
+	require.Equal(t, size, quota.usage)
+	require.Equal(t, size, quota.peak)
+	require.Zero(t, quota.reserved)
+	require.Zero(t, writer.remaining)
+}
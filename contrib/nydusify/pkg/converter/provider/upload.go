@@ -0,0 +1,95 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"sync"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/remotes"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// SetUploadLimit bounds the total concurrent blob uploads of all the
+// conversions sharing session to limit, so that a conversion can't starve
+// the uplink of node. The manifests and indexes aren't limited, as they're
+// small and pushed after their blobs. It must be called before the session
+// is shared, 0 means no limit.
+func (session *Session) SetUploadLimit(limit int) {
+	if limit <= 0 {
+		session.uploads = nil
+		return
+	}
+	session.uploads = make(chan struct{}, limit)
+}
+
+func (pvd *Provider) uploadResolver(resolver remotes.Resolver) remotes.Resolver {
+	if pvd.session == nil || pvd.session.uploads == nil {
+		return resolver
+	}
+	return &uploadResolver{Resolver: resolver, uploads: pvd.session.uploads}
+}
+
+// uploadResolver holds a slot of session uploads for each blob from
+// pushing until its writer is committed or closed.
+type uploadResolver struct {
+	remotes.Resolver
+	uploads chan struct{}
+}
+
+func (resolver *uploadResolver) Pusher(ctx context.Context, ref string) (remotes.Pusher, error) {
+	pusher, err := resolver.Resolver.Pusher(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	return &uploadPusher{Pusher: pusher, uploads: resolver.uploads}, nil
+}
+
+type uploadPusher struct {
+	remotes.Pusher
+	uploads chan struct{}
+}
+
+func (pusher *uploadPusher) Push(ctx context.Context, desc ocispec.Descriptor) (content.Writer, error) {
+	if images.IsManifestType(desc.MediaType) || images.IsIndexType(desc.MediaType) {
+		return pusher.Pusher.Push(ctx, desc)
+	}
+	select {
+	case pusher.uploads <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	writer, err := pusher.Pusher.Push(ctx, desc)
+	if err != nil {
+		<-pusher.uploads
+		return nil, err
+	}
+	return &uploadWriter{Writer: writer, uploads: pusher.uploads}, nil
+}
+
+type uploadWriter struct {
+	content.Writer
+	once    sync.Once
+	uploads chan struct{}
+}
+
+func (writer *uploadWriter) release() {
+	writer.once.Do(func() {
+		<-writer.uploads
+	})
+}
+
+func (writer *uploadWriter) Commit(ctx context.Context, size int64, expected digest.Digest, opts ...content.Opt) error {
+	defer writer.release()
+	return writer.Writer.Commit(ctx, size, expected, opts...)
+}
+
+func (writer *uploadWriter) Close() error {
+	defer writer.release()
+	return writer.Writer.Close()
+}
@@ -0,0 +1,72 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+func TestSessionUploadLimit(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	registry := newPushableRegistry(t)
+	session := NewSession()
+	session.SetUploadLimit(1)
+
+	// The images of conversions have different blobs, so that each blob is
+	// uploaded.
+	writeImage := func(pvd *Provider, name string) ocispec.Descriptor {
+		config, err := writeJSON(ctx, pvd.store, ocispec.Image{Platform: ocispec.Platform{OS: "linux", Architecture: name}}, ocispec.MediaTypeImageConfig)
+		require.NoError(t, err)
+		var layers []ocispec.Descriptor
+		for idx := 0; idx < 4; idx++ {
+			layer, err := writeJSON(ctx, pvd.store, map[string]string{name: strings.Repeat(strconv.Itoa(idx), 1<<20)}, utils.MediaTypeNydusBlob)
+			require.NoError(t, err)
+			layers = append(layers, *layer)
+		}
+		manifest, err := writeJSON(ctx, pvd.store, ocispec.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: ocispec.MediaTypeImageManifest,
+			Config:    *config,
+			Layers:    layers,
+		}, ocispec.MediaTypeImageManifest)
+		require.NoError(t, err)
+		return *manifest
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for idx, name := range []string{"first", "second"} {
+		pvd := newPlatformProvider(t, platforms.All, "", "")
+		pvd.SetSession(session)
+		desc := writeImage(pvd, name)
+		wg.Add(1)
+		go func(idx int, name string) {
+			defer wg.Done()
+			errs[idx] = pvd.Push(ctx, desc, registry.host+"/library/"+name+":nydus")
+		}(idx, name)
+	}
+	wg.Wait()
+	require.NoError(t, errs[0])
+	require.NoError(t, errs[1])
+
+	// The blobs of both conversions are uploaded one by one.
+	require.Equal(t, 1, registry.MaxUploads())
+	for _, name := range []string{"first", "second"} {
+		_, _, ok := registry.Tag("library/"+name, "nydus")
+		require.True(t, ok)
+	}
+}
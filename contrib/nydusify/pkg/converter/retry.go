@@ -0,0 +1,52 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/containerd/log"
+	"github.com/pkg/errors"
+)
+
+// buildRetryInterval is the interval before the first build retry, it's
+// doubled after each failure.
+var buildRetryInterval = time.Second
+
+// isTransientBuildError checks if the builder failed regardless of its
+// input, i.e. it's killed by a signal, e.g. by the OOM killer under memory
+// pressure, or it can't be started for the lack of resources. The builder
+// exiting with a failure status rejects the input, which fails again on
+// retry.
+func isTransientBuildError(err error) bool {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		status, ok := exitErr.Sys().(syscall.WaitStatus)
+		return ok && status.Signaled()
+	}
+	return errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.ENOMEM) || errors.Is(err, syscall.ETXTBSY)
+}
+
+// buildWithRetries calls build, and calls it again up to retries times with
+// backoff if the builder fails transiently, see isTransientBuildError.
+func buildWithRetries(ctx context.Context, retries int, build func() error) error {
+	interval := buildRetryInterval
+	for attempt := 0; ; attempt++ {
+		err := build()
+		if err == nil || attempt >= retries || !isTransientBuildError(err) {
+			return err
+		}
+		log.G(ctx).WithError(err).Warnf("builder failed transiently, retry (remain %d times)", retries-attempt)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+		interval *= 2
+	}
+}
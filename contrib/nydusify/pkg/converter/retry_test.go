@@ -0,0 +1,68 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// writeStubBuilder writes a builder script running script, the file
+// `failed` next to it marks a previous failure.
+func writeStubBuilder(t *testing.T, script string) string {
+	path := filepath.Join(t.TempDir(), "nydus-image")
+	require.NoError(t, os.WriteFile(path, []byte("#!/bin/sh\ncd \"$(dirname \"$0\")\"\n"+script), 0755))
+	return path
+}
+
+func TestBuildWithRetries(t *testing.T) {
+	interval := buildRetryInterval
+	buildRetryInterval = time.Millisecond
+	defer func() {
+		buildRetryInterval = interval
+	}()
+
+	run := func(builder string, retries int) (int, error) {
+		attempts := 0
+		err := buildWithRetries(context.Background(), retries, func() error {
+			attempts++
+			return errors.Wrap(exec.Command(builder).Run(), "convert blob")
+		})
+		return attempts, err
+	}
+
+	// The builder killed at the first run succeeds on retry.
+	killedOnce := writeStubBuilder(t, "if [ ! -e failed ]; then touch failed; kill -9 $$; fi\n")
+	attempts, err := run(killedOnce, 2)
+	require.NoError(t, err)
+	require.Equal(t, 2, attempts)
+
+	// It's not retried without retries.
+	killedOnce = writeStubBuilder(t, "if [ ! -e failed ]; then touch failed; kill -9 $$; fi\n")
+	attempts, err = run(killedOnce, 0)
+	require.Error(t, err)
+	require.True(t, isTransientBuildError(err))
+	require.Equal(t, 1, attempts)
+
+	// The builder rejecting the input isn't retried.
+	rejecting := writeStubBuilder(t, "echo 'invalid tar header' >&2\nexit 1\n")
+	attempts, err = run(rejecting, 2)
+	require.Error(t, err)
+	require.False(t, isTransientBuildError(err))
+	require.Equal(t, 1, attempts)
+
+	// The builder killed every time fails after the retries.
+	killed := writeStubBuilder(t, "kill -9 $$\n")
+	attempts, err = run(killed, 2)
+	require.Error(t, err)
+	require.Equal(t, 3, attempts)
+}
@@ -0,0 +1,51 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/images"
+	humanize "github.com/dustin/go-humanize"
+)
+
+// conversionWarnings collects the issues of a successful conversion which
+// operators may need to act on.
+func conversionWarnings(opt Opt, target *ImageOutput) []string {
+	var warnings []string
+	for _, manifest := range target.Manifests {
+		for _, layer := range manifest.Layers {
+			if images.IsNonDistributable(layer.MediaType) {
+				warnings = append(warnings, fmt.Sprintf(
+					"foreign layer %s is kept in target manifest %s with its URLs, it isn't built into the nydus filesystem",
+					layer.Digest, manifest.Digest,
+				))
+			}
+		}
+	}
+	if opt.FsVersion == "5" {
+		warnings = append(warnings, "RAFS v5 is deprecated, convert with --fs-version 6 instead")
+	}
+	return warnings
+}
+
+// summarize formats the output into a single line printed on exit.
+func summarize(output *Output) string {
+	parts := []string{
+		fmt.Sprintf("converted %s to %s@%s", output.Source.Reference, output.Target.Reference, output.Target.Digest),
+		fmt.Sprintf("elapsed %s", (time.Duration(output.Elapsed.Total) * time.Millisecond).String()),
+		fmt.Sprintf("pushed %s", humanize.IBytes(uint64(output.PushedBytes))),
+	}
+	if output.Cache != nil && output.Cache.Total > 0 {
+		parts = append(parts, fmt.Sprintf(
+			"cache hit %d/%d (%.0f%%)", output.Cache.Cached, output.Cache.Total,
+			float64(output.Cache.Cached)*100/float64(output.Cache.Total),
+		))
+	}
+	parts = append(parts, fmt.Sprintf("%d warning(s)", len(output.Warnings)))
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,55 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"testing"
+
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSummaryForeignLayer(t *testing.T) {
+	store, err := local.NewStore(t.TempDir())
+	require.NoError(t, err)
+
+	foreign := digest.FromString("foreign")
+	config := writeJSONBlob(t, store, ocispec.MediaTypeImageConfig, ocispec.Image{})
+	manifest := writeJSONBlob(t, store, images.MediaTypeDockerSchema2Manifest, ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: images.MediaTypeDockerSchema2Manifest,
+		Config:    config,
+		Layers: []ocispec.Descriptor{
+			{MediaType: images.MediaTypeDockerSchema2LayerForeignGzip, Digest: foreign, Size: 1000},
+			{MediaType: images.MediaTypeDockerSchema2LayerGzip, Digest: digest.FromString("layer"), Size: 100},
+		},
+	})
+	source, err := imageOutput(context.Background(), store, "docker.io/library/windows:latest", manifest)
+	require.NoError(t, err)
+
+	// The foreign layer is kept in target manifest.
+	warnings := conversionWarnings(Opt{FsVersion: "5"}, source)
+	require.Len(t, warnings, 2)
+	require.Contains(t, warnings[0], "foreign layer "+foreign.String())
+	require.Contains(t, warnings[1], "RAFS v5 is deprecated")
+	require.Empty(t, conversionWarnings(Opt{FsVersion: "6"}, &ImageOutput{}))
+
+	target := digest.FromString("target").String()
+	summary := summarize(&Output{
+		Source:      *source,
+		Target:      ImageOutput{Reference: "docker.io/library/windows:nydus", Digest: target},
+		Cache:       &CacheOutput{Cached: 1, Total: 4},
+		PushedBytes: 2048,
+		Elapsed:     ElapsedOutput{Total: 1500},
+		Warnings:    warnings,
+	})
+	require.Equal(t, "converted docker.io/library/windows:latest to docker.io/library/windows:nydus@"+target+
+		", elapsed 1.5s, pushed 2.0 KiB, cache hit 1/4 (25%), 2 warning(s)", summary)
+}
@@ -0,0 +1,268 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package doctor
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/backend"
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/provider"
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+var versionRegexp = regexp.MustCompile(`v?(\d+)\.(\d+)\.(\d+)`)
+
+// builderCheck checks the nydus-image binary is present and not
+// older than the minimal required version.
+type builderCheck struct {
+	path       string
+	minVersion string
+}
+
+func (check *builderCheck) Name() string {
+	return "builder"
+}
+
+func (check *builderCheck) Run(_ context.Context) (string, error) {
+	path, err := exec.LookPath(check.path)
+	if err != nil {
+		return "", errors.Wrapf(err, "find builder binary %s", check.path)
+	}
+
+	output, err := exec.Command(path, "--version").CombinedOutput()
+	if err != nil {
+		return "", errors.Wrapf(err, "get builder version: %s", strings.TrimSpace(string(output)))
+	}
+	version, err := parseBuilderVersion(string(output))
+	if err != nil {
+		return "", err
+	}
+
+	if check.minVersion != "" {
+		minVersion := versionRegexp.FindStringSubmatch(check.minVersion)
+		if minVersion == nil {
+			return "", errors.Errorf("invalid minimal builder version %s", check.minVersion)
+		}
+		if compareVersion(versionRegexp.FindStringSubmatch(version), minVersion) < 0 {
+			return "", errors.Errorf("builder version %s is older than required %s", version, check.minVersion)
+		}
+	}
+
+	return fmt.Sprintf("%s %s", path, version), nil
+}
+
+// parseBuilderVersion parses the version from `nydus-image --version`
+// output, which looks like:
+//
+//	Version:     v2.2.0
+//	Git Commit:  ...
+func parseBuilderVersion(output string) (string, error) {
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "Version:") {
+			continue
+		}
+		version := strings.TrimSpace(strings.TrimPrefix(line, "Version:"))
+		if versionRegexp.MatchString(version) {
+			return version, nil
+		}
+	}
+	return "", errors.Errorf("unrecognized builder version output: %s", strings.TrimSpace(output))
+}
+
+func compareVersion(a, b []string) int {
+	for idx := 1; idx < len(a) && idx < len(b); idx++ {
+		x, _ := strconv.Atoi(a[idx])
+		y, _ := strconv.Atoi(b[idx])
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// xzCheck checks the xz binary decompressing the legacy xz source layers is
+// present, see utils.DecompressLayer.
+type xzCheck struct {
+	path string
+}
+
+func (check *xzCheck) Name() string {
+	return "xz"
+}
+
+func (check *xzCheck) Run(_ context.Context) (string, error) {
+	path, err := exec.LookPath(check.path)
+	if err != nil {
+		return "", errors.Wrapf(err, "find %s binary to decompress xz source layers", check.path)
+	}
+	return path, nil
+}
+
+// workDirCheck checks the work directory is writable, the work directory
+// not existing is created by conversion, so its nearest existing parent is
+// checked instead of creating it.
+type workDirCheck struct {
+	workDir string
+}
+
+func (check *workDirCheck) Name() string {
+	return "work-dir"
+}
+
+func (check *workDirCheck) Run(_ context.Context) (string, error) {
+	workDir := check.workDir
+	if workDir == "" {
+		workDir = os.TempDir()
+	}
+	dir, err := existingDir(workDir)
+	if err != nil {
+		return "", errors.Wrapf(err, "check work directory %s", workDir)
+	}
+	if err := isWritableDir(dir); err != nil {
+		return "", errors.Wrapf(err, "write work directory %s", dir)
+	}
+	if dir != filepath.Clean(workDir) {
+		return fmt.Sprintf("%s can be created in writable %s", workDir, dir), nil
+	}
+	return fmt.Sprintf("%s is writable", workDir), nil
+}
+
+// existingDir returns path or its nearest existing parent directory.
+func existingDir(path string) (string, error) {
+	path = filepath.Clean(path)
+	for {
+		info, err := os.Stat(path)
+		if err == nil {
+			if !info.IsDir() {
+				return "", errors.Errorf("%s is not a directory", path)
+			}
+			return path, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return "", err
+		}
+		path = parent
+	}
+}
+
+// backendCheck checks the storage backend is reachable and writable by
+// uploading a small probe blob, which is random to never overwrite the
+// existing blobs, and is removed after the check.
+type backendCheck struct {
+	backendType   string
+	backendConfig string
+}
+
+func (check *backendCheck) Name() string {
+	return "backend"
+}
+
+func (check *backendCheck) Run(ctx context.Context) (string, error) {
+	if check.backendType == "" || check.backendType == "registry" {
+		return "", ErrSkipped{Reason: "blobs will be pushed to registry, see registry check"}
+	}
+
+	blobBackend, err := backend.NewBackend(check.backendType, []byte(check.backendConfig), nil)
+	if err != nil {
+		return "", errors.Wrap(err, "create storage backend")
+	}
+
+	probe := []byte(fmt.Sprintf("nydusify doctor probe %d", time.Now().UnixNano()))
+	blobID := digest.FromBytes(probe).Hex()
+	file, err := os.CreateTemp("", "nydusify-doctor-probe-")
+	if err != nil {
+		return "", errors.Wrap(err, "create probe blob")
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(probe); err != nil {
+		file.Close()
+		return "", errors.Wrap(err, "write probe blob")
+	}
+	if err := file.Close(); err != nil {
+		return "", errors.Wrap(err, "close probe blob")
+	}
+
+	if _, err := blobBackend.Upload(ctx, blobID, file.Name(), int64(len(probe)), true); err != nil {
+		_ = blobBackend.Finalize(true)
+		return "", errors.Wrap(err, "upload probe blob to storage backend")
+	}
+	if err := blobBackend.Finalize(false); err != nil {
+		return "", errors.Wrap(err, "finalize storage backend")
+	}
+	exist, err := blobBackend.Check(blobID)
+	if err != nil {
+		return "", errors.Wrap(err, "check probe blob in storage backend")
+	}
+	if !exist {
+		return "", errors.Errorf("probe blob %s not found in storage backend after upload", blobID)
+	}
+
+	remover, ok := blobBackend.(backend.Remover)
+	if !ok {
+		return fmt.Sprintf("%s backend is writable, probe blob %s is left as it can't be removed", check.backendType, blobID), nil
+	}
+	if err := remover.Remove(blobID); err != nil {
+		return "", errors.Wrapf(err, "remove probe blob %s from storage backend", blobID)
+	}
+
+	return fmt.Sprintf("%s backend is writable", check.backendType), nil
+}
+
+// registryCheck checks the target registry is reachable, the credential is
+// accepted and permitted to push, a not found target image is expected.
+type registryCheck struct {
+	target   string
+	insecure bool
+}
+
+func (check *registryCheck) Name() string {
+	return "registry"
+}
+
+func (check *registryCheck) Run(ctx context.Context) (string, error) {
+	if check.target == "" {
+		return "", ErrSkipped{Reason: "no target image reference specified"}
+	}
+
+	remote, err := provider.DefaultRemote(check.target, check.insecure)
+	if err != nil {
+		return "", errors.Wrap(err, "create remote")
+	}
+
+	_, err = remote.Resolve(ctx)
+	if utils.RetryWithHTTP(err) {
+		remote.MaybeWithHTTP(err)
+		_, err = remote.Resolve(ctx)
+	}
+	if err != nil && !errdefs.IsNotFound(err) {
+		return "", errors.Wrapf(err, "access target %s", check.target)
+	}
+
+	if err := remote.CheckPush(ctx); err != nil {
+		return "", errors.Wrapf(err, "no permission to push to %s", check.target)
+	}
+
+	return fmt.Sprintf("%s is accessible and pushable", check.target), nil
+}
@@ -0,0 +1,143 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package doctor validates the toolchain and environment required by
+// image conversion, without performing a real conversion.
+package doctor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+// Opt defines Doctor options.
+type Opt struct {
+	WorkDir           string
+	NydusImagePath    string
+	MinBuilderVersion string
+
+	Target         string
+	TargetInsecure bool
+
+	BackendType   string
+	BackendConfig string
+}
+
+// Check is an item validated by Doctor, Run returns a message describing
+// the validated state, or an error if the check is failed.
+type Check interface {
+	Name() string
+	Run(ctx context.Context) (string, error)
+}
+
+// Result is the outcome of a check.
+type Result struct {
+	Name    string `json:"name"`
+	Passed  bool   `json:"passed"`
+	Skipped bool   `json:"skipped,omitempty"`
+	Message string `json:"message"`
+}
+
+// ErrSkipped is returned by Check.Run if the check isn't applicable
+// with current options.
+type ErrSkipped struct {
+	Reason string
+}
+
+func (e ErrSkipped) Error() string {
+	return e.Reason
+}
+
+// Doctor runs a series of checks against the environment.
+type Doctor struct {
+	Opt
+	checks []Check
+}
+
+// New creates Doctor instance with the default checks.
+func New(opt Opt) *Doctor {
+	return &Doctor{
+		Opt: opt,
+		checks: []Check{
+			&builderCheck{path: opt.NydusImagePath, minVersion: opt.MinBuilderVersion},
+			&xzCheck{path: utils.XzBinary},
+			&workDirCheck{workDir: opt.WorkDir},
+			&backendCheck{backendType: opt.BackendType, backendConfig: opt.BackendConfig},
+			&registryCheck{target: opt.Target, insecure: opt.TargetInsecure},
+		},
+	}
+}
+
+// Run runs all checks in order, a failed check doesn't stop the
+// following checks.
+func (doctor *Doctor) Run(ctx context.Context) []Result {
+	results := make([]Result, 0, len(doctor.checks))
+	for _, check := range doctor.checks {
+		logrus.Debugf("Running check %s", check.Name())
+		result := Result{Name: check.Name()}
+		msg, err := check.Run(ctx)
+		if err != nil {
+			if skipped, ok := err.(ErrSkipped); ok {
+				result.Passed = true
+				result.Skipped = true
+				result.Message = skipped.Reason
+			} else {
+				result.Message = err.Error()
+			}
+		} else {
+			result.Passed = true
+			result.Message = msg
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// Passed returns true if all checks are passed.
+func Passed(results []Result) bool {
+	for _, result := range results {
+		if !result.Passed {
+			return false
+		}
+	}
+	return true
+}
+
+// Report writes check results as a table.
+func Report(w io.Writer, results []Result) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHECK\tSTATUS\tMESSAGE")
+	for _, result := range results {
+		status := "PASS"
+		if result.Skipped {
+			status = "SKIP"
+		} else if !result.Passed {
+			status = "FAIL"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", result.Name, status, strings.ReplaceAll(result.Message, "\n", " "))
+	}
+	return tw.Flush()
+}
+
+func isWritableDir(dir string) error {
+	file, err := os.CreateTemp(dir, ".nydusify-doctor-")
+	if err != nil {
+		return err
+	}
+	name := file.Name()
+	defer os.Remove(name)
+	if _, err := file.WriteString("nydusify"); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
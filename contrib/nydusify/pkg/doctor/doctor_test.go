@@ -0,0 +1,242 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package doctor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeFakeBuilder(t *testing.T, version string) string {
+	path := filepath.Join(t.TempDir(), "nydus-image")
+	script := fmt.Sprintf("#!/bin/sh\nprintf 'Version: \\t%s\\nGit Commit: \\tabc\\n'\n", version)
+	require.NoError(t, os.WriteFile(path, []byte(script), 0755))
+	return path
+}
+
+// newFakeRegistry responds the blob upload requests with uploadStatus, and
+// the other requests with status.
+func newFakeRegistry(t *testing.T, status, uploadStatus int) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/blobs/uploads/") {
+			_, _ = io.Copy(io.Discard, r.Body)
+			if r.Method == http.MethodPost && uploadStatus == http.StatusAccepted {
+				w.Header().Set("Location", r.URL.Path+"session")
+			}
+			w.WriteHeader(uploadStatus)
+			return
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+// newFakeS3 mocks the path-style S3 API of bucket used by s3 backend, it
+// returns the objects stored.
+func newFakeS3(t *testing.T, bucket string) (string, map[string][]byte) {
+	var mutex sync.Mutex
+	objects := map[string][]byte{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		key := strings.TrimPrefix(r.URL.Path, "/"+bucket+"/")
+		switch r.Method {
+		case http.MethodPut:
+			data, err := io.ReadAll(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			objects[key] = data
+		case http.MethodHead:
+			if _, ok := objects[key]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+		case http.MethodDelete:
+			delete(objects, key)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://"), objects
+}
+
+func findResult(t *testing.T, results []Result, name string) Result {
+	for _, result := range results {
+		if result.Name == name {
+			return result
+		}
+	}
+	require.Fail(t, "result not found for check "+name)
+	return Result{}
+}
+
+func healthyOpt(t *testing.T) Opt {
+	// Only the fake xz is found in PATH.
+	binDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(binDir, "xz"), []byte("#!/bin/sh\n"), 0755))
+	t.Setenv("PATH", binDir)
+
+	return Opt{
+		WorkDir:           t.TempDir(),
+		NydusImagePath:    writeFakeBuilder(t, "v2.2.4"),
+		MinBuilderVersion: "v2.2.0",
+		Target:            newFakeRegistry(t, http.StatusNotFound, http.StatusAccepted) + "/nginx:latest-nydus",
+		TargetInsecure:    true,
+	}
+}
+
+func TestDoctorAllPassed(t *testing.T) {
+	results := New(healthyOpt(t)).Run(context.Background())
+	require.Len(t, results, 5)
+	require.True(t, Passed(results))
+
+	require.Contains(t, findResult(t, results, "builder").Message, "v2.2.4")
+	backend := findResult(t, results, "backend")
+	require.True(t, backend.Skipped)
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, Report(buf, results))
+	require.Contains(t, buf.String(), "SKIP")
+	require.NotContains(t, buf.String(), "FAIL")
+}
+
+func TestDoctorWithoutSideEffects(t *testing.T) {
+	opt := healthyOpt(t)
+	opt.WorkDir = filepath.Join(t.TempDir(), "not-exist", "work")
+	endpoint, objects := newFakeS3(t, "nydus")
+	opt.BackendType = "s3"
+	opt.BackendConfig = fmt.Sprintf(`{"endpoint": %q, "scheme": "http", "region": "us-east-1", "bucket_name": "nydus", "access_key_id": "id", "access_key_secret": "secret"}`, endpoint)
+
+	results := New(opt).Run(context.Background())
+	require.True(t, Passed(results), results)
+	require.Contains(t, findResult(t, results, "work-dir").Message, "can be created in writable")
+	require.Contains(t, findResult(t, results, "backend").Message, "s3 backend is writable")
+
+	// The work directory isn't created, and the probe blob is removed.
+	_, err := os.Stat(filepath.Dir(opt.WorkDir))
+	require.True(t, os.IsNotExist(err))
+	require.Empty(t, objects)
+}
+
+func TestDoctorFailures(t *testing.T) {
+	tests := []struct {
+		name    string
+		check   string
+		mutate  func(opt *Opt)
+		message string
+	}{
+		{
+			name:  "builder not found",
+			check: "builder",
+			mutate: func(opt *Opt) {
+				opt.NydusImagePath = filepath.Join(t.TempDir(), "not-exist")
+			},
+			message: "find builder binary",
+		},
+		{
+			name:  "builder too old",
+			check: "builder",
+			mutate: func(opt *Opt) {
+				opt.NydusImagePath = writeFakeBuilder(t, "v2.1.6")
+			},
+			message: "older than required v2.2.0",
+		},
+		{
+			name:  "work dir not writable",
+			check: "work-dir",
+			mutate: func(opt *Opt) {
+				file := filepath.Join(t.TempDir(), "file")
+				require.NoError(t, os.WriteFile(file, nil, 0644))
+				opt.WorkDir = filepath.Join(file, "work")
+			},
+			message: "not a directory",
+		},
+		{
+			name:  "backend invalid",
+			check: "backend",
+			mutate: func(opt *Opt) {
+				opt.BackendType = "oss"
+				opt.BackendConfig = "{}"
+			},
+			message: "create storage backend",
+		},
+		{
+			name:  "registry unauthorized",
+			check: "registry",
+			mutate: func(opt *Opt) {
+				opt.Target = newFakeRegistry(t, http.StatusUnauthorized, http.StatusUnauthorized) + "/nginx:latest-nydus"
+			},
+			message: "access target",
+		},
+		{
+			name:  "registry read only",
+			check: "registry",
+			mutate: func(opt *Opt) {
+				opt.Target = newFakeRegistry(t, http.StatusNotFound, http.StatusForbidden) + "/nginx:latest-nydus"
+			},
+			message: "no permission to push",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := healthyOpt(t)
+			tt.mutate(&opt)
+			results := New(opt).Run(context.Background())
+			require.False(t, Passed(results))
+			for _, result := range results {
+				if result.Name == tt.check {
+					require.False(t, result.Passed)
+					require.Contains(t, result.Message, tt.message)
+				} else {
+					require.True(t, result.Passed, result.Message)
+				}
+			}
+
+			buf := new(bytes.Buffer)
+			require.NoError(t, Report(buf, results))
+			require.Regexp(t, tt.check+` +FAIL`, buf.String())
+		})
+	}
+}
+
+func TestDoctorXzNotFound(t *testing.T) {
+	opt := healthyOpt(t)
+	t.Setenv("PATH", t.TempDir())
+
+	results := New(opt).Run(context.Background())
+	require.False(t, Passed(results))
+	xz := findResult(t, results, "xz")
+	require.False(t, xz.Passed)
+	require.Contains(t, xz.Message, "find xz binary to decompress xz source layers")
+	require.True(t, findResult(t, results, "builder").Passed)
+}
+
+func TestParseBuilderVersion(t *testing.T) {
+	version, err := parseBuilderVersion("\rVersion: \tv2.2.4\nGit Commit: \tabc\n")
+	require.NoError(t, err)
+	require.Equal(t, "v2.2.4", version)
+
+	_, err = parseBuilderVersion("unknown")
+	require.Error(t, err)
+
+	require.Equal(t, -1, compareVersion(versionRegexp.FindStringSubmatch("v2.1.9"), versionRegexp.FindStringSubmatch("2.2.0")))
+	require.Equal(t, 0, compareVersion(versionRegexp.FindStringSubmatch("v2.2.0-rc1"), versionRegexp.FindStringSubmatch("v2.2.0")))
+	require.Equal(t, 1, compareVersion(versionRegexp.FindStringSubmatch("v10.0.0"), versionRegexp.FindStringSubmatch("v9.9.9")))
+}
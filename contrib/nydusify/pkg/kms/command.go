@@ -0,0 +1,53 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package kms
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// commandKMS accesses KMS by an external command, e.g. a script calling the
+// CLI of cloud KMS, it's invoked as `<path> [args...] encrypt|decrypt <key-id>`
+// with the plaintext or ciphertext in stdin, and outputs the result to stdout.
+type commandKMS struct {
+	path string
+	args []string
+}
+
+// NewCommandKMS returns the KMS accessed by command, which is the path of
+// executable followed by the arguments separated by spaces.
+func NewCommandKMS(command string) (KMS, error) {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return nil, errors.New("empty KMS command")
+	}
+	return &commandKMS{path: fields[0], args: fields[1:]}, nil
+}
+
+func (kms *commandKMS) run(ctx context.Context, op, keyID string, input []byte) ([]byte, error) {
+	args := append(append([]string{}, kms.args...), op, keyID)
+	cmd := exec.CommandContext(ctx, kms.path, args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, errors.Wrapf(err, "run KMS command %s %s: %s", kms.path, op, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+func (kms *commandKMS) Encrypt(ctx context.Context, keyID string, plaintext []byte) ([]byte, error) {
+	return kms.run(ctx, "encrypt", keyID, plaintext)
+}
+
+func (kms *commandKMS) Decrypt(ctx context.Context, keyID string, ciphertext []byte) ([]byte, error) {
+	return kms.run(ctx, "decrypt", keyID, ciphertext)
+}
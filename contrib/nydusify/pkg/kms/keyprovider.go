@@ -0,0 +1,51 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package kms
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/containers/ocicrypt/keywrap/keyprovider"
+	"github.com/pkg/errors"
+)
+
+// ServeKeyProvider serves a request of the ocicrypt key provider protocol
+// from in, and writes the response to out. It's the key provider command
+// configured by OCICRYPT_KEYPROVIDER_CONFIG for the runtimes, e.g.
+// `{"key-providers": {"kms": {"cmd": {"path": "nydusify", "args": ["keyprovider", "--kms-command", "..."]}}}}`,
+// which unwraps the data keys wrapped by kms for key provider name.
+func ServeKeyProvider(ctx context.Context, name string, kms KMS, in io.Reader, out io.Writer) error {
+	var input keyprovider.KeyProviderKeyWrapProtocolInput
+	if err := json.NewDecoder(in).Decode(&input); err != nil {
+		return errors.Wrap(err, "decode key provider request")
+	}
+
+	kw := NewKeyWrapper(ctx, name, kms)
+	var output keyprovider.KeyProviderKeyWrapProtocolOutput
+	switch input.Operation {
+	case keyprovider.OpKeyWrap:
+		if input.KeyWrapParams.Ec == nil {
+			return fmt.Errorf("no encrypt config in key provider request")
+		}
+		annotation, err := kw.WrapKeys(input.KeyWrapParams.Ec, input.KeyWrapParams.OptsData)
+		if err != nil {
+			return err
+		}
+		output.KeyWrapResults.Annotation = annotation
+	case keyprovider.OpKeyUnwrap:
+		optsData, err := kw.UnwrapKey(input.KeyUnwrapParams.Dc, input.KeyUnwrapParams.Annotation)
+		if err != nil {
+			return err
+		}
+		output.KeyUnwrapResults.OptsData = optsData
+	default:
+		return fmt.Errorf("unsupported key provider operation %q", input.Operation)
+	}
+
+	return errors.Wrap(json.NewEncoder(out).Encode(output), "encode key provider response")
+}
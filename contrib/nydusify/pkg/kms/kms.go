@@ -0,0 +1,116 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package kms integrates the key management services with the ocicrypt
+// encryption of nydus bootstrap layers. The data key of a layer is wrapped by
+// the master key in KMS for the `provider:<name>:<key-id>` recipients, and
+// the wrapped key is stored in the `org.opencontainers.image.enc.keys.provider.<name>`
+// annotation of layer like the ocicrypt key providers. The runtimes decrypt
+// the layers by the key provider command serving the ocicrypt key provider
+// protocol, see ServeKeyProvider.
+package kms
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/containers/ocicrypt"
+	"github.com/containers/ocicrypt/config"
+	"github.com/containers/ocicrypt/keywrap"
+	"github.com/pkg/errors"
+)
+
+// ProviderName is the key provider name of the KMS configured by nydusify
+// command line, its recipients are like `provider:kms:<key-id>`.
+const ProviderName = "kms"
+
+// KMS encrypts and decrypts the data keys by the master key keyID, which
+// never leaves the key management service.
+type KMS interface {
+	Encrypt(ctx context.Context, keyID string, plaintext []byte) ([]byte, error)
+	Decrypt(ctx context.Context, keyID string, ciphertext []byte) ([]byte, error)
+}
+
+// wrappedKey is the data key wrapped by the master key KeyID.
+type wrappedKey struct {
+	KeyID      string `json:"key_id"`
+	WrappedKey []byte `json:"wrapped_key"`
+}
+
+// Register registers kms as the ocicrypt key provider of name for the
+// encryption and decryption in process, KMS is accessed with ctx.
+func Register(ctx context.Context, name string, kms KMS) {
+	ocicrypt.RegisterKeyWrapper("provider."+name, NewKeyWrapper(ctx, name, kms))
+}
+
+type keyWrapper struct {
+	// ctx is kept for accessing KMS, the ocicrypt key wrapper interface
+	// doesn't pass the context.
+	ctx  context.Context
+	name string
+	kms  KMS
+}
+
+// NewKeyWrapper returns the ocicrypt key wrapper of key provider name, which
+// wraps the data keys by kms with ctx.
+func NewKeyWrapper(ctx context.Context, name string, kms KMS) keywrap.KeyWrapper {
+	return &keyWrapper{ctx: ctx, name: name, kms: kms}
+}
+
+func (kw *keyWrapper) GetAnnotationID() string {
+	return "org.opencontainers.image.enc.keys.provider." + kw.name
+}
+
+// WrapKeys wraps the data key in optsData by the master keys of recipients,
+// nothing is wrapped without the recipients of key provider.
+func (kw *keyWrapper) WrapKeys(ec *config.EncryptConfig, optsData []byte) ([]byte, error) {
+	var keys []wrappedKey
+	for _, param := range ec.Parameters[kw.name] {
+		keyID := string(param)
+		wrapped, err := kw.kms.Encrypt(kw.ctx, keyID, optsData)
+		if err != nil {
+			return nil, errors.Wrapf(err, "wrap key by KMS key %s", keyID)
+		}
+		keys = append(keys, wrappedKey{KeyID: keyID, WrappedKey: wrapped})
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(keys)
+}
+
+// UnwrapKey unwraps the data key by the first master key accessible in KMS.
+func (kw *keyWrapper) UnwrapKey(_ *config.DecryptConfig, annotation []byte) ([]byte, error) {
+	var keys []wrappedKey
+	if err := json.Unmarshal(annotation, &keys); err != nil {
+		return nil, errors.Wrap(err, "parse wrapped keys")
+	}
+	var lastErr error = errors.New("no wrapped key")
+	for _, key := range keys {
+		optsData, err := kw.kms.Decrypt(kw.ctx, key.KeyID, key.WrappedKey)
+		if err != nil {
+			lastErr = errors.Wrapf(err, "unwrap key by KMS key %s", key.KeyID)
+			continue
+		}
+		return optsData, nil
+	}
+	return nil, lastErr
+}
+
+func (kw *keyWrapper) NoPossibleKeys(dcparameters map[string][][]byte) bool {
+	return len(dcparameters[kw.name]) == 0
+}
+
+// GetPrivateKeys returns nil, the master keys aren't exportable from KMS.
+func (kw *keyWrapper) GetPrivateKeys(_ map[string][][]byte) [][]byte {
+	return nil
+}
+
+func (kw *keyWrapper) GetKeyIdsFromPacket(_ string) ([]uint64, error) {
+	return nil, nil
+}
+
+func (kw *keyWrapper) GetRecipients(_ string) ([]string, error) {
+	return []string{"[" + kw.name + "]"}, nil
+}
@@ -0,0 +1,214 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package kms
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/ocicrypt"
+	enchelpers "github.com/containers/ocicrypt/helpers"
+	"github.com/containers/ocicrypt/keywrap/keyprovider"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// mockKMS wraps the data keys by AES-GCM with the master keys in memory.
+type mockKMS struct {
+	keys map[string][]byte
+}
+
+func (kms *mockKMS) aead(keyID string) (cipher.AEAD, error) {
+	key, ok := kms.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("key %s not found", keyID)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (kms *mockKMS) Encrypt(_ context.Context, keyID string, plaintext []byte) ([]byte, error) {
+	aead, err := kms.aead(keyID)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func (kms *mockKMS) Decrypt(_ context.Context, keyID string, ciphertext []byte) ([]byte, error) {
+	aead, err := kms.aead(keyID)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, fmt.Errorf("invalid ciphertext")
+	}
+	return aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], nil)
+}
+
+// encryptDecrypt encrypts data for the recipients and decrypts it with the
+// decryption keys, returns the annotations of encrypted layer.
+func encryptDecrypt(t *testing.T, data []byte, recipients, keys []string) (map[string]string, []byte, error) {
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+	cc, err := enchelpers.CreateCryptoConfig(recipients, nil)
+	require.NoError(t, err)
+	reader, finalizer, err := ocicrypt.EncryptLayer(cc.EncryptConfig, bytes.NewReader(data), desc)
+	require.NoError(t, err)
+	encrypted, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	annotations, err := finalizer()
+	require.NoError(t, err)
+
+	cc, err = enchelpers.CreateCryptoConfig(nil, keys)
+	require.NoError(t, err)
+	desc.Annotations = annotations
+	reader, _, err = ocicrypt.DecryptLayer(cc.DecryptConfig, bytes.NewReader(encrypted), desc, false)
+	if err != nil {
+		return annotations, nil, err
+	}
+	decrypted, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	return annotations, decrypted, nil
+}
+
+func TestKMSKeyWrapper(t *testing.T) {
+	masterKey := make([]byte, 32)
+	_, err := rand.Read(masterKey)
+	require.NoError(t, err)
+	kms := &mockKMS{keys: map[string][]byte{"key-1": masterKey}}
+	Register(context.Background(), "mock", kms)
+
+	data := []byte("nydus bootstrap")
+	annotations, decrypted, err := encryptDecrypt(t, data, []string{"provider:mock:key-1"}, []string{"provider:mock"})
+	require.NoError(t, err)
+	require.Equal(t, data, decrypted)
+
+	// The data key wrapped by KMS is stored in the layer annotation of key
+	// provider, and round-trips by KMS.
+	annotation, err := base64.StdEncoding.DecodeString(annotations["org.opencontainers.image.enc.keys.provider.mock"])
+	require.NoError(t, err)
+	var keys []wrappedKey
+	require.NoError(t, json.Unmarshal(annotation, &keys))
+	require.Len(t, keys, 1)
+	require.Equal(t, "key-1", keys[0].KeyID)
+	optsData, err := kms.Decrypt(context.Background(), "key-1", keys[0].WrappedKey)
+	require.NoError(t, err)
+	unwrapped, err := NewKeyWrapper(context.Background(), "mock", kms).UnwrapKey(nil, annotation)
+	require.NoError(t, err)
+	require.Equal(t, optsData, unwrapped)
+
+	// The data key can't be unwrapped after the master key is revoked.
+	delete(kms.keys, "key-1")
+	_, err = NewKeyWrapper(context.Background(), "mock", kms).UnwrapKey(nil, annotation)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unwrap key by KMS key key-1")
+}
+
+func TestCommandKMS(t *testing.T) {
+	// The script wraps the key by ROT13 with the only master key given in
+	// its arguments.
+	script := filepath.Join(t.TempDir(), "kms.sh")
+	require.NoError(t, os.WriteFile(script, []byte(`#!/bin/sh
+[ "$1" = "$3" ] || { echo "unknown key $3" >&2; exit 1; }
+tr 'a-zA-Z' 'n-za-mN-ZA-M'
+`), 0755))
+
+	kms, err := NewCommandKMS(script + " key-1")
+	require.NoError(t, err)
+	wrapped, err := kms.Encrypt(context.Background(), "key-1", []byte("data key"))
+	require.NoError(t, err)
+	require.NotEqual(t, []byte("data key"), wrapped)
+	unwrapped, err := kms.Decrypt(context.Background(), "key-1", wrapped)
+	require.NoError(t, err)
+	require.Equal(t, []byte("data key"), unwrapped)
+
+	_, err = kms.Encrypt(context.Background(), "key-2", []byte("data key"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unknown key key-2")
+
+	_, err = NewCommandKMS(" ")
+	require.Error(t, err)
+}
+
+func TestServeKeyProvider(t *testing.T) {
+	masterKey := make([]byte, 32)
+	_, err := rand.Read(masterKey)
+	require.NoError(t, err)
+	kms := &mockKMS{keys: map[string][]byte{"key-1": masterKey}}
+	serve := func(ctx context.Context, input keyprovider.KeyProviderKeyWrapProtocolInput) (*keyprovider.KeyProviderKeyWrapProtocolOutput, error) {
+		data, err := json.Marshal(input)
+		require.NoError(t, err)
+		var out bytes.Buffer
+		if err := ServeKeyProvider(ctx, "mock", kms, bytes.NewReader(data), &out); err != nil {
+			return nil, err
+		}
+		var output keyprovider.KeyProviderKeyWrapProtocolOutput
+		require.NoError(t, json.Unmarshal(out.Bytes(), &output))
+		return &output, nil
+	}
+
+	// The data key wrapped by the key provider command is unwrapped by it
+	// in the same way as the key wrapper in process.
+	cc, err := enchelpers.CreateCryptoConfig([]string{"provider:mock:key-1"}, nil)
+	require.NoError(t, err)
+	optsData := []byte("data key")
+	output, err := serve(context.Background(), keyprovider.KeyProviderKeyWrapProtocolInput{
+		Operation:     keyprovider.OpKeyWrap,
+		KeyWrapParams: keyprovider.KeyWrapParams{Ec: cc.EncryptConfig, OptsData: optsData},
+	})
+	require.NoError(t, err)
+	annotation := output.KeyWrapResults.Annotation
+	unwrapped, err := NewKeyWrapper(context.Background(), "mock", kms).UnwrapKey(nil, annotation)
+	require.NoError(t, err)
+	require.Equal(t, optsData, unwrapped)
+	output, err = serve(context.Background(), keyprovider.KeyProviderKeyWrapProtocolInput{
+		Operation:       keyprovider.OpKeyUnwrap,
+		KeyUnwrapParams: keyprovider.KeyUnwrapParams{Annotation: annotation},
+	})
+	require.NoError(t, err)
+	require.Equal(t, optsData, output.KeyUnwrapResults.OptsData)
+
+	_, err = serve(context.Background(), keyprovider.KeyProviderKeyWrapProtocolInput{Operation: "unknown"})
+	require.Error(t, err)
+}
+
+func TestKeyWrapperContext(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "kms.sh")
+	require.NoError(t, os.WriteFile(script, []byte("#!/bin/sh\ncat\n"), 0755))
+	kms, err := NewCommandKMS(script)
+	require.NoError(t, err)
+	cc, err := enchelpers.CreateCryptoConfig([]string{"provider:command:key-1"}, nil)
+	require.NoError(t, err)
+
+	// KMS is accessed with the context of caller.
+	_, err = NewKeyWrapper(context.Background(), "command", kms).WrapKeys(cc.EncryptConfig, []byte("data key"))
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = NewKeyWrapper(ctx, "command", kms).WrapKeys(cc.EncryptConfig, []byte("data key"))
+	require.Error(t, err)
+}
@@ -0,0 +1,232 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package migrator migrates the nydus blobs referenced by nydus images from
+// a storage backend to another, e.g. on changing the object storage.
+package migrator
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/goharbor/acceleration-service/pkg/errdefs"
+	"github.com/goharbor/acceleration-service/pkg/remote"
+	"github.com/goharbor/acceleration-service/pkg/utils"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/backend"
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/checker/tool"
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/converter/provider"
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/parser"
+	nydusifyUtils "github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+type Opt struct {
+	WorkDir        string
+	NydusImagePath string
+
+	// Refs are the nydus images referencing the blobs to migrate.
+	Refs     []string
+	Insecure bool
+
+	SourceBackendType   string
+	SourceBackendConfig string
+
+	TargetBackendType   string
+	TargetBackendConfig string
+	// TargetBackendOptions are the options of target backend besides
+	// TargetBackendConfig, see backend.Options.
+	TargetBackendOptions backend.Options
+
+	// Concurrency is the number of blobs migrated concurrently.
+	Concurrency int
+	// ForcePush uploads the blobs existing in target backend.
+	ForcePush bool
+	// RewriteManifest pushes the manifests of Refs in place, with the
+	// bootstrap layers annotated by the target backend type.
+	RewriteManifest bool
+}
+
+func hosts(opt Opt) remote.HostFunc {
+	return func(ref string) (remote.CredentialFunc, bool, error) {
+		return remote.NewDockerConfigCredFunc(), opt.Insecure, nil
+	}
+}
+
+func newBackend(bt, config string, opts backend.Options) (backend.Backend, error) {
+	// The registry backend can't read blobs, and it stores blobs as the
+	// manifest layers rather than referenced by bootstrap only.
+	if bt == "registry" {
+		return nil, fmt.Errorf("unsupported backend type %s for migration", bt)
+	}
+	return backend.NewBackendWithOptions(bt, []byte(config), nil, opts)
+}
+
+// rewriteManifest annotates the bootstrap layers of nydus manifests in desc
+// by the backend type bt, it returns nil if nothing is changed. The bootstrap
+// addresses blobs by the blob IDs only, so it isn't changed.
+func rewriteManifest(ctx context.Context, store content.Store, desc ocispec.Descriptor, bt string) (*ocispec.Descriptor, error) {
+	switch desc.MediaType {
+	case ocispec.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList:
+		var index ocispec.Index
+		if _, err := utils.ReadJSON(ctx, store, &index, desc); err != nil {
+			return nil, errors.Wrap(err, "read manifest list")
+		}
+		changed := false
+		for idx := range index.Manifests {
+			manifestDesc, err := rewriteManifest(ctx, store, index.Manifests[idx], bt)
+			if err != nil {
+				return nil, err
+			}
+			if manifestDesc != nil {
+				index.Manifests[idx] = *manifestDesc
+				changed = true
+			}
+		}
+		if !changed {
+			return nil, nil
+		}
+		return utils.WriteJSON(ctx, store, index, desc, "", nil)
+	case ocispec.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest:
+		var manifest ocispec.Manifest
+		if _, err := utils.ReadJSON(ctx, store, &manifest, desc); err != nil {
+			return nil, errors.Wrap(err, "read manifest")
+		}
+		bootstrapDesc := parser.FindNydusBootstrapDesc(&manifest)
+		if bootstrapDesc == nil || bootstrapDesc.Annotations[nydusifyUtils.LayerAnnotationNydusBackend] == bt {
+			return nil, nil
+		}
+		bootstrapDesc.Annotations[nydusifyUtils.LayerAnnotationNydusBackend] = bt
+		return utils.WriteJSON(ctx, store, manifest, desc, "", nil)
+	}
+	return nil, nil
+}
+
+// Migrate copies the blobs referenced by the bootstraps of nydus images in
+// opt.Refs, except the blobs in manifest layers, from source backend to
+// target backend. The images of all platforms are pulled for enumerating
+// the blobs, which contain only the bootstrap layers if the blobs are
+// stored in backend.
+func Migrate(ctx context.Context, opt Opt) (*backend.MigrateResult, error) {
+	// Containerd image fetch requires a namespace context.
+	ctx = namespaces.WithNamespace(ctx, "nydusify")
+
+	if len(opt.Refs) == 0 {
+		return nil, fmt.Errorf("no image reference to migrate")
+	}
+	src, err := newBackend(opt.SourceBackendType, opt.SourceBackendConfig, backend.Options{})
+	if err != nil {
+		return nil, errors.Wrap(err, "new source backend")
+	}
+	dst, err := newBackend(opt.TargetBackendType, opt.TargetBackendConfig, opt.TargetBackendOptions)
+	if err != nil {
+		return nil, errors.Wrap(err, "new target backend")
+	}
+
+	if _, err := os.Stat(opt.WorkDir); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			if err := os.MkdirAll(opt.WorkDir, 0755); err != nil {
+				return nil, errors.Wrap(err, "prepare work directory")
+			}
+			// We should only clean up when the work directory not exists
+			// before, otherwise it may delete user data by mistake.
+			defer os.RemoveAll(opt.WorkDir)
+		} else {
+			return nil, errors.Wrap(err, "stat work directory")
+		}
+	}
+	tmpDir, err := os.MkdirTemp(opt.WorkDir, "nydusify-")
+	if err != nil {
+		return nil, errors.Wrap(err, "create temp directory")
+	}
+	defer os.RemoveAll(tmpDir)
+	pvd, err := provider.New(tmpDir, hosts(opt), 200, "v1", platforms.All, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	inspector := tool.NewInspector(opt.NydusImagePath)
+	refs := make([]string, 0, len(opt.Refs))
+	descs := make([]ocispec.Descriptor, 0, len(opt.Refs))
+	blobIDs := []string{}
+	for _, ref := range opt.Refs {
+		named, err := docker.ParseDockerRef(ref)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse reference %s", ref)
+		}
+		ref = named.String()
+
+		logrus.Infof("pulling image %s", ref)
+		if err := pvd.Pull(ctx, ref); err != nil {
+			if errdefs.NeedsRetryWithHTTP(err) {
+				pvd.UsePlainHTTP()
+				if err := pvd.Pull(ctx, ref); err != nil {
+					return nil, errors.Wrap(err, "try to pull image")
+				}
+			} else {
+				return nil, errors.Wrapf(err, "pull image %s", ref)
+			}
+		}
+		desc, err := pvd.Image(ctx, ref)
+		if err != nil {
+			return nil, errors.Wrap(err, "find image from store")
+		}
+		ids, err := pvd.BackendBlobs(ctx, *desc, inspector)
+		if err != nil {
+			return nil, errors.Wrapf(err, "list backend blobs of %s", ref)
+		}
+		if len(ids) == 0 {
+			logrus.Warnf("%s doesn't reference any blob in backend", ref)
+		} else {
+			logrus.Infof("image %s references %d blobs in backend", ref, len(ids))
+		}
+		refs = append(refs, ref)
+		descs = append(descs, *desc)
+		blobIDs = append(blobIDs, ids...)
+	}
+
+	result, err := backend.Migrate(ctx, src, dst, blobIDs, backend.MigrateOption{
+		WorkDir:     tmpDir,
+		Concurrency: opt.Concurrency,
+		ForcePush:   opt.ForcePush,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "migrate blobs")
+	}
+	logrus.Infof("migrated %d blobs, skipped %d blobs existing in target backend", len(result.Migrated), len(result.Skipped))
+
+	if !opt.RewriteManifest {
+		return result, nil
+	}
+	for idx, ref := range refs {
+		desc, err := rewriteManifest(ctx, pvd.ContentStore(), descs[idx], opt.TargetBackendType)
+		if err != nil {
+			return nil, errors.Wrapf(err, "rewrite manifest of %s", ref)
+		}
+		if desc == nil {
+			continue
+		}
+		logrus.Infof("pushing rewritten manifest %s to %s", desc.Digest, ref)
+		if err := pvd.Push(ctx, *desc, ref); err != nil {
+			if errdefs.NeedsRetryWithHTTP(err) {
+				pvd.UsePlainHTTP()
+				if err := pvd.Push(ctx, *desc, ref); err != nil {
+					return nil, errors.Wrap(err, "try to push image manifest")
+				}
+			} else {
+				return nil, errors.Wrapf(err, "push rewritten manifest of %s", ref)
+			}
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,73 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package migrator
+
+import (
+	"context"
+	"testing"
+
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/goharbor/acceleration-service/pkg/utils"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	nydusifyUtils "github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+func TestRewriteManifest(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "nydusify")
+	store, err := local.NewStore(t.TempDir())
+	require.NoError(t, err)
+
+	writeManifest := func(layers ...ocispec.Descriptor) ocispec.Descriptor {
+		desc, err := utils.WriteJSON(ctx, store, ocispec.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: ocispec.MediaTypeImageManifest,
+			Layers:    layers,
+		}, ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest}, "", nil)
+		require.NoError(t, err)
+		return *desc
+	}
+	bootstrap := ocispec.Descriptor{
+		MediaType:   ocispec.MediaTypeImageLayerGzip,
+		Digest:      digest.FromString("bootstrap"),
+		Annotations: map[string]string{nydusifyUtils.LayerAnnotationNydusBootstrap: "true"},
+	}
+	nydusManifest := writeManifest(bootstrap)
+	ociManifest := writeManifest(ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: digest.FromString("layer")})
+	index, err := utils.WriteJSON(ctx, store, ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{nydusManifest, ociManifest},
+	}, ocispec.Descriptor{MediaType: ocispec.MediaTypeImageIndex}, "", nil)
+	require.NoError(t, err)
+
+	// Only the nydus manifest in index is rewritten.
+	rewritten, err := rewriteManifest(ctx, store, *index, "s3")
+	require.NoError(t, err)
+	require.NotNil(t, rewritten)
+	var newIndex ocispec.Index
+	_, err = utils.ReadJSON(ctx, store, &newIndex, *rewritten)
+	require.NoError(t, err)
+	require.Len(t, newIndex.Manifests, 2)
+	require.NotEqual(t, nydusManifest.Digest, newIndex.Manifests[0].Digest)
+	require.Equal(t, ociManifest, newIndex.Manifests[1])
+	var manifest ocispec.Manifest
+	_, err = utils.ReadJSON(ctx, store, &manifest, newIndex.Manifests[0])
+	require.NoError(t, err)
+	require.Equal(t, "s3", manifest.Layers[0].Annotations[nydusifyUtils.LayerAnnotationNydusBackend])
+	require.Equal(t, "true", manifest.Layers[0].Annotations[nydusifyUtils.LayerAnnotationNydusBootstrap])
+
+	// The manifest already pointing at the backend isn't changed.
+	rewritten, err = rewriteManifest(ctx, store, *rewritten, "s3")
+	require.NoError(t, err)
+	require.Nil(t, rewritten)
+	rewritten, err = rewriteManifest(ctx, store, ociManifest, "s3")
+	require.NoError(t, err)
+	require.Nil(t, rewritten)
+}
@@ -27,27 +27,33 @@ type OssBackendConfig struct {
 	BucketName      string `json:"bucket_name"`
 	MetaPrefix      string `json:"meta_prefix"`
 	BlobPrefix      string `json:"blob_prefix"`
+	Concurrency     int    `json:"concurrency,omitempty"`
+	PartSize        int64  `json:"part_size,omitempty"`
 }
 
 func (cfg *OssBackendConfig) rawMetaBackendCfg() []byte {
-	configMap := map[string]string{
+	configMap := map[string]interface{}{
 		"endpoint":          cfg.Endpoint,
 		"access_key_id":     cfg.AccessKeyID,
 		"access_key_secret": cfg.AccessKeySecret,
 		"bucket_name":       cfg.BucketName,
 		"object_prefix":     cfg.MetaPrefix,
+		"concurrency":       cfg.Concurrency,
+		"part_size":         cfg.PartSize,
 	}
 	b, _ := json.Marshal(configMap)
 	return b
 }
 
 func (cfg *OssBackendConfig) rawBlobBackendCfg() []byte {
-	configMap := map[string]string{
+	configMap := map[string]interface{}{
 		"endpoint":          cfg.Endpoint,
 		"access_key_id":     cfg.AccessKeyID,
 		"access_key_secret": cfg.AccessKeySecret,
 		"bucket_name":       cfg.BucketName,
 		"object_prefix":     cfg.BlobPrefix,
+		"concurrency":       cfg.Concurrency,
+		"part_size":         cfg.PartSize,
 	}
 	b, _ := json.Marshal(configMap)
 	return b
@@ -66,6 +72,8 @@ type S3BackendConfig struct {
 	BucketName      string `json:"bucket_name"`
 	MetaPrefix      string `json:"meta_prefix"`
 	BlobPrefix      string `json:"blob_prefix"`
+	Concurrency     int    `json:"concurrency,omitempty"`
+	PartSize        int64  `json:"part_size,omitempty"`
 }
 
 func (cfg *S3BackendConfig) rawMetaBackendCfg() []byte {
@@ -77,6 +85,8 @@ func (cfg *S3BackendConfig) rawMetaBackendCfg() []byte {
 		BucketName:      cfg.BucketName,
 		Region:          cfg.Region,
 		ObjectPrefix:    cfg.MetaPrefix,
+		Concurrency:     cfg.Concurrency,
+		PartSize:        cfg.PartSize,
 	}
 	b, _ := json.Marshal(s3Config)
 	return b
@@ -91,6 +101,8 @@ func (cfg *S3BackendConfig) rawBlobBackendCfg() []byte {
 		BucketName:      cfg.BucketName,
 		Region:          cfg.Region,
 		ObjectPrefix:    cfg.BlobPrefix,
+		Concurrency:     cfg.Concurrency,
+		PartSize:        cfg.PartSize,
 	}
 	b, _ := json.Marshal(s3Config)
 	return b
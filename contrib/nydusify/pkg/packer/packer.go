@@ -3,14 +3,17 @@ package packer
 import (
 	"context"
 	"encoding/json"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
 
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/backend"
 	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/build"
 	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/checker/tool"
 	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/compactor"
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -32,6 +35,9 @@ type Opt struct {
 	NydusImagePath string
 	OutputDir      string
 	BackendConfig  BackendConfig
+	// BackendOptions are the options of storage backend besides
+	// BackendConfig, see backend.Options.
+	BackendOptions backend.Options
 }
 
 type Builder interface {
@@ -52,12 +58,24 @@ type BlobManifest struct {
 }
 
 type PackRequest struct {
-	SourceDir    string
-	ImageName    string
-	FsVersion    string
-	Compressor   string
-	ChunkSize    string
-	PushToRemote bool
+	SourceDir string
+	// SourceTar is the single layer tar (gzip) stream to build from instead
+	// of SourceDir, e.g. the stdin, its size doesn't need to be known.
+	SourceTar io.Reader
+	// KeepSourceDir keeps the source directory unpacked from SourceTar
+	// after building, so that the converted filesystem can be inspected.
+	KeepSourceDir bool
+	// WhiteoutPolicy translates the whiteouts of SourceTar on unpacking,
+	// see utils.WhiteoutPolicies, SourceDir is built by the OCI whiteouts.
+	WhiteoutPolicy string
+	ImageName      string
+	FsVersion      string
+	Compressor     string
+	ChunkSize      string
+	PushToRemote   bool
+	// RafsFeatures toggles the RAFS features of builder, see
+	// build.ParseRafsFeatures.
+	RafsFeatures map[string]bool
 
 	ChunkDict         string
 	Parent            string
@@ -68,6 +86,9 @@ type PackRequest struct {
 type PackResult struct {
 	Meta string
 	Blob string
+	// BlobBytes and MetaBytes are the bytes uploaded to backends.
+	BlobBytes int64
+	MetaBytes int64
 }
 
 func New(opt Opt) (*Packer, error) {
@@ -91,9 +112,10 @@ func New(opt Opt) (*Packer, error) {
 	p.builder = build.NewBuilder(p.nydusImagePath)
 	if p.BackendConfig != nil {
 		p.pusher, err = NewPusher(NewPusherOpt{
-			Artifact:      artifact,
-			BackendConfig: opt.BackendConfig,
-			Logger:        p.logger,
+			Artifact:       artifact,
+			BackendConfig:  opt.BackendConfig,
+			BackendOptions: opt.BackendOptions,
+			Logger:         p.logger,
 		})
 		if err != nil {
 			return nil, err
@@ -227,7 +249,38 @@ func (p *Packer) tryCompactParent(req *PackRequest) error {
 	return nil
 }
 
-func (p *Packer) Pack(_ context.Context, req PackRequest) (PackResult, error) {
+// unpackSourceTar unpacks the source tar stream into a temporary directory
+// under output directory as the source directory of request.
+func (p *Packer) unpackSourceTar(ctx context.Context, req *PackRequest) (func(), error) {
+	sourceDir, err := os.MkdirTemp(p.OutputDir, "source-")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create source directory")
+	}
+	p.logger.Infof("unpacking source tar stream into %q", sourceDir)
+	if err := utils.UnpackLayerWithWhiteoutPolicy(ctx, sourceDir, req.SourceTar, "", req.WhiteoutPolicy); err != nil {
+		os.RemoveAll(sourceDir)
+		return nil, errors.Wrap(err, "failed to unpack source tar stream")
+	}
+	req.SourceDir = sourceDir
+	return func() {
+		if req.KeepSourceDir {
+			p.logger.Infof("keep the unpacked source directory %q for debugging", sourceDir)
+			return
+		}
+		os.RemoveAll(sourceDir)
+	}, nil
+}
+
+func (p *Packer) Pack(ctx context.Context, req PackRequest) (PackResult, error) {
+	whiteoutSpec := "oci"
+	if req.SourceTar != nil {
+		whiteoutSpec = utils.WhiteoutSpec(req.WhiteoutPolicy)
+		cleanup, err := p.unpackSourceTar(ctx, &req)
+		if err != nil {
+			return PackResult{}, err
+		}
+		defer cleanup()
+	}
 	p.logger.Infof("start to build image from source directory %q", req.SourceDir)
 	if err := p.tryCompactParent(&req); err != nil {
 		return PackResult{}, err
@@ -249,10 +302,11 @@ func (p *Packer) Pack(_ context.Context, req PackRequest) (PackResult, error) {
 		BlobPath:            blobPath,
 		OutputJSONPath:      p.outputJSONPath(),
 		RootfsPath:          req.SourceDir,
-		WhiteoutSpec:        "oci",
+		WhiteoutSpec:        whiteoutSpec,
 		Compressor:          req.Compressor,
 		ChunkSize:           req.ChunkSize,
 		FsVersion:           req.FsVersion,
+		RafsFeatures:        req.RafsFeatures,
 	}); err != nil {
 		return PackResult{}, errors.Wrapf(err, "failed to build image from directory %s", req.SourceDir)
 	}
@@ -293,8 +347,10 @@ func (p *Packer) Pack(_ context.Context, req PackRequest) (PackResult, error) {
 		return PackResult{}, errors.Wrap(err, "failed to push pack result to remote")
 	}
 	return PackResult{
-		Meta: pushResult.RemoteMeta,
-		Blob: pushResult.RemoteBlob,
+		Meta:      pushResult.RemoteMeta,
+		Blob:      pushResult.RemoteBlob,
+		BlobBytes: pushResult.BlobBytes,
+		MetaBytes: pushResult.MetaBytes,
 	}, nil
 }
 
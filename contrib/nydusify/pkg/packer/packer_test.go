@@ -5,6 +5,8 @@
 package packer
 
 import (
+	"archive/tar"
+	"bytes"
 	"context"
 	"errors"
 	"io"
@@ -207,6 +209,73 @@ func TestPack(t *testing.T) {
 	}, res)
 }
 
+func TestPackFromTar(t *testing.T) {
+	tmpDir, tearDown := setUpTmpDir(t)
+	defer tearDown()
+	p, err := New(Opt{
+		LogLevel:       logrus.InfoLevel,
+		OutputDir:      tmpDir,
+		NydusImagePath: filepath.Join(tmpDir, "nydus-image"),
+	})
+	require.NoError(t, err)
+	copyFile("testdata/output.json", filepath.Join(tmpDir, "output.json"))
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "etc/", Mode: 0755, Typeflag: tar.TypeDir}))
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "etc/hostname", Mode: 0644, Size: 5, Typeflag: tar.TypeReg}))
+	_, err = tw.Write([]byte("nydus"))
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	tarData := append([]byte{}, buf.Bytes()...)
+
+	builder := &mockBuilder{}
+	p.builder = builder
+	var sourceDir string
+	builder.On("Run", mock.Anything).Run(func(args mock.Arguments) {
+		option := args.Get(0).(build.BuilderOption)
+		sourceDir = option.RootfsPath
+		data, err := os.ReadFile(filepath.Join(sourceDir, "etc/hostname"))
+		require.NoError(t, err)
+		require.Equal(t, "nydus", string(data))
+		require.Equal(t, "oci", option.WhiteoutSpec)
+	}).Return(nil)
+
+	// The stream is read without knowing its size like stdin.
+	res, err := p.Pack(context.Background(), PackRequest{
+		SourceTar: io.MultiReader(&buf),
+		ImageName: "test.meta",
+	})
+	require.NoError(t, err)
+	require.Equal(t, PackResult{
+		Meta: "testdata/TestPackFromTar/test.meta",
+		Blob: "testdata/TestPackFromTar/test.blob",
+	}, res)
+	builder.AssertNumberOfCalls(t, "Run", 1)
+	_, err = os.Stat(sourceDir)
+	require.True(t, os.IsNotExist(err))
+
+	// The unpacked source directory is kept for debugging.
+	_, err = p.Pack(context.Background(), PackRequest{
+		SourceTar:     bytes.NewReader(tarData),
+		KeepSourceDir: true,
+		ImageName:     "test.meta",
+	})
+	require.NoError(t, err)
+	builder.AssertNumberOfCalls(t, "Run", 2)
+	data, err := os.ReadFile(filepath.Join(sourceDir, "etc/hostname"))
+	require.NoError(t, err)
+	require.Equal(t, "nydus", string(data))
+	require.NoError(t, os.RemoveAll(sourceDir))
+
+	_, err = p.Pack(context.Background(), PackRequest{
+		SourceTar: bytes.NewReader([]byte("invalid tar")),
+		ImageName: "test.meta",
+	})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "failed to unpack source tar stream")
+}
+
 func TestPusher_getBlobHash(t *testing.T) {
 	artifact, err := NewArtifact("testdata")
 	require.NoError(t, err)
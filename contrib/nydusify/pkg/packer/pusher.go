@@ -7,13 +7,18 @@ import (
 	"os"
 	"strings"
 
+	humanize "github.com/dustin/go-humanize"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
 
 	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/backend"
 	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
 )
 
+// existenceCheckLimit is the concurrency of checking blob existence.
+const existenceCheckLimit = 10
+
 type Pusher struct {
 	Artifact
 	cfg         BackendConfig
@@ -32,12 +37,17 @@ type PushRequest struct {
 type PushResult struct {
 	RemoteMeta string
 	RemoteBlob string
+	// BlobBytes and MetaBytes are the bytes uploaded to blob backend and
+	// meta backend, the blobs already existing in backend are not counted.
+	BlobBytes int64
+	MetaBytes int64
 }
 
 type NewPusherOpt struct {
 	Artifact
-	BackendConfig BackendConfig
-	Logger        *logrus.Logger
+	BackendConfig  BackendConfig
+	BackendOptions backend.Options
+	Logger         *logrus.Logger
 }
 
 func NewPusher(opt NewPusherOpt) (*Pusher, error) {
@@ -49,11 +59,11 @@ func NewPusher(opt NewPusherOpt) (*Pusher, error) {
 	}
 	backendConfig := opt.BackendConfig
 
-	metaBackend, err := backend.NewBackend(backendConfig.backendType(), backendConfig.rawMetaBackendCfg(), nil)
+	metaBackend, err := backend.NewBackendWithOptions(backendConfig.backendType(), backendConfig.rawMetaBackendCfg(), nil, opt.BackendOptions)
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to init backend for bootstrap blob")
 	}
-	blobBackend, err := backend.NewBackend(backendConfig.backendType(), backendConfig.rawBlobBackendCfg(), nil)
+	blobBackend, err := backend.NewBackendWithOptions(backendConfig.backendType(), backendConfig.rawBlobBackendCfg(), nil, opt.BackendOptions)
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to init backend for data blob")
 	}
@@ -87,15 +97,26 @@ func (p *Pusher) Push(req PushRequest) (pushResult PushResult, retErr error) {
 		}
 	}()
 
-	for _, blob := range req.ParentBlobs {
-		// try push parent blobs
-		if _, err := p.blobBackend.Upload(ctx, blob, p.blobFilePath(blob, true), 0, false); err != nil {
+	missingBlobs, err := p.missingBlobs(ctx, req.ParentBlobs)
+	if err != nil {
+		return PushResult{}, err
+	}
+	for _, blob := range missingBlobs {
+		// try push parent blobs, the existence has been checked
+		if _, err := p.blobBackend.Upload(ctx, blob, p.blobFilePath(blob, true), 0, true); err != nil {
 			return PushResult{}, errors.Wrap(err, "failed to put blobfile to remote")
 		}
+		pushResult.BlobBytes += fileSize(p.blobFilePath(blob, true))
 	}
 
 	p.logger.Infof("push blob %s", req.Blob)
 	if req.Blob != "" {
+		// The existing blob is skipped by backend, but it's still uploaded
+		// to get the remote url of blob.
+		missing, err := p.missingBlobs(ctx, []string{req.Blob})
+		if err != nil {
+			return PushResult{}, err
+		}
 		desc, err := p.blobBackend.Upload(ctx, req.Blob, p.blobFilePath(req.Blob, true), 0, false)
 		if err != nil {
 			return PushResult{}, errors.Wrap(err, "failed to put blobfile to remote")
@@ -103,6 +124,9 @@ func (p *Pusher) Push(req PushRequest) (pushResult PushResult, retErr error) {
 		if len(desc.URLs) > 0 {
 			pushResult.RemoteBlob = desc.URLs[0]
 		}
+		if len(missing) > 0 {
+			pushResult.BlobBytes += fileSize(p.blobFilePath(req.Blob, true))
+		}
 	}
 	if retErr = p.blobBackend.Finalize(false); retErr != nil {
 		return PushResult{}, errors.Wrap(retErr, "Finalize blob backend upload")
@@ -118,10 +142,63 @@ func (p *Pusher) Push(req PushRequest) (pushResult PushResult, retErr error) {
 	if retErr = p.metaBackend.Finalize(false); retErr != nil {
 		return PushResult{}, errors.Wrap(retErr, "Finalize meta backend upload")
 	}
+	pushResult.MetaBytes = fileSize(p.bootstrapPath(req.Meta))
+
+	p.logger.Infof(
+		"uploaded %s to %s blob backend, %s to %s meta backend",
+		humanize.IBytes(uint64(pushResult.BlobBytes)), p.cfg.backendType(),
+		humanize.IBytes(uint64(pushResult.MetaBytes)), p.cfg.backendType(),
+	)
 
 	return
 }
 
+// fileSize returns the size of the uploaded file, the file has been read by
+// backend successfully, so the error is not expected and ignored.
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// missingBlobs checks the existence of blobs in blob backend concurrently
+// before pushing, and returns the blobs to be uploaded.
+func (p *Pusher) missingBlobs(ctx context.Context, blobs []string) ([]string, error) {
+	if len(blobs) == 0 || p.blobBackend.Type() == backend.RegistryBackend {
+		return blobs, nil
+	}
+
+	exists := make([]bool, len(blobs))
+	eg, _ := errgroup.WithContext(ctx)
+	eg.SetLimit(existenceCheckLimit)
+	for idx, blob := range blobs {
+		idx, blob := idx, blob
+		eg.Go(func() error {
+			exist, err := p.blobBackend.Check(blob)
+			if err != nil {
+				return errors.Wrapf(err, "check existence of blob %s", blob)
+			}
+			exists[idx] = exist
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+
+	missing := []string{}
+	for idx, blob := range blobs {
+		if exists[idx] {
+			p.logger.Infof("skip pushing blob %s, already exists", blob)
+			continue
+		}
+		missing = append(missing, blob)
+	}
+	return missing, nil
+}
+
 func ParseBackendConfig(backendType, backendConfigFile string) (BackendConfig, error) {
 
 	cfgFile, err := os.Open(backendConfigFile)
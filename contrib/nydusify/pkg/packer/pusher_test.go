@@ -20,6 +20,8 @@ import (
 
 type mockBackend struct {
 	mock.Mock
+	// existing is the blobs already in backend.
+	existing map[string]bool
 }
 
 func (m *mockBackend) Upload(ctx context.Context, blobID, blobPath string, blobSize int64, forcePush bool) (*ocispec.Descriptor, error) {
@@ -32,8 +34,8 @@ func (m *mockBackend) Finalize(_ bool) error {
 	return nil
 }
 
-func (m *mockBackend) Check(_ string) (bool, error) {
-	return false, nil
+func (m *mockBackend) Check(blobID string) (bool, error) {
+	return m.existing[blobID], nil
 }
 
 func (m *mockBackend) Type() backend.Type {
@@ -158,6 +160,37 @@ func TestPusher_Push(t *testing.T) {
 	)
 }
 
+func TestPusher_PushSkipExistingBlobs(t *testing.T) {
+	tmpDir, tearDown := setUpTmpDir(t)
+	defer tearDown()
+
+	artifact, err := NewArtifact(tmpDir)
+	require.NoError(t, err)
+
+	parents := []string{"parent-1", "parent-2", "parent-3", "parent-4"}
+	mp := &mockBackend{existing: map[string]bool{"parent-1": true, "parent-3": true}}
+	pusher := Pusher{
+		Artifact:    artifact,
+		cfg:         &OssBackendConfig{BucketName: "testbucket"},
+		logger:      logrus.New(),
+		metaBackend: mp,
+		blobBackend: mp,
+	}
+	mp.On("Upload", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(&ocispec.Descriptor{}, nil)
+
+	_, err = pusher.Push(PushRequest{
+		Meta:        "mock.meta",
+		ParentBlobs: parents,
+	})
+	require.NoError(t, err)
+
+	var uploaded []string
+	for _, call := range mp.Calls {
+		uploaded = append(uploaded, call.Arguments.String(1))
+	}
+	require.Equal(t, []string{"parent-2", "parent-4", "mock.meta"}, uploaded)
+}
+
 func TestNewPusher(t *testing.T) {
 	backendConfig := &OssBackendConfig{
 		Endpoint:   "region.oss.com",
@@ -204,3 +237,44 @@ func TestNewPusher(t *testing.T) {
 	require.Error(t, err)
 	require.Contains(t, err.Error(), "failed to init backend for bootstrap blob")
 }
+
+func TestPusher_PushAccountBytes(t *testing.T) {
+	tmpDir, tearDown := setUpTmpDir(t)
+	defer tearDown()
+
+	artifact, err := NewArtifact(tmpDir)
+	require.NoError(t, err)
+	hash := "3093776c78a21e47f0a8b4c80a1f019b1e838fc1ade274209332af1ca5f57090"
+	require.NoError(t, os.WriteFile(artifact.bootstrapPath("mock.meta"), []byte("meta"), 0644))
+	require.NoError(t, os.WriteFile(artifact.blobFilePath(hash, true), []byte("blob data"), 0644))
+	require.NoError(t, os.WriteFile(artifact.blobFilePath("parent-1", true), []byte("parent-1 data"), 0644))
+	require.NoError(t, os.WriteFile(artifact.blobFilePath("parent-2", true), []byte("parent-2"), 0644))
+
+	for _, tc := range []struct {
+		existing  map[string]bool
+		blobBytes int64
+	}{
+		{existing: nil, blobBytes: int64(len("blob data") + len("parent-1 data") + len("parent-2"))},
+		// The existing blobs are not counted.
+		{existing: map[string]bool{hash: true, "parent-1": true}, blobBytes: int64(len("parent-2"))},
+	} {
+		mp := &mockBackend{existing: tc.existing}
+		pusher := Pusher{
+			Artifact:    artifact,
+			cfg:         &OssBackendConfig{BucketName: "testbucket"},
+			logger:      logrus.New(),
+			metaBackend: mp,
+			blobBackend: mp,
+		}
+		mp.On("Upload", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(&ocispec.Descriptor{}, nil)
+
+		res, err := pusher.Push(PushRequest{
+			Meta:        "mock.meta",
+			Blob:        hash,
+			ParentBlobs: []string{"parent-1", "parent-2"},
+		})
+		require.NoError(t, err)
+		require.Equal(t, tc.blobBytes, res.BlobBytes)
+		require.Equal(t, int64(len("meta")), res.MetaBytes)
+	}
+}
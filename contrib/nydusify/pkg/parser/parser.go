@@ -30,6 +30,9 @@ type Parser struct {
 	// knows how to choose the source image. In case of single manifest, `interestedArch`
 	// is the same with origin.
 	interestedArch string
+	// interestedVariant selects the variant of interestedArch in case of
+	// manifest list, e.g. `v7` for linux/arm/v7, empty variant matches any.
+	interestedVariant string
 }
 
 // Image presents image contents.
@@ -59,6 +62,12 @@ func New(remote *remote.Remote, interestedArch string) (*Parser, error) {
 	}, nil
 }
 
+// SetVariant sets the platform variant to choose image manifest from
+// manifest list, e.g. `v6` or `v7` of arm.
+func (parser *Parser) SetVariant(variant string) {
+	parser.interestedVariant = variant
+}
+
 // Try to find the topmost layer in Nydus manifest, it should
 // be a Nydus bootstrap layer, see examples/manifest/manifest.json
 func FindNydusBootstrapDesc(manifest *ocispec.Manifest) *ocispec.Descriptor {
@@ -176,11 +185,36 @@ func (parser *Parser) PullNydusBootstrap(ctx context.Context, image *Image) (io.
 
 func (parser *Parser) matchImagePlatform(desc *ocispec.Descriptor) bool {
 	if parser.interestedArch == desc.Platform.Architecture && desc.Platform.OS == "linux" {
-		return true
+		return utils.MatchPlatformVariant(desc.Platform, parser.interestedVariant)
 	}
 	return false
 }
 
+// matchIndex finds the interested OCI and Nydus manifests in manifest index.
+func (parser *Parser) matchIndex(index *ocispec.Index) (*ocispec.Descriptor, *ocispec.Descriptor) {
+	var ociDesc *ocispec.Descriptor
+	var nydusDesc *ocispec.Descriptor
+	for idx := range index.Manifests {
+		desc := index.Manifests[idx]
+		if desc.Platform != nil {
+			// Currently, parser only finds one interested image.
+			if parser.matchImagePlatform(&desc) {
+				if utils.IsNydusPlatform(desc.Platform) {
+					nydusDesc = &desc
+				} else {
+					ociDesc = &desc
+				}
+			}
+		} else {
+			// FIXME: Returning the first image without platform specified is subtle.
+			// It might not violate Image spec.
+			ociDesc = &desc
+			logrus.Warnf("Will cook a image without platform, %s", ociDesc.Digest)
+		}
+	}
+	return ociDesc, nydusDesc
+}
+
 // Parse parses Nydus image reference into Parsed object.
 func (parser *Parser) Parse(ctx context.Context) (*Parsed, error) {
 	logrus.Infof("Parsing image %s", parser.Remote.Ref)
@@ -228,25 +262,7 @@ func (parser *Parser) Parse(ctx context.Context) (*Parsed, error) {
 			return nil, err
 		}
 		parsed.Index = index
-
-		for idx := range index.Manifests {
-			desc := index.Manifests[idx]
-			if desc.Platform != nil {
-				// Currently, parser only finds one interested image.
-				if parser.matchImagePlatform(&desc) {
-					if utils.IsNydusPlatform(desc.Platform) {
-						nydusDesc = &desc
-					} else {
-						ociDesc = &desc
-					}
-				}
-			} else {
-				// FIXME: Returning the first image without platform specified is subtle.
-				// It might not violate Image spec.
-				ociDesc = &desc
-				logrus.Warnf("Will cook a image without platform, %s", ociDesc.Digest)
-			}
-		}
+		ociDesc, nydusDesc = parser.matchIndex(index)
 	}
 
 	if ociDesc != nil {
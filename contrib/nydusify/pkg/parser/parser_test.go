@@ -0,0 +1,65 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package parser
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+func TestMatchIndexVariant(t *testing.T) {
+	manifest := func(arch, variant string, nydus bool) ocispec.Descriptor {
+		platform := &ocispec.Platform{OS: "linux", Architecture: arch, Variant: variant}
+		if nydus {
+			platform.OSFeatures = []string{utils.ManifestOSFeatureNydus}
+		}
+		return ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageManifest,
+			Digest:    digest.FromString(fmt.Sprintf("%s/%s nydus=%t", arch, variant, nydus)),
+			Platform:  platform,
+		}
+	}
+	index := &ocispec.Index{
+		Manifests: []ocispec.Descriptor{
+			manifest("arm", "v6", false),
+			manifest("arm", "v7", false),
+			manifest("arm", "v8", false),
+			manifest("arm64", "v8", false),
+			manifest("amd64", "", false),
+			manifest("arm", "v6", true),
+			manifest("arm", "v7", true),
+		},
+	}
+
+	for _, tc := range []struct {
+		arch    string
+		variant string
+		oci     *ocispec.Descriptor
+		nydus   *ocispec.Descriptor
+	}{
+		{"arm", "v6", &index.Manifests[0], &index.Manifests[5]},
+		{"arm", "v7", &index.Manifests[1], &index.Manifests[6]},
+		{"arm", "8", &index.Manifests[2], nil},
+		{"arm64", "", &index.Manifests[3], nil},
+		// The variant v8 of arm64 is normalized to empty.
+		{"arm64", "v8", &index.Manifests[3], nil},
+		{"amd64", "", &index.Manifests[4], nil},
+		{"amd64", "v2", nil, nil},
+	} {
+		parser, err := New(nil, tc.arch)
+		require.NoError(t, err)
+		parser.SetVariant(tc.variant)
+		ociDesc, nydusDesc := parser.matchIndex(index)
+		platform := tc.arch + "/" + tc.variant
+		require.Equal(t, tc.oci, ociDesc, platform)
+		require.Equal(t, tc.nydus, nydusDesc, platform)
+	}
+}
@@ -50,8 +50,8 @@ type withCredentialFunc = func(string) (string, string, error)
 // withRemote creates an remote instance, it uses the implemention of containerd
 // docker remote to access image from remote registry.
 func withRemote(ref string, insecure bool, credFunc withCredentialFunc) (*remote.Remote, error) {
-	resolverFunc := func(retryWithHTTP bool) remotes.Resolver {
-		registryHosts := docker.ConfigureDefaultRegistries(
+	hostsFunc := func(retryWithHTTP bool) docker.RegistryHosts {
+		return docker.ConfigureDefaultRegistries(
 			docker.WithAuthorizer(
 				docker.NewDockerAuthorizer(
 					docker.WithAuthClient(newDefaultClient(insecure)),
@@ -63,13 +63,19 @@ func withRemote(ref string, insecure bool, credFunc withCredentialFunc) (*remote
 				return retryWithHTTP, nil
 			}),
 		)
-
+	}
+	resolverFunc := func(retryWithHTTP bool) remotes.Resolver {
 		return docker.NewResolver(docker.ResolverOptions{
-			Hosts: registryHosts,
+			Hosts: hostsFunc(retryWithHTTP),
 		})
 	}
 
-	return remote.New(ref, resolverFunc)
+	remoter, err := remote.New(ref, resolverFunc)
+	if err != nil {
+		return nil, err
+	}
+	remoter.SetRegistryHosts(hostsFunc)
+	return remoter, nil
 }
 
 // DefaultRemote creates an remote instance, it attempts to read docker auth config
@@ -60,6 +60,21 @@ type defaultSourceLayer struct {
 	parentChainID *digest.Digest
 }
 
+// layerFormatError is the error of a malformed or unsupported source layer,
+// which can't be recovered by pulling the layer again.
+type layerFormatError struct {
+	error
+}
+
+func (err *layerFormatError) Unwrap() error {
+	return err.error
+}
+
+func isRetryableLayerError(err error) bool {
+	var formatErr *layerFormatError
+	return !errors.As(err, &formatErr)
+}
+
 func (sp *defaultSourceProvider) Manifest(_ context.Context) (*ocispec.Descriptor, error) {
 	return &sp.image.Desc, nil
 }
@@ -99,7 +114,9 @@ func (sp *defaultSourceProvider) Layers(_ context.Context) ([]SourceLayer, error
 func (sl *defaultSourceLayer) Mount(ctx context.Context) ([]mount.Mount, func() error, error) {
 	digestStr := sl.desc.Digest.String()
 
-	if err := utils.WithRetry(func() error {
+	// The layer is pulled again for the network errors and the transient
+	// decompression errors, e.g. a truncated or corrupt download.
+	if err := utils.WithRetryAttempts(0, isRetryableLayerError, func() error {
 		// Pull the layer from source
 		reader, err := sl.remote.Pull(ctx, sl.desc, true)
 		if err != nil {
@@ -107,8 +124,20 @@ func (sl *defaultSourceLayer) Mount(ctx context.Context) ([]mount.Mount, func()
 		}
 		defer reader.Close()
 
+		// Verify the layer before unpacking to avoid leaving a partially
+		// extracted layer for malformed stream.
+		verified, err := utils.VerifyLayer(reader, utils.LayerMediaType(sl.desc), sl.desc.Size, filepath.Dir(sl.mountDir))
+		if err != nil {
+			err = errors.Wrap(err, fmt.Sprintf("Verify source layer %s", digestStr))
+			if !utils.IsTransientLayerError(err) {
+				return &layerFormatError{err}
+			}
+			return err
+		}
+		defer verified.Close()
+
 		// Decompress layer from source stream
-		if err := utils.UnpackTargz(ctx, sl.mountDir, reader, false); err != nil {
+		if err := utils.UnpackLayer(ctx, sl.mountDir, verified, utils.LayerMediaType(sl.desc), false); err != nil {
 			return errors.Wrap(err, fmt.Sprintf("Decompress source layer %s", digestStr))
 		}
 
@@ -147,6 +176,23 @@ func (sl *defaultSourceLayer) ParentChainID() *digest.Digest {
 	return sl.parentChainID
 }
 
+// ExtractPlatform extracts os, arch and the optional variant from platform
+// string formated like os/arch or os/arch/variant.
+func ExtractPlatform(platform string) (string, string, string, error) {
+	p := strings.Split(platform, "/")
+	if len(p) != 3 {
+		os, arch, err := ExtractOsArch(platform)
+		return os, arch, "", err
+	}
+
+	os, arch, err := ExtractOsArch(p[0] + "/" + p[1])
+	if err != nil {
+		return "", "", "", err
+	}
+
+	return os, arch, p[2], nil
+}
+
 // Input platform string should be formated like os/arch.
 func ExtractOsArch(platform string) (string, string, error) {
 
@@ -171,8 +217,7 @@ func ExtractOsArch(platform string) (string, string, error) {
 
 // DefaultSource pulls image layers from specify image reference
 func DefaultSource(ctx context.Context, remote *remote.Remote, workDir, platform string) ([]SourceProvider, error) {
-
-	_, arch, err := ExtractOsArch(platform)
+	_, arch, variant, err := ExtractPlatform(platform)
 	if err != nil {
 		return nil, err
 	}
@@ -181,6 +226,7 @@ func DefaultSource(ctx context.Context, remote *remote.Remote, workDir, platform
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create parser")
 	}
+	parser.SetVariant(variant)
 	parsed, err := parser.Parse(ctx)
 	if err != nil {
 		return nil, errors.Wrap(err, "Parse source image")
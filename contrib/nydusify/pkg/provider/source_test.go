@@ -0,0 +1,137 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/remotes"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/remote"
+)
+
+// testFetcher serves the manifest and config of the source image from blobs,
+// and the layer data of each fetch from fetches in order, the last one is
+// served for the following fetches.
+type testFetcher struct {
+	remotes.Resolver
+	manifest ocispec.Descriptor
+	blobs    map[digest.Digest][]byte
+	fetches  [][]byte
+	count    int
+}
+
+func (fetcher *testFetcher) Resolve(_ context.Context, ref string) (string, ocispec.Descriptor, error) {
+	return ref, fetcher.manifest, nil
+}
+
+func (fetcher *testFetcher) Fetcher(_ context.Context, _ string) (remotes.Fetcher, error) {
+	return remotes.FetcherFunc(func(_ context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+		if data, ok := fetcher.blobs[desc.Digest]; ok {
+			return io.NopCloser(bytes.NewReader(data)), nil
+		}
+		idx := fetcher.count
+		if idx >= len(fetcher.fetches) {
+			idx = len(fetcher.fetches) - 1
+		}
+		fetcher.count++
+		return io.NopCloser(bytes.NewReader(fetcher.fetches[idx])), nil
+	}), nil
+}
+
+func testSourceLayer(t *testing.T, fetcher *testFetcher, layer []byte) SourceLayer {
+	config, err := json.Marshal(ocispec.Image{
+		Platform: ocispec.Platform{OS: "linux", Architecture: "amd64"},
+		RootFS: ocispec.RootFS{
+			Type:    "layers",
+			DiffIDs: []digest.Digest{digest.FromString("diff")},
+		},
+	})
+	require.NoError(t, err)
+	manifest, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config: ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageConfig,
+			Digest:    digest.FromBytes(config),
+			Size:      int64(len(config)),
+		},
+		Layers: []ocispec.Descriptor{{
+			MediaType: ocispec.MediaTypeImageLayerGzip,
+			Digest:    digest.FromBytes(layer),
+			Size:      int64(len(layer)),
+		}},
+	})
+	require.NoError(t, err)
+	fetcher.manifest = ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromBytes(manifest),
+		Size:      int64(len(manifest)),
+	}
+	fetcher.blobs = map[digest.Digest][]byte{
+		digest.FromBytes(config):   config,
+		digest.FromBytes(manifest): manifest,
+	}
+
+	remote, err := remote.New("localhost/library/source:latest", func(bool) remotes.Resolver {
+		return fetcher
+	})
+	require.NoError(t, err)
+	sources, err := DefaultSource(context.Background(), remote, t.TempDir(), "linux/amd64")
+	require.NoError(t, err)
+	require.Len(t, sources, 1)
+	layers, err := sources[0].Layers(context.Background())
+	require.NoError(t, err)
+	require.Len(t, layers, 1)
+	return layers[0]
+}
+
+func TestMountRetryTruncatedLayer(t *testing.T) {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	data := []byte("source layer")
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "file", Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg}))
+	_, err := tw.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+	layer := buf.Bytes()
+
+	// The truncated download is pulled again.
+	fetcher := &testFetcher{fetches: [][]byte{layer[:len(layer)/2], layer}}
+	mounts, umount, err := testSourceLayer(t, fetcher, layer).Mount(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 2, fetcher.count)
+	unpacked, err := os.ReadFile(filepath.Join(mounts[0].Source, "file"))
+	require.NoError(t, err)
+	require.Equal(t, data, unpacked)
+	require.NoError(t, umount())
+
+	// The layer is pulled up to the default attempts.
+	fetcher = &testFetcher{fetches: [][]byte{layer[:len(layer)/2]}}
+	_, _, err = testSourceLayer(t, fetcher, layer).Mount(context.Background())
+	require.Error(t, err)
+	require.Equal(t, 3, fetcher.count)
+
+	// The layer of unsupported format isn't pulled again.
+	notGzip := bytes.Repeat([]byte("not gzip"), 128)
+	fetcher = &testFetcher{fetches: [][]byte{notGzip}}
+	_, _, err = testSourceLayer(t, fetcher, notGzip).Mount(context.Background())
+	require.Error(t, err)
+	require.Equal(t, 1, fetcher.count)
+}
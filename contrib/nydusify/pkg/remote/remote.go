@@ -10,11 +10,14 @@ import (
 	"io"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
 	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
@@ -29,7 +32,9 @@ type Remote struct {
 	// the resolver does not re-apply for a new token, so it's better to create a
 	// new resolver instance using resolverFunc for each request.
 	resolverFunc func(insecure bool) remotes.Resolver
-	pushed       sync.Map
+	// hostsFunc returns the registry hosts for PushStream.
+	hostsFunc func(insecure bool) docker.RegistryHosts
+	pushed    sync.Map
 
 	retryWithHTTP bool
 }
@@ -135,3 +140,41 @@ func (remote *Remote) Resolve(ctx context.Context) (*ocispec.Descriptor, error)
 
 	return &desc, nil
 }
+
+// CheckPush probes the push permission of the repository, see ProbePush.
+func (remote *Remote) CheckPush(ctx context.Context) error {
+	ref := reference.TagNameOnly(remote.parsed).String()
+	return ProbePush(ctx, remote.resolverFunc(remote.retryWithHTTP), ref)
+}
+
+// ProbePush probes the push permission of the repository of ref by
+// initiating a blob upload and canceling it before any content is written.
+// The probe blob is random to never exist in repository, the canceled
+// upload session is left to be cleaned up by registry.
+func ProbePush(ctx context.Context, resolver remotes.Resolver, ref string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	pusher, err := resolver.Pusher(ctx, ref)
+	if err != nil {
+		return err
+	}
+
+	probe := []byte(fmt.Sprintf("nydusify push permission probe %d", time.Now().UnixNano()))
+	writer, err := pusher.Push(ctx, ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayer,
+		Digest:    digest.FromBytes(probe),
+		Size:      int64(len(probe)),
+	})
+	if err != nil {
+		if errdefs.IsAlreadyExists(err) {
+			return nil
+		}
+		return err
+	}
+	// The empty write returns once the upload request starts streaming or
+	// fails, closing the writer before that races with the docker pusher.
+	_, _ = writer.Write(nil)
+	cancel()
+	writer.Close()
+	return nil
+}
@@ -0,0 +1,189 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package remote
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// SetRegistryHosts sets the registry hosts configured like the resolver,
+// which are required by PushStream to upload blobs by the HTTP API of
+// registry directly.
+func (remote *Remote) SetRegistryHosts(hostsFunc func(insecure bool) docker.RegistryHosts) {
+	remote.hostsFunc = hostsFunc
+}
+
+type countWriter struct {
+	size int64
+}
+
+func (writer *countWriter) Write(p []byte) (int, error) {
+	writer.size += int64(len(p))
+	return len(p), nil
+}
+
+// PushStream pushes the blob data of unknown size and digest in reader to
+// the repository of remote in one pass, the digest and size are computed
+// while streaming and returned in the descriptor of media type and
+// annotations of desc, so that the data doesn't need to be staged on disk,
+// e.g. the blob compressed on the fly.
+//
+// The data is uploaded in a single request without Content-Length if
+// chunkSize is 0, otherwise in the chunks of chunkSize buffered in memory
+// with Content-Length, for the registries requiring it.
+func (remote *Remote) PushStream(ctx context.Context, desc ocispec.Descriptor, reader io.Reader, chunkSize int64) (*ocispec.Descriptor, error) {
+	if remote.hostsFunc == nil {
+		return nil, errors.New("registry hosts aren't configured for streaming push")
+	}
+	domain := reference.Domain(remote.parsed)
+	hosts, err := remote.hostsFunc(remote.retryWithHTTP)(domain)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get registry hosts of %s", domain)
+	}
+	var host *docker.RegistryHost
+	for idx := range hosts {
+		if hosts[idx].Capabilities.Has(docker.HostCapabilityPush) {
+			host = &hosts[idx]
+			break
+		}
+	}
+	if host == nil {
+		return nil, errors.Errorf("no registry host of %s to push", domain)
+	}
+
+	uploadURL := fmt.Sprintf("%s://%s%s/%s/blobs/uploads/", host.Scheme, host.Host, host.Path, reference.Path(remote.parsed))
+	resp, err := remote.do(ctx, host, http.MethodPost, uploadURL, nil, 0, "")
+	if err != nil {
+		return nil, errors.Wrap(err, "start blob upload")
+	}
+	location, err := uploadLocation(resp, http.StatusAccepted)
+	if err != nil {
+		return nil, errors.Wrap(err, "start blob upload")
+	}
+
+	digester := digest.SHA256.Digester()
+	counter := &countWriter{}
+	tee := io.TeeReader(reader, io.MultiWriter(digester.Hash(), counter))
+	if chunkSize <= 0 {
+		// The streamed body can't be replayed on the authorization challenge,
+		// the token is granted by the request starting upload already.
+		if resp, err = remote.do(ctx, host, http.MethodPatch, location, tee, -1, ""); err != nil {
+			return nil, errors.Wrap(err, "upload blob data")
+		}
+		if location, err = uploadLocation(resp, http.StatusAccepted); err != nil {
+			return nil, errors.Wrap(err, "upload blob data")
+		}
+	} else {
+		buf := make([]byte, chunkSize)
+		for {
+			start := counter.size
+			n, readErr := io.ReadFull(tee, buf)
+			if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+				return nil, errors.Wrap(readErr, "read blob data")
+			}
+			if n > 0 {
+				contentRange := fmt.Sprintf("%d-%d", start, start+int64(n)-1)
+				if resp, err = remote.do(ctx, host, http.MethodPatch, location, bytes.NewReader(buf[:n]), int64(n), contentRange); err != nil {
+					return nil, errors.Wrapf(err, "upload blob chunk %s", contentRange)
+				}
+				if location, err = uploadLocation(resp, http.StatusAccepted); err != nil {
+					return nil, errors.Wrapf(err, "upload blob chunk %s", contentRange)
+				}
+			}
+			if readErr != nil {
+				break
+			}
+		}
+	}
+
+	dgst := digester.Digest()
+	commitURL, err := url.Parse(location)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse upload location %s", location)
+	}
+	query := commitURL.Query()
+	query.Set("digest", dgst.String())
+	commitURL.RawQuery = query.Encode()
+	if resp, err = remote.do(ctx, host, http.MethodPut, commitURL.String(), nil, 0, ""); err != nil {
+		return nil, errors.Wrap(err, "commit blob upload")
+	}
+	if _, err := uploadLocation(resp, http.StatusCreated); err != nil {
+		return nil, errors.Wrap(err, "commit blob upload")
+	}
+
+	pushed := desc
+	pushed.Digest = dgst
+	pushed.Size = counter.size
+	return &pushed, nil
+}
+
+// do sends the request of registry API authorized by host, the request
+// without body is retried once on the authorization challenge.
+func (remote *Remote) do(ctx context.Context, host *docker.RegistryHost, method, url string, body io.Reader, size int64, contentRange string) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, url, body)
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = size
+		if body != nil {
+			req.Header.Set("Content-Type", "application/octet-stream")
+		}
+		if contentRange != "" {
+			req.Header.Set("Content-Range", contentRange)
+		}
+		if host.Authorizer != nil {
+			if err := host.Authorizer.Authorize(ctx, req); err != nil {
+				return nil, errors.Wrap(err, "authorize request")
+			}
+		}
+		client := host.Client
+		if client == nil {
+			client = http.DefaultClient
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusUnauthorized || host.Authorizer == nil || attempt > 0 || (body != nil && contentRange == "") {
+			return resp, nil
+		}
+		resp.Body.Close()
+		if err := host.Authorizer.AddResponses(ctx, []*http.Response{resp}); err != nil {
+			return nil, errors.Wrap(err, "add authorization challenge")
+		}
+		if seeker, ok := body.(io.Seeker); ok {
+			if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// uploadLocation checks the response of upload request by the expected
+// status, and returns the absolute location of the next request.
+func uploadLocation(resp *http.Response, expected int) (string, error) {
+	defer resp.Body.Close()
+	if resp.StatusCode != expected {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", errors.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(data))
+	}
+	location, err := resp.Request.URL.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return "", errors.Wrapf(err, "parse upload location %s", resp.Header.Get("Location"))
+	}
+	return location.String(), nil
+}
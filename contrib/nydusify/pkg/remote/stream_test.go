@@ -0,0 +1,120 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package remote
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// uploadRegistry serves the blob uploads of registry API, the PATCH
+// requests without Content-Length are rejected if requireLength.
+type uploadRegistry struct {
+	mutex         sync.Mutex
+	requireLength bool
+	uploads       map[string]*bytes.Buffer
+	blobs         map[digest.Digest][]byte
+	patches       []int64
+}
+
+func (registry *uploadRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	prefix := "/v2/library/test/blobs/uploads/"
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == prefix:
+		id := fmt.Sprintf("%d", len(registry.uploads))
+		registry.uploads[id] = &bytes.Buffer{}
+		w.Header().Set("Location", prefix+id)
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == http.MethodPatch && strings.HasPrefix(r.URL.Path, prefix):
+		upload := registry.uploads[strings.TrimPrefix(r.URL.Path, prefix)]
+		if registry.requireLength && r.ContentLength < 0 {
+			w.WriteHeader(http.StatusLengthRequired)
+			return
+		}
+		if r.ContentLength >= 0 {
+			var start, end int64
+			_, err := fmt.Sscanf(r.Header.Get("Content-Range"), "%d-%d", &start, &end)
+			if err != nil || start != int64(upload.Len()) || end-start+1 != r.ContentLength {
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+		}
+		n, _ := io.Copy(upload, r.Body)
+		registry.patches = append(registry.patches, n)
+		w.Header().Set("Location", r.URL.Path)
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, prefix):
+		upload := registry.uploads[strings.TrimPrefix(r.URL.Path, prefix)]
+		dgst := digest.Digest(r.URL.Query().Get("digest"))
+		if dgst != digest.FromBytes(upload.Bytes()) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		registry.blobs[dgst] = upload.Bytes()
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestPushStream(t *testing.T) {
+	registry := &uploadRegistry{uploads: map[string]*bytes.Buffer{}, blobs: map[digest.Digest][]byte{}}
+	server := httptest.NewServer(registry)
+	defer server.Close()
+
+	hostsFunc := func(bool) docker.RegistryHosts {
+		return docker.ConfigureDefaultRegistries(docker.WithPlainHTTP(docker.MatchAllHosts))
+	}
+	remote, err := New(strings.TrimPrefix(server.URL, "http://")+"/library/test:latest", func(insecure bool) remotes.Resolver {
+		return docker.NewResolver(docker.ResolverOptions{Hosts: hostsFunc(insecure)})
+	})
+	require.NoError(t, err)
+	data := bytes.Repeat([]byte("nydus"), 1000)
+	desc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerGzip, Annotations: map[string]string{"key": "value"}}
+
+	_, err = remote.PushStream(context.Background(), desc, bytes.NewReader(data), 0)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "registry hosts aren't configured")
+	remote.SetRegistryHosts(hostsFunc)
+
+	// The reader hides the size of data.
+	pushed, err := remote.PushStream(context.Background(), desc, io.MultiReader(bytes.NewReader(data)), 0)
+	require.NoError(t, err)
+	require.Equal(t, digest.FromBytes(data), pushed.Digest)
+	require.Equal(t, int64(len(data)), pushed.Size)
+	require.Equal(t, desc.MediaType, pushed.MediaType)
+	require.Equal(t, desc.Annotations, pushed.Annotations)
+	require.Equal(t, data, registry.blobs[pushed.Digest])
+	require.Equal(t, []int64{int64(len(data))}, registry.patches)
+
+	// The registry requiring Content-Length accepts the chunks only.
+	registry.requireLength = true
+	data = append(data, 'x')
+	_, err = remote.PushStream(context.Background(), desc, io.MultiReader(bytes.NewReader(data)), 0)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "411")
+	registry.patches = nil
+	pushed, err = remote.PushStream(context.Background(), desc, io.MultiReader(bytes.NewReader(data)), 2048)
+	require.NoError(t, err)
+	require.Equal(t, digest.FromBytes(data), pushed.Digest)
+	require.Equal(t, int64(len(data)), pushed.Size)
+	require.Equal(t, data, registry.blobs[pushed.Digest])
+	require.Equal(t, []int64{2048, 2048, 905}, registry.patches)
+}
@@ -15,10 +15,33 @@ import (
 	"golang.org/x/sys/unix"
 
 	"github.com/containerd/containerd/archive"
-	"github.com/containerd/containerd/archive/compression"
+	"github.com/containerd/containerd/pkg/userns"
 	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
 )
 
+// canCreateDeviceNode reports whether the device nodes in layer can be
+// created, which requires root privileges outside of user namespace.
+var canCreateDeviceNode = func() bool {
+	return os.Geteuid() == 0 && !userns.RunningInUserNS()
+}
+
+// deviceNodeFilter fails the unpacking on the first device node in layer if
+// it can't be created, instead of an obscure mknod error or skipping the
+// device node silently in user namespace.
+func deviceNodeFilter(hdr *tar.Header) (bool, error) {
+	if hdr.Typeflag != tar.TypeChar && hdr.Typeflag != tar.TypeBlock {
+		return true, nil
+	}
+	if !canCreateDeviceNode() {
+		return false, errors.Errorf(
+			"can't create device node %s (%d:%d) without root privileges, please run nydusify as root outside of user namespace",
+			hdr.Name, hdr.Devmajor, hdr.Devminor,
+		)
+	}
+	return true, nil
+}
+
 // PackTargz makes .tar(.gz) stream of file named `name` and return reader
 func PackTargz(src string, name string, compress bool) (io.ReadCloser, error) {
 	fi, err := os.Stat(src)
@@ -132,7 +155,30 @@ func PackTargzInfo(src, name string, compress bool) (digest.Digest, int64, error
 
 // UnpackTargz unpacks .tar(.gz) stream, and write to dst path
 func UnpackTargz(ctx context.Context, dst string, r io.Reader, overlay bool) error {
-	ds, err := compression.DecompressStream(r)
+	return UnpackLayer(ctx, dst, r, "", overlay)
+}
+
+// UnpackLayer unpacks the layer stream of media type to dst path, the layer
+// is decompressed by the compression mapped from media type, see DecompressLayer.
+// The long names of GNU/PAX extensions, FIFOs and device nodes are restored,
+// and the device nodes require root privileges. The whiteouts are converted
+// to overlayfs if overlay, otherwise preserved.
+func UnpackLayer(ctx context.Context, dst string, r io.Reader, mediaType string, overlay bool) error {
+	policy := WhiteoutPolicyPreserve
+	if overlay {
+		policy = WhiteoutPolicyOverlayfs
+	}
+	return UnpackLayerWithWhiteoutPolicy(ctx, dst, r, mediaType, policy)
+}
+
+// UnpackLayerWithWhiteoutPolicy is UnpackLayer translating the whiteouts of
+// layer by policy, see WhiteoutPolicies.
+func UnpackLayerWithWhiteoutPolicy(ctx context.Context, dst string, r io.Reader, mediaType string, policy string) error {
+	opts, err := whiteoutApplyOptions(policy)
+	if err != nil {
+		return err
+	}
+	ds, err := DecompressLayer(r, mediaType)
 	if err != nil {
 		return err
 	}
@@ -146,25 +192,7 @@ func UnpackTargz(ctx context.Context, dst string, r io.Reader, overlay bool) err
 		return err
 	}
 
-	if overlay {
-		_, err = archive.Apply(
-			ctx,
-			dst,
-			ds,
-			archive.WithConvertWhiteout(archive.OverlayConvertWhiteout),
-		)
-	} else {
-		_, err = archive.Apply(
-			ctx,
-			dst,
-			ds,
-			archive.WithConvertWhiteout(func(_ *tar.Header, _ string) (bool, error) {
-				return true, nil
-			}),
-		)
-	}
-
-	if err != nil {
+	if _, err := archive.Apply(ctx, dst, ds, opts...); err != nil {
 		return err
 	}
 
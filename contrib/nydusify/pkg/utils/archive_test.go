@@ -6,10 +6,17 @@
 package utils
 
 import (
+	"archive/tar"
+	"bytes"
+	"context"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
 )
 
 func TestPackTargzInfo(t *testing.T) {
@@ -26,3 +33,52 @@ func TestPackTargzInfo(t *testing.T) {
 	assert.Equal(t, "sha256:6cdd1b26d54d5852fbea95a81cbb25383975b70b4ffad9f9b6d25c7a434a51eb", digest.String())
 	assert.Equal(t, size, int64(315))
 }
+
+func TestUnpackLayerSpecialEntries(t *testing.T) {
+	// The names longer than 100 bytes are stored by GNU/PAX extensions.
+	longDir := strings.Repeat("d", 150)
+	paxName := longDir + "/" + strings.Repeat("p", 200)
+	gnuName := longDir + "/" + strings.Repeat("g", 200)
+	unicodeName := "目录/файл-🙂 with space"
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []*tar.Header{
+		{Name: longDir, Mode: 0755, Typeflag: tar.TypeDir, Format: tar.FormatPAX},
+		{Name: paxName, Mode: 0644, Typeflag: tar.TypeReg, Format: tar.FormatPAX},
+		{Name: gnuName, Mode: 0644, Typeflag: tar.TypeReg, Format: tar.FormatGNU},
+		{Name: "目录", Mode: 0755, Typeflag: tar.TypeDir, Format: tar.FormatPAX},
+		{Name: unicodeName, Mode: 0644, Typeflag: tar.TypeReg, Format: tar.FormatPAX},
+		{Name: "fifo", Mode: 0600, Typeflag: tar.TypeFifo},
+		{Name: "null", Mode: 0666, Typeflag: tar.TypeChar, Devmajor: 1, Devminor: 3},
+	} {
+		require.NoError(t, tw.WriteHeader(hdr))
+	}
+	require.NoError(t, tw.Close())
+	layer := buf.Bytes()
+
+	if canCreateDeviceNode() {
+		dst := t.TempDir()
+		require.NoError(t, UnpackTargz(context.Background(), dst, bytes.NewReader(layer), false))
+		for _, name := range []string{paxName, gnuName, unicodeName} {
+			_, err := os.Stat(filepath.Join(dst, name))
+			require.NoError(t, err, name)
+		}
+
+		var stat unix.Stat_t
+		require.NoError(t, unix.Lstat(filepath.Join(dst, "fifo"), &stat))
+		require.Equal(t, uint32(unix.S_IFIFO), stat.Mode&unix.S_IFMT)
+		require.NoError(t, unix.Lstat(filepath.Join(dst, "null"), &stat))
+		require.Equal(t, uint32(unix.S_IFCHR), stat.Mode&unix.S_IFMT)
+		require.Equal(t, uint32(1), unix.Major(uint64(stat.Rdev)))
+		require.Equal(t, uint32(3), unix.Minor(uint64(stat.Rdev)))
+	}
+
+	// The device node fails the unpacking clearly without privileges.
+	canCreate := canCreateDeviceNode
+	canCreateDeviceNode = func() bool { return false }
+	defer func() { canCreateDeviceNode = canCreate }()
+	err := UnpackTargz(context.Background(), t.TempDir(), bytes.NewReader(layer), false)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "can't create device node null (1:3) without root privileges")
+}
@@ -0,0 +1,282 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/containerd/containerd/archive/compression"
+	"github.com/containerd/containerd/images"
+	"github.com/klauspost/compress/zstd"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+var layerCompressionsLock sync.RWMutex
+
+// layerCompressions maps the media type of layer to its compression, the
+// layers of unknown media type are decompressed by detecting magic number.
+var layerCompressions = map[string]compression.Compression{
+	ocispec.MediaTypeImageLayer:                     compression.Uncompressed,
+	ocispec.MediaTypeImageLayerGzip:                 compression.Gzip,
+	ocispec.MediaTypeImageLayerZstd:                 compression.Zstd,
+	ocispec.MediaTypeImageLayerNonDistributable:     compression.Uncompressed, //nolint:staticcheck
+	ocispec.MediaTypeImageLayerNonDistributableGzip: compression.Gzip,         //nolint:staticcheck
+	ocispec.MediaTypeImageLayerNonDistributableZstd: compression.Zstd,         //nolint:staticcheck
+	images.MediaTypeDockerSchema2Layer:              compression.Uncompressed,
+	images.MediaTypeDockerSchema2LayerGzip:          compression.Gzip,
+	images.MediaTypeDockerSchema2LayerForeign:       compression.Uncompressed,
+	images.MediaTypeDockerSchema2LayerForeignGzip:   compression.Gzip,
+}
+
+// ParseCompression parses the compression name: none, gzip or zstd.
+func ParseCompression(name string) (compression.Compression, error) {
+	switch strings.ToLower(name) {
+	case "none", "uncompressed":
+		return compression.Uncompressed, nil
+	case "gzip":
+		return compression.Gzip, nil
+	case "zstd":
+		return compression.Zstd, nil
+	}
+	return compression.Uncompressed, fmt.Errorf("unsupported compression %s, possible values: none, gzip, zstd", name)
+}
+
+// RegisterLayerCompression registers or overrides the compression of layers
+// in the media type, it's used to support the custom layer media types.
+func RegisterLayerCompression(mediaType string, comp compression.Compression) {
+	layerCompressionsLock.Lock()
+	defer layerCompressionsLock.Unlock()
+	layerCompressions[mediaType] = comp
+}
+
+// ParseLayerCompression registers the layer compression in the format of
+// `<media-type>=<compression>`, for example `application/vnd.custom.layer=gzip`.
+func ParseLayerCompression(mapping string) error {
+	idx := strings.LastIndex(mapping, "=")
+	if idx <= 0 {
+		return fmt.Errorf("invalid layer compression %s, should be in the format '<media-type>=<compression>'", mapping)
+	}
+	comp, err := ParseCompression(mapping[idx+1:])
+	if err != nil {
+		return err
+	}
+	RegisterLayerCompression(mapping[:idx], comp)
+	return nil
+}
+
+// LayerCompression returns the compression of layers in the media type, the
+// second return value reports whether the media type is known.
+func LayerCompression(mediaType string) (compression.Compression, bool) {
+	layerCompressionsLock.RLock()
+	defer layerCompressionsLock.RUnlock()
+	comp, ok := layerCompressions[mediaType]
+	return comp, ok
+}
+
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (rc *readCloser) Close() error {
+	return rc.close()
+}
+
+var (
+	bzip2Magic = []byte{'B', 'Z', 'h'}
+	xzMagic    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+)
+
+// isBzip2 reports whether the header is a bzip2 stream, the block size digit
+// and the block magic are checked as well, since the plain tar may start
+// with the file name `BZh`.
+func isBzip2(header []byte) bool {
+	return len(header) >= 10 && bytes.HasPrefix(header, bzip2Magic) &&
+		header[3] >= '1' && header[3] <= '9' &&
+		bytes.Equal(header[4:10], []byte{0x31, 0x41, 0x59, 0x26, 0x53, 0x59})
+}
+
+// IsLegacyCompressed reports whether the header of layer is a bzip2 or xz
+// stream, which DecompressLayer detects for the unknown and the uncompressed
+// media types.
+func IsLegacyCompressed(header []byte) bool {
+	return bytes.HasPrefix(header, xzMagic) || isBzip2(header)
+}
+
+// decompressThreads is the number of threads decompressing each layer, see
+// SetDecompressThreads.
+var decompressThreads atomic.Int32
+
+// SetDecompressThreads sets the number of threads decompressing each zstd or
+// gzip layer in DecompressLayer, 0 means the default of decompressor. The
+// gzip layer is decompressed by the `unpigz` binary in multiple threads if
+// it's found, as the gzip decompressor in the standard library runs in a
+// single thread.
+func SetDecompressThreads(threads int) {
+	decompressThreads.Store(int32(threads))
+}
+
+// decompressSlots limits the layers being decompressed at once, see
+// SetDecompressLayers.
+var decompressSlots atomic.Pointer[chan struct{}]
+
+// SetDecompressLayers limits the number of layers being decompressed at once
+// by DecompressLayer, the slot of layer is released once its reader is
+// closed, 0 means unlimited.
+func SetDecompressLayers(layers int) {
+	if layers <= 0 {
+		decompressSlots.Store(nil)
+		return
+	}
+	slots := make(chan struct{}, layers)
+	decompressSlots.Store(&slots)
+}
+
+// commandReader reads the output of the binary decompressing the stream.
+type commandReader struct {
+	*io.PipeReader
+	done chan struct{}
+}
+
+func newCommandReader(reader io.Reader, name, path string, args ...string) (io.ReadCloser, error) {
+	pr, pw := io.Pipe()
+	var stderr bytes.Buffer
+	cmd := exec.Command(path, args...)
+	cmd.Stdin = reader
+	cmd.Stdout = pw
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Wrapf(err, "start %s", name)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := cmd.Wait(); err != nil {
+			pw.CloseWithError(errors.Wrapf(err, "decompress layer by %s: %s", name, strings.TrimSpace(stderr.String())))
+			return
+		}
+		pw.Close()
+	}()
+
+	return &commandReader{PipeReader: pr, done: done}, nil
+}
+
+// Close stops the binary and waits for its exit, so that the source stream
+// isn't read after closing.
+func (reader *commandReader) Close() error {
+	reader.PipeReader.Close()
+	<-reader.done
+	return nil
+}
+
+// XzBinary is the binary decompressing the xz layers, which is looked up in
+// PATH, as there is no xz decompressor in the standard library.
+const XzBinary = "xz"
+
+// newXzReader decompresses the xz stream by XzBinary.
+func newXzReader(reader io.Reader) (io.ReadCloser, error) {
+	path, err := exec.LookPath(XzBinary)
+	if err != nil {
+		return nil, errors.Wrapf(err, "xz layer requires the %s binary in PATH, which can be validated by `nydusify doctor`", XzBinary)
+	}
+	return newCommandReader(reader, "xz", path, "-d", "-c", "-q")
+}
+
+// decompressLegacyLayer decompresses the bzip2 or xz layer detected by magic
+// number, which is used by some legacy images, it returns nil reader for
+// other layers with the buffered stream to continue reading from.
+func decompressLegacyLayer(reader io.Reader) (io.ReadCloser, io.Reader, error) {
+	buffered := bufio.NewReader(reader)
+	// The short or empty stream is left to the following decompression.
+	header, _ := buffered.Peek(10)
+
+	if bytes.HasPrefix(header, xzMagic) {
+		xzReader, err := newXzReader(buffered)
+		return xzReader, nil, err
+	}
+	if isBzip2(header) {
+		return io.NopCloser(bzip2.NewReader(buffered)), nil, nil
+	}
+
+	return nil, buffered, nil
+}
+
+// DecompressLayer decompresses the layer stream by the compression of media
+// type, and falls back to detect the compression for unknown media types.
+// The bzip2 and xz compressions, which have no layer media types, are
+// detected for both the unknown and the uncompressed media types. It waits
+// for a free slot if the layers are limited by SetDecompressLayers.
+func DecompressLayer(reader io.Reader, mediaType string) (io.ReadCloser, error) {
+	slots := decompressSlots.Load()
+	if slots == nil {
+		return decompressLayer(reader, mediaType)
+	}
+	*slots <- struct{}{}
+	decompressed, err := decompressLayer(reader, mediaType)
+	if err != nil {
+		<-*slots
+		return nil, err
+	}
+	var release sync.Once
+	return &readCloser{Reader: decompressed, close: func() error {
+		defer release.Do(func() { <-*slots })
+		return decompressed.Close()
+	}}, nil
+}
+
+func decompressLayer(reader io.Reader, mediaType string) (io.ReadCloser, error) {
+	comp, ok := LayerCompression(mediaType)
+	if !ok || comp == compression.Uncompressed {
+		decompressed, buffered, err := decompressLegacyLayer(reader)
+		if err != nil || decompressed != nil {
+			return decompressed, err
+		}
+		reader = buffered
+	}
+	if !ok {
+		return compression.DecompressStream(reader)
+	}
+
+	switch comp {
+	case compression.Gzip:
+		if threads := int(decompressThreads.Load()); threads > 1 {
+			if path, err := exec.LookPath("unpigz"); err == nil {
+				return newCommandReader(reader, "unpigz", path, "-d", "-c", "-p", strconv.Itoa(threads))
+			}
+		}
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, errors.Wrapf(err, "create gzip reader for layer of %s", mediaType)
+		}
+		return gzipReader, nil
+	case compression.Zstd:
+		var opts []zstd.DOption
+		if threads := int(decompressThreads.Load()); threads > 0 {
+			opts = append(opts, zstd.WithDecoderConcurrency(threads))
+		}
+		zstdReader, err := zstd.NewReader(reader, opts...)
+		if err != nil {
+			return nil, errors.Wrapf(err, "create zstd reader for layer of %s", mediaType)
+		}
+		return &readCloser{Reader: zstdReader, close: func() error {
+			zstdReader.Close()
+			return nil
+		}}, nil
+	}
+
+	return io.NopCloser(reader), nil
+}
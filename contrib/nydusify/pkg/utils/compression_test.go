@@ -0,0 +1,222 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package utils
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/archive/compression"
+	"github.com/klauspost/compress/zstd"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func compressTestData(t *testing.T, comp compression.Compression, data []byte) []byte {
+	var buf bytes.Buffer
+	switch comp {
+	case compression.Gzip:
+		writer := gzip.NewWriter(&buf)
+		_, err := writer.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, writer.Close())
+	case compression.Zstd:
+		writer, err := zstd.NewWriter(&buf)
+		require.NoError(t, err)
+		_, err = writer.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, writer.Close())
+	default:
+		buf.Write(data)
+	}
+	return buf.Bytes()
+}
+
+func TestParseLayerCompression(t *testing.T) {
+	require.NoError(t, ParseLayerCompression("application/vnd.test.layer.v1=zstd"))
+	comp, ok := LayerCompression("application/vnd.test.layer.v1")
+	require.True(t, ok)
+	require.Equal(t, compression.Zstd, comp)
+
+	require.Error(t, ParseLayerCompression("application/vnd.test.layer.v1"))
+	require.Error(t, ParseLayerCompression("=gzip"))
+	require.Error(t, ParseLayerCompression("application/vnd.test.layer.v1=bzip2"))
+}
+
+func TestDecompressLayer(t *testing.T) {
+	data := []byte("layer data")
+
+	for _, tc := range []struct {
+		mediaType string
+		comp      compression.Compression
+	}{
+		{ocispec.MediaTypeImageLayer, compression.Uncompressed},
+		{ocispec.MediaTypeImageLayerGzip, compression.Gzip},
+		{ocispec.MediaTypeImageLayerZstd, compression.Zstd},
+		// Unknown media type is detected by magic number.
+		{"application/vnd.unknown.layer", compression.Gzip},
+	} {
+		reader, err := DecompressLayer(bytes.NewReader(compressTestData(t, tc.comp, data)), tc.mediaType)
+		require.NoError(t, err)
+		decompressed, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		require.NoError(t, reader.Close())
+		require.Equal(t, data, decompressed)
+	}
+
+	// Mapped media type is decompressed explicitly without detecting.
+	_, err := DecompressLayer(bytes.NewReader(data), ocispec.MediaTypeImageLayerGzip)
+	require.Error(t, err)
+}
+
+func TestUnpackLayerWithCustomMediaType(t *testing.T) {
+	var buf bytes.Buffer
+	writer := tar.NewWriter(&buf)
+	content := []byte("hello")
+	require.NoError(t, writer.WriteHeader(&tar.Header{Name: "hello.txt", Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}))
+	_, err := writer.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	mediaType := "application/vnd.custom.image.layer.v1+zst"
+	RegisterLayerCompression(mediaType, compression.Zstd)
+	defer func() {
+		layerCompressionsLock.Lock()
+		delete(layerCompressions, mediaType)
+		layerCompressionsLock.Unlock()
+	}()
+
+	dst := t.TempDir()
+	layer := compressTestData(t, compression.Zstd, buf.Bytes())
+	require.NoError(t, UnpackLayer(context.Background(), dst, bytes.NewReader(layer), mediaType, false))
+	data, err := os.ReadFile(filepath.Join(dst, "hello.txt"))
+	require.NoError(t, err)
+	require.Equal(t, content, data)
+}
+
+func TestUnpackLegacyCompressedLayer(t *testing.T) {
+	for _, fixture := range []string{"layer.tar.bz2", "layer.tar.xz"} {
+		layer, err := os.ReadFile(filepath.Join("testdata", fixture))
+		require.NoError(t, err)
+		require.True(t, IsLegacyCompressed(layer), fixture)
+		if filepath.Ext(fixture) == ".xz" {
+			if _, err := exec.LookPath("xz"); err != nil {
+				t.Logf("skip %s as xz binary isn't found", fixture)
+				continue
+			}
+		}
+
+		// The compression is detected for both the plain tar and the
+		// unknown media types.
+		for _, mediaType := range []string{ocispec.MediaTypeImageLayer, ""} {
+			dst := t.TempDir()
+			require.NoError(t, UnpackLayer(context.Background(), dst, bytes.NewReader(layer), mediaType, false), fixture)
+			data, err := os.ReadFile(filepath.Join(dst, "dir", "file"))
+			require.NoError(t, err)
+			require.Equal(t, "legacy layer\n", string(data))
+		}
+
+		file, err := os.Open(filepath.Join("testdata", fixture))
+		require.NoError(t, err)
+		verified, err := VerifyLayer(file, ocispec.MediaTypeImageLayer, int64(len(layer)), t.TempDir())
+		require.NoError(t, err)
+		require.NoError(t, verified.Close())
+		require.NoError(t, file.Close())
+
+		// The truncated layer is reported.
+		_, err = VerifyLayer(bytes.NewReader(layer[:len(layer)/2]), ocispec.MediaTypeImageLayer, 0, t.TempDir())
+		require.Error(t, err, fixture)
+	}
+
+	// The plain tar starting with the bzip2 magic isn't decompressed.
+	var buf bytes.Buffer
+	writer := tar.NewWriter(&buf)
+	require.NoError(t, writer.WriteHeader(&tar.Header{Name: "BZh9.txt", Mode: 0644, Typeflag: tar.TypeReg}))
+	require.NoError(t, writer.Close())
+	require.False(t, IsLegacyCompressed(buf.Bytes()))
+	reader, err := DecompressLayer(bytes.NewReader(buf.Bytes()), ocispec.MediaTypeImageLayer)
+	require.NoError(t, err)
+	require.NoError(t, VerifyTar(reader))
+	require.NoError(t, reader.Close())
+}
+
+func TestDecompressThreads(t *testing.T) {
+	defer SetDecompressThreads(0)
+	content := []byte("decompressed content")
+
+	// The fake unpigz records its arguments and outputs the test content.
+	binDir := t.TempDir()
+	argsPath := filepath.Join(binDir, "args")
+	script := "#!/bin/sh\necho \"$@\" > " + argsPath + "\ncat > /dev/null\nprintf 'unpigz output'\n"
+	require.NoError(t, os.WriteFile(filepath.Join(binDir, "unpigz"), []byte(script), 0755))
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	for _, threads := range []int{0, 1, 3} {
+		os.Remove(argsPath)
+		SetDecompressThreads(threads)
+		reader, err := DecompressLayer(bytes.NewReader(compressTestData(t, compression.Gzip, content)), ocispec.MediaTypeImageLayerGzip)
+		require.NoError(t, err)
+		data, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		require.NoError(t, reader.Close())
+
+		args, err := os.ReadFile(argsPath)
+		if threads > 1 {
+			require.NoError(t, err)
+			require.Equal(t, "-d -c -p 3\n", string(args))
+			require.Equal(t, "unpigz output", string(data))
+		} else {
+			require.True(t, os.IsNotExist(err), threads)
+			require.Equal(t, content, data, threads)
+		}
+
+		// The zstd layer is decoded by the goroutines.
+		reader, err = DecompressLayer(bytes.NewReader(compressTestData(t, compression.Zstd, content)), ocispec.MediaTypeImageLayerZstd)
+		require.NoError(t, err)
+		data, err = io.ReadAll(reader)
+		require.NoError(t, err)
+		require.NoError(t, reader.Close())
+		require.Equal(t, content, data, threads)
+	}
+}
+
+func TestDecompressLayers(t *testing.T) {
+	defer SetDecompressLayers(0)
+	SetDecompressLayers(1)
+	content := compressTestData(t, compression.Gzip, []byte("decompressed content"))
+
+	first, err := DecompressLayer(bytes.NewReader(content), ocispec.MediaTypeImageLayerGzip)
+	require.NoError(t, err)
+
+	// The second layer waits for the first one to be closed.
+	opened := make(chan io.ReadCloser)
+	go func() {
+		second, err := DecompressLayer(bytes.NewReader(content), ocispec.MediaTypeImageLayerGzip)
+		require.NoError(t, err)
+		opened <- second
+	}()
+	select {
+	case <-opened:
+		t.Fatal("the second layer is decompressed beyond the limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	require.NoError(t, first.Close())
+	// Closing twice doesn't release the slot again.
+	require.NoError(t, first.Close())
+	second := <-opened
+	data, err := io.ReadAll(second)
+	require.NoError(t, err)
+	require.Equal(t, "decompressed content", string(data))
+	require.NoError(t, second.Close())
+}
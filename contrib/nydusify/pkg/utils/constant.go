@@ -10,6 +10,10 @@ const (
 	BootstrapFileNameInLayer = "image/image.boot"
 
 	ManifestNydusCache = "containerd.io/snapshot/nydus-cache"
+	// ManifestNydusSourceDigest records the digest of source manifest in the
+	// annotations of nydus manifest, and optionally in the labels of nydus
+	// image config.
+	ManifestNydusSourceDigest = "containerd.io/snapshot/nydus-source-digest"
 
 	LayerAnnotationNydusBlob          = "containerd.io/snapshot/nydus-blob"
 	LayerAnnotationNydusBlobDigest    = "containerd.io/snapshot/nydus-blob-digest"
@@ -19,6 +23,17 @@ const (
 	LayerAnnotationNydusSourceChainID = "containerd.io/snapshot/nydus-source-chainid"
 
 	LayerAnnotationNydusReferenceBlobIDs = "containerd.io/snapshot/nydus-reference-blob-ids"
+	// LayerAnnotationNydusBlobIDs lists the IDs of the nydus blobs which are
+	// referenced by the bootstrap in a JSON array, in the annotations of
+	// bootstrap layer.
+	LayerAnnotationNydusBlobIDs = "containerd.io/snapshot/nydus-blob-ids"
+	// LayerAnnotationNydusBackend records the type of the storage backend,
+	// like "oss" or "s3", which stores the blobs referenced by the bootstrap
+	// but not in the manifest layers, in the annotations of bootstrap layer.
+	LayerAnnotationNydusBackend = "containerd.io/snapshot/nydus-backend"
+	// ManifestNydusSnapshotter advertises the snapshotter to lazily load the
+	// image in the annotations of nydus manifest.
+	ManifestNydusSnapshotter = "containerd.io/snapshot/nydus-snapshotter"
 
 	LayerAnnotationUncompressed = "containerd.io/uncompressed"
 
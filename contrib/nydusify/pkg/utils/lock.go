@@ -0,0 +1,20 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package utils
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// ErrLocked indicates the file lock is held by others.
+var ErrLocked = errors.New("file is locked")
+
+// FileLock is an exclusive advisory lock on a file, it works across
+// processes and is released when the process exits.
+type FileLock struct {
+	file *os.File
+}
@@ -0,0 +1,22 @@
+//go:build !unix
+
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package utils
+
+import (
+	"github.com/pkg/errors"
+)
+
+// LockFile is unsupported without flock, the build cache directory can't be
+// used on this platform.
+func LockFile(_ string, _ bool) (*FileLock, error) {
+	return nil, errors.New("file lock is unsupported on this platform")
+}
+
+// Unlock releases the file lock.
+func (lock *FileLock) Unlock() error {
+	return nil
+}
@@ -0,0 +1,46 @@
+//go:build unix
+
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package utils
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lock")
+
+	lock, err := LockFile(path, false)
+	require.NoError(t, err)
+
+	_, err = LockFile(path, false)
+	require.True(t, errors.Is(err, ErrLocked))
+
+	locked := make(chan *FileLock)
+	go func() {
+		lock, err := LockFile(path, true)
+		require.NoError(t, err)
+		locked <- lock
+	}()
+	select {
+	case <-locked:
+		require.Fail(t, "lock should be blocked")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	require.NoError(t, lock.Unlock())
+	select {
+	case lock := <-locked:
+		require.NoError(t, lock.Unlock())
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "lock should be acquired after unlocked")
+	}
+}
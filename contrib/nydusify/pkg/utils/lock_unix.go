@@ -0,0 +1,44 @@
+//go:build unix
+
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package utils
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// LockFile takes the exclusive lock on the file at path, it returns ErrLocked
+// immediately if the lock is held by others and wait is false, otherwise it
+// blocks until the lock is released.
+func LockFile(path string, wait bool) (*FileLock, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "open lock file")
+	}
+
+	how := syscall.LOCK_EX
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+	if err := syscall.Flock(int(file.Fd()), how); err != nil {
+		file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, ErrLocked
+		}
+		return nil, errors.Wrap(err, "lock file")
+	}
+
+	return &FileLock{file: file}, nil
+}
+
+// Unlock releases the file lock.
+func (lock *FileLock) Unlock() error {
+	defer lock.file.Close()
+	return syscall.Flock(int(lock.file.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,110 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package utils
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// BlobReader reads the content of a staged blob file.
+type BlobReader interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+	io.Closer
+	Size() int64
+}
+
+type fileBlobReader struct {
+	*os.File
+	size int64
+}
+
+func (reader *fileBlobReader) Size() int64 {
+	return reader.size
+}
+
+// mmapBlobReader reads the blob mapped into memory, the reads after Close
+// return os.ErrClosed rather than touching the unmapped memory.
+type mmapBlobReader struct {
+	mutex  sync.RWMutex
+	reader *bytes.Reader
+	data   []byte
+}
+
+func (reader *mmapBlobReader) Read(p []byte) (int, error) {
+	reader.mutex.RLock()
+	defer reader.mutex.RUnlock()
+	if reader.reader == nil {
+		return 0, os.ErrClosed
+	}
+	return reader.reader.Read(p)
+}
+
+func (reader *mmapBlobReader) ReadAt(p []byte, off int64) (int, error) {
+	reader.mutex.RLock()
+	defer reader.mutex.RUnlock()
+	if reader.reader == nil {
+		return 0, os.ErrClosed
+	}
+	return reader.reader.ReadAt(p, off)
+}
+
+func (reader *mmapBlobReader) Seek(offset int64, whence int) (int64, error) {
+	reader.mutex.RLock()
+	defer reader.mutex.RUnlock()
+	if reader.reader == nil {
+		return 0, os.ErrClosed
+	}
+	return reader.reader.Seek(offset, whence)
+}
+
+func (reader *mmapBlobReader) Size() int64 {
+	return int64(len(reader.data))
+}
+
+func (reader *mmapBlobReader) Close() error {
+	reader.mutex.Lock()
+	defer reader.mutex.Unlock()
+	if reader.data == nil {
+		return nil
+	}
+	data := reader.data
+	reader.reader, reader.data = nil, nil
+	return munmap(data)
+}
+
+// OpenBlob opens the staged blob file for reading, the file is mapped into
+// memory to reduce the data copies if useMmap is enabled, and falls back to
+// the normal file reading when mmap is unsupported or fails.
+func OpenBlob(path string, useMmap bool) (BlobReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "open blob file")
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, errors.Wrap(err, "stat blob file")
+	}
+
+	if useMmap && info.Size() > 0 {
+		data, err := mmap(file, info.Size())
+		if err == nil {
+			// The mapping is still valid after the file is closed.
+			file.Close()
+			return &mmapBlobReader{reader: bytes.NewReader(data), data: data}, nil
+		}
+		logrus.Debugf("fallback to read blob file %s without mmap: %s", path, err)
+	}
+
+	return &fileBlobReader{File: file, size: info.Size()}, nil
+}
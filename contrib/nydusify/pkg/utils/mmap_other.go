@@ -0,0 +1,21 @@
+//go:build !linux && !darwin && !freebsd
+
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package utils
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+func mmap(_ *os.File, _ int64) ([]byte, error) {
+	return nil, errors.New("mmap is unsupported on this platform")
+}
+
+func munmap(_ []byte) error {
+	return nil
+}
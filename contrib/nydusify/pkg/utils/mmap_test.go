@@ -0,0 +1,94 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package utils
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestBlob(t testing.TB, size int) (string, []byte) {
+	data := make([]byte, size)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "blob")
+	require.NoError(t, os.WriteFile(path, data, 0644))
+	return path, data
+}
+
+func TestOpenBlob(t *testing.T) {
+	path, data := writeTestBlob(t, 3<<20+123)
+
+	for _, useMmap := range []bool{true, false} {
+		reader, err := OpenBlob(path, useMmap)
+		require.NoError(t, err)
+		require.Equal(t, int64(len(data)), reader.Size())
+
+		// Uploaded bytes are identical with or without mmap.
+		var uploaded bytes.Buffer
+		_, err = io.Copy(&uploaded, reader)
+		require.NoError(t, err)
+		require.Equal(t, data, uploaded.Bytes())
+
+		buf := make([]byte, 100)
+		_, err = reader.ReadAt(buf, 1<<20)
+		require.NoError(t, err)
+		require.Equal(t, data[1<<20:1<<20+100], buf)
+
+		_, err = reader.Seek(10, io.SeekStart)
+		require.NoError(t, err)
+		_, err = io.ReadFull(reader, buf)
+		require.NoError(t, err)
+		require.Equal(t, data[10:110], buf)
+
+		require.NoError(t, reader.Close())
+		// Reading a closed blob fails rather than crashes.
+		_, err = reader.Read(buf)
+		require.ErrorIs(t, err, os.ErrClosed)
+		_, err = reader.ReadAt(buf, 0)
+		require.ErrorIs(t, err, os.ErrClosed)
+	}
+
+	// Fall back to normal reading for empty file which can't be mapped.
+	emptyPath := filepath.Join(t.TempDir(), "empty")
+	require.NoError(t, os.WriteFile(emptyPath, nil, 0644))
+	reader, err := OpenBlob(emptyPath, true)
+	require.NoError(t, err)
+	_, ok := reader.(*fileBlobReader)
+	require.True(t, ok)
+	require.NoError(t, reader.Close())
+
+	_, err = OpenBlob(filepath.Join(t.TempDir(), "not-found"), true)
+	require.Error(t, err)
+}
+
+func benchmarkOpenBlob(b *testing.B, useMmap bool) {
+	path, data := writeTestBlob(b, 64<<20)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		reader, err := OpenBlob(path, useMmap)
+		require.NoError(b, err)
+		// Digest the content like uploading to touch all the bytes.
+		_, err = io.Copy(sha256.New(), reader)
+		require.NoError(b, err)
+		require.NoError(b, reader.Close())
+	}
+}
+
+func BenchmarkOpenBlobMmap(b *testing.B) {
+	benchmarkOpenBlob(b, true)
+}
+
+func BenchmarkOpenBlobRead(b *testing.B) {
+	benchmarkOpenBlob(b, false)
+}
@@ -0,0 +1,32 @@
+//go:build linux || darwin || freebsd
+
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package utils
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+func mmap(file *os.File, size int64) ([]byte, error) {
+	// The length of mapping is an int, which is 32-bit on some platforms.
+	if int64(int(size)) != size {
+		return nil, fmt.Errorf("size %d exceeds the mapping length limit", size)
+	}
+	data, err := unix.Mmap(int(file.Fd()), 0, int(size), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	// Hint the kernel to read ahead aggressively for the sequential upload.
+	_ = unix.Madvise(data, unix.MADV_SEQUENTIAL)
+	return data, nil
+}
+
+func munmap(data []byte) error {
+	return unix.Munmap(data)
+}
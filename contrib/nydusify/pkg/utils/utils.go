@@ -17,6 +17,7 @@ import (
 	"time"
 
 	"github.com/containerd/containerd/archive/compression"
+	"github.com/containerd/containerd/platforms"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
@@ -33,6 +34,7 @@ const defaultRetryInterval = time.Second * 2
 const (
 	PlatformArchAMD64 string = "amd64"
 	PlatformArchARM64 string = "arm64"
+	PlatformArchARM   string = "arm"
 )
 
 type FsVersion int
@@ -59,12 +61,22 @@ func GetNydusFsVersionOrDefault(annotations map[string]string, defaultVersion Fs
 }
 
 func WithRetry(op func() error) error {
+	return WithRetryAttempts(defaultRetryAttempts, nil, op)
+}
+
+// WithRetryAttempts calls op up to attempts times until it succeeds, the
+// default attempts are used if it's not positive. The error is retried only
+// if retryable accepts it, or retryable is nil, and never for the error
+// requiring to retry with plain HTTP.
+func WithRetryAttempts(attempts int, retryable func(error) bool, op func() error) error {
+	if attempts <= 0 {
+		attempts = defaultRetryAttempts
+	}
 	var err error
-	attempts := defaultRetryAttempts
 	for attempts > 0 {
 		attempts--
 		if err != nil {
-			if RetryWithHTTP(err) {
+			if RetryWithHTTP(err) || (retryable != nil && !retryable(err)) {
 				return err
 			}
 			logrus.Warnf("Retry due to error: %s", err)
@@ -109,12 +121,24 @@ func IsNydusPlatform(platform *ocispec.Platform) bool {
 }
 
 func IsSupportedArch(arch string) bool {
-	if arch != PlatformArchAMD64 && arch != PlatformArchARM64 {
+	if arch != PlatformArchAMD64 && arch != PlatformArchARM64 && arch != PlatformArchARM {
 		return false
 	}
 	return true
 }
 
+// MatchPlatformVariant checks if the variant of platform is variant, which
+// are compared in normalized form, e.g. `v8` matches the empty variant of
+// arm64, and `v7` matches the empty variant of arm. Empty variant matches
+// any platform.
+func MatchPlatformVariant(platform *ocispec.Platform, variant string) bool {
+	if variant == "" {
+		return true
+	}
+	expected := platforms.Normalize(ocispec.Platform{OS: platform.OS, Architecture: platform.Architecture, Variant: variant})
+	return platforms.Normalize(*platform).Variant == expected.Variant
+}
+
 // A matched nydus image should match os/arch
 func MatchNydusPlatform(dst *ocispec.Descriptor, os, arch string) bool {
 	if dst.Platform.Architecture != arch || dst.Platform.OS != os {
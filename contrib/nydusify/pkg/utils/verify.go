@@ -0,0 +1,107 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package utils
+
+import (
+	"archive/tar"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// ErrLayerSizeMismatch is returned by VerifyLayer if the layer size differs
+// from the expected size, e.g. the download is truncated.
+var ErrLayerSizeMismatch = errors.New("layer size mismatch")
+
+// IsTransientLayerError checks if the layer error is caused by a truncated
+// or corrupt download, which may be recovered by fetching the layer again,
+// rather than a malformed or unsupported layer format.
+func IsTransientLayerError(err error) bool {
+	var corrupt flate.CorruptInputError
+	return errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, ErrLayerSizeMismatch) ||
+		errors.Is(err, gzip.ErrChecksum) ||
+		errors.Is(err, zstd.ErrCRCMismatch) ||
+		errors.As(err, &corrupt)
+}
+
+// verifiedLayerReader reads the layer spooled in a temporary file, the file
+// is removed on closing.
+type verifiedLayerReader struct {
+	*os.File
+}
+
+func (reader *verifiedLayerReader) Close() error {
+	defer os.Remove(reader.Name())
+	return reader.File.Close()
+}
+
+// VerifyLayer spools the layer stream into a temporary file under tmpDir, and
+// verifies that the layer size equals the expected size (skipped if it's not
+// positive) and the decompressed stream is a well-formed tar, it returns the
+// reader of the verified layer, so that a malformed layer fails cleanly before
+// touching the filesystem. It complements rather than replaces the digest
+// verification.
+func VerifyLayer(reader io.Reader, mediaType string, size int64, tmpDir string) (io.ReadCloser, error) {
+	file, err := os.CreateTemp(tmpDir, "nydusify-layer-")
+	if err != nil {
+		return nil, errors.Wrap(err, "create temp file for layer")
+	}
+	layer := &verifiedLayerReader{File: file}
+
+	if err := verifyLayer(file, reader, mediaType, size); err != nil {
+		layer.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		layer.Close()
+		return nil, errors.Wrap(err, "seek layer")
+	}
+
+	return layer, nil
+}
+
+func verifyLayer(file *os.File, reader io.Reader, mediaType string, size int64) error {
+	written, err := io.Copy(file, reader)
+	if err != nil {
+		return errors.Wrap(err, "read layer")
+	}
+	if size > 0 && written != size {
+		return errors.Wrapf(ErrLayerSizeMismatch, "layer size %d mismatches the expected size %d", written, size)
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return errors.Wrap(err, "seek layer")
+	}
+	decompressed, err := DecompressLayer(file, mediaType)
+	if err != nil {
+		return errors.Wrap(err, "decompress layer")
+	}
+	defer decompressed.Close()
+
+	return VerifyTar(decompressed)
+}
+
+// VerifyTar reads the whole tar stream to check that all the entry headers
+// and contents are complete and well-formed.
+func VerifyTar(reader io.Reader) error {
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "invalid tar header")
+		}
+		if _, err := io.Copy(io.Discard, tr); err != nil {
+			return errors.Wrapf(err, "invalid tar entry %s", hdr.Name)
+		}
+	}
+}
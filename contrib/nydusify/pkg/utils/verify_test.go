@@ -0,0 +1,90 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package utils
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/archive/compression"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func makeTestTar(t *testing.T) []byte {
+	var buf bytes.Buffer
+	writer := tar.NewWriter(&buf)
+	for _, name := range []string{"a.txt", "b.txt"} {
+		data := bytes.Repeat([]byte(name), 1024)
+		require.NoError(t, writer.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg}))
+		_, err := writer.Write(data)
+		require.NoError(t, err)
+	}
+	require.NoError(t, writer.Close())
+	return buf.Bytes()
+}
+
+func TestVerifyLayer(t *testing.T) {
+	tmpDir := t.TempDir()
+	layer := compressTestData(t, compression.Gzip, makeTestTar(t))
+
+	reader, err := VerifyLayer(bytes.NewReader(layer), ocispec.MediaTypeImageLayerGzip, int64(len(layer)), tmpDir)
+	require.NoError(t, err)
+	dst := t.TempDir()
+	require.NoError(t, UnpackLayer(context.Background(), dst, reader, ocispec.MediaTypeImageLayerGzip, false))
+	require.NoError(t, reader.Close())
+	_, err = os.Stat(filepath.Join(dst, "b.txt"))
+	require.NoError(t, err)
+
+	// Temporary files are cleaned up.
+	entries, err := os.ReadDir(tmpDir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	// Size mismatch.
+	_, err = VerifyLayer(bytes.NewReader(layer), ocispec.MediaTypeImageLayerGzip, int64(len(layer))+1, tmpDir)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "mismatches the expected size")
+	require.True(t, IsTransientLayerError(err))
+
+	entries, err = os.ReadDir(tmpDir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestVerifyLayerInvalid(t *testing.T) {
+	tarData := makeTestTar(t)
+
+	for name, tc := range map[string]struct {
+		data      []byte
+		mediaType string
+		// transient is true for the truncated or corrupt download.
+		transient bool
+	}{
+		// Truncated in the content of the first entry.
+		"truncated tar": {tarData[:1024], ocispec.MediaTypeImageLayer, true},
+		// Truncated compressed stream.
+		"truncated gzip": {compressTestData(t, compression.Gzip, tarData)[:100], ocispec.MediaTypeImageLayerGzip, true},
+		// Header with corrupted checksum.
+		"malformed header": {append(bytes.Repeat([]byte{'x'}, 512), tarData...), ocispec.MediaTypeImageLayer, false},
+		// Not a tar at all.
+		"garbage": {compressTestData(t, compression.Gzip, bytes.Repeat([]byte("garbage"), 200)), ocispec.MediaTypeImageLayerGzip, false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			_, err := VerifyLayer(bytes.NewReader(tc.data), tc.mediaType, int64(len(tc.data)), tmpDir)
+			require.Error(t, err)
+			require.Equal(t, tc.transient, IsTransientLayerError(err))
+
+			entries, err := os.ReadDir(tmpDir)
+			require.NoError(t, err)
+			require.Empty(t, entries)
+		})
+	}
+}
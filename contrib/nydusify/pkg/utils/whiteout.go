@@ -0,0 +1,125 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package utils
+
+import (
+	"archive/tar"
+	"path"
+	"strings"
+
+	"github.com/containerd/containerd/archive"
+	"github.com/pkg/errors"
+)
+
+// The policies translating the whiteouts of source layers on unpacking.
+const (
+	// WhiteoutPolicyPreserve keeps the OCI whiteout files (`.wh.<name>` and
+	// `.wh..wh..opq`) as is, they are interpreted by the builder with the
+	// `oci` whiteout spec.
+	WhiteoutPolicyPreserve = "preserve"
+	// WhiteoutPolicyOverlayfs converts the whiteout files to the overlayfs
+	// semantics, i.e. the 0/0 character devices and the opaque directories
+	// with `trusted.overlay.opaque` xattr, for the `overlayfs` whiteout spec.
+	WhiteoutPolicyOverlayfs = "overlayfs"
+	// WhiteoutPolicyError preserves the whiteout files like
+	// WhiteoutPolicyPreserve, but fails on the whiteouts interpreted
+	// differently by runtimes, see checkWhiteout.
+	WhiteoutPolicyError = "error"
+)
+
+// WhiteoutPolicies are the possible whiteout policies.
+var WhiteoutPolicies = []string{WhiteoutPolicyPreserve, WhiteoutPolicyOverlayfs, WhiteoutPolicyError}
+
+const (
+	whiteoutPrefix     = ".wh."
+	whiteoutMetaPrefix = whiteoutPrefix + whiteoutPrefix
+	whiteoutOpaqueDir  = whiteoutMetaPrefix + ".opq"
+)
+
+// WhiteoutSpec returns the whiteout spec of builder for the directory
+// unpacked by whiteout policy.
+func WhiteoutSpec(policy string) string {
+	if policy == WhiteoutPolicyOverlayfs {
+		return "overlayfs"
+	}
+	return "oci"
+}
+
+// whiteoutChecker records the entries and the whiteouts of a layer to find
+// the ambiguous whiteouts.
+type whiteoutChecker struct {
+	entries   map[string]bool
+	whiteouts map[string]bool
+}
+
+// checkWhiteout fails on the ambiguous whiteout by the header of layer:
+//   - the aufs meta files other than the opaque whiteout, e.g. `.wh..wh.plnk`,
+//     which aren't defined by the OCI image spec;
+//   - the whiteout of an entry added in the same layer, the whiteouts apply
+//     to the lower layers only by the OCI image spec, but some runtimes apply
+//     them in the order of tar.
+func (checker *whiteoutChecker) checkWhiteout(hdr *tar.Header) error {
+	name := path.Clean("/" + hdr.Name)
+	dir, base := path.Split(name)
+	if !strings.HasPrefix(base, whiteoutPrefix) {
+		if checker.whiteouts[name] {
+			return errors.Errorf("ambiguous whiteout: %s is removed and added in the same layer", name)
+		}
+		checker.entries[name] = true
+		return nil
+	}
+	if base == whiteoutOpaqueDir {
+		return nil
+	}
+	if strings.HasPrefix(base, whiteoutMetaPrefix) {
+		return errors.Errorf("ambiguous whiteout: aufs meta file %s isn't supported", name)
+	}
+	removed := path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))
+	if checker.entries[removed] {
+		return errors.Errorf("ambiguous whiteout: %s is added and removed in the same layer", removed)
+	}
+	checker.whiteouts[removed] = true
+	return nil
+}
+
+// whiteoutApplyOptions returns the options of archive.Apply unpacking the
+// whiteouts of layer by policy.
+func whiteoutApplyOptions(policy string) ([]archive.ApplyOpt, error) {
+	switch policy {
+	case WhiteoutPolicyPreserve, "":
+		return []archive.ApplyOpt{
+			archive.WithConvertWhiteout(func(_ *tar.Header, _ string) (bool, error) {
+				return true, nil
+			}),
+			archive.WithFilter(deviceNodeFilter),
+		}, nil
+	case WhiteoutPolicyOverlayfs:
+		return []archive.ApplyOpt{
+			archive.WithConvertWhiteout(func(hdr *tar.Header, file string) (bool, error) {
+				base := path.Base(file)
+				if strings.HasPrefix(base, whiteoutPrefix) && base != whiteoutOpaqueDir && !canCreateDeviceNode() {
+					return false, errors.Errorf("can't create overlayfs whiteout for %s without root privileges, please run nydusify as root outside of user namespace", hdr.Name)
+				}
+				return archive.OverlayConvertWhiteout(hdr, file)
+			}),
+			archive.WithFilter(deviceNodeFilter),
+		}, nil
+	case WhiteoutPolicyError:
+		checker := &whiteoutChecker{entries: map[string]bool{}, whiteouts: map[string]bool{}}
+		return []archive.ApplyOpt{
+			archive.WithConvertWhiteout(func(_ *tar.Header, _ string) (bool, error) {
+				return true, nil
+			}),
+			archive.WithFilter(func(hdr *tar.Header) (bool, error) {
+				if err := checker.checkWhiteout(hdr); err != nil {
+					return false, err
+				}
+				return deviceNodeFilter(hdr)
+			}),
+		}, nil
+	default:
+		return nil, errors.Errorf("invalid whiteout policy %s, possible values: %s", policy, strings.Join(WhiteoutPolicies, ", "))
+	}
+}
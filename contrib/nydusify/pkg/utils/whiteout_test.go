@@ -0,0 +1,104 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package utils
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func writeWhiteoutLayer(t *testing.T, hdrs []*tar.Header) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range hdrs {
+		if hdr.Typeflag == 0 {
+			hdr.Typeflag = tar.TypeReg
+		}
+		if hdr.Mode == 0 {
+			hdr.Mode = 0644
+		}
+		require.NoError(t, tw.WriteHeader(hdr))
+	}
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+func TestUnpackLayerWithWhiteoutPolicy(t *testing.T) {
+	// The layer replaces the content of opaque directory `etc`, and removes
+	// the file `usr/bin/sh`.
+	layer := writeWhiteoutLayer(t, []*tar.Header{
+		{Name: "etc/", Mode: 0755, Typeflag: tar.TypeDir},
+		{Name: "etc/.wh..wh..opq"},
+		{Name: "etc/hostname"},
+		{Name: "usr/", Mode: 0755, Typeflag: tar.TypeDir},
+		{Name: "usr/bin/", Mode: 0755, Typeflag: tar.TypeDir},
+		{Name: "usr/bin/.wh.sh"},
+	})
+
+	for _, policy := range []string{WhiteoutPolicyPreserve, WhiteoutPolicyError} {
+		dst := t.TempDir()
+		require.NoError(t, UnpackLayerWithWhiteoutPolicy(context.Background(), dst, bytes.NewReader(layer), "", policy), policy)
+		for _, name := range []string{"etc/.wh..wh..opq", "etc/hostname", "usr/bin/.wh.sh"} {
+			info, err := os.Lstat(filepath.Join(dst, name))
+			require.NoError(t, err, policy)
+			require.True(t, info.Mode().IsRegular(), policy)
+		}
+		_, err := os.Lstat(filepath.Join(dst, "usr/bin/sh"))
+		require.True(t, os.IsNotExist(err), policy)
+		require.Equal(t, "oci", WhiteoutSpec(policy))
+	}
+
+	require.Equal(t, "overlayfs", WhiteoutSpec(WhiteoutPolicyOverlayfs))
+	if canCreateDeviceNode() {
+		dst := t.TempDir()
+		require.NoError(t, UnpackLayerWithWhiteoutPolicy(context.Background(), dst, bytes.NewReader(layer), "", WhiteoutPolicyOverlayfs))
+		for _, name := range []string{"etc/.wh..wh..opq", "usr/bin/.wh.sh"} {
+			_, err := os.Lstat(filepath.Join(dst, name))
+			require.True(t, os.IsNotExist(err), name)
+		}
+		var stat unix.Stat_t
+		require.NoError(t, unix.Lstat(filepath.Join(dst, "usr/bin/sh"), &stat))
+		require.Equal(t, uint32(unix.S_IFCHR), stat.Mode&unix.S_IFMT)
+		require.Zero(t, stat.Rdev)
+		opaque := make([]byte, 1)
+		_, err := unix.Lgetxattr(filepath.Join(dst, "etc"), "trusted.overlay.opaque", opaque)
+		require.NoError(t, err)
+		require.Equal(t, "y", string(opaque))
+		_, err = os.Lstat(filepath.Join(dst, "etc/hostname"))
+		require.NoError(t, err)
+	}
+
+	// The overlayfs whiteouts fail clearly without privileges.
+	canCreate := canCreateDeviceNode
+	canCreateDeviceNode = func() bool { return false }
+	err := UnpackLayerWithWhiteoutPolicy(context.Background(), t.TempDir(), bytes.NewReader(layer), "", WhiteoutPolicyOverlayfs)
+	canCreateDeviceNode = canCreate
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "can't create overlayfs whiteout for usr/bin/.wh.sh without root privileges")
+
+	// The ambiguous whiteouts are preserved, but fail the error policy.
+	for _, hdrs := range [][]*tar.Header{
+		{{Name: "etc/hostname"}, {Name: "etc/.wh.hostname"}},
+		{{Name: "./etc/.wh.hostname"}, {Name: "etc/hostname"}},
+		{{Name: "etc/.wh..wh.plnk"}},
+	} {
+		layer := writeWhiteoutLayer(t, hdrs)
+		require.NoError(t, UnpackLayerWithWhiteoutPolicy(context.Background(), t.TempDir(), bytes.NewReader(layer), "", WhiteoutPolicyPreserve))
+		err := UnpackLayerWithWhiteoutPolicy(context.Background(), t.TempDir(), bytes.NewReader(layer), "", WhiteoutPolicyError)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "ambiguous whiteout")
+	}
+
+	err = UnpackLayerWithWhiteoutPolicy(context.Background(), t.TempDir(), bytes.NewReader(layer), "", "aufs")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid whiteout policy aufs")
+}
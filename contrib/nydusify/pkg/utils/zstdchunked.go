@@ -0,0 +1,41 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package utils
+
+import (
+	"github.com/containerd/containerd/archive/compression"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// LayerAnnotationZstdChunkedManifestChecksum and
+	// LayerAnnotationZstdChunkedManifestPosition are set by containers/storage
+	// on the layers compressed in zstd:chunked format.
+	LayerAnnotationZstdChunkedManifestChecksum = "io.github.containers.zstd-chunked.manifest-checksum"
+	LayerAnnotationZstdChunkedManifestPosition = "io.github.containers.zstd-chunked.manifest-position"
+)
+
+// IsZstdChunkedLayer reports whether the layer is compressed in zstd:chunked
+// format, the layer is a valid zstd stream with the TOC and footer stored in
+// skippable frames.
+func IsZstdChunkedLayer(desc ocispec.Descriptor) bool {
+	if desc.Annotations == nil {
+		return false
+	}
+	_, ok := desc.Annotations[LayerAnnotationZstdChunkedManifestChecksum]
+	return ok
+}
+
+// LayerMediaType returns the media type used to decompress the layer, the
+// zstd:chunked layers are always decompressed as zstd, with the skippable
+// frames of TOC ignored, no matter what media type they declare.
+func LayerMediaType(desc ocispec.Descriptor) string {
+	if IsZstdChunkedLayer(desc) {
+		if comp, ok := LayerCompression(desc.MediaType); !ok || comp != compression.Zstd {
+			return ocispec.MediaTypeImageLayerZstd
+		}
+	}
+	return desc.MediaType
+}
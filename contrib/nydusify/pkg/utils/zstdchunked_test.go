@@ -0,0 +1,103 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/archive/compression"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// skippableFrame wraps the data in a zstd skippable frame.
+func skippableFrame(data []byte) []byte {
+	frame := make([]byte, 8, 8+len(data))
+	binary.LittleEndian.PutUint32(frame[0:4], 0x184D2A50)
+	binary.LittleEndian.PutUint32(frame[4:8], uint32(len(data)))
+	return append(frame, data...)
+}
+
+// makeZstdChunkedLayer builds a layer like containers/storage does: the tar
+// stream is split into multiple zstd frames, followed by the zstd compressed
+// TOC and the footer, both are stored in skippable frames.
+func makeZstdChunkedLayer(t *testing.T, tarData []byte) ([]byte, ocispec.Descriptor) {
+	var buf bytes.Buffer
+	for offset := 0; offset < len(tarData); offset += 1024 {
+		end := offset + 1024
+		if end > len(tarData) {
+			end = len(tarData)
+		}
+		buf.Write(compressTestData(t, compression.Zstd, tarData[offset:end]))
+	}
+
+	toc := compressTestData(t, compression.Zstd, []byte(`{"version":1,"entries":[{"type":"reg","name":"a.txt"},{"type":"reg","name":"b.txt"}]}`))
+	tocOffset := buf.Len() + 8
+	buf.Write(skippableFrame(toc))
+
+	footer := make([]byte, 40)
+	binary.LittleEndian.PutUint64(footer[0:8], uint64(tocOffset))
+	binary.LittleEndian.PutUint64(footer[8:16], uint64(len(toc)))
+	binary.LittleEndian.PutUint64(footer[24:32], 1)
+	copy(footer[32:40], "GNUlInUx")
+	buf.Write(skippableFrame(footer))
+
+	layer := buf.Bytes()
+	return layer, ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerZstd,
+		Digest:    digest.FromBytes(layer),
+		Size:      int64(len(layer)),
+		Annotations: map[string]string{
+			LayerAnnotationZstdChunkedManifestChecksum: digest.FromBytes(toc).String(),
+			LayerAnnotationZstdChunkedManifestPosition: fmt.Sprintf("%d:%d:%d:1", tocOffset, len(toc), 0),
+		},
+	}
+}
+
+func TestZstdChunkedLayer(t *testing.T) {
+	tarData := makeTestTar(t)
+	layer, desc := makeZstdChunkedLayer(t, tarData)
+	require.True(t, IsZstdChunkedLayer(desc))
+	require.False(t, IsZstdChunkedLayer(ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerZstd}))
+
+	// The TOC and footer frames are skipped on decompression.
+	reader, err := DecompressLayer(bytes.NewReader(layer), LayerMediaType(desc))
+	require.NoError(t, err)
+	data, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+	require.Equal(t, tarData, data)
+
+	detected, err := compression.DecompressStream(bytes.NewReader(layer))
+	require.NoError(t, err)
+	data, err = io.ReadAll(detected)
+	require.NoError(t, err)
+	require.NoError(t, detected.Close())
+	require.Equal(t, tarData, data)
+
+	// The zstd:chunked layer declaring the media type of other compression
+	// is still decompressed as zstd.
+	desc.MediaType = ocispec.MediaTypeImageLayerGzip
+	require.Equal(t, ocispec.MediaTypeImageLayerZstd, LayerMediaType(desc))
+
+	verified, err := VerifyLayer(bytes.NewReader(layer), LayerMediaType(desc), desc.Size, t.TempDir())
+	require.NoError(t, err)
+	dst := t.TempDir()
+	require.NoError(t, UnpackLayer(context.Background(), dst, verified, LayerMediaType(desc), false))
+	require.NoError(t, verified.Close())
+	for _, name := range []string{"a.txt", "b.txt"} {
+		data, err := os.ReadFile(filepath.Join(dst, name))
+		require.NoError(t, err)
+		require.Equal(t, bytes.Repeat([]byte(name), 1024), data)
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package viewer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/backend"
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/checker/tool"
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/parser"
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/utils"
+)
+
+// blobOpener opens the nydus blob specified by blob ID for reading.
+type blobOpener func(blobID string) (io.ReadCloser, error)
+
+// ReadFile reads the contents of the regular file specified by path from
+// the Nydus image without mounting it, the chunks of file are located by
+// the bootstrap and only they are read from the data blobs in registry or
+// storage backend.
+func (fsViewer *FsViewer) ReadFile(ctx context.Context, path string) ([]byte, error) {
+	data, err := fsViewer.readFile(ctx, path)
+	if err != nil {
+		if utils.RetryWithHTTP(err) {
+			fsViewer.Parser.Remote.MaybeWithHTTP(err)
+			return fsViewer.readFile(ctx, path)
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+func (fsViewer *FsViewer) readFile(ctx context.Context, path string) ([]byte, error) {
+	if fsViewer.NydusImagePath == "" {
+		return nil, errors.New("missing nydus-image binary path")
+	}
+
+	targetParsed, err := fsViewer.Parser.Parse(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse image reference")
+	}
+	if targetParsed.NydusImage == nil {
+		return nil, errors.Errorf("not a Nydus image: %s", fsViewer.Target)
+	}
+	if err := fsViewer.PullBootstrap(ctx, targetParsed); err != nil {
+		return nil, errors.Wrap(err, "failed to pull Nydus image bootstrap")
+	}
+	defer os.RemoveAll(fsViewer.WorkDir)
+
+	inspector := tool.NewInspector(fsViewer.NydusImagePath)
+	info, err := inspector.StatFile(fsViewer.NydusdConfig.BootstrapPath, path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to stat file in bootstrap")
+	}
+
+	open, err := fsViewer.blobOpener(ctx, targetParsed.NydusImage)
+	if err != nil {
+		return nil, err
+	}
+
+	return readChunks(info, open)
+}
+
+// blobOpener reads the blobs from the layers of nydus image for registry
+// backend, or from the storage backend of viewer.
+func (fsViewer *FsViewer) blobOpener(ctx context.Context, image *parser.Image) (blobOpener, error) {
+	if fsViewer.BackendType == "" || fsViewer.BackendType == "registry" {
+		return func(blobID string) (io.ReadCloser, error) {
+			blobDigest := digest.NewDigestFromEncoded(digest.SHA256, blobID)
+			for _, layer := range image.Manifest.Layers {
+				if layer.Digest == blobDigest {
+					return fsViewer.Parser.Remote.Pull(ctx, layer, true)
+				}
+			}
+			return fsViewer.Parser.Remote.Pull(ctx, ocispec.Descriptor{
+				MediaType: utils.MediaTypeNydusBlob,
+				Digest:    blobDigest,
+			}, true)
+		}, nil
+	}
+
+	blobBackend, err := backend.NewBackend(fsViewer.BackendType, []byte(fsViewer.BackendConfig), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to init storage backend")
+	}
+	return blobBackend.Reader, nil
+}
+
+// readChunks reassembles the file data from its chunks, the blobs are read
+// sequentially once, skipping the data not belonging to the file.
+func readChunks(info *tool.FileInfo, open blobOpener) ([]byte, error) {
+	data := make([]byte, info.Size)
+	chunksByBlob := map[string][]tool.ChunkInfo{}
+	for _, chunk := range info.Chunks {
+		if chunk.FileOffset+chunk.DecompressedSize > info.Size {
+			return nil, fmt.Errorf("chunk at file offset %d exceeds file size %d", chunk.FileOffset, info.Size)
+		}
+		chunksByBlob[chunk.BlobID] = append(chunksByBlob[chunk.BlobID], chunk)
+	}
+
+	for blobID, chunks := range chunksByBlob {
+		compressor, ok := info.Compressors[blobID]
+		if !ok {
+			return nil, fmt.Errorf("not found blob %s in bootstrap", blobID)
+		}
+		if err := readBlobChunks(data, blobID, compressor, chunks, open); err != nil {
+			return nil, errors.Wrapf(err, "read chunks from blob %s", blobID)
+		}
+	}
+
+	return data, nil
+}
+
+func readBlobChunks(data []byte, blobID, compressor string, chunks []tool.ChunkInfo, open blobOpener) error {
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].CompressedOffset < chunks[j].CompressedOffset
+	})
+
+	reader, err := open(blobID)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	var offset uint64
+	var last *tool.ChunkInfo
+	var lastData []byte
+	for idx := range chunks {
+		chunk := &chunks[idx]
+		// The file may contain the same chunk more than once.
+		if last != nil && last.CompressedOffset == chunk.CompressedOffset {
+			copy(data[chunk.FileOffset:], lastData)
+			continue
+		}
+		if chunk.CompressedOffset < offset {
+			return fmt.Errorf("chunk at offset %d overlaps with previous chunk", chunk.CompressedOffset)
+		}
+		if _, err := io.CopyN(io.Discard, reader, int64(chunk.CompressedOffset-offset)); err != nil {
+			return errors.Wrapf(err, "seek to offset %d", chunk.CompressedOffset)
+		}
+		compressed := make([]byte, chunk.CompressedSize)
+		if _, err := io.ReadFull(reader, compressed); err != nil {
+			return errors.Wrapf(err, "read chunk at offset %d", chunk.CompressedOffset)
+		}
+		offset = chunk.CompressedOffset + chunk.CompressedSize
+
+		decompressed, err := decompressChunk(compressor, compressed, chunk.DecompressedSize)
+		if err != nil {
+			return errors.Wrapf(err, "decompress chunk at offset %d", chunk.CompressedOffset)
+		}
+		copy(data[chunk.FileOffset:], decompressed)
+		last, lastData = chunk, decompressed
+	}
+
+	return nil
+}
+
+// decompressChunk decompresses the chunk by the compressor name displayed
+// by `nydus-image inspect`, the chunk not smaller after compression is
+// stored as is by builder.
+func decompressChunk(compressor string, compressed []byte, size uint64) ([]byte, error) {
+	if uint64(len(compressed)) == size {
+		return compressed, nil
+	}
+
+	var decompressed []byte
+	switch strings.ToLower(compressor) {
+	case "zstd":
+		decoder, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer decoder.Close()
+		if decompressed, err = decoder.DecodeAll(compressed, make([]byte, 0, size)); err != nil {
+			return nil, err
+		}
+	case "gzip":
+		reader, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return nil, err
+		}
+		if decompressed, err = io.ReadAll(reader); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported compressor %s", compressor)
+	}
+
+	if uint64(len(decompressed)) != size {
+		return nil, fmt.Errorf("decompressed size %d doesn't match %d", len(decompressed), size)
+	}
+	return decompressed, nil
+}
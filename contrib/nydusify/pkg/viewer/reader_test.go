@@ -0,0 +1,131 @@
+// Copyright 2023 Nydus Developers. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package viewer
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/nydus/contrib/nydusify/pkg/checker/tool"
+)
+
+func buildTar(t *testing.T, files map[string][]byte) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for name, data := range files {
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+			Size:     int64(len(data)),
+		}))
+		_, err := tw.Write(data)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	return buf
+}
+
+func readTarFile(t *testing.T, reader io.Reader, name string) []byte {
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		require.NoError(t, err)
+		if hdr.Name == name {
+			data, err := io.ReadAll(tr)
+			require.NoError(t, err)
+			return data
+		}
+	}
+}
+
+// buildBlob builds a zstd compressed nydus blob of the file data split into
+// chunks of chunkSize, the chunks of the same data are deduplicated and the
+// incompressible chunks are stored as is.
+func buildBlob(t *testing.T, blobID string, data []byte, chunkSize int) ([]byte, []tool.ChunkInfo) {
+	encoder, err := zstd.NewWriter(nil)
+	require.NoError(t, err)
+	defer encoder.Close()
+
+	blob := new(bytes.Buffer)
+	// Unrelated data of other files in the blob.
+	blob.WriteString("other-file-data")
+	var chunks []tool.ChunkInfo
+	existing := map[string]tool.ChunkInfo{}
+	for offset := 0; offset < len(data); offset += chunkSize {
+		end := offset + chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		raw := data[offset:end]
+		if chunk, ok := existing[string(raw)]; ok {
+			chunk.FileOffset = uint64(offset)
+			chunks = append(chunks, chunk)
+			continue
+		}
+		compressed := encoder.EncodeAll(raw, nil)
+		if len(compressed) >= len(raw) {
+			compressed = raw
+		}
+		chunk := tool.ChunkInfo{
+			BlobID:           blobID,
+			FileOffset:       uint64(offset),
+			CompressedOffset: uint64(blob.Len()),
+			CompressedSize:   uint64(len(compressed)),
+			DecompressedSize: uint64(len(raw)),
+		}
+		blob.Write(compressed)
+		existing[string(raw)] = chunk
+		chunks = append(chunks, chunk)
+	}
+	return blob.Bytes(), chunks
+}
+
+func TestReadChunks(t *testing.T) {
+	random := make([]byte, 1<<16)
+	_, err := rand.Read(random)
+	require.NoError(t, err)
+	repeated := bytes.Repeat([]byte("nydus-chunk-data"), 1<<12)
+	// Compressible, duplicated and incompressible chunks.
+	source := append(append(append([]byte{}, repeated...), repeated...), random...)
+	source = append(source, []byte("tail")...)
+	layer := buildTar(t, map[string][]byte{"usr/lib/large": source}).Bytes()
+	expected := readTarFile(t, bytes.NewReader(layer), "usr/lib/large")
+
+	blob, chunks := buildBlob(t, "blob-1", expected, 1<<16)
+	require.Len(t, chunks, 4)
+	require.Equal(t, chunks[0].CompressedOffset, chunks[1].CompressedOffset)
+
+	info := &tool.FileInfo{
+		Size:        uint64(len(expected)),
+		Chunks:      chunks,
+		Compressors: map[string]string{"blob-1": "Zstd"},
+	}
+	opened := 0
+	data, err := readChunks(info, func(blobID string) (io.ReadCloser, error) {
+		require.Equal(t, "blob-1", blobID)
+		opened++
+		return io.NopCloser(bytes.NewReader(blob)), nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, expected, data)
+	require.Equal(t, 1, opened)
+
+	info.Compressors["blob-1"] = "Lz4Block"
+	_, err = readChunks(info, func(string) (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(blob)), nil
+	})
+	require.ErrorContains(t, err, "unsupported compressor Lz4Block")
+
+	info.Compressors = map[string]string{}
+	_, err = readChunks(info, nil)
+	require.ErrorContains(t, err, "not found blob blob-1")
+}
@@ -31,12 +31,15 @@ type Opt struct {
 	Target         string
 	TargetInsecure bool
 
-	MountPath     string
-	NydusdPath    string
-	BackendType   string
-	BackendConfig string
-	ExpectedArch  string
-	FsVersion     string
+	MountPath      string
+	NydusdPath     string
+	NydusImagePath string
+	BackendType    string
+	BackendConfig  string
+	ExpectedArch   string
+	// ExpectedVariant selects the variant of ExpectedArch, e.g. `v7` of arm.
+	ExpectedVariant string
+	FsVersion       string
 }
 
 // fsViewer provides complete view of file system in nydus image
@@ -59,6 +62,7 @@ func New(opt Opt) (*FsViewer, error) {
 	if targetParser == nil {
 		return nil, errors.Wrap(err, "failed to create image reference parser")
 	}
+	targetParser.SetVariant(opt.ExpectedVariant)
 
 	mode := "cached"
 
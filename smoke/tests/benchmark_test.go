@@ -120,7 +120,13 @@ func (b *BenchmarkTestSuite) prepareImage(t *testing.T, ctx *tool.Context, image
 		t.Fatalf("can't read convert metric file")
 		return 0, 0
 	}
-	var convertMetirc map[string]int64
+	// Only the flat metric fields are read, which are kept in the
+	// versioned output of new nydusify.
+	var convertMetirc struct {
+		SourceImageSize   int64
+		TargetImageSize   int64
+		ConversionElapsed int64
+	}
 	err = json.Unmarshal(metricData, &convertMetirc)
 	if err != nil {
 		t.Fatalf("can't parsing convert metric file")
@@ -128,10 +134,10 @@ func (b *BenchmarkTestSuite) prepareImage(t *testing.T, ctx *tool.Context, image
 	}
 	if b.snapshotter == "nydus" {
 		b.testImage = target
-		return convertMetirc["TargetImageSize"], convertMetirc["ConversionElapsed"]
+		return convertMetirc.TargetImageSize, convertMetirc.ConversionElapsed
 	}
 	b.testImage = source
-	return convertMetirc["SourceImageSize"], 0
+	return convertMetirc.SourceImageSize, 0
 }
 
 func (b *BenchmarkTestSuite) dumpMetric() {
@@ -7,11 +7,13 @@ package tests
 import (
 	"fmt"
 	"path/filepath"
+	"regexp"
 	"testing"
 
 	"github.com/dragonflyoss/nydus/smoke/tests/tool"
 	"github.com/dragonflyoss/nydus/smoke/tests/tool/test"
 	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
 )
 
 const (
@@ -35,6 +37,7 @@ func (i *ImageTestSuite) TestConvertImages() test.Generator {
 		Dimension(paramZran, []interface{}{false, true}).
 		Dimension(paramBatch, []interface{}{"0", "0x100000"}).
 		Dimension(paramEncrypt, []interface{}{false, true}).
+		Dimension(paramChunkSize, []interface{}{"0x100000", "0x40000"}).
 		Skip(
 			func(param *tool.DescartesItem) bool {
 				// Zran and Batch not work with rafs v5.
@@ -60,6 +63,7 @@ func (i *ImageTestSuite) TestConvertImages() test.Generator {
 		ctx.Build.OCIRef = scenario.GetBool(paramZran)
 		ctx.Build.BatchSize = scenario.GetString(paramBatch)
 		ctx.Build.Encrypt = scenario.GetBool(paramEncrypt)
+		ctx.Build.ChunkSize = scenario.GetString(paramChunkSize)
 
 		image := i.prepareImage(i.T, scenario.GetString(paramImage))
 		return scenario.Str(), func(t *testing.T) {
@@ -90,6 +94,11 @@ func (i *ImageTestSuite) TestConvertAndCopyImage(t *testing.T, ctx tool.Context,
 		enableEncrypt = "--encrypt"
 	}
 
+	chunkSize := ""
+	if ctx.Build.ChunkSize != "" && !ctx.Binary.NydusifyNotSupportCompressor {
+		chunkSize = "--chunk-size " + ctx.Build.ChunkSize
+	}
+
 	target := fmt.Sprintf("%s-nydus-%s", source, uuid.NewString())
 	fsVersion := fmt.Sprintf("--fs-version %s", ctx.Build.FSVersion)
 	logLevel := "--log-level warn"
@@ -104,8 +113,8 @@ func (i *ImageTestSuite) TestConvertAndCopyImage(t *testing.T, ctx tool.Context,
 
 	// Convert image
 	convertCmd := fmt.Sprintf(
-		"%s %s convert --source %s --target %s %s %s %s %s --nydus-image %s --work-dir %s %s",
-		ctx.Binary.Nydusify, logLevel, source, target, fsVersion, enableOCIRef, enableBatchSize, enableEncrypt, ctx.Binary.Builder, ctx.Env.WorkDir, compressor,
+		"%s %s convert --source %s --target %s %s %s %s %s %s --nydus-image %s --work-dir %s %s",
+		ctx.Binary.Nydusify, logLevel, source, target, fsVersion, enableOCIRef, enableBatchSize, enableEncrypt, chunkSize, ctx.Binary.Builder, ctx.Env.WorkDir, compressor,
 	)
 	tool.RunWithoutOutput(t, convertCmd)
 
@@ -120,6 +129,15 @@ func (i *ImageTestSuite) TestConvertAndCopyImage(t *testing.T, ctx tool.Context,
 	)
 	tool.RunWithoutOutput(t, checkCmd)
 
+	// The chunk size of zran blobs is decided by the gzip source layers.
+	if chunkSize != "" && !ctx.Build.OCIRef {
+		chunkSizes, _ := inspectBlobs(t, ctx, filepath.Join(ctx.Env.WorkDir, "check", "nydus_bootstrap"))
+		require.NotEmpty(t, chunkSizes)
+		for _, size := range chunkSizes {
+			require.Equal(t, ctx.Build.ChunkSize, size)
+		}
+	}
+
 	if !testCopy {
 		return
 	}
@@ -140,6 +158,65 @@ func (i *ImageTestSuite) TestConvertAndCopyImage(t *testing.T, ctx tool.Context,
 	tool.RunWithoutOutput(t, checkCmd)
 }
 
+// TestConvertWithChunkSizes converts the same image with different chunk
+// sizes, which are recorded in bootstrap and produce different blobs.
+func (i *ImageTestSuite) TestConvertWithChunkSizes(t *testing.T) {
+	ctx := tool.DefaultContext(t)
+	if ctx.Binary.NydusifyNotSupportCompressor {
+		t.Skip("nydusify doesn't support --chunk-size")
+	}
+	ctx.PrepareWorkDir(t)
+	defer ctx.Destroy(t)
+
+	source := i.prepareImage(t, "nginx:latest")
+	blobs := map[string][]string{}
+	for _, chunkSize := range []string{"0x100000", "0x40000"} {
+		target := fmt.Sprintf("%s-nydus-%s", source, uuid.NewString())
+		workDir := filepath.Join(ctx.Env.WorkDir, chunkSize)
+		convertCmd := fmt.Sprintf(
+			"%s --log-level warn convert --source %s --target %s --fs-version %s --chunk-size %s --nydus-image %s --work-dir %s",
+			ctx.Binary.Nydusify, source, target, ctx.Build.FSVersion, chunkSize, ctx.Binary.Builder, workDir,
+		)
+		tool.RunWithoutOutput(t, convertCmd)
+
+		checkCmd := fmt.Sprintf(
+			"%s --log-level warn check --source %s --target %s --nydus-image %s --nydusd %s --work-dir %s",
+			ctx.Binary.Nydusify, source, target, ctx.Binary.Builder, ctx.Binary.Nydusd, filepath.Join(workDir, "check"),
+		)
+		tool.RunWithoutOutput(t, checkCmd)
+
+		chunkSizes, blobIDs := inspectBlobs(t, *ctx, filepath.Join(workDir, "check", "nydus_bootstrap"))
+		require.NotEmpty(t, blobIDs)
+		for _, size := range chunkSizes {
+			require.Equal(t, chunkSize, size)
+		}
+		blobs[chunkSize] = blobIDs
+	}
+
+	require.NotEqual(t, blobs["0x100000"], blobs["0x40000"])
+}
+
+var (
+	blobIDPattern    = regexp.MustCompile(`(?m)^Blob ID:\s+(\S+)`)
+	chunkSizePattern = regexp.MustCompile(`(?m)^Chunk Size:\s+(0x[0-9a-f]+)`)
+)
+
+// inspectBlobs returns the chunk sizes and IDs of blobs in the blob table of
+// bootstrap by `nydus-image inspect`.
+func inspectBlobs(t *testing.T, ctx tool.Context, bootstrap string) ([]string, []string) {
+	output, err := tool.RunWithCombinedOutput(fmt.Sprintf("printf 'blobs\\nexit\\n' | %s inspect %s", ctx.Binary.Builder, bootstrap))
+	require.NoError(t, err, output)
+
+	var chunkSizes, blobIDs []string
+	for _, match := range chunkSizePattern.FindAllStringSubmatch(output, -1) {
+		chunkSizes = append(chunkSizes, match[1])
+	}
+	for _, match := range blobIDPattern.FindAllStringSubmatch(output, -1) {
+		blobIDs = append(blobIDs, match[1])
+	}
+	return chunkSizes, blobIDs
+}
+
 func (i *ImageTestSuite) prepareImage(t *testing.T, image string) string {
 	if i.preparedImages == nil {
 		i.preparedImages = make(map[string]string)